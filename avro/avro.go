@@ -0,0 +1,513 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package avro writes Avro object container files
+// (https://avro.apache.org/docs/1.11.1/specification/#object-container-files)
+// of records, without depending on an Avro library. The files can be read by
+// any Avro implementation, such as Kafka Connect, Spark, BigQuery or DuckDB.
+//
+// Only what is needed to write files is supported: schemas are built in Go
+// rather than parsed, named types are always defined inline rather than
+// referred to by name, and the only codecs are null and deflate.
+package avro
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+)
+
+// Schema types.
+const (
+	Null    = "null"
+	Boolean = "boolean"
+	Int     = "int"
+	Long    = "long"
+	Float   = "float"
+	Double  = "double"
+	Bytes   = "bytes"
+	String  = "string"
+	Record  = "record"
+	Array   = "array"
+	Map     = "map"
+	// Union is not an Avro type name: unions are written as a JSON array of
+	// their branches.
+	Union = "union"
+)
+
+// Codecs with which the blocks of a file are compressed.
+const (
+	CodecNull    = "null"
+	CodecDeflate = "deflate"
+)
+
+// blockSize is the size above which a block of records is written to the file,
+// similar to the default sync interval of the Java implementation.
+const blockSize = 64 * 1024
+
+var nameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Schema is an Avro schema.
+type Schema struct {
+	// Type is one of the schema type constants, such as String or Record.
+	Type string
+
+	// Name, Namespace and Doc are set for records only. The full name of each
+	// record of a schema, its namespace and name, must be unique.
+	Name      string
+	Namespace string
+	Doc       string
+	Fields    []*Field
+
+	// Items is the schema of the items of an array, or the values of a map.
+	Items *Schema
+
+	// Branches are the schemas of the branches of a union.
+	Branches []*Schema
+}
+
+// Field is a field of a record.
+type Field struct {
+	Name string
+	Type *Schema
+	// Default is the JSON encoding of the default value of the field, which
+	// readers use when reading data written without the field. If nil, the
+	// field has no default.
+	Default json.RawMessage
+}
+
+// Primitive returns the schema of a primitive type, such as String.
+func Primitive(t string) *Schema {
+	return &Schema{Type: t}
+}
+
+// ArrayOf returns the schema of an array of items.
+func ArrayOf(items *Schema) *Schema {
+	return &Schema{Type: Array, Items: items}
+}
+
+// MapOf returns the schema of a map of values.
+func MapOf(values *Schema) *Schema {
+	return &Schema{Type: Map, Items: values}
+}
+
+// UnionOf returns the schema of a union of branches.
+func UnionOf(branches ...*Schema) *Schema {
+	return &Schema{Type: Union, Branches: branches}
+}
+
+// Optional returns the schema of a union of null and s, the usual way of
+// writing a field which may be missing.
+func Optional(s *Schema) *Schema {
+	return UnionOf(Primitive(Null), s)
+}
+
+// MarshalJSON returns the schema's JSON, as written to the header of files.
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	switch s.Type {
+	case Null, Boolean, Int, Long, Float, Double, Bytes, String:
+		return json.Marshal(s.Type)
+	case Union:
+		return json.Marshal(s.Branches)
+	case Array:
+		return json.Marshal(struct {
+			Type  string  `json:"type"`
+			Items *Schema `json:"items"`
+		}{Array, s.Items})
+	case Map:
+		return json.Marshal(struct {
+			Type   string  `json:"type"`
+			Values *Schema `json:"values"`
+		}{Map, s.Items})
+	case Record:
+		type field struct {
+			Name    string          `json:"name"`
+			Type    *Schema         `json:"type"`
+			Default json.RawMessage `json:"default,omitempty"`
+		}
+		fields := make([]field, len(s.Fields))
+		for i, f := range s.Fields {
+			fields[i] = field{f.Name, f.Type, f.Default}
+		}
+		return json.Marshal(struct {
+			Type      string  `json:"type"`
+			Name      string  `json:"name"`
+			Namespace string  `json:"namespace,omitempty"`
+			Doc       string  `json:"doc,omitempty"`
+			Fields    []field `json:"fields"`
+		}{Record, s.Name, s.Namespace, s.Doc, fields})
+	}
+	return nil, fmt.Errorf("unknown Avro type %q", s.Type)
+}
+
+// Validate checks the names in the schema are valid, and that unions are not
+// ambiguous.
+func (s *Schema) Validate() error {
+	return s.validate(map[string]bool{})
+}
+
+func (s *Schema) validate(records map[string]bool) error {
+	switch s.Type {
+	case Null, Boolean, Int, Long, Float, Double, Bytes, String:
+		return nil
+	case Array, Map:
+		if s.Items == nil {
+			return fmt.Errorf("%s has no item schema", s.Type)
+		}
+		return s.Items.validate(records)
+	case Union:
+		types := map[string]bool{}
+		for _, b := range s.Branches {
+			if b.Type == Union {
+				return errors.New("unions may not contain unions")
+			}
+			// Records are distinguished by name, other types by type.
+			key := b.Type
+			if b.Type == Record {
+				key = b.Namespace + "." + b.Name
+			}
+			if types[key] {
+				return fmt.Errorf("union has more than one %s branch", key)
+			}
+			types[key] = true
+			if err := b.validate(records); err != nil {
+				return err
+			}
+		}
+		return nil
+	case Record:
+		if !nameRegexp.MatchString(s.Name) {
+			return fmt.Errorf("invalid record name %q", s.Name)
+		}
+		fullName := s.Namespace + "." + s.Name
+		if records[fullName] {
+			return fmt.Errorf("record %s is defined more than once", fullName)
+		}
+		records[fullName] = true
+		fields := map[string]bool{}
+		for _, f := range s.Fields {
+			if !nameRegexp.MatchString(f.Name) {
+				return fmt.Errorf("invalid field name %q in record %s", f.Name, s.Name)
+			}
+			if fields[f.Name] {
+				return fmt.Errorf("record %s has more than one field %s", s.Name, f.Name)
+			}
+			fields[f.Name] = true
+			if err := f.Type.validate(records); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown Avro type %q", s.Type)
+}
+
+// Encode appends the binary encoding of v to b. Values are of the Go types
+// produced by encoding/json:
+//
+//   - null: nil.
+//   - boolean: bool.
+//   - int, long, float and double: float64, json.Number, or any int type.
+//   - string: string.
+//   - bytes: []byte.
+//   - record and map: map[string]any. Record fields missing from the map are
+//     written as null, or as empty arrays and maps.
+//   - array: []any.
+//   - union: a value of any of its branches, which is written as the first
+//     branch accepting it.
+func (s *Schema) Encode(b []byte, v any) ([]byte, error) {
+	switch s.Type {
+	case Null:
+		if v != nil {
+			return nil, fmt.Errorf("got %T, want null", v)
+		}
+		return b, nil
+	case Boolean:
+		bv, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("got %T, want boolean", v)
+		}
+		if bv {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case Int, Long:
+		n, ok := toLong(v)
+		if !ok || (s.Type == Int && (n < math.MinInt32 || n > math.MaxInt32)) {
+			return nil, fmt.Errorf("got %v, want %s", v, s.Type)
+		}
+		return appendLong(b, n), nil
+	case Float, Double:
+		f, ok := toDouble(v)
+		if !ok {
+			return nil, fmt.Errorf("got %v, want %s", v, s.Type)
+		}
+		if s.Type == Float {
+			return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(f))), nil
+		}
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(f)), nil
+	case String:
+		sv, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("got %T, want string", v)
+		}
+		return append(appendLong(b, int64(len(sv))), sv...), nil
+	case Bytes:
+		bv, ok := v.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("got %T, want bytes", v)
+		}
+		return append(appendLong(b, int64(len(bv))), bv...), nil
+	case Array:
+		if v == nil {
+			return append(b, 0), nil
+		}
+		items, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("got %T, want array", v)
+		}
+		if len(items) > 0 {
+			b = appendLong(b, int64(len(items)))
+			for i, item := range items {
+				var err error
+				if b, err = s.Items.Encode(b, item); err != nil {
+					return nil, fmt.Errorf("[%d]: %w", i, err)
+				}
+			}
+		}
+		return append(b, 0), nil
+	case Map:
+		if v == nil {
+			return append(b, 0), nil
+		}
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("got %T, want map", v)
+		}
+		if len(m) > 0 {
+			b = appendLong(b, int64(len(m)))
+			for k, value := range m {
+				b = append(appendLong(b, int64(len(k))), k...)
+				var err error
+				if b, err = s.Items.Encode(b, value); err != nil {
+					return nil, fmt.Errorf("%s: %w", k, err)
+				}
+			}
+		}
+		return append(b, 0), nil
+	case Union:
+		for i, branch := range s.Branches {
+			if branch.accepts(v) {
+				return branch.Encode(appendLong(b, int64(i)), v)
+			}
+		}
+		return nil, fmt.Errorf("no branch of union accepts %T", v)
+	case Record:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("got %T, want record %s", v, s.Name)
+		}
+		for _, f := range s.Fields {
+			var err error
+			if b, err = f.Type.Encode(b, m[f.Name]); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown Avro type %q", s.Type)
+}
+
+// accepts returns whether v is a value of the schema, ignoring its contents.
+func (s *Schema) accepts(v any) bool {
+	switch s.Type {
+	case Null:
+		return v == nil
+	case Boolean:
+		_, ok := v.(bool)
+		return ok
+	case Int, Long:
+		n, ok := toLong(v)
+		return ok && (s.Type == Long || (n >= math.MinInt32 && n <= math.MaxInt32))
+	case Float, Double:
+		_, ok := toDouble(v)
+		return ok
+	case String:
+		_, ok := v.(string)
+		return ok
+	case Bytes:
+		_, ok := v.([]byte)
+		return ok
+	case Array:
+		_, ok := v.([]any)
+		return ok
+	case Map, Record:
+		_, ok := v.(map[string]any)
+		return ok
+	}
+	return false
+}
+
+func toLong(v any) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+func toDouble(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// appendLong appends the zig-zag variable length encoding of n.
+func appendLong(b []byte, n int64) []byte {
+	return binary.AppendUvarint(b, uint64((n<<1)^(n>>63)))
+}
+
+// Writer writes records to an Avro object container file. It is not
+// threadsafe.
+type Writer struct {
+	w      io.Writer
+	schema *Schema
+	codec  string
+	sync   [16]byte
+
+	block []byte
+	count int64
+	err   error
+}
+
+// NewWriter writes the header of a file of values of schema, compressed with
+// codec, to w, and returns a Writer of its records.
+func NewWriter(w io.Writer, schema *Schema, codec string) (*Writer, error) {
+	if codec != CodecNull && codec != CodecDeflate {
+		return nil, fmt.Errorf("unknown Avro codec %q", codec)
+	}
+	if err := schema.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %w", err)
+	}
+	schemaJSON, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	aw := &Writer{w: w, schema: schema, codec: codec}
+	if _, err := rand.Read(aw.sync[:]); err != nil {
+		return nil, err
+	}
+
+	// The header is the magic bytes, the file metadata as a map of bytes, and
+	// the sync marker ending each block.
+	header := []byte{'O', 'b', 'j', 1}
+	header = appendLong(header, 2)
+	for _, kv := range [][2]string{{"avro.schema", string(schemaJSON)}, {"avro.codec", codec}} {
+		header = append(appendLong(header, int64(len(kv[0]))), kv[0]...)
+		header = append(appendLong(header, int64(len(kv[1]))), kv[1]...)
+	}
+	header = append(header, 0)
+	header = append(header, aw.sync[:]...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// Append adds a record to the file. The records are written to the underlying
+// writer in blocks, so Close must be called to write the last of them.
+func (aw *Writer) Append(v any) error {
+	if aw.err != nil {
+		return aw.err
+	}
+	// On error, the block is left as it was, without any part of the record.
+	b, err := aw.schema.Encode(aw.block, v)
+	if err != nil {
+		return fmt.Errorf("record does not match the Avro schema: %w", err)
+	}
+	aw.block = b
+	aw.count++
+	if len(aw.block) >= blockSize {
+		return aw.flush()
+	}
+	return nil
+}
+
+// flush writes the pending records as a block.
+func (aw *Writer) flush() error {
+	if aw.count == 0 {
+		return aw.err
+	}
+	data := aw.block
+	if aw.codec == CodecDeflate {
+		var buf bytes.Buffer
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return err
+		}
+		if err := fw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	header := appendLong(appendLong(nil, aw.count), int64(len(data)))
+	for _, b := range [][]byte{header, data, aw.sync[:]} {
+		if _, err := aw.w.Write(b); err != nil {
+			aw.err = err
+			return err
+		}
+	}
+	aw.block, aw.count = aw.block[:0], 0
+	return nil
+}
+
+// Close writes the remaining records to the underlying writer. It does not
+// close the underlying writer.
+func (aw *Writer) Close() error {
+	return aw.flush()
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package avro_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/avro"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+func patientSchema() *avro.Schema {
+	return &avro.Schema{
+		Type:      avro.Record,
+		Name:      "Patient",
+		Namespace: "fhir",
+		Fields: []*avro.Field{
+			{Name: "id", Type: avro.Primitive(avro.String)},
+			{Name: "active", Type: avro.Optional(avro.Primitive(avro.Boolean)), Default: json.RawMessage("null")},
+			{Name: "age", Type: avro.Primitive(avro.Int)},
+			{Name: "score", Type: avro.Primitive(avro.Double)},
+			{Name: "given", Type: avro.ArrayOf(avro.Primitive(avro.String))},
+			{Name: "tags", Type: avro.MapOf(avro.Primitive(avro.Long))},
+			{Name: "address", Type: avro.Optional(&avro.Schema{
+				Type:      avro.Record,
+				Name:      "Patient_address",
+				Namespace: "fhir",
+				Fields:    []*avro.Field{{Name: "city", Type: avro.Optional(avro.Primitive(avro.String))}},
+			})},
+			{Name: "photo", Type: avro.Optional(avro.Primitive(avro.Bytes))},
+		},
+	}
+}
+
+func TestWriter(t *testing.T) {
+	records := []any{
+		map[string]any{
+			"id":      "p1",
+			"active":  true,
+			"age":     json.Number("42"),
+			"score":   json.Number("0.5"),
+			"given":   []any{"Ann", "B"},
+			"tags":    map[string]any{"a": 1, "b": int64(-2)},
+			"address": map[string]any{"city": "Springfield"},
+			"photo":   []byte{1, 2},
+		},
+		// Missing optional fields, arrays and maps.
+		map[string]any{"id": "p2", "age": 7, "score": 1.0},
+	}
+	want := []any{
+		map[string]any{
+			"id":      "p1",
+			"active":  true,
+			"age":     int64(42),
+			"score":   0.5,
+			"given":   []any{"Ann", "B"},
+			"tags":    map[string]any{"a": int64(1), "b": int64(-2)},
+			"address": map[string]any{"city": "Springfield"},
+			"photo":   []byte{1, 2},
+		},
+		map[string]any{"id": "p2", "active": nil, "age": int64(7), "score": 1.0, "given": []any{}, "tags": map[string]any{}, "address": nil, "photo": nil},
+	}
+	for _, codec := range []string{avro.CodecNull, avro.CodecDeflate} {
+		t.Run(codec, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := avro.NewWriter(&buf, patientSchema(), codec)
+			if err != nil {
+				t.Fatalf("NewWriter() returned unexpected error: %v", err)
+			}
+			for _, r := range records {
+				if err := w.Append(r); err != nil {
+					t.Fatalf("Append(%v) returned unexpected error: %v", r, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() returned unexpected error: %v", err)
+			}
+
+			schema, got := testhelpers.ReadAvroFile(t, buf.Bytes())
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("ReadAvroFile() returned unexpected records (-want +got): %s", diff)
+			}
+			fields := schema.(map[string]any)["fields"].([]any)
+			if diff := cmp.Diff(map[string]any{"name": "active", "type": []any{"null", "boolean"}, "default": nil}, fields[1]); diff != "" {
+				t.Errorf("file has unexpected schema of field active (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestWriter_ManyBlocks(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := avro.NewWriter(&buf, patientSchema(), avro.CodecDeflate)
+	if err != nil {
+		t.Fatalf("NewWriter() returned unexpected error: %v", err)
+	}
+	var want []any
+	for i := 0; i < 5000; i++ {
+		r := map[string]any{"id": fmt.Sprintf("p%d", i), "age": i, "score": 0.0, "given": []any{strings.Repeat("x", i%100)}}
+		if err := w.Append(r); err != nil {
+			t.Fatalf("Append() returned unexpected error: %v", err)
+		}
+		want = append(want, map[string]any{"id": r["id"], "active": nil, "age": int64(i), "score": 0.0, "given": r["given"], "tags": map[string]any{}, "address": nil, "photo": nil})
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+	if _, got := testhelpers.ReadAvroFile(t, buf.Bytes()); !cmp.Equal(want, got) {
+		t.Errorf("ReadAvroFile() returned %d records, want %d equal to those appended", len(got), len(want))
+	}
+}
+
+func TestWriter_InvalidRecord(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := avro.NewWriter(&buf, patientSchema(), avro.CodecNull)
+	if err != nil {
+		t.Fatalf("NewWriter() returned unexpected error: %v", err)
+	}
+	for _, r := range []any{
+		"not a record",
+		map[string]any{"age": 1, "score": 1.0},
+		map[string]any{"id": "p1", "age": 1.5, "score": 1.0},
+		map[string]any{"id": "p1", "age": int64(1) << 40, "score": 1.0},
+		map[string]any{"id": "p1", "age": 1, "score": "high"},
+		map[string]any{"id": "p1", "age": 1, "score": 1.0, "given": []any{1}},
+		map[string]any{"id": "p1", "age": 1, "score": 1.0, "active": "yes"},
+	} {
+		if err := w.Append(r); err == nil {
+			t.Errorf("Append(%v) succeeded, want error", r)
+		}
+	}
+	// A valid record is still written after the invalid ones.
+	if err := w.Append(map[string]any{"id": "p1", "age": 1, "score": 1.0}); err != nil {
+		t.Fatalf("Append() returned unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+	if _, got := testhelpers.ReadAvroFile(t, buf.Bytes()); len(got) != 1 {
+		t.Errorf("ReadAvroFile() returned %d records, want 1", len(got))
+	}
+}
+
+func TestNewWriter_Invalid(t *testing.T) {
+	record := func(name string, fields ...*avro.Field) *avro.Schema {
+		return &avro.Schema{Type: avro.Record, Name: name, Fields: fields}
+	}
+	for _, tc := range []struct {
+		schema *avro.Schema
+		codec  string
+	}{
+		{schema: patientSchema(), codec: "snappy"},
+		{schema: record("my-record"), codec: avro.CodecNull},
+		{schema: record("r", &avro.Field{Name: "a.b", Type: avro.Primitive(avro.String)}), codec: avro.CodecNull},
+		{schema: record("r", &avro.Field{Name: "a", Type: avro.Primitive(avro.String)}, &avro.Field{Name: "a", Type: avro.Primitive(avro.Long)}), codec: avro.CodecNull},
+		{schema: record("r", &avro.Field{Name: "a", Type: record("r")}), codec: avro.CodecNull},
+		{schema: record("r", &avro.Field{Name: "a", Type: avro.UnionOf(avro.Primitive(avro.String), avro.Primitive(avro.String))}), codec: avro.CodecNull},
+		{schema: avro.Primitive("decimal"), codec: avro.CodecNull},
+	} {
+		if _, err := avro.NewWriter(&bytes.Buffer{}, tc.schema, tc.codec); err == nil {
+			t.Errorf("NewWriter(%+v, %q) succeeded, want error", tc.schema, tc.codec)
+		}
+	}
+}
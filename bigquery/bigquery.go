@@ -0,0 +1,306 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bigquery contains utilities for writing FHIR resources to BigQuery
+// tables, one table per FHIR resource type.
+package bigquery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	bqapi "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var bigQueryInsertCounter *metrics.Counter = metrics.NewCounter("bigquery-insert-counter", "Count of FHIR Resources inserted into BigQuery by FHIR Resource Type and Status (OK or ERROR).", "1", aggregation.Count, "FHIRResourceType", "Status")
+
+// DefaultBigQueryEndpoint represents the default BigQuery API endpoint. This
+// should be used in Config, unless in a test environment.
+const DefaultBigQueryEndpoint = "https://bigquery.googleapis.com/bigquery/v2/"
+
+// ErrorAPIServer indicates that an error was received from the BigQuery API
+// server.
+var ErrorAPIServer = errors.New("error was received from the BigQuery API server")
+
+// Config represents the BigQuery dataset FHIR resources are written to.
+type Config struct {
+	// Endpoint is the base BigQuery API endpoint. For example,
+	// "https://bigquery.googleapis.com/bigquery/v2/".
+	Endpoint string
+	// ProjectID is the GCP project the dataset belongs to.
+	ProjectID string
+	// DatasetID is the BigQuery dataset ID. The dataset must already exist.
+	DatasetID string
+}
+
+// Client writes FHIR resources to tables in a BigQuery dataset. Do not use this
+// directly, call NewClient to create a new one.
+type Client struct {
+	service *bqapi.Service
+	cfg     *Config
+}
+
+// ClientOption configures a Client created by NewClient.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	httpClient *http.Client
+}
+
+// WithHTTPClient makes the Client send requests to the BigQuery API with hc,
+// which must add any credentials required. By default the application default
+// credentials are used with DefaultBigQueryEndpoint, and no credentials with
+// other endpoints, such as test servers.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(o *clientOptions) { o.httpClient = hc }
+}
+
+// NewClient initializes and returns a new BigQuery client. An error is
+// returned if cfg does not identify a dataset. If cfg has no Endpoint,
+// DefaultBigQueryEndpoint is used.
+func NewClient(ctx context.Context, cfg *Config, opts ...ClientOption) (*Client, error) {
+	if cfg == nil || cfg.ProjectID == "" || cfg.DatasetID == "" {
+		return nil, errors.New("a BigQuery project ID and dataset ID are required")
+	}
+	o := &clientOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	cp := *cfg
+	if cp.Endpoint == "" {
+		cp.Endpoint = DefaultBigQueryEndpoint
+	}
+
+	var service *bqapi.Service
+	var err error
+	if o.httpClient != nil {
+		service, err = bqapi.NewService(ctx, option.WithHTTPClient(o.httpClient), option.WithEndpoint(cp.Endpoint))
+	} else if cp.Endpoint == DefaultBigQueryEndpoint {
+		service, err = bqapi.NewService(ctx, option.WithEndpoint(cp.Endpoint))
+	} else {
+		// When not using the default endpoint, we provide an empty http.Client so
+		// that the service does not look for credentials in the test environment.
+		service, err = bqapi.NewService(ctx, option.WithHTTPClient(&http.Client{}), option.WithEndpoint(cp.Endpoint))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Client{service: service, cfg: &cp}, nil
+}
+
+// EnsureTable creates the table for the given resource type with the schema
+// returned by Schema, if it does not already exist. The schema of an existing
+// table is not modified.
+func (c *Client) EnsureTable(ctx context.Context, resourceType cpb.ResourceTypeCode_Value) error {
+	tableName, err := TableName(resourceType)
+	if err != nil {
+		return err
+	}
+	schema, err := Schema(resourceType)
+	if err != nil {
+		return err
+	}
+	return c.EnsureNamedTable(ctx, tableName, schema)
+}
+
+// EnsureNamedTable creates the named table with the given schema, if it does
+// not already exist, for tables other than those of resource types, such as
+// the tables of SQL on FHIR views. The schema of an existing table is not
+// modified.
+func (c *Client) EnsureNamedTable(ctx context.Context, tableName string, schema *bqapi.TableSchema) error {
+	_, err := c.service.Tables.Get(c.cfg.ProjectID, c.cfg.DatasetID, tableName).Context(ctx).Do()
+	if err == nil {
+		return nil
+	}
+	if !isHTTPStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("error getting BigQuery table %s: %v %w", tableName, err, ErrorAPIServer)
+	}
+
+	table := &bqapi.Table{
+		TableReference: &bqapi.TableReference{
+			ProjectId: c.cfg.ProjectID,
+			DatasetId: c.cfg.DatasetID,
+			TableId:   tableName,
+		},
+		Schema: schema,
+	}
+	_, err = c.service.Tables.Insert(c.cfg.ProjectID, c.cfg.DatasetID, table).Context(ctx).Do()
+	// The table may have been created concurrently by another client.
+	if err != nil && !isHTTPStatus(err, http.StatusConflict) {
+		return fmt.Errorf("error creating BigQuery table %s: %v %w", tableName, err, ErrorAPIServer)
+	}
+	return nil
+}
+
+// InsertRows streams the given rows into the table for the given resource
+// type, which must already exist (see EnsureTable). If BigQuery rejects some
+// of the rows, the returned error is an *InsertError identifying them; the
+// other rows are still inserted.
+func (c *Client) InsertRows(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, rows []Row) error {
+	tableName, err := TableName(resourceType)
+	if err != nil {
+		return err
+	}
+	err = c.InsertNamedRows(ctx, tableName, rows)
+	var insertErr *InsertError
+	switch {
+	case errors.As(err, &insertErr):
+		recordInsert(ctx, resourceType, "OK", len(rows)-len(insertErr.RowErrors))
+		recordInsert(ctx, resourceType, "ERROR", len(insertErr.RowErrors))
+	case err != nil:
+		recordInsert(ctx, resourceType, "ERROR", len(rows))
+	default:
+		recordInsert(ctx, resourceType, "OK", len(rows))
+	}
+	return err
+}
+
+// InsertNamedRows streams the given rows into the named table, which must
+// already exist (see EnsureNamedTable). As with InsertRows, if BigQuery
+// rejects some of the rows, the returned error is an *InsertError identifying
+// them.
+func (c *Client) InsertNamedRows(ctx context.Context, tableName string, rows []Row) error {
+	req := &bqapi.TableDataInsertAllRequest{SkipInvalidRows: true}
+	for _, r := range rows {
+		req.Rows = append(req.Rows, &bqapi.TableDataInsertAllRequestRows{Json: r})
+	}
+
+	resp, err := c.service.Tabledata.InsertAll(c.cfg.ProjectID, c.cfg.DatasetID, tableName, req).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error inserting rows into BigQuery table %s: %v %w", tableName, err, ErrorAPIServer)
+	}
+
+	insertErr := &InsertError{Table: tableName, RowErrors: map[int]string{}}
+	for _, ie := range resp.InsertErrors {
+		var msgs []string
+		for _, e := range ie.Errors {
+			// With SkipInvalidRows, valid rows in the same request are reported
+			// as stopped, but are inserted.
+			if e.Reason == "stopped" {
+				continue
+			}
+			msg := fmt.Sprintf("%s: %s", e.Reason, e.Message)
+			if e.Location != "" {
+				msg += fmt.Sprintf(" (at %s)", e.Location)
+			}
+			msgs = append(msgs, msg)
+		}
+		if len(msgs) > 0 {
+			insertErr.RowErrors[int(ie.Index)] = strings.Join(msgs, "; ")
+		}
+	}
+	if len(insertErr.RowErrors) > 0 {
+		return insertErr
+	}
+	return nil
+}
+
+// loadJobPollInterval is how often LoadJSON checks whether its load job is
+// done. It is a variable so that tests may shorten it.
+var loadJobPollInterval = 5 * time.Second
+
+// LoadJSON runs a load job appending the newline delimited JSON files at the
+// given GCS URIs, which may contain wildcards, to the named table, and waits
+// for it to finish. The table is created if it does not exist, with a schema
+// detected from the data.
+func (c *Client) LoadJSON(ctx context.Context, table string, sourceURIs []string) error {
+	job := &bqapi.Job{
+		Configuration: &bqapi.JobConfiguration{
+			Load: &bqapi.JobConfigurationLoad{
+				DestinationTable: &bqapi.TableReference{
+					ProjectId: c.cfg.ProjectID,
+					DatasetId: c.cfg.DatasetID,
+					TableId:   table,
+				},
+				SourceUris:       sourceURIs,
+				SourceFormat:     "NEWLINE_DELIMITED_JSON",
+				Autodetect:       true,
+				WriteDisposition: "WRITE_APPEND",
+			},
+		},
+	}
+	job, err := c.service.Jobs.Insert(c.cfg.ProjectID, job).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error starting BigQuery load job into table %s: %v %w", table, err, ErrorAPIServer)
+	}
+	for job.Status == nil || job.Status.State != "DONE" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(loadJobPollInterval):
+		}
+		job, err = c.service.Jobs.Get(c.cfg.ProjectID, job.JobReference.JobId).Location(job.JobReference.Location).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("error getting BigQuery load job into table %s: %v %w", table, err, ErrorAPIServer)
+		}
+	}
+	if e := job.Status.ErrorResult; e != nil {
+		return fmt.Errorf("BigQuery load job %s into table %s failed: %s: %s %w", job.JobReference.JobId, table, e.Reason, e.Message, ErrorAPIServer)
+	}
+	return nil
+}
+
+// InsertError is returned by InsertRows when BigQuery rejects some of the rows.
+type InsertError struct {
+	Table string
+	// RowErrors maps the index of each rejected row to a description of the
+	// reason it was rejected.
+	RowErrors map[int]string
+}
+
+// Error returns a string version of error information.
+func (e *InsertError) Error() string {
+	var idxs []int
+	for i := range e.RowErrors {
+		idxs = append(idxs, i)
+	}
+	sort.Ints(idxs)
+	var msgs []string
+	for _, i := range idxs {
+		msgs = append(msgs, fmt.Sprintf("row %d: %s", i, e.RowErrors[i]))
+	}
+	return fmt.Sprintf("BigQuery rejected %d rows inserted into table %s: %s", len(e.RowErrors), e.Table, strings.Join(msgs, ", "))
+}
+
+// Is returns true if this error should be considered equivalent to the target
+// error (and makes this work smoothly with errors.Is calls)
+func (e *InsertError) Is(target error) bool {
+	return target == ErrorAPIServer
+}
+
+func isHTTPStatus(err error, code int) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+func recordInsert(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, status string, n int) {
+	if n == 0 {
+		return
+	}
+	if err := bigQueryInsertCounter.Record(ctx, int64(n), resourceType.String(), status); err != nil {
+		log.Errorf("error recording bigQueryInsertCounter metric: %v", err)
+	}
+}
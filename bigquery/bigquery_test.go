@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bigquery_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/bigquery"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestEnsureTable(t *testing.T) {
+	ctx := context.Background()
+	server := testhelpers.NewBigQueryServer(t, "project", "dataset")
+	server.AddTable("Patient")
+	c, err := bigquery.NewClient(ctx, &bigquery.Config{Endpoint: server.URL(), ProjectID: "project", DatasetID: "dataset"})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+
+	for _, rt := range []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_OBSERVATION, cpb.ResourceTypeCode_OBSERVATION} {
+		if err := c.EnsureTable(ctx, rt); err != nil {
+			t.Fatalf("EnsureTable(%s) returned unexpected error: %v", rt, err)
+		}
+	}
+
+	if diff := cmp.Diff(server.Tables(), []string{"Observation", "Patient"}); diff != "" {
+		t.Errorf("EnsureTable() created unexpected tables (-got +want): %s", diff)
+	}
+	if server.Schema("Patient") != nil {
+		t.Errorf("EnsureTable() modified the existing Patient table")
+	}
+	if len(server.Schema("Observation")) == 0 {
+		t.Errorf("EnsureTable() created the Observation table without a schema")
+	}
+}
+
+func TestInsertRows(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	server := testhelpers.NewBigQueryServer(t, "project", "dataset")
+	server.AddTable("Patient")
+	server.RejectRow = func(table string, row map[string]any) string {
+		if row["id"] == "bad" {
+			return "no such field"
+		}
+		return ""
+	}
+	c, err := bigquery.NewClient(ctx, &bigquery.Config{Endpoint: server.URL(), ProjectID: "project", DatasetID: "dataset"})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+
+	rows := []bigquery.Row{{"id": "1"}, {"id": "bad"}, {"id": "2"}}
+	err = c.InsertRows(ctx, cpb.ResourceTypeCode_PATIENT, rows)
+	var insertErr *bigquery.InsertError
+	if !errors.As(err, &insertErr) {
+		t.Fatalf("InsertRows() returned error %v, want an InsertError", err)
+	}
+	if !errors.Is(err, bigquery.ErrorAPIServer) {
+		t.Errorf("InsertRows() returned error %v, want it to wrap %v", err, bigquery.ErrorAPIServer)
+	}
+	if diff := cmp.Diff(insertErr.RowErrors, map[int]string{1: "invalid: no such field"}); diff != "" {
+		t.Errorf("InsertRows() returned unexpected row errors (-got +want): %s", diff)
+	}
+	if diff := cmp.Diff(server.Rows("Patient"), []map[string]any{{"id": "1"}, {"id": "2"}}); diff != "" {
+		t.Errorf("InsertRows() inserted unexpected rows (-got +want): %s", diff)
+	}
+
+	gotCount, _, err := metrics.GetResults()
+	if err != nil {
+		t.Errorf("GetResults failed; err = %s", err)
+	}
+	wantCount := map[string]int64{"PATIENT-OK": 2, "PATIENT-ERROR": 1}
+	if diff := cmp.Diff(wantCount, gotCount["bigquery-insert-counter"].Count); diff != "" {
+		t.Errorf("GetResults() return unexpected count (-want +got): \n%s", diff)
+	}
+}
+
+func TestInsertRows_MissingTable(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	server := testhelpers.NewBigQueryServer(t, "project", "dataset")
+	c, err := bigquery.NewClient(ctx, &bigquery.Config{Endpoint: server.URL(), ProjectID: "project", DatasetID: "dataset"})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	if err := c.InsertRows(ctx, cpb.ResourceTypeCode_PATIENT, []bigquery.Row{{"id": "1"}}); !errors.Is(err, bigquery.ErrorAPIServer) {
+		t.Errorf("InsertRows() returned error %v, want %v", err, bigquery.ErrorAPIServer)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	ctx := context.Background()
+	server := testhelpers.NewBigQueryServer(t, "project", "dataset")
+	server.FailLoad = func(table string, sourceURIs []string) string {
+		if table == "bad" {
+			return "no such field"
+		}
+		return ""
+	}
+	c, err := bigquery.NewClient(ctx, &bigquery.Config{Endpoint: server.URL(), ProjectID: "project", DatasetID: "dataset"})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+
+	uris := []string{"gs://bucket/run/Patient_*.ndjson"}
+	if err := c.LoadJSON(ctx, "patients", uris); err != nil {
+		t.Errorf("LoadJSON() returned unexpected error: %v", err)
+	}
+	if err := c.LoadJSON(ctx, "bad", uris); !errors.Is(err, bigquery.ErrorAPIServer) {
+		t.Errorf("LoadJSON() of a failing job returned error %v, want %v", err, bigquery.ErrorAPIServer)
+	}
+	want := []testhelpers.LoadJob{{Table: "patients", SourceURIs: uris}, {Table: "bad", SourceURIs: uris}}
+	if diff := cmp.Diff(server.LoadJobs(), want); diff != "" {
+		t.Errorf("LoadJSON() ran unexpected load jobs (-got +want): %s", diff)
+	}
+}
+
+func TestNewClient_Invalid(t *testing.T) {
+	for _, cfg := range []*bigquery.Config{
+		nil,
+		{Endpoint: "http://localhost", DatasetID: "dataset"},
+		{Endpoint: "http://localhost", ProjectID: "project"},
+	} {
+		if _, err := bigquery.NewClient(context.Background(), cfg); err == nil {
+			t.Errorf("NewClient(%+v) returned nil error, want an error", cfg)
+		}
+	}
+}
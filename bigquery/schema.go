@@ -0,0 +1,464 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bigquery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	bqapi "google.golang.org/api/bigquery/v2"
+
+	apb "github.com/google/fhir/go/proto/google/fhir/proto/annotations_go_proto"
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// ErrorInvalidResource indicates a FHIR resource could not be converted to a
+// BigQuery row.
+var ErrorInvalidResource = errors.New("FHIR resource does not match the expected structure")
+
+// maxRecursionDepth is the number of times a FHIR data type may be nested
+// within itself in the schema, for example Identifier.assigner.identifier. This
+// matches the default recursive structure depth of the FHIR store BigQuery
+// export.
+const maxRecursionDepth = 2
+
+// maxNestingDepth is the maximum depth of nested RECORD columns supported by
+// BigQuery.
+const maxNestingDepth = 15
+
+// maxExpandedChoiceOptions is the number of options above which the complex
+// type options of a choice type are stored as JSON strings rather than RECORDs.
+// This applies to choice types which may hold any data type, such as
+// ElementDefinition.fixed[x], which would otherwise exceed the limit on the
+// number of columns in a BigQuery table.
+const maxExpandedChoiceOptions = 20
+
+const (
+	typeString  = "STRING"
+	typeBoolean = "BOOLEAN"
+	typeInteger = "INTEGER"
+	typeFloat   = "FLOAT"
+	typeRecord  = "RECORD"
+)
+
+// primitiveTypes maps FHIR primitive types which are not represented as
+// strings to the BigQuery type holding them.
+var primitiveTypes = map[protoreflect.FullName]string{
+	"google.fhir.r4.core.Boolean":     typeBoolean,
+	"google.fhir.r4.core.Integer":     typeInteger,
+	"google.fhir.r4.core.PositiveInt": typeInteger,
+	"google.fhir.r4.core.UnsignedInt": typeInteger,
+	"google.fhir.r4.core.Decimal":     typeFloat,
+}
+
+// jsonStringTypes are stored as a column holding their JSON, rather than as a
+// nested RECORD. Extensions are open ended, and contained resources could be
+// of any type, so neither can be expanded into a useful fixed schema.
+var jsonStringTypes = map[protoreflect.FullName]bool{
+	"google.fhir.r4.core.Extension":         true,
+	"google.fhir.r4.core.ContainedResource": true,
+	"google.protobuf.Any":                   true,
+}
+
+const referenceType protoreflect.FullName = "google.fhir.r4.core.Reference"
+
+// column is a node in the analytics schema of a FHIR resource.
+type column struct {
+	name     string
+	bqType   string
+	repeated bool
+	// jsonString indicates the value is stored as its JSON encoding.
+	jsonString bool
+	// reference indicates this is a Reference, for which the resource type and
+	// ID in its reference field are additionally stored in a typed ID column,
+	// for example patientId.
+	reference bool
+	// choice indicates this is a choice type, for example Observation.value[x],
+	// which has a column for each option.
+	choice bool
+
+	// Set for RECORD columns only.
+	children []*column
+	byName   map[string]*column
+	// choices maps the JSON field name of each option of a choice type, for
+	// example valueQuantity, to the RECORD column holding the choice (value)
+	// and the option column within it (quantity).
+	choices map[string]choiceOption
+}
+
+type choiceOption struct {
+	choice, option *column
+}
+
+func newRecord(name string, repeated bool) *column {
+	return &column{
+		name:     name,
+		bqType:   typeRecord,
+		repeated: repeated,
+		byName:   map[string]*column{},
+		choices:  map[string]choiceOption{},
+	}
+}
+
+func (c *column) addChild(child *column) {
+	c.children = append(c.children, child)
+	if !child.choice {
+		c.byName[child.name] = child
+		return
+	}
+	// The options of a choice type only appear in the FHIR JSON under the name
+	// of the choice suffixed with the type, for example valueQuantity.
+	for _, option := range child.children {
+		r := []rune(option.name)
+		r[0] = unicode.ToUpper(r[0])
+		c.choices[child.name+string(r)] = choiceOption{choice: child, option: option}
+	}
+}
+
+type schemaBuilder struct {
+	// seen counts the occurrences of each message type on the current path.
+	seen map[protoreflect.FullName]int
+}
+
+// buildRecord returns a RECORD column for the given message, or nil if none of
+// its fields can be included in the schema.
+func (b *schemaBuilder) buildRecord(name string, repeated bool, md protoreflect.MessageDescriptor, nesting int) *column {
+	if nesting >= maxNestingDepth || b.seen[md.FullName()] >= maxRecursionDepth {
+		return nil
+	}
+	b.seen[md.FullName()]++
+	defer func() { b.seen[md.FullName()]-- }()
+
+	rec := newRecord(name, repeated)
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if child := b.buildColumn(fields.Get(i), nesting+1); child != nil {
+			rec.addChild(child)
+		}
+	}
+	if len(rec.children) == 0 {
+		return nil
+	}
+	return rec
+}
+
+// buildColumn returns the column for the given field, or nil if it cannot be
+// included in the schema.
+func (b *schemaBuilder) buildColumn(fd protoreflect.FieldDescriptor, nesting int) *column {
+	name := fd.JSONName()
+	repeated := fd.Cardinality() == protoreflect.Repeated
+	if fd.Kind() != protoreflect.MessageKind {
+		// FHIR protos only use scalar fields for the values of primitives, which
+		// are handled by the primitive message.
+		return nil
+	}
+	md := fd.Message()
+	switch {
+	case jsonStringTypes[md.FullName()]:
+		return &column{name: name, bqType: typeString, repeated: repeated, jsonString: true}
+	case isPrimitive(md):
+		t, ok := primitiveTypes[md.FullName()]
+		if !ok {
+			t = typeString
+		}
+		return &column{name: name, bqType: t, repeated: repeated}
+	case proto.GetExtension(md.Options(), apb.E_IsChoiceType).(bool):
+		return b.buildChoice(name, md, nesting)
+	case md.FullName() == referenceType:
+		return b.buildReference(fd, nesting)
+	default:
+		return b.buildRecord(name, repeated, md, nesting)
+	}
+}
+
+// buildChoice returns a RECORD column for a choice type, for example
+// Observation.value[x], with a column for each option.
+func (b *schemaBuilder) buildChoice(name string, md protoreflect.MessageDescriptor, nesting int) *column {
+	if nesting >= maxNestingDepth {
+		return nil
+	}
+	rec := newRecord(name, false)
+	rec.choice = true
+	fields := md.Fields()
+	open := fields.Len() > maxExpandedChoiceOptions
+	for i := 0; i < fields.Len(); i++ {
+		f := fields.Get(i)
+		if open && f.Kind() == protoreflect.MessageKind && !isPrimitive(f.Message()) {
+			rec.addChild(&column{name: f.JSONName(), bqType: typeString, jsonString: true})
+			continue
+		}
+		if option := b.buildColumn(f, nesting+1); option != nil {
+			rec.addChild(option)
+		}
+	}
+	if len(rec.children) == 0 {
+		return nil
+	}
+	return rec
+}
+
+// buildReference returns a RECORD column for a Reference, with a typed ID
+// column for each resource type the field may refer to.
+func (b *schemaBuilder) buildReference(fd protoreflect.FieldDescriptor, nesting int) *column {
+	md := fd.Message()
+	rec := b.buildRecord(fd.JSONName(), fd.Cardinality() == protoreflect.Repeated, md, nesting)
+	if rec == nil {
+		return nil
+	}
+	// The oneof fields of the Reference proto are an alternative representation
+	// of the reference field of the FHIR JSON, so are replaced by it.
+	var kept []*column
+	for _, c := range rec.children {
+		if f := md.Fields().ByJSONName(c.name); f != nil && f.ContainingOneof() != nil {
+			delete(rec.byName, c.name)
+			continue
+		}
+		kept = append(kept, c)
+	}
+	rec.children = kept
+	rec.reference = true
+	rec.addChild(&column{name: "reference", bqType: typeString})
+
+	valid := map[string]bool{}
+	for _, t := range proto.GetExtension(fd.Options(), apb.E_ValidReferenceType).([]string) {
+		valid[t] = true
+	}
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		f := fields.Get(i)
+		t := proto.GetExtension(f.Options(), apb.E_ReferencedFhirType).(string)
+		if t == "" || !(valid[t] || valid["Resource"]) {
+			continue
+		}
+		rec.addChild(&column{name: referenceIDColumn(t), bqType: typeString})
+	}
+	return rec
+}
+
+func isPrimitive(md protoreflect.MessageDescriptor) bool {
+	return proto.GetExtension(md.Options(), apb.E_StructureDefinitionKind).(apb.StructureDefinitionKindValue) == apb.StructureDefinitionKindValue_KIND_PRIMITIVE_TYPE
+}
+
+// referenceIDColumn returns the name of the typed ID column for references to
+// the given resource type, for example patientId.
+func referenceIDColumn(resourceType string) string {
+	r := []rune(resourceType)
+	r[0] = unicode.ToLower(r[0])
+	return string(r) + "Id"
+}
+
+// tableFieldSchema converts the column to the BigQuery API representation.
+func (c *column) tableFieldSchema() *bqapi.TableFieldSchema {
+	f := &bqapi.TableFieldSchema{Name: c.name, Type: c.bqType, Mode: "NULLABLE"}
+	if c.repeated {
+		f.Mode = "REPEATED"
+	}
+	for _, child := range c.children {
+		f.Fields = append(f.Fields, child.tableFieldSchema())
+	}
+	return f
+}
+
+type resourceSchema struct {
+	tableName string
+	root      *column
+}
+
+var (
+	schemasMu sync.Mutex
+	schemas   = map[cpb.ResourceTypeCode_Value]*resourceSchema{}
+)
+
+// schemaFor returns the schema for the given resource type, generating it from
+// the FHIR protos on first use.
+func schemaFor(resourceType cpb.ResourceTypeCode_Value) (*resourceSchema, error) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	if s, ok := schemas[resourceType]; ok {
+		return s, nil
+	}
+
+	fieldName := protoreflect.Name(strings.ToLower(resourceType.String()))
+	fd := (&rpb.ContainedResource{}).ProtoReflect().Descriptor().Fields().ByName(fieldName)
+	if fd == nil || fd.Message() == nil {
+		return nil, fmt.Errorf("no FHIR proto for resource type %s", resourceType)
+	}
+	b := &schemaBuilder{seen: map[protoreflect.FullName]int{}}
+	root := b.buildRecord("", false, fd.Message(), 0)
+	if root == nil {
+		return nil, fmt.Errorf("empty schema for resource type %s", resourceType)
+	}
+	s := &resourceSchema{tableName: string(fd.Message().Name()), root: root}
+	schemas[resourceType] = s
+	return s, nil
+}
+
+// TableName returns the name of the BigQuery table holding resources of the
+// given type, which is the FHIR resource type name, for example Observation.
+func TableName(resourceType cpb.ResourceTypeCode_Value) (string, error) {
+	s, err := schemaFor(resourceType)
+	if err != nil {
+		return "", err
+	}
+	return s.tableName, nil
+}
+
+// Schema returns the BigQuery table schema for the given resource type.
+//
+// The schema is modelled on the analytics schema used by the FHIR store when
+// exporting to BigQuery: each FHIR element is a column named after the element,
+// choice types such as Observation.value[x] are a RECORD with a column for each
+// type (value.quantity, value.string, ...), and References have an additional
+// typed ID column for each resource type they may refer to, for example
+// subject.patientId. Recursive data types are nested at most twice.
+// Extensions and contained resources are stored as columns holding their JSON.
+func Schema(resourceType cpb.ResourceTypeCode_Value) (*bqapi.TableSchema, error) {
+	s, err := schemaFor(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	ts := &bqapi.TableSchema{}
+	for _, c := range s.root.children {
+		ts.Fields = append(ts.Fields, c.tableFieldSchema())
+	}
+	return ts, nil
+}
+
+// Row is a BigQuery row holding a FHIR resource.
+type Row map[string]bqapi.JsonValue
+
+// RowFromJSON converts a FHIR JSON resource of the given type to a row matching
+// the table schema returned by Schema. Elements which are not part of the
+// schema, such as the extensions of primitive elements and data types nested
+// deeper than the schema allows, are dropped.
+func RowFromJSON(resourceType cpb.ResourceTypeCode_Value, fhirJSON []byte) (Row, error) {
+	s, err := schemaFor(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(fhirJSON))
+	// Keep numbers as they were written, so that decimals do not lose precision
+	// before being sent to BigQuery.
+	d.UseNumber()
+	var obj map[string]any
+	if err := d.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorInvalidResource, err)
+	}
+	return convertRecord(s.root, obj, s.tableName)
+}
+
+func convertRecord(c *column, obj map[string]any, path string) (Row, error) {
+	row := Row{}
+	for k, v := range obj {
+		if child, ok := c.byName[k]; ok {
+			val, err := convertValue(child, v, path+"."+k)
+			if err != nil {
+				return nil, err
+			}
+			row[k] = val
+			continue
+		}
+		if co, ok := c.choices[k]; ok {
+			val, err := convertValue(co.option, v, path+"."+k)
+			if err != nil {
+				return nil, err
+			}
+			choice, _ := row[co.choice.name].(Row)
+			if choice == nil {
+				choice = Row{}
+				row[co.choice.name] = choice
+			}
+			choice[co.option.name] = val
+		}
+	}
+	if c.reference {
+		if ref, ok := obj["reference"].(string); ok {
+			if t, id, ok := splitReference(ref); ok {
+				if col := referenceIDColumn(t); c.byName[col] != nil {
+					row[col] = id
+				}
+			}
+		}
+	}
+	return row, nil
+}
+
+func convertValue(c *column, v any, path string) (bqapi.JsonValue, error) {
+	if c.repeated {
+		arr, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is not an array", ErrorInvalidResource, path)
+		}
+		out := make([]bqapi.JsonValue, 0, len(arr))
+		for _, e := range arr {
+			val, err := convertSingleValue(c, e, path)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, val)
+		}
+		return out, nil
+	}
+	return convertSingleValue(c, v, path)
+}
+
+func convertSingleValue(c *column, v any, path string) (bqapi.JsonValue, error) {
+	switch {
+	case c.jsonString:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrorInvalidResource, path, err)
+		}
+		return string(b), nil
+	case c.bqType == typeRecord:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is not an object", ErrorInvalidResource, path)
+		}
+		return convertRecord(c, obj, path)
+	default:
+		switch v.(type) {
+		case string, bool, json.Number:
+			return v, nil
+		}
+		return nil, fmt.Errorf("%w: %s is not a primitive value", ErrorInvalidResource, path)
+	}
+}
+
+// splitReference returns the resource type and ID of a relative or absolute
+// literal reference, for example Patient/123 or
+// https://example.com/fhir/Patient/123/_history/2.
+func splitReference(ref string) (resourceType, id string, ok bool) {
+	if i := strings.Index(ref, "/_history/"); i >= 0 {
+		ref = ref[:i]
+	}
+	parts := strings.Split(ref, "/")
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	resourceType, id = parts[len(parts)-2], parts[len(parts)-1]
+	if resourceType == "" || id == "" || !unicode.IsUpper([]rune(resourceType)[0]) {
+		return "", "", false
+	}
+	return resourceType, id, true
+}
@@ -0,0 +1,201 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bigquery_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	bqapi "google.golang.org/api/bigquery/v2"
+	"github.com/google/bulk_fhir_tools/bigquery"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func findField(fields []*bqapi.TableFieldSchema, path ...string) *bqapi.TableFieldSchema {
+	for _, f := range fields {
+		if f.Name != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return f
+		}
+		return findField(f.Fields, path[1:]...)
+	}
+	return nil
+}
+
+func countColumns(fields []*bqapi.TableFieldSchema, depth int) (columns, maxDepth int) {
+	maxDepth = depth
+	for _, f := range fields {
+		c, d := countColumns(f.Fields, depth+1)
+		columns += c + 1
+		if d > maxDepth {
+			maxDepth = d
+		}
+	}
+	return columns, maxDepth
+}
+
+func TestSchema(t *testing.T) {
+	schema, err := bigquery.Schema(cpb.ResourceTypeCode_OBSERVATION)
+	if err != nil {
+		t.Fatalf("Schema() returned unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		path     []string
+		wantType string
+		wantMode string
+	}{
+		{[]string{"id"}, "STRING", "NULLABLE"},
+		{[]string{"status"}, "STRING", "NULLABLE"},
+		{[]string{"category"}, "RECORD", "REPEATED"},
+		{[]string{"category", "coding", "code"}, "STRING", "NULLABLE"},
+		{[]string{"value", "quantity", "value"}, "FLOAT", "NULLABLE"},
+		{[]string{"value", "string"}, "STRING", "NULLABLE"},
+		{[]string{"value", "boolean"}, "BOOLEAN", "NULLABLE"},
+		{[]string{"value", "integer"}, "INTEGER", "NULLABLE"},
+		{[]string{"subject", "reference"}, "STRING", "NULLABLE"},
+		{[]string{"subject", "patientId"}, "STRING", "NULLABLE"},
+		{[]string{"extension"}, "STRING", "REPEATED"},
+		{[]string{"contained"}, "STRING", "REPEATED"},
+		{[]string{"identifier", "assigner", "identifier", "value"}, "STRING", "NULLABLE"},
+	}
+	for _, tc := range cases {
+		f := findField(schema.Fields, tc.path...)
+		if f == nil {
+			t.Errorf("Schema() has no column %v", tc.path)
+			continue
+		}
+		if f.Type != tc.wantType || f.Mode != tc.wantMode {
+			t.Errorf("Schema() column %v is %s %s, want %s %s", tc.path, f.Mode, f.Type, tc.wantMode, tc.wantType)
+		}
+	}
+
+	for _, path := range [][]string{
+		// Observation.subject may not refer to an Organization.
+		{"subject", "organizationId"},
+		// The proto representation of a reference is not used.
+		{"subject", "uri"},
+		// Choice types are nested under the choice name.
+		{"valueQuantity"},
+		// Recursive types are nested at most twice.
+		{"identifier", "assigner", "identifier", "assigner", "identifier"},
+	} {
+		if f := findField(schema.Fields, path...); f != nil {
+			t.Errorf("Schema() has unexpected column %v", path)
+		}
+	}
+}
+
+func TestSchema_AllResourceTypesWithinBigQueryLimits(t *testing.T) {
+	for v := range cpb.ResourceTypeCode_Value_name {
+		rt := cpb.ResourceTypeCode_Value(v)
+		switch rt {
+		case cpb.ResourceTypeCode_INVALID_UNINITIALIZED, cpb.ResourceTypeCode_RESOURCE, cpb.ResourceTypeCode_DOMAIN_RESOURCE:
+			continue
+		}
+		schema, err := bigquery.Schema(rt)
+		if err != nil {
+			t.Errorf("Schema(%s) returned unexpected error: %v", rt, err)
+			continue
+		}
+		columns, depth := countColumns(schema.Fields, 0)
+		if columns > 10000 || depth > 15 {
+			t.Errorf("Schema(%s) has %d columns nested %d deep, want at most 10000 columns nested at most 15 deep", rt, columns, depth)
+		}
+	}
+}
+
+func TestTableName(t *testing.T) {
+	got, err := bigquery.TableName(cpb.ResourceTypeCode_DOCUMENT_REFERENCE)
+	if err != nil {
+		t.Fatalf("TableName() returned unexpected error: %v", err)
+	}
+	if got != "DocumentReference" {
+		t.Errorf("TableName() = %q, want %q", got, "DocumentReference")
+	}
+}
+
+func TestRowFromJSON(t *testing.T) {
+	in := `{
+		"resourceType": "Observation",
+		"id": "1",
+		"status": "final",
+		"_status": {"extension": [{"url": "http://example.com", "valueString": "dropped"}]},
+		"extension": [{"url": "http://example.com", "valueString": "kept"}],
+		"category": [{"coding": [{"system": "http://terminology.hl7.org/CodeSystem/observation-category", "code": "laboratory"}]}],
+		"subject": {"reference": "https://example.com/fhir/Patient/123/_history/2", "display": "Jane"},
+		"performer": [{"reference": "Practitioner/456"}, {"reference": "#contained"}],
+		"valueQuantity": {"value": 1.50, "unit": "mg"},
+		"component": [{"code": {"text": "c"}, "valueBoolean": true}]
+	}`
+	got, err := bigquery.RowFromJSON(cpb.ResourceTypeCode_OBSERVATION, []byte(in))
+	if err != nil {
+		t.Fatalf("RowFromJSON() returned unexpected error: %v", err)
+	}
+
+	want := `{
+		"id": "1",
+		"status": "final",
+		"extension": ["{\"url\":\"http://example.com\",\"valueString\":\"kept\"}"],
+		"category": [{"coding": [{"system": "http://terminology.hl7.org/CodeSystem/observation-category", "code": "laboratory"}]}],
+		"subject": {"reference": "https://example.com/fhir/Patient/123/_history/2", "display": "Jane", "patientId": "123"},
+		"performer": [{"reference": "Practitioner/456", "practitionerId": "456"}, {"reference": "#contained"}],
+		"value": {"quantity": {"value": 1.50, "unit": "mg"}},
+		"component": [{"code": {"text": "c"}, "value": {"boolean": true}}]
+	}`
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotMap, wantMap map[string]any
+	if err := json.Unmarshal(gotJSON, &gotMap); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantMap); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(gotMap, wantMap); diff != "" {
+		t.Errorf("RowFromJSON() returned unexpected row (-got +want): %s", diff)
+	}
+	// Decimals should be passed through as written.
+	if !strings.Contains(string(gotJSON), `"value":1.50`) {
+		t.Errorf("RowFromJSON() did not preserve decimal precision: %s", gotJSON)
+	}
+}
+
+func TestRowFromJSON_Invalid(t *testing.T) {
+	cases := []struct {
+		name string
+		json string
+	}{
+		{"not JSON", `{"resourceType":`},
+		{"object for a primitive", `{"resourceType": "Observation", "status": {"value": "final"}}`},
+		{"object for an array", `{"resourceType": "Observation", "category": {"text": "c"}}`},
+		{"primitive for an object", `{"resourceType": "Observation", "code": "c"}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := bigquery.RowFromJSON(cpb.ResourceTypeCode_OBSERVATION, []byte(tc.json)); !errors.Is(err, bigquery.ErrorInvalidResource) {
+				t.Errorf("RowFromJSON() returned error %v, want %v", err, bigquery.ErrorInvalidResource)
+			}
+		})
+	}
+}
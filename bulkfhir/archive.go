@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+)
+
+// The kinds of request whose responses are archived.
+const (
+	ResponseKindKickoff   = "kickoff"
+	ResponseKindJobStatus = "status"
+)
+
+// ArchivedResponse is a response of the bulk FHIR server recorded by a
+// ResponseArchive.
+type ArchivedResponse struct {
+	// Kind is the kind of request, ResponseKindKickoff or ResponseKindJobStatus.
+	Kind string
+	// RequestURL is the URL the request was sent to.
+	RequestURL string
+	// ReceivedAt is when the response was received.
+	ReceivedAt time.Time
+	// Response is the raw response, including its status line, headers and
+	// body, as returned by httputil.DumpResponse.
+	Response []byte
+}
+
+// ResponseArchive records the raw responses of the bulk FHIR server to export
+// kick-off and job status requests, including the completed job's manifest, so
+// that what the server reported can be shown later, for example to auditors in
+// a dispute about what a payer delivered. Archived responses are never
+// overwritten.
+type ResponseArchive interface {
+	Archive(ctx context.Context, r ArchivedResponse) error
+}
+
+// archiveFileName returns the name of the file holding r, which sorts by the
+// time it was received, and ends with a prefix of the SHA-256 hash of the
+// file's content so that names do not collide.
+func archiveFileName(r ArchivedResponse, content []byte) string {
+	hash := sha256.Sum256(content)
+	return fmt.Sprintf("%s_%s_%s.http", r.ReceivedAt.UTC().Format("20060102T150405.000000000Z"), r.Kind, hex.EncodeToString(hash[:8]))
+}
+
+// archiveContent returns the content of the file holding r: the request line,
+// followed by the raw response.
+func archiveContent(r ArchivedResponse) []byte {
+	return append([]byte(fmt.Sprintf("GET %s\r\n", r.RequestURL)), r.Response...)
+}
+
+type localResponseArchive struct {
+	dir string
+}
+
+func (a *localResponseArchive) Archive(ctx context.Context, r ArchivedResponse) error {
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", a.dir, err)
+	}
+	content := archiveContent(r)
+	path := filepath.Join(a.dir, archiveFileName(r, content))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// NewLocalResponseArchive returns a ResponseArchive which writes each response
+// to a new read-only file in the local directory dir.
+func NewLocalResponseArchive(dir string) ResponseArchive {
+	return &localResponseArchive{dir: dir}
+}
+
+type gcsResponseArchive struct {
+	client       gcs.Client
+	relativePath string
+	fullURI      string
+	retention    time.Duration
+}
+
+func (a *gcsResponseArchive) Archive(ctx context.Context, r ArchivedResponse) error {
+	content := archiveContent(r)
+	name := archiveFileName(r, content)
+	var retainUntil time.Time
+	if a.retention > 0 {
+		retainUntil = r.ReceivedAt.Add(a.retention)
+	}
+	w := a.client.GetRetainedFileWriter(ctx, gcs.JoinPath(a.relativePath, name), retainUntil)
+	if _, err := w.Write(content); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write %s to %s: %w", name, a.fullURI, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write %s to %s: %w", name, a.fullURI, err)
+	}
+	return nil
+}
+
+// NewGCSResponseArchive returns a ResponseArchive which writes each response
+// to a new object in the GCS directory at the given URI. If retention is not
+// zero, each object is locked against deletion or replacement for that long
+// after its response was received, which requires a bucket with object
+// retention enabled. Alternatively, a locked retention policy on the bucket
+// itself makes every object write-once.
+func NewGCSResponseArchive(ctx context.Context, gcsEndpoint, uri string, retention time.Duration) (ResponseArchive, error) {
+	bucket, relativePath, err := gcs.PathComponents(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := gcs.NewClient(ctx, bucket, gcsEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GCS client: %w", err)
+	}
+	return &gcsResponseArchive{
+		client:       client,
+		relativePath: relativePath,
+		fullURI:      uri,
+		retention:    retention,
+	}, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestLocalResponseArchive(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "archive")
+	a := NewLocalResponseArchive(dir)
+	r := ArchivedResponse{
+		Kind:       ResponseKindJobStatus,
+		RequestURL: "https://server/jobs/1",
+		ReceivedAt: time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		Response:   []byte("HTTP/1.1 202 Accepted\r\nX-Progress: 50%\r\n\r\n"),
+	}
+	if err := a.Archive(context.Background(), r); err != nil {
+		t.Fatalf("Archive() returned unexpected error: %v", err)
+	}
+	// Archiving the same response again must not overwrite it.
+	if err := a.Archive(context.Background(), r); err == nil {
+		t.Error("Archive() of an already archived response succeeded, want error")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "20240102T030405.000000006Z_status_") {
+		t.Fatalf("archive holds %v, want one file for the response", entries)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "GET https://server/jobs/1\r\nHTTP/1.1 202 Accepted\r\nX-Progress: 50%\r\n\r\n"
+	if string(got) != want {
+		t.Errorf("archived file holds %q, want %q", got, want)
+	}
+	info, err := entries[0].Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0222 != 0 {
+		t.Errorf("archived file has mode %v, want read-only", info.Mode())
+	}
+}
+
+func TestGCSResponseArchive(t *testing.T) {
+	gcsServer := testhelpers.NewGCSServer(t)
+	a, err := NewGCSResponseArchive(context.Background(), gcsServer.URL(), "gs://archiveBucket/responses", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewGCSResponseArchive() returned unexpected error: %v", err)
+	}
+	r := ArchivedResponse{
+		Kind:       ResponseKindKickoff,
+		RequestURL: "https://server/$export",
+		ReceivedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Response:   []byte("HTTP/1.1 202 Accepted\r\nContent-Location: https://server/jobs/1\r\n\r\n"),
+	}
+	if err := a.Archive(context.Background(), r); err != nil {
+		t.Fatalf("Archive() returned unexpected error: %v", err)
+	}
+	if err := a.Archive(context.Background(), r); err == nil {
+		t.Error("Archive() of an already archived response succeeded, want error")
+	}
+
+	paths := gcsServer.GetAllPaths()
+	if len(paths) != 1 || !strings.HasPrefix(paths[0], "gs://archiveBucket/responses/20240102T030405.000000000Z_kickoff_") {
+		t.Fatalf("archive holds %v, want one object for the response", paths)
+	}
+	obj, ok := gcsServer.GetObject("archiveBucket", strings.TrimPrefix(paths[0], "gs://archiveBucket/"))
+	if !ok {
+		t.Fatalf("object %s not found", paths[0])
+	}
+	wantRetention := &testhelpers.GCSObjectRetention{Mode: "Locked", RetainUntilTime: "2024-01-03T03:04:05Z"}
+	if diff := cmp.Diff(wantRetention, obj.Retention); diff != "" {
+		t.Errorf("archived object has unexpected retention (-want +got):\n%s", diff)
+	}
+}
+
+// fakeResponseArchive holds the responses archived in memory.
+type fakeResponseArchive struct {
+	responses []ArchivedResponse
+}
+
+func (a *fakeResponseArchive) Archive(ctx context.Context, r ArchivedResponse) error {
+	a.responses = append(a.responses, r)
+	return nil
+}
+
+func TestClient_ResponseArchive(t *testing.T) {
+	manifest := `{"transactionTime": "2020-09-15T17:53:11.476Z", "output": [{"type": "Patient", "url": "https://server/data/1.ndjson"}]}`
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/$export":
+			w.Header().Set("Content-Location", server.URL+"/jobs/1")
+			w.WriteHeader(http.StatusAccepted)
+		case "/jobs/1":
+			w.Write([]byte(manifest))
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	archive := &fakeResponseArchive{}
+	cl, err := NewClient(server.URL, testAuthenticator{}, WithResponseArchive(archive))
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	jobStatusURL, err := cl.StartBulkDataExportSystem(nil, nil, time.Time{})
+	if err != nil {
+		t.Fatalf("StartBulkDataExportSystem() returned unexpected error: %v", err)
+	}
+	jobStatus, err := cl.JobStatus(jobStatusURL)
+	if err != nil {
+		t.Fatalf("JobStatus() returned unexpected error: %v", err)
+	}
+	// The manifest can still be read after being archived.
+	if got := jobStatus.ResultURLs[cpb.ResourceTypeCode_PATIENT]; len(got) != 1 {
+		t.Errorf("JobStatus() returned result URLs %v, want the manifest's", jobStatus.ResultURLs)
+	}
+
+	if len(archive.responses) != 2 {
+		t.Fatalf("archived %d responses, want 2", len(archive.responses))
+	}
+	kickoff, status := archive.responses[0], archive.responses[1]
+	if kickoff.Kind != ResponseKindKickoff || !strings.HasPrefix(kickoff.RequestURL, server.URL+"/$export") || !strings.Contains(string(kickoff.Response), "Content-Location: "+server.URL+"/jobs/1") {
+		t.Errorf("unexpected archived kick-off response %+v", kickoff)
+	}
+	if status.Kind != ResponseKindJobStatus || status.RequestURL != jobStatusURL || !strings.HasPrefix(string(status.Response), "HTTP/1.1 200 OK") || !strings.HasSuffix(string(status.Response), manifest) {
+		t.Errorf("unexpected archived job status response %+v", status)
+	}
+}
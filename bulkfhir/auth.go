@@ -16,6 +16,8 @@ package bulkfhir
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
@@ -27,6 +29,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -108,10 +111,14 @@ type CredentialExchanger interface {
 // CredentialExchanger to obtain a bearer token which is presented in an
 // Authorization header.
 //
-// Note: this implementation is not thread safe.
+// It is threadsafe to use this Authenticator from multiple goroutines;
+// credential exchange is performed by at most one goroutine at a time.
 type BearerTokenAuthenticator struct {
 	Exchanger CredentialExchanger
-	token     *BearerToken
+
+	// mu must be held when accessing token.
+	mu    sync.Mutex
+	token *BearerToken
 }
 
 // Authenticate is Authenticator.Authenticate.
@@ -119,6 +126,12 @@ type BearerTokenAuthenticator struct {
 // This Authenticator uses the CredentialExchanger it contains to obtain a
 // bearer token.
 func (bta *BearerTokenAuthenticator) Authenticate(hc *http.Client) error {
+	bta.mu.Lock()
+	defer bta.mu.Unlock()
+	return bta.authenticateLocked(hc)
+}
+
+func (bta *BearerTokenAuthenticator) authenticateLocked(hc *http.Client) error {
 	token, err := bta.Exchanger.Authenticate(hc)
 	if err != nil {
 		return err
@@ -132,8 +145,10 @@ func (bta *BearerTokenAuthenticator) Authenticate(hc *http.Client) error {
 // This Authenticator uses the CredentialExchanger it contains to obtain a
 // bearer token.
 func (bta *BearerTokenAuthenticator) AuthenticateIfNecessary(hc *http.Client) error {
+	bta.mu.Lock()
+	defer bta.mu.Unlock()
 	if bta.token.shouldRenew() {
-		return bta.Authenticate(hc)
+		return bta.authenticateLocked(hc)
 	}
 	return nil
 }
@@ -143,8 +158,12 @@ func (bta *BearerTokenAuthenticator) AuthenticateIfNecessary(hc *http.Client) er
 // This Authenticator adds an access token as an Authorization: Bearer {token}
 // header, automatically requesting/refreshing the token as necessary.
 func (bta *BearerTokenAuthenticator) AddAuthenticationToRequest(hc *http.Client, req *http.Request) error {
-	if err := bta.AuthenticateIfNecessary(hc); err != nil {
-		return err
+	bta.mu.Lock()
+	defer bta.mu.Unlock()
+	if bta.token.shouldRenew() {
+		if err := bta.authenticateLocked(hc); err != nil {
+			return err
+		}
 	}
 	bta.token.addHeader(req)
 	return nil
@@ -335,35 +354,111 @@ func NewHTTPBasicOAuthAuthenticator(username, password, tokenURL string, opts *H
 	return &BearerTokenAuthenticator{Exchanger: e}, nil
 }
 
-// A JWTKeyProvider provides the RSA private key used for signing JSON Web Tokens.
+// staticTokenExchanger is an implementation of CredentialExchanger for use with
+// BearerTokenAuthenticator which returns a fixed token, such as a long-lived API
+// token issued by a FHIR server's administrator.
+type staticTokenExchanger struct {
+	token string
+}
+
+// Authenticate is CredentialExchanger.Authenticate.
+//
+// This CredentialExchanger returns the fixed token, which never expires.
+func (ste *staticTokenExchanger) Authenticate(hc *http.Client) (*BearerToken, error) {
+	return &BearerToken{Token: ste.token}, nil
+}
+
+// NewStaticBearerTokenAuthenticator creates a new Authenticator which presents
+// the given token as an "Authorization: Bearer {token}" header in all
+// requests, without any credential exchange.
+func NewStaticBearerTokenAuthenticator(token string) (Authenticator, error) {
+	if token == "" {
+		return nil, errors.New("a token must be specified for bearer token authentication")
+	}
+	return &BearerTokenAuthenticator{Exchanger: &staticTokenExchanger{token: token}}, nil
+}
+
+// httpBasicAuthenticator is an implementation of Authenticator which presents
+// a username and password with HTTP Basic Authentication in all requests.
+type httpBasicAuthenticator struct {
+	username, password string
+}
+
+// Authenticate is Authenticator.Authenticate.
+//
+// HTTP Basic Authentication requires no credential exchange, so this does
+// nothing.
+func (hba *httpBasicAuthenticator) Authenticate(hc *http.Client) error {
+	return nil
+}
+
+// AuthenticateIfNecessary is Authenticator.AuthenticateIfNecessary.
+//
+// HTTP Basic Authentication requires no credential exchange, so this does
+// nothing.
+func (hba *httpBasicAuthenticator) AuthenticateIfNecessary(hc *http.Client) error {
+	return nil
+}
+
+// AddAuthenticationToRequest is Authenticator.AddAuthenticationToRequest.
+//
+// This Authenticator adds the username and password as an Authorization: Basic
+// header.
+func (hba *httpBasicAuthenticator) AddAuthenticationToRequest(hc *http.Client, req *http.Request) error {
+	req.SetBasicAuth(hba.username, hba.password)
+	return nil
+}
+
+// NewHTTPBasicAuthenticator creates a new Authenticator which presents the
+// username and password with HTTP Basic Authentication in all requests. Unlike
+// NewHTTPBasicOAuthAuthenticator, the credentials are not exchanged for a
+// bearer token; this is for servers, such as many HAPI FHIR deployments, which
+// accept them directly.
+func NewHTTPBasicAuthenticator(username, password string) (Authenticator, error) {
+	if username == "" || password == "" {
+		return nil, errors.New("username and password must be specified for HTTP Basic authentication")
+	}
+	return &httpBasicAuthenticator{username: username, password: password}, nil
+}
+
+// A JWTKeyProvider provides the private key used for signing JSON Web Tokens.
+// The key must be either an *rsa.PrivateKey (used with RS384) or an
+// *ecdsa.PrivateKey on the P-384 curve (used with ES384), as required by the
+// SMART Backend Services specification.
 type JWTKeyProvider interface {
-	Key() (*rsa.PrivateKey, error)
+	Key() (crypto.Signer, error)
 	KeyID() string
 }
 
 // pemFileKeyProvider is an implementation of JWTKeyProvider which reads a
-// PEM-encoded key from a local file.
+// PEM-encoded RSA or EC key from a local file, or from keyPEM if set.
 type pemFileKeyProvider struct {
 	filename, keyID string
-	key             *rsa.PrivateKey
+	keyPEM          []byte
+	key             crypto.Signer
 }
 
-func (pfkp *pemFileKeyProvider) Key() (*rsa.PrivateKey, error) {
+func (pfkp *pemFileKeyProvider) Key() (crypto.Signer, error) {
 	if pfkp.key != nil {
 		return pfkp.key, nil
 	}
-	f, err := os.Open(pfkp.filename)
-	if err != nil {
-		return nil, err
+	keyBytes := pfkp.keyPEM
+	if keyBytes == nil {
+		var err error
+		keyBytes, err = os.ReadFile(pfkp.filename)
+		if err != nil {
+			return nil, err
+		}
 	}
-	keyBytes, err := io.ReadAll(f)
-	if err != nil {
-		return nil, err
+	if rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyBytes); err == nil {
+		pfkp.key = rsaKey
+		return pfkp.key, nil
 	}
-	pfkp.key, err = jwt.ParseRSAPrivateKeyFromPEM(keyBytes)
+	ecKey, err := jwt.ParseECPrivateKeyFromPEM(keyBytes)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s does not contain a PEM-encoded RSA or EC private key: %w", pfkp.filename, err)
 	}
+	pfkp.key = ecKey
 	return pfkp.key, nil
 }
 
@@ -377,6 +472,29 @@ func NewPEMFileKeyProvider(filename, keyID string) JWTKeyProvider {
 	return &pemFileKeyProvider{filename: filename, keyID: keyID}
 }
 
+// NewPEMKeyProvider returns a JWTKeyProvider which reads a PEM-encoded key from
+// keyPEM, for keys which are not stored in a local file (e.g. keys held in
+// Secret Manager). source is only used to identify the key in error messages.
+func NewPEMKeyProvider(source string, keyPEM []byte, keyID string) JWTKeyProvider {
+	return &pemFileKeyProvider{filename: source, keyID: keyID, keyPEM: keyPEM}
+}
+
+// signingMethodForKey returns the JWT signing method to use with the given
+// key; RS384 for RSA keys and ES384 for EC keys.
+func signingMethodForKey(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS384, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve.Params().BitSize != 384 {
+			return nil, fmt.Errorf("EC keys must use the P-384 curve for ES384 signing, got %s", k.Curve.Params().Name)
+		}
+		return jwt.SigningMethodES384, nil
+	default:
+		return nil, fmt.Errorf("unsupported JWT signing key type %T", key)
+	}
+}
+
 type jwtOAuthExchanger struct {
 	issuer, subject, tokenURL       string
 	keyProvider                     JWTKeyProvider
@@ -394,8 +512,12 @@ func (joe *jwtOAuthExchanger) buildBody() (io.Reader, error) {
 	if err != nil {
 		return nil, err
 	}
+	method, err := signingMethodForKey(key)
+	if err != nil {
+		return nil, err
+	}
 	now := timeNow()
-	token := jwt.NewWithClaims(jwt.SigningMethodRS384, jwt.StandardClaims{
+	token := jwt.NewWithClaims(method, jwt.StandardClaims{
 		ExpiresAt: now.Add(joe.jwtLifetime).Unix(),
 		Issuer:    joe.issuer,
 		Subject:   joe.subject,
@@ -466,6 +588,8 @@ type JWTOAuthOptions struct {
 
 // NewJWTOAuthAuthenticator creates a new Authenticator which uses  2-legged
 // OAuth with JWT authentication (according to RFC9068) to obtain a bearer token.
+// This is the asymmetric client authentication flow used by SMART Backend
+// Services, in which case the issuer and subject should both be the client ID.
 func NewJWTOAuthAuthenticator(issuer, subject, tokenURL string, keyProvider JWTKeyProvider, opts *JWTOAuthOptions) (Authenticator, error) {
 	if issuer == "" || subject == "" {
 		return nil, errors.New("issuer and subject must be specified for JWT OAuth authentication")
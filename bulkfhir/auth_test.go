@@ -15,12 +15,19 @@
 package bulkfhir
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -254,11 +261,11 @@ func TestHTTPBasicOAuthAuthenticator_AuthenticateOnlyIfNecessary(t *testing.T) {
 }
 
 type testKeyProvider struct {
-	key   *rsa.PrivateKey
+	key   crypto.Signer
 	keyID string
 }
 
-func (tkp *testKeyProvider) Key() (*rsa.PrivateKey, error) {
+func (tkp *testKeyProvider) Key() (crypto.Signer, error) {
 	return tkp.key, nil
 }
 
@@ -540,6 +547,160 @@ func TestJWTOAuthAuthenticator_AuthenticateOnlyIfNecessary(t *testing.T) {
 	}
 }
 
+func TestJWTOAuthAuthenticator_SigningMethods(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecP256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		key        crypto.Signer
+		wantMethod string
+		wantErr    bool
+	}{
+		{
+			name:       "RSA",
+			key:        rsaKey,
+			wantMethod: "RS384",
+		},
+		{
+			name:       "EC P-384",
+			key:        ecKey,
+			wantMethod: "ES384",
+		},
+		{
+			name:    "EC P-256",
+			key:     ecP256Key,
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := req.ParseForm(); err != nil {
+					t.Errorf("Authenticate() sent a body that could not be parsed as a form: %s", err)
+				}
+				token, err := jwt.Parse(req.Form.Get("client_assertion"), func(_ *jwt.Token) (any, error) {
+					return tc.key.Public(), nil
+				})
+				if err != nil {
+					t.Fatalf("Failed to parse JWT: %v", err)
+				}
+				if got := token.Method.Alg(); got != tc.wantMethod {
+					t.Errorf("Authenticate() signed JWT with unexpected algorithm. got: %q, want: %q", got, tc.wantMethod)
+				}
+				w.Write([]byte(`{"access_token": "123", "expires_in": 1200}`))
+			}))
+			defer server.Close()
+
+			authURL := server.URL + "/auth/token"
+			authenticator, err := NewJWTOAuthAuthenticator("client", "client", authURL, &testKeyProvider{tc.key, "kid"}, nil)
+			if err != nil {
+				t.Fatalf("NewJWTOAuthAuthenticator(...) error: %v", err)
+			}
+			err = authenticator.Authenticate(http.DefaultClient)
+			if tc.wantErr && err == nil {
+				t.Errorf("Authenticate() succeeded, want error")
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("Authenticate() returned unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestStaticBearerTokenAuthenticator_AddAuthenticationToRequest(t *testing.T) {
+	authenticator, err := NewStaticBearerTokenAuthenticator("token")
+	if err != nil {
+		t.Fatalf("NewStaticBearerTokenAuthenticator() error: %v", err)
+	}
+	// The token is presented on every request, and never exchanged.
+	buildRequestAndCheckHeader(t, authenticator, "Bearer token")
+	buildRequestAndCheckHeader(t, authenticator, "Bearer token")
+
+	if _, err := NewStaticBearerTokenAuthenticator(""); err == nil {
+		t.Errorf("NewStaticBearerTokenAuthenticator(\"\") succeeded, want error")
+	}
+}
+
+func TestHTTPBasicAuthenticator_AddAuthenticationToRequest(t *testing.T) {
+	authenticator, err := NewHTTPBasicAuthenticator("user", "password")
+	if err != nil {
+		t.Fatalf("NewHTTPBasicAuthenticator() error: %v", err)
+	}
+	// "user:password" in base64.
+	buildRequestAndCheckHeader(t, authenticator, "Basic dXNlcjpwYXNzd29yZA==")
+
+	if _, err := NewHTTPBasicAuthenticator("user", ""); err == nil {
+		t.Errorf("NewHTTPBasicAuthenticator(\"user\", \"\") succeeded, want error")
+	}
+}
+
+func TestPEMFileKeyProvider(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		block *pem.Block
+		want  crypto.Signer
+	}{
+		{
+			name:  "RSA",
+			block: &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+			want:  rsaKey,
+		},
+		{
+			name:  "EC",
+			block: &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER},
+			want:  ecKey,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "key.pem")
+			if err := os.WriteFile(filename, pem.EncodeToMemory(tc.block), 0600); err != nil {
+				t.Fatal(err)
+			}
+			providers := map[string]JWTKeyProvider{
+				"file":   NewPEMFileKeyProvider(filename, "kid"),
+				"memory": NewPEMKeyProvider("secret", pem.EncodeToMemory(tc.block), "kid"),
+			}
+			for source, kp := range providers {
+				got, err := kp.Key()
+				if err != nil {
+					t.Fatalf("%s: Key() returned unexpected error: %v", source, err)
+				}
+				if !tc.want.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(got.Public()) {
+					t.Errorf("%s: Key() returned an unexpected key", source)
+				}
+				if kp.KeyID() != "kid" {
+					t.Errorf("%s: KeyID() = %q, want %q", source, kp.KeyID(), "kid")
+				}
+			}
+		})
+	}
+}
+
 func buildRequestAndCheckHeader(t *testing.T, authenticator Authenticator, wantHeader string) {
 	t.Helper()
 
@@ -0,0 +1,151 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/bulk_fhir_tools/gcs"
+)
+
+// Checkpoint records the progress made processing the results of an export
+// job, so that an interrupted fetch can be resumed.
+type Checkpoint struct {
+	// JobURL is the status URL of the export job whose results are being
+	// processed, or empty if there is no job in progress.
+	JobURL string `json:"jobURL,omitempty"`
+	// CompletedURLs are the result URLs of the job which have been fully
+	// processed.
+	CompletedURLs []string `json:"completedURLs,omitempty"`
+	// Updated is when the checkpoint was last stored with progress for JobURL.
+	Updated time.Time `json:"updated,omitempty"`
+}
+
+// Expired returns whether the checkpoint records a job whose progress has not
+// been updated within the ttl. Bulk FHIR servers only keep the results of a job
+// for a limited time, so such a job should not be resumed.
+func (c *Checkpoint) Expired(ttl time.Duration) bool {
+	return c.JobURL != "" && !c.Updated.IsZero() && time.Since(c.Updated) > ttl
+}
+
+// CheckpointStore persists a Checkpoint between runs.
+type CheckpointStore interface {
+	// Load the stored checkpoint. If no checkpoint has previously been stored,
+	// this returns an empty checkpoint with no error.
+	Load(ctx context.Context) (*Checkpoint, error)
+	// Store overwrites the stored checkpoint with the given one.
+	Store(ctx context.Context, c *Checkpoint) error
+}
+
+func readCheckpoint(r io.Reader, name string) (*Checkpoint, error) {
+	c := &Checkpoint{}
+	if err := json.NewDecoder(r).Decode(c); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %w", name, err)
+	}
+	return c, nil
+}
+
+func writeCheckpoint(c *Checkpoint, w io.WriteCloser, name string) error {
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write checkpoint %s: %w", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write checkpoint %s: %w", name, err)
+	}
+	return nil
+}
+
+type localFileCheckpointStore struct {
+	path string
+}
+
+func (lfcs *localFileCheckpointStore) Load(ctx context.Context) (*Checkpoint, error) {
+	f, err := os.Open(lfcs.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Checkpoint{}, nil
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", lfcs.path, err)
+	}
+	defer f.Close()
+	return readCheckpoint(f, lfcs.path)
+}
+
+func (lfcs *localFileCheckpointStore) Store(ctx context.Context, c *Checkpoint) error {
+	// Write to a temporary file and rename it, so that a crash while writing
+	// does not corrupt the existing checkpoint.
+	tmp := lfcs.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	if err := writeCheckpoint(c, f, lfcs.path); err != nil {
+		return err
+	}
+	return os.Rename(tmp, lfcs.path)
+}
+
+// NewLocalFileCheckpointStore returns a CheckpointStore which persists the
+// checkpoint as JSON to a local file at the given path.
+func NewLocalFileCheckpointStore(path string) CheckpointStore {
+	return &localFileCheckpointStore{path: path}
+}
+
+type gcsCheckpointStore struct {
+	client                gcs.Client
+	relativePath, fullURI string
+}
+
+func (gcps *gcsCheckpointStore) Load(ctx context.Context) (*Checkpoint, error) {
+	r, err := gcps.client.GetFileReader(ctx, gcps.relativePath)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return &Checkpoint{}, nil
+		}
+		return nil, fmt.Errorf("failed to get GCS reader for %s: %w", gcps.fullURI, err)
+	}
+	defer r.Close()
+	return readCheckpoint(r, gcps.fullURI)
+}
+
+func (gcps *gcsCheckpointStore) Store(ctx context.Context, c *Checkpoint) error {
+	return writeCheckpoint(c, gcps.client.GetFileWriter(ctx, gcps.relativePath), gcps.fullURI)
+}
+
+// NewGCSCheckpointStore returns a CheckpointStore which persists the
+// checkpoint as JSON to a file in GCS at the given URI.
+func NewGCSCheckpointStore(ctx context.Context, gcsEndpoint, uri string) (CheckpointStore, error) {
+	bucket, relativePath, err := gcs.PathComponents(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := gcs.NewClient(ctx, bucket, gcsEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GCS client: %w", err)
+	}
+	return &gcsCheckpointStore{
+		client:       client,
+		relativePath: relativePath,
+		fullURI:      uri,
+	}, nil
+}
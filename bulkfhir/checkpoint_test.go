@@ -0,0 +1,89 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+func testCheckpointStore(t *testing.T, s CheckpointStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	got, err := s.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() of a new checkpoint returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, &Checkpoint{}); diff != "" {
+		t.Errorf("Load() of a new checkpoint returned unexpected diff (-got +want): %s", diff)
+	}
+
+	want := &Checkpoint{
+		JobURL:        "http://server/job/1",
+		CompletedURLs: []string{"http://server/data/1.ndjson", "http://server/data/2.ndjson"},
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Store(ctx, want); err != nil {
+			t.Fatalf("Store() returned unexpected error: %v", err)
+		}
+	}
+	got, err = s.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Load() returned unexpected diff (-got +want): %s", diff)
+	}
+}
+
+func TestLocalFileCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, NewLocalFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json")))
+}
+
+func TestGCSCheckpointStore(t *testing.T) {
+	gcsServer := testhelpers.NewGCSServer(t)
+	s, err := NewGCSCheckpointStore(context.Background(), gcsServer.URL(), "gs://checkpointBucket/checkpoint.json")
+	if err != nil {
+		t.Fatalf("NewGCSCheckpointStore() returned unexpected error: %v", err)
+	}
+	testCheckpointStore(t, s)
+}
+
+func TestCheckpointExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		c    *Checkpoint
+		want bool
+	}{
+		{name: "empty", c: &Checkpoint{}, want: false},
+		{name: "recent", c: &Checkpoint{JobURL: "job", Updated: now.Add(-time.Hour)}, want: false},
+		{name: "stale", c: &Checkpoint{JobURL: "job", Updated: now.Add(-3 * time.Hour)}, want: true},
+		{name: "stale without job", c: &Checkpoint{Updated: now.Add(-3 * time.Hour)}, want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.c.Expired(2 * time.Hour); got != tc.want {
+				t.Errorf("Expired() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
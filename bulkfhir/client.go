@@ -18,11 +18,14 @@
 package bulkfhir
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"regexp"
 	"strconv"
@@ -44,10 +47,19 @@ var (
 	// the result of expired credentials. Clients should consider retrying the
 	// operation if needed.
 	ErrorUnauthorized = errors.New("server indicates this client is unauthorized")
+	// ErrorForbidden indicates that the server refused this client access to a
+	// resource, typically because the client's credentials do not grant the
+	// required scope or permissions. Unlike ErrorUnauthorized, retrying with
+	// renewed credentials is not expected to help.
+	ErrorForbidden = errors.New("server indicates this client is forbidden from accessing the resource")
 	// ErrorTimeout indicates the operation timed out.
 	ErrorTimeout = errors.New("this operation timed out")
 	// ErrorExportJobNotFound indicates that the Job URL returned a 404 status.
 	ErrorExportJobNotFound = errors.New("job URL returned 404 not found")
+	// ErrorDataNotFound indicates that a data URL still returned a 404 status
+	// once the Client's RetryPolicy was exhausted, most likely because it has
+	// expired.
+	ErrorDataNotFound = errors.New("data URL returned 404 not found, it may have expired")
 	// ErrorUnexpectedStatusCode indicates an unexpected status code was present.
 	ErrorUnexpectedStatusCode = errors.New("unexpected non-ok HTTP status code")
 	// ErrorGreaterThanOneContentLocation indicates more than 1 Content-Location header was present.
@@ -56,9 +68,24 @@ var (
 	ErrorUnexpectedNumberOfXProgress = errors.New("unexpected number of x-progress headers")
 	// ErrorRetryableHTTPStatus may be wrapped into other errors emitted by this package
 	// to indicate to the caller that a retryable http error code was returned
-	// from the server.
-	// TODO(b/239596656): consider adding auto-retry logic within this package.
+	// from the server, and that the Client's RetryPolicy was exhausted.
 	ErrorRetryableHTTPStatus = errors.New("this is a retryable but unexpected HTTP status code error")
+	// ErrorTooManyRequests indicates that the server is throttling this
+	// client, responding 429 Too Many Requests. The RetryAfter of the
+	// JobStatus returned with it holds how long the server asked the client to
+	// wait, if it said.
+	ErrorTooManyRequests = errors.New("server is throttling requests (429 Too Many Requests)")
+	// ErrorInvalidTypeFilter indicates a malformed _typeFilter value was passed
+	// when starting an export.
+	ErrorInvalidTypeFilter = errors.New("invalid _typeFilter")
+	// ErrorKickoffTooLarge indicates that the server rejected the kick-off
+	// request as too large, responding 413 Content Too Large, 414 URI Too Long
+	// or 431 Request Header Fields Too Large, for example because the URL is
+	// too long with many _type values or long _typeFilter expressions.
+	ErrorKickoffTooLarge = errors.New("server rejected the export kick-off request as too large")
+	// ErrorUnsupportedContentEncoding indicates that the server compressed data
+	// with a Content-Encoding other than gzip, which cannot be decompressed.
+	ErrorUnsupportedContentEncoding = errors.New("unsupported Content-Encoding")
 )
 
 // ExportGroupAll is a default group ID of "all" which can be supplied to
@@ -66,22 +93,178 @@ var (
 // ID may differ, so be sure to consult relevant documentation.
 var ExportGroupAll = "all"
 
+// ExportScope is the level at which a bulk data export is requested, which
+// determines the kick-off endpoint used.
+type ExportScope string
+
+const (
+	// ExportScopeSystem exports all data on the server, via /$export.
+	ExportScopeSystem ExportScope = "system"
+	// ExportScopePatient exports data for all patients, via /Patient/$export.
+	ExportScopePatient ExportScope = "patient"
+	// ExportScopeGroup exports data for the patients in a Group, via
+	// /Group/<id>/$export.
+	ExportScopeGroup ExportScope = "group"
+)
+
+// ExportScopeFromString returns the ExportScope with the given name.
+func ExportScopeFromString(s string) (ExportScope, error) {
+	switch scope := ExportScope(strings.ToLower(s)); scope {
+	case ExportScopeSystem, ExportScopePatient, ExportScopeGroup:
+		return scope, nil
+	default:
+		return "", fmt.Errorf("unknown export scope %q, must be one of system, patient or group", s)
+	}
+}
+
 // Client represents a Bulk FHIR API client at some API version.
 type Client struct {
 	baseURL string
 
 	httpClient    *http.Client
 	authenticator Authenticator
+	disableGzip   bool
+	extraHeaders  http.Header
+	retryPolicy   RetryPolicy
+	// responseArchive, if set, records the responses to kick-off and job
+	// status requests.
+	responseArchive ResponseArchive
+
+	// transport is the Transport set by WithTransport, which is applied after
+	// all options, so that it is not lost if WithHTTPClient comes after it.
+	transport http.RoundTripper
+}
+
+// ClientOption configures a Client created by NewClient. Options are applied
+// in order, so a later option overrides an earlier one.
+type ClientOption func(*Client)
+
+// WithHTTPClient makes the Client send all requests, including those of the
+// Authenticator, with a copy of hc, so that callers can add instrumentation,
+// custom transports or test doubles. The copy shares hc's Transport, Jar and
+// CheckRedirect, but SetTransport does not modify hc itself. A nil hc is
+// ignored.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) {
+		if hc == nil {
+			return
+		}
+		cp := *hc
+		c.httpClient = &cp
+	}
+}
+
+// WithTransport sets the http.RoundTripper used for all requests. See
+// SetTransport. It takes precedence over the Transport of a client passed to
+// WithHTTPClient.
+func WithTransport(t http.RoundTripper) ClientOption {
+	return func(c *Client) { c.transport = t }
+}
+
+// WithDisableGzip sets whether the Client asks the server for gzip compressed
+// data. See SetDisableGzip.
+func WithDisableGzip(disable bool) ClientOption {
+	return func(c *Client) { c.disableGzip = disable }
+}
+
+// WithExtraHeaders sets headers to add to every request made to the bulk FHIR
+// server. See SetExtraHeaders.
+func WithExtraHeaders(h http.Header) ClientOption {
+	return func(c *Client) { c.extraHeaders = h.Clone() }
+}
+
+// WithRetryPolicy sets how requests are retried. NewClient returns an error if
+// the policy is invalid. See SetRetryPolicy.
+func WithRetryPolicy(p RetryPolicy) ClientOption {
+	return func(c *Client) { c.retryPolicy = p }
+}
+
+// WithResponseArchive sets where the Client archives the raw responses to
+// export kick-off and job status requests. See SetResponseArchive.
+func WithResponseArchive(a ResponseArchive) ClientOption {
+	return func(c *Client) { c.responseArchive = a }
 }
 
 // NewClient creates and returns a new bulk fhir API Client for the input
-// baseURL, using the given authenticator.
-func NewClient(baseURL string, authenticator Authenticator) (*Client, error) {
-	return &Client{
+// baseURL, using the given authenticator. By default requests are sent with a
+// new http.Client using http.DefaultTransport, with gzip compression and
+// DefaultRetryPolicy; see the ClientOptions to change these. An error is
+// returned if baseURL is not an absolute http(s) URL, the authenticator is nil
+// or the options are invalid.
+func NewClient(baseURL string, authenticator Authenticator, opts ...ClientOption) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %q, must be an absolute http(s) URL such as https://example.com/api/v2", baseURL)
+	}
+	if authenticator == nil {
+		return nil, errors.New("an authenticator is required")
+	}
+	c := &Client{
 		baseURL:       baseURL,
 		httpClient:    &http.Client{},
 		authenticator: authenticator,
-	}, nil
+		retryPolicy:   DefaultRetryPolicy(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.transport != nil {
+		c.httpClient.Transport = c.transport
+		c.transport = nil
+	}
+	if err := c.retryPolicy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid retry policy: %w", err)
+	}
+	return c, nil
+}
+
+// BaseURL returns the base URL of the bulk FHIR server the Client sends
+// requests to.
+func (c *Client) BaseURL() string { return c.baseURL }
+
+// SetDisableGzip sets whether GetData asks the server for gzip compressed
+// data. By default it does, and compressed responses are transparently
+// decompressed.
+func (c *Client) SetDisableGzip(disable bool) { c.disableGzip = disable }
+
+// SetTransport sets the http.RoundTripper used for all requests, including
+// those of the Authenticator, for example one returned by NewDebugTransport.
+// By default http.DefaultTransport is used.
+func (c *Client) SetTransport(t http.RoundTripper) { c.httpClient.Transport = t }
+
+// SetExtraHeaders sets headers to add to every request made to the bulk FHIR
+// server, including kick-off, job status and data download requests, for
+// example a tenant ID or API gateway key. They are not sent to the
+// authentication server, and do not replace the headers set by the Client or
+// its Authenticator.
+func (c *Client) SetExtraHeaders(h http.Header) { c.extraHeaders = h.Clone() }
+
+// SetRetryPolicy sets how kick-off, job status and data requests are retried.
+// By default DefaultRetryPolicy is used.
+func (c *Client) SetRetryPolicy(p RetryPolicy) { c.retryPolicy = p }
+
+// SetResponseArchive sets where the Client archives the raw responses to
+// export kick-off and job status requests, including the manifest of each
+// completed job, or stops archiving them if a is nil. A request whose
+// response cannot be archived fails.
+func (c *Client) SetResponseArchive(a ResponseArchive) { c.responseArchive = a }
+
+// archiveResponse records resp, the response to a request of the given kind
+// to requestURL, in the Client's ResponseArchive, if set. The body of resp is
+// read, and replaced so that it can still be read.
+func (c *Client) archiveResponse(ctx context.Context, kind, requestURL string, resp *http.Response) error {
+	if c.responseArchive == nil {
+		return nil
+	}
+	dump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return fmt.Errorf("failed to read %s response to archive: %w", kind, err)
+	}
+	r := ArchivedResponse{Kind: kind, RequestURL: requestURL, ReceivedAt: timeNow(), Response: dump}
+	if err := c.responseArchive.Archive(ctx, r); err != nil {
+		return fmt.Errorf("failed to archive %s response: %w", kind, err)
+	}
+	return nil
 }
 
 // Close is a placeholder for any cleanup actions needed for the Client. Please
@@ -103,10 +286,19 @@ const (
 	contentLocation = "Content-Location"
 
 	xProgress = "X-Progress"
+
+	rangeHeader = "Range"
+
+	acceptEncodingHeader  = "Accept-Encoding"
+	contentEncodingHeader = "Content-Encoding"
+	encodingGzip          = "gzip"
+	encodingXGzip         = "x-gzip"
+	encodingIdentity      = "identity"
 )
 
 // Endpoint locations
 const (
+	exportSystemEndpoint         = "/$export"
 	exportAllPatientsEndpoint    = "/Patient/$export"
 	bulkDataExportEndpointFmtStr = "/Group/%s/$export"
 )
@@ -126,8 +318,17 @@ func (c *Client) AuthenticateIfNecessary() error {
 	return c.authenticator.AuthenticateIfNecessary(c.httpClient)
 }
 
-// doHTTP wraps a call to c.httpClient.Do to apply authentication.
+// doHTTP wraps a call to c.httpClient.Do to apply authentication and any extra
+// headers.
 func (c *Client) doHTTP(req *http.Request) (*http.Response, error) {
+	for name, values := range c.extraHeaders {
+		if req.Header.Get(name) != "" {
+			continue
+		}
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
 	if err := c.authenticator.AddAuthenticationToRequest(c.httpClient, req); err != nil {
 		return nil, err
 	}
@@ -139,31 +340,121 @@ func (c *Client) doHTTP(req *http.Request) (*http.Response, error) {
 // and returns the URL to query the job status (from the response Content-
 // Location header). StartBulkDataExportAll can be used if you wish to export
 // all FHIR resources without a group ID.
-func (c *Client) StartBulkDataExport(types []cpb.ResourceTypeCode_Value, since time.Time, groupID string) (jobStatusURL string, err error) {
-	u, err := url.Parse(c.baseURL + fmt.Sprintf(bulkDataExportEndpointFmtStr, groupID))
+//
+// Each of typeFilters is sent as a separate _typeFilter parameter, and should
+// be a FHIR search query prefixed by a resource type, for example
+// "Observation?category=laboratory". Not all servers support _typeFilter.
+func (c *Client) StartBulkDataExport(types []cpb.ResourceTypeCode_Value, typeFilters []string, since time.Time, groupID string) (jobStatusURL string, err error) {
+	return c.StartBulkDataExportContext(context.Background(), types, typeFilters, since, groupID)
+}
+
+// StartBulkDataExportContext is StartBulkDataExport, except that the kick-off
+// request, including any retries, is abandoned once ctx is done.
+func (c *Client) StartBulkDataExportContext(ctx context.Context, types []cpb.ResourceTypeCode_Value, typeFilters []string, since time.Time, groupID string) (jobStatusURL string, err error) {
+	if groupID == "" {
+		return "", errors.New("groupID must be set; use StartBulkDataExportAll to export data for all patients")
+	}
+	u, err := url.Parse(c.baseURL + fmt.Sprintf(bulkDataExportEndpointFmtStr, url.PathEscape(groupID)))
 	if err != nil {
 		return "", err
 	}
-	return c.startBulkDataExportInternal(u, types, since)
+	return c.startBulkDataExportInternal(ctx, u, types, typeFilters, since, time.Time{})
 }
 
 // StartBulkDataExportAll starts a job via the bulk FHIR to begin exporting the
 // requested resource types since the provided timestamp for all patients and
-// returns the URL to query the job status.
-func (c *Client) StartBulkDataExportAll(types []cpb.ResourceTypeCode_Value, since time.Time) (jobStatusURL string, err error) {
+// returns the URL to query the job status. typeFilters is interpreted as for
+// StartBulkDataExport.
+func (c *Client) StartBulkDataExportAll(types []cpb.ResourceTypeCode_Value, typeFilters []string, since time.Time) (jobStatusURL string, err error) {
+	return c.StartBulkDataExportAllContext(context.Background(), types, typeFilters, since)
+}
+
+// StartBulkDataExportAllContext is StartBulkDataExportAll, except that the
+// kick-off request, including any retries, is abandoned once ctx is done.
+func (c *Client) StartBulkDataExportAllContext(ctx context.Context, types []cpb.ResourceTypeCode_Value, typeFilters []string, since time.Time) (jobStatusURL string, err error) {
 	u, err := url.Parse(c.baseURL + exportAllPatientsEndpoint)
 	if err != nil {
 		return "", err
 	}
-	return c.startBulkDataExportInternal(u, types, since)
+	return c.startBulkDataExportInternal(ctx, u, types, typeFilters, since, time.Time{})
+}
+
+// StartBulkDataExportSystem starts a system level export job via the bulk
+// FHIR API, exporting the requested resource types since the provided
+// timestamp for all data on the server (not just data associated with
+// patients), and returns the URL to query the job status. typeFilters is
+// interpreted as for StartBulkDataExport.
+func (c *Client) StartBulkDataExportSystem(types []cpb.ResourceTypeCode_Value, typeFilters []string, since time.Time) (jobStatusURL string, err error) {
+	return c.StartBulkDataExportSystemContext(context.Background(), types, typeFilters, since)
+}
+
+// StartBulkDataExportSystemContext is StartBulkDataExportSystem, except that the
+// kick-off request, including any retries, is abandoned once ctx is done.
+func (c *Client) StartBulkDataExportSystemContext(ctx context.Context, types []cpb.ResourceTypeCode_Value, typeFilters []string, since time.Time) (jobStatusURL string, err error) {
+	u, err := url.Parse(c.baseURL + exportSystemEndpoint)
+	if err != nil {
+		return "", err
+	}
+	return c.startBulkDataExportInternal(ctx, u, types, typeFilters, since, time.Time{})
+}
+
+// ExportParameters are the kick-off parameters of an export job started with
+// StartExportContext.
+type ExportParameters struct {
+	// Scope is the level at which to export data. It must be set.
+	Scope ExportScope
+	// GroupID is the Group to export, which must be set if Scope is
+	// ExportScopeGroup, and is otherwise ignored.
+	GroupID string
+	// Types are the resource types to export. If empty, all are exported.
+	Types []cpb.ResourceTypeCode_Value
+	// TypeFilters are interpreted as for StartBulkDataExport.
+	TypeFilters []string
+	// If set, only resources changed after Since are exported.
+	Since time.Time
+	// If set, only resources changed before Until are exported, with the
+	// _until kick-off parameter. Not all servers support _until; those which do
+	// not may export resources changed after it as well.
+	Until time.Time
+}
+
+// StartExportContext starts an export job with the given parameters, which
+// may also restrict the export to the resources changed before a time, and
+// returns the URL to query the job status.
+func (c *Client) StartExportContext(ctx context.Context, p ExportParameters) (jobStatusURL string, err error) {
+	var endpoint string
+	switch p.Scope {
+	case ExportScopeGroup:
+		if p.GroupID == "" {
+			return "", errors.New("GroupID must be set to export a Group")
+		}
+		endpoint = fmt.Sprintf(bulkDataExportEndpointFmtStr, url.PathEscape(p.GroupID))
+	case ExportScopePatient:
+		endpoint = exportAllPatientsEndpoint
+	case ExportScopeSystem:
+		endpoint = exportSystemEndpoint
+	default:
+		return "", fmt.Errorf("unknown export scope %q", p.Scope)
+	}
+	if !p.Since.IsZero() && !p.Until.IsZero() && !p.Since.Before(p.Until) {
+		return "", fmt.Errorf("export since %s must be before until %s", fhir.ToFHIRInstant(p.Since), fhir.ToFHIRInstant(p.Until))
+	}
+	u, err := url.Parse(c.baseURL + endpoint)
+	if err != nil {
+		return "", err
+	}
+	return c.startBulkDataExportInternal(ctx, u, p.Types, p.TypeFilters, p.Since, p.Until)
 }
 
-func (c *Client) startBulkDataExportInternal(u *url.URL, types []cpb.ResourceTypeCode_Value, since time.Time) (jobStatusURL string, err error) {
+func (c *Client) startBulkDataExportInternal(ctx context.Context, u *url.URL, types []cpb.ResourceTypeCode_Value, typeFilters []string, since, until time.Time) (jobStatusURL string, err error) {
 	qParams := u.Query()
 
 	if !since.IsZero() {
 		qParams.Add("_since", fhir.ToFHIRInstant(since))
 	}
+	if !until.IsZero() {
+		qParams.Add("_until", fhir.ToFHIRInstant(until))
+	}
 
 	if len(types) > 0 {
 		v, err := resourceTypesToQueryValue(types)
@@ -173,8 +464,15 @@ func (c *Client) startBulkDataExportInternal(u *url.URL, types []cpb.ResourceTyp
 		qParams.Add("_type", v)
 	}
 
+	for _, tf := range typeFilters {
+		if err := validateTypeFilter(tf); err != nil {
+			return "", err
+		}
+		qParams.Add("_typeFilter", tf)
+	}
+
 	u.RawQuery = qParams.Encode()
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return "", err
 	}
@@ -182,14 +480,21 @@ func (c *Client) startBulkDataExportInternal(u *url.URL, types []cpb.ResourceTyp
 	req.Header.Add(acceptHeader, acceptHeaderFHIRJSON)
 	req.Header.Add(preferHeader, preferHeaderAsync)
 
-	resp, err := c.doHTTP(req)
+	resp, err := c.doKickoffWithRetries(req)
 	if err != nil {
 		return "", err
 	}
+	if err := c.archiveResponse(ctx, ResponseKindKickoff, req.URL.String(), resp); err != nil {
+		return "", err
+	}
 
 	if resp.StatusCode == http.StatusUnauthorized {
 		return "", ErrorUnauthorized
 	}
+	switch resp.StatusCode {
+	case http.StatusRequestEntityTooLarge, http.StatusRequestURITooLong, http.StatusRequestHeaderFieldsTooLarge:
+		return "", fmt.Errorf("http status code %d for a %d byte URL: %w", resp.StatusCode, len(req.URL.String()), ErrorKickoffTooLarge)
+	}
 	// TODO(b/163811116): revisit possibly accecpting other 2xx status codes
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
 		return "", fmt.Errorf("unexpected non-OK and non-Accepted http status code: %d %w", resp.StatusCode, ErrorUnexpectedStatusCode)
@@ -204,6 +509,19 @@ func (c *Client) startBulkDataExportInternal(u *url.URL, types []cpb.ResourceTyp
 	return cLocations[0], nil
 }
 
+// validateTypeFilter checks that a _typeFilter value starts with a known
+// resource type followed by a search query.
+func validateTypeFilter(typeFilter string) error {
+	resourceType, query, ok := strings.Cut(typeFilter, "?")
+	if !ok || query == "" {
+		return fmt.Errorf("_typeFilter %q must be of the form ResourceType?query: %w", typeFilter, ErrorInvalidTypeFilter)
+	}
+	if _, err := ResourceTypeCodeFromName(resourceType); err != nil {
+		return fmt.Errorf("_typeFilter %q has an invalid resource type: %w", typeFilter, ErrorInvalidTypeFilter)
+	}
+	return nil
+}
+
 // JobStatus represents the current status of a bulk fhir export Job, returned from GetJobStatus.
 type JobStatus struct {
 	IsComplete      bool
@@ -211,6 +529,14 @@ type JobStatus struct {
 	RetryAfter      time.Duration
 	// ResultURLs holds the final NDJSON URLs for the job by resource type (if the job is complete).
 	ResultURLs map[cpb.ResourceTypeCode_Value][]string
+	// DeletedURLs holds the NDJSON URLs of the job's deleted Bundles (if the job
+	// is complete). Each line is a Bundle listing resources deleted since the
+	// _since time as DELETE requests.
+	DeletedURLs []string
+	// ErrorURLs holds the NDJSON URLs of the job's error files (if the job is
+	// complete). Each line is an OperationOutcome describing a problem the
+	// server encountered while exporting data.
+	ErrorURLs []string
 	// Indicates the FHIR server time when the bulk data export was processed.
 	TransactionTime time.Time
 }
@@ -237,8 +563,10 @@ func getProgress(resp *http.Response) int {
 	return progress
 }
 
+// getRetryAfter returns how long the Retry-After header of resp asks the
+// client to wait, given either as a number of seconds or as an HTTP-date, or
+// zero if there is no header or the date has passed.
 func getRetryAfter(resp *http.Response) time.Duration {
-	// Job is still pending, check X-Progress header for progress information.
 	h := resp.Header.Values("Retry-After")
 	if len(h) != 1 {
 		if len(h) > 1 {
@@ -246,11 +574,18 @@ func getRetryAfter(resp *http.Response) time.Duration {
 		}
 		return 0
 	}
-	if retryAfterSeconds, err := strconv.Atoi(h[0]); err == nil {
-		return time.Duration(retryAfterSeconds) * time.Second
+	if retryAfterSeconds, err := strconv.Atoi(strings.TrimSpace(h[0])); err == nil {
+		return max(time.Duration(retryAfterSeconds)*time.Second, 0)
+	}
+	// http.ParseTime accepts the IMF-fixdate, RFC 850 and ANSI C asctime
+	// formats of HTTP-date. Some servers send RFC 1123 dates in a zone other
+	// than GMT, which it rejects.
+	retryAfterTime, err := http.ParseTime(h[0])
+	if err != nil {
+		retryAfterTime, err = time.Parse(time.RFC1123, h[0])
 	}
-	if retryAfterTime, err := time.Parse(time.RFC1123, h[0]); err == nil {
-		return retryAfterTime.Sub(time.Now())
+	if err == nil {
+		return max(time.Until(retryAfterTime), 0)
 	}
 	log.Infof("Could not parse Retry-After header %q as date or number of seconds", h[0])
 	return 0
@@ -259,15 +594,24 @@ func getRetryAfter(resp *http.Response) time.Duration {
 // JobStatus retrieves the current JobStatus via the bulk fhir API for the
 // provided job status URL.
 func (c *Client) JobStatus(jobStatusURL string) (st JobStatus, err error) {
-	req, err := http.NewRequest(http.MethodGet, jobStatusURL, nil)
+	return c.JobStatusContext(context.Background(), jobStatusURL)
+}
+
+// JobStatusContext is JobStatus, except that the request, including any
+// retries, is abandoned once ctx is done.
+func (c *Client) JobStatusContext(ctx context.Context, jobStatusURL string) (st JobStatus, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jobStatusURL, nil)
 	if err != nil {
 		return JobStatus{}, err
 	}
 
-	resp, err := c.doHTTP(req)
+	resp, err := c.doHTTPWithRetries(req, nil)
 	if err != nil {
 		return JobStatus{}, err
 	}
+	if err := c.archiveResponse(ctx, ResponseKindJobStatus, jobStatusURL, resp); err != nil {
+		return JobStatus{}, err
+	}
 
 	switch resp.StatusCode {
 	case http.StatusAccepted:
@@ -294,6 +638,12 @@ func (c *Client) JobStatus(jobStatusURL string) (st JobStatus, err error) {
 			}
 			jobStatus.ResultURLs[r] = append(jobStatus.ResultURLs[r], item.URL)
 		}
+		for _, item := range jr.Deleted {
+			jobStatus.DeletedURLs = append(jobStatus.DeletedURLs, item.URL)
+		}
+		for _, item := range jr.Error {
+			jobStatus.ErrorURLs = append(jobStatus.ErrorURLs, item.URL)
+		}
 
 		t, err := fhir.ParseFHIRInstant(jr.TransactionTime)
 		if err != nil {
@@ -306,6 +656,11 @@ func (c *Client) JobStatus(jobStatusURL string) (st JobStatus, err error) {
 		return JobStatus{}, ErrorUnauthorized
 	case http.StatusNotFound:
 		return JobStatus{}, ErrorExportJobNotFound
+	case http.StatusTooManyRequests:
+		return JobStatus{RetryAfter: getRetryAfter(resp)}, ErrorTooManyRequests
+	case http.StatusServiceUnavailable:
+		// The server may also say when to try again while it is unavailable.
+		return JobStatus{RetryAfter: getRetryAfter(resp)}, fmt.Errorf("%w: %d", ErrorUnexpectedStatusCode, resp.StatusCode)
 	default:
 		return JobStatus{}, fmt.Errorf("%w: %d", ErrorUnexpectedStatusCode, resp.StatusCode)
 	}
@@ -328,6 +683,28 @@ type MonitorResult struct {
 // If an ErrorUnauthroized is encountered, MonitorJobStatus will attempt to
 // reauthenticate and continue trying.
 func (c *Client) MonitorJobStatus(jobStatusURL string, checkPeriod, timeout time.Duration) <-chan *MonitorResult {
+	return c.MonitorJobStatusContext(context.Background(), jobStatusURL, checkPeriod, timeout)
+}
+
+// MonitorJobStatusContext is MonitorJobStatus, except that once ctx is done it
+// stops checking the status of the job and closes the channel, without
+// sending a final result.
+func (c *Client) MonitorJobStatusContext(ctx context.Context, jobStatusURL string, checkPeriod, timeout time.Duration) <-chan *MonitorResult {
+	return c.monitorJobStatus(ctx, jobStatusURL, checkPeriod, timeout, nil)
+}
+
+// MonitorJobStatusNotifiedContext is MonitorJobStatusContext, except that
+// rather than polling the job every checkPeriod, or as often as the server
+// asks, it checks the job's status once straight away and then whenever
+// notified receives a value, such as from JobNotificationListener.Watch. The
+// job is still checked every fallbackPeriod in case a notification is lost.
+func (c *Client) MonitorJobStatusNotifiedContext(ctx context.Context, jobStatusURL string, notified <-chan struct{}, fallbackPeriod, timeout time.Duration) <-chan *MonitorResult {
+	return c.monitorJobStatus(ctx, jobStatusURL, fallbackPeriod, timeout, notified)
+}
+
+// monitorJobStatus implements MonitorJobStatusContext, and if notified is not
+// nil MonitorJobStatusNotifiedContext.
+func (c *Client) monitorJobStatus(ctx context.Context, jobStatusURL string, checkPeriod, timeout time.Duration, notified <-chan struct{}) <-chan *MonitorResult {
 	out := make(chan *MonitorResult, 100)
 	deadline := time.Now().Add(timeout)
 	go func() {
@@ -335,7 +712,10 @@ func (c *Client) MonitorJobStatus(jobStatusURL string, checkPeriod, timeout time
 		var jobStatus JobStatus
 		var err error
 		for !jobStatus.IsComplete && time.Now().Before(deadline) {
-			jobStatus, err = c.JobStatus(jobStatusURL)
+			if ctx.Err() != nil {
+				return
+			}
+			jobStatus, err = c.JobStatusContext(ctx, jobStatusURL)
 			if err != nil {
 				if errors.Is(err, ErrorExportJobNotFound) {
 					out <- &MonitorResult{Error: err}
@@ -354,11 +734,16 @@ func (c *Client) MonitorJobStatus(jobStatusURL string, checkPeriod, timeout time
 			}
 
 			if !jobStatus.IsComplete {
-				if jobStatus.RetryAfter > 0 {
+				wait := checkPeriod
+				if jobStatus.RetryAfter > 0 && (notified == nil || jobStatus.RetryAfter > wait) {
 					log.Infof("Server requests that we retry after %s", jobStatus.RetryAfter)
-					time.Sleep(jobStatus.RetryAfter)
-				} else {
-					time.Sleep(checkPeriod)
+					wait = jobStatus.RetryAfter
+				}
+				select {
+				case <-time.After(wait):
+				case <-notified:
+				case <-ctx.Done():
+					return
 				}
 			}
 		}
@@ -371,13 +756,38 @@ func (c *Client) MonitorJobStatus(jobStatusURL string, checkPeriod, timeout time
 
 // GetData retrieves the NDJSON data result from the provided BCDA result url.
 // The caller must close the dataStream io.ReadCloser when finished.
+//
+// As well as the responses retried by the Client's RetryPolicy, unauthorized
+// responses are retried after re-authenticating, and not found responses are
+// retried as BCDA returns them for files which are not yet available.
 func (c *Client) GetData(bcdaURL string) (dataStream io.ReadCloser, err error) {
-	req, err := http.NewRequest(http.MethodGet, bcdaURL, nil)
+	return c.GetDataContext(context.Background(), bcdaURL)
+}
+
+// GetDataContext is GetData, except that the request, including any retries,
+// is abandoned once ctx is done. Reading from dataStream also fails once ctx is
+// done, so that long downloads can be cancelled.
+func (c *Client) GetDataContext(ctx context.Context, bcdaURL string) (dataStream io.ReadCloser, err error) {
+	return c.GetDataWithStats(ctx, bcdaURL, nil)
+}
+
+// GetDataWithStats is GetDataContext, also recording the attempts made to
+// download the data in stats, if it is not nil. If retries do not resolve a
+// not found response, the error wraps ErrorDataNotFound.
+func (c *Client) GetDataWithStats(ctx context.Context, bcdaURL string, stats *RequestStats) (dataStream io.ReadCloser, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bcdaURL, nil)
 	if err != nil {
 		return nil, err
 	}
+	// Setting the header explicitly stops the transport from handling
+	// compression itself, so that it can be disabled.
+	if c.disableGzip {
+		req.Header.Add(acceptEncodingHeader, encodingIdentity)
+	} else {
+		req.Header.Add(acceptEncodingHeader, encodingGzip)
+	}
 
-	resp, err := c.doHTTP(req)
+	resp, err := c.doHTTPWithRetries(req, stats, http.StatusUnauthorized, http.StatusNotFound)
 	if err != nil {
 		return nil, err
 	}
@@ -385,18 +795,117 @@ func (c *Client) GetData(bcdaURL string) (dataStream io.ReadCloser, err error) {
 	// TODO(b/163811116): revisit possibly accecpting other 2xx status codes
 	switch resp.StatusCode {
 	case http.StatusOK:
-		return resp.Body, nil
+		encoding := strings.TrimSpace(resp.Header.Get(contentEncodingHeader))
+		if encoding == "" || strings.EqualFold(encoding, encodingIdentity) {
+			return resp.Body, nil
+		}
+		if !isGzipEncoding(encoding) {
+			resp.Body.Close()
+			return nil, fmt.Errorf("data has Content-Encoding %q: %w", encoding, ErrorUnsupportedContentEncoding)
+		}
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to read gzip compressed data: %w", err)
+		}
+		return &gzipReadCloser{Reader: gz, body: resp.Body}, nil
 	// Handle some explicit error cases
 	case http.StatusUnauthorized:
 		return nil, ErrorUnauthorized
 	case http.StatusNotFound:
-		// BCDA 404s need to be retried in some instances.
-		return nil, retryableNonOKError(resp.StatusCode)
+		// BCDA 404s need to be retried in some instances, but once retries are
+		// exhausted the URL has most likely expired.
+		return nil, fmt.Errorf("%w: %w", ErrorDataNotFound, retryableNonOKError(resp.StatusCode))
+	case http.StatusTooManyRequests:
+		return nil, ErrorTooManyRequests
 	default:
 		return nil, fmt.Errorf("unexpected non-OK http status code: %d %w", resp.StatusCode, ErrorUnexpectedStatusCode)
 	}
 }
 
+// CheckDataAccess checks that the client may download the NDJSON data from the
+// provided result url, without downloading it, by requesting only its first
+// byte. It returns ErrorUnauthorized or ErrorForbidden if the server denies
+// access. Servers which do not support range requests return the whole file,
+// which is not read.
+func (c *Client) CheckDataAccess(ctx context.Context, bcdaURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bcdaURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add(rangeHeader, "bytes=0-0")
+	req.Header.Add(acceptEncodingHeader, encodingIdentity)
+
+	resp, err := c.doHTTP(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	// An empty file can not satisfy the range.
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		return nil
+	case http.StatusUnauthorized:
+		return ErrorUnauthorized
+	case http.StatusForbidden:
+		return ErrorForbidden
+	default:
+		return fmt.Errorf("unexpected http status code when checking data access: %d %w", resp.StatusCode, ErrorUnexpectedStatusCode)
+	}
+}
+
+// isGzipEncoding returns whether a Content-Encoding is gzip. Content-coding
+// names are case-insensitive, and x-gzip is an alias of gzip.
+func isGzipEncoding(encoding string) bool {
+	encoding = strings.TrimSpace(encoding)
+	return strings.EqualFold(encoding, encodingGzip) || strings.EqualFold(encoding, encodingXGzip)
+}
+
+// gzipReadCloser decompresses a gzip compressed response body, closing the
+// body when closed.
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g *gzipReadCloser) Close() error {
+	return errors.Join(g.Reader.Close(), g.body.Close())
+}
+
+// CancelJob cancels the export job with the given job status URL, asking the
+// server to stop processing the job and to delete any files it has produced.
+func (c *Client) CancelJob(jobStatusURL string) error {
+	return c.CancelJobContext(context.Background(), jobStatusURL)
+}
+
+// CancelJobContext is CancelJob, except that the request is abandoned once ctx
+// is done.
+func (c *Client) CancelJobContext(ctx context.Context, jobStatusURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, jobStatusURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add(acceptHeader, acceptHeaderFHIRJSON)
+
+	resp, err := c.doHTTP(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusUnauthorized:
+		return ErrorUnauthorized
+	case http.StatusNotFound:
+		return ErrorExportJobNotFound
+	default:
+		return fmt.Errorf("unexpected http status code when cancelling job: %d %w", resp.StatusCode, ErrorUnexpectedStatusCode)
+	}
+}
+
 func retryableNonOKError(code int) error {
 	return fmt.Errorf("unexpected non-OK http status code: %d %w", code, ErrorRetryableHTTPStatus)
 }
@@ -404,6 +913,8 @@ func retryableNonOKError(code int) error {
 // jobStatusResponse represents the BCDA api response from the JobStatus endpoint.
 type jobStatusResponse struct {
 	Output          []jobStatusOutput `json:"output"`
+	Deleted         []jobStatusOutput `json:"deleted"`
+	Error           []jobStatusOutput `json:"error"`
 	TransactionTime string            `json:"transactionTime"`
 }
 
@@ -15,12 +15,15 @@
 package bulkfhir
 
 import (
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -65,9 +68,9 @@ func startBulkDataExportCases(t *testing.T, useGroupEndpoint bool) {
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
 		var err error
 		if useGroupEndpoint {
-			_, err = cl.StartBulkDataExport(nil, time.Time{}, ExportGroupAll)
+			_, err = cl.StartBulkDataExport(nil, nil, time.Time{}, ExportGroupAll)
 		} else {
-			_, err = cl.StartBulkDataExportAll(nil, time.Time{})
+			_, err = cl.StartBulkDataExportAll(nil, nil, time.Time{})
 		}
 		if err != ErrorUnauthorized {
 			t.Errorf("StartBulkDataExport unexpected error returned: got: %v, want: %v", err, ErrorUnauthorized)
@@ -135,9 +138,9 @@ func startBulkDataExportCases(t *testing.T, useGroupEndpoint bool) {
 		var err error
 		var jobURL string
 		if useGroupEndpoint {
-			jobURL, err = cl.StartBulkDataExport(resourceTypes, since, group)
+			jobURL, err = cl.StartBulkDataExport(resourceTypes, nil, since, group)
 		} else {
-			jobURL, err = cl.StartBulkDataExportAll(resourceTypes, since)
+			jobURL, err = cl.StartBulkDataExportAll(resourceTypes, nil, since)
 		}
 
 		if err != nil {
@@ -203,9 +206,9 @@ func startBulkDataExportCases(t *testing.T, useGroupEndpoint bool) {
 				var jobURL string
 				var err error
 				if useGroupEndpoint {
-					jobURL, err = cl.StartBulkDataExport(tc.resourceTypes, tc.since, ExportGroupAll)
+					jobURL, err = cl.StartBulkDataExport(tc.resourceTypes, nil, tc.since, ExportGroupAll)
 				} else {
-					jobURL, err = cl.StartBulkDataExportAll(tc.resourceTypes, tc.since)
+					jobURL, err = cl.StartBulkDataExportAll(tc.resourceTypes, nil, tc.since)
 				}
 				if err != nil {
 					t.Errorf("StartBulkDataExport(%v, %v) returned unexpected error: %v", tc.resourceTypes, tc.since, err)
@@ -226,16 +229,190 @@ func startBulkDataExportCases(t *testing.T, useGroupEndpoint bool) {
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
 		var err error
 		if useGroupEndpoint {
-			_, err = cl.StartBulkDataExport(nil, time.Time{}, ExportGroupAll)
+			_, err = cl.StartBulkDataExport(nil, nil, time.Time{}, ExportGroupAll)
 		} else {
-			_, err = cl.StartBulkDataExportAll(nil, time.Time{})
+			_, err = cl.StartBulkDataExportAll(nil, nil, time.Time{})
 		}
 		if !errors.Is(err, ErrorGreaterThanOneContentLocation) {
-			t.Errorf("StartBulkDataExport(nil, %v) unexpected underlying error got: %v want: %v", time.Time{}, err, ErrorGreaterThanOneContentLocation)
+			t.Errorf("StartBulkDataExport(nil, nil, %v) unexpected underlying error got: %v want: %v", time.Time{}, err, ErrorGreaterThanOneContentLocation)
+		}
+	})
+
+	t.Run("with group ID requiring escaping", func(t *testing.T) {
+		if !useGroupEndpoint {
+			t.Skip("only applicable to the Group endpoint")
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if want := "/Group/my%20group%2F1/$export"; req.URL.EscapedPath() != want {
+				t.Errorf("StartBulkDataExport made request with unexpected path. got: %v, want: %v", req.URL.EscapedPath(), want)
+			}
+			w.Header()["Content-Location"] = []string{"/some/url/job/1"}
+		}))
+		defer server.Close()
+
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+		if _, err := cl.StartBulkDataExport(nil, nil, time.Time{}, "my group/1"); err != nil {
+			t.Errorf("StartBulkDataExport returned unexpected error: %v", err)
+		}
+	})
+
+	t.Run("with empty group ID", func(t *testing.T) {
+		if !useGroupEndpoint {
+			t.Skip("only applicable to the Group endpoint")
+		}
+		cl := Client{authenticator: testAuthenticator{}, baseURL: "http://unused", httpClient: &http.Client{}}
+		if _, err := cl.StartBulkDataExport(nil, nil, time.Time{}, ""); err == nil {
+			t.Errorf("StartBulkDataExport with an empty group ID succeeded, want error")
+		}
+	})
+
+	t.Run("with typeFilters", func(t *testing.T) {
+		typeFilters := []string{"Observation?category=laboratory", "MedicationRequest?status=active&_lastUpdated=gt2018"}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if diff := cmp.Diff(req.URL.Query()["_typeFilter"], typeFilters); diff != "" {
+				t.Errorf("StartBulkDataExport(nil, %v) sent unexpected _typeFilter params (-got +want): %v", typeFilters, diff)
+			}
+			w.Header()["Content-Location"] = []string{"/some/url/job/1"}
+		}))
+		defer server.Close()
+
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+		var err error
+		if useGroupEndpoint {
+			_, err = cl.StartBulkDataExport(nil, typeFilters, time.Time{}, ExportGroupAll)
+		} else {
+			_, err = cl.StartBulkDataExportAll(nil, typeFilters, time.Time{})
+		}
+		if err != nil {
+			t.Errorf("StartBulkDataExport(nil, %v) returned unexpected error: %v", typeFilters, err)
+		}
+	})
+
+	t.Run("with invalid typeFilter", func(t *testing.T) {
+		for _, tf := range []string{"category=laboratory", "Observation?", "NotAResource?foo=bar"} {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				t.Errorf("StartBulkDataExport(nil, [%q]) unexpectedly made a request", tf)
+			}))
+			cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+			var err error
+			if useGroupEndpoint {
+				_, err = cl.StartBulkDataExport(nil, []string{tf}, time.Time{}, ExportGroupAll)
+			} else {
+				_, err = cl.StartBulkDataExportAll(nil, []string{tf}, time.Time{})
+			}
+			if !errors.Is(err, ErrorInvalidTypeFilter) {
+				t.Errorf("StartBulkDataExport(nil, [%q]) unexpected error got: %v want: %v", tf, err, ErrorInvalidTypeFilter)
+			}
+			server.Close()
 		}
 	})
 }
 
+func TestClient_StartBulkDataExportSystem(t *testing.T) {
+	resourceTypes := []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_ORGANIZATION}
+	typeFilters := []string{"Patient?active=true"}
+	since := time.Date(2013, 12, 9, 11, 0, 0, 123000000, time.UTC)
+	expectedJobStatusURL := "/some/url/job/1"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/$export" {
+			t.Errorf("StartBulkDataExportSystem made request with unexpected path. got: %v, want: %v", req.URL.Path, "/$export")
+		}
+		q := req.URL.Query()
+		if got, want := q.Get("_type"), "Patient,Organization"; got != want {
+			t.Errorf("StartBulkDataExportSystem sent unexpected _type value, got %v, want: %v", got, want)
+		}
+		if got, want := q.Get("_since"), "2013-12-09T11:00:00.123+00:00"; got != want {
+			t.Errorf("StartBulkDataExportSystem sent unexpected _since value, got %v, want: %v", got, want)
+		}
+		if diff := cmp.Diff(q["_typeFilter"], typeFilters); diff != "" {
+			t.Errorf("StartBulkDataExportSystem sent unexpected _typeFilter params (-got +want): %v", diff)
+		}
+		w.Header()["Content-Location"] = []string{expectedJobStatusURL}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	jobURL, err := cl.StartBulkDataExportSystem(resourceTypes, typeFilters, since)
+	if err != nil {
+		t.Errorf("StartBulkDataExportSystem returned unexpected error: %v", err)
+	}
+	if jobURL != expectedJobStatusURL {
+		t.Errorf("StartBulkDataExportSystem returned unexpected job status URL got: %v, want: %v", jobURL, expectedJobStatusURL)
+	}
+}
+
+func TestClient_StartExportContext(t *testing.T) {
+	since := time.Date(2013, 12, 9, 11, 0, 0, 0, time.UTC)
+	until := time.Date(2014, 1, 9, 11, 0, 0, 0, time.UTC)
+	expectedJobStatusURL := "/some/url/job/1"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if want := "/Group/g1/$export"; req.URL.Path != want {
+			t.Errorf("StartExportContext made request with unexpected path. got: %v, want: %v", req.URL.Path, want)
+		}
+		q := req.URL.Query()
+		if got, want := q.Get("_since"), "2013-12-09T11:00:00.000+00:00"; got != want {
+			t.Errorf("StartExportContext sent unexpected _since value, got %v, want: %v", got, want)
+		}
+		if got, want := q.Get("_until"), "2014-01-09T11:00:00.000+00:00"; got != want {
+			t.Errorf("StartExportContext sent unexpected _until value, got %v, want: %v", got, want)
+		}
+		w.Header()["Content-Location"] = []string{expectedJobStatusURL}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	jobURL, err := cl.StartExportContext(context.Background(), ExportParameters{Scope: ExportScopeGroup, GroupID: "g1", Since: since, Until: until})
+	if err != nil {
+		t.Errorf("StartExportContext returned unexpected error: %v", err)
+	}
+	if jobURL != expectedJobStatusURL {
+		t.Errorf("StartExportContext returned unexpected job status URL got: %v, want: %v", jobURL, expectedJobStatusURL)
+	}
+
+	for _, p := range []ExportParameters{
+		{Scope: ExportScopeGroup},
+		{Scope: "all"},
+		{Scope: ExportScopeSystem, Since: until, Until: since},
+	} {
+		if _, err := cl.StartExportContext(context.Background(), p); err == nil {
+			t.Errorf("StartExportContext(%+v) returned nil error", p)
+		}
+	}
+}
+
+func TestClient_StartExportContext_TooLarge(t *testing.T) {
+	for _, code := range []int{http.StatusRequestEntityTooLarge, http.StatusRequestURITooLong, http.StatusRequestHeaderFieldsTooLarge} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(code)
+			}))
+			defer server.Close()
+
+			cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+			_, err := cl.StartExportContext(context.Background(), ExportParameters{Scope: ExportScopePatient, Types: []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT}})
+			if !errors.Is(err, ErrorKickoffTooLarge) {
+				t.Errorf("StartExportContext returned unexpected error: %v, want %v", err, ErrorKickoffTooLarge)
+			}
+		})
+	}
+}
+
+func TestExportScopeFromString(t *testing.T) {
+	for in, want := range map[string]ExportScope{"system": ExportScopeSystem, "Patient": ExportScopePatient, "GROUP": ExportScopeGroup} {
+		got, err := ExportScopeFromString(in)
+		if err != nil || got != want {
+			t.Errorf("ExportScopeFromString(%q) = %q, %v, want %q, nil", in, got, err, want)
+		}
+	}
+	if _, err := ExportScopeFromString("all"); err == nil {
+		t.Errorf("ExportScopeFromString(%q) succeeded, want error", "all")
+	}
+}
+
 func TestClient_GetJobStatus(t *testing.T) {
 	t.Run("unauthorized", func(t *testing.T) {
 		server := newUnauthorizedServer(t)
@@ -374,6 +551,54 @@ func TestClient_GetJobStatus(t *testing.T) {
 		}
 	})
 
+	t.Run("job completed with deleted", func(t *testing.T) {
+		jsonResponse := `{"transactionTime": "2020-09-15T17:53:11.476Z",
+												"output":[{"type": "Patient","url": "url_1"}],
+												"deleted":[
+												{"type": "Bundle","url": "deleted_1"},
+												{"type": "Bundle","url": "deleted_2"}]}`
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(jsonResponse))
+		}))
+		jobStatusURL := server.URL
+
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+		jobStatus, err := cl.JobStatus(jobStatusURL)
+		if err != nil {
+			t.Errorf("GetJobStatus(%v) returned unexpected error: %v", jobStatusURL, err)
+		}
+		if diff := cmp.Diff([]string{"deleted_1", "deleted_2"}, jobStatus.DeletedURLs); diff != "" {
+			t.Errorf("GetJobStatus(%v) returned unexpected DeletedURLs (-want +got):\n%s", jobStatusURL, diff)
+		}
+		// Deleted Bundles are not results of the Bundle type.
+		if _, ok := jobStatus.ResultURLs[cpb.ResourceTypeCode_BUNDLE]; ok {
+			t.Errorf("GetJobStatus(%v) ResultURLs has deleted Bundles: %v", jobStatusURL, jobStatus.ResultURLs)
+		}
+	})
+
+	t.Run("job completed with errors", func(t *testing.T) {
+		jsonResponse := `{"transactionTime": "2020-09-15T17:53:11.476Z",
+												"output":[{"type": "Patient","url": "url_1"}],
+												"error":[{"type": "OperationOutcome","url": "error_1"}]}`
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(jsonResponse))
+		}))
+		jobStatusURL := server.URL
+
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+		jobStatus, err := cl.JobStatus(jobStatusURL)
+		if err != nil {
+			t.Errorf("GetJobStatus(%v) returned unexpected error: %v", jobStatusURL, err)
+		}
+		if diff := cmp.Diff([]string{"error_1"}, jobStatus.ErrorURLs); diff != "" {
+			t.Errorf("GetJobStatus(%v) returned unexpected ErrorURLs (-want +got):\n%s", jobStatusURL, diff)
+		}
+		// Error files are not results of the OperationOutcome type.
+		if _, ok := jobStatus.ResultURLs[cpb.ResourceTypeCode_OPERATION_OUTCOME]; ok {
+			t.Errorf("GetJobStatus(%v) ResultURLs has error files: %v", jobStatusURL, jobStatus.ResultURLs)
+		}
+	})
+
 	t.Run("unexpected number of X-Progress", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			w.Header()["X-Progress"] = []string{fmt.Sprintf("(%d%%)", 60), fmt.Sprintf("(%d%%)", 160)}
@@ -446,6 +671,42 @@ func TestClient_GetJobStatus(t *testing.T) {
 		}
 	})
 
+	t.Run("throttled with Retry-After", func(t *testing.T) {
+		cases := []struct {
+			name       string
+			retryAfter string
+			want       time.Duration
+		}{
+			{"seconds", "30", 30 * time.Second},
+			{"IMF-fixdate", time.Now().Add(60 * time.Second).UTC().Format(http.TimeFormat), 60 * time.Second},
+			{"RFC 850", time.Now().Add(60 * time.Second).UTC().Format(time.RFC850), 60 * time.Second},
+			{"past date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+			{"negative seconds", "-5", 0},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					w.Header()["Retry-After"] = []string{tc.retryAfter}
+					w.WriteHeader(http.StatusTooManyRequests)
+				}))
+				defer server.Close()
+
+				cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+				jobStatus, err := cl.JobStatus(server.URL)
+				if !errors.Is(err, ErrorTooManyRequests) {
+					t.Errorf("GetJobStatus(%v) returned error %v, want %v", server.URL, err, ErrorTooManyRequests)
+				}
+				delta := jobStatus.RetryAfter - tc.want
+				if delta < 0 {
+					delta = -delta
+				}
+				if delta > time.Second {
+					t.Errorf("GetJobStatus(%v) returned unexpected Retry-After; got %s, want approx %s", server.URL, jobStatus.RetryAfter, tc.want)
+				}
+			})
+		}
+	})
+
 	t.Run("invalid transaction time", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			w.Write([]byte(`{"output": [{"type": "Patient", "url": "url"}], "transactionTime" : "2013-12-09T11:00Z"}`))
@@ -523,6 +784,344 @@ func TestClient_GetData(t *testing.T) {
 			t.Errorf("GetData(%v) returned unexpected response diff. (-want +got):\n%s", path, diff)
 		}
 	})
+
+	gzipCases := []struct {
+		name                   string
+		disableGzip            bool
+		contentEncoding        string
+		wantAcceptEncoding     string
+		wantCompressedResponse bool
+	}{
+		{name: "gzip", contentEncoding: "gzip", wantAcceptEncoding: "gzip", wantCompressedResponse: true},
+		{name: "gzip upper case", contentEncoding: "GZIP", wantAcceptEncoding: "gzip", wantCompressedResponse: true},
+		{name: "x-gzip", contentEncoding: "x-gzip", wantAcceptEncoding: "gzip", wantCompressedResponse: true},
+		{name: "gzip disabled", disableGzip: true, wantAcceptEncoding: "identity"},
+	}
+	for _, tc := range gzipCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectedResponse := []byte("the response")
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.Header.Get("Accept-Encoding"); got != tc.wantAcceptEncoding {
+					t.Errorf("GetData made request with unexpected Accept-Encoding. got: %v, want: %v", got, tc.wantAcceptEncoding)
+				}
+				if got := req.Header.Get("Accept-Encoding"); got != "gzip" {
+					w.Write(expectedResponse)
+					return
+				}
+				w.Header().Set("Content-Encoding", tc.contentEncoding)
+				gz := gzip.NewWriter(w)
+				gz.Write(expectedResponse)
+				gz.Close()
+			}))
+			defer server.Close()
+
+			cl := Client{baseURL: server.URL, authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+			cl.SetDisableGzip(tc.disableGzip)
+			r, err := cl.GetData(server.URL)
+			if err != nil {
+				t.Fatalf("GetData(%v) returned unexpected error: %v", server.URL, err)
+			}
+			if _, ok := r.(*gzipReadCloser); ok != tc.wantCompressedResponse {
+				t.Errorf("GetData(%v) decompressed response: %v, want: %v", server.URL, ok, tc.wantCompressedResponse)
+			}
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Errorf("Unexpected error reading returned ReadCloser: %v", err)
+			}
+			if err := r.Close(); err != nil {
+				t.Errorf("Unexpected error closing returned ReadCloser: %v", err)
+			}
+			if diff := cmp.Diff(data, expectedResponse); diff != "" {
+				t.Errorf("GetData(%v) returned unexpected response diff. (-want +got):\n%s", server.URL, diff)
+			}
+		})
+	}
+
+	t.Run("unsupported encoding", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte("brotli compressed data"))
+		}))
+		defer server.Close()
+
+		cl := Client{baseURL: server.URL, authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+		if _, err := cl.GetData(server.URL); !errors.Is(err, ErrorUnsupportedContentEncoding) {
+			t.Errorf("GetData(%v) returned unexpected error. got: %v, want: %v", server.URL, err, ErrorUnsupportedContentEncoding)
+		}
+	})
+
+	t.Run("invalid gzip data", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte("this is not gzip compressed data"))
+		}))
+		defer server.Close()
+
+		cl := Client{baseURL: server.URL, authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+		if _, err := cl.GetData(server.URL); !errors.Is(err, gzip.ErrHeader) {
+			t.Errorf("GetData(%v) returned unexpected error. got: %v, want: %v", server.URL, err, gzip.ErrHeader)
+		}
+	})
+}
+
+func TestClient_ContextCancellation(t *testing.T) {
+	// The server never responds until the request is abandoned.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	cl.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour})
+
+	cases := []struct {
+		name string
+		call func(ctx context.Context) error
+	}{
+		{"StartBulkDataExportContext", func(ctx context.Context) error {
+			_, err := cl.StartBulkDataExportContext(ctx, nil, nil, time.Time{}, "group")
+			return err
+		}},
+		{"StartBulkDataExportAllContext", func(ctx context.Context) error {
+			_, err := cl.StartBulkDataExportAllContext(ctx, nil, nil, time.Time{})
+			return err
+		}},
+		{"StartBulkDataExportSystemContext", func(ctx context.Context) error {
+			_, err := cl.StartBulkDataExportSystemContext(ctx, nil, nil, time.Time{})
+			return err
+		}},
+		{"JobStatusContext", func(ctx context.Context) error {
+			_, err := cl.JobStatusContext(ctx, server.URL)
+			return err
+		}},
+		{"GetDataContext", func(ctx context.Context) error {
+			_, err := cl.GetDataContext(ctx, server.URL)
+			return err
+		}},
+		{"CancelJobContext", func(ctx context.Context) error {
+			return cl.CancelJobContext(ctx, server.URL)
+		}},
+		{"ProbeSupportMatrixContext", func(ctx context.Context) error {
+			_, err := cl.ProbeSupportMatrixContext(ctx)
+			return err
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if err := tc.call(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("%s() returned error %v, want %v", tc.name, err, context.DeadlineExceeded)
+			}
+		})
+	}
+}
+
+func TestClient_GetDataContext_CancelDuringDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+	cl := Client{authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := cl.GetDataContext(ctx, server.URL)
+	if err != nil {
+		t.Fatalf("GetDataContext() returned unexpected error: %v", err)
+	}
+	defer r.Close()
+	cancel()
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, context.Canceled) {
+		t.Errorf("reading data after cancelling returned error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestClient_CheckDataAccess(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  int
+		wantErr error
+	}{
+		{name: "partial content", status: http.StatusPartialContent},
+		{name: "range ignored", status: http.StatusOK},
+		{name: "empty file", status: http.StatusRequestedRangeNotSatisfiable},
+		{name: "unauthorized", status: http.StatusUnauthorized, wantErr: ErrorUnauthorized},
+		{name: "forbidden", status: http.StatusForbidden, wantErr: ErrorForbidden},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: ErrorUnexpectedStatusCode},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodGet {
+					t.Errorf("CheckDataAccess sent unexpected method %s", req.Method)
+				}
+				if got := req.Header.Get("Range"); got != "bytes=0-0" {
+					t.Errorf("CheckDataAccess sent unexpected Range header. got: %v, want: %v", got, "bytes=0-0")
+				}
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			cl := Client{baseURL: server.URL, authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+			if err := cl.CheckDataAccess(context.Background(), server.URL+"/data"); !errors.Is(err, tc.wantErr) {
+				t.Errorf("CheckDataAccess returned unexpected error. got: %v, want: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// recordingTransport records the URLs of the requests sent through it.
+type recordingTransport struct {
+	mu   sync.Mutex
+	urls []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.urls = append(rt.urls, req.URL.String())
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// clientCheckingAuthenticator fails unless it is given the wanted http.Client.
+type clientCheckingAuthenticator struct {
+	testAuthenticator
+	want *http.Client
+}
+
+func (ca clientCheckingAuthenticator) AddAuthenticationToRequest(hc *http.Client, req *http.Request) error {
+	if hc.Transport != ca.want.Transport {
+		return errors.New("authenticator was given an unexpected http.Client")
+	}
+	return nil
+}
+
+func TestClient_WithHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"output": [], "transactionTime": "2024-01-01T00:00:00Z"}`))
+	}))
+	defer server.Close()
+
+	rt := &recordingTransport{}
+	hc := &http.Client{Transport: rt}
+	cl, err := NewClient(server.URL, clientCheckingAuthenticator{want: hc}, WithHTTPClient(hc))
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	if _, err := cl.JobStatus(server.URL + "/jobs/1"); err != nil {
+		t.Fatalf("JobStatus() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(rt.urls, []string{server.URL + "/jobs/1"}); diff != "" {
+		t.Errorf("injected transport saw unexpected requests (-got +want): %s", diff)
+	}
+
+	cl.SetTransport(http.DefaultTransport)
+	if hc.Transport != rt {
+		t.Errorf("SetTransport() modified the http.Client passed to WithHTTPClient")
+	}
+}
+
+func TestNewClient_Options(t *testing.T) {
+	rt := &recordingTransport{}
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Second}
+	// WithTransport takes precedence over the client's transport, whatever the
+	// order.
+	cl, err := NewClient("https://example.com/api", testAuthenticator{},
+		WithTransport(rt),
+		WithHTTPClient(&http.Client{Transport: http.DefaultTransport}),
+		WithDisableGzip(true),
+		WithExtraHeaders(http.Header{"X-Tenant": []string{"t1"}}),
+		WithRetryPolicy(policy))
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	if cl.httpClient.Transport != rt {
+		t.Errorf("NewClient() client has transport %v, want the one passed to WithTransport", cl.httpClient.Transport)
+	}
+	if !cl.disableGzip {
+		t.Errorf("NewClient() client has gzip enabled, want it disabled")
+	}
+	if got := cl.extraHeaders.Get("X-Tenant"); got != "t1" {
+		t.Errorf("NewClient() client has X-Tenant header %q, want t1", got)
+	}
+	if diff := cmp.Diff(policy, cl.retryPolicy); diff != "" {
+		t.Errorf("NewClient() client has unexpected retry policy (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewClient_Invalid(t *testing.T) {
+	cases := []struct {
+		name          string
+		baseURL       string
+		authenticator Authenticator
+		opts          []ClientOption
+	}{
+		{name: "relative base URL", baseURL: "/api", authenticator: testAuthenticator{}},
+		{name: "base URL without scheme", baseURL: "example.com/api", authenticator: testAuthenticator{}},
+		{name: "nil authenticator", baseURL: "https://example.com/api"},
+		{name: "negative backoff", baseURL: "https://example.com/api", authenticator: testAuthenticator{}, opts: []ClientOption{WithRetryPolicy(RetryPolicy{InitialBackoff: -time.Second})}},
+		{name: "jitter above 1", baseURL: "https://example.com/api", authenticator: testAuthenticator{}, opts: []ClientOption{WithRetryPolicy(RetryPolicy{Jitter: 1.5})}},
+	}
+	for _, tc := range cases {
+		if _, err := NewClient(tc.baseURL, tc.authenticator, tc.opts...); err == nil {
+			t.Errorf("NewClient() with %s returned nil error, want an error", tc.name)
+		}
+	}
+}
+
+func TestClient_ExtraHeaders(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string]http.Header{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		got[req.URL.Path] = req.Header.Clone()
+		mu.Unlock()
+		switch req.URL.Path {
+		case "/$export":
+			w.Header().Set("Content-Location", server.URL+"/status")
+			w.WriteHeader(http.StatusAccepted)
+		case "/status":
+			w.Header().Set("X-Progress", "50%")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.Write([]byte("data"))
+		}
+	}))
+	defer server.Close()
+
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	cl.SetExtraHeaders(http.Header{
+		"X-Tenant-Id": []string{"tenant1"},
+		"X-Trace":     []string{"a", "b"},
+		"Accept":      []string{"text/plain"},
+	})
+	jobURL, err := cl.StartBulkDataExportSystem(nil, nil, time.Time{})
+	if err != nil {
+		t.Fatalf("StartBulkDataExportSystem returned unexpected error: %v", err)
+	}
+	if _, err := cl.JobStatus(jobURL); err != nil {
+		t.Fatalf("JobStatus returned unexpected error: %v", err)
+	}
+	data, err := cl.GetData(server.URL + "/data")
+	if err != nil {
+		t.Fatalf("GetData returned unexpected error: %v", err)
+	}
+	data.Close()
+
+	for _, path := range []string{"/$export", "/status", "/data"} {
+		h := got[path]
+		if h.Get("X-Tenant-Id") != "tenant1" {
+			t.Errorf("request to %s sent X-Tenant-Id %q, want %q", path, h.Get("X-Tenant-Id"), "tenant1")
+		}
+		if diff := cmp.Diff([]string{"a", "b"}, h.Values("X-Trace")); diff != "" {
+			t.Errorf("request to %s sent unexpected X-Trace headers (-want +got): %s", path, diff)
+		}
+	}
+	if diff := cmp.Diff([]string{acceptHeaderFHIRJSON}, got["/$export"].Values("Accept")); diff != "" {
+		t.Errorf("extra header replaced the kick-off Accept header (-want +got): %s", diff)
+	}
 }
 
 func TestClient_MonitorJobStatus(t *testing.T) {
@@ -546,6 +1145,58 @@ func TestClient_MonitorJobStatus(t *testing.T) {
 		}
 	})
 
+	t.Run("cancelled", func(t *testing.T) {
+		period := time.Minute
+		timeout := time.Hour
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header()["X-Progress"] = []string{fmt.Sprintf("(%d%%)", 60)}
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		jobStatusURL := server.URL
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		results := []*MonitorResult{}
+		for st := range cl.MonitorJobStatusContext(ctx, jobStatusURL, period, timeout) {
+			results = append(results, st)
+			// Cancelling while waiting for the next check closes the channel
+			// without waiting for the period or timeout.
+			cancel()
+		}
+		if len(results) != 1 || results[0].Error != nil || results[0].Status.IsComplete {
+			t.Errorf("MonitorJobStatusContext(%v,%v,%v) output %+v, want one in progress status", jobStatusURL, period, timeout, results)
+		}
+	})
+
+	t.Run("notified", func(t *testing.T) {
+		fallbackPeriod := time.Hour
+		timeout := time.Hour
+
+		var checks atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if checks.Add(1) == 1 {
+				// Asks to be polled often, which is ignored in favour of notifications.
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			w.Write([]byte(`{"transactionTime": "2020-09-15T17:53:11.476Z", "output": []}`))
+		}))
+		defer server.Close()
+		jobStatusURL := server.URL + "/jobs/1"
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+		notified := make(chan struct{}, 1)
+		results := []*MonitorResult{}
+		for st := range cl.MonitorJobStatusNotifiedContext(context.Background(), jobStatusURL, notified, fallbackPeriod, timeout) {
+			results = append(results, st)
+			notified <- struct{}{}
+		}
+		if len(results) != 2 || results[0].Status.IsComplete || !results[1].Status.IsComplete {
+			t.Errorf("MonitorJobStatusNotifiedContext(%v,%v,%v) output %+v, want one in progress and one complete status", jobStatusURL, fallbackPeriod, timeout, results)
+		}
+	})
+
 	t.Run("not found", func(t *testing.T) {
 		period := time.Second
 		timeout := time.Minute
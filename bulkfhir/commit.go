@@ -0,0 +1,172 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/bulk_fhir_tools/gcs"
+)
+
+// PendingCommit records that the outputs of an export job were durably
+// finalized, before its transaction time is stored. If a run is interrupted
+// between the two, the next run completes the commit by storing the recorded
+// transaction time, rather than exporting and processing the same data again.
+type PendingCommit struct {
+	// JobURL is the status URL of the export job.
+	JobURL string `json:"jobURL,omitempty"`
+	// Previous is the transaction time the job exported data since, which is
+	// replaced by TransactionTime when the commit is completed.
+	Previous time.Time `json:"previous,omitempty"`
+	// TransactionTime is the transaction time of the job.
+	TransactionTime time.Time `json:"transactionTime,omitempty"`
+	// Tokens describe the durable outputs reported by the sinks once they were
+	// finalized, such as the files written or a FHIR store import operation.
+	Tokens []string `json:"tokens,omitempty"`
+	// Prepared is when the commit was recorded.
+	Prepared time.Time `json:"prepared,omitempty"`
+}
+
+// Pending returns whether the PendingCommit records a commit which has not
+// been completed. An empty PendingCommit records none.
+func (pc *PendingCommit) Pending() bool {
+	return !pc.TransactionTime.IsZero()
+}
+
+// CommitLog persists a PendingCommit between runs.
+type CommitLog interface {
+	// Load the stored PendingCommit. If none has previously been stored, this
+	// returns an empty PendingCommit with no error.
+	Load(ctx context.Context) (*PendingCommit, error)
+	// Store overwrites the stored PendingCommit with the given one. Storing an
+	// empty PendingCommit marks the commit as completed.
+	Store(ctx context.Context, pc *PendingCommit) error
+}
+
+func readPendingCommit(r io.Reader, name string) (*PendingCommit, error) {
+	pc := &PendingCommit{}
+	if err := json.NewDecoder(r).Decode(pc); err != nil {
+		return nil, fmt.Errorf("failed to parse commit log %s: %w", name, err)
+	}
+	return pc, nil
+}
+
+func writePendingCommit(pc *PendingCommit, w io.WriteCloser, name string) error {
+	if err := json.NewEncoder(w).Encode(pc); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write commit log %s: %w", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write commit log %s: %w", name, err)
+	}
+	return nil
+}
+
+type localFileCommitLog struct {
+	path string
+}
+
+func (lfcl *localFileCommitLog) Load(ctx context.Context) (*PendingCommit, error) {
+	f, err := os.Open(lfcl.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &PendingCommit{}, nil
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", lfcl.path, err)
+	}
+	defer f.Close()
+	return readPendingCommit(f, lfcl.path)
+}
+
+func (lfcl *localFileCommitLog) Store(ctx context.Context, pc *PendingCommit) error {
+	// Write to a temporary file and rename it, so that a crash while writing
+	// does not corrupt the existing record. The file is synced before it is
+	// renamed, as the record must be durable before the transaction time is
+	// stored.
+	tmp := lfcl.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	if err := writePendingCommit(pc, &syncingFile{f}, lfcl.path); err != nil {
+		return err
+	}
+	return os.Rename(tmp, lfcl.path)
+}
+
+// syncingFile syncs the file to disk before closing it.
+type syncingFile struct {
+	*os.File
+}
+
+func (sf *syncingFile) Close() error {
+	if err := sf.File.Sync(); err != nil {
+		sf.File.Close()
+		return err
+	}
+	return sf.File.Close()
+}
+
+// NewLocalFileCommitLog returns a CommitLog which persists the PendingCommit
+// as JSON to a local file at the given path.
+func NewLocalFileCommitLog(path string) CommitLog {
+	return &localFileCommitLog{path: path}
+}
+
+type gcsCommitLog struct {
+	client                gcs.Client
+	relativePath, fullURI string
+}
+
+func (gcl *gcsCommitLog) Load(ctx context.Context) (*PendingCommit, error) {
+	r, err := gcl.client.GetFileReader(ctx, gcl.relativePath)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return &PendingCommit{}, nil
+		}
+		return nil, fmt.Errorf("failed to get GCS reader for %s: %w", gcl.fullURI, err)
+	}
+	defer r.Close()
+	return readPendingCommit(r, gcl.fullURI)
+}
+
+func (gcl *gcsCommitLog) Store(ctx context.Context, pc *PendingCommit) error {
+	return writePendingCommit(pc, gcl.client.GetFileWriter(ctx, gcl.relativePath), gcl.fullURI)
+}
+
+// NewGCSCommitLog returns a CommitLog which persists the PendingCommit as JSON
+// to a file in GCS at the given URI.
+func NewGCSCommitLog(ctx context.Context, gcsEndpoint, uri string) (CommitLog, error) {
+	bucket, relativePath, err := gcs.PathComponents(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := gcs.NewClient(ctx, bucket, gcsEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GCS client: %w", err)
+	}
+	return &gcsCommitLog{
+		client:       client,
+		relativePath: relativePath,
+		fullURI:      uri,
+	}, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+func testCommitLog(t *testing.T, l CommitLog) {
+	t.Helper()
+	ctx := context.Background()
+
+	got, err := l.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() of a new commit log returned unexpected error: %v", err)
+	}
+	if got.Pending() {
+		t.Errorf("Load() of a new commit log returned a pending commit: %+v", got)
+	}
+
+	want := &PendingCommit{
+		JobURL:          "http://server/job/1",
+		Previous:        time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		TransactionTime: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		Tokens:          []string{"ndjson /out: 2 resources"},
+		Prepared:        time.Date(2024, 2, 1, 1, 0, 0, 0, time.UTC),
+	}
+	if err := l.Store(ctx, want); err != nil {
+		t.Fatalf("Store() returned unexpected error: %v", err)
+	}
+	got, err = l.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Load() returned unexpected diff (-got +want): %s", diff)
+	}
+	if !got.Pending() {
+		t.Errorf("Load() returned a commit which is not pending: %+v", got)
+	}
+
+	if err := l.Store(ctx, &PendingCommit{}); err != nil {
+		t.Fatalf("Store() of an empty commit returned unexpected error: %v", err)
+	}
+	got, err = l.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() returned unexpected error: %v", err)
+	}
+	if got.Pending() {
+		t.Errorf("Load() after completing the commit returned a pending commit: %+v", got)
+	}
+}
+
+func TestLocalFileCommitLog(t *testing.T) {
+	testCommitLog(t, NewLocalFileCommitLog(filepath.Join(t.TempDir(), "commit.json")))
+}
+
+func TestGCSCommitLog(t *testing.T) {
+	gcsServer := testhelpers.NewGCSServer(t)
+	l, err := NewGCSCommitLog(context.Background(), gcsServer.URL(), "gs://commitBucket/commit.json")
+	if err != nil {
+		t.Fatalf("NewGCSCommitLog() returned unexpected error: %v", err)
+	}
+	testCommitLog(t, l)
+}
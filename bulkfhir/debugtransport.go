@@ -0,0 +1,204 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/redact"
+)
+
+// sensitiveNameParts are substrings of the (lower case) names of headers and
+// URL parameters whose values are redacted from debug traces, such as
+// Authorization, or the signature parameters of signed data URLs.
+var sensitiveNameParts = []string{"auth", "token", "secret", "password", "credential", "sig", "key", "cookie", "session"}
+
+func isSensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range sensitiveNameParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeURL returns u without user info, and with the values of sensitive
+// query parameters redacted.
+func sanitizeURL(u *url.URL) string {
+	s := *u
+	s.User = nil
+	if s.RawQuery != "" {
+		params := strings.Split(s.RawQuery, "&")
+		for i, p := range params {
+			name, _, _ := strings.Cut(p, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			if isSensitiveName(name) {
+				params[i] = url.QueryEscape(name) + "=" + redact.Placeholder
+			}
+		}
+		s.RawQuery = strings.Join(params, "&")
+	}
+	return s.String()
+}
+
+// writeHeaders writes the headers to b, one per line and sorted by name, with
+// the values of sensitive headers redacted and those holding URLs sanitized.
+func writeHeaders(b *strings.Builder, prefix string, h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			switch {
+			case isSensitiveName(name):
+				v = redact.Placeholder
+			case name == "Location" || name == contentLocation || name == "Referer":
+				if u, err := url.Parse(v); err == nil {
+					v = sanitizeURL(u)
+				}
+			}
+			fmt.Fprintf(b, "\n%s  %s: %s", prefix, name, v)
+		}
+	}
+}
+
+// DebugTransportOptions configures NewDebugTransport.
+type DebugTransportOptions struct {
+	// Trace additionally logs the connection events of each request: DNS
+	// lookups, connections (including to proxies), TLS handshakes, and whether
+	// connections were reused.
+	Trace bool
+	// Logf is called with each line of the trace. It defaults to logging at
+	// info level.
+	Logf func(format string, args ...any)
+}
+
+type debugTransport struct {
+	base  http.RoundTripper
+	trace bool
+	logf  func(format string, args ...any)
+	// lastID numbers requests, so that the lines of concurrent requests can be
+	// told apart.
+	lastID atomic.Int64
+}
+
+// NewDebugTransport returns an http.RoundTripper which makes requests with
+// base, or http.DefaultTransport if base is nil, and logs a sanitized trace of
+// each request and its response: the request and status lines, headers and
+// timings. Bodies are never logged, and the values of credentials, such as
+// the Authorization header or the signatures of signed URLs, are redacted.
+// Each redirect followed by an http.Client is logged as a separate request.
+// This is intended for debugging issues such as broken redirects or proxies
+// interfering with requests.
+func NewDebugTransport(base http.RoundTripper, opts *DebugTransportOptions) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	dt := &debugTransport{base: base, logf: log.Infof}
+	if opts != nil {
+		dt.trace = opts.Trace
+		if opts.Logf != nil {
+			dt.logf = opts.Logf
+		}
+	}
+	return dt
+}
+
+func (dt *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := fmt.Sprintf("[http %d]", dt.lastID.Add(1))
+	start := time.Now()
+	elapsed := func() time.Duration { return time.Since(start).Round(time.Millisecond) }
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s > %s %s", id, req.Method, sanitizeURL(req.URL))
+	writeHeaders(b, id+" >", req.Header)
+	dt.logf("%s", b.String())
+
+	if dt.trace {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), dt.clientTrace(id, elapsed)))
+	}
+	resp, err := dt.base.RoundTrip(req)
+	if err != nil {
+		dt.logf("%s < error after %s: %v", id, elapsed(), err)
+		return nil, err
+	}
+
+	b = &strings.Builder{}
+	fmt.Fprintf(b, "%s < %s %s (%s)", id, resp.Proto, resp.Status, elapsed())
+	writeHeaders(b, id+" <", resp.Header)
+	dt.logf("%s", b.String())
+	return resp, nil
+}
+
+func (dt *debugTransport) clientTrace(id string, elapsed func() time.Duration) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			dt.logf("%s DNS lookup of %s (%s)", id, info.Host, elapsed())
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil {
+				dt.logf("%s DNS lookup failed: %v (%s)", id, info.Err, elapsed())
+				return
+			}
+			addrs := make([]string, len(info.Addrs))
+			for i, a := range info.Addrs {
+				addrs[i] = a.String()
+			}
+			dt.logf("%s DNS lookup returned %s (%s)", id, strings.Join(addrs, ", "), elapsed())
+		},
+		ConnectStart: func(network, addr string) {
+			dt.logf("%s connecting to %s %s (%s)", id, network, addr, elapsed())
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				dt.logf("%s connecting to %s %s failed: %v (%s)", id, network, addr, err, elapsed())
+				return
+			}
+			dt.logf("%s connected to %s %s (%s)", id, network, addr, elapsed())
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				dt.logf("%s TLS handshake failed: %v (%s)", id, err, elapsed())
+				return
+			}
+			peer := ""
+			if len(state.PeerCertificates) > 0 {
+				cert := state.PeerCertificates[0]
+				peer = fmt.Sprintf(", certificate for %s issued by %s", cert.Subject, cert.Issuer)
+			}
+			dt.logf("%s TLS handshake done: %s, %s, server name %q, protocol %q%s (%s)", id, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.ServerName, state.NegotiatedProtocol, peer, elapsed())
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			dt.logf("%s using connection %s -> %s (reused %t, was idle %t for %s) (%s)", id, info.Conn.LocalAddr(), info.Conn.RemoteAddr(), info.Reused, info.WasIdle, info.IdleTime, elapsed())
+		},
+		GotFirstResponseByte: func() {
+			dt.logf("%s first response byte (%s)", id, elapsed())
+		},
+	}
+}
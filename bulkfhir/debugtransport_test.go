@@ -0,0 +1,91 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDebugTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/redirect":
+			http.Redirect(w, req, "/data?X-Goog-Signature=sig123&page=2", http.StatusFound)
+		case "/data":
+			w.Header().Set("Set-Cookie", "session=cookie123")
+			w.Write([]byte("body123"))
+		}
+	}))
+	defer server.Close()
+
+	for _, trace := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Trace=%t", trace), func(t *testing.T) {
+			var mu sync.Mutex
+			var lines []string
+			transport := NewDebugTransport(nil, &DebugTransportOptions{
+				Trace: trace,
+				Logf: func(format string, args ...any) {
+					mu.Lock()
+					defer mu.Unlock()
+					lines = append(lines, fmt.Sprintf(format, args...))
+				},
+			})
+			client := &http.Client{Transport: transport}
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/redirect?_since=2024&access_token=token123", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer token123")
+			req.Header.Set("Accept", "application/fhir+json")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Do() returned unexpected error: %v", err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			got := strings.Join(lines, "\n")
+			for _, want := range []string{
+				"[http 1] > GET " + server.URL + "/redirect?_since=2024&access_token=[REDACTED]",
+				"[http 1] >  Accept: application/fhir+json",
+				"[http 1] >  Authorization: [REDACTED]",
+				"[http 1] < HTTP/1.1 302 Found",
+				"[http 1] <  Location: /data?X-Goog-Signature=[REDACTED]&page=2",
+				"[http 2] > GET " + server.URL + "/data?X-Goog-Signature=[REDACTED]&page=2",
+				"[http 2] >  Referer: " + server.URL + "/redirect?_since=2024&access_token=[REDACTED]",
+				"[http 2] < HTTP/1.1 200 OK",
+				"[http 2] <  Set-Cookie: [REDACTED]",
+			} {
+				if !strings.Contains(got, want) {
+					t.Errorf("debug trace does not contain %q; got:\n%s", want, got)
+				}
+			}
+			for _, secret := range []string{"token123", "sig123", "cookie123", "body123"} {
+				if strings.Contains(got, secret) {
+					t.Errorf("debug trace contains %q; got:\n%s", secret, got)
+				}
+			}
+			if gotTrace := strings.Contains(got, "first response byte"); gotTrace != trace {
+				t.Errorf("debug trace contains connection events: %t, want %t; got:\n%s", gotTrace, trace, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package bulkfhir
+
+import "sync"
+
+var (
+	fileLocksMu sync.Mutex
+	fileLocks   = map[string]*sync.Mutex{}
+)
+
+// lockFile blocks until it holds an exclusive lock on path, and returns a
+// function which releases the lock. On this platform the lock only excludes
+// other goroutines of this process, not other processes.
+func lockFile(path string) (func(), error) {
+	fileLocksMu.Lock()
+	mu, ok := fileLocks[path]
+	if !ok {
+		mu = &sync.Mutex{}
+		fileLocks[path] = mu
+	}
+	fileLocksMu.Unlock()
+	mu.Lock()
+	return mu.Unlock, nil
+}
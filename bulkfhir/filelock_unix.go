@@ -0,0 +1,45 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package bulkfhir
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// lockFile blocks until it holds an exclusive lock on the file at path,
+// creating it if necessary, and returns a function which releases the lock.
+// The lock is advisory, and is released if the process exits.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return func() {
+		// Closing the file releases the lock.
+		if err := f.Close(); err != nil {
+			log.Errorf("failed to close lock file %s: %v", path, err)
+		}
+	}, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+const groupEndpointFmtStr = "/Group/%s"
+
+// GroupSnapshot records the membership of a FHIR Group at a point in time, such
+// as the attribution of patients to an ACO for a run exporting the Group.
+type GroupSnapshot struct {
+	GroupID string    `json:"groupID"`
+	Taken   time.Time `json:"taken"`
+	// Members holds the references (e.g. Patient/123) of the Group's active
+	// members, sorted.
+	Members []string `json:"members,omitempty"`
+	// Added and Removed hold the members added to and removed from the Group
+	// since the previous snapshot, as set by DiffFrom.
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// DiffFrom sets Added and Removed to the changes in membership since prev.
+func (s *GroupSnapshot) DiffFrom(prev *GroupSnapshot) {
+	s.Added, s.Removed = nil, nil
+	for _, m := range s.Members {
+		if _, found := slices.BinarySearch(prev.Members, m); !found {
+			s.Added = append(s.Added, m)
+		}
+	}
+	for _, m := range prev.Members {
+		if _, found := slices.BinarySearch(s.Members, m); !found {
+			s.Removed = append(s.Removed, m)
+		}
+	}
+}
+
+// LatestGroupSnapshot returns the snapshot of the Group with the given ID
+// recorded by the most recent run, or nil if no run recorded one.
+func (l *RunLedger) LatestGroupSnapshot(groupID string) *GroupSnapshot {
+	for i := len(l.Runs) - 1; i >= 0; i-- {
+		if g := l.Runs[i].Group; g != nil && g.GroupID == groupID {
+			return g
+		}
+	}
+	return nil
+}
+
+// GroupSnapshot reads the Group resource with the given ID from the server and
+// returns a snapshot of its active members. Not all bulk FHIR servers which
+// support exporting a Group allow reading it.
+func (c *Client) GroupSnapshot(ctx context.Context, groupID string) (*GroupSnapshot, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+fmt.Sprintf(groupEndpointFmtStr, url.PathEscape(groupID)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add(acceptHeader, acceptHeaderFHIRJSON)
+
+	resp, err := c.doHTTP(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, ErrorUnauthorized
+	case http.StatusForbidden:
+		return nil, ErrorForbidden
+	default:
+		return nil, fmt.Errorf("unexpected http status code when reading Group %s: %d %w", groupID, resp.StatusCode, ErrorUnexpectedStatusCode)
+	}
+
+	var group struct {
+		ResourceType string `json:"resourceType"`
+		Member       []struct {
+			Entity struct {
+				Reference string `json:"reference"`
+			} `json:"entity"`
+			Inactive bool `json:"inactive"`
+		} `json:"member"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&group); err != nil {
+		return nil, fmt.Errorf("failed to parse Group %s: %w", groupID, err)
+	}
+	if group.ResourceType != "Group" {
+		return nil, fmt.Errorf("reading Group %s returned a %q resource", groupID, group.ResourceType)
+	}
+	s := &GroupSnapshot{GroupID: groupID, Taken: time.Now().UTC()}
+	for _, m := range group.Member {
+		if m.Inactive || m.Entity.Reference == "" {
+			continue
+		}
+		s.Members = append(s.Members, m.Entity.Reference)
+	}
+	slices.Sort(s.Members)
+	s.Members = slices.Compact(s.Members)
+	return s, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestClient_GroupSnapshot(t *testing.T) {
+	t.Run("members", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if got, want := req.URL.EscapedPath(), "/Group/aco%201"; got != want {
+				t.Errorf("GroupSnapshot sent request to unexpected path. got: %v, want: %v", got, want)
+			}
+			w.Write([]byte(`{"resourceType":"Group","id":"aco 1","member":[
+				{"entity":{"reference":"Patient/2"}},
+				{"entity":{"reference":"Patient/1"}},
+				{"entity":{"reference":"Patient/3"},"inactive":true},
+				{"entity":{"reference":"Patient/1"}}]}`))
+		}))
+		defer server.Close()
+
+		cl := Client{baseURL: server.URL, authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+		got, err := cl.GroupSnapshot(context.Background(), "aco 1")
+		if err != nil {
+			t.Fatalf("GroupSnapshot() returned unexpected error: %v", err)
+		}
+		want := &GroupSnapshot{GroupID: "aco 1", Members: []string{"Patient/1", "Patient/2"}}
+		if diff := cmp.Diff(got, want, cmpopts.IgnoreFields(GroupSnapshot{}, "Taken")); diff != "" {
+			t.Errorf("GroupSnapshot() returned unexpected diff (-got +want): %s", diff)
+		}
+		if got.Taken.IsZero() {
+			t.Errorf("GroupSnapshot() returned a snapshot without the time taken")
+		}
+	})
+
+	errCases := []struct {
+		name    string
+		status  int
+		wantErr error
+	}{
+		{name: "unauthorized", status: http.StatusUnauthorized, wantErr: ErrorUnauthorized},
+		{name: "forbidden", status: http.StatusForbidden, wantErr: ErrorForbidden},
+		{name: "not found", status: http.StatusNotFound, wantErr: ErrorUnexpectedStatusCode},
+	}
+	for _, tc := range errCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			cl := Client{baseURL: server.URL, authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+			if _, err := cl.GroupSnapshot(context.Background(), "aco"); !errors.Is(err, tc.wantErr) {
+				t.Errorf("GroupSnapshot() returned unexpected error. got: %v, want: %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	t.Run("not a Group", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(`{"resourceType":"OperationOutcome"}`))
+		}))
+		defer server.Close()
+
+		cl := Client{baseURL: server.URL, authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+		if _, err := cl.GroupSnapshot(context.Background(), "aco"); err == nil {
+			t.Errorf("GroupSnapshot() returned no error for an OperationOutcome, want error")
+		}
+	})
+}
+
+func TestGroupSnapshotDiffFrom(t *testing.T) {
+	prev := &GroupSnapshot{GroupID: "aco", Members: []string{"Patient/1", "Patient/2", "Patient/3"}}
+	s := &GroupSnapshot{GroupID: "aco", Members: []string{"Patient/2", "Patient/4", "Patient/5"}}
+	s.DiffFrom(prev)
+	want := &GroupSnapshot{
+		GroupID: "aco",
+		Members: []string{"Patient/2", "Patient/4", "Patient/5"},
+		Added:   []string{"Patient/4", "Patient/5"},
+		Removed: []string{"Patient/1", "Patient/3"},
+	}
+	if diff := cmp.Diff(s, want); diff != "" {
+		t.Errorf("DiffFrom() produced unexpected snapshot (-got +want): %s", diff)
+	}
+}
+
+func TestRunLedgerLatestGroupSnapshot(t *testing.T) {
+	first := &GroupSnapshot{GroupID: "aco", Members: []string{"Patient/1"}}
+	other := &GroupSnapshot{GroupID: "other", Members: []string{"Patient/2"}}
+	l := &RunLedger{Runs: []RunRecord{{Group: first}, {Group: other}, {}}}
+
+	if got := l.LatestGroupSnapshot("aco"); got != first {
+		t.Errorf("LatestGroupSnapshot(aco) = %+v, want %+v", got, first)
+	}
+	if got := l.LatestGroupSnapshot("missing"); got != nil {
+		t.Errorf("LatestGroupSnapshot(missing) = %+v, want nil", got)
+	}
+}
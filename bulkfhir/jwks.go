@@ -0,0 +1,185 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// jwk holds the subset of JSON Web Key (RFC7517) fields needed to reconstruct
+// RSA and EC private keys.
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+
+	// RSA parameters.
+	N string `json:"n"`
+	E string `json:"e"`
+	D string `json:"d"`
+	P string `json:"p"`
+	Q string `json:"q"`
+
+	// EC parameters (D is shared with RSA).
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+func decodeJWKInt(field, value string) (*big.Int, error) {
+	if value == "" {
+		return nil, fmt.Errorf("JWK is missing the %q parameter", field)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("JWK parameter %q is not valid base64url: %w", field, err)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) rsaKey() (*rsa.PrivateKey, error) {
+	var ints [5]*big.Int
+	for i, f := range []struct{ name, value string }{{"n", k.N}, {"e", k.E}, {"d", k.D}, {"p", k.P}, {"q", k.Q}} {
+		v, err := decodeJWKInt(f.name, f.value)
+		if err != nil {
+			return nil, err
+		}
+		ints[i] = v
+	}
+	if !ints[1].IsInt64() {
+		return nil, errors.New("JWK RSA exponent is too large")
+	}
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: ints[0], E: int(ints[1].Int64())},
+		D:         ints[2],
+		Primes:    []*big.Int{ints[3], ints[4]},
+	}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid JWK RSA key: %w", err)
+	}
+	key.Precompute()
+	return key, nil
+}
+
+func (k *jwk) ecKey() (*ecdsa.PrivateKey, error) {
+	// Only P-384 keys can sign the ES384 JWTs (see signingMethodForKey), so
+	// other curves are rejected here rather than at the first token exchange.
+	if k.Curve != "P-384" {
+		return nil, fmt.Errorf("EC keys must use the P-384 curve for ES384 signing, got %s", k.Curve)
+	}
+	curve := elliptic.P384()
+	var ints [3]*big.Int
+	for i, f := range []struct{ name, value string }{{"x", k.X}, {"y", k.Y}, {"d", k.D}} {
+		v, err := decodeJWKInt(f.name, f.value)
+		if err != nil {
+			return nil, err
+		}
+		ints[i] = v
+	}
+	if !curve.IsOnCurve(ints[0], ints[1]) {
+		return nil, errors.New("invalid JWK EC key: point is not on the curve")
+	}
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: ints[0], Y: ints[1]},
+		D:         ints[2],
+	}, nil
+}
+
+func (k *jwk) privateKey() (crypto.Signer, error) {
+	switch k.KeyType {
+	case "RSA":
+		return k.rsaKey()
+	case "EC":
+		return k.ecKey()
+	default:
+		return nil, fmt.Errorf("unsupported JWK key type %q", k.KeyType)
+	}
+}
+
+// jwksFileKeyProvider is an implementation of JWTKeyProvider which reads a
+// private key from a JSON Web Key Set stored in a local file, or from data if
+// set.
+type jwksFileKeyProvider struct {
+	filename, keyID string
+	data            []byte
+	key             crypto.Signer
+}
+
+func (jfkp *jwksFileKeyProvider) Key() (crypto.Signer, error) {
+	if jfkp.key != nil {
+		return jfkp.key, nil
+	}
+	data := jfkp.data
+	if data == nil {
+		var err error
+		data, err = os.ReadFile(jfkp.filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var set jwks
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS file %s: %w", jfkp.filename, err)
+	}
+	for _, k := range set.Keys {
+		if jfkp.keyID != "" && k.KeyID != jfkp.keyID {
+			continue
+		}
+		if jfkp.keyID == "" && len(set.Keys) > 1 {
+			return nil, fmt.Errorf("JWKS file %s contains %d keys; a key ID must be specified", jfkp.filename, len(set.Keys))
+		}
+		key, err := k.privateKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %q from JWKS file %s: %w", k.KeyID, jfkp.filename, err)
+		}
+		jfkp.keyID = k.KeyID
+		jfkp.key = key
+		return jfkp.key, nil
+	}
+	return nil, fmt.Errorf("JWKS file %s does not contain a key with ID %q", jfkp.filename, jfkp.keyID)
+}
+
+func (jfkp *jwksFileKeyProvider) KeyID() string {
+	return jfkp.keyID
+}
+
+// NewJWKSFileKeyProvider returns a JWTKeyProvider which reads a private key
+// from a JSON Web Key Set (RFC7517) in the given file. If keyID is empty, the
+// set must contain exactly one key, and that key's "kid" is used.
+//
+// Note that KeyID only returns the key ID from the file after Key has been
+// called.
+func NewJWKSFileKeyProvider(filename, keyID string) JWTKeyProvider {
+	return &jwksFileKeyProvider{filename: filename, keyID: keyID}
+}
+
+// NewJWKSKeyProvider is like NewJWKSFileKeyProvider, but reads the JSON Web Key
+// Set from data rather than a local file. source is only used to identify the
+// key set in error messages.
+func NewJWKSKeyProvider(source string, data []byte, keyID string) JWTKeyProvider {
+	return &jwksFileKeyProvider{filename: source, keyID: keyID, data: data}
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func b64(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) jwk {
+	return jwk{
+		KeyType: "RSA",
+		KeyID:   kid,
+		N:       b64(key.N),
+		E:       b64(big.NewInt(int64(key.E))),
+		D:       b64(key.D),
+		P:       b64(key.Primes[0]),
+		Q:       b64(key.Primes[1]),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) jwk {
+	return jwk{
+		KeyType: "EC",
+		KeyID:   kid,
+		Curve:   key.Curve.Params().Name,
+		X:       b64(key.X),
+		Y:       b64(key.Y),
+		D:       b64(key.D),
+	}
+}
+
+func writeJWKS(t *testing.T, keys ...jwk) string {
+	t.Helper()
+	data, err := json.Marshal(jwks{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestJWKSFileKeyProvider(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		keys      []jwk
+		keyID     string
+		want      crypto.Signer
+		wantKeyID string
+		wantErr   string
+	}{
+		{
+			name:      "single RSA key without key ID",
+			keys:      []jwk{rsaJWK("rsa-kid", rsaKey)},
+			want:      rsaKey,
+			wantKeyID: "rsa-kid",
+		},
+		{
+			name:      "single EC key without key ID",
+			keys:      []jwk{ecJWK("ec-kid", ecKey)},
+			want:      ecKey,
+			wantKeyID: "ec-kid",
+		},
+		{
+			name:      "selects key by ID",
+			keys:      []jwk{rsaJWK("rsa-kid", rsaKey), ecJWK("ec-kid", ecKey)},
+			keyID:     "ec-kid",
+			want:      ecKey,
+			wantKeyID: "ec-kid",
+		},
+		{
+			name:    "multiple keys without key ID",
+			keys:    []jwk{rsaJWK("rsa-kid", rsaKey), ecJWK("ec-kid", ecKey)},
+			wantErr: "key ID",
+		},
+		{
+			name:    "key ID not found",
+			keys:    []jwk{rsaJWK("rsa-kid", rsaKey)},
+			keyID:   "other-kid",
+			wantErr: "other-kid",
+		},
+		{
+			name:    "public key only",
+			keys:    []jwk{{KeyType: "EC", KeyID: "ec-kid", Curve: "P-384", X: b64(ecKey.X), Y: b64(ecKey.Y)}},
+			wantErr: `"d"`,
+		},
+		{
+			name:    "EC key not on P-384",
+			keys:    []jwk{ecJWK("ec-kid", p256Key)},
+			wantErr: "EC keys must use the P-384 curve for ES384 signing, got P-256",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			kp := NewJWKSFileKeyProvider(writeJWKS(t, tc.keys...), tc.keyID)
+			got, err := kp.Key()
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("Key() returned error %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Key() returned unexpected error: %v", err)
+			}
+			if !tc.want.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(got.Public()) {
+				t.Errorf("Key() returned an unexpected key")
+			}
+			if kp.KeyID() != tc.wantKeyID {
+				t.Errorf("KeyID() = %q, want %q", kp.KeyID(), tc.wantKeyID)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/bulk_fhir_tools/gcs"
+)
+
+// RunLedger is a persistent record of what is known about a bulk FHIR server
+// and of previous fetch runs against it, used to configure subsequent runs.
+type RunLedger struct {
+	// SupportMatrix is the result of the most recent ProbeSupportMatrix call, or
+	// nil if the server has never been probed.
+	SupportMatrix *SupportMatrix `json:"supportMatrix,omitempty"`
+	// Runs holds a record of each fetch run, oldest first.
+	Runs []RunRecord `json:"runs,omitempty"`
+
+	// TotalDownloadedBytes is the number of bytes downloaded across all
+	// recorded runs.
+	TotalDownloadedBytes int64 `json:"totalDownloadedBytes,omitempty"`
+	// TotalUploadedBytes maps the name of each sink to the number of bytes
+	// written to it across all recorded runs.
+	TotalUploadedBytes map[string]int64 `json:"totalUploadedBytes,omitempty"`
+	// CompactedRuns is the number of runs removed from Runs by Compact. Their
+	// bytes are still included in the cumulative totals.
+	CompactedRuns int `json:"compactedRuns,omitempty"`
+}
+
+// Compact removes the records of runs which ended before the given time, so
+// that the ledger does not grow without bound. It returns the number of runs
+// removed.
+func (l *RunLedger) Compact(before time.Time) int {
+	kept := l.Runs[:0]
+	for _, r := range l.Runs {
+		if !r.End.Before(before) {
+			kept = append(kept, r)
+		}
+	}
+	removed := len(l.Runs) - len(kept)
+	clear(l.Runs[len(kept):])
+	l.Runs = kept
+	l.CompactedRuns += removed
+	return removed
+}
+
+// EncodedSize returns the size in bytes of the ledger as stored.
+func (l *RunLedger) EncodedSize() (int, error) {
+	var b bytes.Buffer
+	if err := writeLedger(l, nopWriteCloser{&b}, "in memory"); err != nil {
+		return 0, err
+	}
+	return b.Len(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// AddRun appends the run to the ledger, updating the per-run and cumulative
+// byte totals.
+func (l *RunLedger) AddRun(r RunRecord) {
+	r.TotalDownloadedBytes = 0
+	for _, n := range r.DownloadedBytes {
+		r.TotalDownloadedBytes += n
+	}
+	l.TotalDownloadedBytes += r.TotalDownloadedBytes
+	for sink, n := range r.UploadedBytes {
+		if l.TotalUploadedBytes == nil {
+			l.TotalUploadedBytes = map[string]int64{}
+		}
+		l.TotalUploadedBytes[sink] += n
+	}
+	l.Runs = append(l.Runs, r)
+}
+
+// RunRecord is the ledger entry for a single fetch run.
+type RunRecord struct {
+	// RunID identifies the run. It is also the code of the meta.tag added to
+	// resources loaded by the run, if they are tagged.
+	RunID string    `json:"runID,omitempty"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// JobURL is the export job status URL, if a job was started.
+	JobURL string `json:"jobURL,omitempty"`
+	// TransactionTime is the transaction time reported by the server, if the
+	// export job completed.
+	TransactionTime time.Time `json:"transactionTime,omitempty"`
+	// Error is the error the run failed with, or empty if it succeeded.
+	Error string `json:"error,omitempty"`
+
+	// DownloadedBytes maps each downloaded data URL to the number of bytes
+	// downloaded from it.
+	DownloadedBytes map[string]int64 `json:"downloadedBytes,omitempty"`
+	// TotalDownloadedBytes is the sum of DownloadedBytes, set by AddRun.
+	TotalDownloadedBytes int64 `json:"totalDownloadedBytes,omitempty"`
+	// DownloadRetries maps each data URL which was retried or failed to
+	// download to the requests made for it.
+	DownloadRetries map[string]*RequestStats `json:"downloadRetries,omitempty"`
+	// UploadedBytes maps the name of each sink to the number of bytes of
+	// resource JSON written to it.
+	UploadedBytes map[string]int64 `json:"uploadedBytes,omitempty"`
+
+	// Group is the snapshot of the membership of the exported Group taken at
+	// the start of the run, if one was taken.
+	Group *GroupSnapshot `json:"group,omitempty"`
+
+	// Window is the period of changes exported by the run, if it exported one
+	// window of a backfill.
+	Window *ExportWindow `json:"window,omitempty"`
+}
+
+// ExportWindow is a period of changes requested from a server by an export
+// job, from the _since to the _until kick-off parameters.
+type ExportWindow struct {
+	Since time.Time `json:"since,omitempty"`
+	Until time.Time `json:"until"`
+}
+
+// RunLedgerStore persists a RunLedger between runs.
+type RunLedgerStore interface {
+	// Load the stored ledger. If no ledger has previously been stored, this
+	// returns an empty ledger with no error.
+	Load(ctx context.Context) (*RunLedger, error)
+	// Store overwrites the stored ledger with the given one.
+	Store(ctx context.Context, l *RunLedger) error
+}
+
+func readLedger(r io.Reader, name string) (*RunLedger, error) {
+	l := &RunLedger{}
+	if err := json.NewDecoder(r).Decode(l); err != nil {
+		return nil, fmt.Errorf("failed to parse run ledger %s: %w", name, err)
+	}
+	return l, nil
+}
+
+func writeLedger(l *RunLedger, w io.WriteCloser, name string) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(l); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write run ledger %s: %w", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write run ledger %s: %w", name, err)
+	}
+	return nil
+}
+
+type localFileRunLedgerStore struct {
+	path string
+}
+
+func (lfrls *localFileRunLedgerStore) Load(ctx context.Context) (*RunLedger, error) {
+	f, err := os.Open(lfrls.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &RunLedger{}, nil
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", lfrls.path, err)
+	}
+	defer f.Close()
+	return readLedger(f, lfrls.path)
+}
+
+func (lfrls *localFileRunLedgerStore) Store(ctx context.Context, l *RunLedger) error {
+	// Write to a temporary file and rename it, so that a failed write does not
+	// corrupt the existing ledger.
+	tmp := lfrls.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	if err := writeLedger(l, f, lfrls.path); err != nil {
+		return err
+	}
+	return os.Rename(tmp, lfrls.path)
+}
+
+// NewLocalFileRunLedgerStore returns a RunLedgerStore which persists the ledger
+// as JSON to a local file at the given path.
+func NewLocalFileRunLedgerStore(path string) RunLedgerStore {
+	return &localFileRunLedgerStore{path: path}
+}
+
+type gcsRunLedgerStore struct {
+	client                gcs.Client
+	relativePath, fullURI string
+}
+
+func (grls *gcsRunLedgerStore) Load(ctx context.Context) (*RunLedger, error) {
+	r, err := grls.client.GetFileReader(ctx, grls.relativePath)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return &RunLedger{}, nil
+		}
+		return nil, fmt.Errorf("failed to get GCS reader for %s: %w", grls.fullURI, err)
+	}
+	defer r.Close()
+	return readLedger(r, grls.fullURI)
+}
+
+func (grls *gcsRunLedgerStore) Store(ctx context.Context, l *RunLedger) error {
+	return writeLedger(l, grls.client.GetFileWriter(ctx, grls.relativePath), grls.fullURI)
+}
+
+// NewGCSRunLedgerStore returns a RunLedgerStore which persists the ledger as
+// JSON to a file in GCS at the given URI.
+func NewGCSRunLedgerStore(ctx context.Context, gcsEndpoint, uri string) (RunLedgerStore, error) {
+	bucket, relativePath, err := gcs.PathComponents(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := gcs.NewClient(ctx, bucket, gcsEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GCS client: %w", err)
+	}
+	return &gcsRunLedgerStore{
+		client:       client,
+		relativePath: relativePath,
+		fullURI:      uri,
+	}, nil
+}
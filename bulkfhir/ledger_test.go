@@ -0,0 +1,144 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+func testRunLedgerStore(t *testing.T, s RunLedgerStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	got, err := s.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() of a new ledger returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, &RunLedger{}); diff != "" {
+		t.Errorf("Load() of a new ledger returned unexpected diff (-got +want): %s", diff)
+	}
+
+	want := &RunLedger{
+		SupportMatrix: &SupportMatrix{
+			ProbedAt:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			TypeFilter: FeatureSupported,
+			Elements:   FeatureUnsupported,
+		},
+		Runs: []RunRecord{{
+			Start:           time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			End:             time.Date(2024, 1, 2, 4, 4, 5, 0, time.UTC),
+			JobURL:          "http://server/job/1",
+			TransactionTime: time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC),
+		}},
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Store(ctx, want); err != nil {
+			t.Fatalf("Store() returned unexpected error: %v", err)
+		}
+	}
+	got, err = s.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Load() returned unexpected diff (-got +want): %s", diff)
+	}
+}
+
+func TestLocalFileRunLedgerStore(t *testing.T) {
+	testRunLedgerStore(t, NewLocalFileRunLedgerStore(filepath.Join(t.TempDir(), "ledger.json")))
+}
+
+func TestGCSRunLedgerStore(t *testing.T) {
+	gcsServer := testhelpers.NewGCSServer(t)
+	s, err := NewGCSRunLedgerStore(context.Background(), gcsServer.URL(), "gs://ledgerBucket/ledger.json")
+	if err != nil {
+		t.Fatalf("NewGCSRunLedgerStore() returned unexpected error: %v", err)
+	}
+	testRunLedgerStore(t, s)
+}
+
+func TestRunLedgerAddRun(t *testing.T) {
+	l := &RunLedger{}
+	l.AddRun(RunRecord{
+		DownloadedBytes: map[string]int64{"http://server/a": 10, "http://server/b": 5},
+		UploadedBytes:   map[string]int64{"ndjson": 12},
+	})
+	l.AddRun(RunRecord{
+		DownloadedBytes: map[string]int64{"http://server/c": 7},
+		UploadedBytes:   map[string]int64{"ndjson": 6, "bigquery": 6},
+	})
+
+	want := &RunLedger{
+		Runs: []RunRecord{{
+			DownloadedBytes:      map[string]int64{"http://server/a": 10, "http://server/b": 5},
+			TotalDownloadedBytes: 15,
+			UploadedBytes:        map[string]int64{"ndjson": 12},
+		}, {
+			DownloadedBytes:      map[string]int64{"http://server/c": 7},
+			TotalDownloadedBytes: 7,
+			UploadedBytes:        map[string]int64{"ndjson": 6, "bigquery": 6},
+		}},
+		TotalDownloadedBytes: 22,
+		TotalUploadedBytes:   map[string]int64{"ndjson": 18, "bigquery": 6},
+	}
+	if diff := cmp.Diff(l, want); diff != "" {
+		t.Errorf("AddRun() produced unexpected ledger (-got +want): %s", diff)
+	}
+}
+
+func TestRunLedgerCompact(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	l := &RunLedger{
+		Runs:                 []RunRecord{{End: day(1)}, {End: day(2)}, {End: day(3)}},
+		TotalDownloadedBytes: 30,
+		CompactedRuns:        4,
+	}
+
+	if got := l.Compact(day(2)); got != 1 {
+		t.Errorf("Compact() removed %d runs, want 1", got)
+	}
+	want := &RunLedger{
+		Runs:                 []RunRecord{{End: day(2)}, {End: day(3)}},
+		TotalDownloadedBytes: 30,
+		CompactedRuns:        5,
+	}
+	if diff := cmp.Diff(l, want); diff != "" {
+		t.Errorf("Compact() produced unexpected ledger (-got +want): %s", diff)
+	}
+
+	size, err := l.EncodedSize()
+	if err != nil {
+		t.Fatalf("EncodedSize() returned unexpected error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	if err := NewLocalFileRunLedgerStore(path).Store(context.Background(), l); err != nil {
+		t.Fatalf("Store() returned unexpected error: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat ledger: %v", err)
+	}
+	if int64(size) != fi.Size() {
+		t.Errorf("EncodedSize() = %d, want the stored size %d", size, fi.Size())
+	}
+}
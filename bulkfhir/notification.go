@@ -0,0 +1,124 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// maxNotificationBytes is the largest notification body which is read.
+const maxNotificationBytes = 1 << 20
+
+// JobNotificationListener receives notifications that export jobs have
+// completed, from servers which push them rather than being polled, such as
+// through a FHIR Subscription with a rest-hook channel or an export completion
+// webhook. It is an http.Handler, to be served on an address the server can
+// reach, and each notification wakes the MonitorJobStatusNotifiedContext calls
+// watching the jobs it names, so that they check the job's status straight
+// away.
+//
+// A notification names a job if its body or Content-Location header holds the
+// job's status URL, as a SubscriptionStatus focus reference or a field of a
+// webhook's JSON for example. Notifications which do not name any job being
+// watched, including Subscription handshakes and heartbeats, wake every
+// watcher, as checking a job's status is cheap. It is safe to use from
+// multiple goroutines.
+type JobNotificationListener struct {
+	secret string
+
+	mu       sync.Mutex
+	watchers map[*jobWatcher]bool
+}
+
+type jobWatcher struct {
+	jobStatusURL string
+	notified     chan struct{}
+}
+
+// NewJobNotificationListener returns a new JobNotificationListener. If secret
+// is not empty, notifications must be sent with it as a bearer token in their
+// Authorization header, which for a FHIR Subscription can be set in its
+// channel.header, and others are rejected.
+func NewJobNotificationListener(secret string) *JobNotificationListener {
+	return &JobNotificationListener{secret: secret, watchers: map[*jobWatcher]bool{}}
+}
+
+// Watch returns a channel which receives a value when a notification for the
+// job with the given status URL is received, and a function to call once the
+// job is no longer being waited for. Notifications received while a previous
+// one has not been read are merged.
+func (l *JobNotificationListener) Watch(jobStatusURL string) (notified <-chan struct{}, stop func()) {
+	w := &jobWatcher{jobStatusURL: jobStatusURL, notified: make(chan struct{}, 1)}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.watchers[w] = true
+	return w.notified, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.watchers, w)
+	}
+}
+
+// ServeHTTP is http.Handler.ServeHTTP.
+func (l *JobNotificationListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "notifications must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	if l.secret != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+l.secret)) != 1 {
+		http.Error(w, "invalid authorization", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxNotificationBytes))
+	if err != nil {
+		http.Error(w, "could not read notification", http.StatusBadRequest)
+		return
+	}
+	l.notify(req.Header.Get("Content-Location") + "\n" + string(body))
+	w.WriteHeader(http.StatusOK)
+}
+
+// notify wakes the watchers of the jobs named in notification, or every
+// watcher if it names none of them.
+func (l *JobNotificationListener) notify(notification string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var named []*jobWatcher
+	for w := range l.watchers {
+		if strings.Contains(notification, w.jobStatusURL) {
+			named = append(named, w)
+		}
+	}
+	if len(named) == 0 {
+		log.Infof("Received a job notification which does not name a job being waited for, checking the status of all %d", len(l.watchers))
+		for w := range l.watchers {
+			named = append(named, w)
+		}
+	}
+	for _, w := range named {
+		log.Infof("Received a job notification for export job %s", w.jobStatusURL)
+		select {
+		case w.notified <- struct{}{}:
+		default:
+		}
+	}
+}
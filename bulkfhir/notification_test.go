@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJobNotificationListener(t *testing.T) {
+	const job1, job2 = "https://server/jobs/1", "https://server/jobs/2"
+	subscriptionNotification := `{"resourceType": "Bundle", "type": "history", "entry": [{"resource": {"resourceType": "SubscriptionStatus", "notificationEvent": [{"focus": {"reference": "` + job1 + `"}}]}}]}`
+	cases := []struct {
+		name            string
+		method          string
+		authorization   string
+		contentLocation string
+		body            string
+		wantStatus      int
+		wantNotified    []string
+	}{
+		{name: "subscription notification", method: http.MethodPost, authorization: "Bearer secret", body: subscriptionNotification, wantStatus: http.StatusOK, wantNotified: []string{job1}},
+		{name: "content location", method: http.MethodPost, authorization: "Bearer secret", contentLocation: job2, wantStatus: http.StatusOK, wantNotified: []string{job2}},
+		{name: "names no job", method: http.MethodPost, authorization: "Bearer secret", body: `{"type": "heartbeat"}`, wantStatus: http.StatusOK, wantNotified: []string{job1, job2}},
+		{name: "wrong secret", method: http.MethodPost, authorization: "Bearer other", body: subscriptionNotification, wantStatus: http.StatusUnauthorized},
+		{name: "no secret", method: http.MethodPost, body: subscriptionNotification, wantStatus: http.StatusUnauthorized},
+		{name: "get", method: http.MethodGet, authorization: "Bearer secret", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewJobNotificationListener("secret")
+			notified := map[string]<-chan struct{}{}
+			for _, job := range []string{job1, job2} {
+				ch, stop := l.Watch(job)
+				defer stop()
+				notified[job] = ch
+			}
+
+			req := httptest.NewRequest(tc.method, "/", strings.NewReader(tc.body))
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			if tc.contentLocation != "" {
+				req.Header.Set("Content-Location", tc.contentLocation)
+			}
+			w := httptest.NewRecorder()
+			l.ServeHTTP(w, req)
+			if w.Code != tc.wantStatus {
+				t.Errorf("ServeHTTP() returned status %d, want %d", w.Code, tc.wantStatus)
+			}
+
+			for job, ch := range notified {
+				wantNotified := false
+				for _, j := range tc.wantNotified {
+					wantNotified = wantNotified || j == job
+				}
+				gotNotified := false
+				select {
+				case <-ch:
+					gotNotified = true
+				default:
+				}
+				if gotNotified != wantNotified {
+					t.Errorf("watcher of %s notified: %t, want %t", job, gotNotified, wantNotified)
+				}
+			}
+		})
+	}
+}
+
+func TestJobNotificationListener_Stop(t *testing.T) {
+	l := NewJobNotificationListener("")
+	notified, stop := l.Watch("https://server/jobs/1")
+	stop()
+	l.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://server/jobs/1")))
+	select {
+	case <-notified:
+		t.Error("watcher was notified after it was stopped")
+	default:
+	}
+}
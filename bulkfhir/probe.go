@@ -0,0 +1,173 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// FeatureSupport records whether a server supports an optional feature of the
+// bulk data specification.
+type FeatureSupport string
+
+const (
+	// FeatureUnknown indicates support for the feature could not be determined.
+	FeatureUnknown FeatureSupport = ""
+	// FeatureSupported indicates the server supports the feature.
+	FeatureSupported FeatureSupport = "supported"
+	// FeatureUnsupported indicates the server does not support the feature.
+	FeatureUnsupported FeatureSupport = "unsupported"
+)
+
+// SupportMatrix records which optional bulk data features a server supports,
+// as determined by ProbeSupportMatrix.
+type SupportMatrix struct {
+	ProbedAt time.Time `json:"probedAt"`
+
+	// TypeFilter is support for the _typeFilter kick-off parameter.
+	TypeFilter FeatureSupport `json:"typeFilter,omitempty"`
+	// Elements is support for the _elements kick-off parameter.
+	Elements FeatureSupport `json:"elements,omitempty"`
+	// AllowPartialManifests is support for the allowPartialManifests kick-off
+	// parameter.
+	AllowPartialManifests FeatureSupport `json:"allowPartialManifests,omitempty"`
+	// DeletedFiles is support for reporting deleted resources in the "deleted"
+	// field of the manifest. This can only be observed from the manifest of a
+	// completed export, so is not determined by ProbeSupportMatrix.
+	DeletedFiles FeatureSupport `json:"deletedFiles,omitempty"`
+	// AcceptEncodingGzip is support for gzip compressed responses.
+	AcceptEncodingGzip FeatureSupport `json:"acceptEncodingGzip,omitempty"`
+}
+
+// Used for testing.
+var probeTimeNow = time.Now
+
+// ProbeSupportMatrix determines which optional bulk data features the server
+// supports.
+//
+// Kick-off parameters are probed by starting a Patient level export of Patient
+// resources with the parameter set and strict handling requested, and checking
+// whether the server accepts it. Any export which is started is cancelled
+// immediately. Gzip support is probed by requesting the server's
+// CapabilityStatement with an Accept-Encoding: gzip header.
+func (c *Client) ProbeSupportMatrix() (*SupportMatrix, error) {
+	return c.ProbeSupportMatrixContext(context.Background())
+}
+
+// ProbeSupportMatrixContext is ProbeSupportMatrix, except that probing is
+// abandoned once ctx is done.
+func (c *Client) ProbeSupportMatrixContext(ctx context.Context) (*SupportMatrix, error) {
+	m := &SupportMatrix{ProbedAt: probeTimeNow().UTC()}
+	var err error
+	if m.TypeFilter, err = c.probeKickOffParameter(ctx, "_typeFilter", "Patient?active=true"); err != nil {
+		return nil, err
+	}
+	if m.Elements, err = c.probeKickOffParameter(ctx, "_elements", "id"); err != nil {
+		return nil, err
+	}
+	if m.AllowPartialManifests, err = c.probeKickOffParameter(ctx, "allowPartialManifests", "true"); err != nil {
+		return nil, err
+	}
+	if m.AcceptEncodingGzip, err = c.probeGzip(ctx); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *Client) probeKickOffParameter(ctx context.Context, name, value string) (FeatureSupport, error) {
+	u, err := url.Parse(c.baseURL + exportAllPatientsEndpoint)
+	if err != nil {
+		return FeatureUnknown, err
+	}
+	u.RawQuery = url.Values{"_type": {"Patient"}, name: {value}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return FeatureUnknown, err
+	}
+	req.Header.Add(acceptHeader, acceptHeaderFHIRJSON)
+	req.Header.Add(preferHeader, preferHeaderAsync)
+	// Servers should otherwise ignore unsupported parameters.
+	req.Header.Add(preferHeader, "handling=strict")
+
+	resp, err := c.doHTTP(req)
+	if err != nil {
+		return FeatureUnknown, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return FeatureUnknown, ErrorUnauthorized
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted:
+		if jobURL := resp.Header.Get(contentLocation); jobURL != "" {
+			if err := c.CancelJobContext(ctx, jobURL); err != nil {
+				log.Warningf("failed to cancel export job %s started to probe %s support: %v", jobURL, name, err)
+			}
+		}
+		return FeatureSupported, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return FeatureUnsupported, nil
+	default:
+		log.Warningf("unable to determine %s support, kick-off returned http status code %d", name, resp.StatusCode)
+		return FeatureUnknown, nil
+	}
+}
+
+func (c *Client) probeGzip(ctx context.Context) (FeatureSupport, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/metadata", nil)
+	if err != nil {
+		return FeatureUnknown, err
+	}
+	req.Header.Add(acceptHeader, acceptHeaderFHIRJSON)
+	// Setting the header explicitly stops the transport from transparently
+	// decompressing the response, so Content-Encoding can be inspected.
+	req.Header.Add(acceptEncodingHeader, encodingGzip)
+
+	resp, err := c.doHTTP(req)
+	if err != nil {
+		return FeatureUnknown, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return FeatureUnknown, ErrorUnauthorized
+	case resp.StatusCode != http.StatusOK:
+		log.Warningf("unable to determine gzip support, %s returned http status code %d", req.URL, resp.StatusCode)
+		return FeatureUnknown, nil
+	case isGzipEncoding(resp.Header.Get(contentEncodingHeader)):
+		return FeatureSupported, nil
+	default:
+		return FeatureUnsupported, nil
+	}
+}
+
+// String returns a human readable summary of the matrix.
+func (m *SupportMatrix) String() string {
+	name := func(f FeatureSupport) FeatureSupport {
+		if f == FeatureUnknown {
+			return "unknown"
+		}
+		return f
+	}
+	return fmt.Sprintf("_typeFilter: %s, _elements: %s, allowPartialManifests: %s, deleted files: %s, gzip: %s",
+		name(m.TypeFilter), name(m.Elements), name(m.AllowPartialManifests), name(m.DeletedFiles), name(m.AcceptEncodingGzip))
+}
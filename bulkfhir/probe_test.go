@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClient_ProbeSupportMatrix(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	probeTimeNow = func() time.Time { return now }
+	defer func() { probeTimeNow = time.Now }()
+
+	var mu sync.Mutex
+	var cancelled []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodDelete:
+			mu.Lock()
+			cancelled = append(cancelled, req.URL.Path)
+			mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+		case req.URL.Path == "/metadata":
+			if req.Header.Get("Accept-Encoding") != "gzip" {
+				t.Errorf("metadata request sent unexpected Accept-Encoding %q", req.Header.Get("Accept-Encoding"))
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusOK)
+		case req.URL.Path == "/Patient/$export":
+			if got := req.Header.Values("Prefer"); !cmp.Equal(got, []string{"respond-async", "handling=strict"}) {
+				t.Errorf("kick-off request sent unexpected Prefer headers %v", got)
+			}
+			q := req.URL.Query()
+			switch {
+			case q.Has("_typeFilter"):
+				w.Header().Set("Content-Location", "http://"+req.Host+"/jobs/typeFilter")
+				w.WriteHeader(http.StatusAccepted)
+			case q.Has("_elements"):
+				w.WriteHeader(http.StatusBadRequest)
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		default:
+			t.Errorf("unexpected request to %s", req.URL)
+		}
+	}))
+	defer server.Close()
+
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	got, err := cl.ProbeSupportMatrix()
+	if err != nil {
+		t.Fatalf("ProbeSupportMatrix() returned unexpected error: %v", err)
+	}
+	want := &SupportMatrix{
+		ProbedAt:              now,
+		TypeFilter:            FeatureSupported,
+		Elements:              FeatureUnsupported,
+		AllowPartialManifests: FeatureUnknown,
+		DeletedFiles:          FeatureUnknown,
+		AcceptEncodingGzip:    FeatureSupported,
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ProbeSupportMatrix() returned unexpected diff (-got +want): %s", diff)
+	}
+	if diff := cmp.Diff(cancelled, []string{"/jobs/typeFilter"}); diff != "" {
+		t.Errorf("ProbeSupportMatrix() cancelled unexpected jobs (-got +want): %s", diff)
+	}
+}
+
+func TestClient_ProbeSupportMatrixUnauthorized(t *testing.T) {
+	server := newUnauthorizedServer(t)
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	if _, err := cl.ProbeSupportMatrix(); err != ErrorUnauthorized {
+		t.Errorf("ProbeSupportMatrix() returned unexpected error: got %v, want %v", err, ErrorUnauthorized)
+	}
+}
+
+func TestClient_CancelJob(t *testing.T) {
+	cases := []struct {
+		status  int
+		wantErr error
+	}{
+		{status: http.StatusAccepted},
+		{status: http.StatusNotFound, wantErr: ErrorExportJobNotFound},
+		{status: http.StatusUnauthorized, wantErr: ErrorUnauthorized},
+	}
+	for _, tc := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodDelete {
+				t.Errorf("CancelJob sent unexpected method %s", req.Method)
+			}
+			w.WriteHeader(tc.status)
+		}))
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+		if err := cl.CancelJob(server.URL + "/jobs/1"); err != tc.wantErr {
+			t.Errorf("CancelJob() with status %d returned unexpected error: got %v, want %v", tc.status, err, tc.wantErr)
+		}
+		server.Close()
+	}
+}
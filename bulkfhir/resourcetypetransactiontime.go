@@ -0,0 +1,374 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/bulk_fhir_tools/gcs"
+	"github.com/google/bulk_fhir_tools/s3"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ResourceTypeTransactionTimeStore is a TransactionTimeStore which also
+// records the transaction time of each resource type separately, so that if
+// only some resource types of an export are processed successfully, only the
+// others need to be exported again from the previous transaction time.
+type ResourceTypeTransactionTimeStore interface {
+	TransactionTimeStore
+	// LoadResourceTypes returns the transaction time of each of the given
+	// resource types: the time stored for the type by StoreResourceTypes if it
+	// is later than that stored by Store, and otherwise that stored by Store.
+	// Resource types which have never been stored have a zero time.
+	LoadResourceTypes(ctx context.Context, resourceTypes []cpb.ResourceTypeCode_Value) (map[cpb.ResourceTypeCode_Value]time.Time, error)
+	// StoreResourceTypes saves the given timestamp for the given resource
+	// types only, provided that the transaction time of each of them is still
+	// previous, as returned by LoadResourceTypes before the export. Otherwise
+	// nothing is stored, and an error wrapping ErrTransactionTimeConflict is
+	// returned.
+	StoreResourceTypes(ctx context.Context, previous, ts time.Time, resourceTypes []cpb.ResourceTypeCode_Value) error
+}
+
+// ExportScopeKey returns the key of an export's transaction times in a
+// ResourceTypeTransactionTimeStore, so that one store can hold the times of
+// exports at different scopes or of different Groups.
+func ExportScopeKey(scope ExportScope, groupID string) string {
+	if scope == ExportScopeGroup {
+		return string(scope) + "/" + groupID
+	}
+	return string(scope)
+}
+
+// transactionTimesFile is the format of the file persisted by
+// resourceTypeTransactionTimeStore.
+type transactionTimesFile struct {
+	// Scopes maps each key returned by ExportScopeKey to the transaction times
+	// of exports at that scope.
+	Scopes map[string]*scopeTransactionTimes `json:"scopes"`
+}
+
+type scopeTransactionTimes struct {
+	// All is the transaction time of the last export of all resource types,
+	// saved by Store.
+	All time.Time `json:"all,omitempty"`
+	// ResourceTypes maps FHIR resource type names to the transaction time saved
+	// for the type by StoreResourceTypes.
+	ResourceTypes map[string]time.Time `json:"resourceTypes,omitempty"`
+}
+
+func (s *scopeTransactionTimes) get(resourceType cpb.ResourceTypeCode_Value) (time.Time, error) {
+	name, err := ResourceTypeCodeToName(resourceType)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t := s.ResourceTypes[name]; t.After(s.All) {
+		return t, nil
+	}
+	return s.All, nil
+}
+
+// earliest returns the earliest transaction time of any resource type.
+func (s *scopeTransactionTimes) earliest() time.Time {
+	earliest := s.All
+	for _, t := range s.ResourceTypes {
+		if t.Before(earliest) {
+			earliest = t
+		}
+	}
+	return earliest
+}
+
+type resourceTypeTransactionTimeStore struct {
+	scopeKey string
+	name     string
+	// open returns a reader of the stored file and its version, such as its
+	// GCS generation, or a nil reader if it does not exist. The version is
+	// passed to create when the file is updated, and may be empty for backends
+	// which do not need it.
+	open func(ctx context.Context) (io.ReadCloser, string, error)
+	// create returns a writer replacing the stored file, which fails with an
+	// error wrapping ErrTransactionTimeConflict on Close if the file is no
+	// longer at the given version.
+	create func(ctx context.Context, version string) (io.WriteCloser, error)
+	// lock, if set, is held while the file is updated.
+	lock func() (func(), error)
+}
+
+func (rttts *resourceTypeTransactionTimeStore) read(ctx context.Context) (*transactionTimesFile, *scopeTransactionTimes, string, error) {
+	f := &transactionTimesFile{}
+	r, version, err := rttts.open(ctx)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if r != nil {
+		defer r.Close()
+		if err := json.NewDecoder(r).Decode(f); err != nil {
+			return nil, nil, "", fmt.Errorf("failed to parse transaction times %s: %w", rttts.name, err)
+		}
+	}
+	if f.Scopes == nil {
+		f.Scopes = map[string]*scopeTransactionTimes{}
+	}
+	s, ok := f.Scopes[rttts.scopeKey]
+	if !ok {
+		s = &scopeTransactionTimes{}
+		f.Scopes[rttts.scopeKey] = s
+	}
+	return f, s, version, nil
+}
+
+// update reads the stored file, applies modify to it, and writes it back,
+// atomically.
+func (rttts *resourceTypeTransactionTimeStore) update(ctx context.Context, modify func(f *transactionTimesFile, s *scopeTransactionTimes) error) error {
+	if rttts.lock != nil {
+		unlock, err := rttts.lock()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	f, s, version, err := rttts.read(ctx)
+	if err != nil {
+		return err
+	}
+	if err := modify(f, s); err != nil {
+		return err
+	}
+	return rttts.write(ctx, f, version)
+}
+
+func (rttts *resourceTypeTransactionTimeStore) write(ctx context.Context, f *transactionTimesFile, version string) error {
+	w, err := rttts.create(ctx, version)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write transaction times %s: %w", rttts.name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write transaction times %s: %w", rttts.name, err)
+	}
+	return nil
+}
+
+// Load returns the earliest transaction time of any resource type, so that
+// an export of all resource types includes the data of those which were not
+// processed successfully by an earlier run.
+func (rttts *resourceTypeTransactionTimeStore) Load(ctx context.Context) (time.Time, error) {
+	_, s, _, err := rttts.read(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return s.earliest(), nil
+}
+
+// Store saves the transaction time of an export of all resource types,
+// replacing the times of individual resource types. previous is compared with
+// the time returned by Load.
+func (rttts *resourceTypeTransactionTimeStore) Store(ctx context.Context, previous, ts time.Time) error {
+	return rttts.update(ctx, func(f *transactionTimesFile, s *scopeTransactionTimes) error {
+		if err := checkPreviousTransactionTime(rttts.name, s.earliest(), previous); err != nil {
+			return err
+		}
+		f.Scopes[rttts.scopeKey] = &scopeTransactionTimes{All: ts.UTC()}
+		return nil
+	})
+}
+
+func (rttts *resourceTypeTransactionTimeStore) LoadResourceTypes(ctx context.Context, resourceTypes []cpb.ResourceTypeCode_Value) (map[cpb.ResourceTypeCode_Value]time.Time, error) {
+	_, s, _, err := rttts.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	times := map[cpb.ResourceTypeCode_Value]time.Time{}
+	for _, rt := range resourceTypes {
+		if times[rt], err = s.get(rt); err != nil {
+			return nil, err
+		}
+	}
+	return times, nil
+}
+
+func (rttts *resourceTypeTransactionTimeStore) StoreResourceTypes(ctx context.Context, previous, ts time.Time, resourceTypes []cpb.ResourceTypeCode_Value) error {
+	return rttts.update(ctx, func(f *transactionTimesFile, s *scopeTransactionTimes) error {
+		if s.ResourceTypes == nil {
+			s.ResourceTypes = map[string]time.Time{}
+		}
+		for _, rt := range resourceTypes {
+			stored, err := s.get(rt)
+			if err != nil {
+				return err
+			}
+			name, err := ResourceTypeCodeToName(rt)
+			if err != nil {
+				return err
+			}
+			if err := checkPreviousTransactionTime(fmt.Sprintf("%s for %s", rttts.name, name), stored, previous); err != nil {
+				return err
+			}
+			s.ResourceTypes[name] = ts.UTC()
+		}
+		return nil
+	})
+}
+
+// renameOnClose writes to a temporary file, which is renamed to path once
+// closed, so that a failed write does not corrupt the existing file.
+type renameOnClose struct {
+	*os.File
+	path string
+}
+
+func (r *renameOnClose) Close() error {
+	if err := r.File.Close(); err != nil {
+		return err
+	}
+	return os.Rename(r.File.Name(), r.path)
+}
+
+// conflictOnClose wraps the errors of GCS or S3 conditional writes whose
+// preconditions were not met with ErrTransactionTimeConflict.
+type conflictOnClose struct {
+	io.WriteCloser
+	name string
+}
+
+func (c *conflictOnClose) Close() error {
+	err := c.WriteCloser.Close()
+	if gcs.IsPreconditionFailed(err) || s3.IsPreconditionFailed(err) {
+		return fmt.Errorf("%w: %s was written while it was being updated", ErrTransactionTimeConflict, c.name)
+	}
+	return err
+}
+
+// NewLocalFileResourceTypeTransactionTimeStore returns a
+// ResourceTypeTransactionTimeStore which persists transaction times as JSON to
+// a local file at the given path. The file may hold the times of several
+// export scopes; this store reads and writes those of the given scope key (see
+// ExportScopeKey). Updates are serialized by locking a file alongside it, at
+// the path with ".lock" appended.
+func NewLocalFileResourceTypeTransactionTimeStore(path, scopeKey string) ResourceTypeTransactionTimeStore {
+	return &resourceTypeTransactionTimeStore{
+		scopeKey: scopeKey,
+		name:     path,
+		open: func(ctx context.Context) (io.ReadCloser, string, error) {
+			f, err := os.Open(path)
+			if os.IsNotExist(err) {
+				return nil, "", nil
+			}
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to open %s: %w", path, err)
+			}
+			return f, "", nil
+		},
+		create: func(ctx context.Context, _ string) (io.WriteCloser, error) {
+			tmp := path + ".tmp"
+			f, err := os.Create(tmp)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create %s: %w", tmp, err)
+			}
+			return &renameOnClose{File: f, path: path}, nil
+		},
+		lock: func() (func(), error) {
+			return lockFile(path + ".lock")
+		},
+	}
+}
+
+// NewGCSResourceTypeTransactionTimeStore returns a
+// ResourceTypeTransactionTimeStore which persists transaction times as JSON to
+// a file in GCS at the given URI. Concurrent updates are detected with the
+// generation of the file. See NewLocalFileResourceTypeTransactionTimeStore for
+// additional documentation.
+func NewGCSResourceTypeTransactionTimeStore(ctx context.Context, gcsEndpoint, uri, scopeKey string) (ResourceTypeTransactionTimeStore, error) {
+	bucket, relativePath, err := gcs.PathComponents(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := gcs.NewClient(ctx, bucket, gcsEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GCS client: %w", err)
+	}
+	return &resourceTypeTransactionTimeStore{
+		scopeKey: scopeKey,
+		name:     uri,
+		open: func(ctx context.Context) (io.ReadCloser, string, error) {
+			r, generation, err := client.GetFileReaderWithGeneration(ctx, relativePath)
+			if errors.Is(err, storage.ErrObjectNotExist) {
+				return nil, "", nil
+			}
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to get GCS reader for %s: %w", uri, err)
+			}
+			return r, strconv.FormatInt(generation, 10), nil
+		},
+		create: func(ctx context.Context, version string) (io.WriteCloser, error) {
+			// A missing file has no version, and generation 0.
+			var generation int64
+			if version != "" {
+				var err error
+				if generation, err = strconv.ParseInt(version, 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid generation %q of %s: %w", version, uri, err)
+				}
+			}
+			return &conflictOnClose{WriteCloser: client.GetConditionalFileWriter(ctx, relativePath, generation), name: uri}, nil
+		},
+	}, nil
+}
+
+// NewS3ResourceTypeTransactionTimeStore returns a
+// ResourceTypeTransactionTimeStore which persists transaction times as JSON to
+// an object in S3 at the given URI, of the form s3://bucket/path. Concurrent
+// updates are detected with the ETag of the object. See
+// NewLocalFileResourceTypeTransactionTimeStore for additional documentation.
+func NewS3ResourceTypeTransactionTimeStore(ctx context.Context, s3Endpoint, uri, scopeKey string) (ResourceTypeTransactionTimeStore, error) {
+	bucket, relativePath, err := s3.PathComponents(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s3.NewClient(ctx, bucket, s3Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get S3 client: %w", err)
+	}
+	return &resourceTypeTransactionTimeStore{
+		scopeKey: scopeKey,
+		name:     uri,
+		open: func(ctx context.Context) (io.ReadCloser, string, error) {
+			r, etag, err := client.GetFileReaderWithETag(ctx, relativePath)
+			if errors.Is(err, s3.ErrObjectNotExist) {
+				return nil, "", nil
+			}
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to get S3 reader for %s: %w", uri, err)
+			}
+			return r, etag, nil
+		},
+		create: func(ctx context.Context, etag string) (io.WriteCloser, error) {
+			return &conflictOnClose{WriteCloser: client.GetConditionalFileWriter(ctx, relativePath, etag), name: uri}, nil
+		},
+	}, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestLocalFileResourceTypeTransactionTimeStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "since.json")
+	testResourceTypeTransactionTimeStore(t, func(scopeKey string) ResourceTypeTransactionTimeStore {
+		return NewLocalFileResourceTypeTransactionTimeStore(filename, scopeKey)
+	})
+}
+
+func TestGCSResourceTypeTransactionTimeStore(t *testing.T) {
+	ctx := context.Background()
+	gcsServer := testhelpers.NewGCSServer(t)
+	sinceFile := "gs://sinceBucket/since.json"
+	testResourceTypeTransactionTimeStore(t, func(scopeKey string) ResourceTypeTransactionTimeStore {
+		s, err := NewGCSResourceTypeTransactionTimeStore(ctx, gcsServer.URL(), sinceFile, scopeKey)
+		if err != nil {
+			t.Fatalf("NewGCSResourceTypeTransactionTimeStore(%q, %q) returned unexpected error: %v", gcsServer.URL(), sinceFile, err)
+		}
+		return s
+	})
+}
+
+func TestS3ResourceTypeTransactionTimeStore(t *testing.T) {
+	ctx := context.Background()
+	testhelpers.SetFakeAWSCredentials(t)
+	s3Server := testhelpers.NewS3Server(t)
+	sinceFile := "s3://sinceBucket/since.json"
+	testResourceTypeTransactionTimeStore(t, func(scopeKey string) ResourceTypeTransactionTimeStore {
+		s, err := NewS3ResourceTypeTransactionTimeStore(ctx, s3Server.URL(), sinceFile, scopeKey)
+		if err != nil {
+			t.Fatalf("NewS3ResourceTypeTransactionTimeStore(%q, %q) returned unexpected error: %v", s3Server.URL(), sinceFile, err)
+		}
+		return s
+	})
+}
+
+func testResourceTypeTransactionTimeStore(t *testing.T, newStore func(scopeKey string) ResourceTypeTransactionTimeStore) {
+	t.Helper()
+	ctx := context.Background()
+	types := []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_OBSERVATION}
+	time1 := time.Date(2022, 11, 25, 14, 54, 33, 0, time.UTC)
+	time2 := time.Date(2022, 11, 26, 14, 51, 22, 0, time.UTC)
+	time3 := time.Date(2022, 11, 27, 9, 0, 0, 0, time.UTC)
+
+	s := newStore(ExportScopeKey(ExportScopeGroup, "group1"))
+	checkLoad(ctx, t, s, time.Time{})
+	checkLoadResourceTypes(ctx, t, s, types, map[cpb.ResourceTypeCode_Value]time.Time{
+		cpb.ResourceTypeCode_PATIENT:     {},
+		cpb.ResourceTypeCode_OBSERVATION: {},
+	})
+
+	// Only Patient was processed successfully.
+	if err := s.StoreResourceTypes(ctx, time.Time{}, time1, types[:1]); err != nil {
+		t.Fatalf("StoreResourceTypes() returned unexpected error: %v", err)
+	}
+	// A concurrent run which also exported Patient from the beginning may not
+	// overwrite its transaction time.
+	if err := s.StoreResourceTypes(ctx, time.Time{}, time3, types); !errors.Is(err, ErrTransactionTimeConflict) {
+		t.Errorf("StoreResourceTypes() with a stale previous time returned error %v, want %v", err, ErrTransactionTimeConflict)
+	}
+	checkLoad(ctx, t, s, time.Time{})
+	checkLoadResourceTypes(ctx, t, s, types, map[cpb.ResourceTypeCode_Value]time.Time{
+		cpb.ResourceTypeCode_PATIENT:     time1,
+		cpb.ResourceTypeCode_OBSERVATION: {},
+	})
+
+	// Storing a time for all resource types replaces those of individual ones.
+	if err := s.Store(ctx, time1, time2); !errors.Is(err, ErrTransactionTimeConflict) {
+		t.Errorf("Store() with a previous time other than the earliest returned error %v, want %v", err, ErrTransactionTimeConflict)
+	}
+	if err := s.Store(ctx, time.Time{}, time2); err != nil {
+		t.Fatalf("Store() returned unexpected error: %v", err)
+	}
+	checkLoad(ctx, t, s, time2)
+	checkLoadResourceTypes(ctx, t, s, types, map[cpb.ResourceTypeCode_Value]time.Time{
+		cpb.ResourceTypeCode_PATIENT:     time2,
+		cpb.ResourceTypeCode_OBSERVATION: time2,
+	})
+
+	if err := s.StoreResourceTypes(ctx, time2, time3, types[1:]); err != nil {
+		t.Fatalf("StoreResourceTypes() returned unexpected error: %v", err)
+	}
+	checkLoad(ctx, t, s, time2)
+	checkLoadResourceTypes(ctx, t, s, types, map[cpb.ResourceTypeCode_Value]time.Time{
+		cpb.ResourceTypeCode_PATIENT:     time2,
+		cpb.ResourceTypeCode_OBSERVATION: time3,
+	})
+
+	// Other scopes in the same file are independent.
+	other := newStore(ExportScopeKey(ExportScopeGroup, "group2"))
+	checkLoad(ctx, t, other, time.Time{})
+	if err := other.Store(ctx, time.Time{}, time1); err != nil {
+		t.Fatalf("Store() returned unexpected error: %v", err)
+	}
+	checkLoad(ctx, t, other, time1)
+	checkLoadResourceTypes(ctx, t, newStore(ExportScopeKey(ExportScopeGroup, "group1")), types, map[cpb.ResourceTypeCode_Value]time.Time{
+		cpb.ResourceTypeCode_PATIENT:     time2,
+		cpb.ResourceTypeCode_OBSERVATION: time3,
+	})
+}
+
+func checkLoad(ctx context.Context, t *testing.T, s TransactionTimeStore, want time.Time) {
+	t.Helper()
+	got, err := s.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() returned unexpected error: %v", err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("Load() returned %s, want %s", got, want)
+	}
+}
+
+func checkLoadResourceTypes(ctx context.Context, t *testing.T, s ResourceTypeTransactionTimeStore, types []cpb.ResourceTypeCode_Value, want map[cpb.ResourceTypeCode_Value]time.Time) {
+	t.Helper()
+	got, err := s.LoadResourceTypes(ctx, types)
+	if err != nil {
+		t.Fatalf("LoadResourceTypes() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("LoadResourceTypes() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
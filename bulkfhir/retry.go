@@ -0,0 +1,332 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// RetryPolicy configures how the Client retries kick-off, job status and data
+// requests to the bulk FHIR server which time out, have their connection
+// reset, or fail with a retryable HTTP status code. The zero RetryPolicy does
+// not retry. Kick-off requests are only retried when the server cannot have
+// started a job: after 429 or 503 responses, or network errors from before the
+// request was sent.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is sent, including
+	// the first. Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before the first retry. The wait is
+	// doubled for each later retry.
+	InitialBackoff time.Duration
+	// MaxBackoff, if set, caps the wait between retries. A longer Retry-After
+	// header sent by the server is still respected.
+	MaxBackoff time.Duration
+	// Jitter is the fraction, between 0 and 1, of each wait which is randomly
+	// taken off it, so that clients do not retry in lockstep.
+	Jitter float64
+	// RetryableStatusCodes are the HTTP status codes of responses to retry.
+	RetryableStatusCodes []int
+}
+
+// DefaultRetryPolicy returns the RetryPolicy used by clients returned by
+// NewClient: up to 6 attempts, waiting 2s, 4s, 8s, 16s and 30s between them,
+// on rate limiting and server errors.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    6,
+		InitialBackoff: 2 * time.Second,
+		MaxBackoff:     30 * time.Second,
+		Jitter:         0.2,
+		RetryableStatusCodes: []int{
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// ParseStatusCodes parses a comma separated list of HTTP status codes, such as
+// "429,503", for RetryPolicy.RetryableStatusCodes.
+func ParseStatusCodes(s string) ([]int, error) {
+	var codes []int
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid HTTP status code %q", v)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// validate returns an error if the policy's backoffs are negative or its
+// jitter is not between 0 and 1.
+func (p RetryPolicy) validate() error {
+	if p.InitialBackoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("backoffs must not be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("jitter %v must be between 0 and 1", p.Jitter)
+	}
+	return nil
+}
+
+// backoff returns how long to wait after the given (1-based) failed attempt.
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+	if retryAfter > d {
+		d = retryAfter
+	}
+	return d
+}
+
+// RequestOutcome classifies the response to an attempt at a request, or the
+// error it failed with.
+type RequestOutcome string
+
+// The outcomes recorded in RequestStats.
+const (
+	OutcomeOK RequestOutcome = "OK"
+	// OutcomeUnauthorized is a 401 response. Data requests are retried after
+	// re-authenticating.
+	OutcomeUnauthorized RequestOutcome = "UNAUTHORIZED"
+	// OutcomeNotFound is a 404 response. Data requests are retried, as some
+	// servers return it for files which are not yet available, but if retries
+	// do not resolve it the result URL has most likely expired.
+	OutcomeNotFound RequestOutcome = "NOT_FOUND"
+	// OutcomeThrottled is a 429 response.
+	OutcomeThrottled RequestOutcome = "THROTTLED"
+	// OutcomeServerError is a 5xx response.
+	OutcomeServerError RequestOutcome = "SERVER_ERROR"
+	// OutcomeOtherStatus is any other non-OK response.
+	OutcomeOtherStatus RequestOutcome = "OTHER_STATUS"
+	// OutcomeNetworkError is a request which failed without a response.
+	OutcomeNetworkError RequestOutcome = "NETWORK_ERROR"
+	// OutcomeCancelled is a request abandoned because its context was done.
+	OutcomeCancelled RequestOutcome = "CANCELLED"
+)
+
+// statusOutcome returns the outcome of a response with the given status code.
+func statusOutcome(code int) RequestOutcome {
+	switch {
+	case code >= 200 && code < 300:
+		return OutcomeOK
+	case code == http.StatusUnauthorized:
+		return OutcomeUnauthorized
+	case code == http.StatusNotFound:
+		return OutcomeNotFound
+	case code == http.StatusTooManyRequests:
+		return OutcomeThrottled
+	case code >= 500:
+		return OutcomeServerError
+	default:
+		return OutcomeOtherStatus
+	}
+}
+
+// RequestStats records the attempts made at a request and how it was
+// resolved.
+type RequestStats struct {
+	// Attempts is the number of times the request was sent.
+	Attempts int `json:"attempts"`
+	// Retries counts the attempts which were retried, by their outcome.
+	Retries map[RequestOutcome]int `json:"retries,omitempty"`
+	// Outcome is the outcome of the last attempt.
+	Outcome RequestOutcome `json:"outcome"`
+}
+
+// Retried returns the total number of retried attempts.
+func (s *RequestStats) Retried() int {
+	n := 0
+	for _, c := range s.Retries {
+		n += c
+	}
+	return n
+}
+
+// String summarizes the attempts, with the outcomes of those retried, such as
+// "3 attempts (1 SERVER_ERROR, 1 THROTTLED)".
+func (s *RequestStats) String() string {
+	attempts := fmt.Sprintf("%d attempts", s.Attempts)
+	if s.Attempts == 1 {
+		attempts = "1 attempt"
+	}
+	if len(s.Retries) == 0 {
+		return attempts
+	}
+	outcomes := make([]string, 0, len(s.Retries))
+	for o := range s.Retries {
+		outcomes = append(outcomes, string(o))
+	}
+	slices.Sort(outcomes)
+	for i, o := range outcomes {
+		outcomes[i] = fmt.Sprintf("%d %s", s.Retries[RequestOutcome(o)], o)
+	}
+	return fmt.Sprintf("%s (%s)", attempts, strings.Join(outcomes, ", "))
+}
+
+// record records an attempt, which resulted in resp or err.
+func (s *RequestStats) record(req *http.Request, resp *http.Response, err error) {
+	if s == nil {
+		return
+	}
+	s.Attempts++
+	switch {
+	case req.Context().Err() != nil:
+		s.Outcome = OutcomeCancelled
+	case err != nil:
+		s.Outcome = OutcomeNetworkError
+	default:
+		s.Outcome = statusOutcome(resp.StatusCode)
+	}
+}
+
+// retried records that the last attempt is being retried.
+func (s *RequestStats) retried() {
+	if s == nil {
+		return
+	}
+	if s.Retries == nil {
+		s.Retries = map[RequestOutcome]int{}
+	}
+	s.Retries[s.Outcome]++
+}
+
+// kickoffRetryableStatusCodes are the statuses of kick-off responses which
+// are retried, if the RetryPolicy retries them too. With them the server has
+// declined to start a job, while after other failures it may already have
+// started one, which a retry would duplicate.
+var kickoffRetryableStatusCodes = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+
+// doHTTPWithRetries is doHTTP, retrying the request as configured by the
+// Client's RetryPolicy. Responses with any of the statuses in alsoRetry are
+// retried too; before retrying an unauthorized response the Client
+// re-authenticates. The response of the last attempt is returned. If stats is
+// not nil, the attempts are recorded in it.
+func (c *Client) doHTTPWithRetries(req *http.Request, stats *RequestStats, alsoRetry ...int) (*http.Response, error) {
+	return c.retryHTTP(req, stats, func(resp *http.Response, err error, sent bool) bool {
+		if err != nil {
+			return isTransientNetworkError(err)
+		}
+		return slices.Contains(c.retryPolicy.RetryableStatusCodes, resp.StatusCode) || slices.Contains(alsoRetry, resp.StatusCode)
+	})
+}
+
+// doKickoffWithRetries is doHTTPWithRetries for kick-off requests, which
+// start a new export job each time the server accepts them. Only responses
+// with kickoffRetryableStatusCodes, and transient network errors from before
+// the request was sent, are retried.
+func (c *Client) doKickoffWithRetries(req *http.Request) (*http.Response, error) {
+	return c.retryHTTP(req, nil, func(resp *http.Response, err error, sent bool) bool {
+		if err != nil {
+			return !sent && isTransientNetworkError(err)
+		}
+		return slices.Contains(kickoffRetryableStatusCodes, resp.StatusCode) && slices.Contains(c.retryPolicy.RetryableStatusCodes, resp.StatusCode)
+	})
+}
+
+// retryHTTP sends req with doHTTP until retryable returns false for the
+// response or error of an attempt, or the Client's RetryPolicy is exhausted.
+// retryable is also passed whether the request was sent to the server before
+// any error.
+func (c *Client) retryHTTP(req *http.Request, stats *RequestStats, retryable func(resp *http.Response, err error, sent bool) bool) (*http.Response, error) {
+	p := c.retryPolicy
+	for attempt := 1; ; attempt++ {
+		var sent atomic.Bool
+		trace := &httptrace.ClientTrace{WroteHeaders: func() { sent.Store(true) }}
+		resp, err := c.doHTTP(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		stats.record(req, resp, err)
+		if attempt >= p.MaxAttempts || req.Context().Err() != nil || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if !retryable(resp, err, sent.Load()) {
+			return resp, err
+		}
+		var retryAfter time.Duration
+		if err != nil {
+			log.Infof("%s request to the bulk FHIR server failed, retrying (attempt %d of %d): %v", req.Method, attempt, p.MaxAttempts, err)
+		} else {
+			log.Infof("%s request to the bulk FHIR server returned status %d, retrying (attempt %d of %d).", req.Method, resp.StatusCode, attempt, p.MaxAttempts)
+			retryAfter = getRetryAfter(resp)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		stats.retried()
+
+		timer := time.NewTimer(p.backoff(attempt, retryAfter))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			if stats != nil {
+				stats.Outcome = OutcomeCancelled
+			}
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			if err := c.Authenticate(); err != nil {
+				return nil, fmt.Errorf("failed to re-authenticate before retrying: %w", err)
+			}
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// isTransientNetworkError returns whether err is a network error which may not
+// recur, unlike for example a TLS certificate error.
+func isTransientNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
@@ -0,0 +1,354 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// countingAuthenticator counts the calls to Authenticate.
+type countingAuthenticator struct {
+	testAuthenticator
+	n atomic.Int32
+}
+
+func (ca *countingAuthenticator) Authenticate(hc *http.Client) error {
+	ca.n.Add(1)
+	return nil
+}
+
+func TestClient_RetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, RetryableStatusCodes: []int{http.StatusServiceUnavailable}}
+	cases := []struct {
+		name         string
+		policy       RetryPolicy
+		failures     int
+		status       int
+		wantRequests int32
+		wantAuth     int32
+		wantErr      error
+	}{
+		{name: "retryable status", policy: policy, failures: 2, status: http.StatusServiceUnavailable, wantRequests: 3},
+		{name: "attempts exhausted", policy: policy, failures: 3, status: http.StatusServiceUnavailable, wantRequests: 3, wantErr: ErrorUnexpectedStatusCode},
+		{name: "status not retryable", policy: policy, failures: 1, status: http.StatusBadGateway, wantRequests: 1, wantErr: ErrorUnexpectedStatusCode},
+		{name: "not found retried for data", policy: policy, failures: 2, status: http.StatusNotFound, wantRequests: 3},
+		{name: "unauthorized retried after authenticating", policy: policy, failures: 2, status: http.StatusUnauthorized, wantRequests: 3, wantAuth: 2},
+		{name: "zero policy does not retry", failures: 1, status: http.StatusServiceUnavailable, wantRequests: 1, wantErr: ErrorUnexpectedStatusCode},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if requests.Add(1) <= int32(tc.failures) {
+					w.WriteHeader(tc.status)
+					return
+				}
+				w.Write([]byte("data"))
+			}))
+			defer server.Close()
+			auth := &countingAuthenticator{}
+			c := Client{authenticator: auth, httpClient: &http.Client{}}
+			c.SetRetryPolicy(tc.policy)
+
+			r, err := c.GetData(server.URL)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("GetData() returned error %v, want %v", err, tc.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("GetData() returned unexpected error: %v", err)
+			} else {
+				data, err := io.ReadAll(r)
+				r.Close()
+				if err != nil || string(data) != "data" {
+					t.Errorf("GetData() returned data %q, error %v, want %q", data, err, "data")
+				}
+			}
+			if got := requests.Load(); got != tc.wantRequests {
+				t.Errorf("GetData() sent %d requests, want %d", got, tc.wantRequests)
+			}
+			if got := auth.n.Load(); got != tc.wantAuth {
+				t.Errorf("GetData() authenticated %d times, want %d", got, tc.wantAuth)
+			}
+		})
+	}
+}
+
+func TestClient_RetryPolicy_JobStatus(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"output": [], "transactionTime": "2024-01-01T00:00:00Z"}`))
+	}))
+	defer server.Close()
+	c := Client{authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, RetryableStatusCodes: []int{http.StatusTooManyRequests}})
+
+	st, err := c.JobStatus(server.URL)
+	if err != nil {
+		t.Fatalf("JobStatus() returned unexpected error: %v", err)
+	}
+	if !st.IsComplete {
+		t.Errorf("JobStatus() returned incomplete status after retrying")
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("JobStatus() sent %d requests, want 2", got)
+	}
+}
+
+func TestClient_RetryPolicy_Kickoff(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	cases := []struct {
+		name string
+		// status is the status of the first kick-off response. If zero, the
+		// first kick-off is accepted but the client times out before the
+		// response.
+		status   int
+		wantJobs int32
+		wantErr  bool
+	}{
+		{name: "timeout after the server accepted the kick-off", wantJobs: 1, wantErr: true},
+		{name: "server error", status: http.StatusInternalServerError, wantJobs: 1, wantErr: true},
+		{name: "bad gateway", status: http.StatusBadGateway, wantJobs: 1, wantErr: true},
+		{name: "throttled", status: http.StatusTooManyRequests, wantJobs: 2},
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantJobs: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var jobs atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				// Each kick-off request reaching the server creates a job.
+				n := jobs.Add(1)
+				if n == 1 {
+					if tc.status == 0 {
+						time.Sleep(200 * time.Millisecond)
+					} else {
+						w.Header().Set("Retry-After", "0")
+						w.WriteHeader(tc.status)
+						return
+					}
+				}
+				w.Header().Set("Content-Location", fmt.Sprintf("%s/jobs/%d", "http://"+req.Host, n))
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer server.Close()
+			c := Client{baseURL: server.URL, authenticator: testAuthenticator{}, httpClient: &http.Client{Timeout: 50 * time.Millisecond}}
+			c.SetRetryPolicy(policy)
+
+			_, err := c.StartBulkDataExportSystem(nil, nil, time.Time{})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("StartBulkDataExportSystem() returned error %v, want error: %v", err, tc.wantErr)
+			}
+			if got := jobs.Load(); got != tc.wantJobs {
+				t.Errorf("StartBulkDataExportSystem() created %d jobs, want %d", got, tc.wantJobs)
+			}
+		})
+	}
+}
+
+func TestClient_MonitorJobStatus_Throttled(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"output": [], "transactionTime": "2024-01-01T00:00:00Z"}`))
+	}))
+	defer server.Close()
+	c := Client{authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+
+	// The check period is far longer than the test timeout, so the job is only
+	// seen to complete if the monitor waits for the Retry-After instead.
+	start := time.Now()
+	var results []*MonitorResult
+	for r := range c.MonitorJobStatus(server.URL, time.Hour, 5*time.Second) {
+		results = append(results, r)
+	}
+	if len(results) != 2 {
+		t.Fatalf("MonitorJobStatus() sent %d results, want 2", len(results))
+	}
+	if !errors.Is(results[0].Error, ErrorTooManyRequests) {
+		t.Errorf("MonitorJobStatus() sent first result error %v, want %v", results[0].Error, ErrorTooManyRequests)
+	}
+	if results[1].Error != nil || !results[1].Status.IsComplete {
+		t.Errorf("MonitorJobStatus() sent final result %+v, want complete job", results[1])
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("MonitorJobStatus() polled again after %s, want at least the 1s Retry-After", elapsed)
+	}
+}
+
+func TestClient_GetData_Throttled(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	t.Run("waits for Retry-After", func(t *testing.T) {
+		c := Client{authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+		c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, RetryableStatusCodes: []int{http.StatusTooManyRequests}})
+		start := time.Now()
+		r, err := c.GetData(server.URL)
+		if err != nil {
+			t.Fatalf("GetData() returned unexpected error: %v", err)
+		}
+		r.Close()
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("GetData() retried after %s, want at least the 1s Retry-After", elapsed)
+		}
+	})
+
+	t.Run("without retries", func(t *testing.T) {
+		requests.Store(0)
+		c := Client{authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+		if _, err := c.GetData(server.URL); !errors.Is(err, ErrorTooManyRequests) {
+			t.Errorf("GetData() returned error %v, want %v", err, ErrorTooManyRequests)
+		}
+	})
+}
+
+func TestClient_GetDataWithStats(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond, RetryableStatusCodes: []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}}
+	cases := []struct {
+		name      string
+		statuses  []int
+		wantStats RequestStats
+		wantErr   error
+	}{
+		{
+			name:      "first attempt",
+			wantStats: RequestStats{Attempts: 1, Outcome: OutcomeOK},
+		},
+		{
+			name:      "resolved by retries",
+			statuses:  []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusUnauthorized},
+			wantStats: RequestStats{Attempts: 4, Retries: map[RequestOutcome]int{OutcomeThrottled: 1, OutcomeServerError: 1, OutcomeUnauthorized: 1}, Outcome: OutcomeOK},
+		},
+		{
+			name:      "expired URL",
+			statuses:  []int{http.StatusNotFound, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound},
+			wantStats: RequestStats{Attempts: 4, Retries: map[RequestOutcome]int{OutcomeNotFound: 3}, Outcome: OutcomeNotFound},
+			wantErr:   ErrorDataNotFound,
+		},
+		{
+			name:      "not retried",
+			statuses:  []int{http.StatusForbidden},
+			wantStats: RequestStats{Attempts: 1, Outcome: OutcomeOtherStatus},
+			wantErr:   ErrorUnexpectedStatusCode,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if n := int(requests.Add(1)); n <= len(tc.statuses) {
+					w.WriteHeader(tc.statuses[n-1])
+					return
+				}
+				w.Write([]byte("data"))
+			}))
+			defer server.Close()
+
+			c := Client{authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+			c.SetRetryPolicy(policy)
+			var stats RequestStats
+			r, err := c.GetDataWithStats(context.Background(), server.URL, &stats)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("GetDataWithStats() returned error %v, want %v", err, tc.wantErr)
+			}
+			if err == nil {
+				r.Close()
+			}
+			if diff := cmp.Diff(stats, tc.wantStats); diff != "" {
+				t.Errorf("GetDataWithStats() recorded unexpected stats (-got +want): %s", diff)
+			}
+		})
+	}
+}
+
+func TestRequestStats_String(t *testing.T) {
+	cases := []struct {
+		stats RequestStats
+		want  string
+	}{
+		{stats: RequestStats{Attempts: 1, Outcome: OutcomeOK}, want: "1 attempt"},
+		{stats: RequestStats{Attempts: 3, Retries: map[RequestOutcome]int{OutcomeThrottled: 1, OutcomeServerError: 1}, Outcome: OutcomeOK}, want: "3 attempts (1 SERVER_ERROR, 1 THROTTLED)"},
+	}
+	for _, tc := range cases {
+		if got := tc.stats.String(); got != tc.want {
+			t.Errorf("%+v.String() = %q, want %q", tc.stats, got, tc.want)
+		}
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 2 * time.Second, MaxBackoff: 30 * time.Second}
+	var got []time.Duration
+	for attempt := 1; attempt <= 6; attempt++ {
+		got = append(got, p.backoff(attempt, 0))
+	}
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("backoff() returned unexpected waits (-got +want): %s", diff)
+	}
+	if got := p.backoff(1, time.Minute); got != time.Minute {
+		t.Errorf("backoff() with Retry-After of 1m = %s, want 1m", got)
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.backoff(2, 0); got <= 2*time.Second || got > 4*time.Second {
+			t.Fatalf("backoff() with jitter 0.5 = %s, want in (2s, 4s]", got)
+		}
+	}
+}
+
+func TestParseStatusCodes(t *testing.T) {
+	got, err := ParseStatusCodes("429, 503,")
+	if err != nil {
+		t.Fatalf("ParseStatusCodes() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, []int{429, 503}); diff != "" {
+		t.Errorf("ParseStatusCodes() returned unexpected codes (-got +want): %s", diff)
+	}
+	for _, s := range []string{"abc", "99", "600"} {
+		if _, err := ParseStatusCodes(s); err == nil {
+			t.Errorf("ParseStatusCodes(%q) succeeded, want error", s)
+		}
+	}
+}
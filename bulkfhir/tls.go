@@ -0,0 +1,70 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSOptions configures the TLS connections made by a Client, for servers
+// which present certificates from a private CA or require client certificates.
+type TLSOptions struct {
+	// CACertFile is the path to a PEM file of CA certificates to trust, in
+	// addition to the system's, when verifying servers.
+	CACertFile string
+	// ClientCertFile and ClientKeyFile are the paths to the PEM encoded
+	// certificate and private key presented to servers which require mutual
+	// TLS. They must be set together.
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+// NewTLSConfig returns a tls.Config configured by opts, for use with
+// (*Client).SetTransport and the http.Client passed to an Authenticator, so
+// that authentication and data requests use the same certificates.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if opts.CACertFile != "" {
+		pem, err := os.ReadFile(opts.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate file: %w", err)
+		}
+		// Fall back to an empty pool if the system pool is unavailable, as on
+		// some platforms, so that at least the configured CAs are trusted.
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA certificate file %s", opts.CACertFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if (opts.ClientCertFile == "") != (opts.ClientKeyFile == "") {
+		return nil, errors.New("the client certificate and key files must be set together")
+	}
+	if opts.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to dir,
+// returning the certificate and the paths of the two files.
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bulk_fhir_fetch"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+func TestNewTLSConfig_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, certFile, keyFile := writeClientCert(t, dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	// The server's certificate is self-signed, so it is its own CA.
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		opts    TLSOptions
+		wantErr bool
+	}{
+		{
+			name: "CAAndClientCert",
+			opts: TLSOptions{CACertFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile},
+		},
+		{
+			name:    "NoCA",
+			opts:    TLSOptions{ClientCertFile: certFile, ClientKeyFile: keyFile},
+			wantErr: true,
+		},
+		{
+			name:    "NoClientCert",
+			opts:    TLSOptions{CACertFile: caFile},
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tlsConfig, err := NewTLSConfig(tc.opts)
+			if err != nil {
+				t.Fatalf("NewTLSConfig() returned unexpected error: %v", err)
+			}
+			c, err := NewClient(server.URL, testAuthenticator{})
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			c.SetTransport(&http.Transport{TLSClientConfig: tlsConfig})
+			r, err := c.GetData(server.URL + "/data.ndjson")
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("GetData() returned error %v, want error: %t", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer r.Close()
+			if got, err := io.ReadAll(r); err != nil || string(got) != "data" {
+				t.Errorf("GetData() read %q, %v, want %q", got, err, "data")
+			}
+		})
+	}
+}
+
+func TestNewTLSConfig_Errors(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, keyFile := writeClientCert(t, dir)
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		opts TLSOptions
+	}{
+		{name: "MissingCAFile", opts: TLSOptions{CACertFile: filepath.Join(dir, "missing.pem")}},
+		{name: "CAFileWithoutCertificates", opts: TLSOptions{CACertFile: notPEM}},
+		{name: "CertWithoutKey", opts: TLSOptions{ClientCertFile: certFile}},
+		{name: "KeyWithoutCert", opts: TLSOptions{ClientKeyFile: keyFile}},
+		{name: "InvalidKey", opts: TLSOptions{ClientCertFile: certFile, ClientKeyFile: notPEM}},
+	}
+	for _, tc := range cases {
+		if _, err := NewTLSConfig(tc.opts); err == nil {
+			t.Errorf("NewTLSConfig() for %s returned nil error", tc.name)
+		}
+	}
+}
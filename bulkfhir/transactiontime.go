@@ -16,17 +16,20 @@ package bulkfhir
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	log "github.com/google/bulk_fhir_tools/internal/logger"
 	"cloud.google.com/go/storage"
 	"github.com/google/bulk_fhir_tools/fhir"
 	"github.com/google/bulk_fhir_tools/gcs"
+	"github.com/google/bulk_fhir_tools/s3"
 )
 
 // ErrUnsetTransactionTime is returned from TransactionTime.Get if it is
@@ -61,9 +64,21 @@ func NewTransactionTime() *TransactionTime {
 	return &TransactionTime{}
 }
 
+// ErrTransactionTimeConflict is returned (wrapped) by TransactionTimeStore
+// implementations when the stored transaction time is not the expected
+// previous one, because another run stored a transaction time in the
+// meantime.
+var ErrTransactionTimeConflict = errors.New("the stored transaction time was modified concurrently")
+
 // TransactionTimeStore manages the transaction time of Bulk FHIR fetches. The
 // transaction timestamp of a successful export is saved so that it can be used
 // as the _since parameter for the subsequent export.
+//
+// Several runs, perhaps triggered by different orchestration systems, may
+// share a store. Store therefore takes the transaction time which was loaded
+// before the export, and only replaces it if it is still stored; of several
+// runs which export data since the same time, only the first to finish stores
+// its transaction time.
 type TransactionTimeStore interface {
 	// Load a previously stored transaction time. If no transaction time has
 	// previously been stored (i.e. if the program has never been successfully run
@@ -71,25 +86,56 @@ type TransactionTimeStore interface {
 	// error.
 	Load(ctx context.Context) (time.Time, error)
 	// Store() saves the given timestamp to persistent storage so that it can be
-	// retrieved by Load() the next time the program is run.
-	Store(ctx context.Context, ts time.Time) error
+	// retrieved by Load() the next time the program is run, provided that the
+	// stored transaction time is still previous, as returned by Load() before
+	// the export. Otherwise nothing is stored, and an error wrapping
+	// ErrTransactionTimeConflict is returned. The check and the update are
+	// atomic.
+	Store(ctx context.Context, previous, ts time.Time) error
+}
+
+// checkPreviousTransactionTime returns an error wrapping
+// ErrTransactionTimeConflict if the stored transaction time is not previous.
+func checkPreviousTransactionTime(name string, stored, previous time.Time) error {
+	if stored.Equal(previous) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s holds %s, want %s", ErrTransactionTimeConflict, name, describeTransactionTime(stored), describeTransactionTime(previous))
+}
+
+func describeTransactionTime(ts time.Time) string {
+	if ts.IsZero() {
+		return "no transaction time"
+	}
+	return fhir.ToFHIRInstant(ts)
 }
 
 type inMemoryTransactionTimeStore struct {
+	mu    sync.Mutex
 	since time.Time
 }
 
 func (imtts *inMemoryTransactionTimeStore) Load(ctx context.Context) (time.Time, error) {
+	imtts.mu.Lock()
+	defer imtts.mu.Unlock()
 	return imtts.since, nil
 }
 
-func (imtts *inMemoryTransactionTimeStore) Store(ctx context.Context, ts time.Time) error {
+func (imtts *inMemoryTransactionTimeStore) Store(ctx context.Context, previous, ts time.Time) error {
+	imtts.mu.Lock()
+	defer imtts.mu.Unlock()
+	if err := checkPreviousTransactionTime("the in-memory store", imtts.since, previous); err != nil {
+		return err
+	}
+	imtts.since = ts
 	return nil
 }
 
 // NewInMemoryTransactionTimeStore returns an implementation of
-// TransactionTimeStore which does not persist the since timestamp anywhere. It
-// is initialised with a string timestamp, which may be blank.
+// TransactionTimeStore which does not persist the since timestamp beyond the
+// lifetime of the process; stored timestamps are only returned by later calls
+// to Load on the same store. It is initialised with a string timestamp, which
+// may be blank.
 func NewInMemoryTransactionTimeStore(timestamp string) (TransactionTimeStore, error) {
 	if timestamp == "" {
 		return &inMemoryTransactionTimeStore{}, nil
@@ -124,40 +170,61 @@ func (gtts *gcsTransactionTimeStore) Load(ctx context.Context) (time.Time, error
 	return ts, nil
 }
 
-func (gtts *gcsTransactionTimeStore) Store(ctx context.Context, ts time.Time) error {
-	writer := gtts.client.GetFileWriter(ctx, gtts.relativePath)
-	if err := gtts.copyPreviousContent(ctx, writer); err != nil {
+// Store rewrites the file with the timestamp appended, on condition that the
+// file is not modified in the meantime.
+func (gtts *gcsTransactionTimeStore) Store(ctx context.Context, previous, ts time.Time) error {
+	content, generation, err := gtts.readPreviousContent(ctx)
+	if err != nil {
+		return err
+	}
+	var stored time.Time
+	if generation != 0 {
+		if stored, err = readTimestampFromFile(io.NopCloser(bytes.NewReader(content))); err != nil {
+			return fmt.Errorf("failed to get since timestamp from %s: %w", gtts.fullURI, err)
+		}
+	}
+	if err := checkPreviousTransactionTime(gtts.fullURI, stored, previous); err != nil {
 		return err
 	}
+
+	writer := &conflictOnClose{WriteCloser: gtts.client.GetConditionalFileWriter(ctx, gtts.relativePath, generation), name: gtts.fullURI}
+	if _, err := writer.Write(content); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to copy existing content in %s: %w", gtts.fullURI, err)
+	}
 	if err := writeTimestampToFile(ts, writer); err != nil {
 		return fmt.Errorf("failed to write since timestamp to %s: %w", gtts.fullURI, err)
 	}
 	return nil
 }
 
-func (gtts *gcsTransactionTimeStore) copyPreviousContent(ctx context.Context, writer io.Writer) error {
-	reader, err := gtts.client.GetFileReader(ctx, gtts.relativePath)
+// readPreviousContent returns the content of the file and its generation, or
+// a zero generation if it does not exist.
+func (gtts *gcsTransactionTimeStore) readPreviousContent(ctx context.Context) ([]byte, int64, error) {
+	reader, generation, err := gtts.client.GetFileReaderWithGeneration(ctx, gtts.relativePath)
 	if err != nil {
 		if errors.Is(err, storage.ErrObjectNotExist) {
-			return nil
+			return nil, 0, nil
 		}
-		return fmt.Errorf("failed to get GCS reader for %s to copy existing content: %w", gtts.fullURI, err)
+		return nil, 0, fmt.Errorf("failed to get GCS reader for %s to copy existing content: %w", gtts.fullURI, err)
 	}
 	defer func() {
 		if err := reader.Close(); err != nil {
 			log.Errorf("failed to close GCS reader for %s after copying: %v", gtts.fullURI, err)
 		}
 	}()
-	if _, err := io.Copy(writer, reader); err != nil {
-		return fmt.Errorf("failed to copy existing content in %s: %w", gtts.fullURI, err)
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read existing content in %s: %w", gtts.fullURI, err)
 	}
-	return nil
+	return content, generation, nil
 }
 
 // NewGCSTransactionTimeStore returns an implementation of TransactionTimeStore
 // which persists the since timestamp to a file in GCS at the given URI. A new
 // line is appended to the file on each run, so that the entire history of
-// transaction times may be seen.
+// transaction times may be seen. Concurrent updates are detected with the
+// generation of the file.
 func NewGCSTransactionTimeStore(ctx context.Context, gcsEndpoint, uri string) (TransactionTimeStore, error) {
 	bucket, relativePath, err := gcs.PathComponents(uri)
 	if err != nil {
@@ -174,6 +241,87 @@ func NewGCSTransactionTimeStore(ctx context.Context, gcsEndpoint, uri string) (T
 	}, nil
 }
 
+type s3TransactionTimeStore struct {
+	client                s3.Client
+	relativePath, fullURI string
+}
+
+func (stts *s3TransactionTimeStore) Load(ctx context.Context) (time.Time, error) {
+	reader, err := stts.client.GetFileReader(ctx, stts.relativePath)
+	if err != nil {
+		if errors.Is(err, s3.ErrObjectNotExist) {
+			// If the S3 object has not been created, this is the first time it is
+			// used, so return an empty time to fetch all data.
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf("failed to get S3 reader for %s: %w", stts.fullURI, err)
+	}
+	ts, err := readTimestampFromFile(reader)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get since timestamp from %s: %w", stts.fullURI, err)
+	}
+	return ts, nil
+}
+
+// Store rewrites the object with the timestamp appended, on condition that the
+// object's ETag does not change in the meantime.
+func (stts *s3TransactionTimeStore) Store(ctx context.Context, previous, ts time.Time) error {
+	var content []byte
+	reader, etag, err := stts.client.GetFileReaderWithETag(ctx, stts.relativePath)
+	switch {
+	case errors.Is(err, s3.ErrObjectNotExist):
+	case err != nil:
+		return fmt.Errorf("failed to get S3 reader for %s to copy existing content: %w", stts.fullURI, err)
+	default:
+		content, err = io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read existing content in %s: %w", stts.fullURI, err)
+		}
+	}
+	var stored time.Time
+	if etag != "" {
+		if stored, err = readTimestampFromFile(io.NopCloser(bytes.NewReader(content))); err != nil {
+			return fmt.Errorf("failed to get since timestamp from %s: %w", stts.fullURI, err)
+		}
+	}
+	if err := checkPreviousTransactionTime(stts.fullURI, stored, previous); err != nil {
+		return err
+	}
+
+	writer := &conflictOnClose{WriteCloser: stts.client.GetConditionalFileWriter(ctx, stts.relativePath, etag), name: stts.fullURI}
+	if _, err := writer.Write(content); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to copy existing content in %s: %w", stts.fullURI, err)
+	}
+	if err := writeTimestampToFile(ts, writer); err != nil {
+		return fmt.Errorf("failed to write since timestamp to %s: %w", stts.fullURI, err)
+	}
+	return nil
+}
+
+// NewS3TransactionTimeStore returns an implementation of TransactionTimeStore
+// which persists the since timestamp to an object in S3 at the given URI, of
+// the form s3://bucket/path. As with NewGCSTransactionTimeStore, a new line is
+// appended on each run. Concurrent updates are detected with the ETag of the
+// object. If s3Endpoint is empty, the S3 endpoint of the configured AWS region
+// is used.
+func NewS3TransactionTimeStore(ctx context.Context, s3Endpoint, uri string) (TransactionTimeStore, error) {
+	bucket, relativePath, err := s3.PathComponents(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s3.NewClient(ctx, bucket, s3Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get S3 client: %w", err)
+	}
+	return &s3TransactionTimeStore{
+		client:       client,
+		relativePath: relativePath,
+		fullURI:      uri,
+	}, nil
+}
+
 type localFileTransactionTimeStore struct {
 	path string
 }
@@ -195,7 +343,20 @@ func (lftts *localFileTransactionTimeStore) Load(ctx context.Context) (time.Time
 	return ts, nil
 }
 
-func (lftts *localFileTransactionTimeStore) Store(ctx context.Context, ts time.Time) error {
+func (lftts *localFileTransactionTimeStore) Store(ctx context.Context, previous, ts time.Time) error {
+	unlock, err := lockFile(lftts.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	stored, err := lftts.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkPreviousTransactionTime(lftts.path, stored, previous); err != nil {
+		return err
+	}
+
 	writer, err := os.OpenFile(lftts.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open %s: %w", lftts.path, err)
@@ -209,7 +370,8 @@ func (lftts *localFileTransactionTimeStore) Store(ctx context.Context, ts time.T
 // NewLocalFileTransactionTimeStore returns an implementation of
 // TransactionTimeStore which persists the since timestamp to a local file at
 // the given path. A new line is appended to the file on each run, so that the
-// entire history of transaction times may be seen.
+// entire history of transaction times may be seen. Updates are serialized by
+// locking a file alongside it, at the path with ".lock" appended.
 func NewLocalFileTransactionTimeStore(path string) TransactionTimeStore {
 	return &localFileTransactionTimeStore{path: path}
 }
@@ -16,8 +16,10 @@ package bulkfhir
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -81,9 +83,20 @@ func TestInMemoryTransactionTimeStore(t *testing.T) {
 			if !got.Equal(tc.wantInitialTimestamp) {
 				t.Errorf("unexpected timestamp from inMemoryTransactionTimeStore.Load(): want %s; got %s", tc.wantInitialTimestamp, got.In(time.UTC))
 			}
-			if err := s.Store(ctx, time.Now()); err != nil {
+			stored := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+			if err := s.Store(ctx, stored, stored); !errors.Is(err, ErrTransactionTimeConflict) {
+				t.Errorf("inMemoryTransactionTimeStore.Store() with a stale previous time returned error %v, want %v", err, ErrTransactionTimeConflict)
+			}
+			if err := s.Store(ctx, got, stored); err != nil {
 				t.Fatalf("got unexpected error from inMemoryTransactionTimeStore.Store(): %v", err)
 			}
+			got, err = s.Load(ctx)
+			if err != nil {
+				t.Fatalf("got unexpected error from inMemoryTransactionTimeStore.Load(): %v", err)
+			}
+			if !got.Equal(stored) {
+				t.Errorf("unexpected timestamp from inMemoryTransactionTimeStore.Load() after Store(): want %s; got %s", stored, got.In(time.UTC))
+			}
 		})
 	}
 }
@@ -104,10 +117,11 @@ func TestLocalFileTransactionTimeStore(t *testing.T) {
 	}
 
 	time1 := time.Date(2022, 11, 25, 14, 54, 33, 0, time.UTC)
-	testStoreAndRetrieve(ctx, t, s, time1)
+	testStoreAndRetrieve(ctx, t, s, time.Time{}, time1)
 
 	time2 := time.Date(2022, 11, 26, 14, 51, 22, 0, time.UTC)
-	testStoreAndRetrieve(ctx, t, s, time2)
+	testStoreAndRetrieve(ctx, t, s, time1, time2)
+	testStoreConflict(ctx, t, s, time1)
 
 	// Note: we check the contents of the file solely to assert the behaviour
 	// that timestamps are appended to the file, rather than replacing its
@@ -147,10 +161,11 @@ func TestGCSTransactionTimeStore(t *testing.T) {
 	}
 
 	time1 := time.Date(2022, 11, 25, 14, 54, 33, 0, time.UTC)
-	testStoreAndRetrieve(ctx, t, s, time1)
+	testStoreAndRetrieve(ctx, t, s, time.Time{}, time1)
 
 	time2 := time.Date(2022, 11, 26, 14, 51, 22, 0, time.UTC)
-	testStoreAndRetrieve(ctx, t, s, time2)
+	testStoreAndRetrieve(ctx, t, s, time1, time2)
+	testStoreConflict(ctx, t, s, time1)
 
 	// Note: we check the contents of the file solely to assert the behaviour
 	// that timestamps are appended to the file, rather than replacing its
@@ -170,9 +185,43 @@ func TestGCSTransactionTimeStore(t *testing.T) {
 	}
 }
 
-func testStoreAndRetrieve(ctx context.Context, t *testing.T, s TransactionTimeStore, ts time.Time) {
+func TestS3TransactionTimeStore(t *testing.T) {
+	ctx := context.Background()
+	testhelpers.SetFakeAWSCredentials(t)
+	s3Server := testhelpers.NewS3Server(t)
+	sinceFile := "s3://sinceBucket/dir/sinceFile"
+
+	s, err := NewS3TransactionTimeStore(ctx, s3Server.URL(), sinceFile)
+	if err != nil {
+		t.Fatalf("NewS3TransactionTimeStore(%q, %q) returned unexpected error: %v", s3Server.URL(), sinceFile, err)
+	}
+	got, err := s.Load(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error from s3TransactionTimeStore.Load(): %v", err)
+	}
+	if !got.IsZero() {
+		t.Errorf("expected initial timestamp to be zero; got %s", got)
+	}
+
+	time1 := time.Date(2022, 11, 25, 14, 54, 33, 0, time.UTC)
+	testStoreAndRetrieve(ctx, t, s, time.Time{}, time1)
+	time2 := time.Date(2022, 11, 26, 14, 51, 22, 0, time.UTC)
+	testStoreAndRetrieve(ctx, t, s, time1, time2)
+	testStoreConflict(ctx, t, s, time1)
+
+	data, ok := s3Server.GetObject("sinceBucket", "dir/sinceFile")
+	if !ok {
+		t.Fatalf("%s not found", sinceFile)
+	}
+	wantContents := "2022-11-25T14:54:33.000+00:00\n2022-11-26T14:51:22.000+00:00\n"
+	if diff := cmp.Diff(wantContents, string(data)); diff != "" {
+		t.Errorf("unexpected diff in since file (-want, +got):\n%s", diff)
+	}
+}
+
+func testStoreAndRetrieve(ctx context.Context, t *testing.T, s TransactionTimeStore, previous, ts time.Time) {
 	t.Helper()
-	if err := s.Store(ctx, ts); err != nil {
+	if err := s.Store(ctx, previous, ts); err != nil {
 		t.Fatalf("got unexpected error from Store(): %v", err)
 	}
 	got, err := s.Load(ctx)
@@ -183,3 +232,90 @@ func testStoreAndRetrieve(ctx context.Context, t *testing.T, s TransactionTimeSt
 		t.Errorf("unexpected timestamp from Load(): want %s; got %s", ts, got)
 	}
 }
+
+// testStoreConflict checks that storing a transaction time with a stale
+// previous time fails, without changing the stored time.
+func testStoreConflict(ctx context.Context, t *testing.T, s TransactionTimeStore, stale time.Time) {
+	t.Helper()
+	want, err := s.Load(ctx)
+	if err != nil {
+		t.Fatalf("got unexpected error from Load(): %v", err)
+	}
+	if err := s.Store(ctx, stale, time.Now()); !errors.Is(err, ErrTransactionTimeConflict) {
+		t.Errorf("Store() with a stale previous time returned error %v, want %v", err, ErrTransactionTimeConflict)
+	}
+	got, err := s.Load(ctx)
+	if err != nil {
+		t.Fatalf("got unexpected error from Load(): %v", err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("Load() after a conflicting Store() returned %s, want %s", got, want)
+	}
+}
+
+func TestTransactionTimeStore_ConcurrentStores(t *testing.T) {
+	ctx := context.Background()
+	gcsServer := testhelpers.NewGCSServer(t)
+	gcsStore, err := NewGCSTransactionTimeStore(ctx, gcsServer.URL(), "gs://sinceBucket/sinceFile")
+	if err != nil {
+		t.Fatalf("NewGCSTransactionTimeStore() returned unexpected error: %v", err)
+	}
+	gcsResourceTypeStore, err := NewGCSResourceTypeTransactionTimeStore(ctx, gcsServer.URL(), "gs://sinceBucket/since.json", ExportScopeKey(ExportScopePatient, ""))
+	if err != nil {
+		t.Fatalf("NewGCSResourceTypeTransactionTimeStore() returned unexpected error: %v", err)
+	}
+	testhelpers.SetFakeAWSCredentials(t)
+	s3Server := testhelpers.NewS3Server(t)
+	s3Store, err := NewS3TransactionTimeStore(ctx, s3Server.URL(), "s3://sinceBucket/sinceFile")
+	if err != nil {
+		t.Fatalf("NewS3TransactionTimeStore() returned unexpected error: %v", err)
+	}
+	s3ResourceTypeStore, err := NewS3ResourceTypeTransactionTimeStore(ctx, s3Server.URL(), "s3://sinceBucket/since.json", ExportScopeKey(ExportScopePatient, ""))
+	if err != nil {
+		t.Fatalf("NewS3ResourceTypeTransactionTimeStore() returned unexpected error: %v", err)
+	}
+	inMemoryStore, err := NewInMemoryTransactionTimeStore("")
+	if err != nil {
+		t.Fatalf("NewInMemoryTransactionTimeStore() returned unexpected error: %v", err)
+	}
+	dir := t.TempDir()
+	stores := map[string]TransactionTimeStore{
+		"InMemory":              inMemoryStore,
+		"LocalFile":             NewLocalFileTransactionTimeStore(filepath.Join(dir, "since.txt")),
+		"LocalFileResourceType": NewLocalFileResourceTypeTransactionTimeStore(filepath.Join(dir, "since.json"), ExportScopeKey(ExportScopePatient, "")),
+		"GCS":                   gcsStore,
+		"GCSResourceType":       gcsResourceTypeStore,
+		"S3":                    s3Store,
+		"S3ResourceType":        s3ResourceTypeStore,
+	}
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			// Several runs export data from the beginning and then store their
+			// transaction times at once; only one of them may succeed.
+			const runs = 10
+			var wg sync.WaitGroup
+			errs := make([]error, runs)
+			for i := 0; i < runs; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = s.Store(ctx, time.Time{}, time.Date(2023, 1, 1, i, 0, 0, 0, time.UTC))
+				}(i)
+			}
+			wg.Wait()
+
+			succeeded := 0
+			for _, err := range errs {
+				if err == nil {
+					succeeded++
+				} else if !errors.Is(err, ErrTransactionTimeConflict) {
+					t.Errorf("Store() returned unexpected error: %v", err)
+				}
+			}
+			if succeeded != 1 {
+				t.Errorf("%d concurrent Store() calls succeeded, want 1", succeeded)
+			}
+		})
+	}
+}
@@ -0,0 +1,545 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary fixture_sample samples the NDJSON of a bulk FHIR export, such as the
+// output of bulk_fhir_fetch, into a small set of test fixtures: a random
+// sample of patients, the resources which reference them and the resources
+// those reference in turn, such as practitioners and organizations. Resource
+// IDs, the references between them and identifier values are masked, so that
+// the fixtures can be shared as test data for downstream pipelines while
+// remaining referentially consistent.
+//
+// The fixtures are written to output_dir as {resource_type}_0.ndjson files,
+// the layout served by cmd/test_server.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"flag"
+	"github.com/google/bulk_fhir_tools/gcs"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+var (
+	inputFiles  = flag.String("input_files", "", "Required. A comma separated list of the NDJSON files of the export to sample, such as those written to output_dir by bulk_fhir_fetch. Local paths may be glob patterns, such as export/*.ndjson. Files in GCS are given in the form gs://bucket/file_path.")
+	outputDir   = flag.String("output_dir", "", "Required. The local directory to write the fixtures to, as {resource_type}_0.ndjson files.")
+	patients    = flag.Int("patients", 10, "The number of patients to sample.")
+	seed        = flag.Int64("seed", 1, "The seed of the random sample of patients. The same seed samples the same patients from the same export.")
+	maskSalt    = flag.String("mask_salt", "", "Optional. The secret which masked IDs and identifiers are derived from. The same salt masks the same values the same way, so fixtures sampled at different times can be joined. If unset, a random salt is used.")
+	gcsEndpoint = flag.String("gcs_endpoint", gcs.DefaultCloudStorageEndpoint, "The endpoint for Google Cloud Storage. This is only set for testing.")
+)
+
+// sampleConfig holds the configuration of a sample, from the flags.
+type sampleConfig struct {
+	files       []string
+	outputDir   string
+	patients    int
+	seed        int64
+	maskSalt    []byte
+	gcsEndpoint string
+}
+
+func main() {
+	flag.Parse()
+	cfg, err := buildSampleConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	counts, err := sampleFixtures(context.Background(), cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, rt := range sortedKeys(counts) {
+		log.Infof("Wrote %d %s fixtures to %s", counts[rt], rt, cfg.outputDir)
+	}
+}
+
+func buildSampleConfig() (sampleConfig, error) {
+	cfg := sampleConfig{
+		outputDir:   *outputDir,
+		patients:    *patients,
+		seed:        *seed,
+		maskSalt:    []byte(*maskSalt),
+		gcsEndpoint: *gcsEndpoint,
+	}
+	for _, f := range strings.Split(*inputFiles, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			cfg.files = append(cfg.files, f)
+		}
+	}
+	if len(cfg.files) == 0 {
+		return sampleConfig{}, errors.New("input_files must be set")
+	}
+	if cfg.outputDir == "" {
+		return sampleConfig{}, errors.New("output_dir must be set")
+	}
+	if cfg.patients < 1 {
+		return sampleConfig{}, errors.New("patients must be at least 1")
+	}
+	if len(cfg.maskSalt) == 0 {
+		cfg.maskSalt = make([]byte, 32)
+		if _, err := rand.Read(cfg.maskSalt); err != nil {
+			return sampleConfig{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// resourceKey identifies a resource as ResourceType/id.
+type resourceKey string
+
+func newResourceKey(resourceType, id string) resourceKey {
+	return resourceKey(resourceType + "/" + id)
+}
+
+func (k resourceKey) split() (resourceType, id string) {
+	resourceType, id, _ = strings.Cut(string(k), "/")
+	return resourceType, id
+}
+
+// export indexes the resources of the input files, so that references can be
+// resolved without holding the resources themselves in memory.
+type export struct {
+	cfg   sampleConfig
+	files []string
+	// patients are the IDs of the Patient resources.
+	patients map[string]bool
+	// byID maps each resource ID to the resources with that ID, to resolve
+	// urn:uuid references, as used by Synthea.
+	byID map[string][]resourceKey
+}
+
+// sampleFixtures samples the export in the configured files, writes the
+// fixtures to the output directory, and returns the number of fixtures of each
+// resource type written.
+//
+// The export is read several times: once to index it, once to find the
+// resources of the sampled patients, and once for each further level of
+// references to follow.
+func sampleFixtures(ctx context.Context, cfg sampleConfig) (map[string]int, error) {
+	files, err := expandInputFiles(cfg.files)
+	if err != nil {
+		return nil, err
+	}
+	e := &export{cfg: cfg, files: files, patients: map[string]bool{}, byID: map[string][]resourceKey{}}
+	if err := e.index(ctx); err != nil {
+		return nil, err
+	}
+	sampled := e.samplePatients(cfg.patients, cfg.seed)
+
+	selected := map[resourceKey][]byte{}
+	// pending are the references of the selected resources which are yet to
+	// be followed.
+	pending := map[resourceKey]bool{}
+	selectResource := func(key resourceKey, data []byte, refs []resourceKey) {
+		selected[key] = data
+		delete(pending, key)
+		for _, ref := range refs {
+			if _, ok := selected[ref]; !ok {
+				pending[ref] = true
+			}
+		}
+	}
+	// excluded counts the resources which reference patients outside the
+	// sample, such as a Group of every patient, which would otherwise pull in
+	// the whole export.
+	excluded := 0
+	err = e.scan(ctx, func(key resourceKey, data []byte, refs []resourceKey) error {
+		resourceType, id := key.split()
+		if resourceType == "Patient" {
+			if sampled[id] {
+				selectResource(key, data, refs)
+			}
+			return nil
+		}
+		inSample, outOfSample := e.patientReferences(refs, sampled)
+		if inSample && outOfSample {
+			excluded++
+		} else if inSample {
+			selectResource(key, data, refs)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for len(pending) > 0 {
+		following := pending
+		pending = map[resourceKey]bool{}
+		err := e.scan(ctx, func(key resourceKey, data []byte, refs []resourceKey) error {
+			if !following[key] {
+				return nil
+			}
+			if _, outOfSample := e.patientReferences(append(refs, key), sampled); outOfSample {
+				excluded++
+				return nil
+			}
+			selectResource(key, data, refs)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if excluded > 0 {
+		log.Warningf("Excluded %d resources which reference patients outside the sample; references to them are left dangling.", excluded)
+	}
+
+	m := &masker{salt: cfg.maskSalt, export: e}
+	return writeFixtures(cfg.outputDir, selected, m)
+}
+
+// samplePatients returns a random sample of n of the export's patients, or all
+// of them if it has n or fewer.
+func (e *export) samplePatients(n int, seed int64) map[string]bool {
+	ids := make([]string, 0, len(e.patients))
+	for id := range e.patients {
+		ids = append(ids, id)
+	}
+	// Sort before shuffling, so that the sample only depends on the seed.
+	sort.Strings(ids)
+	r := mrand.New(mrand.NewSource(seed))
+	r.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	sampled := map[string]bool{}
+	for _, id := range ids {
+		sampled[id] = true
+	}
+	return sampled
+}
+
+// patientReferences reports whether refs include patients in the sample, and
+// patients outside it.
+func (e *export) patientReferences(refs []resourceKey, sampled map[string]bool) (inSample, outOfSample bool) {
+	for _, ref := range refs {
+		resourceType, id := ref.split()
+		if resourceType != "Patient" || !e.patients[id] {
+			continue
+		}
+		if sampled[id] {
+			inSample = true
+		} else {
+			outOfSample = true
+		}
+	}
+	return inSample, outOfSample
+}
+
+// index records the patients and resource IDs of the export.
+func (e *export) index(ctx context.Context) error {
+	return e.read(ctx, func(data []byte) error {
+		var r struct {
+			ResourceType string `json:"resourceType"`
+			ID           string `json:"id"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		if r.ResourceType == "" || r.ID == "" {
+			return errors.New("resource has no resourceType or id")
+		}
+		if r.ResourceType == "Patient" {
+			e.patients[r.ID] = true
+		}
+		e.byID[r.ID] = append(e.byID[r.ID], newResourceKey(r.ResourceType, r.ID))
+		return nil
+	})
+}
+
+// scan calls fn with each resource of the export, and the resources of the
+// export which it references.
+func (e *export) scan(ctx context.Context, fn func(key resourceKey, data []byte, refs []resourceKey) error) error {
+	return e.read(ctx, func(data []byte) error {
+		var r map[string]any
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		resourceType, _ := r["resourceType"].(string)
+		id, _ := r["id"].(string)
+		var refs []resourceKey
+		walkReferences(r, func(ref string) string {
+			if key, ok := e.resolve(ref); ok {
+				refs = append(refs, key)
+			}
+			return ref
+		})
+		return fn(newResourceKey(resourceType, id), data, refs)
+	})
+}
+
+// resolve returns the resource of the export which the reference refers to.
+// References may be relative (Patient/123), absolute
+// (https://server/fhir/Patient/123), versioned (Patient/123/_history/2) or
+// urn:uuid references to the ID of a resource.
+func (e *export) resolve(ref string) (resourceKey, bool) {
+	if id, ok := strings.CutPrefix(ref, "urn:uuid:"); ok {
+		if keys := e.byID[id]; len(keys) == 1 {
+			return keys[0], true
+		}
+		return "", false
+	}
+	if i := strings.Index(ref, "/_history/"); i >= 0 {
+		ref = ref[:i]
+	}
+	parts := strings.Split(ref, "/")
+	if len(parts) < 2 {
+		return "", false
+	}
+	key := newResourceKey(parts[len(parts)-2], parts[len(parts)-1])
+	for _, k := range e.byID[parts[len(parts)-1]] {
+		if k == key {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// read calls fn with each line of the input files.
+func (e *export) read(ctx context.Context, fn func(data []byte) error) error {
+	for _, file := range e.files {
+		if err := e.readFile(ctx, file, fn); err != nil {
+			return fmt.Errorf("error reading %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+func (e *export) readFile(ctx context.Context, file string, fn func(data []byte) error) error {
+	var r io.ReadCloser
+	if strings.HasPrefix(file, "gs://") {
+		bucket, relativePath, err := gcs.PathComponents(file)
+		if err != nil {
+			return err
+		}
+		client, err := gcs.NewClient(ctx, bucket, e.cfg.gcsEndpoint)
+		if err != nil {
+			return err
+		}
+		r, err = client.GetFileReader(ctx, relativePath)
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+		r, err = os.Open(file)
+		if err != nil {
+			return err
+		}
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if ferr := fn(trimmed); ferr != nil {
+				return fmt.Errorf("line %d: %w", lineNum, ferr)
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// expandInputFiles expands the glob patterns among the local files.
+func expandInputFiles(patterns []string) ([]string, error) {
+	var files []string
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "gs://") {
+			files = append(files, p)
+			continue
+		}
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("input_files flag invalid: %w", err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no input files match %s", p)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// walkReferences calls fn with the reference of each Reference in the parsed
+// JSON of a resource, replacing it with the value fn returns.
+func walkReferences(v any, fn func(ref string) string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if ref, ok := child.(string); ok && k == "reference" {
+				v[k] = fn(ref)
+				continue
+			}
+			walkReferences(child, fn)
+		}
+	case []any:
+		for _, child := range v {
+			walkReferences(child, fn)
+		}
+	}
+}
+
+// masker masks the IDs, references and identifiers of resources. Values are
+// replaced with a keyed hash of themselves, so that a value is masked the same
+// way wherever it appears, and references still resolve.
+type masker struct {
+	salt   []byte
+	export *export
+}
+
+// maskID returns the masked ID of the resource, formatted as a UUID.
+func (m *masker) maskID(key resourceKey) string {
+	h := m.hash("id", string(key))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+func (m *masker) hash(kind, value string) []byte {
+	mac := hmac.New(sha256.New, m.salt)
+	mac.Write([]byte(kind + "\x00" + value))
+	return mac.Sum(nil)
+}
+
+// mask returns the JSON of the resource with its ID, references and
+// identifier values masked. References to resources of the export are
+// rewritten as relative references to their masked IDs; other references,
+// to resources outside the export, are masked the same way so that they
+// remain consistent with each other. The narrative is removed, as it may
+// repeat identifiers.
+func (m *masker) mask(key resourceKey, data []byte) ([]byte, error) {
+	var r map[string]any
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	r["id"] = m.maskID(key)
+	delete(r, "text")
+	walkReferences(r, func(ref string) string {
+		if strings.HasPrefix(ref, "#") {
+			// A reference to a contained resource.
+			return ref
+		}
+		target, ok := m.export.resolve(ref)
+		if !ok {
+			parts := strings.Split(strings.TrimPrefix(ref, "urn:uuid:"), "/")
+			if len(parts) < 2 {
+				return "urn:uuid:" + m.maskID(resourceKey(ref))
+			}
+			target = newResourceKey(parts[len(parts)-2], parts[len(parts)-1])
+		}
+		targetType, _ := target.split()
+		return targetType + "/" + m.maskID(target)
+	})
+	m.maskIdentifiers(r)
+	return json.Marshal(r)
+}
+
+// maskIdentifiers masks the value of each Identifier, keeping its system so
+// that the fixtures still exercise the handling of each kind of identifier.
+func (m *masker) maskIdentifiers(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if k == "identifier" {
+				m.maskIdentifier(child)
+			}
+			m.maskIdentifiers(child)
+		}
+	case []any:
+		for _, child := range v {
+			m.maskIdentifiers(child)
+		}
+	}
+}
+
+func (m *masker) maskIdentifier(v any) {
+	identifiers, ok := v.([]any)
+	if !ok {
+		identifiers = []any{v}
+	}
+	for _, i := range identifiers {
+		identifier, ok := i.(map[string]any)
+		if !ok {
+			continue
+		}
+		value, ok := identifier["value"].(string)
+		if !ok {
+			continue
+		}
+		system, _ := identifier["system"].(string)
+		identifier["value"] = fmt.Sprintf("%x", m.hash("identifier", system+"|"+value)[:12])
+	}
+}
+
+// writeFixtures masks the selected resources and writes them to dir, one
+// {resource_type}_0.ndjson file per resource type, sorted so that the same
+// sample produces the same files.
+func writeFixtures(dir string, selected map[resourceKey][]byte, m *masker) (map[string]int, error) {
+	byType := map[string][][]byte{}
+	for key, data := range selected {
+		masked, err := m.mask(key, data)
+		if err != nil {
+			return nil, fmt.Errorf("error masking %s: %w", key, err)
+		}
+		resourceType, _ := key.split()
+		byType[resourceType] = append(byType[resourceType], masked)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for resourceType, resources := range byType {
+		sort.Slice(resources, func(i, j int) bool { return bytes.Compare(resources[i], resources[j]) < 0 })
+		var b bytes.Buffer
+		for _, r := range resources {
+			b.Write(r)
+			b.WriteByte('\n')
+		}
+		if err := os.WriteFile(filepath.Join(dir, resourceType+"_0.ndjson"), b.Bytes(), 0644); err != nil {
+			return nil, err
+		}
+		counts[resourceType] = len(resources)
+	}
+	return counts, nil
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,270 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"flag"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+const patientNDJSON = `{"resourceType":"Patient","id":"p1","identifier":[{"system":"http://hl7.org/fhir/sid/us-mbi","value":"1S00E00AA01"}],"text":{"status":"generated","div":"<div>1S00E00AA01</div>"}}
+{"resourceType":"Patient","id":"p2","identifier":[{"system":"http://hl7.org/fhir/sid/us-mbi","value":"1S00E00AA02"}]}
+{"resourceType":"Patient","id":"p3","identifier":[{"system":"http://hl7.org/fhir/sid/us-mbi","value":"1S00E00AA03"}]}
+`
+
+const otherNDJSON = `{"resourceType":"Organization","id":"parent"}
+{"resourceType":"Organization","id":"org","partOf":{"reference":"Organization/parent"}}
+{"resourceType":"Encounter","id":"e1","subject":{"reference":"Patient/p1"},"serviceProvider":{"reference":"https://server/fhir/Organization/org"}}
+{"resourceType":"Encounter","id":"e2","subject":{"reference":"Patient/p2"},"serviceProvider":{"reference":"Organization/org"}}
+{"resourceType":"Encounter","id":"e3","subject":{"reference":"Patient/p3/_history/1"},"serviceProvider":{"reference":"Organization/org"}}
+{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p1"},"encounter":{"reference":"Encounter/e1"},"performer":[{"reference":"Practitioner/outside"}]}
+{"resourceType":"Observation","id":"o2","subject":{"reference":"Patient/p2"},"encounter":{"reference":"Encounter/e2"}}
+{"resourceType":"Observation","id":"o3","subject":{"reference":"Patient/p3"},"encounter":{"reference":"Encounter/e3"}}
+{"resourceType":"Coverage","id":"c1","beneficiary":{"reference":"urn:uuid:p1"}}
+{"resourceType":"Coverage","id":"c2","beneficiary":{"reference":"urn:uuid:p2"}}
+{"resourceType":"Coverage","id":"c3","beneficiary":{"reference":"urn:uuid:p3"}}
+{"resourceType":"Group","id":"all","member":[{"entity":{"reference":"Patient/p1"}},{"entity":{"reference":"Patient/p2"}},{"entity":{"reference":"Patient/p3"}}]}
+{"resourceType":"Practitioner","id":"unreferenced"}
+`
+
+func writeExport(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range map[string]string{"Patient_0.ndjson": patientNDJSON, "Other_0.ndjson": otherNDJSON} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// readFixtures reads the fixtures written to dir, keyed by file name.
+func readFixtures(t *testing.T, dir string) map[string][]map[string]any {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures := map[string][]map[string]any{}
+	for _, e := range entries {
+		f, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var r map[string]any
+			if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+				t.Fatalf("invalid fixture in %s: %v", e.Name(), err)
+			}
+			fixtures[e.Name()] = append(fixtures[e.Name()], r)
+		}
+		f.Close()
+	}
+	return fixtures
+}
+
+func TestSampleFixtures(t *testing.T) {
+	exportDir := writeExport(t)
+	cfg := sampleConfig{
+		files:     []string{filepath.Join(exportDir, "*.ndjson")},
+		outputDir: t.TempDir(),
+		patients:  1,
+		seed:      1,
+		maskSalt:  []byte("salt"),
+	}
+	counts, err := sampleFixtures(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("sampleFixtures() returned unexpected error: %v", err)
+	}
+	wantCounts := map[string]int{"Patient": 1, "Encounter": 1, "Observation": 1, "Coverage": 1, "Organization": 2}
+	if diff := cmp.Diff(wantCounts, counts); diff != "" {
+		t.Errorf("sampleFixtures() returned unexpected counts (-want +got):\n%s", diff)
+	}
+
+	// Unmask the fixtures with the masked IDs of every resource in the export.
+	m := &masker{salt: cfg.maskSalt}
+	unmasked := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(patientNDJSON+otherNDJSON), "\n") {
+		var r struct{ ResourceType, ID string }
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		key := newResourceKey(r.ResourceType, r.ID)
+		unmasked[r.ResourceType+"/"+m.maskID(key)] = string(key)
+	}
+	fixtures := readFixtures(t, cfg.outputDir)
+	var got []string
+	for file, resources := range fixtures {
+		for _, r := range resources {
+			key, ok := unmasked[r["resourceType"].(string)+"/"+r["id"].(string)]
+			if !ok {
+				t.Errorf("%s has a resource with an unknown masked ID: %v", file, r)
+				continue
+			}
+			got = append(got, key)
+			walkReferences(r, func(ref string) string {
+				if _, ok := unmasked[ref]; !ok && ref != "Practitioner/"+m.maskID("Practitioner/outside") {
+					t.Errorf("%s in %s has reference %s which does not resolve to a fixture", key, file, ref)
+				}
+				return ref
+			})
+		}
+	}
+
+	// The sampled patient is chosen by the seed.
+	var patient string
+	for _, r := range fixtures["Patient_0.ndjson"] {
+		patient = strings.TrimPrefix(unmasked["Patient/"+r["id"].(string)], "Patient/p")
+		if _, ok := r["text"]; ok {
+			t.Errorf("Patient fixture has a narrative, want it removed: %v", r)
+		}
+		identifier := r["identifier"].([]any)[0].(map[string]any)
+		if identifier["system"] != "http://hl7.org/fhir/sid/us-mbi" || strings.HasPrefix(identifier["value"].(string), "1S00E00AA") {
+			t.Errorf("Patient fixture has identifier %v, want the value masked and the system kept", identifier)
+		}
+	}
+	want := []string{"Patient/p" + patient, "Encounter/e" + patient, "Observation/o" + patient, "Coverage/c" + patient, "Organization/org", "Organization/parent"}
+	sort.Strings(want)
+	sort.Strings(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("sampleFixtures() wrote unexpected resources (-want +got):\n%s", diff)
+	}
+}
+
+func TestSampleFixtures_Deterministic(t *testing.T) {
+	exportDir := writeExport(t)
+	sample := func(salt string) []byte {
+		cfg := sampleConfig{
+			files:     []string{filepath.Join(exportDir, "Patient_0.ndjson"), filepath.Join(exportDir, "Other_0.ndjson")},
+			outputDir: t.TempDir(),
+			patients:  2,
+			seed:      1,
+			maskSalt:  []byte(salt),
+		}
+		if _, err := sampleFixtures(context.Background(), cfg); err != nil {
+			t.Fatalf("sampleFixtures() returned unexpected error: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(cfg.outputDir, "Observation_0.ndjson"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	first := sample("salt")
+	if second := sample("salt"); !bytes.Equal(first, second) {
+		t.Errorf("sampleFixtures() with the same seed and salt wrote %s, then %s, want the same fixtures", first, second)
+	}
+	if other := sample("other salt"); bytes.Equal(first, other) {
+		t.Errorf("sampleFixtures() with different salts wrote the same fixtures %s, want them masked differently", first)
+	}
+}
+
+func TestSampleFixtures_AllPatients(t *testing.T) {
+	exportDir := writeExport(t)
+	cfg := sampleConfig{
+		files:     []string{filepath.Join(exportDir, "*.ndjson")},
+		outputDir: t.TempDir(),
+		patients:  10,
+		maskSalt:  []byte("salt"),
+	}
+	counts, err := sampleFixtures(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("sampleFixtures() returned unexpected error: %v", err)
+	}
+	// The Group references only sampled patients once every patient is
+	// sampled, so it is included, but the unreferenced Practitioner is not.
+	want := map[string]int{"Patient": 3, "Encounter": 3, "Observation": 3, "Coverage": 3, "Organization": 2, "Group": 1}
+	if diff := cmp.Diff(want, counts); diff != "" {
+		t.Errorf("sampleFixtures() returned unexpected counts (-want +got):\n%s", diff)
+	}
+}
+
+func TestSampleFixtures_GCS(t *testing.T) {
+	gcsServer := testhelpers.NewGCSServer(t)
+	gcsServer.AddObject("bucket", "export/Patient_0.ndjson", testhelpers.GCSObjectEntry{Data: []byte(patientNDJSON)})
+	cfg := sampleConfig{
+		files:       []string{"gs://bucket/export/Patient_0.ndjson"},
+		outputDir:   t.TempDir(),
+		patients:    2,
+		maskSalt:    []byte("salt"),
+		gcsEndpoint: gcsServer.URL(),
+	}
+	counts, err := sampleFixtures(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("sampleFixtures() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"Patient": 2}, counts); diff != "" {
+		t.Errorf("sampleFixtures() returned unexpected counts (-want +got):\n%s", diff)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	e := &export{byID: map[string][]resourceKey{
+		"p1":     {"Patient/p1"},
+		"shared": {"Patient/shared", "Encounter/shared"},
+	}}
+	cases := []struct {
+		ref     string
+		want    resourceKey
+		wantErr bool
+	}{
+		{ref: "Patient/p1", want: "Patient/p1"},
+		{ref: "https://server/fhir/Patient/p1", want: "Patient/p1"},
+		{ref: "Patient/p1/_history/3", want: "Patient/p1"},
+		{ref: "urn:uuid:p1", want: "Patient/p1"},
+		{ref: "Encounter/shared", want: "Encounter/shared"},
+		{ref: "urn:uuid:shared", wantErr: true},
+		{ref: "Encounter/p1", wantErr: true},
+		{ref: "#contained", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, ok := e.resolve(tc.ref)
+		if ok == tc.wantErr || got != tc.want {
+			t.Errorf("resolve(%q) = %q, %v, want %q, %v", tc.ref, got, ok, tc.want, !tc.wantErr)
+		}
+	}
+}
+
+func TestBuildSampleConfig(t *testing.T) {
+	defer flag.CommandLine.Set("input_files", "")
+	defer flag.CommandLine.Set("output_dir", "")
+	if _, err := buildSampleConfig(); err == nil {
+		t.Errorf("buildSampleConfig() without input_files succeeded, want error")
+	}
+	flag.CommandLine.Set("input_files", "a.ndjson, b.ndjson")
+	flag.CommandLine.Set("output_dir", "out")
+	cfg, err := buildSampleConfig()
+	if err != nil {
+		t.Fatalf("buildSampleConfig() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"a.ndjson", "b.ndjson"}, cfg.files); diff != "" {
+		t.Errorf("buildSampleConfig() returned unexpected files (-want +got):\n%s", diff)
+	}
+	if len(cfg.maskSalt) == 0 {
+		t.Errorf("buildSampleConfig() without mask_salt returned an empty salt, want a random one")
+	}
+}
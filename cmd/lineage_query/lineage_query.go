@@ -0,0 +1,187 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary lineage_query prints the lineage of resources recorded by
+// bulk_fhir_fetch with -lineage_dir: where each matching resource was written
+// to, the URL and byte range it was downloaded from, the run which fetched it
+// and the processors applied to it.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"flag"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/gcs"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+var (
+	lineageFiles = flag.String("lineage_files", "", "Required. A comma separated list of the lineage files to query, as written to lineage_dir by bulk_fhir_fetch. Local paths may be glob patterns, such as lineage/lineage_*.ndjson to query every run. Files in GCS are given in the form gs://bucket/file_path.")
+	resource     = flag.String("resource", "", "Optional. The resource to find, as ResourceType/id, e.g. Patient/123, or ResourceType to find all resources of a type.")
+	runID        = flag.String("run_id", "", "Optional. Only find resources fetched by the run with this ID.")
+	output       = flag.String("output", "", "Optional. Only find resources written to outputs starting with this, such as an NDJSON file, a directory or a FHIR store name.")
+	jsonOutput   = flag.Bool("json", false, "If true, print the matching lineage records as lines of JSON, rather than as text.")
+	gcsEndpoint  = flag.String("gcs_endpoint", gcs.DefaultCloudStorageEndpoint, "The endpoint for Google Cloud Storage. This is only set for testing.")
+)
+
+// lineageQueryConfig holds the configuration of a query, from the flags.
+type lineageQueryConfig struct {
+	files       []string
+	query       processing.LineageQuery
+	json        bool
+	gcsEndpoint string
+}
+
+func main() {
+	flag.Parse()
+	cfg, err := buildLineageQueryConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := queryLineage(context.Background(), cfg, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func buildLineageQueryConfig() (lineageQueryConfig, error) {
+	cfg := lineageQueryConfig{
+		query:       processing.LineageQuery{RunID: *runID, Output: *output},
+		json:        *jsonOutput,
+		gcsEndpoint: *gcsEndpoint,
+	}
+	for _, f := range strings.Split(*lineageFiles, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			cfg.files = append(cfg.files, f)
+		}
+	}
+	if len(cfg.files) == 0 {
+		return lineageQueryConfig{}, errors.New("lineage_files must be set")
+	}
+	if *resource != "" {
+		resourceType, id, _ := strings.Cut(*resource, "/")
+		if resourceType == "" || strings.Contains(id, "/") {
+			return lineageQueryConfig{}, fmt.Errorf("resource flag invalid: %q must be of the form ResourceType/id or ResourceType", *resource)
+		}
+		cfg.query.ResourceType = resourceType
+		cfg.query.ResourceID = id
+	}
+	return cfg, nil
+}
+
+// queryLineage writes the lineage records in the configured files which match
+// the query to w.
+func queryLineage(ctx context.Context, cfg lineageQueryConfig, w io.Writer) error {
+	files, err := expandLineageFiles(cfg.files)
+	if err != nil {
+		return err
+	}
+	matched := 0
+	for _, file := range files {
+		records, err := readLineageFile(ctx, cfg, file)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", file, err)
+		}
+		for _, r := range records {
+			if err := writeRecord(w, r, cfg.json); err != nil {
+				return err
+			}
+		}
+		matched += len(records)
+	}
+	if !cfg.json {
+		fmt.Fprintf(w, "%d matching outputs in %d lineage files.\n", matched, len(files))
+	}
+	return nil
+}
+
+// expandLineageFiles expands the glob patterns among the local files.
+func expandLineageFiles(patterns []string) ([]string, error) {
+	var files []string
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "gs://") {
+			files = append(files, p)
+			continue
+		}
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("lineage_files flag invalid: %w", err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no lineage files match %s", p)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+func readLineageFile(ctx context.Context, cfg lineageQueryConfig, file string) ([]processing.LineageRecord, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(file, "gs://") {
+		bucket, relativePath, err := gcs.PathComponents(file)
+		if err != nil {
+			return nil, err
+		}
+		client, err := gcs.NewClient(ctx, bucket, cfg.gcsEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		r, err = client.GetFileReader(ctx, relativePath)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		r, err = os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer r.Close()
+	return processing.ReadLineage(r, cfg.query)
+}
+
+func writeRecord(w io.Writer, r processing.LineageRecord, asJSON bool) error {
+	if asJSON {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s/%s", r.ResourceType, r.ResourceID)
+	if r.RunID != "" {
+		fmt.Fprintf(&b, " (run %s)", r.RunID)
+	}
+	fmt.Fprintf(&b, "\n  output:     %s\n  source:     %s", r.Output, r.SourceURL)
+	if r.SourceLength > 0 {
+		fmt.Fprintf(&b, " bytes %d-%d", r.SourceOffset, r.SourceOffset+r.SourceLength-1)
+	}
+	processors := strings.Join(r.Processors, ", ")
+	if processors == "" {
+		processors = "none"
+	}
+	fmt.Fprintf(&b, "\n  processors: %s\n", processors)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
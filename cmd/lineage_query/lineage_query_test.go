@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"flag"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+const run1Lineage = `{"runID":"run1","resourceType":"Patient","resourceID":"p1","sourceURL":"https://server/data/patient.ndjson","sourceOffset":0,"sourceLength":36,"processors":["bcdaRectify"],"output":"/out/fhir_data_0_0.ndjson"}
+{"runID":"run1","resourceType":"Patient","resourceID":"p2","sourceURL":"https://server/data/patient.ndjson","sourceOffset":37,"sourceLength":36,"processors":["bcdaRectify"],"output":"/out/fhir_data_0_0.ndjson"}
+`
+
+const run2Lineage = `{"runID":"run2","resourceType":"Patient","resourceID":"p1","sourceURL":"https://server/data/patient2.ndjson","sourceOffset":100,"sourceLength":36,"processors":null,"output":"projects/p/locations/l/datasets/d/fhirStores/s/fhir/Patient/p1"}
+`
+
+func TestQueryLineage(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"lineage_run1.ndjson": run1Lineage, "lineage_run2.ndjson": run2Lineage} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := lineageQueryConfig{
+		files: []string{filepath.Join(dir, "lineage_*.ndjson")},
+		query: processing.LineageQuery{ResourceType: "Patient", ResourceID: "p1"},
+	}
+	var got bytes.Buffer
+	if err := queryLineage(context.Background(), cfg, &got); err != nil {
+		t.Fatalf("queryLineage() returned unexpected error: %v", err)
+	}
+	want := `Patient/p1 (run run1)
+  output:     /out/fhir_data_0_0.ndjson
+  source:     https://server/data/patient.ndjson bytes 0-35
+  processors: bcdaRectify
+Patient/p1 (run run2)
+  output:     projects/p/locations/l/datasets/d/fhirStores/s/fhir/Patient/p1
+  source:     https://server/data/patient2.ndjson bytes 100-135
+  processors: none
+2 matching outputs in 2 lineage files.
+`
+	if diff := cmp.Diff(want, got.String()); diff != "" {
+		t.Errorf("queryLineage() printed unexpected output (-want +got):\n%s", diff)
+	}
+}
+
+func TestQueryLineage_GCSAndJSON(t *testing.T) {
+	gcsServer := testhelpers.NewGCSServer(t)
+	gcsServer.AddObject("bucket", "lineage/lineage_run1.ndjson", testhelpers.GCSObjectEntry{Data: []byte(run1Lineage)})
+
+	cfg := lineageQueryConfig{
+		files:       []string{"gs://bucket/lineage/lineage_run1.ndjson"},
+		query:       processing.LineageQuery{ResourceID: "p2"},
+		json:        true,
+		gcsEndpoint: gcsServer.URL(),
+	}
+	var got bytes.Buffer
+	if err := queryLineage(context.Background(), cfg, &got); err != nil {
+		t.Fatalf("queryLineage() returned unexpected error: %v", err)
+	}
+	want := strings.Split(run1Lineage, "\n")[1] + "\n"
+	if diff := cmp.Diff(want, got.String()); diff != "" {
+		t.Errorf("queryLineage() printed unexpected output (-want +got):\n%s", diff)
+	}
+}
+
+func TestQueryLineage_NoFiles(t *testing.T) {
+	cfg := lineageQueryConfig{files: []string{filepath.Join(t.TempDir(), "lineage_*.ndjson")}}
+	if err := queryLineage(context.Background(), cfg, &bytes.Buffer{}); err == nil {
+		t.Errorf("queryLineage() with no matching files returned nil error, want an error")
+	}
+}
+
+func TestBuildLineageQueryConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		files    string
+		resource string
+		want     lineageQueryConfig
+		wantErr  bool
+	}{
+		{
+			name:     "resource",
+			files:    "a.ndjson, gs://bucket/b.ndjson",
+			resource: "Patient/123",
+			want: lineageQueryConfig{
+				files: []string{"a.ndjson", "gs://bucket/b.ndjson"},
+				query: processing.LineageQuery{ResourceType: "Patient", ResourceID: "123"},
+			},
+		},
+		{
+			name:     "resource type",
+			files:    "a.ndjson",
+			resource: "Patient",
+			want: lineageQueryConfig{
+				files: []string{"a.ndjson"},
+				query: processing.LineageQuery{ResourceType: "Patient"},
+			},
+		},
+		{name: "no files", resource: "Patient/123", wantErr: true},
+		{name: "invalid resource", files: "a.ndjson", resource: "Patient/123/_history/1", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer flag.Set("lineage_files", "")
+			defer flag.Set("resource", "")
+			flag.Set("lineage_files", tc.files)
+			flag.Set("resource", tc.resource)
+			flag.Set("gcs_endpoint", "")
+			got, err := buildLineageQueryConfig()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("buildLineageQueryConfig() returned error %v, want error: %t", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(lineageQueryConfig{})); diff != "" {
+				t.Errorf("buildLineageQueryConfig() returned unexpected config (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -166,7 +166,7 @@ func TestTestServer_ValidPatientExport(t *testing.T) {
 
 			// Start export:
 			jobURL, err := c.StartBulkDataExport([]cpb.ResourceTypeCode_Value{
-				cpb.ResourceTypeCode_PATIENT}, time.Time{}, tc.groupName)
+				cpb.ResourceTypeCode_PATIENT}, nil, time.Time{}, tc.groupName)
 			if err != nil {
 				t.Fatalf("Error starting bulk fhir export: %v", err)
 			}
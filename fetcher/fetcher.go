@@ -22,13 +22,20 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/bulk_fhir_tools/bulkfhir"
 	"github.com/google/bulk_fhir_tools/fhir"
 	"github.com/google/bulk_fhir_tools/fhir/processing"
 	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
 	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	extmetrics "github.com/google/bulk_fhir_tools/metrics"
+	"go.opentelemetry.io/otel/attribute"
 
 	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
 )
@@ -37,10 +44,44 @@ import (
 // fails to produce a valid timestamp. This is primarily used for testing.
 var ErrInvalidTransactionTime = errors.New("failed to get transaction timestamp")
 
+// ErrInterrupted is returned (wrapped) when a fetch stops early because its
+// Interrupt channel was closed.
+var ErrInterrupted = errors.New("fetch interrupted")
+
+// ErrTooManyServerErrors is returned (wrapped) when the error files of the
+// export job's manifest report more errors than MaxServerErrors.
+var ErrTooManyServerErrors = errors.New("too many server errors")
+
+// OutputHandling is how a Fetcher handles the output files of a resource type
+// which is not ordinary data, such as Provenance or OperationOutcome.
+type OutputHandling string
+
+const (
+	// OutputHandlingProcess passes the resources to the Pipeline like any other
+	// data. This is the default.
+	OutputHandlingProcess OutputHandling = "process"
+	// OutputHandlingRoute passes the resources to a sink dedicated to the
+	// resource type instead of the Pipeline.
+	OutputHandlingRoute OutputHandling = "route"
+	// OutputHandlingSkip does not download the output files at all.
+	OutputHandlingSkip OutputHandling = "skip"
+)
+
+// OutputHandlingFromString returns the OutputHandling with the given name.
+func OutputHandlingFromString(s string) (OutputHandling, error) {
+	switch h := OutputHandling(strings.ToLower(s)); h {
+	case OutputHandlingProcess, OutputHandlingRoute, OutputHandlingSkip:
+		return h, nil
+	default:
+		return "", fmt.Errorf("unknown output handling %q, must be one of process, route or skip", s)
+	}
+}
+
 const (
-	defaultJobStatusPeriod  = 5 * time.Second
-	defaultJobStatusTimeout = 6 * time.Hour
-	defaultDataRetryCount   = 5
+	defaultJobStatusPeriod               = 5 * time.Second
+	defaultJobStatusTimeout              = 6 * time.Hour
+	defaultJobNotificationFallbackPeriod = 30 * time.Minute
+	defaultAccessCheckTimeout            = 30 * time.Second
 )
 
 const (
@@ -54,12 +95,33 @@ const (
 
 var processURLTime *metrics.Latency = metrics.NewLatency("process-url-time", "Bulk FHIR Server's provide a list of URLs to download FHIR ndjson from. ProcessURLTime records the time to download and process data from a particular Job URL.", "min", []float64{0, 1, 3, 7, 15, 30, 45, 60, 75, 90, 120, 150, 180, 210, 240, 270, 300, 330, 360, 390, 420, 450, 480})
 
+var downloadCounter *metrics.Counter = metrics.NewCounter("download-counter", "Count of requests to download data URLs, including retries, from the Bulk FHIR Server. The counter is tagged by the outcome of the request ex) OK or THROTTLED, and whether it was retried.", "1", aggregation.Count, "Outcome", "Retried")
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
 // Fetcher is a utility for running a bulk FHIR fetch end-to-end.
 type Fetcher struct {
-	Client               *bulkfhir.Client
-	Pipeline             *processing.Pipeline
+	Client   *bulkfhir.Client
+	Pipeline *processing.Pipeline
+	// If TransactionTimeStore is a bulkfhir.ResourceTypeTransactionTimeStore,
+	// ResourceTypes is set and no JobURL is specified, a separate export job is
+	// started for each distinct transaction time stored for the resource types,
+	// and the transaction time of each resource type is stored once all of its
+	// data has been processed, even if other resource types failed. A
+	// CheckpointStore cannot be used in this case.
 	TransactionTimeStore bulkfhir.TransactionTimeStore
-	TransactionTime      *bulkfhir.TransactionTime
+	// TransactionTime is set to the transaction time of the (first) export job.
+	TransactionTime *bulkfhir.TransactionTime
 
 	// If specified, no new job is started, and the Fetcher waits for this job to
 	// complete before processing data from it.
@@ -68,10 +130,26 @@ type Fetcher struct {
 	// Resource types to request if no JobURL is specified. May be empty.
 	ResourceTypes []cpb.ResourceTypeCode_Value
 
+	// _typeFilter expressions (e.g. "Observation?category=laboratory") to request
+	// if no JobURL is specified. May be empty.
+	TypeFilters []string
+
 	// Group to export if no JobURL is specified. If empty, defaults to exporting
 	// data for all patients.
 	ExportGroup string
 
+	// The level at which to export data if no JobURL is specified. If empty,
+	// this is ExportScopeGroup if ExportGroup is set, and ExportScopePatient
+	// otherwise.
+	ExportScope bulkfhir.ExportScope
+
+	// If set, only data changed before Until is requested if no JobURL is
+	// specified, and Until rather than the job's transaction time is stored as
+	// the time to export data since next, unless the transaction time is
+	// earlier. This lets a series of Fetchers each export one window of a
+	// server's history.
+	Until time.Time
+
 	// The following parameters may all be omitted, and sane defaults will be used.
 
 	// How frequently to poll for job status if the server does not return a
@@ -81,38 +159,553 @@ type Fetcher struct {
 	// How long to poll for job status for before giving up.
 	JobStatusTimeout time.Duration
 
-	// How many times to retry fetching each data URL.
+	// If set, rather than polling for job status every JobStatusPeriod, the
+	// job's status is checked when the server notifies JobNotifications that
+	// the job is complete, and every JobNotificationFallbackPeriod in case a
+	// notification is lost. JobNotificationFallbackPeriod defaults to 30m.
+	JobNotifications              *bulkfhir.JobNotificationListener
+	JobNotificationFallbackPeriod time.Duration
+
+	// Deprecated: DataRetryCount is ignored. Data requests are retried as
+	// configured by the RetryPolicy of the Client.
 	DataRetryCount int
+
+	// If greater than zero, before downloading any data, check that up to this
+	// many of the job's result URLs can be accessed, so that missing scopes or
+	// permissions fail the run straight away rather than partway through
+	// processing. The first URL of each resource type is checked before the
+	// second of any.
+	AccessCheckSampleSize int
+
+	// How long the access checks may take in total. If they take longer they
+	// are abandoned, and downloads go ahead. Defaults to 30s.
+	AccessCheckTimeout time.Duration
+
+	// How many data URLs to download concurrently. Resources are still passed
+	// to the Pipeline one at a time. Defaults to 1.
+	MaxDownloadWorkers int
+
+	// If set, the result URLs of the export job which have been fully
+	// processed are recorded here as they complete, after flushing the
+	// Pipeline. All of the Pipeline's sinks must implement processing.Flusher.
+	CheckpointStore bulkfhir.CheckpointStore
+
+	// If true, and CheckpointStore holds a checkpoint for an export job whose
+	// results were not all processed, the results of that job are processed
+	// instead of starting a new job, skipping those already completed. Ignored
+	// if JobURL is set to a different job.
+	Resume bool
+
+	// If set, a checkpoint which has not been updated within this long is
+	// discarded rather than resumed, as the server may no longer hold the job's
+	// results.
+	CheckpointTTL time.Duration
+
+	// If set, the transaction time is stored with a two-phase commit: once the
+	// Pipeline has been finalized, the previous and new transaction times and
+	// the CompletionTokens of the Pipeline's sinks are recorded here before the
+	// transaction time is stored, and cleared afterwards. If a run is
+	// interrupted in between, the next Run completes the commit before
+	// starting, rather than exporting and processing the same data again. It
+	// cannot be used when fetching multiple Groups or storing transaction times
+	// per resource type.
+	CommitLog bulkfhir.CommitLog
+
+	// If set, closing Interrupt stops the fetch early but cleanly: the Fetcher
+	// stops waiting for the export job and stops starting new downloads, lets
+	// the data URLs in progress finish, finalizes the Pipeline, and returns an
+	// error wrapping ErrInterrupted.
+	Interrupt <-chan struct{}
+
+	// If true, the export job is cancelled on the server when the fetch is
+	// interrupted, unless CheckpointStore is set, in which case the job is kept
+	// so that it can be resumed.
+	CancelJobOnInterrupt bool
+
+	// If greater than zero, and data URLs of the export job fail to download
+	// because they have expired (bulkfhir.ErrorDataNotFound), rather than
+	// failing the fetch, a new export job is started for just the resource
+	// types whose data was not all processed, since the same time as the
+	// original job and until its transaction time, and its results are
+	// processed in place of the expired ones. The transaction time of the
+	// original job is still the one stored. This is repeated up to this many
+	// times if the new job's URLs expire too. Servers which reject _until are
+	// asked for the resource types' data up to the present instead. Resources
+	// from the data URLs of those types which were processed before the others
+	// expired are written again.
+	MaxExpiredReKickoffs int
+
+	// If set, Pause is called before each data URL is downloaded and before
+	// the Pipeline is finalized, which wait until it returns. It lets work be
+	// held off for a while, such as during the peak hours of the server or of
+	// the outputs, without stopping the downloads in progress. If it returns an
+	// error, the download or finalization fails with it.
+	Pause func(ctx context.Context) error
+
+	// If set, each data URL, including the job's error files, is downloaded in
+	// full to a temporary file in ScanDir and scanned by Scanner before any of
+	// it is processed. A file which fails the scan fails the fetch, and is
+	// removed without being processed.
+	Scanner Scanner
+	// The directory in which to hold downloaded files while they are scanned.
+	// Defaults to the system's temporary directory.
+	ScanDir string
+
+	// If set, the OperationOutcomes in the error files of the export job's
+	// manifest are written here. They are summarized in the log regardless.
+	ServerErrorSink processing.ServerErrorSink
+
+	// If true, the fetch fails before any data is processed if the error files
+	// of the export job's manifest report more than MaxServerErrors issues with
+	// a severity of error or fatal.
+	FailOnServerErrors bool
+	MaxServerErrors    int
+
+	// How to handle OperationOutcome output files, which some servers list in
+	// the output array of the manifest rather than its error array. If
+	// OutputHandlingRoute, they are handled like the job's error files: they
+	// are summarized, written to ServerErrorSink if set, and counted towards
+	// MaxServerErrors.
+	OperationOutcomeHandling OutputHandling
+
+	// How to handle Provenance output files. If OutputHandlingRoute, the
+	// Provenance resources are written to ProvenanceSink, which must be set,
+	// instead of being passed to the Pipeline.
+	ProvenanceHandling OutputHandling
+	ProvenanceSink     processing.ProvenanceSink
+
+	// If set, and the fetch fails against Client before any data has been
+	// downloaded, for example because the export job cannot be started or its
+	// status polled, the fetch is retried from the start against
+	// FallbackClient, such as a regional mirror of the same server. The
+	// fallback is only tried once per Run.
+	FallbackClient *bulkfhir.Client
+
+	// DownloadedBytes is populated by Run with the number of bytes downloaded
+	// from each data URL, including the job's error files.
+	DownloadedBytes map[string]int64
+
+	// DownloadStats is populated by Run with the requests made to download each
+	// data URL, including the job's error files, and how each was resolved.
+	DownloadStats map[string]*bulkfhir.RequestStats
+
+	// ServerErrors is populated by Run with a summary of the job's error files.
+	ServerErrors processing.ServerErrorSummary
+
+	// mu must be held when calling Pipeline.Process, or when accessing
+	// DownloadedBytes, DownloadStats or checkpoint while data is being
+	// processed.
+	mu         sync.Mutex
+	checkpoint *bulkfhir.Checkpoint
+
+	// since is the transaction time loaded from TransactionTimeStore at the
+	// start of the run, which must still be stored when the run stores its own.
+	since time.Time
+
+	// shared is set when the Fetcher is one of a GroupsFetcher's, in which
+	// case the GroupsFetcher finalizes the Pipeline and ServerErrorSink and
+	// stores the transaction time, jobTransactionTime, once all are done.
+	shared             *sharedPipeline
+	jobTransactionTime time.Time
+
+	// jobURLs holds the export jobs whose results are processed, JobURL being
+	// the first. There is more than one if the kick-off request had to be
+	// split, see startJob.
+	jobURLs []string
+}
+
+// SetMetricsRecorder sends the metrics recorded by the Fetcher, and by the
+// rest of the bulk_fhir_tools libraries, to r, for example a Recorder from the
+// metrics/prometheus or metrics/opencensus packages, or metrics.NoOp to
+// discard them. It must be called at most once, before any metric is
+// recorded, so before the first Run, and otherwise returns an error. If it is
+// not called, metrics are counted in memory and never reported.
+func SetMetricsRecorder(r extmetrics.Recorder) error {
+	return metrics.InitRecorder(r)
+}
+
+// JobURLs returns the URLs of the export jobs whose results the last Run
+// processed, or is processing. There is more than one if the kick-off request
+// had to be split.
+func (f *Fetcher) JobURLs() []string {
+	return slices.Clone(f.jobURLs)
 }
 
 // Run the bulk FHIR fetch end-to-end. Note that while this does finalize the
 // configured processing pipeline, it does not close the bulk FHIR client.
-func (f *Fetcher) Run(ctx context.Context) error {
+func (f *Fetcher) Run(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "fetcher.Run")
+	defer func() { tracing.End(span, err) }()
 	f.setDefaultParameters()
+	if f.ProvenanceHandling == OutputHandlingRoute && f.ProvenanceSink == nil {
+		return errors.New("ProvenanceSink must be set to route Provenance output")
+	}
+	// The sinks are shared by every export job of the run, including any
+	// started on the fallback server, so they are only finalized once they are
+	// done.
+	if f.shared == nil {
+		defer func() {
+			if ferr := f.finalizeRoutedSinks(ctx); ferr != nil && err == nil {
+				err = ferr
+			}
+		}()
+	}
+
+	if err := f.recoverPendingCommit(ctx); err != nil {
+		return err
+	}
+	if err := f.loadCheckpoint(ctx); err != nil {
+		return err
+	}
+
+	err = f.run(ctx)
+	if err == nil || !f.canFailOver(ctx, err) {
+		return err
+	}
+	log.Warningf("Bulk FHIR fetch from the primary server failed before downloading any data, failing over to the fallback server: %v", err)
+	span.AddEvent("fetcher.FailOver")
+	// The job, if any, was started on the primary server, so a new one is
+	// started on the fallback server.
+	f.Client, f.FallbackClient = f.FallbackClient, nil
+	f.JobURL, f.jobURLs = "", nil
+	if err := f.run(ctx); err != nil {
+		return fmt.Errorf("fetch from the fallback server failed: %w", err)
+	}
+	return nil
+}
+
+// canFailOver returns whether the fetch, which failed with err, may be retried
+// against FallbackClient. Failures which would recur against the fallback
+// server, or which happen once data may already have been written, are not.
+func (f *Fetcher) canFailOver(ctx context.Context, err error) bool {
+	if f.FallbackClient == nil || ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, ErrInterrupted) || errors.Is(err, ErrTooManyServerErrors) || errors.Is(err, ErrInvalidTransactionTime) {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.DownloadedBytes) == 0
+}
+
+func (f *Fetcher) run(ctx context.Context) error {
+	if store, ok := f.TransactionTimeStore.(bulkfhir.ResourceTypeTransactionTimeStore); ok && f.JobURL == "" && len(f.ResourceTypes) > 0 {
+		return f.runPerResourceType(ctx, store)
+	}
 
 	if err := f.maybeStartJob(ctx); err != nil {
 		return err
 	}
 
-	jobStatus, err := f.waitForJob()
+	jobStatus, err := f.waitForJob(ctx)
 	if err != nil {
+		if errors.Is(err, ErrInterrupted) {
+			f.maybeCancelJob()
+		}
 		return err
 	}
 
-	f.TransactionTime.Set(jobStatus.TransactionTime)
+	f.setTransactionTime(jobStatus.TransactionTime)
+	ctx = f.withExportJob(ctx, jobStatus)
+
+	if err := f.processServerErrors(ctx, jobStatus); err != nil {
+		return err
+	}
+
+	if err := f.startCheckpoint(ctx); err != nil {
+		return err
+	}
+
+	if err := f.checkDataAccess(ctx, jobStatus); err != nil {
+		return err
+	}
 
 	if err := f.processData(ctx, jobStatus); err != nil {
+		if errors.Is(err, ErrInterrupted) {
+			f.maybeCancelJob()
+		}
 		return err
 	}
 
-	if err := f.TransactionTimeStore.Store(ctx, jobStatus.TransactionTime); err != nil {
-		return fmt.Errorf("failed to store transaction timestamp: %v", err)
+	if f.shared != nil {
+		f.jobTransactionTime = f.nextSince(jobStatus.TransactionTime)
+		return nil
+	}
+
+	if err := f.commitTransactionTime(ctx, f.nextSince(jobStatus.TransactionTime)); err != nil {
+		return err
 	}
 
 	log.Info("Bulk FHIR fetch job and processing complete.")
 	return nil
 }
 
+// nextSince returns the time to store as the time to export data since next,
+// given the transaction time of the job: Until if it is set and earlier, as no
+// data changed after it was requested.
+func (f *Fetcher) nextSince(transactionTime time.Time) time.Time {
+	if !f.Until.IsZero() && f.Until.Before(transactionTime) {
+		return f.Until
+	}
+	return transactionTime
+}
+
+// commitTransactionTime stores the transaction time of the job, whose outputs
+// have been finalized, and clears the checkpoint. If CommitLog is set, the
+// commit is first recorded there, so that it can be completed by
+// recoverPendingCommit if the run is interrupted before it is.
+func (f *Fetcher) commitTransactionTime(ctx context.Context, transactionTime time.Time) error {
+	if f.CommitLog != nil {
+		pc := &bulkfhir.PendingCommit{
+			JobURL:          f.JobURL,
+			Previous:        f.since,
+			TransactionTime: transactionTime,
+			Tokens:          f.Pipeline.CompletionTokens(),
+			Prepared:        time.Now().UTC(),
+		}
+		if err := f.CommitLog.Store(ctx, pc); err != nil {
+			return fmt.Errorf("failed to record pending commit: %w", err)
+		}
+		for _, token := range pc.Tokens {
+			log.Infof("Output finalized: %s", token)
+		}
+	}
+	if err := f.TransactionTimeStore.Store(ctx, f.since, transactionTime); err != nil {
+		if f.CommitLog != nil && errors.Is(err, bulkfhir.ErrTransactionTimeConflict) {
+			// Another run has stored a transaction time, so the commit can never
+			// be completed.
+			f.clearPendingCommit(ctx)
+		}
+		return fmt.Errorf("failed to store transaction timestamp: %w", err)
+	}
+	return f.completeCommit(ctx)
+}
+
+// completeCommit clears the checkpoint and pending commit once the transaction
+// time of a job has been stored.
+func (f *Fetcher) completeCommit(ctx context.Context) error {
+	if f.CheckpointStore != nil {
+		// The job is complete, so there is nothing left to resume.
+		if err := f.CheckpointStore.Store(ctx, &bulkfhir.Checkpoint{}); err != nil {
+			return fmt.Errorf("failed to clear checkpoint: %w", err)
+		}
+	}
+	if f.CommitLog != nil {
+		if err := f.CommitLog.Store(ctx, &bulkfhir.PendingCommit{}); err != nil {
+			return fmt.Errorf("failed to clear pending commit: %w", err)
+		}
+	}
+	return nil
+}
+
+// clearPendingCommit discards the pending commit, logging rather than
+// returning any error, as it is only called when the commit has failed.
+func (f *Fetcher) clearPendingCommit(ctx context.Context) {
+	if err := f.CommitLog.Store(ctx, &bulkfhir.PendingCommit{}); err != nil {
+		log.Errorf("Failed to clear pending commit: %v", err)
+	}
+}
+
+// recoverPendingCommit completes the commit recorded in CommitLog, if any, by
+// a run which finalized its outputs but was interrupted before storing its
+// transaction time.
+func (f *Fetcher) recoverPendingCommit(ctx context.Context) error {
+	if f.CommitLog == nil {
+		return nil
+	}
+	pc, err := f.CommitLog.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load pending commit: %w", err)
+	}
+	if !pc.Pending() {
+		return nil
+	}
+	log.Warningf("Completing the commit of transaction time %s for export job %s, whose outputs were finalized at %s by a run which was interrupted before storing it.", pc.TransactionTime.Format(time.RFC3339Nano), pc.JobURL, pc.Prepared.Format(time.RFC3339))
+	for _, token := range pc.Tokens {
+		log.Infof("Output finalized: %s", token)
+	}
+	if err := f.TransactionTimeStore.Store(ctx, pc.Previous, pc.TransactionTime); err != nil {
+		if !errors.Is(err, bulkfhir.ErrTransactionTimeConflict) {
+			return fmt.Errorf("failed to store transaction timestamp of pending commit: %w", err)
+		}
+		stored, lerr := f.TransactionTimeStore.Load(ctx)
+		if lerr != nil {
+			return fmt.Errorf("%v: %w", ErrInvalidTransactionTime, lerr)
+		}
+		if !stored.Equal(pc.TransactionTime) {
+			log.Warningf("Discarding the pending commit, as another run has since stored a transaction time: %v", err)
+			f.clearPendingCommit(ctx)
+			return nil
+		}
+		// The transaction time was stored, but the run was interrupted before
+		// clearing the pending commit.
+	}
+	return f.completeCommit(ctx)
+}
+
+// runPerResourceType fetches ResourceTypes with an export job for each
+// distinct transaction time stored for them, oldest first, so that resource
+// types which failed in a previous run are exported again from their last
+// successful transaction time without exporting the others again. A failed job
+// does not stop the jobs for the other resource types. The Pipeline is
+// finalized once all jobs are done, and then the transaction time of each
+// resource type which was fully processed is stored.
+func (f *Fetcher) runPerResourceType(ctx context.Context, store bulkfhir.ResourceTypeTransactionTimeStore) error {
+	if f.CheckpointStore != nil {
+		return errors.New("checkpointing is not supported when storing transaction times per resource type")
+	}
+	if f.CommitLog != nil {
+		return errors.New("a commit log is not supported when storing transaction times per resource type")
+	}
+	if f.shared != nil {
+		return errors.New("fetching multiple Groups is not supported when storing transaction times per resource type")
+	}
+	sinces, err := store.LoadResourceTypes(ctx, f.ResourceTypes)
+	if err != nil {
+		return fmt.Errorf("%v: %w", ErrInvalidTransactionTime, err)
+	}
+	jobTypes := map[time.Time][]cpb.ResourceTypeCode_Value{}
+	var jobSinces []time.Time
+	for _, rt := range f.ResourceTypes {
+		since := sinces[rt]
+		if _, ok := jobTypes[since]; !ok {
+			jobSinces = append(jobSinces, since)
+		}
+		jobTypes[since] = append(jobTypes[since], rt)
+	}
+	slices.SortFunc(jobSinces, time.Time.Compare)
+
+	// completedJob holds the resource types of a job which were fully
+	// processed, to be stored with the job's transaction time.
+	type completedJob struct {
+		since, transactionTime time.Time
+		types                  []cpb.ResourceTypeCode_Value
+	}
+	var errs []error
+	var completed []completedJob
+	for _, since := range jobSinces {
+		types := jobTypes[since]
+		if len(jobSinces) > 1 {
+			log.Infof("Exporting %v since %s.", types, fhir.ToFHIRInstant(since))
+		}
+		transactionTime, done, err := f.runJob(ctx, since, types)
+		if len(done) > 0 {
+			completed = append(completed, completedJob{since: since, transactionTime: transactionTime, types: done})
+		}
+		if err != nil {
+			errs = append(errs, err)
+			if errors.Is(err, ErrInterrupted) || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	if len(completed) == 0 {
+		return errors.Join(errs...)
+	}
+
+	if err := f.pause(ctx); err != nil {
+		return errors.Join(append(errs, fmt.Errorf("failed to finalize output pipeline: %w", err))...)
+	}
+	if err := f.Pipeline.Finalize(ctx); err != nil {
+		return errors.Join(append(errs, fmt.Errorf("failed to finalize output pipeline: %w", err))...)
+	}
+	stored := 0
+	for _, job := range completed {
+		if err := store.StoreResourceTypes(ctx, job.since, job.transactionTime, job.types); err != nil {
+			errs = append(errs, fmt.Errorf("failed to store transaction timestamp: %w", err))
+			continue
+		}
+		stored += len(job.types)
+	}
+	if len(errs) > 0 {
+		log.Warningf("Stored the transaction times of %d of %d resource types; the others will be exported again from their previous transaction time.", stored, len(f.ResourceTypes))
+		return errors.Join(errs...)
+	}
+	log.Info("Bulk FHIR fetch jobs and processing complete.")
+	return nil
+}
+
+// runJob starts and processes an export job for the given resource types,
+// without finalizing the Pipeline. It returns the time to export the resource
+// types since next, which is the job's transaction time unless Until is
+// earlier, and the resource types whose data was all processed, which may be some of them
+// even if an error is returned.
+func (f *Fetcher) runJob(ctx context.Context, since time.Time, types []cpb.ResourceTypeCode_Value) (time.Time, []cpb.ResourceTypeCode_Value, error) {
+	f.JobURL = ""
+	if err := f.startJob(ctx, since, types, typeFiltersFor(f.TypeFilters, types)); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	jobStatus, err := f.waitForJob(ctx)
+	if err != nil {
+		if errors.Is(err, ErrInterrupted) {
+			f.maybeCancelJob()
+		}
+		return time.Time{}, nil, err
+	}
+
+	// Sinks may use the transaction time from their first write until they are
+	// finalized, so it is kept from the first job.
+	if _, err := f.TransactionTime.Get(); err != nil {
+		f.TransactionTime.Set(jobStatus.TransactionTime)
+	}
+	ctx = f.withExportJob(ctx, jobStatus)
+
+	if err := f.processServerErrors(ctx, jobStatus); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	if err := f.checkDataAccess(ctx, jobStatus); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	processed, err := f.processResults(ctx, jobStatus, since, types, typeFiltersFor(f.TypeFilters, types))
+	if err == nil && f.interrupted() {
+		err = fmt.Errorf("%w before all data URLs were processed", ErrInterrupted)
+	}
+	if errors.Is(err, ErrInterrupted) {
+		f.maybeCancelJob()
+	}
+	return f.nextSince(jobStatus.TransactionTime), completedTypes(jobStatus, types, processed), err
+}
+
+// completedTypes returns those of types whose result URLs were all processed.
+// As the deleted resources are not listed by type, none are complete unless all
+// of them were processed too.
+func completedTypes(jobStatus bulkfhir.JobStatus, types []cpb.ResourceTypeCode_Value, processed map[string]bool) []cpb.ResourceTypeCode_Value {
+	for _, url := range jobStatus.DeletedURLs {
+		if !processed[url] {
+			return nil
+		}
+	}
+	var completed []cpb.ResourceTypeCode_Value
+	for _, rt := range types {
+		complete := true
+		for _, url := range jobStatus.ResultURLs[rt] {
+			complete = complete && processed[url]
+		}
+		if complete {
+			completed = append(completed, rt)
+		}
+	}
+	return completed
+}
+
+// typeFiltersFor returns those of the _typeFilter expressions which apply to
+// one of the given resource types.
+func typeFiltersFor(typeFilters []string, types []cpb.ResourceTypeCode_Value) []string {
+	var filtered []string
+	for _, tf := range typeFilters {
+		name, _, _ := strings.Cut(tf, "?")
+		rt, err := bulkfhir.ResourceTypeCodeFromName(name)
+		if err != nil || slices.Contains(types, rt) {
+			filtered = append(filtered, tf)
+		}
+	}
+	return filtered
+}
+
 func (f *Fetcher) setDefaultParameters() {
 	if f.JobStatusPeriod == 0 {
 		f.JobStatusPeriod = defaultJobStatusPeriod
@@ -120,39 +713,262 @@ func (f *Fetcher) setDefaultParameters() {
 	if f.JobStatusTimeout == 0 {
 		f.JobStatusTimeout = defaultJobStatusTimeout
 	}
-	if f.DataRetryCount == 0 {
-		f.DataRetryCount = defaultDataRetryCount
+	if f.JobNotificationFallbackPeriod == 0 {
+		f.JobNotificationFallbackPeriod = defaultJobNotificationFallbackPeriod
+	}
+	if f.MaxDownloadWorkers == 0 {
+		f.MaxDownloadWorkers = 1
+	}
+	if f.AccessCheckTimeout == 0 {
+		f.AccessCheckTimeout = defaultAccessCheckTimeout
 	}
 }
 
-func (f *Fetcher) maybeStartJob(ctx context.Context) error {
-	if f.JobURL != "" {
+// loadCheckpoint loads the checkpoint from CheckpointStore, if set. If resuming,
+// JobURL is set to the job recorded in the checkpoint.
+func (f *Fetcher) loadCheckpoint(ctx context.Context) error {
+	if f.CheckpointStore == nil {
+		return nil
+	}
+	if err := f.Pipeline.CanFlush(); err != nil {
+		return fmt.Errorf("checkpointing is not supported by the output pipeline: %w", err)
+	}
+	cp, err := f.CheckpointStore.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+	if f.CheckpointTTL > 0 && cp.Expired(f.CheckpointTTL) {
+		log.Warningf("Discarding the checkpoint for export job %s, which was last updated at %s, more than %s ago.", cp.JobURL, cp.Updated, f.CheckpointTTL)
+		cp = &bulkfhir.Checkpoint{}
+	}
+	f.checkpoint = cp
+	if f.Resume && f.JobURL == "" && cp.JobURL != "" {
+		log.Infof("Resuming export job %s, skipping %d result URLs which have already been processed.", cp.JobURL, len(cp.CompletedURLs))
+		f.JobURL = cp.JobURL
+	}
+	return nil
+}
+
+// startCheckpoint stores a new checkpoint for the job being processed, unless
+// the stored checkpoint is for the same job and resuming.
+func (f *Fetcher) startCheckpoint(ctx context.Context) error {
+	if f.CheckpointStore == nil {
+		return nil
+	}
+	if f.Resume && f.checkpoint.JobURL == f.JobURL {
 		return nil
 	}
+	f.checkpoint = &bulkfhir.Checkpoint{JobURL: f.JobURL, Updated: time.Now().UTC()}
+	if err := f.CheckpointStore.Store(ctx, f.checkpoint); err != nil {
+		return fmt.Errorf("failed to store checkpoint: %w", err)
+	}
+	return nil
+}
+
+// isCompleted returns whether the result URL was already processed by a
+// previous run, according to the checkpoint.
+func (f *Fetcher) isCompleted(url string) bool {
+	if f.checkpoint == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Contains(f.checkpoint.CompletedURLs, url)
+}
+
+// completeURL flushes the pipeline, so that all resources from the result URL
+// are durably stored, and then records the URL as completed in the checkpoint.
+func (f *Fetcher) completeURL(ctx context.Context, url string) error {
+	if f.CheckpointStore == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Pipeline.Flush(ctx); err != nil {
+		return fmt.Errorf("failed to flush output pipeline: %w", err)
+	}
+	f.checkpoint.CompletedURLs = append(f.checkpoint.CompletedURLs, url)
+	f.checkpoint.Updated = time.Now().UTC()
+	if err := f.CheckpointStore.Store(ctx, f.checkpoint); err != nil {
+		return fmt.Errorf("failed to store checkpoint: %w", err)
+	}
+	return nil
+}
 
+// maybeStartJob loads the transaction time to export data since, which is
+// also needed to store the transaction time of a job which is resumed, and
+// starts a job unless JobURL is set.
+func (f *Fetcher) maybeStartJob(ctx context.Context) error {
 	since, err := f.TransactionTimeStore.Load(ctx)
 	if err != nil {
 		// We match the text of ErrInvalidTransactionTime in tests; fmt.Errorf does
 		// not allow using multiple %w verbs.
 		return fmt.Errorf("%v: %w", ErrInvalidTransactionTime, err)
 	}
-	if f.ExportGroup != "" {
-		f.JobURL, err = f.Client.StartBulkDataExport(f.ResourceTypes, since, f.ExportGroup)
-	} else {
-		log.Warning("No export Group ID set, so defaulting to the Patient endpoint to export all resources.")
-		f.JobURL, err = f.Client.StartBulkDataExportAll(f.ResourceTypes, since)
+	f.since = since
+	if f.JobURL != "" {
+		f.jobURLs = []string{f.JobURL}
+		return nil
 	}
+	return f.startJob(ctx, since, f.ResourceTypes, f.TypeFilters)
+}
+
+// startJob starts an export job for the given resource types and sets JobURL.
+//
+// If the server rejects the kick-off request as too large, for example
+// because the URL is too long for it with many _type values or long
+// _typeFilter expressions, the request is split in two, each half for half of
+// the resource types, or for half of the _typeFilters if there is only one
+// type, and so on until the server accepts them. JobURL is then set to the
+// first of the jobs started, and waitForJob waits for all of them and merges
+// their results. Resources matching more than one _typeFilter of a type which
+// was split may be exported twice. Split jobs cannot be checkpointed.
+func (f *Fetcher) startJob(ctx context.Context, since time.Time, resourceTypes []cpb.ResourceTypeCode_Value, typeFilters []string) error {
+	jobURLs, err := f.kickOff(ctx, since, resourceTypes, typeFilters)
 	if err != nil {
-		return fmt.Errorf("unable to start Bulk FHIR export job: %w", err)
+		return err
+	}
+	f.JobURL, f.jobURLs = jobURLs[0], jobURLs
+	if len(jobURLs) > 1 {
+		log.Infof("Started %d Bulk FHIR export jobs in place of one: %v", len(jobURLs), jobURLs)
 	}
-	log.Infof("Started Bulk FHIR export job: %s\n", f.JobURL)
 	return nil
 }
 
-func (f *Fetcher) waitForJob() (bulkfhir.JobStatus, error) {
+// exportRequest is the resource types and _typeFilters of a kick-off request.
+type exportRequest struct {
+	types       []cpb.ResourceTypeCode_Value
+	typeFilters []string
+}
+
+// kickOff starts export jobs for the given resource types, splitting the
+// request if the server rejects it as too large, and returns their URLs.
+func (f *Fetcher) kickOff(ctx context.Context, since time.Time, resourceTypes []cpb.ResourceTypeCode_Value, typeFilters []string) ([]string, error) {
+	jobURL, err := f.startExport(ctx, since, f.Until, resourceTypes, typeFilters)
+	if err == nil {
+		return []string{jobURL}, nil
+	}
+	halves := splitExportRequest(exportRequest{types: resourceTypes, typeFilters: typeFilters})
+	if !errors.Is(err, bulkfhir.ErrorKickoffTooLarge) || halves == nil {
+		return nil, err
+	}
+	if f.CheckpointStore != nil {
+		return nil, fmt.Errorf("%w, and it cannot be split into smaller export jobs when checkpointing", err)
+	}
+	log.Warningf("The Bulk FHIR server rejected the kick-off request for resource types %v with %d _typeFilters as too large, splitting it in two: %v", resourceTypes, len(typeFilters), err)
+
+	var jobURLs []string
+	for _, half := range halves {
+		urls, err := f.kickOff(ctx, since, half.types, half.typeFilters)
+		if err != nil {
+			// Cancel the jobs already started, whose results would not be
+			// processed.
+			for _, u := range jobURLs {
+				if cerr := f.Client.CancelJobContext(ctx, u); cerr != nil {
+					log.Errorf("failed to cancel export job %s: %v", u, cerr)
+				}
+			}
+			return nil, err
+		}
+		jobURLs = append(jobURLs, urls...)
+	}
+	return jobURLs, nil
+}
+
+// splitExportRequest splits r into two requests for half of its resource
+// types each, with the _typeFilters of those types, or, if it has only one
+// resource type, for half of its _typeFilters each. It returns nil if r
+// cannot be split, as it is for all resource types, or for one type with at
+// most one _typeFilter.
+func splitExportRequest(r exportRequest) []exportRequest {
+	switch {
+	case len(r.types) > 1:
+		a, b := r.types[:len(r.types)/2], r.types[len(r.types)/2:]
+		return []exportRequest{
+			{types: a, typeFilters: typeFiltersFor(r.typeFilters, a)},
+			{types: b, typeFilters: typeFiltersFor(r.typeFilters, b)},
+		}
+	case len(r.types) == 1 && len(r.typeFilters) > 1:
+		return []exportRequest{
+			{types: r.types, typeFilters: r.typeFilters[:len(r.typeFilters)/2]},
+			{types: r.types, typeFilters: r.typeFilters[len(r.typeFilters)/2:]},
+		}
+	}
+	return nil
+}
+
+// startExport sends a single kick-off request, returning the job's URL.
+func (f *Fetcher) startExport(ctx context.Context, since, until time.Time, resourceTypes []cpb.ResourceTypeCode_Value, typeFilters []string) (jobURL string, err error) {
+	ctx, span := tracing.Start(ctx, "bulkfhir.KickOff")
+	defer func() { tracing.End(span, err) }()
+
+	scope := f.ExportScope
+	if scope == "" {
+		scope = bulkfhir.ExportScopePatient
+		if f.ExportGroup != "" {
+			scope = bulkfhir.ExportScopeGroup
+		} else {
+			log.Warning("No export Group ID set, so defaulting to the Patient endpoint to export all resources.")
+		}
+	}
+	jobURL, err = f.Client.StartExportContext(ctx, bulkfhir.ExportParameters{
+		Scope:       scope,
+		GroupID:     f.ExportGroup,
+		Types:       resourceTypes,
+		TypeFilters: typeFilters,
+		Since:       since,
+		Until:       until,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to start Bulk FHIR export job: %w", err)
+	}
+	log.Infof("Started Bulk FHIR export job: %s\n", jobURL)
+	return jobURL, nil
+}
+
+// waitForJob waits for the export jobs in jobURLs to complete, and returns
+// their merged status: the result URLs of all of them, and the earliest of
+// their transaction times, so that no data is missed by the next export.
+func (f *Fetcher) waitForJob(ctx context.Context) (bulkfhir.JobStatus, error) {
+	if len(f.jobURLs) <= 1 {
+		return f.waitForJobURL(ctx, f.JobURL)
+	}
+	merged := bulkfhir.JobStatus{IsComplete: true, PercentComplete: 100, ResultURLs: map[cpb.ResourceTypeCode_Value][]string{}}
+	for i, jobURL := range f.jobURLs {
+		jobStatus, err := f.waitForJobURL(ctx, jobURL)
+		if err != nil {
+			return jobStatus, err
+		}
+		for rt, urls := range jobStatus.ResultURLs {
+			merged.ResultURLs[rt] = append(merged.ResultURLs[rt], urls...)
+		}
+		merged.DeletedURLs = append(merged.DeletedURLs, jobStatus.DeletedURLs...)
+		merged.ErrorURLs = append(merged.ErrorURLs, jobStatus.ErrorURLs...)
+		if i == 0 || jobStatus.TransactionTime.Before(merged.TransactionTime) {
+			merged.TransactionTime = jobStatus.TransactionTime
+		}
+	}
+	log.Infof("All %d Bulk FHIR export jobs finished. Using the earliest transaction time, %s.", len(f.jobURLs), fhir.ToFHIRInstant(merged.TransactionTime))
+	return merged, nil
+}
+
+func (f *Fetcher) waitForJobURL(ctx context.Context, jobURL string) (_ bulkfhir.JobStatus, err error) {
+	ctx, span := tracing.Start(ctx, "bulkfhir.PollJobStatus")
+	defer func() { tracing.End(span, err) }()
+	ctx, cancel := f.untilInterrupted(ctx)
+	defer cancel()
 	start := time.Now()
+	var monitorResults <-chan *bulkfhir.MonitorResult
+	if f.JobNotifications != nil {
+		notified, stop := f.JobNotifications.Watch(jobURL)
+		defer stop()
+		log.Infof("Waiting for a notification that export job %s is complete, checking every %s in case it is lost", jobURL, f.JobNotificationFallbackPeriod)
+		monitorResults = f.Client.MonitorJobStatusNotifiedContext(ctx, jobURL, notified, f.JobNotificationFallbackPeriod, f.JobStatusTimeout)
+	} else {
+		monitorResults = f.Client.MonitorJobStatusContext(ctx, jobURL, f.JobStatusPeriod, f.JobStatusTimeout)
+	}
 	var monitorResult *bulkfhir.MonitorResult
-	for monitorResult = range f.Client.MonitorJobStatus(f.JobURL, f.JobStatusPeriod, f.JobStatusTimeout) {
+	for monitorResult = range monitorResults {
 		if monitorResult.Error != nil {
 			log.Errorf("error while checking job status: %v", monitorResult.Error)
 		}
@@ -165,6 +981,12 @@ func (f *Fetcher) waitForJob() (bulkfhir.JobStatus, error) {
 		}
 	}
 
+	if f.interrupted() {
+		return bulkfhir.JobStatus{}, fmt.Errorf("%w while waiting for export job %s", ErrInterrupted, jobURL)
+	}
+	if monitorResult == nil {
+		return bulkfhir.JobStatus{}, fmt.Errorf("stopped waiting for export job %s: %w", jobURL, ctx.Err())
+	}
 	jobStatus := monitorResult.Status
 	if !jobStatus.IsComplete {
 		return jobStatus, fmt.Errorf("Bulk FHIR export job did not finish before the timeout of %s: %w", f.JobStatusTimeout, monitorResult.Error)
@@ -175,61 +997,687 @@ func (f *Fetcher) waitForJob() (bulkfhir.JobStatus, error) {
 	return jobStatus, nil
 }
 
+// dataURL is a single result URL of an export job.
+type dataURL struct {
+	resourceType cpb.ResourceTypeCode_Value
+	url          string
+	// deleted is whether this is a URL from the deleted array of the job's
+	// manifest, listing deleted resources in Bundles.
+	deleted bool
+}
+
+// checkDataAccess checks that a sample of the job's result URLs which have not
+// already been processed can be accessed. Only errors denying access fail the
+// run; other errors may be transient, and are retried when downloading.
+func (f *Fetcher) checkDataAccess(ctx context.Context, jobStatus bulkfhir.JobStatus) (err error) {
+	if f.AccessCheckSampleSize <= 0 {
+		return nil
+	}
+	sample := f.accessCheckSample(jobStatus.ResultURLs)
+	ctx, span := tracing.Start(ctx, "bulkfhir.CheckDataAccess", attribute.Int("bulkfhir.urls", len(sample)))
+	defer func() { tracing.End(span, err) }()
+
+	checkCtx, cancel := context.WithTimeout(ctx, f.AccessCheckTimeout)
+	defer cancel()
+	for _, u := range sample {
+		err := f.Client.CheckDataAccess(checkCtx, u.url)
+		if errors.Is(err, bulkfhir.ErrorUnauthorized) {
+			// The credentials may have expired while waiting for the job.
+			if err := f.authenticate(ctx); err != nil {
+				return fmt.Errorf("failed to authenticate: %w", err)
+			}
+			err = f.Client.CheckDataAccess(checkCtx, u.url)
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, bulkfhir.ErrorUnauthorized), errors.Is(err, bulkfhir.ErrorForbidden):
+			return fmt.Errorf("access denied to %s data at %s, check the scopes and permissions of the client: %w", u.resourceType, u.url, err)
+		case checkCtx.Err() != nil:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Warningf("Checking access to the result URLs took longer than %s, starting downloads anyway.", f.AccessCheckTimeout)
+			return nil
+		default:
+			log.Warningf("Unable to check access to %s data at %s: %v", u.resourceType, u.url, err)
+		}
+	}
+	log.Infof("Checked access to %d result URLs.", len(sample))
+	return nil
+}
+
+// accessCheckSample returns up to AccessCheckSampleSize of resultURLs which
+// have not already been processed, taking the first URL of each resource type,
+// then the second, and so on.
+func (f *Fetcher) accessCheckSample(resultURLs map[cpb.ResourceTypeCode_Value][]string) []dataURL {
+	types := make([]cpb.ResourceTypeCode_Value, 0, len(resultURLs))
+	for t := range resultURLs {
+		if f.downloadedWithData(t) {
+			types = append(types, t)
+		}
+	}
+	slices.Sort(types)
+	var sample []dataURL
+	for i, more := 0, true; more && len(sample) < f.AccessCheckSampleSize; i++ {
+		more = false
+		for _, t := range types {
+			if i >= len(resultURLs[t]) {
+				continue
+			}
+			more = true
+			if u := resultURLs[t][i]; !f.isCompleted(u) && len(sample) < f.AccessCheckSampleSize {
+				sample = append(sample, dataURL{resourceType: t, url: u})
+			}
+		}
+	}
+	return sample
+}
+
 func (f *Fetcher) processData(ctx context.Context, jobStatus bulkfhir.JobStatus) error {
 	log.Infof("Starting data download and processing.")
 	start := time.Now()
-	for resourceType, urls := range jobStatus.ResultURLs {
+
+	if _, err := f.processResults(ctx, jobStatus, f.since, f.ResourceTypes, f.TypeFilters); err != nil {
+		return err
+	}
+
+	if f.shared == nil {
+		if err := f.pause(ctx); err != nil {
+			return fmt.Errorf("failed to finalize output pipeline: %w", err)
+		}
+		if err := f.Pipeline.Finalize(ctx); err != nil {
+			return fmt.Errorf("failed to finalize output pipeline: %w", err)
+		}
+	}
+	if f.interrupted() {
+		return fmt.Errorf("%w before all data URLs were processed", ErrInterrupted)
+	}
+	log.Infof("It took %s to download, process and output the FHIR from all the ndjson URLs.", time.Since(start).Round(time.Second))
+	return nil
+}
+
+// processURLs downloads and processes the job's result URLs, and then the URLs
+// of its deleted resources, returning the set of URLs which were fully
+// processed, including by a previous run. It stops starting new downloads once
+// any has failed or the fetch is interrupted.
+func (f *Fetcher) processURLs(ctx context.Context, jobStatus bulkfhir.JobStatus) (map[string]bool, error) {
+	processed := map[string]bool{}
+	var (
+		errsMu sync.Mutex
+		errs   []error
+		// expired counts the errors of data URLs which had expired.
+		expired int
+	)
+	// run processes the URLs which dispatch sends with MaxDownloadWorkers
+	// workers, returning once they have all been processed.
+	run := func(dispatch func(urls chan<- dataURL)) {
+		urls := make(chan dataURL)
+		var wg sync.WaitGroup
+		for i := 0; i < f.MaxDownloadWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for u := range urls {
+					if f.isCompleted(u.url) {
+						errsMu.Lock()
+						processed[u.url] = true
+						errsMu.Unlock()
+						continue
+					}
+					start := time.Now()
+					err := f.processURL(ctx, u)
+					if err == nil {
+						err = f.completeURL(ctx, u.url)
+					}
+					if err == nil {
+						err = processURLTime.Record(ctx, float64(time.Since(start)/time.Minute))
+					}
+					if err != nil {
+						log.Errorf("failed to process %s data from %s: %v", u.resourceType, u.url, err)
+						errsMu.Lock()
+						errs = append(errs, fmt.Errorf("%s: %w", u.url, err))
+						if errors.Is(err, bulkfhir.ErrorDataNotFound) {
+							expired++
+						}
+						errsMu.Unlock()
+						continue
+					}
+					errsMu.Lock()
+					processed[u.url] = true
+					errsMu.Unlock()
+				}
+			}()
+		}
+		dispatch(urls)
+		close(urls)
+		if f.interrupted() {
+			log.Warning("Fetch interrupted: finishing the data URLs in progress without starting any more.")
+		}
+		wg.Wait()
+	}
+
+	// Stop handing out URLs once any has failed, but let those in progress
+	// finish so that all failures are reported.
+	failed := func() bool {
+		errsMu.Lock()
+		defer errsMu.Unlock()
+		return len(errs) > 0
+	}
+	run(func(urls chan<- dataURL) {
+	dispatch:
+		for resourceType, resourceURLs := range jobStatus.ResultURLs {
+			if !f.downloadedWithData(resourceType) {
+				// These URLs are skipped, or were already handled with the job's
+				// error files.
+				errsMu.Lock()
+				for _, url := range resourceURLs {
+					processed[url] = true
+				}
+				errsMu.Unlock()
+				continue
+			}
+			for _, url := range resourceURLs {
+				if failed() || f.interrupted() {
+					break dispatch
+				}
+				select {
+				case urls <- dataURL{resourceType: resourceType, url: url}:
+				case <-f.Interrupt:
+					break dispatch
+				}
+			}
+		}
+	})
+	// Deletions are processed once all of the output has been, although the two
+	// should not overlap: a resource deleted and then recreated is only in the
+	// output.
+	if !failed() && !f.interrupted() && len(jobStatus.DeletedURLs) > 0 {
+		log.Infof("Processing %d files of resources deleted since the last fetch.", len(jobStatus.DeletedURLs))
+		run(func(urls chan<- dataURL) {
+			for _, url := range jobStatus.DeletedURLs {
+				if failed() || f.interrupted() {
+					return
+				}
+				select {
+				case urls <- dataURL{resourceType: cpb.ResourceTypeCode_BUNDLE, url: url, deleted: true}:
+				case <-f.Interrupt:
+					return
+				}
+			}
+		})
+	}
+	var err error
+	if len(errs) == 1 {
+		err = errs[0]
+	} else if len(errs) > 1 {
+		err = fmt.Errorf("failed to process %d data URLs: %w", len(errs), errors.Join(errs...))
+	}
+	if err != nil && expired == len(errs) {
+		err = &expiredError{err}
+	}
+	return processed, err
+}
+
+// expiredError wraps the error of processURLs when all of the data URLs which
+// failed had expired.
+type expiredError struct {
+	err error
+}
+
+func (e *expiredError) Error() string { return e.err.Error() }
+func (e *expiredError) Unwrap() error { return e.err }
+
+// processResults processes the job's result URLs with processURLs, returning
+// the set of URLs which were fully processed. If some expired, and
+// MaxExpiredReKickoffs allows, a new export job, for the given resource types
+// and _typeFilters since the given time, is started for the resource types
+// whose URLs were not all processed, and its results are processed in their
+// place. The URLs of the original job of the resource types whose data was
+// processed by a new job are then included in the set returned.
+func (f *Fetcher) processResults(ctx context.Context, jobStatus bulkfhir.JobStatus, since time.Time, types []cpb.ResourceTypeCode_Value, typeFilters []string) (map[string]bool, error) {
+	processed, err := f.processURLs(ctx, jobStatus)
+	job, jobProcessed := jobStatus, processed
+	for attempt := 1; attempt <= f.MaxExpiredReKickoffs; attempt++ {
+		var expired *expiredError
+		if !errors.As(err, &expired) || f.interrupted() || ctx.Err() != nil {
+			break
+		}
+		// The deleted resources are not listed by type, so if any of their URLs
+		// expired, the deletions of every type are exported again.
+		missing, deleted := unprocessedTypes(job, jobProcessed)
+		reTypes, reTypeFilters := missing, typeFiltersFor(typeFilters, missing)
+		if deleted {
+			reTypes, reTypeFilters = types, typeFilters
+		}
+		log.Warningf("Data URLs of the Bulk FHIR export job expired before they could be downloaded, exporting %s again (attempt %d of %d): %v", describeTypes(reTypes), attempt, f.MaxExpiredReKickoffs, err)
+
+		var reJob bulkfhir.JobStatus
+		if reJob, err = f.reExport(ctx, since, f.nextSince(jobStatus.TransactionTime), reTypes, reTypeFilters); err != nil {
+			return processed, fmt.Errorf("failed to export the data of expired URLs again: %w", err)
+		}
+		if err = f.processServerErrors(ctx, reJob); err != nil {
+			return processed, err
+		}
+		job = reJob
+		jobProcessed, err = f.processURLs(ctx, reJob)
+
+		// Stitch the results of the new job into those of the original.
+		if reTypes == nil {
+			reTypes = resultTypes(jobStatus, reJob)
+		}
+		done := completedTypes(reJob, reTypes, jobProcessed)
+		for _, rt := range done {
+			for _, url := range jobStatus.ResultURLs[rt] {
+				processed[url] = true
+			}
+		}
+		if deleted && len(done) > 0 {
+			for _, url := range jobStatus.DeletedURLs {
+				processed[url] = true
+			}
+		}
+	}
+	return processed, err
+}
+
+// unprocessedTypes returns the resource types with result URLs which were not
+// processed, and whether any of the URLs of deleted resources were not.
+func unprocessedTypes(jobStatus bulkfhir.JobStatus, processed map[string]bool) ([]cpb.ResourceTypeCode_Value, bool) {
+	var types []cpb.ResourceTypeCode_Value
+	for rt, urls := range jobStatus.ResultURLs {
 		for _, url := range urls {
-			start := time.Now()
-			if err := f.processURL(ctx, resourceType, url); err != nil {
-				return err
+			if !processed[url] {
+				types = append(types, rt)
+				break
 			}
-			if err := processURLTime.Record(ctx, float64(time.Since(start)/time.Minute)); err != nil {
-				return err
+		}
+	}
+	slices.Sort(types)
+	deleted := slices.ContainsFunc(jobStatus.DeletedURLs, func(url string) bool { return !processed[url] })
+	return types, deleted
+}
+
+// resultTypes returns the resource types with result URLs in any of the jobs.
+func resultTypes(jobs ...bulkfhir.JobStatus) []cpb.ResourceTypeCode_Value {
+	var types []cpb.ResourceTypeCode_Value
+	for _, job := range jobs {
+		for rt := range job.ResultURLs {
+			if !slices.Contains(types, rt) {
+				types = append(types, rt)
 			}
 		}
 	}
+	return types
+}
 
-	if err := f.Pipeline.Finalize(ctx); err != nil {
-		return fmt.Errorf("failed to finalize output pipeline: %w", err)
+func describeTypes(types []cpb.ResourceTypeCode_Value) string {
+	if len(types) == 0 {
+		return "all resource types"
 	}
-	log.Infof("It took %s to download, process and output the FHIR from all the ndjson URLs.", time.Since(start).Round(time.Second))
-	return nil
+	return fmt.Sprint(types)
 }
 
-func (f *Fetcher) processURL(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, url string) error {
-	r, err := f.getDataWithRetries(url)
+// reExport starts an export job for the given resource types, until the given
+// time if the server supports _until, and waits for it to complete. The job is
+// added to jobURLs, so that it is cancelled with the others.
+func (f *Fetcher) reExport(ctx context.Context, since, until time.Time, types []cpb.ResourceTypeCode_Value, typeFilters []string) (bulkfhir.JobStatus, error) {
+	jobURL, err := f.startExport(ctx, since, until, types, typeFilters)
+	if errors.Is(err, bulkfhir.ErrorUnexpectedStatusCode) {
+		log.Warningf("The Bulk FHIR server rejected the kick-off request with _until, exporting the data up to the present instead: %v", err)
+		jobURL, err = f.startExport(ctx, since, time.Time{}, types, typeFilters)
+	}
+	if err != nil {
+		return bulkfhir.JobStatus{}, err
+	}
+	f.jobURLs = append(f.jobURLs, jobURL)
+	jobStatus, err := f.waitForJobURL(ctx, jobURL)
+	if errors.Is(err, ErrInterrupted) {
+		f.maybeCancelJob()
+	}
+	return jobStatus, err
+}
+
+func (f *Fetcher) processURL(ctx context.Context, u dataURL) (err error) {
+	resourceType, url := u.resourceType, u.url
+	// The download span also covers processing, as resources are passed to the
+	// pipeline as they are read. The time spent in the pipeline (rectification
+	// and writing to sinks) is recorded as an attribute to tell the two apart.
+	ctx, span := tracing.Start(ctx, "bulkfhir.Download",
+		attribute.String("fhir.resource_type", resourceType.String()),
+		attribute.String("url.full", url),
+		attribute.Bool("bulkfhir.deleted", u.deleted))
+	defer func() { tracing.End(span, err) }()
+	if err := f.pause(ctx); err != nil {
+		return err
+	}
+	r, err := f.getData(ctx, url)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
-	s := bufio.NewScanner(r)
+	cr := &countingReader{r: r}
+	var resources int64
+	var processing time.Duration
+	defer func() {
+		span.SetAttributes(
+			attribute.Int64("bulkfhir.downloaded_bytes", cr.n),
+			attribute.Int64("bulkfhir.resources", resources),
+			attribute.Float64("pipeline.process_seconds", processing.Seconds()))
+		f.addDownloadedBytes(url, cr.n)
+	}()
+	var data io.Reader = cr
+	if f.Scanner != nil {
+		scanned, err := f.scan(ctx, url, cr)
+		if err != nil {
+			return err
+		}
+		defer scanned.Close()
+		data = scanned
+	}
+	s := bufio.NewScanner(data)
 	// The default bufio.MaxScanTokenSize of 64kB is too small for some resources.
 	s.Buffer(make([]byte, initialBufferSize), maxTokenSize)
+	// Track the offset of each line, so that the lineage of resources can
+	// locate them in the data.
+	var lineOffset, nextOffset int64
+	s.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			lineOffset = nextOffset
+		}
+		nextOffset += int64(advance)
+		return advance, token, err
+	})
 	for s.Scan() {
-		if err := f.Pipeline.Process(ctx, resourceType, url, s.Bytes()); err != nil {
+		start := time.Now()
+		var err error
+		if u.deleted {
+			err = f.processDeleted(ctx, url, s.Bytes())
+		} else if resourceType == cpb.ResourceTypeCode_PROVENANCE && f.ProvenanceHandling == OutputHandlingRoute {
+			err = f.writeProvenance(ctx, url, s.Bytes())
+		} else {
+			err = f.process(withLine(ctx, lineOffset, s.Bytes()), resourceType, url, s.Bytes())
+		}
+		processing += time.Since(start)
+		if err != nil {
 			return err
 		}
+		resources++
 	}
 	return s.Err()
 }
 
-func (f *Fetcher) getDataWithRetries(url string) (io.ReadCloser, error) {
-	r, err := f.Client.GetData(url)
-	numRetries := 0
-	// Retry both unauthorized and other retryable errors by re-authenticating,
-	// as sometimes they appear to be related.
-	for (errors.Is(err, bulkfhir.ErrorUnauthorized) || errors.Is(err, bulkfhir.ErrorRetryableHTTPStatus)) && numRetries < 5 {
-		time.Sleep(2 * time.Second)
-		log.Infof("Got retryable error from Bulk FHIR server. Re-authenticating and trying again.")
-		if err := f.Client.Authenticate(); err != nil {
-			return nil, fmt.Errorf("failed to authenticate: %w", err)
+func (f *Fetcher) addDownloadedBytes(url string, n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.DownloadedBytes == nil {
+		f.DownloadedBytes = map[string]int64{}
+	}
+	f.DownloadedBytes[url] += n
+}
+
+// processServerErrors downloads the job's error files, summarizing the
+// OperationOutcomes they hold and writing them to ServerErrorSink if set. This
+// is done before processing data, so that a job with too many errors can fail
+// the fetch straight away.
+func (f *Fetcher) processServerErrors(ctx context.Context, jobStatus bulkfhir.JobStatus) (err error) {
+	urls := jobStatus.ErrorURLs
+	if f.OperationOutcomeHandling == OutputHandlingRoute {
+		urls = append(slices.Clone(urls), jobStatus.ResultURLs[cpb.ResourceTypeCode_OPERATION_OUTCOME]...)
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	ctx, span := tracing.Start(ctx, "bulkfhir.ProcessServerErrors", attribute.Int("bulkfhir.urls", len(urls)))
+	defer func() { tracing.End(span, err) }()
+
+	for _, url := range urls {
+		if err := f.processServerErrorURL(ctx, url); err != nil {
+			return fmt.Errorf("failed to process error file %s: %w", url, err)
+		}
+	}
+
+	log.Warningf("The Bulk FHIR export job reported %d errors in %d error files: %s", f.ServerErrors.Errors(), len(urls), &f.ServerErrors)
+	if f.FailOnServerErrors && f.ServerErrors.Errors() > f.MaxServerErrors {
+		return fmt.Errorf("the export job reported %d errors, more than the maximum of %d: %w", f.ServerErrors.Errors(), f.MaxServerErrors, ErrTooManyServerErrors)
+	}
+	return nil
+}
+
+// finalizeRoutedSinks finalizes ServerErrorSink and ProvenanceSink, if set.
+func (f *Fetcher) finalizeRoutedSinks(ctx context.Context) error {
+	var errs []error
+	if f.ServerErrorSink != nil {
+		if err := f.ServerErrorSink.Finalize(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to finalize server error sink: %w", err))
+		}
+	}
+	if f.ProvenanceSink != nil {
+		if err := f.ProvenanceSink.Finalize(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to finalize provenance sink: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// downloadedWithData returns whether the output files of resourceType are
+// downloaded with the rest of the job's data, rather than being skipped or
+// handled with its error files.
+func (f *Fetcher) downloadedWithData(resourceType cpb.ResourceTypeCode_Value) bool {
+	var handling OutputHandling
+	switch resourceType {
+	case cpb.ResourceTypeCode_OPERATION_OUTCOME:
+		if f.OperationOutcomeHandling == OutputHandlingRoute {
+			return false
+		}
+		handling = f.OperationOutcomeHandling
+	case cpb.ResourceTypeCode_PROVENANCE:
+		handling = f.ProvenanceHandling
+	}
+	return handling != OutputHandlingSkip
+}
+
+func (f *Fetcher) processServerErrorURL(ctx context.Context, url string) error {
+	r, err := f.getData(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cr := &countingReader{r: r}
+	defer func() { f.addDownloadedBytes(url, cr.n) }()
+	var data io.Reader = cr
+	if f.Scanner != nil {
+		scanned, err := f.scan(ctx, url, cr)
+		if err != nil {
+			return err
+		}
+		defer scanned.Close()
+		data = scanned
+	}
+	s := bufio.NewScanner(data)
+	s.Buffer(make([]byte, initialBufferSize), maxTokenSize)
+	for s.Scan() {
+		if err := f.ServerErrors.Add(s.Bytes()); err != nil {
+			return err
+		}
+		if f.ServerErrorSink != nil {
+			if err := f.writeServerError(ctx, url, s.Bytes()); err != nil {
+				return err
+			}
 		}
-		r, err = f.Client.GetData(url)
-		numRetries++
+	}
+	return s.Err()
+}
+
+// process passes a single resource to the Pipeline, which is not safe to call
+// from multiple goroutines.
+func (f *Fetcher) process(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, url string, json []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.lockShared()()
+	return f.Pipeline.Process(ctx, resourceType, url, json)
+}
+
+// processDeleted passes a Bundle of deleted resources to the Pipeline, which is
+// not safe to call from multiple goroutines.
+func (f *Fetcher) processDeleted(ctx context.Context, url string, json []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.lockShared()()
+	_, err := f.Pipeline.ProcessDeleted(ctx, url, json)
+	return err
+}
+
+// writeServerError writes an OperationOutcome to ServerErrorSink, which may be
+// shared with the other Fetchers of a GroupsFetcher.
+func (f *Fetcher) writeServerError(ctx context.Context, url string, json []byte) error {
+	defer f.lockShared()()
+	return f.ServerErrorSink.WriteServerError(ctx, url, json)
+}
+
+// writeProvenance writes a Provenance resource to ProvenanceSink, which may be
+// shared with the other Fetchers of a GroupsFetcher.
+func (f *Fetcher) writeProvenance(ctx context.Context, url string, json []byte) error {
+	defer f.lockShared()()
+	return f.ProvenanceSink.WriteProvenance(ctx, url, json)
+}
+
+// withExportJob returns a context for processing the data of the export job
+// with the given status (see processing.WithExportJob).
+func (f *Fetcher) withExportJob(ctx context.Context, jobStatus bulkfhir.JobStatus) context.Context {
+	return processing.WithExportJob(ctx, processing.ExportJob{
+		URL:             f.JobURL,
+		TransactionTime: jobStatus.TransactionTime,
+		ServerURL:       f.Client.BaseURL(),
+	})
+}
+
+// withLine returns a context for processing the line read at the given offset
+// of a data URL (see processing.WithSourceRange).
+func withLine(ctx context.Context, offset int64, line []byte) context.Context {
+	return processing.WithSourceRange(ctx, processing.SourceRange{Offset: offset, Length: int64(len(line))})
+}
+
+// setTransactionTime sets TransactionTime to that of the export job. If
+// TransactionTime is shared with the other Fetchers of a GroupsFetcher, it is
+// kept from the first job, as sinks may use it from their first write until
+// they are finalized.
+func (f *Fetcher) setTransactionTime(ts time.Time) {
+	if f.shared == nil {
+		f.TransactionTime.Set(ts)
+		return
+	}
+	defer f.lockShared()()
+	if _, err := f.TransactionTime.Get(); err != nil {
+		f.TransactionTime.Set(ts)
+	}
+}
+
+// lockShared locks the Pipeline shared with the other Fetchers of a
+// GroupsFetcher, if any, and returns the function which unlocks it.
+func (f *Fetcher) lockShared() func() {
+	if f.shared == nil {
+		return func() {}
+	}
+	f.shared.mu.Lock()
+	return f.shared.mu.Unlock
+}
+
+// getData fetches the data at url. Failed requests are retried by the Client,
+// as configured by its RetryPolicy. The download is abandoned once ctx is done.
+func (f *Fetcher) getData(ctx context.Context, url string) (io.ReadCloser, error) {
+	stats := &bulkfhir.RequestStats{}
+	r, err := f.Client.GetDataWithStats(ctx, url, stats)
+	if merr := f.recordDownloadStats(ctx, url, stats); merr != nil && err == nil {
+		r.Close()
+		return nil, merr
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch data from %s: %w", url, err)
+		return nil, fmt.Errorf("failed to fetch data from %s after %s: %w", url, stats, err)
+	}
+	if stats.Retried() > 0 {
+		log.Infof("Downloading %s succeeded after %s.", url, stats)
 	}
 	return r, nil
 }
+
+// recordDownloadStats adds the requests made to download url to DownloadStats
+// and the download counter.
+func (f *Fetcher) recordDownloadStats(ctx context.Context, url string, stats *bulkfhir.RequestStats) error {
+	f.mu.Lock()
+	if f.DownloadStats == nil {
+		f.DownloadStats = map[string]*bulkfhir.RequestStats{}
+	}
+	f.DownloadStats[url] = stats
+	f.mu.Unlock()
+
+	for outcome, n := range stats.Retries {
+		if err := downloadCounter.Record(ctx, int64(n), string(outcome), "true"); err != nil {
+			return err
+		}
+	}
+	if stats.Attempts == 0 {
+		return nil
+	}
+	return downloadCounter.Record(ctx, 1, string(stats.Outcome), "false")
+}
+
+// pause waits until Pause returns, if it is set.
+func (f *Fetcher) pause(ctx context.Context) error {
+	if f.Pause == nil {
+		return nil
+	}
+	return f.Pause(ctx)
+}
+
+// interrupted returns whether Interrupt has been closed.
+func (f *Fetcher) interrupted() bool {
+	select {
+	case <-f.Interrupt:
+		return true
+	default:
+		return false
+	}
+}
+
+// untilInterrupted returns a context derived from ctx which is also cancelled
+// once Interrupt is closed.
+func (f *Fetcher) untilInterrupted(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if f.Interrupt != nil {
+		go func() {
+			select {
+			case <-f.Interrupt:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// maybeCancelJob cancels the export jobs after the fetch was interrupted, if
+// configured to. Failures are logged rather than returned, so that they do not
+// mask the interruption.
+func (f *Fetcher) maybeCancelJob() {
+	if !f.CancelJobOnInterrupt {
+		return
+	}
+	if f.CheckpointStore != nil {
+		log.Infof("Not cancelling export job %s, so that it can be resumed from the checkpoint.", f.JobURL)
+		return
+	}
+	for _, jobURL := range f.jobURLs {
+		if err := f.Client.CancelJob(jobURL); err != nil {
+			log.Errorf("failed to cancel export job %s: %v", jobURL, err)
+			continue
+		}
+		log.Infof("Cancelled export job %s.", jobURL)
+	}
+}
+
+func (f *Fetcher) authenticate(ctx context.Context) (err error) {
+	_, span := tracing.Start(ctx, "bulkfhir.Authenticate")
+	defer func() { tracing.End(span, err) }()
+	return f.Client.Authenticate()
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// sharedPipeline is shared by the Fetchers of a GroupsFetcher.
+type sharedPipeline struct {
+	// mu must be held when calling Pipeline.Process, ServerErrorSink,
+	// ProvenanceSink or TransactionTime.
+	mu sync.Mutex
+}
+
+// GroupsFetcher runs a bulk FHIR fetch for each of several Groups, passing the
+// data of all of them through the same Pipeline, or the data of each through
+// its own. Each resource is processed with a context carrying its Group's ID
+// (see processing.WithGroup), so that for example
+// processing.NewGroupTagProcessor can record where it came from.
+type GroupsFetcher struct {
+	// Fetchers holds a Fetcher for each Group, with ExportGroup set. They must
+	// share the same TransactionTime, and ServerErrorSink, ProvenanceSink and
+	// Pause if set. They may share the same Pipeline, or have a Pipeline each, for
+	// example to deliver the data of each Group only to its own outputs. Each
+	// loads the since time of its Group from its own TransactionTimeStore, to
+	// which the Group's transaction time is stored once its Pipeline has been
+	// finalized. JobURL, CheckpointStore and transaction times per resource
+	// type are not supported.
+	Fetchers []*Fetcher
+
+	// How many Groups to fetch concurrently. Defaults to 1.
+	MaxConcurrentGroups int
+}
+
+// Run the bulk FHIR fetch of every Group end-to-end. A Group which fails does
+// not stop the fetches of the others. Once all are done, each Pipeline is
+// finalized, and the transaction time of each Group which was fetched and
+// finalized successfully is stored. A Pipeline which fails to finalize fails
+// only the Groups passed through it. The errors of the Groups which failed are
+// returned together.
+func (gf *GroupsFetcher) Run(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "fetcher.GroupsFetcher.Run", attribute.Int("bulkfhir.groups", len(gf.Fetchers)))
+	defer func() { tracing.End(span, err) }()
+	if len(gf.Fetchers) == 0 {
+		return errors.New("no Groups to fetch")
+	}
+	shared := &sharedPipeline{}
+	for _, f := range gf.Fetchers {
+		if f.ExportGroup == "" {
+			return errors.New("every Fetcher of a GroupsFetcher must set ExportGroup")
+		}
+		if f.JobURL != "" || f.CheckpointStore != nil || f.CommitLog != nil {
+			return fmt.Errorf("group %s: JobURL, CheckpointStore and CommitLog are not supported when fetching multiple Groups", f.ExportGroup)
+		}
+		f.shared = shared
+	}
+	maxConcurrent := gf.MaxConcurrentGroups
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+
+	errs := make([]error, len(gf.Fetchers))
+	sem := make(chan struct{}, maxConcurrent)
+	var wg sync.WaitGroup
+	for i, f := range gf.Fetchers {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, f *Fetcher) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if f.interrupted() || ctx.Err() != nil {
+				errs[i] = fmt.Errorf("group %s: %w before the fetch started", f.ExportGroup, ErrInterrupted)
+				return
+			}
+			log.Infof("Starting bulk FHIR fetch for Group %s.", f.ExportGroup)
+			if err := f.Run(processing.WithGroup(ctx, f.ExportGroup)); err != nil {
+				errs[i] = fmt.Errorf("group %s: %w", f.ExportGroup, err)
+			}
+		}(i, f)
+	}
+	wg.Wait()
+
+	// As when fetching a single Group, a Pipeline is finalized after an
+	// interruption, so that the data processed so far is written out.
+	var pipelines []*processing.Pipeline
+	finalize := map[*processing.Pipeline]bool{}
+	for i, f := range gf.Fetchers {
+		if _, ok := finalize[f.Pipeline]; !ok {
+			pipelines = append(pipelines, f.Pipeline)
+			finalize[f.Pipeline] = false
+		}
+		if errs[i] == nil || errors.Is(errs[i], ErrInterrupted) {
+			finalize[f.Pipeline] = true
+		}
+	}
+	for _, p := range pipelines {
+		if !finalize[p] {
+			continue
+		}
+		ferr := gf.Fetchers[0].pause(ctx)
+		if ferr == nil {
+			ferr = p.Finalize(ctx)
+		}
+		for i, f := range gf.Fetchers {
+			if f.Pipeline != p || errs[i] != nil {
+				continue
+			}
+			if ferr != nil {
+				errs[i] = fmt.Errorf("group %s: failed to finalize output pipeline: %w", f.ExportGroup, ferr)
+				continue
+			}
+			if err := f.TransactionTimeStore.Store(ctx, f.since, f.jobTransactionTime); err != nil {
+				errs[i] = fmt.Errorf("group %s: failed to store transaction timestamp: %w", f.ExportGroup, err)
+			}
+		}
+	}
+	if err := gf.Fetchers[0].finalizeRoutedSinks(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	log.Infof("Bulk FHIR fetch jobs and processing complete for %d Groups.", len(gf.Fetchers))
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+)
+
+// ErrMalwareDetected is returned by a Scanner when a downloaded file must not
+// be processed.
+var ErrMalwareDetected = errors.New("malware detected")
+
+var scanCounter *metrics.Counter = metrics.NewCounter("download-scan-counter", "Count of downloaded data files scanned for malware before processing. The counter is tagged by the outcome of the scan ex) CLEAN, DETECTED or FAILED.", "1", aggregation.Count, "Outcome")
+
+// Scanner scans a downloaded file for malware, such as by calling a virus
+// scanner or a scanning API, before any of it is processed.
+type Scanner interface {
+	// Scan scans the file at path, which holds the data downloaded from url. It
+	// returns an error wrapping ErrMalwareDetected if the file must not be
+	// processed, or another error if it could not be scanned.
+	Scan(ctx context.Context, url, path string) error
+}
+
+// CommandScanner is a Scanner which runs a command, such as ClamAV's
+// clamdscan, with the path of the file as its last argument. Following the
+// convention of ClamAV's scanners, an exit status of 0 means the file is
+// clean, and 1 that malware was detected; any other status means the file
+// could not be scanned.
+type CommandScanner struct {
+	// Command is the program to run followed by its arguments, e.g.
+	// []string{"clamdscan", "--no-summary", "--fdpass"}.
+	Command []string
+}
+
+// Scan is Scanner.Scan.
+func (cs CommandScanner) Scan(ctx context.Context, url, path string) error {
+	if len(cs.Command) == 0 {
+		return errors.New("no scan command configured")
+	}
+	cmd := exec.CommandContext(ctx, cs.Command[0], append(slices.Clone(cs.Command[1:]), path)...)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return fmt.Errorf("%w in %s by %s: %s", ErrMalwareDetected, url, cs.Command[0], strings.TrimSpace(string(out)))
+	default:
+		return fmt.Errorf("%s failed: %w: %s", cs.Command[0], err, strings.TrimSpace(string(out)))
+	}
+}
+
+// scannedFile is a downloaded file which has passed the Scanner. It is removed
+// when closed.
+type scannedFile struct {
+	*os.File
+}
+
+func (sf *scannedFile) Close() error {
+	return errors.Join(sf.File.Close(), os.Remove(sf.Name()))
+}
+
+// scan downloads all of r, the data from url, to a temporary file in ScanDir
+// and scans it with Scanner, returning a reader of the file if it passes.
+func (f *Fetcher) scan(ctx context.Context, url string, r io.Reader) (io.ReadCloser, error) {
+	tmp, err := os.CreateTemp(f.ScanDir, "bulk_fhir_scan_*.ndjson")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a file to scan the data from %s: %w", url, err)
+	}
+	sf := &scannedFile{tmp}
+	if _, err := io.Copy(tmp, r); err != nil {
+		sf.Close()
+		return nil, fmt.Errorf("failed to download %s for scanning: %w", url, err)
+	}
+	if err := f.Scanner.Scan(ctx, url, tmp.Name()); err != nil {
+		sf.Close()
+		outcome := "FAILED"
+		if errors.Is(err, ErrMalwareDetected) {
+			outcome = "DETECTED"
+			log.Errorf("Refusing to process %s: %v", url, err)
+		}
+		return nil, errors.Join(fmt.Errorf("scan of %s failed: %w", url, err), scanCounter.Record(ctx, 1, outcome))
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		sf.Close()
+		return nil, err
+	}
+	if err := scanCounter.Record(ctx, 1, "CLEAN"); err != nil {
+		sf.Close()
+		return nil, err
+	}
+	return sf, nil
+}
@@ -0,0 +1,392 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/gcs"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// NDJSONManifestFile is the name of the manifest written to the root of the
+// output directory by an appending NDJSON sink.
+const NDJSONManifestFile = "manifest.json"
+
+// defaultMaxNDJSONFileBytes is the default size at which an appending NDJSON
+// sink rotates to a new file.
+const defaultMaxNDJSONFileBytes = 256 * 1024 * 1024
+
+// AppendingNDJSONSinkConfig defines the configuration passed to
+// NewAppendingNDJSONSink.
+type AppendingNDJSONSinkConfig struct {
+	// Directory is either a local directory, which must exist, or a GCS path of
+	// the form gs://bucket/folder_path.
+	Directory   string
+	GCSEndpoint string
+
+	// PartitionTime determines the date partition resources are written to.
+	// Typically this is the start time of the run.
+	PartitionTime time.Time
+
+	// MaxFileBytes is the size after which a new file is started rather than
+	// appending to the existing one. If zero, a default of 256MiB is used.
+	MaxFileBytes int64
+}
+
+// ndjsonManifest records the files written by an appending NDJSON sink. Only
+// data recorded in the manifest is considered committed.
+type ndjsonManifest struct {
+	Files []*ndjsonManifestEntry `json:"files"`
+}
+
+type ndjsonManifestEntry struct {
+	// Path is relative to the output directory.
+	Path         string `json:"path"`
+	ResourceType string `json:"resourceType"`
+	Date         string `json:"date"`
+	Index        int    `json:"index"`
+	Resources    int64  `json:"resources"`
+	Bytes        int64  `json:"bytes"`
+}
+
+// appendFileStore abstracts over the local file system and GCS.
+type appendFileStore interface {
+	// openAppend returns a writer which appends to the named file, after
+	// discarding anything beyond the first committedBytes bytes of it.
+	openAppend(ctx context.Context, name string, committedBytes int64) (io.WriteCloser, error)
+	// readFile returns the contents of the named file, or nil if it does not
+	// exist.
+	readFile(ctx context.Context, name string) ([]byte, error)
+	// replaceFile atomically replaces the contents of the named file.
+	replaceFile(ctx context.Context, name string, data []byte) error
+}
+
+type appendingNDJSONSink struct {
+	store        appendFileStore
+	directory    string
+	date         string
+	maxFileBytes int64
+
+	// mu must be held when accessing the fields below.
+	mu       sync.Mutex
+	manifest *ndjsonManifest
+	// open holds the entry and writer of the file currently being appended to
+	// for each resource type.
+	open map[cpb.ResourceTypeCode_Value]*appendFile
+}
+
+type appendFile struct {
+	entry *ndjsonManifestEntry
+	w     io.WriteCloser
+}
+
+// NewAppendingNDJSONSink creates a new Sink which appends resources to NDJSON
+// files partitioned by date and resource type, for use by successive
+// incremental runs writing to the same directory. Resources are written to
+// <date>/<ResourceType>_<index>.ndjson, where the date is that of
+// PartitionTime in UTC, and the index is incremented whenever a file reaches
+// MaxFileBytes.
+//
+// The files written are listed in a manifest.json at the root of the
+// directory, which is updated when the sink is finalized. Data appended to a
+// file beyond the size recorded in the manifest (e.g. by a run which failed
+// before finalizing) is discarded by the next run appending to that file.
+//
+// Files in GCS can not be appended to, so appending to a GCS file rewrites
+// it.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+func NewAppendingNDJSONSink(ctx context.Context, cfg *AppendingNDJSONSinkConfig) (Sink, error) {
+	store, err := newAppendFileStore(ctx, cfg.Directory, cfg.GCSEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := store.readFile(ctx, NDJSONManifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read NDJSON manifest: %w", err)
+	}
+	manifest := &ndjsonManifest{}
+	if data != nil {
+		if err := json.Unmarshal(data, manifest); err != nil {
+			return nil, fmt.Errorf("failed to parse NDJSON manifest: %w", err)
+		}
+	}
+
+	ans := &appendingNDJSONSink{
+		store:        store,
+		directory:    cfg.Directory,
+		date:         cfg.PartitionTime.UTC().Format("2006-01-02"),
+		maxFileBytes: defaultMaxNDJSONFileBytes,
+		manifest:     manifest,
+		open:         map[cpb.ResourceTypeCode_Value]*appendFile{},
+	}
+	if cfg.MaxFileBytes > 0 {
+		ans.maxFileBytes = cfg.MaxFileBytes
+	}
+	return ans, nil
+}
+
+// Write is Sink.Write.
+func (ans *appendingNDJSONSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	json, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	line := append(json, '\n')
+
+	ans.mu.Lock()
+	defer ans.mu.Unlock()
+	f, err := ans.fileFor(ctx, resource.Type(), int64(len(line)))
+	if err != nil {
+		return err
+	}
+	if _, err := f.w.Write(line); err != nil {
+		return fmt.Errorf("error writing FHIR resource to %s: %w", f.entry.Path, err)
+	}
+	f.entry.Resources++
+	f.entry.Bytes += int64(len(line))
+	return nil
+}
+
+// fileFor returns the file to append the next resource of the given type
+// to, rotating to a new file if appending lineBytes would exceed the maximum
+// file size.
+func (ans *appendingNDJSONSink) fileFor(ctx context.Context, rt cpb.ResourceTypeCode_Value, lineBytes int64) (*appendFile, error) {
+	if f, ok := ans.open[rt]; ok {
+		if f.entry.Bytes == 0 || f.entry.Bytes+lineBytes <= ans.maxFileBytes {
+			return f, nil
+		}
+		if err := f.w.Close(); err != nil {
+			return nil, fmt.Errorf("error closing %s: %w", f.entry.Path, err)
+		}
+		delete(ans.open, rt)
+		return ans.openFile(ctx, rt, &ndjsonManifestEntry{ResourceType: f.entry.ResourceType, Date: ans.date, Index: f.entry.Index + 1})
+	}
+
+	name, err := bulkfhir.ResourceTypeCodeToName(rt)
+	if err != nil {
+		return nil, err
+	}
+	// Append to the latest file for this resource type and date, if there is
+	// one with space remaining.
+	var latest *ndjsonManifestEntry
+	for _, e := range ans.manifest.Files {
+		if e.ResourceType == name && e.Date == ans.date && (latest == nil || e.Index > latest.Index) {
+			latest = e
+		}
+	}
+	switch {
+	case latest == nil:
+		return ans.openFile(ctx, rt, &ndjsonManifestEntry{ResourceType: name, Date: ans.date})
+	case latest.Bytes > 0 && latest.Bytes+lineBytes > ans.maxFileBytes:
+		return ans.openFile(ctx, rt, &ndjsonManifestEntry{ResourceType: name, Date: ans.date, Index: latest.Index + 1})
+	default:
+		return ans.openFile(ctx, rt, latest)
+	}
+}
+
+// openFile opens the file described by the manifest entry for appending,
+// adding the entry to the manifest if it is new.
+func (ans *appendingNDJSONSink) openFile(ctx context.Context, rt cpb.ResourceTypeCode_Value, entry *ndjsonManifestEntry) (*appendFile, error) {
+	isNew := entry.Path == ""
+	if isNew {
+		entry.Path = path.Join(entry.Date, fmt.Sprintf("%s_%d.ndjson", entry.ResourceType, entry.Index))
+	}
+	w, err := ans.store.openAppend(ctx, entry.Path, entry.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s for appending: %w", entry.Path, err)
+	}
+	if isNew {
+		ans.manifest.Files = append(ans.manifest.Files, entry)
+	}
+	f := &appendFile{entry: entry, w: w}
+	ans.open[rt] = f
+	return f, nil
+}
+
+// Flush is Flusher.Flush. This closes all open files, and then updates the
+// manifest to commit the data written to them. Files are reopened as needed by
+// later writes, which for GCS means rewriting them.
+func (ans *appendingNDJSONSink) Flush(ctx context.Context) error {
+	ans.mu.Lock()
+	defer ans.mu.Unlock()
+	return ans.commit(ctx)
+}
+
+// Finalize is Sink.Finalize. This closes all open files, and then updates the
+// manifest to commit the data written to them.
+func (ans *appendingNDJSONSink) Finalize(ctx context.Context) error {
+	ans.mu.Lock()
+	defer ans.mu.Unlock()
+	return ans.commit(ctx)
+}
+
+// commit closes all open files and updates the manifest. mu must be held.
+func (ans *appendingNDJSONSink) commit(ctx context.Context) error {
+	var errs []error
+	for rt, f := range ans.open {
+		if err := f.w.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing %s: %w", f.entry.Path, err))
+		}
+		delete(ans.open, rt)
+	}
+	if len(errs) > 0 {
+		// Leave the manifest unchanged, so that the partially written data is
+		// discarded by the next run.
+		return errors.Join(errs...)
+	}
+
+	sort.Slice(ans.manifest.Files, func(i, j int) bool {
+		return ans.manifest.Files[i].Path < ans.manifest.Files[j].Path
+	})
+	data, err := json.MarshalIndent(ans.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ans.store.replaceFile(ctx, NDJSONManifestFile, data); err != nil {
+		return fmt.Errorf("failed to update NDJSON manifest: %w", err)
+	}
+	log.Infof("Updated NDJSON manifest, which now lists %d files.", len(ans.manifest.Files))
+	return nil
+}
+
+// CompletionToken is Completer.CompletionToken.
+func (ans *appendingNDJSONSink) CompletionToken() string {
+	ans.mu.Lock()
+	defer ans.mu.Unlock()
+	var resources int64
+	for _, e := range ans.manifest.Files {
+		resources += e.Resources
+	}
+	return fmt.Sprintf("appending ndjson %s: %s lists %d files of %d resources", ans.directory, NDJSONManifestFile, len(ans.manifest.Files), resources)
+}
+
+// newAppendFileStore returns the appendFileStore of a local directory, which
+// must exist, or a GCS path of the form gs://bucket/folder_path.
+func newAppendFileStore(ctx context.Context, directory, gcsEndpoint string) (appendFileStore, error) {
+	if bucket, relativePath, err := gcs.PathComponents(directory); err == nil {
+		gcsClient, err := gcs.NewClient(ctx, bucket, gcsEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		return &gcsAppendFileStore{client: gcsClient, directory: relativePath}, nil
+	}
+	if stat, err := os.Stat(directory); err != nil {
+		return nil, fmt.Errorf("could not stat directory %q - %w", directory, err)
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", directory)
+	}
+	return &localAppendFileStore{directory: directory}, nil
+}
+
+type localAppendFileStore struct {
+	directory string
+}
+
+func (s *localAppendFileStore) openAppend(ctx context.Context, name string, committedBytes int64) (io.WriteCloser, error) {
+	name = filepath.Join(s.directory, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(committedBytes); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(committedBytes, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *localAppendFileStore) readFile(ctx context.Context, name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.directory, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *localAppendFileStore) replaceFile(ctx context.Context, name string, data []byte) error {
+	name = filepath.Join(s.directory, name)
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+type gcsAppendFileStore struct {
+	client    gcs.Client
+	directory string
+}
+
+func (s *gcsAppendFileStore) openAppend(ctx context.Context, name string, committedBytes int64) (io.WriteCloser, error) {
+	name = gcs.JoinPath(s.directory, name)
+	w := s.client.GetFileWriter(ctx, name)
+	if committedBytes == 0 {
+		return w, nil
+	}
+	r, err := s.client.GetFileReader(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if _, err := io.CopyN(w, r, committedBytes); err != nil {
+		return nil, fmt.Errorf("failed to copy existing data: %w", err)
+	}
+	return w, nil
+}
+
+func (s *gcsAppendFileStore) readFile(ctx context.Context, name string) ([]byte, error) {
+	r, err := s.client.GetFileReader(ctx, gcs.JoinPath(s.directory, name))
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (s *gcsAppendFileStore) replaceFile(ctx context.Context, name string, data []byte) error {
+	w := s.client.GetFileWriter(ctx, gcs.JoinPath(s.directory, name))
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
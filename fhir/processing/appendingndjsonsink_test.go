@@ -0,0 +1,204 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+type manifestEntry struct {
+	Path      string `json:"path"`
+	Resources int64  `json:"resources"`
+	Bytes     int64  `json:"bytes"`
+}
+
+func readManifest(t *testing.T, data []byte) []manifestEntry {
+	t.Helper()
+	var m struct {
+		Files []manifestEntry `json:"files"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("failed to parse manifest: %v", err)
+	}
+	return m.Files
+}
+
+func runAppendingNDJSONSink(t *testing.T, cfg *processing.AppendingNDJSONSinkConfig, resources []testResourceWrapper, finalize bool) {
+	t.Helper()
+	ctx := context.Background()
+	sink, err := processing.NewAppendingNDJSONSink(ctx, cfg)
+	if err != nil {
+		t.Fatalf("NewAppendingNDJSONSink() returned unexpected error: %v", err)
+	}
+	for _, r := range resources {
+		r := r
+		if err := sink.Write(ctx, &r); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if !finalize {
+		return
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+}
+
+func TestAppendingNDJSONSink(t *testing.T) {
+	dir := t.TempDir()
+	day1 := time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC)
+	day2 := day1.Add(2 * time.Hour)
+	// Allows two of the resources below per file.
+	cfg := &processing.AppendingNDJSONSinkConfig{Directory: dir, PartitionTime: day1, MaxFileBytes: 8}
+
+	runAppendingNDJSONSink(t, cfg, []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p1a")},
+		{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte("o1a")},
+	}, true)
+	runAppendingNDJSONSink(t, cfg, []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p2a")},
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p2b")},
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p2c")},
+	}, true)
+	// A run which fails before finalizing; its data is discarded by the next
+	// run.
+	runAppendingNDJSONSink(t, cfg, []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("bad")},
+	}, false)
+	runAppendingNDJSONSink(t, cfg, []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p3a")},
+	}, true)
+	cfg.PartitionTime = day2
+	runAppendingNDJSONSink(t, cfg, []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p4a")},
+	}, true)
+
+	wantFiles := map[string]string{
+		"2024-01-02/Observation_0.ndjson": "o1a\n",
+		"2024-01-02/Patient_0.ndjson":     "p1a\np2a\n",
+		"2024-01-02/Patient_1.ndjson":     "p2b\np2c\n",
+		"2024-01-02/Patient_2.ndjson":     "p3a\n",
+		"2024-01-03/Patient_0.ndjson":     "p4a\n",
+	}
+	for name, want := range wantFiles {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("failed to read %s: %v", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("unexpected content of %s. got: %q, want: %q", name, got, want)
+		}
+	}
+
+	manifest, err := os.ReadFile(filepath.Join(dir, processing.NDJSONManifestFile))
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	wantManifest := []manifestEntry{
+		{Path: "2024-01-02/Observation_0.ndjson", Resources: 1, Bytes: 4},
+		{Path: "2024-01-02/Patient_0.ndjson", Resources: 2, Bytes: 8},
+		{Path: "2024-01-02/Patient_1.ndjson", Resources: 2, Bytes: 8},
+		{Path: "2024-01-02/Patient_2.ndjson", Resources: 1, Bytes: 4},
+		{Path: "2024-01-03/Patient_0.ndjson", Resources: 1, Bytes: 4},
+	}
+	if diff := cmp.Diff(readManifest(t, manifest), wantManifest); diff != "" {
+		t.Errorf("unexpected manifest (-got +want): %s", diff)
+	}
+}
+
+func TestAppendingNDJSONSink_GCS(t *testing.T) {
+	gcsServer := testhelpers.NewGCSServer(t)
+	cfg := &processing.AppendingNDJSONSinkConfig{
+		Directory:     "gs://bucket/dir",
+		GCSEndpoint:   gcsServer.URL(),
+		PartitionTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	runAppendingNDJSONSink(t, cfg, []testResourceWrapper{{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p1")}}, true)
+	runAppendingNDJSONSink(t, cfg, []testResourceWrapper{{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("bad")}}, false)
+	runAppendingNDJSONSink(t, cfg, []testResourceWrapper{{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p2")}}, true)
+
+	obj, ok := gcsServer.GetObject("bucket", "dir/2024-01-02/Patient_0.ndjson")
+	if !ok {
+		t.Fatalf("GCS object dir/2024-01-02/Patient_0.ndjson not found")
+	}
+	if got, want := string(obj.Data), "p1\np2\n"; got != want {
+		t.Errorf("unexpected GCS object content. got: %q, want: %q", got, want)
+	}
+	manifest, ok := gcsServer.GetObject("bucket", "dir/"+processing.NDJSONManifestFile)
+	if !ok {
+		t.Fatalf("GCS manifest not found")
+	}
+	wantManifest := []manifestEntry{{Path: "2024-01-02/Patient_0.ndjson", Resources: 2, Bytes: 6}}
+	if diff := cmp.Diff(readManifest(t, manifest.Data), wantManifest); diff != "" {
+		t.Errorf("unexpected manifest (-got +want): %s", diff)
+	}
+}
+
+func TestAppendingNDJSONSink_Flush(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfg := &processing.AppendingNDJSONSinkConfig{Directory: dir, PartitionTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	sink, err := processing.NewAppendingNDJSONSink(ctx, cfg)
+	if err != nil {
+		t.Fatalf("NewAppendingNDJSONSink() returned unexpected error: %v", err)
+	}
+	flusher, ok := sink.(processing.Flusher)
+	if !ok {
+		t.Fatalf("appending NDJSON sink does not implement Flusher")
+	}
+	for _, data := range []string{"p1", "p2"} {
+		if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(data)}); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+		if err := flusher.Flush(ctx); err != nil {
+			t.Fatalf("Flush() returned unexpected error: %v", err)
+		}
+	}
+	// Not flushed, so discarded by the next run.
+	if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("bad")}); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+
+	manifest, err := os.ReadFile(filepath.Join(dir, processing.NDJSONManifestFile))
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	wantManifest := []manifestEntry{{Path: "2024-01-02/Patient_0.ndjson", Resources: 2, Bytes: 6}}
+	if diff := cmp.Diff(readManifest(t, manifest), wantManifest); diff != "" {
+		t.Errorf("unexpected manifest after Flush (-got +want): %s", diff)
+	}
+
+	runAppendingNDJSONSink(t, cfg, []testResourceWrapper{{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p3")}}, true)
+	got, err := os.ReadFile(filepath.Join(dir, "2024-01-02/Patient_0.ndjson"))
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if want := "p1\np2\np3\n"; string(got) != want {
+		t.Errorf("unexpected output. got: %q, want: %q", got, want)
+	}
+}
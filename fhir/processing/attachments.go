@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"mime"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+var fhirAttachmentExternalizationCounter *metrics.Counter = metrics.NewCounter("fhir-attachment-externalization-counter", "Count of inline attachments in FHIR Resources which were written to files and replaced by references to them. The counter is tagged by the FHIR Resource type ex) DOCUMENT_REFERENCE.", "1", aggregation.Count, "FHIRResourceType")
+
+// AttachmentExternalizationConfig contains the configuration needed for
+// creating an attachment externalization Processor.
+type AttachmentExternalizationConfig struct {
+	// MinSize is the size in bytes of the decoded content of the smallest
+	// attachment which is externalized; smaller attachments are left inline.
+	MinSize int
+	// The content is written to LocalDirectory if it is set, or else to
+	// GCSDirectory within GCSBucket.
+	LocalDirectory                       string
+	GCSEndpoint, GCSBucket, GCSDirectory string
+}
+
+type attachmentExternalizationProcessor struct {
+	BaseProcessor
+	minSize    int
+	fileWriter fileWriter
+
+	attachments, bytes atomic.Int64
+}
+
+// Assert attachmentExternalizationProcessor satisfies the Processor interface.
+var _ Processor = &attachmentExternalizationProcessor{}
+
+// NewAttachmentExternalizationProcessor creates a Processor which writes the
+// content of inline attachments of at least cfg.MinSize bytes, found anywhere
+// in a resource (such as DocumentReference.content.attachment), to files, and
+// replaces the inline data with the URL of the file. The files are named by
+// the SHA-256 of their content, so attachments repeated across resources or
+// fetches are only stored once. The size and hash of the attachment are set
+// if the resource did not already provide them.
+//
+// Binary resources are left as they are, as they have no element in which to
+// reference external content.
+func NewAttachmentExternalizationProcessor(ctx context.Context, cfg AttachmentExternalizationConfig) (Processor, error) {
+	if cfg.MinSize < 1 {
+		return nil, errors.New("the minimum size of externalized attachments must be at least 1 byte")
+	}
+	fw, err := newFileWriter(ctx, cfg.LocalDirectory, cfg.GCSEndpoint, cfg.GCSBucket, cfg.GCSDirectory)
+	if err != nil {
+		return nil, err
+	}
+	return &attachmentExternalizationProcessor{minSize: cfg.MinSize, fileWriter: fw}, nil
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (ap *attachmentExternalizationProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (ap *attachmentExternalizationProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	var attachments []*dpb.Attachment
+	walkMessages(cr, func(_ string, m protoreflect.Message) {
+		if a, ok := m.Interface().(*dpb.Attachment); ok && len(a.GetData().GetValue()) >= ap.minSize {
+			attachments = append(attachments, a)
+		}
+	})
+	for _, a := range attachments {
+		if err := ap.externalize(ctx, a); err != nil {
+			return err
+		}
+	}
+
+	if len(attachments) > 0 {
+		if err := fhirAttachmentExternalizationCounter.Record(ctx, int64(len(attachments)), resource.Type().String()); err != nil {
+			return err
+		}
+	}
+	return ap.Output(ctx, resource)
+}
+
+// externalize writes the data of the attachment to a file, and replaces it
+// with the URL of the file.
+func (ap *attachmentExternalizationProcessor) externalize(ctx context.Context, a *dpb.Attachment) error {
+	data := a.GetData().GetValue()
+	sum := sha256.Sum256(data)
+	// Best effort attempt to determine an appropriate file extension, as for
+	// downloaded documents.
+	var ext string
+	exts, err := mime.ExtensionsByType(a.GetContentType().GetValue())
+	if err == nil && len(exts) > 0 {
+		ext = exts[0]
+	}
+	fileURL, err := ap.fileWriter.writeFile(ctx, hex.EncodeToString(sum[:])+ext, data)
+	if err != nil {
+		return err
+	}
+
+	if a.GetSize() == nil && len(data) <= math.MaxUint32 {
+		a.Size = &dpb.UnsignedInt{Value: uint32(len(data))}
+	}
+	if a.GetHash() == nil {
+		hash := sha1.Sum(data)
+		a.Hash = &dpb.Base64Binary{Value: hash[:]}
+	}
+	a.Url = &dpb.Url{Value: fileURL}
+	a.Data = nil
+	ap.attachments.Add(1)
+	ap.bytes.Add(int64(len(data)))
+	return nil
+}
+
+func (ap *attachmentExternalizationProcessor) Finalize(ctx context.Context) error {
+	if n := ap.attachments.Load(); n > 0 {
+		log.Infof("Externalized %d attachments totalling %d bytes.", n, ap.bytes.Load())
+	}
+	return nil
+}
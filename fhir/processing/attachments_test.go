@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestAttachmentExternalizationProcessor(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	dir := t.TempDir()
+	ap, err := processing.NewAttachmentExternalizationProcessor(ctx, processing.AttachmentExternalizationConfig{MinSize: 5, LocalDirectory: dir})
+	if err != nil {
+		t.Fatalf("NewAttachmentExternalizationProcessor() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{ap}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+
+	// The first attachment is "hello world", and the second, which is below the
+	// minimum size, is "hi".
+	input := `{"resourceType":"DocumentReference","id":"1","status":"current","content":[{"attachment":{"contentType":"text/plain","data":"aGVsbG8gd29ybGQ="}},{"attachment":{"contentType":"text/plain","data":"aGk="}}]}`
+	wantJSON := `{"resourceType":"DocumentReference","id":"1","status":"current","content":[{"attachment":{"contentType":"text/plain","url":"FILEPATH","size":11,"hash":"Kq5sNclPz7QV2+lfQIuc6R7oRu0="}},{"attachment":{"contentType":"text/plain","data":"aGk="}}]}`
+	if err := p.Process(ctx, cpb.ResourceTypeCode_DOCUMENT_REFERENCE, "", []byte(input)); err != nil {
+		t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", input, err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+
+	gotResource, err := ts.WrittenResources[0].Proto()
+	if err != nil && err != processing.ErrorDoNotModifyProto {
+		t.Fatalf("writtenResource.Proto() returned unexpected error: %v", err)
+	}
+	url := gotResource.GetDocumentReference().GetContent()[0].GetAttachment().GetUrl().GetValue()
+	path := strings.TrimPrefix(url, "file://")
+	// The extension of the file depends on the host's MIME type configuration,
+	// so only the name is checked.
+	wantName := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	if filepath.Dir(path) != dir || !strings.HasPrefix(filepath.Base(path), wantName) {
+		t.Errorf("attachment url = %s, want a file named %s in %s", url, wantName, dir)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read attachment file %s: %v", url, err)
+	}
+	if string(content) != "hello world" {
+		t.Errorf("attachment file content = %q, want %q", content, "hello world")
+	}
+
+	// We're inserting a file path potentially containing backslashes (on
+	// Windows) into an encoded JSON string, so we need to escape any
+	// backslashes.
+	wantJSON = strings.Replace(wantJSON, "FILEPATH", strings.ReplaceAll(url, `\`, `\\`), 1)
+	gotJSON, err := ts.WrittenResources[0].JSON()
+	if err != nil {
+		t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+	}
+	normalizedWantJSON := testhelpers.NormalizeJSON(t, []byte(wantJSON))
+	normalizedGotJSON := testhelpers.NormalizeJSON(t, gotJSON)
+	if !cmp.Equal(normalizedGotJSON, normalizedWantJSON) {
+		t.Errorf("pipeline.Process(..., %s) produced unexpected output. got: %s, want: %s", input, normalizedGotJSON, normalizedWantJSON)
+	}
+
+	gotCount, _, err := metrics.GetResults()
+	if err != nil {
+		t.Errorf("GetResults failed; err = %s", err)
+	}
+	if diff := cmp.Diff(map[string]int64{"DOCUMENT_REFERENCE": 1}, gotCount["fhir-attachment-externalization-counter"].Count); diff != "" {
+		t.Errorf("GetResults() return unexpected count (-want +got): \n%s", diff)
+	}
+}
+
+func TestAttachmentExternalizationProcessor_InvalidMinSize(t *testing.T) {
+	if _, err := processing.NewAttachmentExternalizationProcessor(context.Background(), processing.AttachmentExternalizationConfig{LocalDirectory: t.TempDir()}); err == nil {
+		t.Errorf("NewAttachmentExternalizationProcessor() with no minimum size returned nil error, want an error")
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	bqapi "google.golang.org/api/bigquery/v2"
+	"github.com/google/bulk_fhir_tools/avro"
+	"github.com/google/bulk_fhir_tools/bigquery"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/gcs"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// Avro schemas written by the Avro sink. See NewAvroSink.
+const (
+	AvroSchemaFHIR    = "fhir"
+	AvroSchemaGeneric = "generic"
+)
+
+// DefaultAvroGenericDepth is the default AvroSinkConfig.GenericDepth.
+const DefaultAvroGenericDepth = 3
+
+// avroNamespace is the namespace of the records of the Avro schemas.
+const avroNamespace = "fhir.r4"
+
+// AvroSinkConfig defines the configuration passed to NewAvroSink.
+type AvroSinkConfig struct {
+	// Directory is either a local directory, which must exist, or a GCS path of
+	// the form gs://bucket/folder_path.
+	Directory   string
+	GCSEndpoint string
+
+	// Schema is AvroSchemaFHIR or AvroSchemaGeneric. If empty, AvroSchemaFHIR is
+	// used.
+	Schema string
+	// GenericDepth is the number of levels of elements expanded by the generic
+	// schema. If zero, DefaultAvroGenericDepth is used.
+	GenericDepth int
+	// Codec is the codec the files are compressed with, avro.CodecDeflate or
+	// avro.CodecNull. If empty, avro.CodecDeflate is used.
+	Codec string
+}
+
+// avroFile is the Avro file of a resource type.
+type avroFile struct {
+	name   string
+	file   io.WriteCloser
+	writer *avro.Writer
+	count  int64
+}
+
+// avroSink implements the processing.Sink interface to write resources to
+// Avro object container files, with a file per resource type.
+type avroSink struct {
+	store        appendFileStore
+	directory    string
+	schema       string
+	genericDepth int
+	codec        string
+
+	// mu must be held when accessing files.
+	mu    sync.Mutex
+	files map[cpb.ResourceTypeCode_Value]*avroFile
+}
+
+// Assert avroSink satisfies the Sink interface.
+var _ Sink = &avroSink{}
+
+// NewAvroSink creates a new Sink which writes resources to Avro object
+// container files in a directory, one named <ResourceType>.avro per resource
+// type, for ingestion by Kafka Connect, Spark and other tools which prefer Avro
+// to NDJSON. The schema of each file is also written to <ResourceType>.avsc,
+// for registering with a schema registry. Each run replaces the files of the
+// previous one.
+//
+// With AvroSchemaFHIR, the schema of each resource type is generated from the
+// FHIR R4 definitions, and matches the analytics schema of the BigQuery sink
+// (see bigquery.Schema): each element is a field, choice types are a record
+// with a field for each type, references have typed ID fields, recursive data
+// types are nested at most twice, and extensions and contained resources are
+// strings holding their JSON. Elements missing from the schema are dropped.
+//
+// With AvroSchemaGeneric, every resource type has the same shape of schema, a
+// record of the resourceType, the id, and a map of the other elements. Element
+// values are a union of null, boolean, double, string, and arrays and maps of
+// values, nested GenericDepth levels deep, below which arrays and objects are
+// strings holding their JSON. No element is dropped.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+func NewAvroSink(ctx context.Context, cfg *AvroSinkConfig) (Sink, error) {
+	if cfg.Directory == "" {
+		return nil, errors.New("an Avro output directory is required")
+	}
+	as := &avroSink{
+		directory:    cfg.Directory,
+		schema:       cfg.Schema,
+		genericDepth: cfg.GenericDepth,
+		codec:        cfg.Codec,
+		files:        map[cpb.ResourceTypeCode_Value]*avroFile{},
+	}
+	if as.schema == "" {
+		as.schema = AvroSchemaFHIR
+	}
+	if as.schema != AvroSchemaFHIR && as.schema != AvroSchemaGeneric {
+		return nil, fmt.Errorf("unknown Avro schema %q, want %s or %s", cfg.Schema, AvroSchemaFHIR, AvroSchemaGeneric)
+	}
+	if as.genericDepth == 0 {
+		as.genericDepth = DefaultAvroGenericDepth
+	}
+	if as.genericDepth < 0 {
+		return nil, fmt.Errorf("invalid Avro generic schema depth %d", cfg.GenericDepth)
+	}
+	if as.codec == "" {
+		as.codec = avro.CodecDeflate
+	}
+	if as.codec != avro.CodecDeflate && as.codec != avro.CodecNull {
+		return nil, fmt.Errorf("unknown Avro codec %q, want %s or %s", cfg.Codec, avro.CodecDeflate, avro.CodecNull)
+	}
+	var err error
+	if as.store, err = newAppendFileStore(ctx, cfg.Directory, cfg.GCSEndpoint); err != nil {
+		return nil, err
+	}
+	return as, nil
+}
+
+// Write is Sink.Write. The resource is appended to the file of its resource
+// type, which is created if needed.
+func (as *avroSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var record any
+	if as.schema == AvroSchemaFHIR {
+		record, err = avroFHIRRecord(resource.Type(), data)
+	} else {
+		record, err = avroGenericRecord(data, as.genericDepth)
+	}
+	if err != nil {
+		return err
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	f, err := as.file(ctx, resource.Type())
+	if err != nil {
+		return err
+	}
+	if err := f.writer.Append(record); err != nil {
+		return fmt.Errorf("error writing to %s: %w", f.name, err)
+	}
+	f.count++
+	recordOutput(resource, as.location(f.name))
+	return nil
+}
+
+// file returns the file of a resource type, creating it and writing its schema
+// if needed. as.mu must be held.
+func (as *avroSink) file(ctx context.Context, rt cpb.ResourceTypeCode_Value) (*avroFile, error) {
+	if f, ok := as.files[rt]; ok {
+		return f, nil
+	}
+	var schema *avro.Schema
+	var err error
+	if as.schema == AvroSchemaFHIR {
+		schema, err = avroFHIRSchema(rt)
+	} else {
+		schema, err = avroGenericSchema(rt, as.genericDepth)
+	}
+	if err != nil {
+		return nil, err
+	}
+	name := schema.Name
+	schemaJSON, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := as.store.replaceFile(ctx, name+".avsc", schemaJSON); err != nil {
+		return nil, fmt.Errorf("error writing %s.avsc: %w", name, err)
+	}
+
+	f := &avroFile{name: name + ".avro"}
+	if f.file, err = as.store.openAppend(ctx, f.name, 0); err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", f.name, err)
+	}
+	if f.writer, err = avro.NewWriter(f.file, schema, as.codec); err != nil {
+		f.file.Close()
+		return nil, fmt.Errorf("error creating %s: %w", f.name, err)
+	}
+	as.files[rt] = f
+	return f, nil
+}
+
+// location returns the path or URI of a file written by the sink.
+func (as *avroSink) location(name string) string {
+	if strings.HasPrefix(as.directory, "gs://") {
+		return "gs://" + gcs.JoinPath(strings.TrimPrefix(as.directory, "gs://"), name)
+	}
+	return path.Join(as.directory, name)
+}
+
+// Finalize is Sink.Finalize. This writes the last records of each file, and
+// closes them.
+func (as *avroSink) Finalize(ctx context.Context) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	var errs []error
+	for _, f := range as.files {
+		if err := f.writer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error writing to %s: %w", f.name, err))
+		}
+		if err := f.file.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing %s: %w", f.name, err))
+		}
+		log.Infof("Wrote %d resources to %s.", f.count, f.name)
+	}
+	return errors.Join(errs...)
+}
+
+// CompletionToken is Completer.CompletionToken.
+func (as *avroSink) CompletionToken() string {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	var count int64
+	for _, f := range as.files {
+		count += f.count
+	}
+	return fmt.Sprintf("avro: %d resources in %d files in %s", count, len(as.files), as.directory)
+}
+
+// avroFHIRSchema returns the Avro schema of a resource type, derived from its
+// BigQuery analytics schema.
+func avroFHIRSchema(rt cpb.ResourceTypeCode_Value) (*avro.Schema, error) {
+	name, err := bigquery.TableName(rt)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := bigquery.Schema(rt)
+	if err != nil {
+		return nil, err
+	}
+	return &avro.Schema{Type: avro.Record, Name: name, Namespace: avroNamespace, Fields: avroFields(name, ts.Fields)}, nil
+}
+
+// avroFields returns the fields of the record named name for the columns of a
+// BigQuery RECORD. The records nested in it are named after their path, such
+// as Observation_code_coding, so that each has a unique name.
+func avroFields(name string, columns []*bqapi.TableFieldSchema) []*avro.Field {
+	var fields []*avro.Field
+	for _, c := range columns {
+		var t *avro.Schema
+		switch c.Type {
+		case "BOOLEAN":
+			t = avro.Primitive(avro.Boolean)
+		case "INTEGER":
+			t = avro.Primitive(avro.Long)
+		case "FLOAT":
+			t = avro.Primitive(avro.Double)
+		case "RECORD":
+			recordName := name + "_" + c.Name
+			t = &avro.Schema{Type: avro.Record, Name: recordName, Namespace: avroNamespace, Fields: avroFields(recordName, c.Fields)}
+		default:
+			t = avro.Primitive(avro.String)
+		}
+		if c.Mode == "REPEATED" {
+			fields = append(fields, &avro.Field{Name: c.Name, Type: avro.ArrayOf(t), Default: json.RawMessage("[]")})
+		} else {
+			fields = append(fields, &avro.Field{Name: c.Name, Type: avro.Optional(t), Default: json.RawMessage("null")})
+		}
+	}
+	return fields
+}
+
+// avroFHIRRecord converts a resource to a record of its avroFHIRSchema.
+func avroFHIRRecord(rt cpb.ResourceTypeCode_Value, data []byte) (any, error) {
+	row, err := bigquery.RowFromJSON(rt, data)
+	if err != nil {
+		return nil, err
+	}
+	return avroValue(row), nil
+}
+
+// avroValue converts the values of a BigQuery row to the types of the values
+// of Avro records.
+func avroValue(v bqapi.JsonValue) any {
+	switch v := v.(type) {
+	case bigquery.Row:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = avroValue(e)
+		}
+		return m
+	case []bqapi.JsonValue:
+		l := make([]any, len(v))
+		for i, e := range v {
+			l[i] = avroValue(e)
+		}
+		return l
+	}
+	return v
+}
+
+// avroGenericSchema returns the generic Avro schema of a resource type.
+func avroGenericSchema(rt cpb.ResourceTypeCode_Value, depth int) (*avro.Schema, error) {
+	name, err := bulkfhir.ResourceTypeCodeToName(rt)
+	if err != nil {
+		return nil, err
+	}
+	return &avro.Schema{
+		Type:      avro.Record,
+		Name:      name,
+		Namespace: avroNamespace,
+		Fields: []*avro.Field{
+			{Name: "resourceType", Type: avro.Primitive(avro.String)},
+			{Name: "id", Type: avro.Optional(avro.Primitive(avro.String)), Default: json.RawMessage("null")},
+			{Name: "elements", Type: avro.MapOf(avroGenericValue(1, depth)), Default: json.RawMessage("{}")},
+		},
+	}, nil
+}
+
+// avroGenericValue returns the schema of values at the given level of the
+// generic schema. Values at the deepest level are primitives, or strings
+// holding the JSON of arrays and objects.
+func avroGenericValue(level, depth int) *avro.Schema {
+	branches := []*avro.Schema{avro.Primitive(avro.Null), avro.Primitive(avro.Boolean), avro.Primitive(avro.Double), avro.Primitive(avro.String)}
+	if level < depth {
+		branches = append(branches, avro.ArrayOf(avroGenericValue(level+1, depth)), avro.MapOf(avroGenericValue(level+1, depth)))
+	}
+	return avro.UnionOf(branches...)
+}
+
+// avroGenericRecord converts a resource to a record of its avroGenericSchema.
+func avroGenericRecord(data []byte, depth int) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var resource map[string]any
+	if err := d.Decode(&resource); err != nil {
+		return nil, err
+	}
+	elements := map[string]any{}
+	record := map[string]any{"resourceType": resource["resourceType"], "id": resource["id"], "elements": elements}
+	for k, v := range resource {
+		if k == "resourceType" || k == "id" {
+			continue
+		}
+		var err error
+		if elements[k], err = avroGenericElement(v, 1, depth); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// avroGenericElement converts an element at the given level of the generic
+// schema to its value.
+func avroGenericElement(v any, level, depth int) (any, error) {
+	switch v := v.(type) {
+	case []any:
+		if level >= depth {
+			b, err := json.Marshal(v)
+			return string(b), err
+		}
+		l := make([]any, len(v))
+		for i, e := range v {
+			var err error
+			if l[i], err = avroGenericElement(e, level+1, depth); err != nil {
+				return nil, err
+			}
+		}
+		return l, nil
+	case map[string]any:
+		if level >= depth {
+			b, err := json.Marshal(v)
+			return string(b), err
+		}
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			var err error
+			if m[k], err = avroGenericElement(e, level+1, depth); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/avro"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+const avroObservation = `{
+	"resourceType": "Observation",
+	"id": "o1",
+	"status": "final",
+	"code": {"coding": [{"system": "http://loinc.org", "code": "8867-4"}]},
+	"subject": {"reference": "Patient/p1"},
+	"valueQuantity": {"value": 72.5, "unit": "/min"},
+	"extension": [{"url": "http://example.com/ext", "valueString": "x"}]
+}`
+
+// writeAvroSink writes a Patient and an Observation to a new Avro sink, and
+// returns the records of each file written.
+func writeAvroSink(t *testing.T, cfg *processing.AvroSinkConfig) map[string][]any {
+	t.Helper()
+	ctx := context.Background()
+	cfg.Directory = t.TempDir()
+	sink, err := processing.NewAvroSink(ctx, cfg)
+	if err != nil {
+		t.Fatalf("NewAvroSink() returned unexpected error: %v", err)
+	}
+	for _, r := range []*testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(`{"resourceType":"Patient","id":"p1","active":true,"name":[{"family":"Smith","given":["Ann"]}]}`)},
+		{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte(avroObservation)},
+	} {
+		if err := sink.Write(ctx, r); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	got := map[string][]any{}
+	for _, name := range []string{"Patient", "Observation"} {
+		data, err := os.ReadFile(filepath.Join(cfg.Directory, name+".avro"))
+		if err != nil {
+			t.Fatalf("failed to read %s.avro: %v", name, err)
+		}
+		_, got[name] = testhelpers.ReadAvroFile(t, data)
+		if _, err := os.Stat(filepath.Join(cfg.Directory, name+".avsc")); err != nil {
+			t.Errorf("schema %s.avsc was not written: %v", name, err)
+		}
+	}
+	return got
+}
+
+func TestAvroSink_FHIRSchema(t *testing.T) {
+	for _, codec := range []string{avro.CodecDeflate, avro.CodecNull} {
+		t.Run(codec, func(t *testing.T) {
+			got := writeAvroSink(t, &processing.AvroSinkConfig{Schema: processing.AvroSchemaFHIR, Codec: codec})
+
+			patient := got["Patient"][0].(map[string]any)
+			if patient["id"] != "p1" || patient["active"] != true {
+				t.Errorf("Patient record has id %v and active %v, want p1 and true", patient["id"], patient["active"])
+			}
+			name := patient["name"].([]any)[0].(map[string]any)
+			if diff := cmp.Diff([]any{"Ann"}, name["given"]); diff != "" {
+				t.Errorf("Patient record has unexpected name.given (-want +got): %s", diff)
+			}
+
+			obs := got["Observation"][0].(map[string]any)
+			value := obs["value"].(map[string]any)["quantity"].(map[string]any)
+			if value["value"] != 72.5 || value["unit"] != "/min" {
+				t.Errorf("Observation record has value.quantity %v, want 72.5 /min", value)
+			}
+			if got := obs["subject"].(map[string]any)["patientId"]; got != "p1" {
+				t.Errorf("Observation record has subject.patientId %v, want p1", got)
+			}
+			if diff := cmp.Diff([]any{`{"url":"http://example.com/ext","valueString":"x"}`}, obs["extension"]); diff != "" {
+				t.Errorf("Observation record has unexpected extension (-want +got): %s", diff)
+			}
+			if got := obs["note"]; !cmp.Equal(got, []any{}) {
+				t.Errorf("Observation record has note %v, want empty", got)
+			}
+		})
+	}
+}
+
+func TestAvroSink_GenericSchema(t *testing.T) {
+	got := writeAvroSink(t, &processing.AvroSinkConfig{Schema: processing.AvroSchemaGeneric, GenericDepth: 2})
+
+	want := map[string]any{
+		"resourceType": "Observation",
+		"id":           "o1",
+		"elements": map[string]any{
+			"status": "final",
+			// Objects and arrays below the second level are JSON strings.
+			"code":          map[string]any{"coding": `[{"code":"8867-4","system":"http://loinc.org"}]`},
+			"subject":       map[string]any{"reference": "Patient/p1"},
+			"valueQuantity": map[string]any{"value": 72.5, "unit": "/min"},
+			"extension":     []any{`{"url":"http://example.com/ext","valueString":"x"}`},
+		},
+	}
+	if diff := cmp.Diff(want, got["Observation"][0]); diff != "" {
+		t.Errorf("unexpected Observation record (-want +got): %s", diff)
+	}
+}
+
+func TestNewAvroSink_Invalid(t *testing.T) {
+	ctx := context.Background()
+	for _, cfg := range []*processing.AvroSinkConfig{
+		{Schema: processing.AvroSchemaFHIR},
+		{Directory: t.TempDir(), Schema: "parquet"},
+		{Directory: t.TempDir(), Schema: processing.AvroSchemaGeneric, GenericDepth: -1},
+		{Directory: t.TempDir(), Schema: processing.AvroSchemaFHIR, Codec: "snappy"},
+		{Directory: filepath.Join(t.TempDir(), "missing"), Schema: processing.AvroSchemaFHIR},
+	} {
+		if _, err := processing.NewAvroSink(ctx, cfg); err == nil {
+			t.Errorf("NewAvroSink(%+v) succeeded, want error", cfg)
+		}
+	}
+}
@@ -43,6 +43,11 @@ func NewBCDARectifyProcessor() Processor {
 	return &bcdaRectifyProcessor{}
 }
 
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (brp *bcdaRectifyProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
 func (brp *bcdaRectifyProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
 	switch resource.Type() {
 	case cpb.ResourceTypeCode_COVERAGE:
@@ -122,7 +127,7 @@ func (brp *bcdaRectifyProcessor) rectifyCoverage(ctx context.Context, resource R
 			// We only try to correct this placeholder reference for safety. We
 			// replace the Coverage reference with a Contract reference with the same
 			// value.
-			contract.Reference = &dpb.Reference_ContractId{&dpb.ReferenceId{Value: "part-a-contract1"}}
+			contract.Reference = &dpb.Reference_ContractId{ContractId: &dpb.ReferenceId{Value: "part-a-contract1"}}
 			if err := fhirRectifyCounter.Record(ctx, 1, cpb.ResourceTypeCode_COVERAGE.String(), "PLACEHOLDER_COVERAGE_REFERENCE"); err != nil {
 				return err
 			}
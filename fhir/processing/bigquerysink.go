@@ -0,0 +1,232 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/bulk_fhir_tools/bigquery"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ErrBigQueryInsertFailures is returned (wrapped) when inserts into BigQuery
+// have failed.
+var ErrBigQueryInsertFailures = errors.New("non-zero BigQuery insert errors")
+
+// defaultBigQueryBatchSize is the default number of rows inserted into
+// BigQuery in a single request.
+const defaultBigQueryBatchSize = 500
+
+// BigQuerySinkConfig defines the configuration passed to NewBigQuerySink.
+type BigQuerySinkConfig struct {
+	BigQueryConfig       *bigquery.Config
+	NoFailOnUploadErrors bool
+
+	// BatchSize is the maximum number of rows inserted in a single request. If
+	// zero, a default batch size is used.
+	BatchSize int
+	// MaxWorkers is the number of concurrent insert requests. If zero, a
+	// single worker is used.
+	MaxWorkers int
+}
+
+type bigQueryBatch struct {
+	resourceType cpb.ResourceTypeCode_Value
+	rows         []bigquery.Row
+}
+
+// bigQuerySink implements the processing.Sink interface to insert resources
+// into BigQuery, with a table per resource type.
+type bigQuerySink struct {
+	client    *bigquery.Client
+	batchSize int
+
+	// mu must be held when accessing tables or pending.
+	mu sync.Mutex
+	// tables records the resource types whose table is known to exist.
+	tables map[cpb.ResourceTypeCode_Value]bool
+	// pending holds the rows of each resource type not yet sent to a worker.
+	pending map[cpb.ResourceTypeCode_Value][]bigquery.Row
+
+	batches chan bigQueryBatch
+	wg      *sync.WaitGroup
+	// inFlight counts the batches sent to workers but not yet inserted.
+	inFlight sync.WaitGroup
+
+	insertErrorOccurred  atomic.Bool
+	insertErrors         atomic.Int64
+	noFailOnUploadErrors bool
+}
+
+// NewBigQuerySink creates a new Sink which inserts resources into tables in a
+// BigQuery dataset, one table per resource type, using the schema described
+// in bigquery.Schema. Tables are created as needed; the dataset must already
+// exist. Rows are inserted in batches by a pool of workers.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+func NewBigQuerySink(ctx context.Context, cfg *BigQuerySinkConfig) (Sink, error) {
+	if cfg == nil {
+		return nil, errors.New("a BigQuery sink config is required")
+	}
+	if cfg.BatchSize < 0 || cfg.MaxWorkers < 0 {
+		return nil, errors.New("BigQuery sink batch size and workers must not be negative")
+	}
+	client, err := bigquery.NewClient(ctx, cfg.BigQueryConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing BigQuery client: %w", err)
+	}
+	bqs := &bigQuerySink{
+		client:               client,
+		batchSize:            defaultBigQueryBatchSize,
+		tables:               map[cpb.ResourceTypeCode_Value]bool{},
+		pending:              map[cpb.ResourceTypeCode_Value][]bigquery.Row{},
+		batches:              make(chan bigQueryBatch, 10),
+		wg:                   &sync.WaitGroup{},
+		noFailOnUploadErrors: cfg.NoFailOnUploadErrors,
+	}
+	if cfg.BatchSize > 0 {
+		bqs.batchSize = cfg.BatchSize
+	}
+	maxWorkers := 1
+	if cfg.MaxWorkers > 0 {
+		maxWorkers = cfg.MaxWorkers
+	}
+	for i := 0; i < maxWorkers; i++ {
+		bqs.wg.Add(1)
+		go bqs.insertWorker(ctx)
+	}
+	return bqs, nil
+}
+
+// Write is Sink.Write. The resource is converted to a row and queued for
+// insertion into the table for its resource type, which is created if needed.
+func (bqs *bigQuerySink) Write(ctx context.Context, resource ResourceWrapper) error {
+	json, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	row, err := bigquery.RowFromJSON(resource.Type(), json)
+	if err != nil {
+		log.Errorf("unable to convert %s resource from %s to a BigQuery row: %v", resource.Type(), resource.SourceURL(), err)
+		bqs.insertErrorOccurred.Store(true)
+		bqs.insertErrors.Add(1)
+		return nil
+	}
+
+	rt := resource.Type()
+	bqs.mu.Lock()
+	if !bqs.tables[rt] {
+		if err := bqs.client.EnsureTable(ctx, rt); err != nil {
+			bqs.mu.Unlock()
+			return err
+		}
+		bqs.tables[rt] = true
+	}
+	bqs.pending[rt] = append(bqs.pending[rt], row)
+	var full []bigquery.Row
+	if len(bqs.pending[rt]) >= bqs.batchSize {
+		full = bqs.pending[rt]
+		delete(bqs.pending, rt)
+	}
+	bqs.mu.Unlock()
+
+	if full != nil {
+		bqs.send(bigQueryBatch{resourceType: rt, rows: full})
+	}
+	return nil
+}
+
+func (bqs *bigQuerySink) send(b bigQueryBatch) {
+	bqs.inFlight.Add(1)
+	bqs.batches <- b
+}
+
+// sendPending sends the rows of every resource type not yet sent to a worker.
+func (bqs *bigQuerySink) sendPending() {
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	for rt, rows := range bqs.pending {
+		bqs.send(bigQueryBatch{resourceType: rt, rows: rows})
+	}
+	bqs.pending = map[cpb.ResourceTypeCode_Value][]bigquery.Row{}
+}
+
+// Flush is Flusher.Flush. This inserts any pending rows and waits for all
+// inserts to complete. It returns an error if any resources could not be
+// inserted, unless NoFailOnUploadErrors was set when the sink was created.
+func (bqs *bigQuerySink) Flush(ctx context.Context) error {
+	bqs.sendPending()
+	bqs.inFlight.Wait()
+	if bqs.insertErrorOccurred.Load() && !bqs.noFailOnUploadErrors {
+		return fmt.Errorf("%w", ErrBigQueryInsertFailures)
+	}
+	return nil
+}
+
+// Finalize is Sink.Finalize. This inserts any remaining rows and waits for all
+// inserts to complete. It returns an error if any resources could not be
+// inserted, unless NoFailOnUploadErrors was set when the sink was created.
+func (bqs *bigQuerySink) Finalize(ctx context.Context) error {
+	bqs.sendPending()
+	close(bqs.batches)
+	bqs.wg.Wait()
+	if bqs.insertErrorOccurred.Load() {
+		if bqs.noFailOnUploadErrors {
+			log.Warningf("%v", ErrBigQueryInsertFailures)
+		} else {
+			return fmt.Errorf("%w", ErrBigQueryInsertFailures)
+		}
+	}
+	return nil
+}
+
+// UploadErrors is UploadErrorCounter.UploadErrors, counting the resources
+// which could not be converted to rows or inserted.
+func (bqs *bigQuerySink) UploadErrors() int64 {
+	return bqs.insertErrors.Load()
+}
+
+func (bqs *bigQuerySink) insertWorker(ctx context.Context) {
+	defer bqs.wg.Done()
+	for b := range bqs.batches {
+		if err := bqs.insertRows(ctx, b); err != nil {
+			log.Errorf("error inserting %d %s rows into BigQuery: %v", len(b.rows), b.resourceType, err)
+			bqs.insertErrorOccurred.Store(true)
+			failed := len(b.rows)
+			var insertErr *bigquery.InsertError
+			if errors.As(err, &insertErr) {
+				failed = len(insertErr.RowErrors)
+			}
+			bqs.insertErrors.Add(int64(failed))
+		}
+		bqs.inFlight.Done()
+	}
+}
+
+func (bqs *bigQuerySink) insertRows(ctx context.Context, b bigQueryBatch) (err error) {
+	ctx, span := tracing.Start(ctx, "bigquery.InsertRows",
+		attribute.String("fhir.resource_type", b.resourceType.String()),
+		attribute.Int("bigquery.rows", len(b.rows)))
+	defer func() { tracing.End(span, err) }()
+	return bqs.client.InsertRows(ctx, b.resourceType, b.rows)
+}
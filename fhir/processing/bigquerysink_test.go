@@ -0,0 +1,204 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/bigquery"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestBigQuerySink(t *testing.T) {
+	cases := []struct {
+		name       string
+		batchSize  int
+		maxWorkers int
+	}{
+		{name: "DefaultBatchSize"},
+		{name: "SmallBatchesWithMultipleWorkers", batchSize: 2, maxWorkers: 3},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			server := testhelpers.NewBigQueryServer(t, "project", "dataset")
+			sink, err := processing.NewBigQuerySink(ctx, &processing.BigQuerySinkConfig{
+				BigQueryConfig: &bigquery.Config{Endpoint: server.URL(), ProjectID: "project", DatasetID: "dataset"},
+				BatchSize:      tc.batchSize,
+				MaxWorkers:     tc.maxWorkers,
+			})
+			if err != nil {
+				t.Fatalf("NewBigQuerySink() returned unexpected error: %v", err)
+			}
+			p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+			if err != nil {
+				t.Fatalf("failed to create pipeline: %v", err)
+			}
+
+			var wantPatients []string
+			for i := 0; i < 5; i++ {
+				id := fmt.Sprintf("PatientID%d", i)
+				wantPatients = append(wantPatients, id)
+				if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(`{"resourceType":"Patient","id":"`+id+`"}`)); err != nil {
+					t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+				}
+			}
+			observation := `{"resourceType":"Observation","id":"ObservationID","status":"final","subject":{"reference":"Patient/PatientID0"},"valueString":"v"}`
+			if err := p.Process(ctx, cpb.ResourceTypeCode_OBSERVATION, "http://source", []byte(observation)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+			}
+
+			if diff := cmp.Diff(server.Tables(), []string{"Observation", "Patient"}); diff != "" {
+				t.Errorf("BigQuery sink created unexpected tables (-got +want): %s", diff)
+			}
+			var gotPatients []string
+			for _, r := range server.Rows("Patient") {
+				gotPatients = append(gotPatients, r["id"].(string))
+			}
+			sort.Strings(gotPatients)
+			if diff := cmp.Diff(gotPatients, wantPatients); diff != "" {
+				t.Errorf("BigQuery sink inserted unexpected Patients (-got +want): %s", diff)
+			}
+			wantObservations := []map[string]any{{
+				"id":      "ObservationID",
+				"status":  "final",
+				"subject": map[string]any{"reference": "Patient/PatientID0", "patientId": "PatientID0"},
+				"value":   map[string]any{"string": "v"},
+			}}
+			if diff := cmp.Diff(server.Rows("Observation"), wantObservations); diff != "" {
+				t.Errorf("BigQuery sink inserted unexpected Observations (-got +want): %s", diff)
+			}
+		})
+	}
+}
+
+func TestBigQuerySink_InsertErrors(t *testing.T) {
+	cases := []struct {
+		name                 string
+		noFailOnUploadErrors bool
+	}{
+		{name: "FailOnUploadErrors"},
+		{name: "NoFailOnUploadErrors", noFailOnUploadErrors: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			server := testhelpers.NewBigQueryServer(t, "project", "dataset")
+			server.RejectRow = func(table string, row map[string]any) string {
+				if row["id"] == "bad" {
+					return "invalid row"
+				}
+				return ""
+			}
+			sink, err := processing.NewBigQuerySink(ctx, &processing.BigQuerySinkConfig{
+				BigQueryConfig:       &bigquery.Config{Endpoint: server.URL(), ProjectID: "project", DatasetID: "dataset"},
+				NoFailOnUploadErrors: tc.noFailOnUploadErrors,
+			})
+			if err != nil {
+				t.Fatalf("NewBigQuerySink() returned unexpected error: %v", err)
+			}
+			p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+			if err != nil {
+				t.Fatalf("failed to create pipeline: %v", err)
+			}
+
+			for _, r := range []string{
+				`{"resourceType":"Patient","id":"good"}`,
+				`{"resourceType":"Patient","id":"bad"}`,
+				// Cannot be converted to a row, as name should be an array.
+				`{"resourceType":"Patient","id":"unconvertible","name":{"family":"f"}}`,
+			} {
+				if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(r)); err != nil {
+					t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+				}
+			}
+
+			err = p.Finalize(ctx)
+			if tc.noFailOnUploadErrors && err != nil {
+				t.Errorf("pipeline.Finalize() returned unexpected error: %v", err)
+			}
+			if !tc.noFailOnUploadErrors && !errors.Is(err, processing.ErrBigQueryInsertFailures) {
+				t.Errorf("pipeline.Finalize() returned error %v, want %v", err, processing.ErrBigQueryInsertFailures)
+			}
+			if diff := cmp.Diff(server.Rows("Patient"), []map[string]any{{"id": "good"}}); diff != "" {
+				t.Errorf("BigQuery sink inserted unexpected rows (-got +want): %s", diff)
+			}
+		})
+	}
+}
+
+func TestBigQuerySink_Flush(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	server := testhelpers.NewBigQueryServer(t, "project", "dataset")
+	sink, err := processing.NewBigQuerySink(ctx, &processing.BigQuerySinkConfig{
+		BigQueryConfig: &bigquery.Config{Endpoint: server.URL(), ProjectID: "project", DatasetID: "dataset"},
+	})
+	if err != nil {
+		t.Fatalf("NewBigQuerySink() returned unexpected error: %v", err)
+	}
+	p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+	if err != nil {
+		t.Fatalf("failed to create pipeline: %v", err)
+	}
+
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(`{"resourceType":"Patient","id":"1"}`)); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Flush(ctx); err != nil {
+		t.Fatalf("pipeline.Flush() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(server.Rows("Patient"), []map[string]any{{"id": "1"}}); diff != "" {
+		t.Errorf("BigQuery sink inserted unexpected rows before Finalize (-got +want): %s", diff)
+	}
+
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(`{"resourceType":"Patient","id":"2"}`)); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(server.Rows("Patient"), []map[string]any{{"id": "1"}, {"id": "2"}}); diff != "" {
+		t.Errorf("BigQuery sink inserted unexpected rows (-got +want): %s", diff)
+	}
+}
+
+func TestNewBigQuerySink_Invalid(t *testing.T) {
+	bqCfg := &bigquery.Config{Endpoint: "http://localhost", ProjectID: "project", DatasetID: "dataset"}
+	for _, cfg := range []*processing.BigQuerySinkConfig{
+		nil,
+		{},
+		{BigQueryConfig: bqCfg, MaxWorkers: -1},
+		{BigQueryConfig: bqCfg, BatchSize: -1},
+	} {
+		if _, err := processing.NewBigQuerySink(context.Background(), cfg); err == nil {
+			t.Errorf("NewBigQuerySink(%+v) returned nil error, want an error", cfg)
+		}
+	}
+}
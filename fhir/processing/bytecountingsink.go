@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ByteCountingSink wraps another Sink, counting the bytes of resource JSON
+// successfully written to it, and the resources of each type. The bytes are
+// the size of the resources as serialized by this tool, and do not include
+// any framing added by the wrapped sink (e.g. newlines, bundles or request
+// bodies).
+type ByteCountingSink struct {
+	Sink
+	bytes atomic.Int64
+
+	mu        sync.Mutex
+	resources map[cpb.ResourceTypeCode_Value]int64
+}
+
+// NewByteCountingSink returns a ByteCountingSink wrapping the given sink.
+func NewByteCountingSink(s Sink) *ByteCountingSink {
+	return &ByteCountingSink{Sink: s}
+}
+
+// Write is Sink.Write.
+func (bcs *ByteCountingSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	json, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	if err := bcs.Sink.Write(ctx, resource); err != nil {
+		return err
+	}
+	bcs.bytes.Add(int64(len(json)))
+	bcs.mu.Lock()
+	defer bcs.mu.Unlock()
+	if bcs.resources == nil {
+		bcs.resources = map[cpb.ResourceTypeCode_Value]int64{}
+	}
+	bcs.resources[resource.Type()]++
+	return nil
+}
+
+// Flush is Flusher.Flush, and flushes the wrapped sink. It returns an error
+// wrapping ErrFlushNotSupported if the wrapped sink does not implement Flusher.
+func (bcs *ByteCountingSink) Flush(ctx context.Context) error {
+	f, ok := bcs.Sink.(Flusher)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrFlushNotSupported, bcs.Sink)
+	}
+	return f.Flush(ctx)
+}
+
+// Bytes returns the number of bytes written to the sink so far.
+func (bcs *ByteCountingSink) Bytes() int64 {
+	return bcs.bytes.Load()
+}
+
+// Resources returns the number of resources of each type written to the sink
+// so far.
+func (bcs *ByteCountingSink) Resources() map[cpb.ResourceTypeCode_Value]int64 {
+	bcs.mu.Lock()
+	defer bcs.mu.Unlock()
+	resources := make(map[cpb.ResourceTypeCode_Value]int64, len(bcs.resources))
+	for rt, n := range bcs.resources {
+		resources[rt] = n
+	}
+	return resources
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestByteCountingSink(t *testing.T) {
+	ctx := context.Background()
+	ts := &processing.TestSink{}
+	bcs := processing.NewByteCountingSink(ts)
+	p, err := processing.NewPipeline(nil, []processing.Sink{bcs})
+	if err != nil {
+		t.Fatalf("failed to create pipeline: %v", err)
+	}
+
+	resources := []string{`{"resourceType":"Patient","id":"1"}`, `{"resourceType":"Patient","id":"22"}`}
+	var want int64
+	for _, r := range resources {
+		want += int64(len(r))
+		if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(r)); err != nil {
+			t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+
+	if got := bcs.Bytes(); got != want {
+		t.Errorf("ByteCountingSink.Bytes() = %d, want %d", got, want)
+	}
+	if got := bcs.Resources()[cpb.ResourceTypeCode_PATIENT]; got != int64(len(resources)) {
+		t.Errorf("ByteCountingSink.Resources() counted %d Patients, want %d", got, len(resources))
+	}
+	if len(ts.WrittenResources) != len(resources) {
+		t.Errorf("ByteCountingSink wrote %d resources to the wrapped sink, want %d", len(ts.WrittenResources), len(resources))
+	}
+	if !ts.FinalizeCalled {
+		t.Errorf("ByteCountingSink did not finalize the wrapped sink")
+	}
+}
+
+func TestPipelineFlush_NotSupported(t *testing.T) {
+	ctx := context.Background()
+	// TestSink does not implement Flusher, even when wrapped.
+	p, err := processing.NewPipeline(nil, []processing.Sink{processing.NewByteCountingSink(&processing.TestSink{})})
+	if err != nil {
+		t.Fatalf("failed to create pipeline: %v", err)
+	}
+	if err := p.CanFlush(); !errors.Is(err, processing.ErrFlushNotSupported) {
+		t.Errorf("pipeline.CanFlush() returned error %v, want %v", err, processing.ErrFlushNotSupported)
+	}
+	if err := p.Flush(ctx); !errors.Is(err, processing.ErrFlushNotSupported) {
+		t.Errorf("pipeline.Flush() returned error %v, want %v", err, processing.ErrFlushNotSupported)
+	}
+}
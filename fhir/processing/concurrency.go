@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"sync"
+)
+
+// ConcurrentProcessor is implemented by Processors whose Process may be called
+// from multiple goroutines at once, and which may call their output function
+// from each of them. When concurrency is enabled on a Pipeline, other
+// processors are serialized: only one resource at a time passes through them,
+// and through the processors after them.
+type ConcurrentProcessor interface {
+	// ProcessesConcurrently returns whether Process may be called concurrently.
+	ProcessesConcurrently() bool
+}
+
+func processesConcurrently(pr Processor) bool {
+	cp, ok := pr.(ConcurrentProcessor)
+	return ok && cp.ProcessesConcurrently()
+}
+
+// serialize returns an OutputFunction which calls f for one resource at a time.
+func serialize(f OutputFunction) OutputFunction {
+	var mu sync.Mutex
+	return func(ctx context.Context, resource ResourceWrapper) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return f(ctx, resource)
+	}
+}
+
+// SetConcurrency enables processing up to workers resources at once, so that
+// CPU-bound processors such as rectification, validation and de-identification
+// can use multiple cores. It must be called before any resources are processed.
+// A value of 1 or less disables concurrency, which is the default.
+//
+// With concurrency enabled:
+//
+//   - Process returns once the resource is queued, blocking while workers
+//     resources are already being processed. An error processing a resource is
+//     returned by a later call to Process, Delete, Flush or Finalize.
+//   - Processors which implement ConcurrentProcessor process resources
+//     concurrently. Other processors, and those after them, are passed one
+//     resource at a time.
+//   - Sinks are passed one resource at a time, but resources may reach them in
+//     a different order to the one they were passed to Process in.
+//   - Delete, Flush and Finalize first wait for all queued resources to be
+//     processed. If any of them failed, they return the error of the one which
+//     was queued first, so that the error reported does not depend on the
+//     timing of the workers, and Finalize does not finalize the processors or
+//     sinks.
+func (p *Pipeline) SetConcurrency(workers int) {
+	if workers <= 1 {
+		p.concurrency = nil
+		p.sinkMu = nil
+	} else {
+		p.concurrency = &concurrentProcessing{sem: make(chan struct{}, workers)}
+		p.sinkMu = make([]sync.Mutex, len(p.sinks))
+	}
+	p.chainProcessors()
+}
+
+// concurrentProcessing runs the processing of resources on a bounded number of
+// goroutines, keeping the error of the earliest queued resource which failed.
+type concurrentProcessing struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+	// next is the sequence number of the next resource to be queued. Like
+	// Pipeline.Process, submit is not called concurrently, so it is not guarded.
+	next int64
+
+	// mu guards the fields below.
+	mu     sync.Mutex
+	err    error
+	errSeq int64
+}
+
+// submit runs f on a new goroutine once fewer than the maximum number of
+// resources are being processed. It returns the earliest error of the
+// resources submitted so far, in which case f is not run.
+func (c *concurrentProcessing) submit(ctx context.Context, f func(ctx context.Context) error) error {
+	if err := c.firstErr(); err != nil {
+		return err
+	}
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	seq := c.next
+	c.next++
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer func() { <-c.sem }()
+		if err := f(ctx); err != nil {
+			c.fail(seq, err)
+		}
+	}()
+	return nil
+}
+
+func (c *concurrentProcessing) fail(seq int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil || seq < c.errSeq {
+		c.err, c.errSeq = err, seq
+	}
+}
+
+func (c *concurrentProcessing) firstErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// wait returns once all submitted resources have been processed, returning the
+// error of the earliest submitted resource which failed. It may be called on a
+// nil concurrentProcessing, when concurrency is disabled.
+func (c *concurrentProcessing) wait() error {
+	if c == nil {
+		return nil
+	}
+	c.wg.Wait()
+	return c.firstErr()
+}
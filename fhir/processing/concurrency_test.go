@@ -0,0 +1,283 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// inFlightProcessor records the most resources passed to it at once, holding
+// each for delay.
+type inFlightProcessor struct {
+	processing.BaseProcessor
+	concurrent bool
+	delay      time.Duration
+
+	inFlight, maxInFlight atomic.Int64
+}
+
+func (ip *inFlightProcessor) ProcessesConcurrently() bool {
+	return ip.concurrent
+}
+
+func (ip *inFlightProcessor) Process(ctx context.Context, resource processing.ResourceWrapper) error {
+	n := ip.inFlight.Add(1)
+	defer ip.inFlight.Add(-1)
+	for {
+		max := ip.maxInFlight.Load()
+		if n <= max || ip.maxInFlight.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	time.Sleep(ip.delay)
+	return ip.Output(ctx, resource)
+}
+
+func TestPipeline_Concurrency(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	concurrent := &inFlightProcessor{concurrent: true, delay: 5 * time.Millisecond}
+	serial := &inFlightProcessor{}
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{concurrent, serial}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	workers := 4
+	p.SetConcurrency(workers)
+
+	var want []string
+	json := make([]byte, 0, 64)
+	for i := 0; i < 40; i++ {
+		// Reuse the buffer, as the fetcher does, to check that it is copied.
+		json = fmt.Appendf(json[:0], `{"resourceType":"Patient","id":"%d"}`, i)
+		want = append(want, string(json))
+		if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", json); err != nil {
+			t.Fatalf("p.Process() returned unexpected error: %v", err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, r := range ts.WrittenResources {
+		json, err := r.JSON()
+		if err != nil {
+			t.Fatalf("JSON() returned unexpected error: %v", err)
+		}
+		got = append(got, string(json))
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("pipeline wrote unexpected resources (-want +got):\n%s", diff)
+	}
+	if !ts.FinalizeCalled {
+		t.Errorf("Finalize() was not called on the sink")
+	}
+	if got := concurrent.maxInFlight.Load(); got < 2 || got > int64(workers) {
+		t.Errorf("concurrent processor was passed up to %d resources at once, want between 2 and %d", got, workers)
+	}
+	if got := serial.maxInFlight.Load(); got != 1 {
+		t.Errorf("serialized processor was passed up to %d resources at once, want 1", got)
+	}
+}
+
+// failingProcessor fails the resources whose JSON contains one of fail, after
+// the delay given for it.
+type failingProcessor struct {
+	processing.BaseProcessor
+	fail map[string]time.Duration
+}
+
+func (fp *failingProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (fp *failingProcessor) Process(ctx context.Context, resource processing.ResourceWrapper) error {
+	json, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	for id, delay := range fp.fail {
+		if strings.Contains(string(json), fmt.Sprintf(`"id":"%s"`, id)) {
+			time.Sleep(delay)
+			return fmt.Errorf("resource %s failed", id)
+		}
+	}
+	return fp.Output(ctx, resource)
+}
+
+func TestPipeline_Concurrency_EarliestError(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	// The later resource fails first.
+	fp := &failingProcessor{fail: map[string]time.Duration{"1": 100 * time.Millisecond, "2": 0}}
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{fp}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetConcurrency(4)
+
+	for i := 0; i < 10; i++ {
+		json := []byte(fmt.Sprintf(`{"resourceType":"Patient","id":"%d"}`, i))
+		if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", json); err != nil {
+			break
+		}
+	}
+	wantErr := "resource 1 failed"
+	if err := p.Finalize(ctx); err == nil || err.Error() != wantErr {
+		t.Errorf("p.Finalize() returned error %v, want %q", err, wantErr)
+	}
+	if ts.FinalizeCalled {
+		t.Errorf("Finalize() was called on the sink after a resource failed")
+	}
+}
+
+func TestPipeline_Concurrency_Flush(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	ts := &flushTestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{&inFlightProcessor{concurrent: true, delay: 10 * time.Millisecond}}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetConcurrency(4)
+	for i := 0; i < 8; i++ {
+		json := []byte(fmt.Sprintf(`{"resourceType":"Patient","id":"%d"}`, i))
+		if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", json); err != nil {
+			t.Fatalf("p.Process() returned unexpected error: %v", err)
+		}
+	}
+	if err := p.Flush(ctx); err != nil {
+		t.Fatalf("p.Flush() returned unexpected error: %v", err)
+	}
+	if ts.flushedAt != 8 {
+		t.Errorf("Flush() was called on the sink after %d resources were written, want 8", ts.flushedAt)
+	}
+}
+
+// flushTestSink records how many resources had been written when it was last
+// flushed.
+type flushTestSink struct {
+	processing.TestSink
+	flushedAt int
+}
+
+func (fs *flushTestSink) Flush(ctx context.Context) error {
+	fs.flushedAt = len(fs.WrittenResources)
+	return nil
+}
+
+func TestPipeline_Concurrency_ProcessAfterError(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	fp := &failingProcessor{fail: map[string]time.Duration{"0": 0}}
+	p, err := processing.NewPipeline([]processing.Processor{fp}, []processing.Sink{&processing.TestSink{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetConcurrency(2)
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(`{"resourceType":"Patient","id":"0"}`)); err != nil {
+		t.Fatalf("p.Process() returned unexpected error: %v", err)
+	}
+	// Delete waits for the failed resource.
+	err = p.Delete(ctx, cpb.ResourceTypeCode_PATIENT, "1")
+	if err == nil {
+		t.Fatal("p.Delete() returned nil error, want the error of the failed resource")
+	}
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(`{"resourceType":"Patient","id":"1"}`)); err == nil {
+		t.Errorf("p.Process() after a resource failed returned nil error, want an error")
+	}
+	if err := p.Finalize(ctx); err == nil {
+		t.Errorf("p.Finalize() after a resource failed returned nil error, want an error")
+	}
+}
+
+// discardSink serializes each resource to JSON, as most sinks do, and discards
+// it.
+type discardSink struct{}
+
+func (discardSink) Write(ctx context.Context, resource processing.ResourceWrapper) error {
+	_, err := resource.JSON()
+	return err
+}
+
+func (discardSink) Finalize(ctx context.Context) error {
+	return nil
+}
+
+// benchmarkEOB is a valid ExplanationOfBenefit, which passes through the
+// processors of BenchmarkPipeline_Concurrency to the sink.
+const benchmarkEOB = `{"resourceType":"ExplanationOfBenefit","id":"e1","identifier":[{"system":"claims","value":"c1"}],"status":"active","type":{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/claim-type","code":"institutional"}]},"use":"claim","patient":{"reference":"Patient/p1"},"billablePeriod":{"start":"2024-03-01","end":"2024-03-05"},"created":"2024-03-10T12:00:00Z","insurer":{"reference":"Organization/o1"},"provider":{"reference":"Practitioner/pr1"},"outcome":"complete","insurance":[{"focal":true,"coverage":{"reference":"Coverage/c1"}}],"item":[{"sequence":1,"productOrService":{"coding":[{"system":"http://www.ama-assn.org/go/cpt","code":"99213"}]},"servicedDate":"2024-03-02"}]}`
+
+// BenchmarkPipeline_Concurrency measures the throughput of a pipeline of
+// CPU-bound processors with different numbers of workers. The speedup depends
+// on the number of cores available.
+func BenchmarkPipeline_Concurrency(b *testing.B) {
+	metrics.InitNoOp()
+	ctx := context.Background()
+	workerCounts := []int{1, 2, 4}
+	if n := runtime.NumCPU(); !slices.Contains(workerCounts, n) {
+		workerCounts = append(workerCounts, n)
+	}
+	for _, workers := range workerCounts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			deid, err := processing.NewDeidProcessor(processing.DeidConfig{
+				Salt:          []byte(strings.Repeat("s", processing.MinDeidSaltLength)),
+				DateShiftDays: 30,
+				RedactPaths:   processing.DefaultDeidRedactPaths,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			validation, err := processing.NewValidationProcessor(nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			processors := []processing.Processor{processing.NewBCDARectifyProcessor(), deid, validation}
+			p, err := processing.NewPipeline(processors, []processing.Sink{discardSink{}})
+			if err != nil {
+				b.Fatal(err)
+			}
+			p.SetConcurrency(workers)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := p.Process(ctx, cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, "http://source", []byte(benchmarkEOB)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := p.Finalize(ctx); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
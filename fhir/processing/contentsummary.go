@@ -0,0 +1,356 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// contentSummaryFileName is the name of the file content summaries are written
+// to within the content summary directory.
+const contentSummaryFileName = "content_summary.ndjson"
+
+// contentSummaryDatePaths are the paths to the dates whose range is reported
+// for each resource type, in addition to DefaultResourceDatePaths.
+var contentSummaryDatePaths = []string{
+	"Coverage.period",
+}
+
+// ContentSummary describes the business content of the resources delivered by
+// a run, so that data owners can sanity-check each delivery at a glance.
+type ContentSummary struct {
+	RunID string `json:"runID,omitempty"`
+	// Resources is the number of resources of each type.
+	Resources map[string]int `json:"resources"`
+	// Patients is the number of distinct patients, counting both Patient
+	// resources and the patients other resources refer to.
+	Patients int `json:"patients"`
+	// ExplanationOfBenefits is the number of ExplanationOfBenefit resources.
+	ExplanationOfBenefits int `json:"explanationOfBenefits"`
+	// Payments sums the payment amounts of the ExplanationOfBenefits by month
+	// and currency, ordered by month.
+	Payments []MonthlyPayments `json:"payments,omitempty"`
+	// DateRanges holds the earliest and latest clinically relevant date of each
+	// resource type, as found by DefaultResourceDatePaths, and of the coverage
+	// periods of Coverage resources.
+	DateRanges map[string]DateRange `json:"dateRanges,omitempty"`
+}
+
+// MonthlyPayments is the total of the ExplanationOfBenefit payments made in a
+// month, such as 2024-01, in one currency. Payments without a date have a
+// Month of "unknown".
+type MonthlyPayments struct {
+	Month    string  `json:"month"`
+	Currency string  `json:"currency,omitempty"`
+	Total    float64 `json:"total"`
+	Count    int     `json:"count"`
+}
+
+// DateRange is an inclusive range of dates, formatted as YYYY-MM-DD.
+type DateRange struct {
+	Earliest string `json:"earliest"`
+	Latest   string `json:"latest"`
+}
+
+// String returns a summary suitable for logging.
+func (s *ContentSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d distinct patients, %d ExplanationOfBenefits", s.Patients, s.ExplanationOfBenefits)
+	for _, p := range s.Payments {
+		fmt.Fprintf(&b, "; payments in %s: %.2f %s from %d", p.Month, p.Total, p.Currency, p.Count)
+	}
+	types := make([]string, 0, len(s.DateRanges))
+	for t := range s.DateRanges {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(&b, "; %s dates %s to %s", t, s.DateRanges[t].Earliest, s.DateRanges[t].Latest)
+	}
+	return b.String()
+}
+
+type paymentKey struct {
+	month, currency string
+}
+
+type timeRange struct {
+	earliest, latest time.Time
+}
+
+// ContentSummarySink is a Sink which summarizes the resources written to it,
+// and logs the ContentSummary when finalized. The summary is also written, as
+// a line of JSON, to a content_summary.ndjson file.
+//
+// The summary only covers the resources written during this run, so a run
+// resumed from a checkpoint summarizes only the data it downloads itself.
+type ContentSummarySink struct {
+	runID     string
+	file      *lazyNDJSONFile
+	datePaths map[cpb.ResourceTypeCode_Value][][]string
+
+	resources  map[cpb.ResourceTypeCode_Value]int
+	patients   map[string]bool
+	payments   map[paymentKey]*MonthlyPayments
+	dateRanges map[cpb.ResourceTypeCode_Value]*timeRange
+}
+
+// Assert ContentSummarySink satisfies the Sink and Flusher interfaces.
+var _ Sink = &ContentSummarySink{}
+var _ Flusher = &ContentSummarySink{}
+
+// NewNDJSONContentSummarySink returns a ContentSummarySink which summarizes
+// the run with the given ID, appending the summary to a content_summary.ndjson
+// file in the given directory.
+func NewNDJSONContentSummarySink(ctx context.Context, directory, runID string) (*ContentSummarySink, error) {
+	createFile, err := localCreateFileFunc(directory)
+	if err != nil {
+		return nil, err
+	}
+	return newContentSummarySink(runID, &lazyNDJSONFile{createFile: createFile, fileName: contentSummaryFileName})
+}
+
+// NewGCSNDJSONContentSummarySink returns a ContentSummarySink which writes the
+// summary to GCS. Unlike a local file, an existing file in GCS is overwritten
+// rather than appended to. See NewNDJSONContentSummarySink for additional
+// documentation.
+func NewGCSNDJSONContentSummarySink(ctx context.Context, endpoint, bucket, directory, runID string) (*ContentSummarySink, error) {
+	createFile, err := gcsCreateFileFunc(ctx, endpoint, bucket, directory)
+	if err != nil {
+		return nil, err
+	}
+	return newContentSummarySink(runID, &lazyNDJSONFile{createFile: createFile, fileName: contentSummaryFileName})
+}
+
+func newContentSummarySink(runID string, file *lazyNDJSONFile) (*ContentSummarySink, error) {
+	datePaths, err := parseResourcePaths("resource date", append(append([]string(nil), DefaultResourceDatePaths...), contentSummaryDatePaths...))
+	if err != nil {
+		return nil, err
+	}
+	return &ContentSummarySink{
+		runID:      runID,
+		file:       file,
+		datePaths:  datePaths,
+		resources:  map[cpb.ResourceTypeCode_Value]int{},
+		patients:   map[string]bool{},
+		payments:   map[paymentKey]*MonthlyPayments{},
+		dateRanges: map[cpb.ResourceTypeCode_Value]*timeRange{},
+	}, nil
+}
+
+// Write is Sink.Write.
+func (cs *ContentSummarySink) Write(ctx context.Context, resource ResourceWrapper) error {
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var parsed map[string]any
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	rt := resource.Type()
+	cs.resources[rt]++
+
+	if rt == cpb.ResourceTypeCode_PATIENT {
+		if id, ok := parsed["id"].(string); ok && id != "" {
+			cs.patients[id] = true
+		}
+	}
+	for _, field := range []string{"patient", "subject", "beneficiary"} {
+		if id, ok := patientReferenceID(parsed[field]); ok {
+			cs.patients[id] = true
+		}
+	}
+	if rt == cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT {
+		cs.addPayment(parsed)
+	}
+	if paths, ok := cs.datePaths[rt]; ok {
+		for _, path := range paths {
+			for _, v := range selectElements([]any{parsed}, path) {
+				cs.addDate(rt, v)
+			}
+		}
+	}
+	return nil
+}
+
+// patientReferenceID returns the ID of the Patient a Reference element refers
+// to, for both relative (Patient/123) and absolute references.
+func patientReferenceID(v any) (string, bool) {
+	ref, ok := v.(map[string]any)
+	if !ok {
+		return "", false
+	}
+	s, ok := ref["reference"].(string)
+	if !ok {
+		return "", false
+	}
+	i := strings.LastIndex(s, "Patient/")
+	if i < 0 || (i > 0 && s[i-1] != '/') {
+		return "", false
+	}
+	id, _, _ := strings.Cut(s[i+len("Patient/"):], "/")
+	return id, id != ""
+}
+
+// addPayment adds the payment amount of an ExplanationOfBenefit to the total
+// for the month of the payment date, falling back to the start of the billable
+// period and then the creation date.
+func (cs *ContentSummarySink) addPayment(eob map[string]any) {
+	payment, _ := eob["payment"].(map[string]any)
+	amount, _ := payment["amount"].(map[string]any)
+	value, ok := amount["value"].(float64)
+	if !ok {
+		return
+	}
+	currency, _ := amount["currency"].(string)
+	month := "unknown"
+	period, _ := eob["billablePeriod"].(map[string]any)
+	for _, d := range []any{payment["date"], period["start"], eob["created"]} {
+		if s, ok := d.(string); ok && len(s) >= len("2006-01") {
+			month = s[:len("2006-01")]
+			break
+		}
+	}
+	k := paymentKey{month, currency}
+	p, ok := cs.payments[k]
+	if !ok {
+		p = &MonthlyPayments{Month: month, Currency: currency}
+		cs.payments[k] = p
+	}
+	p.Total += value
+	p.Count++
+}
+
+// addDate widens the date range of the resource type to include a date,
+// dateTime, instant or Period element.
+func (cs *ContentSummarySink) addDate(rt cpb.ResourceTypeCode_Value, v any) {
+	var start, end string
+	switch e := v.(type) {
+	case string:
+		start, end = e, e
+	case map[string]any:
+		start, _ = e["start"].(string)
+		end, _ = e["end"].(string)
+		if start == "" {
+			start = end
+		}
+		if end == "" {
+			end = start
+		}
+	}
+	earliest, ok := parsePartialDateStart(start)
+	if !ok {
+		return
+	}
+	latest, ok := parsePartialDate(end)
+	if !ok {
+		return
+	}
+	r, ok := cs.dateRanges[rt]
+	if !ok {
+		cs.dateRanges[rt] = &timeRange{earliest, latest}
+		return
+	}
+	if earliest.Before(r.earliest) {
+		r.earliest = earliest
+	}
+	if latest.After(r.latest) {
+		r.latest = latest
+	}
+}
+
+// parsePartialDateStart parses a FHIR date, dateTime or instant, returning the
+// start of the year, month or day for values without a time.
+func parsePartialDateStart(s string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Flush is Flusher.Flush. The summary is only written when the sink is
+// finalized, so this is a no-op.
+func (cs *ContentSummarySink) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Finalize is Sink.Finalize. It logs the summary of the resources written, and
+// writes it to the content summary file.
+func (cs *ContentSummarySink) Finalize(ctx context.Context) error {
+	s := cs.Summary()
+	log.Infof("Content summary: %s", s)
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := cs.file.write(ctx, data); err != nil {
+		return err
+	}
+	return cs.file.Finalize(ctx)
+}
+
+// Summary returns the summary of the resources written so far.
+func (cs *ContentSummarySink) Summary() *ContentSummary {
+	s := &ContentSummary{
+		RunID:                 cs.runID,
+		Resources:             map[string]int{},
+		Patients:              len(cs.patients),
+		ExplanationOfBenefits: cs.resources[cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT],
+	}
+	for rt, n := range cs.resources {
+		s.Resources[resourceTypeName(rt)] = n
+	}
+	for _, p := range cs.payments {
+		s.Payments = append(s.Payments, *p)
+	}
+	sort.Slice(s.Payments, func(i, j int) bool {
+		if s.Payments[i].Month != s.Payments[j].Month {
+			return s.Payments[i].Month < s.Payments[j].Month
+		}
+		return s.Payments[i].Currency < s.Payments[j].Currency
+	})
+	if len(cs.dateRanges) > 0 {
+		s.DateRanges = map[string]DateRange{}
+		for rt, r := range cs.dateRanges {
+			s.DateRanges[resourceTypeName(rt)] = DateRange{
+				Earliest: r.earliest.UTC().Format("2006-01-02"),
+				Latest:   r.latest.UTC().Format("2006-01-02"),
+			}
+		}
+	}
+	return s
+}
+
+// resourceTypeName returns the FHIR name of the resource type, falling back to
+// the name of the enum value for types without one.
+func resourceTypeName(rt cpb.ResourceTypeCode_Value) string {
+	if name, err := bulkfhir.ResourceTypeCodeToName(rt); err == nil {
+		return name
+	}
+	return rt.String()
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestContentSummarySink(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cs, err := processing.NewNDJSONContentSummarySink(ctx, dir, "run1")
+	if err != nil {
+		t.Fatalf("NewNDJSONContentSummarySink() returned unexpected error: %v", err)
+	}
+	p, err := processing.NewPipeline(nil, []processing.Sink{cs})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+
+	inputs := []struct {
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+	}{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p1"}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p2"}`},
+		{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"e1","patient":{"reference":"Patient/p1"},"billablePeriod":{"start":"2024-01-05","end":"2024-01-20"},"payment":{"amount":{"value":100.25,"currency":"USD"}}}`},
+		{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"e2","patient":{"reference":"https://example.com/fhir/Patient/p3"},"billablePeriod":{"start":"2024-02-01"},"payment":{"date":"2024-01-31","amount":{"value":50,"currency":"USD"}}}`},
+		{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"e3","patient":{"reference":"Patient/p2"},"billablePeriod":{"start":"2024-03-01","end":"2024-03-02"},"payment":{"amount":{"value":10,"currency":"USD"}}}`},
+		{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"e4","patient":{"reference":"Patient/p2"}}`},
+		{cpb.ResourceTypeCode_COVERAGE, `{"resourceType":"Coverage","id":"c1","beneficiary":{"reference":"Patient/p4"},"period":{"start":"2020-01-01"}}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o1","subject":{"reference":"Group/g1"},"effectiveDateTime":"2023-06"}`},
+	}
+	for _, in := range inputs {
+		if err := p.Process(ctx, in.resourceType, "url", []byte(in.json)); err != nil {
+			t.Fatalf("Process(%s) returned unexpected error: %v", in.json, err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	want := &processing.ContentSummary{
+		RunID:                 "run1",
+		Resources:             map[string]int{"Patient": 2, "ExplanationOfBenefit": 4, "Coverage": 1, "Observation": 1},
+		Patients:              4,
+		ExplanationOfBenefits: 4,
+		Payments: []processing.MonthlyPayments{
+			{Month: "2024-01", Currency: "USD", Total: 150.25, Count: 2},
+			{Month: "2024-03", Currency: "USD", Total: 10, Count: 1},
+		},
+		DateRanges: map[string]processing.DateRange{
+			"ExplanationOfBenefit": {Earliest: "2024-01-05", Latest: "2024-03-02"},
+			"Coverage":             {Earliest: "2020-01-01", Latest: "2020-01-01"},
+			"Observation":          {Earliest: "2023-06-01", Latest: "2023-06-30"},
+		},
+	}
+	if diff := cmp.Diff(cs.Summary(), want); diff != "" {
+		t.Errorf("Summary() returned unexpected summary (-got +want): %s", diff)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "content_summary.ndjson"))
+	if err != nil {
+		t.Fatalf("failed to read content summary file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("content summary file has %d lines, want 1", len(lines))
+	}
+	var written processing.ContentSummary
+	if err := json.Unmarshal([]byte(lines[0]), &written); err != nil {
+		t.Fatalf("failed to parse content summary file: %v", err)
+	}
+	if diff := cmp.Diff(&written, want); diff != "" {
+		t.Errorf("content summary file has unexpected summary (-got +want): %s", diff)
+	}
+}
+
+func TestContentSummary_String(t *testing.T) {
+	s := &processing.ContentSummary{
+		Patients:              3,
+		ExplanationOfBenefits: 5,
+		Payments:              []processing.MonthlyPayments{{Month: "2024-01", Currency: "USD", Total: 12.5, Count: 2}},
+		DateRanges:            map[string]processing.DateRange{"Encounter": {Earliest: "2023-01-01", Latest: "2023-12-31"}},
+	}
+	want := "3 distinct patients, 5 ExplanationOfBenefits; payments in 2024-01: 12.50 USD from 2; Encounter dates 2023-01-01 to 2023-12-31"
+	if got := s.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
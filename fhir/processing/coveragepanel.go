@@ -0,0 +1,179 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+var fhirCoveragePanelDroppedCounter *metrics.Counter = metrics.NewCounter("fhir-coverage-panel-dropped-counter", "Count of FHIR Resources which were dropped because they were about patients without active Coverage during the coverage panel period. The counter is tagged by the FHIR Resource type ex) CLAIM.", "1", aggregation.Count, "FHIRResourceType")
+
+// CoveragePanel is the set of patients with active Coverage at some point
+// during a period, such as the term of a payer contract. It is a Sink which
+// adds the beneficiary of each active Coverage written to it whose period
+// overlaps the panel's period; other resources are ignored.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+type CoveragePanel struct {
+	start, end time.Time
+
+	mu       sync.Mutex
+	patients map[string]bool
+}
+
+// Assert CoveragePanel satisfies the Sink interface.
+var _ Sink = &CoveragePanel{}
+
+// NewCoveragePanel returns an empty CoveragePanel for the period from start to
+// end, inclusive.
+func NewCoveragePanel(start, end time.Time) *CoveragePanel {
+	return &CoveragePanel{start: start, end: end, patients: map[string]bool{}}
+}
+
+// Write adds the beneficiary of the resource to the panel if it is an active
+// Coverage whose period overlaps the panel's. A Coverage without a start or
+// end to its period is treated as open-ended.
+func (cp *CoveragePanel) Write(ctx context.Context, resource ResourceWrapper) error {
+	if resource.Type() != cpb.ResourceTypeCode_COVERAGE {
+		return nil
+	}
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var coverage struct {
+		Status string `json:"status"`
+		Period struct {
+			Start string `json:"start"`
+			End   string `json:"end"`
+		} `json:"period"`
+		Beneficiary struct {
+			Reference string `json:"reference"`
+		} `json:"beneficiary"`
+	}
+	if err := json.Unmarshal(data, &coverage); err != nil {
+		return err
+	}
+	if coverage.Status != "active" {
+		return nil
+	}
+	if start, ok := parsePartialDateStart(coverage.Period.Start); ok && start.After(cp.end) {
+		return nil
+	}
+	if end, ok := parsePartialDate(coverage.Period.End); ok && end.Before(cp.start) {
+		return nil
+	}
+	ref := &dpb.Reference{Reference: &dpb.Reference_Uri{Uri: &dpb.String{Value: coverage.Beneficiary.Reference}}}
+	resourceType, id, _, ok := referenceTarget(ref)
+	if !ok || resourceType != "Patient" {
+		log.Warningf("ignoring Coverage from %s for the coverage panel as its beneficiary %q is not a reference to a Patient", resource.SourceURL(), coverage.Beneficiary.Reference)
+		return nil
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.patients[id] = true
+	return nil
+}
+
+// Finalize is Sink.Finalize.
+func (cp *CoveragePanel) Finalize(ctx context.Context) error {
+	log.Infof("%d patients had active Coverage between %s and %s.", cp.Len(), cp.start.Format(time.DateOnly), cp.end.Format(time.DateOnly))
+	return nil
+}
+
+// Contains returns whether the Patient with the given ID is in the panel.
+func (cp *CoveragePanel) Contains(patientID string) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.patients[patientID]
+}
+
+// Len returns the number of patients in the panel.
+func (cp *CoveragePanel) Len() int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return len(cp.patients)
+}
+
+type coveragePanelProcessor struct {
+	BaseProcessor
+	panel   *CoveragePanel
+	dropped atomic.Int64
+}
+
+// Assert coveragePanelProcessor satisfies the Processor interface.
+var _ Processor = &coveragePanelProcessor{}
+
+// NewCoveragePanelProcessor creates a Processor which drops resources about
+// patients outside the panel, so that only the panel's data is delivered. A
+// Patient is kept if it is in the panel, and any other resource is kept if it
+// references a Patient in the panel, or references no Patient at all, such as
+// a Practitioner or Organization. The panel must be complete before any
+// resources are processed.
+func NewCoveragePanelProcessor(panel *CoveragePanel) Processor {
+	return &coveragePanelProcessor{panel: panel}
+}
+
+func (cpp *coveragePanelProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	inPanel, aboutPatient := false, false
+	if p := cr.GetPatient(); p != nil {
+		aboutPatient = true
+		inPanel = cpp.panel.Contains(p.GetId().GetValue())
+	} else {
+		walkMessages(cr, func(_ string, m protoreflect.Message) {
+			ref, ok := m.Interface().(*dpb.Reference)
+			if !ok || inPanel {
+				return
+			}
+			if rt, id, _, ok := referenceTarget(ref); ok && rt == "Patient" {
+				aboutPatient = true
+				inPanel = cpp.panel.Contains(id)
+			}
+		})
+	}
+	if inPanel || !aboutPatient {
+		return cpp.Output(ctx, resource)
+	}
+	cpp.dropped.Add(1)
+	return fhirCoveragePanelDroppedCounter.Record(ctx, 1, resource.Type().String())
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (cpp *coveragePanelProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (cpp *coveragePanelProcessor) Finalize(ctx context.Context) error {
+	if n := cpp.dropped.Load(); n > 0 {
+		log.Infof("Dropped %d resources about patients outside the coverage panel.", n)
+	}
+	return nil
+}
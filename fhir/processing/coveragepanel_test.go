@@ -0,0 +1,130 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestCoveragePanel(t *testing.T) {
+	ctx := context.Background()
+	panel := processing.NewCoveragePanel(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC))
+	p, err := processing.NewPipeline(nil, []processing.Sink{panel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources := []struct {
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+	}{
+		{cpb.ResourceTypeCode_COVERAGE, `{"resourceType":"Coverage","id":"c1","status":"active","beneficiary":{"reference":"Patient/in-period"},"payor":[{"reference":"Organization/o1"}],"period":{"start":"2022-06-01","end":"2023-01-01"}}`},
+		{cpb.ResourceTypeCode_COVERAGE, `{"resourceType":"Coverage","id":"c2","status":"active","beneficiary":{"reference":"Patient/open-ended"},"payor":[{"reference":"Organization/o1"}],"period":{"start":"2023-12"}}`},
+		{cpb.ResourceTypeCode_COVERAGE, `{"resourceType":"Coverage","id":"c3","status":"active","beneficiary":{"reference":"Patient/no-period"},"payor":[{"reference":"Organization/o1"}]}`},
+		{cpb.ResourceTypeCode_COVERAGE, `{"resourceType":"Coverage","id":"c4","status":"active","beneficiary":{"reference":"Patient/before"},"payor":[{"reference":"Organization/o1"}],"period":{"end":"2022-12-31"}}`},
+		{cpb.ResourceTypeCode_COVERAGE, `{"resourceType":"Coverage","id":"c5","status":"active","beneficiary":{"reference":"Patient/after"},"payor":[{"reference":"Organization/o1"}],"period":{"start":"2024-01-01T00:00:00Z"}}`},
+		{cpb.ResourceTypeCode_COVERAGE, `{"resourceType":"Coverage","id":"c6","status":"cancelled","beneficiary":{"reference":"Patient/cancelled"},"payor":[{"reference":"Organization/o1"}]}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"not-coverage"}`},
+	}
+	for _, r := range resources {
+		if err := p.Process(ctx, r.resourceType, "http://source", []byte(r.json)); err != nil {
+			t.Fatalf("p.Process() returned unexpected error: %v", err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]bool{"in-period": true, "open-ended": true, "no-period": true, "before": false, "after": false, "cancelled": false, "not-coverage": false} {
+		if got := panel.Contains(id); got != want {
+			t.Errorf("panel.Contains(%q) = %t, want %t", id, got, want)
+		}
+	}
+	if got, want := panel.Len(), 3; got != want {
+		t.Errorf("panel.Len() = %d, want %d", got, want)
+	}
+}
+
+func TestCoveragePanelProcessor(t *testing.T) {
+	ctx := context.Background()
+	panel := processing.NewCoveragePanel(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC))
+	panelPipeline, err := processing.NewPipeline(nil, []processing.Sink{panel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coverage := `{"resourceType":"Coverage","id":"c1","status":"active","beneficiary":{"reference":"Patient/p1"},"payor":[{"reference":"Organization/o1"}]}`
+	if err := panelPipeline.Process(ctx, cpb.ResourceTypeCode_COVERAGE, "http://source", []byte(coverage)); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics.ResetAll()
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{processing.NewCoveragePanelProcessor(panel)}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources := []struct {
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+	}{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p1"}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p2"}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"x"},"subject":{"reference":"Patient/p1"}}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o2","status":"final","code":{"text":"x"},"subject":{"reference":"Patient/p2"}}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o3","status":"final","code":{"text":"x"},"subject":{"reference":"https://example.com/fhir/Patient/p2"},"performer":[{"reference":"Patient/p1"}]}`},
+		{cpb.ResourceTypeCode_PRACTITIONER, `{"resourceType":"Practitioner","id":"pr1"}`},
+	}
+	for _, r := range resources {
+		if err := p.Process(ctx, r.resourceType, "http://source", []byte(r.json)); err != nil {
+			t.Fatalf("p.Process() returned unexpected error: %v", err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotIDs []string
+	for _, r := range ts.WrittenResources {
+		data, err := r.JSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resource struct{ ResourceType, ID string }
+		if err := json.Unmarshal(data, &resource); err != nil {
+			t.Fatal(err)
+		}
+		gotIDs = append(gotIDs, resource.ResourceType+"/"+resource.ID)
+	}
+	wantIDs := []string{"Patient/p1", "Observation/o1", "Observation/o3", "Practitioner/pr1"}
+	if diff := cmp.Diff(wantIDs, gotIDs); diff != "" {
+		t.Errorf("coverage panel processor kept unexpected resources (-want +got):\n%s", diff)
+	}
+
+	gotCount, _, err := metrics.GetResults()
+	if err != nil {
+		t.Errorf("GetResults failed; err = %s", err)
+	}
+	wantCount := map[string]int64{"PATIENT": 1, "OBSERVATION": 1}
+	if diff := cmp.Diff(wantCount, gotCount["fhir-coverage-panel-dropped-counter"].Count); diff != "" {
+		t.Errorf("GetResults() return unexpected count (-want +got): \n%s", diff)
+	}
+}
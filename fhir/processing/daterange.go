@@ -0,0 +1,170 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var fhirDateRangeDroppedCounter *metrics.Counter = metrics.NewCounter("fhir-date-range-dropped-counter", "Count of FHIR Resources which were dropped because their clinically relevant date was outside the clinical date range. The counter is tagged by the FHIR Resource type ex) EXPLANATION_OF_BENEFIT.", "1", aggregation.Count, "FHIRResourceType")
+
+// dateRange is a span of time. A zero start or end leaves the span open on that
+// side.
+type dateRange struct {
+	start, end time.Time
+}
+
+// overlaps returns whether the two spans have any time in common.
+func (r dateRange) overlaps(o dateRange) bool {
+	return (r.end.IsZero() || o.start.IsZero() || !r.end.Before(o.start)) &&
+		(r.start.IsZero() || o.end.IsZero() || !o.end.Before(r.start))
+}
+
+// union returns the smallest span covering both spans.
+func (r dateRange) union(o dateRange) dateRange {
+	u := r
+	if r.start.IsZero() || o.start.IsZero() {
+		u.start = time.Time{}
+	} else if o.start.Before(r.start) {
+		u.start = o.start
+	}
+	if r.end.IsZero() || o.end.IsZero() {
+		u.end = time.Time{}
+	} else if o.end.After(r.end) {
+		u.end = o.end
+	}
+	return u
+}
+
+type dateRangeProcessor struct {
+	BaseProcessor
+	window dateRange
+	// paths holds the element path of each resource type's date, split into
+	// its element names, without the leading resource type.
+	paths   map[cpb.ResourceTypeCode_Value][][]string
+	dropped atomic.Int64
+}
+
+// Assert dateRangeProcessor satisfies the Processor interface.
+var _ Processor = &dateRangeProcessor{}
+
+// NewDateRangeProcessor creates a Processor which drops resources whose
+// clinically relevant date, such as the billable period of an
+// ExplanationOfBenefit, is outside the window from start to end, inclusive.
+// Either of start or end may be zero to leave the window open on that side.
+// Unlike _since, which filters by when the server last updated a resource, this
+// filters by when the care was given.
+//
+// The paths are as for NewMaxAgeProcessor, and the paths given for a resource
+// type replace its DefaultResourceDatePaths. A resource is kept if the span
+// covering the dates found by all of its paths overlaps the window. Partial
+// dates span their whole year, month or day, and a Period without a start or
+// end is open on that side. Resources of types without a path, or without a
+// value at any of their paths, are kept.
+func NewDateRangeProcessor(start, end time.Time, paths []string) (Processor, error) {
+	if start.IsZero() && end.IsZero() {
+		return nil, errors.New("at least one of the start or end of the date range is required")
+	}
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		return nil, errors.New("the end of the date range must not be before its start")
+	}
+	parsed, err := resourceDatePaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	return &dateRangeProcessor{window: dateRange{start: start, end: end}, paths: parsed}, nil
+}
+
+func (dp *dateRangeProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	paths, ok := dp.paths[resource.Type()]
+	if !ok {
+		return dp.Output(ctx, resource)
+	}
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var parsed map[string]any
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	var span dateRange
+	found := false
+	for _, path := range paths {
+		for _, v := range selectElements([]any{parsed}, path) {
+			r, ok := elementDateRange(v)
+			if !ok {
+				continue
+			}
+			if found {
+				r = span.union(r)
+			}
+			span, found = r, true
+		}
+	}
+	if !found || span.overlaps(dp.window) {
+		return dp.Output(ctx, resource)
+	}
+	dp.dropped.Add(1)
+	return fhirDateRangeDroppedCounter.Record(ctx, 1, resource.Type().String())
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (dp *dateRangeProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (dp *dateRangeProcessor) Finalize(ctx context.Context) error {
+	if n := dp.dropped.Load(); n > 0 {
+		log.Infof("Dropped %d resources with clinical dates outside the date range.", n)
+	}
+	return nil
+}
+
+// elementDateRange returns the span of time described by a date, dateTime,
+// instant or Period element.
+func elementDateRange(v any) (dateRange, bool) {
+	switch e := v.(type) {
+	case string:
+		start, ok := parsePartialDateStart(e)
+		if !ok {
+			return dateRange{}, false
+		}
+		end, _ := parsePartialDate(e)
+		return dateRange{start: start, end: end}, true
+	case map[string]any:
+		var r dateRange
+		startString, hasStart := e["start"].(string)
+		endString, hasEnd := e["end"].(string)
+		if hasStart {
+			r.start, hasStart = parsePartialDateStart(startString)
+		}
+		if hasEnd {
+			r.end, hasEnd = parsePartialDate(endString)
+		}
+		return r, hasStart || hasEnd
+	}
+	return dateRange{}, false
+}
@@ -0,0 +1,170 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestDateRangeProcessor(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2022, 12, 31, 23, 59, 59, 0, time.UTC)
+	cases := []struct {
+		name         string
+		start, end   time.Time
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+		paths        []string
+		wantDropped  bool
+	}{
+		{
+			name:         "claim within range",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			json:         `{"resourceType":"ExplanationOfBenefit","id":"1","billablePeriod":{"start":"2022-03-01","end":"2022-03-05"}}`,
+		},
+		{
+			name:         "claim before range",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			json:         `{"resourceType":"ExplanationOfBenefit","id":"1","billablePeriod":{"start":"2021-03-01","end":"2021-03-05"}}`,
+			wantDropped:  true,
+		},
+		{
+			name:         "period overlapping start of range",
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			json:         `{"resourceType":"Encounter","id":"1","status":"finished","class":{"code":"IMP"},"period":{"start":"2021-12-30","end":"2022-01-02"}}`,
+		},
+		{
+			name:         "open-ended period",
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			json:         `{"resourceType":"Encounter","id":"1","status":"in-progress","class":{"code":"IMP"},"period":{"start":"2021-12-30"}}`,
+		},
+		{
+			name:         "choice element after range",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"},"effectiveDateTime":"2023-01-01T00:00:00Z"}`,
+			wantDropped:  true,
+		},
+		{
+			name:         "partial date spans its year",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"},"effectiveDateTime":"2022"}`,
+		},
+		{
+			name:         "open start of range",
+			end:          end,
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"},"effectiveDateTime":"1990-01-01"}`,
+		},
+		{
+			name:         "open end of range",
+			start:        start,
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"},"effectiveDateTime":"2021-12-31"}`,
+			wantDropped:  true,
+		},
+		{
+			name:         "resource without a date is kept",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"}}`,
+		},
+		{
+			name:         "resource type without a path is kept",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1","birthDate":"1950-01-01"}`,
+		},
+		{
+			name:         "configured path replaces default",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			json:         `{"resourceType":"ExplanationOfBenefit","id":"1","created":"2023-01-10","billablePeriod":{"end":"2022-12-01"}}`,
+			paths:        []string{"ExplanationOfBenefit.created"},
+			wantDropped:  true,
+		},
+		{
+			name:         "span of several dates overlaps range",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			json:         `{"resourceType":"ExplanationOfBenefit","id":"1","item":[{"sequence":1,"servicedDate":"2021-06-01"},{"sequence":2,"servicedPeriod":{"end":"2023-03-01"}}]}`,
+			paths:        []string{"ExplanationOfBenefit.item.serviced"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			if tc.start.IsZero() && tc.end.IsZero() {
+				tc.start, tc.end = start, end
+			}
+			dp, err := processing.NewDateRangeProcessor(tc.start, tc.end, tc.paths)
+			if err != nil {
+				t.Fatalf("NewDateRangeProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{dp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Process(ctx, tc.resourceType, "http://source", []byte(tc.json)); err != nil {
+				t.Fatalf("p.Process() returned unexpected error: %v", err)
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+			}
+			wantWritten := 1
+			if tc.wantDropped {
+				wantWritten = 0
+			}
+			if len(ts.WrittenResources) != wantWritten {
+				t.Errorf("got %d written resources, want %d", len(ts.WrittenResources), wantWritten)
+			}
+
+			gotCount, _, err := metrics.GetResults()
+			if err != nil {
+				t.Errorf("GetResults failed; err = %s", err)
+			}
+			wantCount := map[string]int64{}
+			if tc.wantDropped {
+				wantCount = map[string]int64{tc.resourceType.String(): 1}
+			}
+			if diff := cmp.Diff(wantCount, gotCount["fhir-date-range-dropped-counter"].Count); diff != "" {
+				t.Errorf("GetResults() return unexpected count (-want +got): \n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewDateRangeProcessor_Errors(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name       string
+		start, end time.Time
+		paths      []string
+	}{
+		{name: "no range"},
+		{name: "end before start", start: start, end: start.AddDate(0, 0, -1)},
+		{name: "invalid path", start: start, paths: []string{"NotAResource.date"}},
+	}
+	for _, tc := range cases {
+		if _, err := processing.NewDateRangeProcessor(tc.start, tc.end, tc.paths); err == nil {
+			t.Errorf("NewDateRangeProcessor() for %s returned nil error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// deadLetterFileName is the name of the file dead letters are written to within
+// the dead letter directory.
+const deadLetterFileName = "dead_letters.ndjson"
+
+// DeadLetter describes a resource which was removed from a Pipeline because it
+// could not be processed.
+type DeadLetter struct {
+	ResourceType cpb.ResourceTypeCode_Value
+	SourceURL    string
+	// JSON is the resource as it was originally passed to the Pipeline.
+	JSON []byte
+	// Err describes why the resource could not be processed. It wraps one of
+	// ErrResourceTimeout, ErrResourcePanic, ErrResourceParse, ErrInvalidEncoding,
+	// ErrResourceProcessing, ErrResourceWrite or ErrResourceInvalid.
+	Err error
+	// Reason classifies Err, e.g. TIMEOUT or WRITE_ERROR, as in the Reason tag
+	// of the fhir-dead-letter-counter metric.
+	Reason string
+	// Time is when the resource was routed to the dead letter sink.
+	Time time.Time
+}
+
+// DeadLetterSink receives resources which could not be processed by a Pipeline,
+// so that they can be inspected and replayed later.
+type DeadLetterSink interface {
+	// WriteDeadLetter writes the dead letter to storage.
+	WriteDeadLetter(ctx context.Context, dl *DeadLetter) error
+	// Finalize performs any final writing and cleanup. This is called after all
+	// dead letters have been passed to WriteDeadLetter().
+	Finalize(ctx context.Context) error
+}
+
+// deadLetterNDJSONLine is the format of each line written by
+// ndjsonDeadLetterSink.
+type deadLetterNDJSONLine struct {
+	ResourceType string `json:"resource_type"`
+	SourceURL    string `json:"source_url"`
+	Err          string `json:"err"`
+	Reason       string `json:"reason,omitempty"`
+	Time         string `json:"time,omitempty"`
+	FHIRResource string `json:"fhir_resource"`
+}
+
+type ndjsonDeadLetterSink struct {
+	createFile createFileFunc
+
+	mu sync.Mutex
+	// The file is only created once the first dead letter is written, so that
+	// successful runs do not leave an empty file behind.
+	w io.WriteCloser
+}
+
+// NewNDJSONDeadLetterSink returns a DeadLetterSink which writes dead letters to
+// a dead_letters.ndjson file in the given directory. Each line holds the
+// resource type, source URL, error and original JSON of the resource.
+//
+// It is threadsafe to call WriteDeadLetter on this sink from multiple
+// goroutines.
+func NewNDJSONDeadLetterSink(ctx context.Context, directory string) (DeadLetterSink, error) {
+	if stat, err := os.Stat(directory); err != nil {
+		return nil, fmt.Errorf("could not stat directory %q - %w", directory, err)
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", directory)
+	}
+	// This closure captures the `directory` parameter.
+	createFile := func(ctx context.Context, filename string) (io.WriteCloser, error) {
+		return os.OpenFile(filepath.Join(directory, filename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	}
+	return &ndjsonDeadLetterSink{createFile: createFile}, nil
+}
+
+// NewGCSNDJSONDeadLetterSink returns a DeadLetterSink which writes dead letters
+// to GCS. See NewNDJSONDeadLetterSink for additional documentation.
+func NewGCSNDJSONDeadLetterSink(ctx context.Context, endpoint, bucket, directory string) (DeadLetterSink, error) {
+	gcsClient, err := gcs.NewClient(ctx, bucket, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// This closure captures the GCS client and the `directory` parameter.
+	createFile := func(ctx context.Context, filename string) (io.WriteCloser, error) {
+		return gcsClient.GetFileWriter(ctx, gcs.JoinPath(directory, filename)), nil
+	}
+	return &ndjsonDeadLetterSink{createFile: createFile}, nil
+}
+
+func (ds *ndjsonDeadLetterSink) WriteDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	line := deadLetterNDJSONLine{
+		ResourceType: dl.ResourceType.String(),
+		SourceURL:    dl.SourceURL,
+		Err:          dl.Err.Error(),
+		Reason:       dl.Reason,
+		FHIRResource: string(dl.JSON),
+	}
+	if !dl.Time.IsZero() {
+		line.Time = dl.Time.UTC().Format(time.RFC3339Nano)
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.w == nil {
+		ds.w, err = ds.createFile(ctx, deadLetterFileName)
+		if err != nil {
+			return fmt.Errorf("error creating dead letter file: %w", err)
+		}
+	}
+	_, err = ds.w.Write(append(data, '\n'))
+	return err
+}
+
+func (ds *ndjsonDeadLetterSink) Finalize(ctx context.Context) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.w == nil {
+		return nil
+	}
+	return ds.w.Close()
+}
@@ -0,0 +1,176 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var fhirDedupDroppedCounter *metrics.Counter = metrics.NewCounter("fhir-dedup-dropped-counter", "Count of FHIR Resources which were dropped as duplicates of a resource already seen in the run. The counter is tagged by the FHIR Resource type ex) EXPLANATION_OF_BENEFIT.", "1", aggregation.Count, "FHIRResourceType")
+
+// DedupKey is how the dedup processor decides whether two resources are the
+// same, as sources differ in what they consider the same resource.
+type DedupKey string
+
+const (
+	// DedupKeyIDVersion treats resources with the same type, id and
+	// meta.versionId as the same. Resources without a versionId are compared by
+	// meta.lastUpdated instead, and by id alone if they have neither.
+	DedupKeyIDVersion DedupKey = "id_version"
+	// DedupKeyContentHash treats resources with the same content, other than
+	// their meta element, as the same. This suits servers whose versionId is
+	// unreliable.
+	DedupKeyContentHash DedupKey = "content_hash"
+	// DedupKeyIdentifier treats resources of the same type with the same values
+	// at configured paths, such as a business identifier, as the same.
+	DedupKeyIdentifier DedupKey = "identifier"
+)
+
+// DedupKeyFromString returns the DedupKey with the given name.
+func DedupKeyFromString(s string) (DedupKey, error) {
+	switch k := DedupKey(strings.ToLower(s)); k {
+	case DedupKeyIDVersion, DedupKeyContentHash, DedupKeyIdentifier:
+		return k, nil
+	default:
+		return "", fmt.Errorf("unknown dedup key %q, must be one of id_version, content_hash or identifier", s)
+	}
+}
+
+type dedupProcessor struct {
+	BaseProcessor
+	key DedupKey
+	// identifierPaths holds the element paths of each resource type's
+	// identifier for DedupKeyIdentifier, split into their element names,
+	// without the leading resource type.
+	identifierPaths map[cpb.ResourceTypeCode_Value][][]string
+	// seen holds a hash of the key of each resource passed on so far.
+	seen    map[[sha256.Size]byte]bool
+	dropped int
+}
+
+// Assert dedupProcessor satisfies the Processor interface.
+var _ Processor = &dedupProcessor{}
+
+// NewDedupProcessor creates a Processor which drops resources which are the
+// same, according to key, as one already passed on in this run. Keys are
+// remembered as SHA-256 hashes, so memory use does not depend on the size of
+// the resources or their keys.
+//
+// identifierPaths must be set for DedupKeyIdentifier, and only then. Each is a
+// simple FHIRPath expression such as ExplanationOfBenefit.identifier, naming
+// the elements which identify resources of a type. Resources of types without
+// a path, or without a value at any of their paths, are never dropped.
+func NewDedupProcessor(key DedupKey, identifierPaths []string) (Processor, error) {
+	if _, err := DedupKeyFromString(string(key)); err != nil {
+		return nil, err
+	}
+	if (key == DedupKeyIdentifier) != (len(identifierPaths) > 0) {
+		return nil, errors.New("identifier paths must be given for, and only for, the identifier dedup key")
+	}
+	paths, err := parseResourcePaths("dedup identifier", identifierPaths)
+	if err != nil {
+		return nil, err
+	}
+	return &dedupProcessor{key: key, identifierPaths: paths, seen: map[[sha256.Size]byte]bool{}}, nil
+}
+
+func (dp *dedupProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	k, ok, err := dp.resourceKey(resource.Type(), data)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return dp.Output(ctx, resource)
+	}
+	h := sha256.Sum256([]byte(resource.Type().String() + "\x00" + k))
+	if !dp.seen[h] {
+		dp.seen[h] = true
+		return dp.Output(ctx, resource)
+	}
+	dp.dropped++
+	return fhirDedupDroppedCounter.Record(ctx, 1, resource.Type().String())
+}
+
+// resourceKey returns the key of the resource, or false if it has none and so
+// is never a duplicate.
+func (dp *dedupProcessor) resourceKey(rt cpb.ResourceTypeCode_Value, data []byte) (string, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as written, so that the content hash is exact.
+	dec.UseNumber()
+	var parsed map[string]any
+	if err := dec.Decode(&parsed); err != nil {
+		return "", false, err
+	}
+	switch dp.key {
+	case DedupKeyIDVersion:
+		id, _ := parsed["id"].(string)
+		if id == "" {
+			return "", false, nil
+		}
+		meta, _ := parsed["meta"].(map[string]any)
+		if v, ok := meta["versionId"].(string); ok && v != "" {
+			return id + "\x00version\x00" + v, true, nil
+		}
+		if u, ok := meta["lastUpdated"].(string); ok && u != "" {
+			return id + "\x00lastUpdated\x00" + u, true, nil
+		}
+		return id, true, nil
+	case DedupKeyContentHash:
+		canonical, err := canonicalContent(parsed)
+		return string(canonical), true, err
+	default:
+		var values []any
+		for _, path := range dp.identifierPaths[rt] {
+			values = append(values, selectElements([]any{parsed}, path)...)
+		}
+		if len(values) == 0 {
+			return "", false, nil
+		}
+		canonical, err := json.Marshal(values)
+		return string(canonical), true, err
+	}
+}
+
+// canonicalContent returns the content of a resource decoded with UseNumber,
+// other than its meta element, in a form which does not depend on the order of
+// its elements.
+func canonicalContent(parsed map[string]any) ([]byte, error) {
+	delete(parsed, "meta")
+	// Marshalling sorts object keys.
+	return json.Marshal(parsed)
+}
+
+func (dp *dedupProcessor) Finalize(ctx context.Context) error {
+	if dp.dropped > 0 {
+		log.Infof("Dropped %d duplicate resources, compared by %s.", dp.dropped, dp.key)
+	}
+	return nil
+}
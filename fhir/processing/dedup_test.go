@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestDedupProcessor(t *testing.T) {
+	type input struct {
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+	}
+	eob := cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT
+	patient := cpb.ResourceTypeCode_PATIENT
+	cases := []struct {
+		name            string
+		key             processing.DedupKey
+		identifierPaths []string
+		inputs          []input
+		// wantWritten holds the meta.source of the resources written, which
+		// tells apart resources with the same id.
+		wantWritten []string
+	}{
+		{
+			name: "id and version",
+			key:  processing.DedupKeyIDVersion,
+			inputs: []input{
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"1","meta":{"versionId":"1","source":"a"}}`},
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"1","meta":{"versionId":"1","source":"b"}}`},
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"1","meta":{"versionId":"2","source":"c"}}`},
+				{patient, `{"resourceType":"Patient","id":"1","meta":{"versionId":"1","source":"d"}}`},
+			},
+			wantWritten: []string{"a", "c", "d"},
+		},
+		{
+			name: "id and lastUpdated without version",
+			key:  processing.DedupKeyIDVersion,
+			inputs: []input{
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"1","meta":{"lastUpdated":"2024-01-01T00:00:00Z","source":"a"}}`},
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"1","meta":{"lastUpdated":"2024-01-02T00:00:00Z","source":"b"}}`},
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"1","meta":{"lastUpdated":"2024-01-02T00:00:00Z","source":"c"}}`},
+			},
+			wantWritten: []string{"a", "b"},
+		},
+		{
+			name: "content hash ignores meta and element order",
+			key:  processing.DedupKeyContentHash,
+			inputs: []input{
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"1","status":"active","meta":{"versionId":"1","source":"a"}}`},
+				{eob, `{"status":"active","resourceType":"ExplanationOfBenefit","id":"1","meta":{"versionId":"2","source":"b"}}`},
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"1","status":"cancelled","meta":{"versionId":"2","source":"c"}}`},
+			},
+			wantWritten: []string{"a", "c"},
+		},
+		{
+			name:            "business identifier",
+			key:             processing.DedupKeyIdentifier,
+			identifierPaths: []string{"ExplanationOfBenefit.identifier"},
+			inputs: []input{
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"1","meta":{"source":"a"},"identifier":[{"system":"claims","value":"c1"}]}`},
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"2","meta":{"source":"b"},"identifier":[{"system":"claims","value":"c1"}]}`},
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"3","meta":{"source":"c"},"identifier":[{"system":"claims","value":"c2"}]}`},
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"4","meta":{"source":"d"}}`},
+				{eob, `{"resourceType":"ExplanationOfBenefit","id":"5","meta":{"source":"e"}}`},
+				{patient, `{"resourceType":"Patient","id":"1","meta":{"source":"f"},"identifier":[{"system":"claims","value":"c1"}]}`},
+				{patient, `{"resourceType":"Patient","id":"1","meta":{"source":"g"},"identifier":[{"system":"claims","value":"c1"}]}`},
+			},
+			wantWritten: []string{"a", "c", "d", "e", "f", "g"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			dp, err := processing.NewDedupProcessor(tc.key, tc.identifierPaths)
+			if err != nil {
+				t.Fatalf("NewDedupProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{dp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, in := range tc.inputs {
+				if err := p.Process(ctx, in.resourceType, "http://source", []byte(in.json)); err != nil {
+					t.Fatalf("p.Process(%s) returned unexpected error: %v", in.json, err)
+				}
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+			}
+			var got []string
+			for _, r := range ts.WrittenResources {
+				data, err := r.JSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var parsed struct {
+					Meta struct {
+						Source string `json:"source"`
+					} `json:"meta"`
+				}
+				if err := json.Unmarshal(data, &parsed); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, parsed.Meta.Source)
+			}
+			if diff := cmp.Diff(got, tc.wantWritten); diff != "" {
+				t.Errorf("dedup processor wrote unexpected resources (-got +want): %s", diff)
+			}
+		})
+	}
+}
+
+func TestNewDedupProcessor_Invalid(t *testing.T) {
+	cases := []struct {
+		name  string
+		key   processing.DedupKey
+		paths []string
+	}{
+		{"unknown key", "name", nil},
+		{"identifier without paths", processing.DedupKeyIdentifier, nil},
+		{"paths without identifier", processing.DedupKeyContentHash, []string{"Patient.identifier"}},
+		{"invalid path", processing.DedupKeyIdentifier, []string{"Patient"}},
+	}
+	for _, tc := range cases {
+		if _, err := processing.NewDedupProcessor(tc.key, tc.paths); err == nil {
+			t.Errorf("NewDedupProcessor() with %s returned nil error", tc.name)
+		}
+	}
+}
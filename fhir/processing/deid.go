@@ -0,0 +1,403 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/fhir/go/jsonformat"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+var fhirDeidCounter *metrics.Counter = metrics.NewCounter("fhir-deid-counter", "Count of FHIR Resources which were de-identified. The counter is tagged by the FHIR Resource type ex) EXPLANATION_OF_BENEFIT.", "1", aggregation.Count, "FHIRResourceType")
+
+// MinDeidSaltLength is the minimum length in bytes of the salt used to
+// de-identify resources, so that hashed identifiers cannot be recovered by
+// hashing every likely value.
+const MinDeidSaltLength = 16
+
+// DeidRedactAllResources may be used in place of a resource type in a path of
+// DeidConfig.RedactPaths to redact the element from resources of every type,
+// e.g. Resource.text.
+const DeidRedactAllResources = "Resource"
+
+// DefaultDeidRedactPaths are the paths to the elements of commonly exported
+// resource types which directly identify a person, such as their name,
+// address and phone numbers, along with the narrative of every resource.
+var DefaultDeidRedactPaths = []string{
+	"Resource.text",
+	"Patient.name",
+	"Patient.telecom",
+	"Patient.address",
+	"Patient.photo",
+	"Patient.contact",
+	"Person.name",
+	"Person.telecom",
+	"Person.address",
+	"Person.photo",
+	"Practitioner.name",
+	"Practitioner.telecom",
+	"Practitioner.address",
+	"Practitioner.photo",
+	"RelatedPerson.name",
+	"RelatedPerson.telecom",
+	"RelatedPerson.address",
+	"RelatedPerson.photo",
+}
+
+// DeidConfig configures the de-identification processor.
+type DeidConfig struct {
+	// Salt keys the hashes of resource IDs and identifiers, and the date shift
+	// of each patient. It must be at least MinDeidSaltLength bytes and kept
+	// secret. The same salt must be used in every run for the hashes and date
+	// shifts of a patient's resources to be consistent across runs.
+	Salt []byte
+	// DateShiftDays is the maximum number of days by which the dates of a
+	// patient's resources are shifted, earlier or later. If zero, dates are not
+	// shifted.
+	DateShiftDays int
+	// RedactPaths are simple FHIRPath expressions such as Patient.name, naming
+	// the elements to remove from resources of a type. Choice elements are
+	// named without their type suffix (e.g. Patient.deceased), and
+	// DeidRedactAllResources may be used in place of the resource type. See
+	// DefaultDeidRedactPaths.
+	RedactPaths []string
+}
+
+type deidProcessor struct {
+	BaseProcessor
+	salt          []byte
+	dateShiftDays int
+	// redactPaths holds the element paths to redact from each resource type,
+	// split into their element names, without the leading resource type.
+	// Paths which apply to every resource type are held under the empty
+	// string.
+	redactPaths map[string][][]string
+
+	deidentified, redacted atomic.Int64
+}
+
+// Assert deidProcessor satisfies the Processor interface.
+var _ Processor = &deidProcessor{}
+
+// NewDeidProcessor creates a Processor which de-identifies resources, so that
+// a de-identified copy of an export can be written directly. Each resource is
+// changed as follows:
+//
+//   - The elements named by cfg.RedactPaths are removed.
+//   - The resource's ID is replaced by a salted hash of its type and ID, and
+//     each reference to a resource by type and ID is replaced by a reference
+//     to the hashed ID, so that references between de-identified resources
+//     still resolve. Other references, except to contained resources, are
+//     removed, as is the display text of every reference, which often names
+//     a person.
+//   - The value of each identifier, such as a medical record number, is
+//     replaced by a salted hash of its system and value.
+//   - If cfg.DateShiftDays is set, every date, dateTime and instant in a
+//     Patient, or in a resource referencing a Patient, is shifted by a number
+//     of days derived from the salt and the Patient's ID, so that intervals
+//     between the events of a patient are preserved. Partial dates, such as a
+//     year, are shifted from their start.
+//
+// The same salt always gives the same hashes and date shifts, so resources
+// de-identified in different runs can still be joined. Contained resources are
+// not de-identified; redact Resource.contained to remove them.
+func NewDeidProcessor(cfg DeidConfig) (Processor, error) {
+	if len(cfg.Salt) < MinDeidSaltLength {
+		return nil, fmt.Errorf("de-identification salt must be at least %d bytes, got %d", MinDeidSaltLength, len(cfg.Salt))
+	}
+	if cfg.DateShiftDays < 0 {
+		return nil, fmt.Errorf("de-identification date shift must not be negative, got %d days", cfg.DateShiftDays)
+	}
+	paths, err := parseElementPaths("redact", cfg.RedactPaths)
+	if err != nil {
+		return nil, err
+	}
+	return &deidProcessor{
+		salt:          append([]byte(nil), cfg.Salt...),
+		dateShiftDays: cfg.DateShiftDays,
+		redactPaths:   paths,
+	}, nil
+}
+
+// resourceDescriptors returns the message descriptor of each resource type
+// which may be held by a ContainedResource, by resource type name.
+func resourceDescriptors() map[string]protoreflect.MessageDescriptor {
+	descriptors := map[string]protoreflect.MessageDescriptor{}
+	fields := (&rpb.ContainedResource{}).ProtoReflect().Descriptor().Oneofs().ByName("oneof_resource").Fields()
+	for i := 0; i < fields.Len(); i++ {
+		md := fields.Get(i).Message()
+		descriptors[string(md.Name())] = md
+	}
+	return descriptors
+}
+
+// hasElementPath returns whether the message has a nested element at the path
+// of FHIR JSON field names.
+func hasElementPath(md protoreflect.MessageDescriptor, path []string) bool {
+	for i, name := range path {
+		fd := md.Fields().ByJSONName(name)
+		if fd == nil {
+			return false
+		}
+		if i < len(path)-1 {
+			if md = fd.Message(); md == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseElementPaths parses paths such as Patient.name, checking that each names
+// an element of its resource type, or of at least one resource type for
+// DeidRedactAllResources. The paths are returned split into their element
+// names by resource type, with those for every resource type under the empty
+// string. kind describes the paths in errors.
+func parseElementPaths(kind string, paths []string) (map[string][][]string, error) {
+	descriptors := resourceDescriptors()
+	parsed := map[string][][]string{}
+	for _, p := range paths {
+		parts := strings.Split(strings.TrimSpace(p), ".")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid %s path %q, must be a resource type followed by element names, e.g. Patient.name", kind, p)
+		}
+		found := false
+		if parts[0] == DeidRedactAllResources {
+			for _, md := range descriptors {
+				if hasElementPath(md, parts[1:]) {
+					found = true
+					break
+				}
+			}
+			parts[0] = ""
+		} else {
+			if _, err := bulkfhir.ResourceTypeCodeFromName(parts[0]); err != nil {
+				return nil, fmt.Errorf("invalid %s path %q: %w", kind, p, err)
+			}
+			md, ok := descriptors[parts[0]]
+			found = ok && hasElementPath(md, parts[1:])
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid %s path %q, no such element", kind, p)
+		}
+		parsed[parts[0]] = append(parsed[parts[0]], parts[1:])
+	}
+	return parsed, nil
+}
+
+func (dp *deidProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	m := cr.ProtoReflect()
+	field := m.WhichOneof(m.Descriptor().Oneofs().ByName("oneof_resource"))
+	if field == nil {
+		return errors.New("ContainedResource has no resource set")
+	}
+	r := m.Mutable(field).Message()
+	typeName := string(r.Descriptor().Name())
+
+	// The date shift is derived from the Patient's original ID, so it must be
+	// found before IDs are hashed.
+	var shift time.Duration
+	if dp.dateShiftDays > 0 {
+		if patientID, ok := patientOf(cr); ok {
+			shift = dp.dateShift(patientID)
+		}
+	}
+
+	for _, key := range []string{"", typeName} {
+		for _, path := range dp.redactPaths[key] {
+			dp.redacted.Add(int64(redactElement(r, path)))
+		}
+	}
+
+	if fd := r.Descriptor().Fields().ByName("id"); fd != nil && r.Has(fd) {
+		if id, ok := r.Get(fd).Message().Interface().(*dpb.Id); ok && id.GetValue() != "" {
+			id.Value = dp.hashID(typeName, id.GetValue())
+		}
+	}
+	walkMessages(cr, func(_ string, m protoreflect.Message) {
+		switch v := m.Interface().(type) {
+		case *dpb.Date:
+			v.ValueUs += shift.Microseconds()
+		case *dpb.DateTime:
+			v.ValueUs += shift.Microseconds()
+		case *dpb.Instant:
+			v.ValueUs += shift.Microseconds()
+		case *dpb.Identifier:
+			if v.GetValue().GetValue() != "" {
+				v.Value.Value = dp.hash("identifier", v.GetSystem().GetValue()+"|"+v.GetValue().GetValue())
+			}
+		case *dpb.Reference:
+			err = errors.Join(err, dp.deidReference(v))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	dp.deidentified.Add(1)
+	if err := fhirDeidCounter.Record(ctx, 1, resource.Type().String()); err != nil {
+		return err
+	}
+	return dp.Output(ctx, resource)
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (dp *deidProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (dp *deidProcessor) Finalize(ctx context.Context) error {
+	if n := dp.deidentified.Load(); n > 0 {
+		log.Infof("De-identified %d resources, redacting %d elements.", n, dp.redacted.Load())
+	}
+	return nil
+}
+
+// hash returns the hex encoded HMAC-SHA256 of the value, keyed by the salt.
+// kind distinguishes the hashes of different kinds of value.
+func (dp *deidProcessor) hash(kind, value string) string {
+	return hex.EncodeToString(dp.mac(kind, value))
+}
+
+func (dp *deidProcessor) mac(kind, value string) []byte {
+	h := hmac.New(sha256.New, dp.salt)
+	h.Write([]byte(kind + "\x00" + value))
+	return h.Sum(nil)
+}
+
+// hashID returns the de-identified ID of a resource. Being 64 hex characters,
+// it is a valid FHIR id.
+func (dp *deidProcessor) hashID(resourceType, id string) string {
+	return dp.hash("id", resourceType+"/"+id)
+}
+
+// dateShift returns the offset of the dates of the patient's resources, a whole
+// number of days between -dateShiftDays and dateShiftDays.
+func (dp *deidProcessor) dateShift(patientID string) time.Duration {
+	v := binary.BigEndian.Uint64(dp.mac("date_shift", patientID))
+	days := int(v%uint64(2*dp.dateShiftDays+1)) - dp.dateShiftDays
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// patientOf returns the ID of the Patient the resource is about: its own ID
+// for a Patient, or else the first Patient it references.
+func patientOf(cr *rpb.ContainedResource) (string, bool) {
+	if p := cr.GetPatient(); p != nil {
+		return p.GetId().GetValue(), p.GetId().GetValue() != ""
+	}
+	var patientID string
+	walkMessages(cr, func(_ string, m protoreflect.Message) {
+		ref, ok := m.Interface().(*dpb.Reference)
+		if !ok || patientID != "" {
+			return
+		}
+		if rt, id, _, ok := referenceTarget(ref); ok && rt == "Patient" {
+			patientID = id
+		}
+	})
+	return patientID, patientID != ""
+}
+
+// referenceTarget returns the resource type, ID and version, if any, of a
+// relative or absolute reference to a resource by type and ID.
+func referenceTarget(ref *dpb.Reference) (resourceType, id, version string, ok bool) {
+	denormalized, err := jsonformat.NewDenormalizedReference(ref)
+	if err != nil {
+		return "", "", "", false
+	}
+	parts := strings.Split(denormalized.(*dpb.Reference).GetUri().GetValue(), "/")
+	if n := len(parts); n >= 4 && parts[n-2] == "_history" {
+		version = parts[n-1]
+		parts = parts[:n-2]
+	}
+	if len(parts) < 2 {
+		return "", "", "", false
+	}
+	resourceType, id = parts[len(parts)-2], parts[len(parts)-1]
+	if _, err := bulkfhir.ResourceTypeCodeFromName(resourceType); err != nil || id == "" {
+		return "", "", "", false
+	}
+	return resourceType, id, version, true
+}
+
+// deidReference replaces a reference to a resource by type and ID with a
+// relative reference to its hashed ID, and removes the reference's display
+// text. References to contained resources are kept, and other references
+// removed.
+func (dp *deidProcessor) deidReference(ref *dpb.Reference) error {
+	ref.Display = nil
+	switch ref.GetReference().(type) {
+	case nil, *dpb.Reference_Fragment:
+		return nil
+	}
+	resourceType, id, version, ok := referenceTarget(ref)
+	if !ok {
+		ref.Reference = nil
+		return nil
+	}
+	uri := resourceType + "/" + dp.hashID(resourceType, id)
+	if version != "" {
+		uri += "/_history/" + version
+	}
+	ref.Reference = &dpb.Reference_Uri{Uri: &dpb.String{Value: uri}}
+	return jsonformat.NormalizeReference(ref)
+}
+
+// redactElement removes the elements at the path of FHIR JSON field names
+// within the message, returning how many were removed.
+func redactElement(m protoreflect.Message, path []string) int {
+	fd := m.Descriptor().Fields().ByJSONName(path[0])
+	if fd == nil || !m.Has(fd) {
+		return 0
+	}
+	if len(path) == 1 {
+		m.Clear(fd)
+		return 1
+	}
+	if fd.Kind() != protoreflect.MessageKind {
+		return 0
+	}
+	if !fd.IsList() {
+		return redactElement(m.Get(fd).Message(), path[1:])
+	}
+	n := 0
+	l := m.Get(fd).List()
+	for i := 0; i < l.Len(); i++ {
+		n += redactElement(l.Get(i).Message(), path[1:])
+	}
+	return n
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+const (
+	deidPatient = `{"resourceType":"Patient","id":"p1","text":{"status":"generated","div":"<div xmlns=\"http://www.w3.org/1999/xhtml\">Jane Doe</div>"},"identifier":[{"system":"mbi","value":"1S00E00AA00"}],"name":[{"family":"Doe","given":["Jane"]}],"telecom":[{"system":"phone","value":"555-0100"}],"address":[{"city":"Springfield","postalCode":"12345"}],"gender":"female","birthDate":"1950-06-15"}`
+	deidEOB     = `{"resourceType":"ExplanationOfBenefit","id":"e1","identifier":[{"system":"claims","value":"c1"}],"status":"active","type":{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/claim-type","code":"institutional"}]},"use":"claim","patient":{"reference":"Patient/p1","display":"Jane Doe"},"billablePeriod":{"start":"2024-03-01","end":"2024-03-05"},"created":"2024-03-10T12:00:00Z","insurer":{"reference":"https://example.com/Organization/o1/_history/2"},"provider":{"reference":"urn:uuid:1234","identifier":{"system":"npi","value":"9999999999"}},"outcome":"complete"}`
+)
+
+// deidentify runs the resources through a de-identification processor with
+// the given config, returning the resources written, parsed from JSON.
+func deidentify(t *testing.T, cfg processing.DeidConfig, resources ...string) []map[string]any {
+	t.Helper()
+	metrics.ResetAll()
+	ctx := context.Background()
+	dp, err := processing.NewDeidProcessor(cfg)
+	if err != nil {
+		t.Fatalf("NewDeidProcessor() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{dp}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range resources {
+		var rt struct {
+			ResourceType string `json:"resourceType"`
+		}
+		if err := json.Unmarshal([]byte(r), &rt); err != nil {
+			t.Fatal(err)
+		}
+		code := cpb.ResourceTypeCode_PATIENT
+		if rt.ResourceType == "ExplanationOfBenefit" {
+			code = cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT
+		}
+		if err := p.Process(ctx, code, "http://source", []byte(r)); err != nil {
+			t.Fatalf("p.Process(%s) returned unexpected error: %v", r, err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+	}
+	var got []map[string]any
+	for _, r := range ts.WrittenResources {
+		data, err := r.JSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed map[string]any
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, parsed)
+	}
+	return got
+}
+
+func mustParseDate(t *testing.T, layout string, value any) time.Time {
+	t.Helper()
+	s, _ := value.(string)
+	d, err := time.Parse(layout, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDeidProcessor(t *testing.T) {
+	cfg := processing.DeidConfig{
+		Salt:          []byte("0123456789abcdef"),
+		DateShiftDays: 30,
+		RedactPaths:   processing.DefaultDeidRedactPaths,
+	}
+	got := deidentify(t, cfg, deidPatient, deidEOB)
+	if len(got) != 2 {
+		t.Fatalf("de-identification processor wrote %d resources, want 2", len(got))
+	}
+	patient, eob := got[0], got[1]
+
+	for _, element := range []string{"text", "name", "telecom", "address"} {
+		if _, ok := patient[element]; ok {
+			t.Errorf("de-identified Patient has %s, want it redacted", element)
+		}
+	}
+	if patient["gender"] != "female" {
+		t.Errorf("de-identified Patient gender = %v, want female", patient["gender"])
+	}
+
+	patientID, _ := patient["id"].(string)
+	if len(patientID) != 64 || patientID == "p1" {
+		t.Errorf("de-identified Patient id = %q, want a 64 character hash", patientID)
+	}
+	if eob["id"] == "e1" {
+		t.Errorf("de-identified ExplanationOfBenefit id was not hashed")
+	}
+	wantPatientRef := map[string]any{"reference": "Patient/" + patientID}
+	if diff := cmp.Diff(eob["patient"], wantPatientRef); diff != "" {
+		t.Errorf("de-identified ExplanationOfBenefit patient unexpected (-got +want): %s", diff)
+	}
+	insurer := eob["insurer"].(map[string]any)["reference"].(string)
+	if !strings.HasPrefix(insurer, "Organization/") || !strings.HasSuffix(insurer, "/_history/2") || strings.Contains(insurer, "/o1/") {
+		t.Errorf("de-identified ExplanationOfBenefit insurer = %q, want a relative reference to the hashed ID", insurer)
+	}
+	provider := eob["provider"].(map[string]any)
+	if _, ok := provider["reference"]; ok {
+		t.Errorf("de-identified ExplanationOfBenefit provider has reference %v, want it removed", provider["reference"])
+	}
+	identifier := provider["identifier"].(map[string]any)
+	if identifier["system"] != "npi" || identifier["value"] == "9999999999" {
+		t.Errorf("de-identified ExplanationOfBenefit provider identifier = %v, want the value hashed", identifier)
+	}
+	mbi := patient["identifier"].([]any)[0].(map[string]any)
+	if mbi["system"] != "mbi" || mbi["value"] == "1S00E00AA00" {
+		t.Errorf("de-identified Patient identifier = %v, want the value hashed", mbi)
+	}
+
+	shift := mustParseDate(t, "2006-01-02", patient["birthDate"]).Sub(time.Date(1950, 6, 15, 0, 0, 0, 0, time.UTC))
+	if shift%(24*time.Hour) != 0 || shift < -30*24*time.Hour || shift > 30*24*time.Hour {
+		t.Errorf("de-identified Patient birthDate shifted by %v, want a whole number of days within 30 days", shift)
+	}
+	period := eob["billablePeriod"].(map[string]any)
+	if got, want := mustParseDate(t, "2006-01-02", period["start"]), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Add(shift); !got.Equal(want) {
+		t.Errorf("de-identified ExplanationOfBenefit billablePeriod.start = %v, want %v", got, want)
+	}
+	if got, want := mustParseDate(t, time.RFC3339, eob["created"]), time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC).Add(shift); !got.Equal(want) {
+		t.Errorf("de-identified ExplanationOfBenefit created = %v, want %v", got, want)
+	}
+
+	// The same salt gives the same result in another run, and a different
+	// salt gives different IDs.
+	if diff := cmp.Diff(deidentify(t, cfg, deidPatient, deidEOB), got); diff != "" {
+		t.Errorf("de-identification with the same salt is not consistent (-got +want): %s", diff)
+	}
+	cfg.Salt = []byte("fedcba9876543210")
+	if other := deidentify(t, cfg, deidPatient); other[0]["id"] == patientID {
+		t.Errorf("de-identification with a different salt gave the same Patient id")
+	}
+}
+
+func TestDeidProcessor_NoDateShift(t *testing.T) {
+	got := deidentify(t, processing.DeidConfig{Salt: []byte("0123456789abcdef")}, deidPatient)
+	if got[0]["birthDate"] != "1950-06-15" {
+		t.Errorf("de-identified Patient birthDate = %v, want it unchanged", got[0]["birthDate"])
+	}
+	if _, ok := got[0]["name"]; !ok {
+		t.Errorf("de-identified Patient has no name, want it kept without redact paths")
+	}
+}
+
+func TestNewDeidProcessor_Invalid(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	cases := []struct {
+		name string
+		cfg  processing.DeidConfig
+	}{
+		{"short salt", processing.DeidConfig{Salt: []byte("short")}},
+		{"negative date shift", processing.DeidConfig{Salt: salt, DateShiftDays: -1}},
+		{"path without element", processing.DeidConfig{Salt: salt, RedactPaths: []string{"Patient"}}},
+		{"unknown resource type", processing.DeidConfig{Salt: salt, RedactPaths: []string{"Patients.name"}}},
+		{"unknown element", processing.DeidConfig{Salt: salt, RedactPaths: []string{"Patient.names"}}},
+		{"unknown element of any resource", processing.DeidConfig{Salt: salt, RedactPaths: []string{"Resource.txt"}}},
+	}
+	for _, tc := range cases {
+		if _, err := processing.NewDeidProcessor(tc.cfg); err == nil {
+			t.Errorf("NewDeidProcessor() with %s returned nil error", tc.name)
+		}
+	}
+}
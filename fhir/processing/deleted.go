@@ -0,0 +1,129 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var fhirDeletedResourceCounter *metrics.Counter = metrics.NewCounter("fhir-deleted-resource-counter", "Count of FHIR Resources listed as deleted by the bulk fhir server, which are deleted from the sinks supporting deletion. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+// Deleter is implemented by Sinks which can delete resources they have
+// written, so that resources deleted on the bulk FHIR server can also be
+// removed from storage rather than retained.
+type Deleter interface {
+	// Delete the resource with the given type and ID. Deleting a resource which
+	// does not exist must succeed. Like Write, it is not called concurrently.
+	Delete(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, id string) error
+}
+
+// Delete passes the deletion of a resource to each of the pipeline's sinks
+// which implement Deleter and are routed resources of its type, sequentially.
+// Other sinks, such as those writing NDJSON files of the exported resources,
+// are left unchanged. Deletions do not pass through the processors. If
+// concurrency is enabled, the resources queued so far are processed first. As
+// with Process, it is not safe to call this function from multiple Goroutines.
+func (p *Pipeline) Delete(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, id string) error {
+	if err := p.concurrency.wait(); err != nil {
+		return err
+	}
+	if err := fhirDeletedResourceCounter.Record(ctx, 1, resourceType.String()); err != nil {
+		return err
+	}
+	ctx = sinkContext(ctx)
+	for _, s := range p.sinks {
+		if !p.routesTo(s, resourceType) {
+			continue
+		}
+		// Look through wrappers, which do not count deletions.
+		if bcs, ok := s.(*ByteCountingSink); ok {
+			s = bcs.Sink
+		}
+		if d, ok := s.(Deleter); ok {
+			if err := d.Delete(ctx, resourceType, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ProcessDeleted processes a Bundle from the deleted array of an export job's
+// manifest, which lists resources deleted since the _since time of the export
+// as entries with a DELETE request, such as:
+//
+//	{"resourceType":"Bundle","type":"transaction","entry":[{"request":{"method":"DELETE","url":"Patient/123"}}]}
+//
+// Each of the listed resources is passed to Delete. It returns the number of
+// resources deleted.
+func (p *Pipeline) ProcessDeleted(ctx context.Context, sourceURL string, bundleJSON []byte) (int, error) {
+	var bundle struct {
+		ResourceType string `json:"resourceType"`
+		Entry        []struct {
+			Request struct {
+				Method string `json:"method"`
+				URL    string `json:"url"`
+			} `json:"request"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(bundleJSON, &bundle); err != nil {
+		return 0, fmt.Errorf("invalid deleted Bundle from %s: %w", sourceURL, err)
+	}
+	if bundle.ResourceType != "Bundle" {
+		return 0, fmt.Errorf("deleted resources from %s must be listed in a Bundle, got %q", sourceURL, bundle.ResourceType)
+	}
+	deleted := 0
+	for i, e := range bundle.Entry {
+		if e.Request.Method != http.MethodDelete {
+			return deleted, fmt.Errorf("deleted Bundle entry %d from %s has request method %q, want DELETE", i, sourceURL, e.Request.Method)
+		}
+		resourceType, id, err := parseDeletedURL(e.Request.URL)
+		if err != nil {
+			return deleted, fmt.Errorf("deleted Bundle entry %d from %s: %w", i, sourceURL, err)
+		}
+		if err := p.Delete(ctx, resourceType, id); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// parseDeletedURL returns the resource type and ID from the request URL of a
+// deleted Bundle entry, which is relative (e.g. Patient/123), although some
+// servers may return an absolute URL.
+func parseDeletedURL(url string) (cpb.ResourceTypeCode_Value, string, error) {
+	path, _, _ := strings.Cut(url, "?")
+	path, _, _ = strings.Cut(path, "/_history")
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(parts) < 2 || parts[len(parts)-1] == "" {
+		return cpb.ResourceTypeCode_INVALID_UNINITIALIZED, "", fmt.Errorf("request URL %q is not of the form ResourceType/id", url)
+	}
+	resourceType, err := bulkfhir.ResourceTypeCodeFromName(parts[len(parts)-2])
+	if err != nil {
+		return cpb.ResourceTypeCode_INVALID_UNINITIALIZED, "", fmt.Errorf("request URL %q has an invalid resource type: %w", url, err)
+	}
+	return resourceType, parts[len(parts)-1], nil
+}
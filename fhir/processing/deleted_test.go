@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestPipeline_ProcessDeleted(t *testing.T) {
+	cases := []struct {
+		name        string
+		json        string
+		wantDeleted []processing.TestDeletedResource
+		wantErr     bool
+	}{
+		{
+			name: "relative and absolute URLs",
+			json: `{"resourceType":"Bundle","type":"transaction","entry":[
+				{"request":{"method":"DELETE","url":"Patient/123"}},
+				{"request":{"method":"DELETE","url":"https://example.com/fhir/Observation/456/_history/2"}}]}`,
+			wantDeleted: []processing.TestDeletedResource{
+				{ResourceType: cpb.ResourceTypeCode_PATIENT, ID: "123"},
+				{ResourceType: cpb.ResourceTypeCode_OBSERVATION, ID: "456"},
+			},
+		},
+		{
+			name: "empty Bundle",
+			json: `{"resourceType":"Bundle","type":"transaction"}`,
+		},
+		{
+			name:    "not a Bundle",
+			json:    `{"resourceType":"Patient","id":"123"}`,
+			wantErr: true,
+		},
+		{
+			name:    "not a DELETE",
+			json:    `{"resourceType":"Bundle","type":"transaction","entry":[{"request":{"method":"PUT","url":"Patient/123"}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid URL",
+			json:    `{"resourceType":"Bundle","type":"transaction","entry":[{"request":{"method":"DELETE","url":"123"}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid resource type",
+			json:    `{"resourceType":"Bundle","type":"transaction","entry":[{"request":{"method":"DELETE","url":"Unknown/123"}}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ts := &processing.TestSink{}
+			// Deletions are passed through wrapping sinks, and are ignored by sinks
+			// which do not support them, such as this one which hides TestSink.Delete.
+			writeOnly := &processing.TestSink{}
+			p, err := processing.NewPipeline(nil, []processing.Sink{processing.NewByteCountingSink(ts), struct{ processing.Sink }{writeOnly}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			deleted, err := p.ProcessDeleted(context.Background(), "http://source", []byte(tc.json))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ProcessDeleted() returned error %v, want error: %v", err, tc.wantErr)
+			}
+			if deleted != len(tc.wantDeleted) {
+				t.Errorf("ProcessDeleted() returned %d, want %d", deleted, len(tc.wantDeleted))
+			}
+			if diff := cmp.Diff(tc.wantDeleted, ts.DeletedResources); diff != "" {
+				t.Errorf("ProcessDeleted() deleted unexpected resources (-want +got):\n%s", diff)
+			}
+			if len(writeOnly.DeletedResources) != 0 {
+				t.Errorf("ProcessDeleted() deleted resources from a sink which does not support deletion: %v", writeOnly.DeletedResources)
+			}
+			if len(ts.WrittenResources) != 0 {
+				t.Errorf("ProcessDeleted() wrote %d resources, want 0", len(ts.WrittenResources))
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/gcs"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var fhirDeltaCounter *metrics.Counter = metrics.NewCounter("fhir-delta-counter", "Count of FHIR Resources compared with the delta state of previous runs. The counter is tagged by the FHIR Resource type ex) OBSERVATION, and whether the resource was new, changed or unchanged.", "1", aggregation.Count, "FHIRResourceType", "Change")
+
+// DeltaState holds a fingerprint of the content of each resource delivered by
+// previous runs, by resource type and id, so that a run can tell which of its
+// resources are new or changed.
+type DeltaState struct {
+	// Fingerprints maps resources, as ResourceType/id, to a SHA-256 hash of
+	// their content other than meta.
+	Fingerprints map[string]string `json:"fingerprints"`
+	// LastSeen maps resources, as in Fingerprints, to the start of the last
+	// run which exported them. Resources whose fingerprints were stored before
+	// this was recorded have no entry.
+	LastSeen map[string]time.Time `json:"lastSeen,omitempty"`
+}
+
+// newDeltaState returns an empty DeltaState.
+func newDeltaState() *DeltaState {
+	return &DeltaState{Fingerprints: map[string]string{}, LastSeen: map[string]time.Time{}}
+}
+
+// Compact removes the fingerprints of resources last exported before the
+// given time, so that the state does not grow without bound as resources are
+// deleted or stop being exported. Such a resource is treated as new if it is
+// exported again. Resources with no LastSeen time are kept, and given the
+// current time. It returns the number of fingerprints removed.
+func (s *DeltaState) Compact(before time.Time) int {
+	now := time.Now().UTC().Truncate(time.Second)
+	removed := 0
+	for key := range s.Fingerprints {
+		seen, ok := s.LastSeen[key]
+		switch {
+		case !ok:
+			s.LastSeen[key] = now
+		case seen.Before(before):
+			delete(s.Fingerprints, key)
+			delete(s.LastSeen, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// EncodedSize returns the size in bytes of the state as stored.
+func (s *DeltaState) EncodedSize() (int, error) {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(s); err != nil {
+		return 0, err
+	}
+	return b.Len(), nil
+}
+
+// DeltaStateStore persists a DeltaState between runs.
+type DeltaStateStore interface {
+	// Load the stored state. If no state has previously been stored, this
+	// returns an empty state with no error.
+	Load(ctx context.Context) (*DeltaState, error)
+	// Store overwrites the stored state with the given one.
+	Store(ctx context.Context, s *DeltaState) error
+}
+
+func readDeltaState(r io.Reader, name string) (*DeltaState, error) {
+	s := newDeltaState()
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return nil, fmt.Errorf("failed to parse delta state %s: %w", name, err)
+	}
+	if s.Fingerprints == nil {
+		s.Fingerprints = map[string]string{}
+	}
+	if s.LastSeen == nil {
+		s.LastSeen = map[string]time.Time{}
+	}
+	return s, nil
+}
+
+func writeDeltaState(s *DeltaState, w io.WriteCloser, name string) error {
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write delta state %s: %w", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write delta state %s: %w", name, err)
+	}
+	return nil
+}
+
+type localFileDeltaStateStore struct {
+	path string
+}
+
+func (ls *localFileDeltaStateStore) Load(ctx context.Context) (*DeltaState, error) {
+	f, err := os.Open(ls.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newDeltaState(), nil
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", ls.path, err)
+	}
+	defer f.Close()
+	return readDeltaState(f, ls.path)
+}
+
+func (ls *localFileDeltaStateStore) Store(ctx context.Context, s *DeltaState) error {
+	// Write to a temporary file and rename it, so that a failed write does not
+	// corrupt the existing state.
+	tmp := ls.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	if err := writeDeltaState(s, f, ls.path); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ls.path)
+}
+
+// NewLocalFileDeltaStateStore returns a DeltaStateStore which persists the
+// state as JSON to a local file at the given path.
+func NewLocalFileDeltaStateStore(path string) DeltaStateStore {
+	return &localFileDeltaStateStore{path: path}
+}
+
+type gcsDeltaStateStore struct {
+	client                gcs.Client
+	relativePath, fullURI string
+}
+
+func (gs *gcsDeltaStateStore) Load(ctx context.Context) (*DeltaState, error) {
+	r, err := gs.client.GetFileReader(ctx, gs.relativePath)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return newDeltaState(), nil
+		}
+		return nil, fmt.Errorf("failed to get GCS reader for %s: %w", gs.fullURI, err)
+	}
+	defer r.Close()
+	return readDeltaState(r, gs.fullURI)
+}
+
+func (gs *gcsDeltaStateStore) Store(ctx context.Context, s *DeltaState) error {
+	return writeDeltaState(s, gs.client.GetFileWriter(ctx, gs.relativePath), gs.fullURI)
+}
+
+// NewGCSDeltaStateStore returns a DeltaStateStore which persists the state as
+// JSON to a file in GCS at the given URI.
+func NewGCSDeltaStateStore(ctx context.Context, gcsEndpoint, uri string) (DeltaStateStore, error) {
+	bucket, relativePath, err := gcs.PathComponents(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := gcs.NewClient(ctx, bucket, gcsEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GCS client: %w", err)
+	}
+	return &gcsDeltaStateStore{client: client, relativePath: relativePath, fullURI: uri}, nil
+}
+
+// DeltaSink wraps another Sink, writing to it only the resources which are new
+// or changed since the runs recorded in a DeltaStateStore, so that downstream
+// consumers with their own stores can apply a small delta rather than the full
+// output. Resources are compared by type and id, and by their content other
+// than meta, as with DedupKeyContentHash. Resources without an id are always
+// written.
+//
+// The fingerprints of the resources written are stored once the wrapped sink
+// has been finalized, so a run which fails before then is delivered again in
+// full by the next. If a ttl is given, the fingerprints of resources which no
+// run has exported within it are then removed, so that the state stays
+// bounded; such resources are written again if they are exported later.
+// Fingerprints are only recorded for resources the wrapped sink wrote without
+// error, and are removed for resources deleted on the server, so that a
+// recreated resource is written again.
+//
+// The fingerprints have their own store rather than sharing one with
+// NewDedupProcessor, which only keeps the keys of the current run's resources
+// in memory and persists nothing between runs. As each run loads the whole
+// state into memory, it should be bounded with a ttl.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+type DeltaSink struct {
+	sink  Sink
+	store DeltaStateStore
+	ttl   time.Duration
+	// start is the time at which the sink was created, recorded as the
+	// LastSeen time of the resources it is written.
+	start time.Time
+
+	mu                      sync.Mutex
+	state                   *DeltaState
+	added, changed, skipped int
+}
+
+// Assert DeltaSink satisfies the Sink and Deleter interfaces.
+var _ Sink = &DeltaSink{}
+var _ Deleter = &DeltaSink{}
+
+// NewDeltaSink returns a DeltaSink writing to sink, with the state of previous
+// runs loaded from store. If ttl is set, fingerprints of resources not
+// exported within it are removed from the state when it is stored.
+func NewDeltaSink(ctx context.Context, sink Sink, store DeltaStateStore, ttl time.Duration) (*DeltaSink, error) {
+	state, err := store.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &DeltaSink{sink: sink, store: store, ttl: ttl, start: time.Now().UTC().Truncate(time.Second), state: state}, nil
+}
+
+// Write is Sink.Write.
+func (ds *DeltaSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as written, so that the fingerprint is exact.
+	dec.UseNumber()
+	var parsed map[string]any
+	if err := dec.Decode(&parsed); err != nil {
+		return err
+	}
+	id, _ := parsed["id"].(string)
+	resourceType, _ := parsed["resourceType"].(string)
+	if id == "" || resourceType == "" {
+		return ds.sink.Write(ctx, resource)
+	}
+	canonical, err := canonicalContent(parsed)
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256(canonical)
+	fingerprint := base64.RawStdEncoding.EncodeToString(h[:])
+	key := resourceType + "/" + id
+
+	ds.mu.Lock()
+	prev, ok := ds.state.Fingerprints[key]
+	ds.mu.Unlock()
+	change := "new"
+	switch {
+	case ok && prev == fingerprint:
+		change = "unchanged"
+	case ok:
+		change = "changed"
+	}
+	if err := fhirDeltaCounter.Record(ctx, 1, resource.Type().String(), change); err != nil {
+		return err
+	}
+	// The fingerprint is only recorded once the resource has been written, so
+	// that a resource which fails to be written is not skipped as unchanged by
+	// later runs.
+	if change != "unchanged" {
+		if err := ds.sink.Write(ctx, resource); err != nil {
+			return err
+		}
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	switch change {
+	case "unchanged":
+		ds.skipped++
+	case "changed":
+		ds.changed++
+	default:
+		ds.added++
+	}
+	ds.state.Fingerprints[key] = fingerprint
+	ds.state.LastSeen[key] = ds.start
+	return nil
+}
+
+// Delete is Deleter.Delete. The resource's fingerprint is removed, so that it
+// is written as new if it is recreated, and the deletion is passed to the
+// wrapped sink if it implements Deleter.
+func (ds *DeltaSink) Delete(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, id string) error {
+	name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+	if err != nil {
+		return err
+	}
+	if d, ok := ds.sink.(Deleter); ok {
+		if err := d.Delete(ctx, resourceType, id); err != nil {
+			return err
+		}
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	key := name + "/" + id
+	delete(ds.state.Fingerprints, key)
+	delete(ds.state.LastSeen, key)
+	return nil
+}
+
+// Flush is Flusher.Flush, and flushes the wrapped sink. It returns an error
+// wrapping ErrFlushNotSupported if the wrapped sink does not implement Flusher.
+// The delta state is only stored when the sink is finalized.
+func (ds *DeltaSink) Flush(ctx context.Context) error {
+	f, ok := ds.sink.(Flusher)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrFlushNotSupported, ds.sink)
+	}
+	return f.Flush(ctx)
+}
+
+// Finalize is Sink.Finalize. It finalizes the wrapped sink, and then compacts
+// and stores the delta state.
+func (ds *DeltaSink) Finalize(ctx context.Context) error {
+	if err := ds.sink.Finalize(ctx); err != nil {
+		return err
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	log.Infof("Delta output: %d new and %d changed resources written, %d unchanged resources skipped.", ds.added, ds.changed, ds.skipped)
+	if ds.ttl > 0 {
+		if n := ds.state.Compact(ds.start.Add(-ds.ttl)); n > 0 {
+			log.Infof("Removed %d resource fingerprints not exported within %s from the delta state.", n, ds.ttl)
+		}
+	}
+	if size, err := ds.state.EncodedSize(); err == nil {
+		log.Infof("Delta state holds %d resource fingerprints (%d bytes).", len(ds.state.Fingerprints), size)
+	}
+	return ds.store.Store(ctx, ds.state)
+}
@@ -0,0 +1,214 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// runDeltaSink writes the resources to a DeltaSink with the given ttl,
+// finalizing it if finalize is true, and returns the resources written to the
+// wrapped sink.
+func runDeltaSink(t *testing.T, store processing.DeltaStateStore, ttl time.Duration, resources []string, finalize bool) []string {
+	t.Helper()
+	ctx := context.Background()
+	ts := &processing.TestSink{}
+	ds, err := processing.NewDeltaSink(ctx, ts, store, ttl)
+	if err != nil {
+		t.Fatalf("NewDeltaSink() returned unexpected error: %v", err)
+	}
+	for _, r := range resources {
+		if err := ds.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(r)}); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if finalize {
+		if err := ds.Finalize(ctx); err != nil {
+			t.Fatalf("Finalize() returned unexpected error: %v", err)
+		}
+	}
+	var written []string
+	for _, r := range ts.WrittenResources {
+		data, err := r.JSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, string(data))
+	}
+	return written
+}
+
+func TestDeltaSink(t *testing.T) {
+	gcsServer := testhelpers.NewGCSServer(t)
+	gcsStore, err := processing.NewGCSDeltaStateStore(context.Background(), gcsServer.URL(), "gs://bucket/delta.json")
+	if err != nil {
+		t.Fatalf("NewGCSDeltaStateStore() returned unexpected error: %v", err)
+	}
+	stores := map[string]processing.DeltaStateStore{
+		"local": processing.NewLocalFileDeltaStateStore(filepath.Join(t.TempDir(), "delta.json")),
+		"gcs":   gcsStore,
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			metrics.ResetAll()
+			first := []string{
+				`{"resourceType":"Patient","id":"1","gender":"male","meta":{"versionId":"1"}}`,
+				`{"resourceType":"Patient","id":"2","gender":"female"}`,
+				`{"resourceType":"Patient","gender":"other"}`,
+			}
+			if diff := cmp.Diff(first, runDeltaSink(t, store, 0, first, true)); diff != "" {
+				t.Errorf("first run wrote unexpected resources (-want +got):\n%s", diff)
+			}
+
+			// A run which is not finalized does not update the state.
+			runDeltaSink(t, store, 0, []string{`{"resourceType":"Patient","id":"3"}`}, false)
+
+			second := []string{
+				`{"meta":{"versionId":"2"},"gender":"male","id":"1","resourceType":"Patient"}`,
+				`{"resourceType":"Patient","id":"2","gender":"unknown"}`,
+				`{"resourceType":"Patient","id":"3"}`,
+				`{"resourceType":"Patient","gender":"other"}`,
+			}
+			want := second[1:]
+			if diff := cmp.Diff(want, runDeltaSink(t, store, 0, second, true)); diff != "" {
+				t.Errorf("second run wrote unexpected resources (-want +got):\n%s", diff)
+			}
+
+			gotCount, _, err := metrics.GetResults()
+			if err != nil {
+				t.Errorf("GetResults failed; err = %s", err)
+			}
+			wantCount := map[string]int64{"PATIENT-new": 4, "PATIENT-changed": 1, "PATIENT-unchanged": 1}
+			if diff := cmp.Diff(wantCount, gotCount["fhir-delta-counter"].Count); diff != "" {
+				t.Errorf("GetResults() return unexpected count (-want +got): \n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDeltaSink_TTL(t *testing.T) {
+	ctx := context.Background()
+	store := processing.NewLocalFileDeltaStateStore(filepath.Join(t.TempDir(), "delta.json"))
+	current := `{"resourceType":"Patient","id":"current"}`
+	stale := `{"resourceType":"Patient","id":"stale"}`
+	ttl := 90 * 24 * time.Hour
+	runDeltaSink(t, store, ttl, []string{current, stale}, true)
+
+	// Age the stale resource beyond the ttl, and add a fingerprint stored
+	// before LastSeen was recorded.
+	state, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() returned unexpected error: %v", err)
+	}
+	state.LastSeen["Patient/stale"] = time.Now().Add(-ttl - time.Hour)
+	state.Fingerprints["Patient/legacy"] = "fingerprint"
+	if err := store.Store(ctx, state); err != nil {
+		t.Fatalf("Store() returned unexpected error: %v", err)
+	}
+
+	if got := runDeltaSink(t, store, ttl, []string{current}, true); len(got) != 0 {
+		t.Errorf("run wrote %v, want no unchanged resources", got)
+	}
+	state, err = store.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() returned unexpected error: %v", err)
+	}
+	var keys []string
+	for key := range state.Fingerprints {
+		keys = append(keys, key)
+	}
+	if diff := cmp.Diff([]string{"Patient/current", "Patient/legacy"}, keys, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("delta state holds unexpected fingerprints after compaction (-want +got):\n%s", diff)
+	}
+	if _, ok := state.LastSeen["Patient/legacy"]; !ok {
+		t.Errorf("delta state has no LastSeen time for a fingerprint without one before compaction")
+	}
+
+	// The expired resource is written again.
+	if diff := cmp.Diff([]string{stale}, runDeltaSink(t, store, ttl, []string{stale}, true)); diff != "" {
+		t.Errorf("run after expiry wrote unexpected resources (-want +got):\n%s", diff)
+	}
+}
+
+func TestDeltaSink_FailedWrite(t *testing.T) {
+	ctx := context.Background()
+	store := processing.NewLocalFileDeltaStateStore(filepath.Join(t.TempDir(), "delta.json"))
+	patient := `{"resourceType":"Patient","id":"1","name":[{"text":"unwritable"}]}`
+	ds, err := processing.NewDeltaSink(ctx, &failingSink{}, store, 0)
+	if err != nil {
+		t.Fatalf("NewDeltaSink() returned unexpected error: %v", err)
+	}
+	if err := ds.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(patient)}); err == nil {
+		t.Fatalf("Write() succeeded, want error from the wrapped sink")
+	}
+	// The run still completes, for example with the resource dead lettered.
+	if err := ds.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{patient}, runDeltaSink(t, store, 0, []string{patient}, true)); diff != "" {
+		t.Errorf("run after a failed write wrote unexpected resources (-want +got):\n%s", diff)
+	}
+}
+
+func TestDeltaSink_Delete(t *testing.T) {
+	ctx := context.Background()
+	store := processing.NewLocalFileDeltaStateStore(filepath.Join(t.TempDir(), "delta.json"))
+	patient := `{"resourceType":"Patient","id":"1"}`
+	runDeltaSink(t, store, 0, []string{patient}, true)
+
+	ts := &processing.TestSink{}
+	ds, err := processing.NewDeltaSink(ctx, ts, store, 0)
+	if err != nil {
+		t.Fatalf("NewDeltaSink() returned unexpected error: %v", err)
+	}
+	p, err := processing.NewPipeline(nil, []processing.Sink{ds})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	if err := p.Delete(ctx, cpb.ResourceTypeCode_PATIENT, "1"); err != nil {
+		t.Fatalf("Delete() returned unexpected error: %v", err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+	wantDeleted := []processing.TestDeletedResource{{ResourceType: cpb.ResourceTypeCode_PATIENT, ID: "1"}}
+	if diff := cmp.Diff(wantDeleted, ts.DeletedResources); diff != "" {
+		t.Errorf("DeltaSink passed unexpected deletions to the wrapped sink (-want +got):\n%s", diff)
+	}
+	state, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() returned unexpected error: %v", err)
+	}
+	if len(state.Fingerprints) != 0 || len(state.LastSeen) != 0 {
+		t.Errorf("delta state holds %v after the resource was deleted, want no fingerprints", state)
+	}
+
+	// A recreated resource is written again, even with the same content.
+	if diff := cmp.Diff([]string{patient}, runDeltaSink(t, store, 0, []string{patient}, true)); diff != "" {
+		t.Errorf("run after deletion wrote unexpected resources (-want +got):\n%s", diff)
+	}
+}
@@ -87,6 +87,23 @@ func (lfw *localFileWriter) writeFile(ctx context.Context, filename string, data
 	return fmt.Sprintf("file://%s", fullPath), os.WriteFile(fullPath, data, 0666)
 }
 
+// newFileWriter returns a fileWriter which writes files to localDirectory if it
+// is set, or else to the directory in the GCS bucket.
+func newFileWriter(ctx context.Context, localDirectory, gcsEndpoint, gcsBucket, gcsDirectory string) (fileWriter, error) {
+	if localDirectory != "" {
+		return &localFileWriter{localDirectory}, nil
+	}
+	gcsClient, err := gcs.NewClient(ctx, gcsBucket, gcsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsFileWriter{
+		client:    gcsClient,
+		bucket:    gcsBucket,
+		directory: gcsDirectory,
+	}, nil
+}
+
 type documentsProcessor struct {
 	BaseProcessor
 	authenticator bulkfhir.Authenticator
@@ -111,19 +128,9 @@ type DocumentsProcessorConfig struct {
 // the URLs found in DocumentReference resources, and replaces those URLs with
 // URIs for the downloaded files.
 func NewDocumentsProcessor(ctx context.Context, cfg *DocumentsProcessorConfig) (Processor, error) {
-	var fw fileWriter
-	if cfg.LocalDirectory != "" {
-		fw = &localFileWriter{cfg.LocalDirectory}
-	} else {
-		gcsClient, err := gcs.NewClient(ctx, cfg.GCSBucket, cfg.GCSEndpoint)
-		if err != nil {
-			return nil, err
-		}
-		fw = &gcsFileWriter{
-			client:    gcsClient,
-			bucket:    cfg.GCSBucket,
-			directory: cfg.GCSDirectory,
-		}
+	fw, err := newFileWriter(ctx, cfg.LocalDirectory, cfg.GCSEndpoint, cfg.GCSBucket, cfg.GCSDirectory)
+	if err != nil {
+		return nil, err
 	}
 	return &documentsProcessor{
 		authenticator: cfg.Authenticator,
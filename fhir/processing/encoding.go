@@ -0,0 +1,230 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var encodingNormalizedCounter *metrics.Counter = metrics.NewCounter("fhir-encoding-normalized-counter", "Count of FHIR Resources whose character encoding was normalized, or which were rejected in strict mode. The counter is tagged by the FHIR Resource type ex) OBSERVATION and the issue found ex) INVALID_UTF8.", "1", aggregation.Count, "FHIRResourceType", "Issue")
+
+// ErrInvalidEncoding is returned (wrapped) by Pipeline.Process for resources
+// with encoding issues when strict encoding normalization is enabled.
+var ErrInvalidEncoding = errors.New("resource has an invalid character encoding")
+
+// EncodingNormalizationConfig configures how a Pipeline handles resources whose
+// JSON is not valid UTF-8 or holds control characters, which FHIR does not
+// allow and which otherwise surface as confusing errors from sinks such as the
+// FHIR store.
+type EncodingNormalizationConfig struct {
+	// If true, resources with encoding issues are rejected rather than
+	// normalized: Process returns an error wrapping ErrInvalidEncoding, or, if
+	// resource isolation is enabled, routes the resource to the dead letter
+	// sink.
+	Strict bool
+}
+
+// SetEncodingNormalization enables normalizing the encoding of resources before
+// they are parsed. The normalization:
+//
+//   - removes a leading UTF-8 byte order mark,
+//   - replaces each byte which is not part of a valid UTF-8 sequence with the
+//     Unicode replacement character U+FFFD,
+//   - escapes tabs, newlines and carriage returns which appear unescaped
+//     within strings, which JSON does not allow,
+//   - and removes other control characters (U+0000 to U+001F), whether
+//     unescaped or escaped as \u0000 to \u001F, which FHIR does not allow.
+//
+// The number of resources with each issue is counted by the
+// fhir-encoding-normalized-counter metric and logged when the pipeline is
+// finalized.
+func (p *Pipeline) SetEncodingNormalization(cfg *EncodingNormalizationConfig) {
+	p.encoding = &encodingNormalizer{cfg: cfg}
+}
+
+// encodingIssue is an issue found by normalizeEncoding, as recorded in the
+// Issue tag of encodingNormalizedCounter.
+type encodingIssue string
+
+const (
+	encodingIssueByteOrderMark    encodingIssue = "BYTE_ORDER_MARK"
+	encodingIssueInvalidUTF8      encodingIssue = "INVALID_UTF8"
+	encodingIssueControlCharacter encodingIssue = "CONTROL_CHARACTER"
+)
+
+var encodingIssues = []encodingIssue{encodingIssueByteOrderMark, encodingIssueInvalidUTF8, encodingIssueControlCharacter}
+
+// encodingNormalizer normalizes the encoding of resources for a Pipeline,
+// counting the resources with each issue.
+type encodingNormalizer struct {
+	cfg *EncodingNormalizationConfig
+
+	// mu guards counts, as resources may be normalized concurrently.
+	mu     sync.Mutex
+	counts map[encodingIssue]int
+}
+
+// normalize returns the normalized JSON of a resource. In strict mode, it
+// returns an error wrapping ErrInvalidEncoding if the JSON needed normalizing.
+func (en *encodingNormalizer) normalize(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, json []byte) ([]byte, error) {
+	normalized, issues := normalizeEncoding(json)
+	if len(issues) == 0 {
+		return json, nil
+	}
+	var found []string
+	for _, issue := range encodingIssues {
+		if !issues[issue] {
+			continue
+		}
+		en.count(issue)
+		found = append(found, string(issue))
+		if err := encodingNormalizedCounter.Record(ctx, 1, resourceType.String(), string(issue)); err != nil {
+			return nil, err
+		}
+	}
+	if en.cfg.Strict {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncoding, found)
+	}
+	return normalized, nil
+}
+
+func (en *encodingNormalizer) count(issue encodingIssue) {
+	en.mu.Lock()
+	defer en.mu.Unlock()
+	if en.counts == nil {
+		en.counts = map[encodingIssue]int{}
+	}
+	en.counts[issue]++
+}
+
+// logSummary logs the number of resources found with each issue, if any.
+func (en *encodingNormalizer) logSummary() {
+	en.mu.Lock()
+	defer en.mu.Unlock()
+	if len(en.counts) == 0 {
+		return
+	}
+	action := "Normalized"
+	if en.cfg.Strict {
+		action = "Rejected"
+	}
+	log.Warningf("%s resources with character encoding issues: %d with a byte order mark, %d with invalid UTF-8 and %d with control characters.",
+		action, en.counts[encodingIssueByteOrderMark], en.counts[encodingIssueInvalidUTF8], en.counts[encodingIssueControlCharacter])
+}
+
+var utf8ByteOrderMark = []byte("\xef\xbb\xbf")
+
+// needsNormalizing returns whether json may have an encoding issue, so that the
+// great majority of resources, which do not, can be passed through without
+// being copied.
+func needsNormalizing(json []byte) bool {
+	if bytes.HasPrefix(json, utf8ByteOrderMark) || bytes.Contains(json, []byte(`\u00`)) || !utf8.Valid(json) {
+		return true
+	}
+	for _, b := range json {
+		if b < 0x20 {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeEncoding returns the normalized JSON as described by
+// SetEncodingNormalization, along with the issues found. If there are none,
+// the JSON is returned unchanged.
+func normalizeEncoding(json []byte) ([]byte, map[encodingIssue]bool) {
+	if !needsNormalizing(json) {
+		return json, nil
+	}
+	issues := map[encodingIssue]bool{}
+	if bytes.HasPrefix(json, utf8ByteOrderMark) {
+		issues[encodingIssueByteOrderMark] = true
+		json = json[len(utf8ByteOrderMark):]
+	}
+	out := make([]byte, 0, len(json))
+	inString, escaped := false, false
+	for i := 0; i < len(json); {
+		b := json[i]
+		if b >= utf8.RuneSelf {
+			r, size := utf8.DecodeRune(json[i:])
+			if r == utf8.RuneError && size == 1 {
+				issues[encodingIssueInvalidUTF8] = true
+				out = utf8.AppendRune(out, utf8.RuneError)
+			} else {
+				out = append(out, json[i:i+size]...)
+			}
+			i += size
+			escaped = false
+			continue
+		}
+		i++
+		switch {
+		case escaped:
+			escaped = false
+			if b == 'u' && i+4 <= len(json) {
+				if v, err := strconv.ParseUint(string(json[i:i+4]), 16, 16); err == nil && v < 0x20 && v != '\t' && v != '\n' && v != '\r' {
+					// Drop the escape sequence, including the backslash already
+					// written.
+					issues[encodingIssueControlCharacter] = true
+					out = out[:len(out)-1]
+					i += 4
+					continue
+				}
+			}
+			out = append(out, b)
+		case b < 0x20:
+			switch {
+			case !inString && (b == '\t' || b == '\n' || b == '\r'):
+				// Whitespace between tokens is allowed.
+				out = append(out, b)
+			case inString && b == '\t':
+				issues[encodingIssueControlCharacter] = true
+				out = append(out, `\t`...)
+			case inString && b == '\n':
+				issues[encodingIssueControlCharacter] = true
+				out = append(out, `\n`...)
+			case inString && b == '\r':
+				issues[encodingIssueControlCharacter] = true
+				out = append(out, `\r`...)
+			default:
+				issues[encodingIssueControlCharacter] = true
+			}
+		case inString && b == '\\':
+			escaped = true
+			out = append(out, b)
+		case b == '"':
+			inString = !inString
+			out = append(out, b)
+		default:
+			out = append(out, b)
+		}
+	}
+	if len(issues) == 0 {
+		return json, nil
+	}
+	return out, issues
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestPipeline_EncodingNormalization(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "valid resource unchanged",
+			input: `{"resourceType":"Patient","id":"1","name":[{"family":"Müller"}]}`,
+			want:  `{"resourceType":"Patient","id":"1","name":[{"family":"Müller"}]}`,
+		},
+		{
+			name:  "byte order mark",
+			input: "\xef\xbb\xbf" + `{"resourceType":"Patient","id":"1"}`,
+			want:  `{"resourceType":"Patient","id":"1"}`,
+		},
+		{
+			name:  "invalid UTF-8",
+			input: `{"resourceType":"Patient","id":"1","name":[{"family":"M` + "\xfc" + `ller"}]}`,
+			want:  `{"resourceType":"Patient","id":"1","name":[{"family":"M` + "�" + `ller"}]}`,
+		},
+		{
+			name:  "unescaped whitespace in strings",
+			input: "{\"resourceType\":\"Patient\",\t\"id\":\"1\",\"name\":[{\"text\":\"Jane\tDoe\r\n\"}]}",
+			want:  "{\"resourceType\":\"Patient\",\t\"id\":\"1\",\"name\":[{\"text\":\"Jane\\tDoe\\r\\n\"}]}",
+		},
+		{
+			name:  "control characters",
+			input: `{"resourceType":"Patient","id":"1","name":[{"text":"Jane` + "\x00\x1b" + ` Doe\u0007é\\u0001"}]}`,
+			want:  `{"resourceType":"Patient","id":"1","name":[{"text":"Jane Doeé\\u0001"}]}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline(nil, []processing.Sink{ts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.SetEncodingNormalization(&processing.EncodingNormalizationConfig{})
+			if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(tc.input)); err != nil {
+				t.Fatalf("p.Process() returned unexpected error: %v", err)
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+			}
+			if len(ts.WrittenResources) != 1 {
+				t.Fatalf("pipeline wrote %d resources, want 1", len(ts.WrittenResources))
+			}
+			got, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(got), tc.want); diff != "" {
+				t.Errorf("pipeline wrote unexpected resource (-got +want): %s", diff)
+			}
+		})
+	}
+}
+
+func TestPipeline_EncodingNormalizationStrict(t *testing.T) {
+	const (
+		valid   = `{"resourceType":"Patient","id":"1"}`
+		invalid = `{"resourceType":"Patient","id":"2","gender":"fe` + "\xff" + `male"}`
+	)
+	ctx := context.Background()
+
+	t.Run("fails without isolation", func(t *testing.T) {
+		metrics.ResetAll()
+		ts := &processing.TestSink{}
+		p, err := processing.NewPipeline(nil, []processing.Sink{ts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.SetEncodingNormalization(&processing.EncodingNormalizationConfig{Strict: true})
+		if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(valid)); err != nil {
+			t.Fatalf("p.Process() returned unexpected error for a valid resource: %v", err)
+		}
+		if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(invalid)); !errors.Is(err, processing.ErrInvalidEncoding) {
+			t.Errorf("p.Process() returned error %v, want %v", err, processing.ErrInvalidEncoding)
+		}
+		if len(ts.WrittenResources) != 1 {
+			t.Errorf("pipeline wrote %d resources, want 1", len(ts.WrittenResources))
+		}
+	})
+
+	t.Run("dead letters with isolation", func(t *testing.T) {
+		metrics.ResetAll()
+		ts := &processing.TestSink{}
+		p, err := processing.NewPipeline(nil, []processing.Sink{ts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dls := &testDeadLetterSink{}
+		p.SetResourceIsolation(&processing.ResourceIsolationConfig{DeadLetterSink: dls})
+		p.SetEncodingNormalization(&processing.EncodingNormalizationConfig{Strict: true})
+		for _, r := range []string{valid, invalid} {
+			if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(r)); err != nil {
+				t.Fatalf("p.Process() returned unexpected error: %v", err)
+			}
+		}
+		if err := p.Finalize(ctx); err != nil {
+			t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+		}
+		if len(ts.WrittenResources) != 1 {
+			t.Errorf("pipeline wrote %d resources, want 1", len(ts.WrittenResources))
+		}
+		if len(dls.deadLetters) != 1 || !errors.Is(dls.deadLetters[0].Err, processing.ErrInvalidEncoding) || string(dls.deadLetters[0].JSON) != invalid {
+			t.Errorf("pipeline wrote dead letters %v, want the invalid resource", dls.deadLetters)
+		}
+	})
+}
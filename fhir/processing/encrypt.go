@@ -0,0 +1,335 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+var fhirFieldEncryptionCounter *metrics.Counter = metrics.NewCounter("fhir-field-encryption-counter", "Count of values in FHIR Resources which were encrypted. The counter is tagged by the FHIR Resource type ex) PATIENT.", "1", aggregation.Count, "FHIRResourceType")
+
+// EncryptedFieldPrefix starts each value encrypted by the field encryption
+// processor. It is followed by the data key wrapped by the KeyEncrypter, and
+// the AES-256-GCM nonce and ciphertext of the value, each base64url encoded
+// without padding and separated by a colon.
+const EncryptedFieldPrefix = "enc1:"
+
+// ErrNotEncryptedField is returned by FieldDecrypter.Decrypt for a value which
+// was not encrypted by the field encryption processor.
+var ErrNotEncryptedField = errors.New("value is not an encrypted field")
+
+// KeyEncrypter encrypts the data keys which encrypt fields, for example with a
+// Cloud KMS key.
+type KeyEncrypter interface {
+	Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
+}
+
+// KeyDecrypter decrypts data keys encrypted by a KeyEncrypter.
+type KeyDecrypter interface {
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// FieldEncryptionConfig configures the field encryption processor. At least
+// one of Paths, IdentifierSystems and ExtensionURLs must be set.
+type FieldEncryptionConfig struct {
+	// Key encrypts the data key, once per processor.
+	Key KeyEncrypter
+	// Paths are simple FHIRPath expressions such as Patient.name, naming the
+	// elements of a resource type to encrypt, as with DeidConfig.RedactPaths.
+	Paths []string
+	// IdentifierSystems are the systems of the identifiers whose values are
+	// encrypted, such as http://hl7.org/fhir/sid/us-ssn.
+	IdentifierSystems []string
+	// ExtensionURLs are the URLs of the extensions whose values are encrypted.
+	ExtensionURLs []string
+}
+
+type fieldEncryptionProcessor struct {
+	BaseProcessor
+	aead cipher.AEAD
+	// prefix is EncryptedFieldPrefix followed by the encoded wrapped data key.
+	prefix            string
+	paths             map[string][][]string
+	identifierSystems map[string]bool
+	extensionURLs     map[string]bool
+
+	resources, values atomic.Int64
+}
+
+// Assert fieldEncryptionProcessor satisfies the Processor interface.
+var _ Processor = &fieldEncryptionProcessor{}
+
+// NewFieldEncryptionProcessor creates a Processor which encrypts designated
+// values in place, so that only consumers able to decrypt with cfg.Key can
+// recover them, while the rest of each resource stays usable. The string
+// values within the elements named by cfg.Paths, and within the identifiers
+// and extensions selected by cfg.IdentifierSystems and cfg.ExtensionURLs, are
+// replaced by their encryption (see EncryptedFieldPrefix). Element ids, and
+// values such as dates and codes which could not hold an encrypted value and
+// stay valid FHIR, are left unchanged. Values which are already encrypted are
+// not encrypted again.
+//
+// Values are encrypted with a random data key generated for the processor,
+// which is encrypted by cfg.Key when the processor is created and stored
+// alongside each value. Use a FieldDecrypter to decrypt them.
+func NewFieldEncryptionProcessor(ctx context.Context, cfg FieldEncryptionConfig) (Processor, error) {
+	if len(cfg.Paths) == 0 && len(cfg.IdentifierSystems) == 0 && len(cfg.ExtensionURLs) == 0 {
+		return nil, errors.New("field encryption requires at least one path, identifier system or extension URL")
+	}
+	paths, err := parseElementPaths("encrypt", cfg.Paths)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("error generating field encryption key: %w", err)
+	}
+	aead, err := newFieldAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := cfg.Key.Encrypt(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting field encryption key: %w", err)
+	}
+	ep := &fieldEncryptionProcessor{
+		aead:              aead,
+		prefix:            EncryptedFieldPrefix + base64.RawURLEncoding.EncodeToString(wrapped) + ":",
+		paths:             paths,
+		identifierSystems: map[string]bool{},
+		extensionURLs:     map[string]bool{},
+	}
+	for _, s := range cfg.IdentifierSystems {
+		ep.identifierSystems[s] = true
+	}
+	for _, u := range cfg.ExtensionURLs {
+		ep.extensionURLs[u] = true
+	}
+	return ep, nil
+}
+
+func newFieldAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (ep *fieldEncryptionProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	m := cr.ProtoReflect()
+	field := m.WhichOneof(m.Descriptor().Oneofs().ByName("oneof_resource"))
+	if field == nil {
+		return errors.New("ContainedResource has no resource set")
+	}
+	r := m.Mutable(field).Message()
+
+	n := 0
+	encrypt := func(m protoreflect.Message) {
+		c, eerr := ep.encryptStrings(m)
+		n += c
+		err = errors.Join(err, eerr)
+	}
+	for _, key := range []string{"", string(r.Descriptor().Name())} {
+		for _, path := range ep.paths[key] {
+			visitElements(r, path, encrypt)
+		}
+	}
+	if len(ep.identifierSystems) > 0 || len(ep.extensionURLs) > 0 {
+		walkMessages(cr, func(_ string, m protoreflect.Message) {
+			switch v := m.Interface().(type) {
+			case *dpb.Identifier:
+				if ep.identifierSystems[v.GetSystem().GetValue()] && v.GetValue() != nil {
+					encrypt(v.GetValue().ProtoReflect())
+				}
+			case *dpb.Extension:
+				if ep.extensionURLs[v.GetUrl().GetValue()] && v.GetValue() != nil {
+					encrypt(v.GetValue().ProtoReflect())
+				}
+			}
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		ep.resources.Add(1)
+		ep.values.Add(int64(n))
+		if err := fhirFieldEncryptionCounter.Record(ctx, int64(n), resource.Type().String()); err != nil {
+			return err
+		}
+	}
+	return ep.Output(ctx, resource)
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (ep *fieldEncryptionProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (ep *fieldEncryptionProcessor) Finalize(ctx context.Context) error {
+	if n := ep.resources.Load(); n > 0 {
+		log.Infof("Encrypted %d values in %d resources.", ep.values.Load(), n)
+	}
+	return nil
+}
+
+// encryptStrings encrypts the non-empty string values within m, other than
+// element ids, returning the number encrypted.
+func (ep *fieldEncryptionProcessor) encryptStrings(m protoreflect.Message) (int, error) {
+	if s, ok := m.Interface().(*dpb.String); ok {
+		if s.GetValue() == "" || strings.HasPrefix(s.GetValue(), EncryptedFieldPrefix) {
+			return 0, nil
+		}
+		nonce := make([]byte, ep.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return 0, fmt.Errorf("error generating field encryption nonce: %w", err)
+		}
+		sealed := ep.aead.Seal(nonce, nonce, []byte(s.GetValue()), nil)
+		s.Value = ep.prefix + base64.RawURLEncoding.EncodeToString(sealed)
+		return 1, nil
+	}
+	n := 0
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Kind() != protoreflect.MessageKind || fd.IsMap() || fd.Name() == "id" {
+			return true
+		}
+		if !fd.IsList() {
+			c, eerr := ep.encryptStrings(v.Message())
+			n, err = n+c, eerr
+			return err == nil
+		}
+		for i := 0; i < v.List().Len() && err == nil; i++ {
+			var c int
+			c, err = ep.encryptStrings(v.List().Get(i).Message())
+			n += c
+		}
+		return err == nil
+	})
+	return n, err
+}
+
+// visitElements calls fn with each element at the path of FHIR JSON field names
+// in m.
+func visitElements(m protoreflect.Message, path []string, fn func(protoreflect.Message)) {
+	fd := m.Descriptor().Fields().ByJSONName(path[0])
+	if fd == nil || !m.Has(fd) || fd.Kind() != protoreflect.MessageKind {
+		return
+	}
+	var elements []protoreflect.Message
+	if fd.IsList() {
+		l := m.Mutable(fd).List()
+		for i := 0; i < l.Len(); i++ {
+			elements = append(elements, l.Get(i).Message())
+		}
+	} else {
+		elements = append(elements, m.Mutable(fd).Message())
+	}
+	for _, e := range elements {
+		if len(path) == 1 {
+			fn(e)
+		} else {
+			visitElements(e, path[1:], fn)
+		}
+	}
+}
+
+// FieldDecrypter decrypts values encrypted by the field encryption processor,
+// for consumers able to decrypt its data keys. Each data key is decrypted once
+// and cached. It is safe for concurrent use.
+type FieldDecrypter struct {
+	key KeyDecrypter
+
+	mu    sync.Mutex
+	aeads map[string]cipher.AEAD
+}
+
+// NewFieldDecrypter returns a FieldDecrypter which decrypts data keys with key.
+func NewFieldDecrypter(key KeyDecrypter) *FieldDecrypter {
+	return &FieldDecrypter{key: key, aeads: map[string]cipher.AEAD{}}
+}
+
+// Decrypt returns the original value of an encrypted value. It returns
+// ErrNotEncryptedField if the value was not encrypted.
+func (d *FieldDecrypter) Decrypt(ctx context.Context, value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, EncryptedFieldPrefix)
+	if !ok {
+		return "", ErrNotEncryptedField
+	}
+	wrapped, sealed, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", fmt.Errorf("%w: missing ciphertext", ErrNotEncryptedField)
+	}
+	aead, err := d.aead(ctx, wrapped)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("%w: invalid ciphertext", ErrNotEncryptedField)
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting field: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// aead returns the cipher of the encoded wrapped data key, decrypting the data
+// key if it has not been seen before.
+func (d *FieldDecrypter) aead(ctx context.Context, wrapped string) (cipher.AEAD, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if aead, ok := d.aeads[wrapped]; ok {
+		return aead, nil
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid data key", ErrNotEncryptedField)
+	}
+	dataKey, err := d.key.Decrypt(ctx, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting field encryption key: %w", err)
+	}
+	aead, err := newFieldAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	d.aeads[wrapped] = aead
+	return aead, nil
+}
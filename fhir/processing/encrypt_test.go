@@ -0,0 +1,172 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+const encryptPatient = `{"resourceType":"Patient","id":"p1","extension":[{"url":"http://example.com/ssn","valueString":"123-45-6789"}],"identifier":[{"system":"http://hl7.org/fhir/sid/us-ssn","value":"987-65-4321"},{"system":"mbi","value":"1S00E00AA00"}],"name":[{"id":"n1","use":"official","family":"Doe","given":["Jane"]}],"gender":"female","birthDate":"1950-06-15"}`
+
+// fakeKey "encrypts" data keys by prepending a marker, counting the calls.
+type fakeKey struct {
+	encryptCalls int
+}
+
+func (fk *fakeKey) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	fk.encryptCalls++
+	return append([]byte("wrapped:"), plaintext...), nil
+}
+
+func (fk *fakeKey) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	plaintext, ok := bytes.CutPrefix(ciphertext, []byte("wrapped:"))
+	if !ok {
+		return nil, errors.New("not wrapped by this key")
+	}
+	return plaintext, nil
+}
+
+func TestFieldEncryptionProcessor(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	key := &fakeKey{}
+	cfg := processing.FieldEncryptionConfig{
+		Key:               key,
+		Paths:             []string{"Patient.name"},
+		IdentifierSystems: []string{"http://hl7.org/fhir/sid/us-ssn"},
+		ExtensionURLs:     []string{"http://example.com/ssn"},
+	}
+	// Encrypting twice checks that encrypted values are not encrypted again.
+	var processors []processing.Processor
+	for i := 0; i < 2; i++ {
+		ep, err := processing.NewFieldEncryptionProcessor(ctx, cfg)
+		if err != nil {
+			t.Fatalf("NewFieldEncryptionProcessor() returned unexpected error: %v", err)
+		}
+		processors = append(processors, ep)
+	}
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline(processors, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(encryptPatient)); err != nil {
+			t.Fatalf("p.Process() returned unexpected error: %v", err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+	}
+	if key.encryptCalls != 2 {
+		t.Errorf("data keys were encrypted %d times, want once per processor", key.encryptCalls)
+	}
+
+	var encrypted []string
+	for _, r := range ts.WrittenResources {
+		data, err := r.JSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var patient struct {
+			Extension []struct {
+				ValueString string `json:"valueString"`
+			} `json:"extension"`
+			Identifier []struct {
+				Value string `json:"value"`
+			} `json:"identifier"`
+			Name []struct {
+				ID     string   `json:"id"`
+				Use    string   `json:"use"`
+				Family string   `json:"family"`
+				Given  []string `json:"given"`
+			} `json:"name"`
+			Gender    string `json:"gender"`
+			BirthDate string `json:"birthDate"`
+		}
+		if err := json.Unmarshal(data, &patient); err != nil {
+			t.Fatal(err)
+		}
+		encrypted = append(encrypted, patient.Extension[0].ValueString, patient.Identifier[0].Value, patient.Name[0].Family, patient.Name[0].Given[0])
+		if patient.Identifier[1].Value != "1S00E00AA00" {
+			t.Errorf("identifier of another system = %q, want it unchanged", patient.Identifier[1].Value)
+		}
+		if patient.Name[0].ID != "n1" || patient.Name[0].Use != "official" {
+			t.Errorf("name id and use = %q, %q, want them unchanged", patient.Name[0].ID, patient.Name[0].Use)
+		}
+		if patient.Gender != "female" || patient.BirthDate != "1950-06-15" {
+			t.Errorf("gender and birthDate = %q, %q, want them unchanged", patient.Gender, patient.BirthDate)
+		}
+	}
+
+	d := processing.NewFieldDecrypter(key)
+	var got []string
+	for _, v := range encrypted {
+		if !strings.HasPrefix(v, processing.EncryptedFieldPrefix) {
+			t.Errorf("value %q is not encrypted", v)
+			continue
+		}
+		plaintext, err := d.Decrypt(ctx, v)
+		if err != nil {
+			t.Fatalf("Decrypt(%q) returned unexpected error: %v", v, err)
+		}
+		got = append(got, plaintext)
+	}
+	want := []string{"123-45-6789", "987-65-4321", "Doe", "Jane", "123-45-6789", "987-65-4321", "Doe", "Jane"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("decrypted values differ from the originals (-want +got):\n%s", diff)
+	}
+	if encrypted[0] == encrypted[4] {
+		t.Errorf("the same value was encrypted to the same ciphertext twice, want a random nonce")
+	}
+}
+
+func TestFieldEncryptionProcessor_InvalidConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  processing.FieldEncryptionConfig
+	}{
+		{name: "nothing to encrypt", cfg: processing.FieldEncryptionConfig{Key: &fakeKey{}}},
+		{name: "unknown element", cfg: processing.FieldEncryptionConfig{Key: &fakeKey{}, Paths: []string{"Patient.ssn"}}},
+		{name: "unknown resource type", cfg: processing.FieldEncryptionConfig{Key: &fakeKey{}, Paths: []string{"Patiently.name"}}},
+	}
+	for _, tc := range cases {
+		if _, err := processing.NewFieldEncryptionProcessor(context.Background(), tc.cfg); err == nil {
+			t.Errorf("NewFieldEncryptionProcessor() with %s returned nil error, want an error", tc.name)
+		}
+	}
+}
+
+func TestFieldDecrypter_Errors(t *testing.T) {
+	ctx := context.Background()
+	d := processing.NewFieldDecrypter(&fakeKey{})
+	if _, err := d.Decrypt(ctx, "Doe"); !errors.Is(err, processing.ErrNotEncryptedField) {
+		t.Errorf("Decrypt() of a plain value returned error %v, want %v", err, processing.ErrNotEncryptedField)
+	}
+	if _, err := d.Decrypt(ctx, processing.EncryptedFieldPrefix+"bm90LXdyYXBwZWQ:AAAA"); err == nil {
+		t.Errorf("Decrypt() of a value with a foreign data key returned nil error, want an error")
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+)
+
+var enrichmentCounter *metrics.Counter = metrics.NewCounter("fhir-enrichment-counter", "Count of FHIR Resources passed to each enricher, by result: ENRICHED, UNCHANGED or LOOKUP_FAILED.", "1", aggregation.Count, "Enricher", "Result")
+
+// ErrEnrichmentLookup is returned (wrapped) by an Enricher when its external
+// lookup service fails. The enrichment processor passes the resource on
+// unenriched in this case, rather than failing the fetch.
+var ErrEnrichmentLookup = errors.New("enrichment lookup failed")
+
+// maxCachedLookups is the maximum number of results held by the cache of each
+// enricher. Once it is full, the cache is cleared.
+const maxCachedLookups = 100000
+
+// Enricher augments resources with data from an external lookup service.
+type Enricher interface {
+	// Name identifies the Enricher in logs and metrics.
+	Name() string
+	// Enrich modifies the resource in place, and returns whether it was
+	// changed. Resources the Enricher does not apply to are left unchanged.
+	Enrich(ctx context.Context, resource ResourceWrapper) (bool, error)
+}
+
+type enrichmentProcessor struct {
+	BaseProcessor
+	enrichers []Enricher
+}
+
+// Assert enrichmentProcessor satisfies the Processor interface.
+var _ Processor = &enrichmentProcessor{}
+
+// NewEnrichmentProcessor creates a Processor which passes each resource to the
+// given enrichers in order, such as those returned by NewNPIEnricher and
+// NewZIPEnricher, so that the resources are augmented before they reach the
+// sinks. If the lookup service of an enricher fails, a warning is logged and
+// the resource is passed on without that enrichment.
+func NewEnrichmentProcessor(enrichers ...Enricher) Processor {
+	return &enrichmentProcessor{enrichers: enrichers}
+}
+
+func (ep *enrichmentProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	for _, e := range ep.enrichers {
+		changed, err := e.Enrich(ctx, resource)
+		result := "UNCHANGED"
+		switch {
+		case errors.Is(err, ErrEnrichmentLookup):
+			log.Warningf("%s enrichment of %s resource from %s skipped: %v", e.Name(), resource.Type(), resource.SourceURL(), err)
+			result = "LOOKUP_FAILED"
+		case err != nil:
+			return err
+		case changed:
+			result = "ENRICHED"
+		}
+		if err := enrichmentCounter.Record(ctx, 1, e.Name(), result); err != nil {
+			return err
+		}
+	}
+	return ep.Output(ctx, resource)
+}
+
+// lookupCache caches the results of an enricher's lookups by key, including
+// keys which were not found, which have a nil result. Lookups which fail are
+// not cached, so that they are tried again for the next resource.
+type lookupCache[V any] struct {
+	lookup func(ctx context.Context, key string) (*V, error)
+
+	mu      sync.Mutex
+	results map[string]*V
+}
+
+func newLookupCache[V any](lookup func(ctx context.Context, key string) (*V, error)) *lookupCache[V] {
+	return &lookupCache[V]{lookup: lookup, results: map[string]*V{}}
+}
+
+func (lc *lookupCache[V]) get(ctx context.Context, key string) (*V, error) {
+	lc.mu.Lock()
+	v, ok := lc.results[key]
+	lc.mu.Unlock()
+	if ok {
+		return v, nil
+	}
+	v, err := lc.lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if len(lc.results) >= maxCachedLookups {
+		lc.results = map[string]*V{}
+	}
+	lc.results[key] = v
+	return v, nil
+}
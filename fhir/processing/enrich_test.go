@@ -0,0 +1,246 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// processEnriched passes each of the resources through a pipeline with the
+// given enrichers, and returns the JSON written.
+func processEnriched(t *testing.T, enrichers []processing.Enricher, resourceType cpb.ResourceTypeCode_Value, jsonIn []string) [][]byte {
+	t.Helper()
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{processing.NewEnrichmentProcessor(enrichers...)}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	for _, j := range jsonIn {
+		if err := p.Process(context.Background(), resourceType, "", []byte(j)); err != nil {
+			t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", j, err)
+		}
+	}
+	var got [][]byte
+	for _, r := range ts.WrittenResources {
+		j, err := r.JSON()
+		if err != nil {
+			t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+		}
+		got = append(got, testhelpers.NormalizeJSON(t, j))
+	}
+	return got
+}
+
+func normalizeAll(t *testing.T, jsons []string) [][]byte {
+	t.Helper()
+	var out [][]byte
+	for _, j := range jsons {
+		out = append(out, testhelpers.NormalizeJSON(t, []byte(j)))
+	}
+	return out
+}
+
+func TestNPIEnricher(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if got := req.URL.Query().Get("version"); got != "2.1" {
+			t.Errorf("NPI registry request has version %q, want 2.1", got)
+		}
+		switch req.URL.Query().Get("number") {
+		case "1234567893":
+			w.Write([]byte(`{"result_count":1,"results":[{"number":1234567893,"taxonomies":[{"code":"363L00000X","desc":"Nurse Practitioner","primary":false},{"code":"207Q00000X","desc":"Family Medicine","primary":true}]}]}`))
+		case "1245319599":
+			w.Write([]byte(`{"result_count":1,"results":[{"number":1245319599,"taxonomies":[{"code":"282N00000X","desc":"General Acute Care Hospital","primary":true}]}]}`))
+		case "5555555555":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"result_count":0,"results":[]}`))
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		jsonIn       []string
+		wantJSON     []string
+		wantRequests int32
+	}{
+		{
+			name:         "practitioner",
+			resourceType: cpb.ResourceTypeCode_PRACTITIONER,
+			jsonIn:       []string{`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1234567893"}]}`},
+			wantJSON:     []string{`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1234567893"}],"qualification":[{"code":{"coding":[{"system":"http://nucc.org/provider-taxonomy","code":"207Q00000X","display":"Family Medicine"}]}}]}`},
+			wantRequests: 1,
+		},
+		{
+			name:         "organization",
+			resourceType: cpb.ResourceTypeCode_ORGANIZATION,
+			jsonIn:       []string{`{"resourceType":"Organization","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1245319599"}]}`},
+			wantJSON:     []string{`{"resourceType":"Organization","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1245319599"}],"type":[{"coding":[{"system":"http://nucc.org/provider-taxonomy","code":"282N00000X","display":"General Acute Care Hospital"}]}]}`},
+			wantRequests: 1,
+		},
+		{
+			name:         "lookups are cached",
+			resourceType: cpb.ResourceTypeCode_PRACTITIONER,
+			jsonIn: []string{
+				`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1234567893"}]}`,
+				`{"resourceType":"Practitioner","id":"2","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1234567893"}]}`,
+			},
+			wantJSON: []string{
+				`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1234567893"}],"qualification":[{"code":{"coding":[{"system":"http://nucc.org/provider-taxonomy","code":"207Q00000X","display":"Family Medicine"}]}}]}`,
+				`{"resourceType":"Practitioner","id":"2","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1234567893"}],"qualification":[{"code":{"coding":[{"system":"http://nucc.org/provider-taxonomy","code":"207Q00000X","display":"Family Medicine"}]}}]}`,
+			},
+			wantRequests: 1,
+		},
+		{
+			name:         "existing taxonomy is not repeated",
+			resourceType: cpb.ResourceTypeCode_PRACTITIONER,
+			jsonIn:       []string{`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1234567893"}],"qualification":[{"code":{"coding":[{"system":"http://nucc.org/provider-taxonomy","code":"207Q00000X"}]}}]}`},
+			wantJSON:     []string{`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1234567893"}],"qualification":[{"code":{"coding":[{"system":"http://nucc.org/provider-taxonomy","code":"207Q00000X"}]}}]}`},
+			wantRequests: 1,
+		},
+		{
+			name:         "unknown NPI",
+			resourceType: cpb.ResourceTypeCode_PRACTITIONER,
+			jsonIn:       []string{`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1111111111"}]}`},
+			wantJSON:     []string{`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1111111111"}]}`},
+			wantRequests: 1,
+		},
+		{
+			name:         "failed lookups are passed on unchanged and not cached",
+			resourceType: cpb.ResourceTypeCode_PRACTITIONER,
+			jsonIn: []string{
+				`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"5555555555"}]}`,
+				`{"resourceType":"Practitioner","id":"2","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"5555555555"}]}`,
+			},
+			wantJSON: []string{
+				`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"5555555555"}]}`,
+				`{"resourceType":"Practitioner","id":"2","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"5555555555"}]}`,
+			},
+			wantRequests: 2,
+		},
+		{
+			name:         "no NPI",
+			resourceType: cpb.ResourceTypeCode_PRACTITIONER,
+			jsonIn:       []string{`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"other","value":"1234567893"}]}`},
+			wantJSON:     []string{`{"resourceType":"Practitioner","id":"1","identifier":[{"system":"other","value":"1234567893"}]}`},
+		},
+		{
+			name:         "other resource types are ignored",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       []string{`{"resourceType":"Patient","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1234567893"}]}`},
+			wantJSON:     []string{`{"resourceType":"Patient","id":"1","identifier":[{"system":"http://hl7.org/fhir/sid/us-npi","value":"1234567893"}]}`},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			requests.Store(0)
+			enricher := processing.NewNPIEnricher(processing.NewNPIRegistryLookup(server.URL+"/api/", server.Client()))
+			got := processEnriched(t, []processing.Enricher{enricher}, tc.resourceType, tc.jsonIn)
+			if diff := cmp.Diff(normalizeAll(t, tc.wantJSON), got); diff != "" {
+				t.Errorf("enrichment produced unexpected output (-want +got):\n%s", diff)
+			}
+			if got := requests.Load(); got != tc.wantRequests {
+				t.Errorf("enrichment made %d NPI registry requests, want %d", got, tc.wantRequests)
+			}
+		})
+	}
+}
+
+func TestZIPEnricher(t *testing.T) {
+	zipFile := filepath.Join(t.TempDir(), "zip.csv")
+	csv := "county_name,zip,county_fips,svi,state\n" +
+		"Travis,78701,48453,0.5412,TX\n" +
+		"Williamson,78701,48491,0.2,TX\n" +
+		"Cook,60601,17031,,IL\n"
+	if err := os.WriteFile(zipFile, []byte(csv), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", zipFile, err)
+	}
+	lookup, err := processing.NewCSVZIPLookup(zipFile)
+	if err != nil {
+		t.Fatalf("NewCSVZIPLookup(%s) returned unexpected error: %v", zipFile, err)
+	}
+
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		jsonIn       string
+		wantJSON     string
+	}{
+		{
+			name:         "patient address",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"1","address":[{"city":"Austin","postalCode":"78701-1234"}]}`,
+			wantJSON:     `{"resourceType":"Patient","id":"1","address":[{"city":"Austin","district":"Travis","postalCode":"78701-1234","extension":[{"url":"https://github.com/google/bulk_fhir_tools/StructureDefinition/county-fips","valueCode":"48453"},{"url":"https://github.com/google/bulk_fhir_tools/StructureDefinition/svi","valueDecimal":0.5412}]}]}`,
+		},
+		{
+			name:         "nested address without SVI",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"1","contact":[{"address":{"postalCode":"60601","district":"Cook County"}}]}`,
+			wantJSON:     `{"resourceType":"Patient","id":"1","contact":[{"address":{"postalCode":"60601","district":"Cook County","extension":[{"url":"https://github.com/google/bulk_fhir_tools/StructureDefinition/county-fips","valueCode":"17031"}]}}]}`,
+		},
+		{
+			name:         "already enriched",
+			resourceType: cpb.ResourceTypeCode_ORGANIZATION,
+			jsonIn:       `{"resourceType":"Organization","id":"1","address":[{"postalCode":"78701","extension":[{"url":"https://github.com/google/bulk_fhir_tools/StructureDefinition/county-fips","valueCode":"48453"}]}]}`,
+			wantJSON:     `{"resourceType":"Organization","id":"1","address":[{"postalCode":"78701","extension":[{"url":"https://github.com/google/bulk_fhir_tools/StructureDefinition/county-fips","valueCode":"48453"}]}]}`,
+		},
+		{
+			name:         "unknown and non-US ZIP codes",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"1","address":[{"postalCode":"99999"},{"postalCode":"78701","country":"CA"},{"postalCode":"K1A 0B1"}]}`,
+			wantJSON:     `{"resourceType":"Patient","id":"1","address":[{"postalCode":"99999"},{"postalCode":"78701","country":"CA"},{"postalCode":"K1A 0B1"}]}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := processEnriched(t, []processing.Enricher{processing.NewZIPEnricher(lookup)}, tc.resourceType, []string{tc.jsonIn})
+			if diff := cmp.Diff(normalizeAll(t, []string{tc.wantJSON}), got); diff != "" {
+				t.Errorf("enrichment produced unexpected output (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewCSVZIPLookup_Invalid(t *testing.T) {
+	for name, csv := range map[string]string{
+		"missing column": "zip,county_name\n78701,Travis\n",
+		"invalid svi":    "zip,county_fips,county_name,svi\n78701,48453,Travis,high\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			zipFile := filepath.Join(t.TempDir(), "zip.csv")
+			if err := os.WriteFile(zipFile, []byte(csv), 0644); err != nil {
+				t.Fatalf("failed to write %s: %v", zipFile, err)
+			}
+			if _, err := processing.NewCSVZIPLookup(zipFile); err == nil {
+				t.Errorf("NewCSVZIPLookup(%s) succeeded, want error", zipFile)
+			}
+		})
+	}
+}
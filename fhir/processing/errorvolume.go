@@ -0,0 +1,226 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// ErrErrorVolumeExceeded is returned (wrapped) by Pipeline.Process and
+// Pipeline.Finalize when the volume of dead letters or upload errors exceeds a
+// threshold of the pipeline's ErrorVolumeConfig, and FailOnExceeded is set.
+var ErrErrorVolumeExceeded = errors.New("error volume threshold exceeded")
+
+// ErrorVolumeKind is the kind of error counted against an ErrorVolumeThreshold.
+type ErrorVolumeKind string
+
+const (
+	// ErrorVolumeDeadLetters counts resources routed to the dead letter sink
+	// (see SetResourceIsolation).
+	ErrorVolumeDeadLetters ErrorVolumeKind = "dead_letters"
+	// ErrorVolumeUploadErrors counts resources which sinks implementing
+	// UploadErrorCounter failed to store.
+	ErrorVolumeUploadErrors ErrorVolumeKind = "upload_errors"
+)
+
+// ErrorVolumeThreshold bounds the number of errors of one kind in a run.
+type ErrorVolumeThreshold struct {
+	// Max is the number of errors above which the threshold is exceeded. If
+	// negative, there is no absolute limit.
+	Max int64 `json:"max"`
+	// MaxPercent is the percentage of the resources processed by the pipeline
+	// above which the threshold is exceeded. If negative, there is no
+	// percentage limit.
+	MaxPercent float64 `json:"max_percent"`
+}
+
+// NoErrorVolumeThreshold is an ErrorVolumeThreshold which is never exceeded.
+var NoErrorVolumeThreshold = ErrorVolumeThreshold{Max: -1, MaxPercent: -1}
+
+// ErrorVolumeConfig configures the limits on the volume of errors in a run, so
+// that a systemic problem, such as every resource of a type failing to upload,
+// is surfaced straight away rather than days later.
+type ErrorVolumeConfig struct {
+	DeadLetters  ErrorVolumeThreshold
+	UploadErrors ErrorVolumeThreshold
+	// MinResources is the number of resources which must have been processed
+	// before percentage thresholds are checked while the run is in progress, so
+	// that a few early errors do not exceed them. They are always checked when
+	// the pipeline is finalized.
+	MinResources int64
+	// If true, Process and Finalize return an error wrapping
+	// ErrErrorVolumeExceeded once a threshold is exceeded. Otherwise a warning
+	// is logged.
+	FailOnExceeded bool
+	// Alert, if set, is called once for each threshold exceeded, for example
+	// to call a webhook. Errors returned by Alert are logged, and do not fail
+	// the run.
+	Alert func(ctx context.Context, alert *ErrorVolumeAlert) error
+}
+
+// ErrorVolumeAlert describes an exceeded ErrorVolumeThreshold.
+type ErrorVolumeAlert struct {
+	Kind ErrorVolumeKind `json:"kind"`
+	// Errors is the number of errors of Kind when the threshold was exceeded.
+	Errors int64 `json:"errors"`
+	// Resources is the number of resources processed by the pipeline when the
+	// threshold was exceeded.
+	Resources int64                `json:"resources"`
+	Threshold ErrorVolumeThreshold `json:"threshold"`
+}
+
+// Percent returns Errors as a percentage of Resources.
+func (a *ErrorVolumeAlert) Percent() float64 {
+	if a.Resources == 0 {
+		return 0
+	}
+	return 100 * float64(a.Errors) / float64(a.Resources)
+}
+
+func (a *ErrorVolumeAlert) String() string {
+	return fmt.Sprintf("%d %s in %d resources (%.2f%%) exceeds the threshold of %s", a.Errors, a.Kind, a.Resources, a.Percent(), a.Threshold)
+}
+
+func (t ErrorVolumeThreshold) String() string {
+	switch {
+	case t.Max >= 0 && t.MaxPercent >= 0:
+		return fmt.Sprintf("%d or %.2f%%", t.Max, t.MaxPercent)
+	case t.Max >= 0:
+		return fmt.Sprintf("%d", t.Max)
+	case t.MaxPercent >= 0:
+		return fmt.Sprintf("%.2f%%", t.MaxPercent)
+	default:
+		return "none"
+	}
+}
+
+// exceeded returns whether n errors out of resources exceeds the threshold.
+// Percentages are only compared if checkPercent is true.
+func (t ErrorVolumeThreshold) exceeded(n, resources int64, checkPercent bool) bool {
+	if t.Max >= 0 && n > t.Max {
+		return true
+	}
+	return checkPercent && t.MaxPercent >= 0 && resources > 0 && 100*float64(n)/float64(resources) > t.MaxPercent
+}
+
+// UploadErrorCounter is implemented by Sinks which may fail to store some
+// resources without failing the run, such as when NoFailOnUploadErrors is set.
+type UploadErrorCounter interface {
+	// UploadErrors returns the number of resources which could not be stored
+	// so far. It must be safe to call concurrently with Write.
+	UploadErrors() int64
+}
+
+// UploadErrors is UploadErrorCounter.UploadErrors, returning the upload errors
+// of the wrapped sink, or zero if it does not implement UploadErrorCounter.
+func (bcs *ByteCountingSink) UploadErrors() int64 {
+	if c, ok := bcs.Sink.(UploadErrorCounter); ok {
+		return c.UploadErrors()
+	}
+	return 0
+}
+
+// errorVolumeMonitor counts the resources and errors of a pipeline, and checks
+// them against the thresholds of an ErrorVolumeConfig.
+type errorVolumeMonitor struct {
+	cfg   *ErrorVolumeConfig
+	sinks []Sink
+
+	resources   atomic.Int64
+	deadLetters atomic.Int64
+
+	// mu must be held when accessing alerted.
+	mu sync.Mutex
+	// alerted records the kinds of error whose threshold has been exceeded, so
+	// that each is only reported once.
+	alerted map[ErrorVolumeKind]*ErrorVolumeAlert
+}
+
+// SetErrorVolumeLimits enables checking the volume of dead letters and upload
+// errors against the given thresholds. Thresholds are checked as each resource
+// is processed, and again once the sinks have been finalized, when all upload
+// errors are known.
+func (p *Pipeline) SetErrorVolumeLimits(cfg *ErrorVolumeConfig) {
+	p.errorVolume = &errorVolumeMonitor{
+		cfg:     cfg,
+		sinks:   p.sinks,
+		alerted: map[ErrorVolumeKind]*ErrorVolumeAlert{},
+	}
+}
+
+// uploadErrors returns the total upload errors of the sinks.
+func (m *errorVolumeMonitor) uploadErrors() int64 {
+	var n int64
+	for _, s := range m.sinks {
+		if c, ok := s.(UploadErrorCounter); ok {
+			n += c.UploadErrors()
+		}
+	}
+	return n
+}
+
+// check compares the error volumes with the thresholds, alerting on any newly
+// exceeded. If final is false, percentage thresholds are only checked once
+// MinResources have been processed. It returns an error wrapping
+// ErrErrorVolumeExceeded if a threshold has been exceeded and FailOnExceeded is
+// set.
+func (m *errorVolumeMonitor) check(ctx context.Context, final bool) error {
+	resources := m.resources.Load()
+	checkPercent := final || resources >= m.cfg.MinResources
+
+	m.mu.Lock()
+	var alerts []*ErrorVolumeAlert
+	for _, c := range []struct {
+		kind      ErrorVolumeKind
+		count     int64
+		threshold ErrorVolumeThreshold
+	}{
+		{ErrorVolumeDeadLetters, m.deadLetters.Load(), m.cfg.DeadLetters},
+		{ErrorVolumeUploadErrors, m.uploadErrors(), m.cfg.UploadErrors},
+	} {
+		if m.alerted[c.kind] != nil || !c.threshold.exceeded(c.count, resources, checkPercent) {
+			continue
+		}
+		alert := &ErrorVolumeAlert{Kind: c.kind, Errors: c.count, Resources: resources, Threshold: c.threshold}
+		m.alerted[c.kind] = alert
+		alerts = append(alerts, alert)
+	}
+	var exceeded []*ErrorVolumeAlert
+	for _, kind := range []ErrorVolumeKind{ErrorVolumeDeadLetters, ErrorVolumeUploadErrors} {
+		if a := m.alerted[kind]; a != nil {
+			exceeded = append(exceeded, a)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, a := range alerts {
+		log.Warningf("Error volume threshold exceeded: %s", a)
+		if m.cfg.Alert != nil {
+			if err := m.cfg.Alert(ctx, a); err != nil {
+				log.Errorf("failed to send error volume alert: %v", err)
+			}
+		}
+	}
+	if len(exceeded) > 0 && m.cfg.FailOnExceeded {
+		return fmt.Errorf("%w: %s", ErrErrorVolumeExceeded, exceeded[0])
+	}
+	return nil
+}
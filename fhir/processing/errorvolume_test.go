@@ -0,0 +1,166 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// failingUploadSink counts every Patient with the ID "fail" as an upload error.
+type failingUploadSink struct {
+	processing.TestSink
+	failed int64
+}
+
+func (fs *failingUploadSink) Write(ctx context.Context, resource processing.ResourceWrapper) error {
+	proto, err := resource.Proto()
+	if err != nil && !errors.Is(err, processing.ErrorDoNotModifyProto) {
+		return err
+	}
+	if proto.GetPatient().GetId().GetValue() == "fail" {
+		fs.failed++
+		return nil
+	}
+	return fs.TestSink.Write(ctx, resource)
+}
+
+func (fs *failingUploadSink) UploadErrors() int64 {
+	return fs.failed
+}
+
+func TestPipeline_ErrorVolumeLimits(t *testing.T) {
+	const (
+		ok   = `{"resourceType":"Patient","id":"ok"}`
+		bad  = `{"resourceType":"Patient","id":`
+		fail = `{"resourceType":"Patient","id":"fail"}`
+	)
+	cases := []struct {
+		name            string
+		resources       []string
+		cfg             processing.ErrorVolumeConfig
+		wantProcessErr  bool
+		wantFinalizeErr bool
+		wantAlerts      []processing.ErrorVolumeKind
+	}{
+		{
+			name:      "within thresholds",
+			resources: []string{ok, bad, ok, fail},
+			cfg: processing.ErrorVolumeConfig{
+				DeadLetters:    processing.ErrorVolumeThreshold{Max: 1, MaxPercent: 50},
+				UploadErrors:   processing.ErrorVolumeThreshold{Max: 1, MaxPercent: 50},
+				FailOnExceeded: true,
+			},
+		},
+		{
+			name:      "absolute dead letter threshold fails the run while processing",
+			resources: []string{bad, bad},
+			cfg: processing.ErrorVolumeConfig{
+				DeadLetters:    processing.ErrorVolumeThreshold{Max: 1, MaxPercent: -1},
+				UploadErrors:   processing.NoErrorVolumeThreshold,
+				FailOnExceeded: true,
+			},
+			wantProcessErr:  true,
+			wantFinalizeErr: true,
+			wantAlerts:      []processing.ErrorVolumeKind{processing.ErrorVolumeDeadLetters},
+		},
+		{
+			name:      "percentage upload error threshold checked on finalize",
+			resources: []string{fail, ok, ok},
+			cfg: processing.ErrorVolumeConfig{
+				DeadLetters:    processing.NoErrorVolumeThreshold,
+				UploadErrors:   processing.ErrorVolumeThreshold{Max: -1, MaxPercent: 10},
+				MinResources:   100,
+				FailOnExceeded: true,
+			},
+			wantFinalizeErr: true,
+			wantAlerts:      []processing.ErrorVolumeKind{processing.ErrorVolumeUploadErrors},
+		},
+		{
+			name:      "percentage threshold checked while processing after min resources",
+			resources: []string{fail, ok, ok},
+			cfg: processing.ErrorVolumeConfig{
+				DeadLetters:    processing.NoErrorVolumeThreshold,
+				UploadErrors:   processing.ErrorVolumeThreshold{Max: -1, MaxPercent: 10},
+				MinResources:   1,
+				FailOnExceeded: true,
+			},
+			wantProcessErr:  true,
+			wantFinalizeErr: true,
+			wantAlerts:      []processing.ErrorVolumeKind{processing.ErrorVolumeUploadErrors},
+		},
+		{
+			name:      "warn only",
+			resources: []string{bad, fail, bad, fail},
+			cfg: processing.ErrorVolumeConfig{
+				DeadLetters:  processing.ErrorVolumeThreshold{Max: 0, MaxPercent: -1},
+				UploadErrors: processing.ErrorVolumeThreshold{Max: 0, MaxPercent: -1},
+			},
+			wantAlerts: []processing.ErrorVolumeKind{processing.ErrorVolumeDeadLetters, processing.ErrorVolumeUploadErrors},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			sink := &failingUploadSink{}
+			p, err := processing.NewPipeline(nil, []processing.Sink{processing.NewByteCountingSink(sink)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.SetResourceIsolation(&processing.ResourceIsolationConfig{})
+			var gotAlerts []processing.ErrorVolumeKind
+			tc.cfg.Alert = func(ctx context.Context, alert *processing.ErrorVolumeAlert) error {
+				gotAlerts = append(gotAlerts, alert.Kind)
+				return errors.New("alert errors are only logged")
+			}
+			p.SetErrorVolumeLimits(&tc.cfg)
+
+			var processErr error
+			for _, r := range tc.resources {
+				if processErr = p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(r)); processErr != nil {
+					break
+				}
+			}
+			if (processErr != nil) != tc.wantProcessErr {
+				t.Errorf("p.Process() returned error %v, want error: %v", processErr, tc.wantProcessErr)
+			}
+			if processErr != nil && !errors.Is(processErr, processing.ErrErrorVolumeExceeded) {
+				t.Errorf("p.Process() returned error %v, want %v", processErr, processing.ErrErrorVolumeExceeded)
+			}
+			finalizeErr := p.Finalize(ctx)
+			if (finalizeErr != nil) != tc.wantFinalizeErr {
+				t.Errorf("p.Finalize() returned error %v, want error: %v", finalizeErr, tc.wantFinalizeErr)
+			}
+			if finalizeErr != nil && !errors.Is(finalizeErr, processing.ErrErrorVolumeExceeded) {
+				t.Errorf("p.Finalize() returned error %v, want %v", finalizeErr, processing.ErrErrorVolumeExceeded)
+			}
+			if len(gotAlerts) != len(tc.wantAlerts) {
+				t.Fatalf("got alerts %v, want %v", gotAlerts, tc.wantAlerts)
+			}
+			for i := range gotAlerts {
+				if gotAlerts[i] != tc.wantAlerts[i] {
+					t.Errorf("got alerts %v, want %v", gotAlerts, tc.wantAlerts)
+				}
+			}
+		})
+	}
+}
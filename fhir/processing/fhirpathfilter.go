@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/internal/fhirpath"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var fhirPathFilterDroppedCounter *metrics.Counter = metrics.NewCounter("fhir-fhirpath-filter-dropped-counter", "Count of FHIR Resources which were dropped because they did not match any FHIRPath filter for their type. The counter is tagged by the FHIR Resource type ex) CLAIM.", "1", aggregation.Count, "FHIRResourceType")
+
+type fhirPathFilterProcessor struct {
+	BaseProcessor
+	filters         map[cpb.ResourceTypeCode_Value][]*fhirpath.Expression
+	dropped, errors atomic.Int64
+}
+
+// Assert fhirPathFilterProcessor satisfies the Processor interface.
+var _ Processor = &fhirPathFilterProcessor{}
+
+// NewFHIRPathFilterProcessor creates a Processor which drops resources that do
+// not match any of the FHIRPath expressions given for their resource type, for
+// filtering resources client-side when the server does not support _typeFilter.
+//
+// Each expression must start with the resource type it applies to, e.g.
+// Claim.where(billablePeriod.start >= @2022-01-01), and may use the subset of
+// FHIRPath described in the fhirpath package. A resource matches an expression
+// if the result is non-empty and not false. As with _typeFilter, a resource
+// is kept if it matches any of the expressions for its type, and resources of
+// types without an expression are always kept. Resources for which an
+// expression cannot be evaluated, such as when comparing a repeated element,
+// are logged and kept.
+func NewFHIRPathFilterProcessor(expressions []string) (Processor, error) {
+	fp := &fhirPathFilterProcessor{filters: map[cpb.ResourceTypeCode_Value][]*fhirpath.Expression{}}
+	for _, src := range expressions {
+		e, err := fhirpath.Parse(strings.TrimSpace(src))
+		if err != nil {
+			return nil, err
+		}
+		name := e.ResourceType()
+		if name == "" {
+			return nil, fmt.Errorf("invalid FHIRPath filter %q, must start with a resource type, e.g. Claim.where(billablePeriod.start >= @2022-01-01)", src)
+		}
+		rt, err := bulkfhir.ResourceTypeCodeFromName(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FHIRPath filter %q: %w", src, err)
+		}
+		fp.filters[rt] = append(fp.filters[rt], e)
+	}
+	return fp, nil
+}
+
+func (fp *fhirPathFilterProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	filters, ok := fp.filters[resource.Type()]
+	if !ok {
+		return fp.Output(ctx, resource)
+	}
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var parsed map[string]any
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	for _, e := range filters {
+		matches, err := e.Matches(parsed)
+		if err != nil {
+			log.Warningf("keeping %s resource from %s as FHIRPath filter %s could not be evaluated: %v", resource.Type(), resource.SourceURL(), e, err)
+			fp.errors.Add(1)
+			return fp.Output(ctx, resource)
+		}
+		if matches {
+			return fp.Output(ctx, resource)
+		}
+	}
+	fp.dropped.Add(1)
+	return fhirPathFilterDroppedCounter.Record(ctx, 1, resource.Type().String())
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (fp *fhirPathFilterProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (fp *fhirPathFilterProcessor) Finalize(ctx context.Context) error {
+	if n := fp.dropped.Load(); n > 0 {
+		log.Infof("Dropped %d resources which did not match the FHIRPath filters.", n)
+	}
+	if n := fp.errors.Load(); n > 0 {
+		log.Warningf("Kept %d resources for which a FHIRPath filter could not be evaluated.", n)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestFHIRPathFilterProcessor(t *testing.T) {
+	filters := []string{
+		"Claim.where(billablePeriod.start >= @2022-01-01)",
+		"Observation.status = 'final'",
+		"Observation.code.coding.where(system = 'http://loinc.org').exists()",
+		"Encounter.location.period.start > @2022-01-01",
+	}
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+		wantDropped  bool
+	}{
+		{
+			name:         "matching claim",
+			resourceType: cpb.ResourceTypeCode_CLAIM,
+			json:         `{"resourceType":"Claim","id":"1","billablePeriod":{"start":"2022-06-01"}}`,
+		},
+		{
+			name:         "old claim",
+			resourceType: cpb.ResourceTypeCode_CLAIM,
+			json:         `{"resourceType":"Claim","id":"1","billablePeriod":{"start":"2021-12-31T23:00:00Z"}}`,
+			wantDropped:  true,
+		},
+		{
+			name:         "claim without a billable period",
+			resourceType: cpb.ResourceTypeCode_CLAIM,
+			json:         `{"resourceType":"Claim","id":"1"}`,
+			wantDropped:  true,
+		},
+		{
+			name:         "observation matching one of several filters",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"preliminary","code":{"coding":[{"system":"http://loinc.org","code":"1-1"}]}}`,
+		},
+		{
+			name:         "observation matching no filter",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"preliminary","code":{"text":"x"}}`,
+			wantDropped:  true,
+		},
+		{
+			name:         "resource type without a filter is kept",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1"}`,
+		},
+		{
+			name:         "resource failing to evaluate is kept",
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			json:         `{"resourceType":"Encounter","id":"1","location":[{"period":{"start":"2022-01-01"}},{"period":{"start":"2023-01-01"}}]}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			fp, err := processing.NewFHIRPathFilterProcessor(filters)
+			if err != nil {
+				t.Fatalf("NewFHIRPathFilterProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{fp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Process(ctx, tc.resourceType, "http://source", []byte(tc.json)); err != nil {
+				t.Fatalf("p.Process() returned unexpected error: %v", err)
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+			}
+			wantWritten := 1
+			if tc.wantDropped {
+				wantWritten = 0
+			}
+			if len(ts.WrittenResources) != wantWritten {
+				t.Errorf("got %d written resources, want %d", len(ts.WrittenResources), wantWritten)
+			}
+		})
+	}
+}
+
+func TestNewFHIRPathFilterProcessor_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "status = 'final'", "NotAResource.status = 'final'", "Claim.where(", "Claim.status.ofType(string)"} {
+		if _, err := processing.NewFHIRPathFilterProcessor([]string{expr}); err == nil {
+			t.Errorf("NewFHIRPathFilterProcessor(%q) returned nil error", expr)
+		}
+	}
+}
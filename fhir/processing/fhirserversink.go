@@ -0,0 +1,194 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhirserver"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// FHIRServerSinkConfig defines the configuration passed to NewFHIRServerSink.
+// Only Client is required; zero values of the other fields select the
+// documented defaults.
+type FHIRServerSinkConfig struct {
+	// Client uploads resources to the FHIR server.
+	Client               *fhirserver.Client
+	NoFailOnUploadErrors bool
+
+	// If true, each Bundle is uploaded as a transaction, in which all resources
+	// fail if any does, rather than a batch.
+	Transaction bool
+	// BatchSize is the number of resources in each Bundle. If zero, a default of
+	// 5 is used.
+	BatchSize int
+	// MaxWorkers is the number of concurrent upload workers. If zero, a default
+	// of 10 is used.
+	MaxWorkers int
+}
+
+// fhirServerSink implements the processing.Sink interface to upload resources
+// to a FHIR server in batch or transaction Bundles.
+type fhirServerSink struct {
+	client      *fhirserver.Client
+	transaction bool
+	batchSize   int
+
+	fhirJSONs  chan []byte
+	maxWorkers int
+	wg         *sync.WaitGroup
+
+	uploadErrorOccurred  atomic.Bool
+	uploadErrors         atomic.Int64
+	noFailOnUploadErrors bool
+}
+
+// NewFHIRServerSink creates a new Sink which uploads resources to any FHIR R4
+// server, such as a HAPI FHIR JPA server, in batch or transaction Bundles
+// through the standard FHIR REST API. An error is returned if the config is
+// invalid.
+func NewFHIRServerSink(ctx context.Context, cfg *FHIRServerSinkConfig) (Sink, error) {
+	if cfg == nil || cfg.Client == nil {
+		return nil, errors.New("a FHIR server client is required")
+	}
+	if cfg.BatchSize < 0 || cfg.MaxWorkers < 0 {
+		return nil, errors.New("FHIR server sink batch size and workers must not be negative")
+	}
+	fss := &fhirServerSink{
+		client:               cfg.Client,
+		transaction:          cfg.Transaction,
+		batchSize:            cfg.BatchSize,
+		maxWorkers:           cfg.MaxWorkers,
+		noFailOnUploadErrors: cfg.NoFailOnUploadErrors,
+		fhirJSONs:            make(chan []byte, 100),
+		wg:                   &sync.WaitGroup{},
+	}
+	if fss.batchSize == 0 {
+		fss.batchSize = defaultBatchSize
+	}
+	if fss.maxWorkers == 0 {
+		fss.maxWorkers = defaultMaxWorkers
+	}
+	for i := 0; i < fss.maxWorkers; i++ {
+		go fss.uploadWorker(ctx)
+	}
+	return fss, nil
+}
+
+// Write is Sink.Write. The provided resource is queued to be uploaded to the
+// FHIR server.
+func (fss *fhirServerSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	json, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	fss.wg.Add(1)
+	fss.fhirJSONs <- json
+	if l := lineageOf(resource); l != nil {
+		l.recordOutput(fss.client.ResourceURL(l.record.ResourceType, l.record.ResourceID))
+	}
+	return nil
+}
+
+// Delete is Deleter.Delete. The resource is deleted from the FHIR server before
+// returning. Failures are handled like upload failures.
+func (fss *fhirServerSink) Delete(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, id string) error {
+	name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+	if err != nil {
+		return err
+	}
+	if err := fss.client.DeleteResource(ctx, name, id); err != nil {
+		log.Errorf("error deleting resource: %v", err)
+		fss.uploadErrorOccurred.Store(true)
+		fss.uploadErrors.Add(1)
+	}
+	return nil
+}
+
+// Finalize is Sink.Finalize. This waits for all resources to be uploaded to
+// the FHIR server before returning. It returns an error if any resources failed
+// to upload, unless NoFailOnUploadErrors was set when the sink was created.
+func (fss *fhirServerSink) Finalize(ctx context.Context) error {
+	close(fss.fhirJSONs)
+	fss.wg.Wait()
+	if fss.uploadErrorOccurred.Load() {
+		if fss.noFailOnUploadErrors {
+			log.Warningf("%v", ErrUploadFailures)
+		} else {
+			return fmt.Errorf("%w", ErrUploadFailures)
+		}
+	}
+	return nil
+}
+
+// UploadErrors is UploadErrorCounter.UploadErrors. Every resource of a batch
+// which fails to upload, and every resource of a transaction which fails, is
+// counted.
+func (fss *fhirServerSink) UploadErrors() int64 {
+	return fss.uploadErrors.Load()
+}
+
+func (fss *fhirServerSink) uploadWorker(ctx context.Context) {
+	for {
+		// Collect up to batchSize resources, uploading what we have once the
+		// channel is closed.
+		var batch [][]byte
+		fhirJSON, ok := <-fss.fhirJSONs
+		for ok {
+			batch = append(batch, fhirJSON)
+			if len(batch) == fss.batchSize {
+				break
+			}
+			fhirJSON, ok = <-fss.fhirJSONs
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := fss.uploadBundle(ctx, batch); err != nil {
+			log.Errorf("error uploading bundle: %v", err)
+			fss.uploadErrorOccurred.Store(true)
+			failed := int64(len(batch))
+			var bundleErr *fhirserver.BundleError
+			if errors.As(err, &bundleErr) && bundleErr.FailedEntries != nil && !fss.transaction {
+				failed = int64(len(bundleErr.FailedEntries))
+			}
+			fss.uploadErrors.Add(failed)
+		}
+
+		for range batch {
+			fss.wg.Done()
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+func (fss *fhirServerSink) uploadBundle(ctx context.Context, batch [][]byte) (err error) {
+	ctx, span := tracing.Start(ctx, "fhirserver.UploadBundle", attribute.Int("fhirserver.batch_size", len(batch)))
+	defer func() { tracing.End(span, err) }()
+	return fss.client.UploadBundle(ctx, batch, fss.transaction)
+}
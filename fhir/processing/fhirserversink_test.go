@@ -0,0 +1,242 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/fhirserver"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// fhirServer is a fake FHIR server which records the resources in the Bundles
+// posted to it, failing the resources whose IDs are in fail.
+type fhirServer struct {
+	t    *testing.T
+	fail map[string]bool
+
+	mu          sync.Mutex
+	bundleTypes []string
+	uploaded    []string
+	deleted     []string
+}
+
+func (fs *fhirServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if req.Method == http.MethodDelete {
+		fs.deleted = append(fs.deleted, strings.TrimPrefix(req.URL.Path, "/fhir/"))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		fs.t.Fatal(err)
+	}
+	var bundle struct {
+		Type  string `json:"type"`
+		Entry []struct {
+			Resource struct {
+				ID string `json:"id"`
+			} `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(body, &bundle); err != nil {
+		fs.t.Errorf("could not parse Bundle %s: %v", body, err)
+	}
+	fs.bundleTypes = append(fs.bundleTypes, bundle.Type)
+	var statuses, uploaded []string
+	for _, e := range bundle.Entry {
+		status := `"201 Created"`
+		if fs.fail[e.Resource.ID] {
+			status = `"400 Bad Request"`
+		} else {
+			uploaded = append(uploaded, e.Resource.ID)
+		}
+		statuses = append(statuses, fmt.Sprintf(`{"response":{"status":%s}}`, status))
+	}
+	if len(uploaded) < len(bundle.Entry) && bundle.Type == "transaction" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"resourceType":"OperationOutcome"}`))
+		return
+	}
+	fs.uploaded = append(fs.uploaded, uploaded...)
+	w.Write([]byte(fmt.Sprintf(`{"resourceType":"Bundle","type":"%s-response","entry":[%s]}`, bundle.Type, strings.Join(statuses, ","))))
+}
+
+func TestFHIRServerSink(t *testing.T) {
+	cases := []struct {
+		name             string
+		transaction      bool
+		fail             map[string]bool
+		wantBundleType   string
+		wantUploaded     []string
+		wantUploadErrors int64
+	}{
+		{
+			name:           "Batch",
+			wantBundleType: "batch",
+			wantUploaded:   []string{"1", "2", "3"},
+		},
+		{
+			name:           "Transaction",
+			transaction:    true,
+			wantBundleType: "transaction",
+			wantUploaded:   []string{"1", "2", "3"},
+		},
+		{
+			name:             "BatchErrors",
+			fail:             map[string]bool{"2": true},
+			wantBundleType:   "batch",
+			wantUploaded:     []string{"1", "3"},
+			wantUploadErrors: 1,
+		},
+		{
+			name:             "TransactionErrors",
+			transaction:      true,
+			fail:             map[string]bool{"2": true},
+			wantBundleType:   "transaction",
+			wantUploadErrors: 3,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			fs := &fhirServer{t: t, fail: tc.fail}
+			server := httptest.NewServer(fs)
+			defer server.Close()
+			client, err := fhirserver.NewClient(server.URL+"/fhir", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			sink, err := processing.NewFHIRServerSink(ctx, &processing.FHIRServerSinkConfig{
+				Client:      client,
+				Transaction: tc.transaction,
+				BatchSize:   3,
+				MaxWorkers:  1,
+			})
+			if err != nil {
+				t.Fatalf("NewFHIRServerSink() returned unexpected error: %v", err)
+			}
+			p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"1", "2", "3"} {
+				if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "", []byte(fmt.Sprintf(`{"resourceType":"Patient","id":"%s"}`, id))); err != nil {
+					t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+				}
+			}
+			err = p.Finalize(ctx)
+			if wantErr := tc.wantUploadErrors > 0; wantErr != errors.Is(err, processing.ErrUploadFailures) {
+				t.Errorf("pipeline.Finalize() returned error %v, want ErrUploadFailures: %t", err, wantErr)
+			}
+
+			if diff := cmp.Diff([]string{tc.wantBundleType}, fs.bundleTypes); diff != "" {
+				t.Errorf("FHIR server received unexpected Bundles (-want +got):\n%s", diff)
+			}
+			sort.Strings(fs.uploaded)
+			if diff := cmp.Diff(tc.wantUploaded, fs.uploaded); diff != "" {
+				t.Errorf("FHIR server received unexpected resources (-want +got):\n%s", diff)
+			}
+			if got := sink.(processing.UploadErrorCounter).UploadErrors(); got != tc.wantUploadErrors {
+				t.Errorf("UploadErrors() = %d, want %d", got, tc.wantUploadErrors)
+			}
+		})
+	}
+}
+
+func TestFHIRServerSink_NoFailOnUploadErrors(t *testing.T) {
+	metrics.ResetAll()
+	fs := &fhirServer{t: t, fail: map[string]bool{"1": true}}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+	client, err := fhirserver.NewClient(server.URL+"/fhir", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	sink, err := processing.NewFHIRServerSink(ctx, &processing.FHIRServerSinkConfig{Client: client, NoFailOnUploadErrors: true})
+	if err != nil {
+		t.Fatalf("NewFHIRServerSink() returned unexpected error: %v", err)
+	}
+	p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "", []byte(`{"resourceType":"Patient","id":"1"}`)); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Errorf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+}
+
+func TestFHIRServerSink_Delete(t *testing.T) {
+	metrics.ResetAll()
+	fs := &fhirServer{t: t}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+	client, err := fhirserver.NewClient(server.URL+"/fhir", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	sink, err := processing.NewFHIRServerSink(ctx, &processing.FHIRServerSinkConfig{Client: client})
+	if err != nil {
+		t.Fatalf("NewFHIRServerSink() returned unexpected error: %v", err)
+	}
+	if err := sink.(processing.Deleter).Delete(ctx, cpb.ResourceTypeCode_PATIENT, "1"); err != nil {
+		t.Errorf("Delete() returned unexpected error: %v", err)
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Errorf("Finalize() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"Patient/1"}, fs.deleted); diff != "" {
+		t.Errorf("FHIR server received unexpected deletions (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewFHIRServerSink_Invalid(t *testing.T) {
+	client, err := fhirserver.NewClient("https://hapi.example.com/fhir", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []*processing.FHIRServerSinkConfig{
+		nil,
+		{},
+		{Client: client, BatchSize: -1},
+		{Client: client, MaxWorkers: -1},
+	} {
+		if _, err := processing.NewFHIRServerSink(context.Background(), cfg); err == nil {
+			t.Errorf("NewFHIRServerSink(%+v) succeeded, want error", cfg)
+		}
+	}
+}
@@ -31,15 +31,30 @@ import (
 	log "github.com/google/bulk_fhir_tools/internal/logger"
 	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
 	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
 )
 
 // ErrUploadFailures is returned (wrapped) when uploads to FHIR Store have
 // failed. It is primarily used to detect this specific failure in tests.
 var ErrUploadFailures = errors.New("non-zero FHIR store upload errors")
 
-// defaultBatchSize is the default batch size for FHIR store uploads in batch
-// mode.
-const defaultBatchSize = 5
+const (
+	// defaultBatchSize is the default batch size for FHIR store uploads in
+	// batch mode.
+	defaultBatchSize = 5
+	// defaultMaxWorkers is the default number of concurrent FHIR store upload
+	// workers.
+	defaultMaxWorkers = 10
+	// defaultGCSImportJobTimeout is the default maximum time spent waiting for
+	// a FHIR store import from GCS to complete.
+	defaultGCSImportJobTimeout = 6 * time.Hour
+	// defaultGCSImportJobPeriod is the default period at which a FHIR store
+	// import from GCS is checked for completion.
+	defaultGCSImportJobPeriod = 30 * time.Second
+)
 
 var fhirStoreChannelSizeCounter *metrics.Counter = metrics.NewCounter("fhir-store-channel-size-counter", "The number of unread FHIR Resources that are waiting in the channel to be uploaded to FHIR Store.", "1", aggregation.LastValueInGCPMaxValueInLocal)
 
@@ -47,6 +62,8 @@ var fhirStoreChannelSizeCounter *metrics.Counter = metrics.NewCounter("fhir-stor
 // resources directly to FHIR store, either individually or batched.
 type directFHIRStoreSink struct {
 	fhirStoreCfg *fhirstore.Config
+	// fhirStoreClient is used for deletions, which are made synchronously.
+	fhirStoreClient *fhirstore.Client
 
 	// batchUpload indicates if fhirJSONs should be uploaded to FHIR store in
 	// batches using executeBundle in batch mode.
@@ -58,6 +75,7 @@ type directFHIRStoreSink struct {
 	wg         *sync.WaitGroup
 
 	uploadErrorOccurred  atomic.Bool
+	uploadErrors         atomic.Int64
 	noFailOnUploadErrors bool
 	errorFileOutputPath  string
 
@@ -86,12 +104,24 @@ func (dfss *directFHIRStoreSink) Write(ctx context.Context, resource ResourceWra
 	}
 	dfss.wg.Add(1)
 	dfss.fhirJSONs <- string(json)
+	recordFHIRStoreOutput(resource, dfss.fhirStoreClient)
 	if err := fhirStoreChannelSizeCounter.Record(ctx, int64(len(dfss.fhirJSONs))); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Delete is Deleter.Delete. The resource is deleted from FHIR Store before
+// returning. Failures are handled like upload failures.
+func (dfss *directFHIRStoreSink) Delete(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, id string) error {
+	if err := deleteFromFHIRStore(ctx, dfss.fhirStoreClient, resourceType, id); err != nil {
+		log.Errorf("error deleting resource: %v", err)
+		dfss.uploadErrorOccurred.Store(true)
+		dfss.uploadErrors.Add(1)
+	}
+	return nil
+}
+
 // Finalize is Sink.Finalize. This waits for all resources to be written to FHIR
 // Store before returning. It may return an error if there was an issue writing
 // resources (if NoFailOnUploadErrors was set when the sink was created), or if
@@ -115,6 +145,12 @@ func (dfss *directFHIRStoreSink) Finalize(ctx context.Context) error {
 	return nil
 }
 
+// UploadErrors is UploadErrorCounter.UploadErrors. Every resource of a batch
+// which fails to upload is counted.
+func (dfss *directFHIRStoreSink) UploadErrors() int64 {
+	return dfss.uploadErrors.Load()
+}
+
 func (dfss *directFHIRStoreSink) uploadWorker(ctx context.Context) {
 	c, err := fhirstore.NewClient(ctx, dfss.fhirStoreCfg)
 	if err != nil {
@@ -128,6 +164,7 @@ func (dfss *directFHIRStoreSink) uploadWorker(ctx context.Context) {
 			// future.
 			log.Errorf("error uploading resource: %v", err)
 			dfss.uploadErrorOccurred.Store(true)
+			dfss.uploadErrors.Add(1)
 			dfss.writeError(fhirJSON, err)
 		}
 		dfss.wg.Done()
@@ -163,10 +200,11 @@ func (dfss *directFHIRStoreSink) uploadBatchWorker(ctx context.Context) {
 		fhirBatch := fhirBatchBuffer[0:numBufferItemsPopulated]
 
 		// Upload batch
-		if err := c.UploadBatch(fhirBatch); err != nil {
+		if err := uploadBatch(ctx, c, fhirBatch); err != nil {
 
 			log.Errorf("error uploading batch: %v", err)
 			dfss.uploadErrorOccurred.Store(true)
+			dfss.uploadErrors.Add(int64(len(fhirBatch)))
 			// TODO(b/225916126): in the future, try to unpack the error and only
 			// write out the resources within the bundle that failed. For now, we
 			// write out all resources in the bundle to be safe.
@@ -181,6 +219,30 @@ func (dfss *directFHIRStoreSink) uploadBatchWorker(ctx context.Context) {
 	}
 }
 
+// recordFHIRStoreOutput records that the resource was written to the FHIR
+// store, if its lineage is recorded.
+func recordFHIRStoreOutput(resource ResourceWrapper, c *fhirstore.Client) {
+	if l := lineageOf(resource); l != nil {
+		l.recordOutput(c.ResourceName(l.record.ResourceType, l.record.ResourceID))
+	}
+}
+
+func deleteFromFHIRStore(ctx context.Context, c *fhirstore.Client, resourceType cpb.ResourceTypeCode_Value, id string) (err error) {
+	ctx, span := tracing.Start(ctx, "fhirstore.DeleteResource", attribute.String("fhir.resource_type", resourceType.String()))
+	defer func() { tracing.End(span, err) }()
+	name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+	if err != nil {
+		return err
+	}
+	return c.DeleteResource(ctx, name, id)
+}
+
+func uploadBatch(ctx context.Context, c *fhirstore.Client, fhirBatch [][]byte) (err error) {
+	_, span := tracing.Start(ctx, "fhirstore.UploadBatch", attribute.Int("fhirstore.batch_size", len(fhirBatch)))
+	defer func() { tracing.End(span, err) }()
+	return c.UploadBatch(fhirBatch)
+}
+
 func (dfss *directFHIRStoreSink) writeError(fhirJSON string, err error) {
 	if dfss.errorNDJSONFile != nil {
 		data, jsonErr := json.Marshal(errorNDJSONLine{Err: err.Error(), FHIRResource: fhirJSON})
@@ -220,27 +282,60 @@ type gcsBasedFHIRStoreSink struct {
 	gcsBucket           string
 	gcsImportJobTimeout time.Duration
 	gcsImportJobPeriod  time.Duration
+	composeParts        bool
 
 	noFailOnUploadErrors bool
+
+	// importOperation and importDone record the import job started by
+	// Finalize, for the CompletionToken.
+	importOperation string
+	importDone      bool
 }
 
 func (gbfss *gcsBasedFHIRStoreSink) Write(ctx context.Context, resource ResourceWrapper) error {
 	if gbfss.ndjsonSink == nil {
+		if gbfss.transactionTime == nil {
+			return errors.New("a transaction time is required to write resources to FHIR store via GCS")
+		}
 		transactionTime, err := gbfss.transactionTime.Get()
 		if err != nil {
 			return err
 		}
 		// Use the stored context from NewFHIRStoreSink, in case ctx is cancelled
 		// before subsequent Write calls.
-		gbfss.ndjsonSink, err = newGCSNDJSONSink(gbfss.ndjsonSinkCtx, gbfss.gcsEndpoint, gbfss.gcsBucket, fhir.ToFHIRInstant(transactionTime))
+		gbfss.ndjsonSink, err = newGCSNDJSONSink(gbfss.ndjsonSinkCtx, &GCSNDJSONSinkConfig{
+			Endpoint:     gbfss.gcsEndpoint,
+			Bucket:       gbfss.gcsBucket,
+			Directory:    fhir.ToFHIRInstant(transactionTime),
+			ComposeParts: gbfss.composeParts,
+		})
 		if err != nil {
 			return err
 		}
+		// The staged files are not outputs in their own right, so the lineage of
+		// resources is recorded as their FHIR store resource instead.
+		gbfss.ndjsonSink.fileLocation = nil
+	}
+	if err := gbfss.ndjsonSink.Write(ctx, resource); err != nil {
+		return err
+	}
+	recordFHIRStoreOutput(resource, gbfss.fhirStoreClient)
+	return nil
+}
+
+// Delete is Deleter.Delete. The resource is deleted from FHIR Store directly,
+// rather than via GCS, before returning.
+func (gbfss *gcsBasedFHIRStoreSink) Delete(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, id string) error {
+	if err := deleteFromFHIRStore(ctx, gbfss.fhirStoreClient, resourceType, id); err != nil {
+		if !gbfss.noFailOnUploadErrors {
+			return fmt.Errorf("error deleting resource: %w", err)
+		}
+		log.Errorf("error deleting resource: %v", err)
 	}
-	return gbfss.ndjsonSink.Write(ctx, resource)
+	return nil
 }
 
-func (gbfss *gcsBasedFHIRStoreSink) Finalize(ctx context.Context) error {
+func (gbfss *gcsBasedFHIRStoreSink) Finalize(ctx context.Context) (err error) {
 	if gbfss.ndjsonSink == nil {
 		// Write was never called; nothing to do here.
 		return nil
@@ -259,11 +354,14 @@ func (gbfss *gcsBasedFHIRStoreSink) Finalize(ctx context.Context) error {
 	gcsURI := fmt.Sprintf("gs://%s/%s/**", gbfss.gcsBucket, fhir.ToFHIRInstant(transactionTime))
 
 	log.Infof("Starting the import job from GCS location where FHIR data was saved: %s", gcsURI)
+	_, span := tracing.Start(ctx, "fhirstore.ImportFromGCS", attribute.String("gcs.uri", gcsURI))
+	defer func() { tracing.End(span, err) }()
 	opName, err := gbfss.fhirStoreClient.ImportFromGCS(gcsURI)
 
 	if err != nil {
 		return fmt.Errorf("failed to start import job: %w", err)
 	}
+	gbfss.importOperation = opName
 
 	isDone := false
 	deadline := time.Now().Add(gbfss.gcsImportJobTimeout)
@@ -289,10 +387,21 @@ func (gbfss *gcsBasedFHIRStoreSink) Finalize(ctx context.Context) error {
 	} else {
 		log.Infof("FHIR Store import is complete!")
 	}
+	gbfss.importDone = isDone
 	return nil
 }
 
+// CompletionToken is Completer.CompletionToken.
+func (gbfss *gcsBasedFHIRStoreSink) CompletionToken() string {
+	if gbfss.importOperation == "" {
+		return "FHIR store import via GCS: no resources"
+	}
+	return fmt.Sprintf("FHIR store import via GCS %s: %s (done: %t)", gbfss.ndjsonSink.location, gbfss.importOperation, gbfss.importDone)
+}
+
 // FHIRStoreSinkConfig defines the configuration passed to NewFHIRStoreSink.
+// Only FHIRStoreConfig is required; zero values of the other fields select the
+// documented defaults.
 type FHIRStoreSinkConfig struct {
 	FHIRStoreConfig      *fhirstore.Config
 	NoFailOnUploadErrors bool
@@ -302,17 +411,55 @@ type FHIRStoreSinkConfig struct {
 	UseGCSUpload bool
 
 	// Parameters for direct upload
-	BatchUpload         bool
-	BatchSize           int
+	BatchUpload bool
+	// BatchSize is the number of resources in each batch upload. If zero, a
+	// default of 5 is used.
+	BatchSize int
+	// MaxWorkers is the number of concurrent upload workers. If zero, a default
+	// of 10 is used.
 	MaxWorkers          int
 	ErrorFileOutputPath string
 
-	// Parameters for GCS-based upload
+	// Parameters for GCS-based upload. GCSBucket and TransactionTime are
+	// required to write resources, but not to delete them. If GCSEndpoint is
+	// empty, gcs.DefaultCloudStorageEndpoint is used; if GCSImportJobTimeout or
+	// GCSImportJobPeriod are zero, the import is waited for for up to 6 hours,
+	// checking every 30 seconds.
 	GCSEndpoint         string
 	GCSBucket           string
 	GCSImportJobTimeout time.Duration
 	GCSImportJobPeriod  time.Duration
 	TransactionTime     *bulkfhir.TransactionTime
+	// If true, each resource type is staged in GCS as a single file, composed
+	// from parts written in parallel. See GCSNDJSONSinkConfig.ComposeParts.
+	GCSComposeParts bool
+}
+
+// withDefaults validates the config, returning a copy with the defaults of
+// unset fields filled in.
+func (cfg *FHIRStoreSinkConfig) withDefaults() (*FHIRStoreSinkConfig, error) {
+	if cfg == nil || cfg.FHIRStoreConfig == nil {
+		return nil, errors.New("a FHIR store config is required")
+	}
+	if cfg.BatchSize < 0 || cfg.MaxWorkers < 0 || cfg.GCSImportJobTimeout < 0 || cfg.GCSImportJobPeriod < 0 {
+		return nil, errors.New("FHIR store sink batch size, workers and import job durations must not be negative")
+	}
+	cp := *cfg
+	if cp.BatchSize == 0 {
+		cp.BatchSize = defaultBatchSize
+	}
+	if cp.MaxWorkers == 0 {
+		cp.MaxWorkers = defaultMaxWorkers
+	}
+	if cp.UseGCSUpload {
+		if cp.GCSImportJobTimeout == 0 {
+			cp.GCSImportJobTimeout = defaultGCSImportJobTimeout
+		}
+		if cp.GCSImportJobPeriod == 0 {
+			cp.GCSImportJobPeriod = defaultGCSImportJobPeriod
+		}
+	}
+	return &cp, nil
 }
 
 func newGCSBasedFHIRStoreSink(ctx context.Context, cfg *FHIRStoreSinkConfig) (Sink, error) {
@@ -329,24 +476,26 @@ func newGCSBasedFHIRStoreSink(ctx context.Context, cfg *FHIRStoreSinkConfig) (Si
 		gcsBucket:            cfg.GCSBucket,
 		gcsImportJobTimeout:  cfg.GCSImportJobTimeout,
 		gcsImportJobPeriod:   cfg.GCSImportJobPeriod,
+		composeParts:         cfg.GCSComposeParts,
 		noFailOnUploadErrors: cfg.NoFailOnUploadErrors,
 	}, nil
 }
 
 // newDirectFHIRStoreSink initializes and returns a directFHIRStoreSink.
 func newDirectFHIRStoreSink(ctx context.Context, cfg *FHIRStoreSinkConfig) (Sink, error) {
-	batchSize := defaultBatchSize
-	if cfg.BatchSize != 0 {
-		batchSize = cfg.BatchSize
+	fhirStoreClient, err := fhirstore.NewClient(ctx, cfg.FHIRStoreConfig)
+	if err != nil {
+		return nil, err
 	}
 
 	dfss := &directFHIRStoreSink{
 		fhirStoreCfg:         cfg.FHIRStoreConfig,
+		fhirStoreClient:      fhirStoreClient,
 		maxWorkers:           cfg.MaxWorkers,
 		noFailOnUploadErrors: cfg.NoFailOnUploadErrors,
 		errorFileOutputPath:  cfg.ErrorFileOutputPath,
 		batchUpload:          cfg.BatchUpload,
-		batchSize:            batchSize,
+		batchSize:            cfg.BatchSize,
 	}
 
 	if cfg.ErrorFileOutputPath != "" {
@@ -363,8 +512,12 @@ func newDirectFHIRStoreSink(ctx context.Context, cfg *FHIRStoreSinkConfig) (Sink
 }
 
 // NewFHIRStoreSink creates a new Sink which writes resources to FHIR Store,
-// either directly or via GCS.
+// either directly or via GCS. An error is returned if the config is invalid.
 func NewFHIRStoreSink(ctx context.Context, cfg *FHIRStoreSinkConfig) (Sink, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
 	if cfg.UseGCSUpload {
 		return newGCSBasedFHIRStoreSink(ctx, cfg)
 	}
@@ -475,6 +475,71 @@ func TestDirectFHIRStoreSink_BatchErrors(t *testing.T) {
 	}
 }
 
+func TestFHIRStoreSink_Delete(t *testing.T) {
+	cases := []struct {
+		name                 string
+		useGCSUpload         bool
+		status               int
+		noFailOnUploadErrors bool
+		wantErr              bool
+	}{
+		{name: "Direct", status: http.StatusOK},
+		{name: "DirectError", status: http.StatusInternalServerError, wantErr: true},
+		{name: "DirectErrorNoFail", status: http.StatusInternalServerError, noFailOnUploadErrors: true},
+		{name: "GCSBased", useGCSUpload: true, status: http.StatusOK},
+		{name: "GCSBasedError", useGCSUpload: true, status: http.StatusInternalServerError, wantErr: true},
+		{name: "GCSBasedErrorNoFail", useGCSUpload: true, status: http.StatusInternalServerError, noFailOnUploadErrors: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			wantPath := "/v1/projects/test/locations/loc/datasets/dataset/fhirStores/fhirstore/fhir/Patient/PatientID"
+			deleted := false
+			testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodDelete || req.URL.Path != wantPath {
+					t.Errorf("FHIR store test server got unexpected request %s %s, want DELETE %s", req.Method, req.URL.Path, wantPath)
+				}
+				deleted = true
+				w.WriteHeader(tc.status)
+			}))
+			defer testServer.Close()
+
+			ctx := context.Background()
+			sink, err := processing.NewFHIRStoreSink(ctx, &processing.FHIRStoreSinkConfig{
+				FHIRStoreConfig: &fhirstore.Config{
+					CloudHealthcareEndpoint: testServer.URL,
+					ProjectID:               "test",
+					Location:                "loc",
+					DatasetID:               "dataset",
+					FHIRStoreID:             "fhirstore",
+				},
+				MaxWorkers:           1,
+				NoFailOnUploadErrors: tc.noFailOnUploadErrors,
+				UseGCSUpload:         tc.useGCSUpload,
+				TransactionTime:      bulkfhir.NewTransactionTime(),
+			})
+			if err != nil {
+				t.Fatalf("NewFHIRStoreSink unexpected error: %v", err)
+			}
+			p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+			if err != nil {
+				t.Fatalf("failed to create pipeline: %v", err)
+			}
+			// Depending on the sink, a failed deletion is returned either straight
+			// away or when finalizing.
+			err = p.Delete(ctx, cpb.ResourceTypeCode_PATIENT, "PatientID")
+			if err == nil {
+				err = p.Finalize(ctx)
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("deleting from the FHIR store sink returned error %v, want error: %v", err, tc.wantErr)
+			}
+			if !deleted {
+				t.Errorf("resource was not deleted from the FHIR store")
+			}
+		})
+	}
+}
+
 func TestDirectFHIRStoreSink_Errors(t *testing.T) {
 	cases := []struct {
 		name            string
@@ -665,3 +730,54 @@ func TestGCSBasedFHIRStoreSink(t *testing.T) {
 		t.Error("expected FHIR Store import operation status to be called")
 	}
 }
+
+func TestFHIRStoreSink_DefaultWorkers(t *testing.T) {
+	// MaxWorkers is unset, so the default number of workers is used.
+	ctx := context.Background()
+	resources := []testhelpers.FHIRStoreTestResource{
+		{
+			ResourceID:       "PatientID",
+			ResourceTypeCode: cpb.ResourceTypeCode_PATIENT,
+			Data:             []byte(`{"resourceType":"Patient","id":"PatientID"}`),
+		},
+	}
+	testServerURL := testhelpers.FHIRStoreServer(t, resources, "project", "loc", "dataset", "store")
+	sink, err := processing.NewFHIRStoreSink(ctx, &processing.FHIRStoreSinkConfig{
+		FHIRStoreConfig: &fhirstore.Config{
+			CloudHealthcareEndpoint: testServerURL,
+			ProjectID:               "project",
+			Location:                "loc",
+			DatasetID:               "dataset",
+			FHIRStoreID:             "store",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFHIRStoreSink unexpected error: %v", err)
+	}
+	p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "", resources[0].Data); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+}
+
+func TestNewFHIRStoreSink_Invalid(t *testing.T) {
+	storeCfg := &fhirstore.Config{CloudHealthcareEndpoint: "http://localhost", ProjectID: "project", Location: "loc", DatasetID: "dataset", FHIRStoreID: "store"}
+	for _, cfg := range []*processing.FHIRStoreSinkConfig{
+		nil,
+		{},
+		{FHIRStoreConfig: &fhirstore.Config{CloudHealthcareEndpoint: "http://localhost"}},
+		{FHIRStoreConfig: storeCfg, MaxWorkers: -1},
+		{FHIRStoreConfig: storeCfg, BatchUpload: true, BatchSize: -5},
+		{FHIRStoreConfig: storeCfg, UseGCSUpload: true, GCSImportJobPeriod: -time.Second},
+	} {
+		if _, err := processing.NewFHIRStoreSink(context.Background(), cfg); err == nil {
+			t.Errorf("NewFHIRStoreSink(%+v) returned nil error, want an error", cfg)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+// GroupTagSystem is the system of the tags added by the group tag processor.
+// The code of each tag is the ID of the Group the resource was exported for.
+const GroupTagSystem = "urn:bulk-fhir-tools:group"
+
+type groupContextKey struct{}
+
+// WithGroup returns a context for processing the resources exported for the
+// Group with the given ID, for example when the data of several Groups is
+// passed through the same Pipeline.
+func WithGroup(ctx context.Context, groupID string) context.Context {
+	return context.WithValue(ctx, groupContextKey{}, groupID)
+}
+
+// GroupFromContext returns the ID of the Group set on the context by WithGroup,
+// or an empty string if there is none.
+func GroupFromContext(ctx context.Context) string {
+	groupID, _ := ctx.Value(groupContextKey{}).(string)
+	return groupID
+}
+
+type groupTagProcessor struct {
+	BaseProcessor
+}
+
+// Assert groupTagProcessor satisfies the Processor interface.
+var _ Processor = &groupTagProcessor{}
+
+// NewGroupTagProcessor creates a Processor which adds a meta.tag to each
+// resource identifying the Group it was exported for, as set on the context
+// passed to Pipeline.Process by WithGroup. The tag has the system
+// GroupTagSystem and the Group ID as its code, so that the resources of a
+// Group can be found with a search such as _tag=<system>|<groupID>. Resources
+// processed without a Group, or which already have the tag, are passed on
+// unchanged.
+func NewGroupTagProcessor() Processor {
+	return &groupTagProcessor{}
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (gtp *groupTagProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (gtp *groupTagProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	if groupID := GroupFromContext(ctx); groupID != "" {
+		tag := &dpb.Coding{
+			System: &dpb.Uri{Value: GroupTagSystem},
+			Code:   &dpb.Code{Value: groupID},
+		}
+		if err := addTag(resource, tag); err != nil {
+			return err
+		}
+	}
+	return gtp.Output(ctx, resource)
+}
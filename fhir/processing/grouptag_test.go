@@ -0,0 +1,84 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestGroupTagProcessor(t *testing.T) {
+	cases := []struct {
+		name     string
+		groupID  string
+		jsonIn   string
+		wantJSON string
+	}{
+		{
+			name:     "resource without meta",
+			groupID:  "group1",
+			jsonIn:   `{"resourceType":"Patient","id":"1"}`,
+			wantJSON: `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:group","code":"group1"}]}}`,
+		},
+		{
+			name:     "tags of other groups are kept",
+			groupID:  "group2",
+			jsonIn:   `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:group","code":"group1"}]}}`,
+			wantJSON: `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:group","code":"group1"},{"system":"urn:bulk-fhir-tools:group","code":"group2"}]}}`,
+		},
+		{
+			name:     "tag is not repeated",
+			groupID:  "group1",
+			jsonIn:   `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:group","code":"group1"}]}}`,
+			wantJSON: `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:group","code":"group1"}]}}`,
+		},
+		{
+			name:     "no group",
+			jsonIn:   `{"resourceType":"Patient","id":"1"}`,
+			wantJSON: `{"resourceType":"Patient","id":"1"}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{processing.NewGroupTagProcessor()}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			ctx := context.Background()
+			if tc.groupID != "" {
+				ctx = processing.WithGroup(ctx, tc.groupID)
+			}
+			if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "", []byte(tc.jsonIn)); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.jsonIn, err)
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			normalizedWantJSON := testhelpers.NormalizeJSON(t, []byte(tc.wantJSON))
+			normalizedGotJSON := testhelpers.NormalizeJSON(t, gotJSON)
+			if !cmp.Equal(normalizedGotJSON, normalizedWantJSON) {
+				t.Errorf("pipeline.Process(..., %s) produced unexpected output. got: %s, want: %s", tc.jsonIn, normalizedGotJSON, normalizedWantJSON)
+			}
+		})
+	}
+}
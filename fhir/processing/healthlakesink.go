@@ -0,0 +1,261 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir"
+	"github.com/google/bulk_fhir_tools/fhirserver"
+	"github.com/google/bulk_fhir_tools/healthlake"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// HealthLakeSinkConfig defines the configuration passed to NewHealthLakeSink.
+// Only HealthLakeConfig is required; zero values of the other fields select
+// the documented defaults.
+type HealthLakeSinkConfig struct {
+	HealthLakeConfig     *healthlake.Config
+	NoFailOnUploadErrors bool
+
+	// Parameters for upload through the FHIR REST API, in batch Bundles.
+	// BatchSize is the number of resources in each Bundle. If zero, a default
+	// of 5 is used. MaxWorkers is the number of concurrent upload workers. If
+	// zero, a default of 10 is used.
+	BatchSize  int
+	MaxWorkers int
+
+	// If true, the sink will write NDJSON files to S3, and start a HealthLake
+	// FHIR import job of those files on Finalize.
+	UseS3Import bool
+
+	// Parameters for S3-based import. S3Bucket, ImportRoleARN,
+	// ImportOutputS3URI, ImportOutputKMSKeyID and TransactionTime are required
+	// to write resources, but not to delete them. If ImportJobTimeout or
+	// ImportJobPeriod are zero, the import is waited for for up to 6 hours,
+	// checking every 30 seconds.
+	S3Bucket             string
+	ImportRoleARN        string
+	ImportOutputS3URI    string
+	ImportOutputKMSKeyID string
+	ImportJobTimeout     time.Duration
+	ImportJobPeriod      time.Duration
+	TransactionTime      *bulkfhir.TransactionTime
+}
+
+// NewHealthLakeSink creates a new Sink which writes resources to an AWS
+// HealthLake data store, either through its FHIR REST API, with requests signed
+// with SigV4, or via S3 and a FHIR import job. An error is returned if the
+// config is invalid.
+func NewHealthLakeSink(ctx context.Context, cfg *HealthLakeSinkConfig) (Sink, error) {
+	if cfg == nil || cfg.HealthLakeConfig == nil {
+		return nil, errors.New("a HealthLake config is required")
+	}
+	if cfg.ImportJobTimeout < 0 || cfg.ImportJobPeriod < 0 {
+		return nil, errors.New("HealthLake import job durations must not be negative")
+	}
+	client, err := healthlake.NewClient(ctx, cfg.HealthLakeConfig)
+	if err != nil {
+		return nil, err
+	}
+	restClient, err := fhirserver.NewClient(client.FHIRBaseURL(), client.Authenticator())
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.UseS3Import {
+		return NewFHIRServerSink(ctx, &FHIRServerSinkConfig{
+			Client:               restClient,
+			NoFailOnUploadErrors: cfg.NoFailOnUploadErrors,
+			BatchSize:            cfg.BatchSize,
+			MaxWorkers:           cfg.MaxWorkers,
+		})
+	}
+	s := &s3BasedHealthLakeSink{
+		client:          client,
+		restClient:      restClient,
+		transactionTime: cfg.TransactionTime,
+		s3Bucket:        cfg.S3Bucket,
+		importCfg: healthlake.ImportConfig{
+			DataAccessRoleARN: cfg.ImportRoleARN,
+			OutputS3URI:       cfg.ImportOutputS3URI,
+			OutputKMSKeyID:    cfg.ImportOutputKMSKeyID,
+		},
+		importJobTimeout:     cfg.ImportJobTimeout,
+		importJobPeriod:      cfg.ImportJobPeriod,
+		noFailOnUploadErrors: cfg.NoFailOnUploadErrors,
+	}
+	if s.importJobTimeout == 0 {
+		s.importJobTimeout = defaultGCSImportJobTimeout
+	}
+	if s.importJobPeriod == 0 {
+		s.importJobPeriod = defaultGCSImportJobPeriod
+	}
+	return s, nil
+}
+
+// s3BasedHealthLakeSink wraps an ndjsonSink which writes files to S3, and then
+// starts a HealthLake FHIR import job ([0]) when Finalize is called, as
+// gcsBasedFHIRStoreSink does for FHIR store.
+//
+// [0]: https://docs.aws.amazon.com/healthlake/latest/APIReference/API_StartFHIRImportJob.html
+type s3BasedHealthLakeSink struct {
+	// ndjsonSink is lazily initialised so that we can retrieve the transaction
+	// time from transactionTime.
+	ndjsonSink *ndjsonSink
+
+	client *healthlake.Client
+	// restClient deletes resources, and names them in their lineage.
+	restClient *fhirserver.Client
+
+	transactionTime *bulkfhir.TransactionTime
+
+	s3Bucket         string
+	importCfg        healthlake.ImportConfig
+	importJobTimeout time.Duration
+	importJobPeriod  time.Duration
+
+	noFailOnUploadErrors bool
+
+	// importJobID and importDone record the import job started by Finalize,
+	// for the CompletionToken.
+	importJobID string
+	importDone  bool
+}
+
+func (s *s3BasedHealthLakeSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	if s.ndjsonSink == nil {
+		if s.transactionTime == nil {
+			return errors.New("a transaction time is required to write resources to HealthLake via S3")
+		}
+		if s.s3Bucket == "" || s.importCfg.DataAccessRoleARN == "" || s.importCfg.OutputS3URI == "" || s.importCfg.OutputKMSKeyID == "" {
+			return errors.New("an S3 bucket, import role ARN, import output S3 URI and KMS key ID are required to write resources to HealthLake via S3")
+		}
+		transactionTime, err := s.transactionTime.Get()
+		if err != nil {
+			return err
+		}
+		s.ndjsonSink = newS3NDJSONSink(s.client, s.s3Bucket, fhir.ToFHIRInstant(transactionTime))
+	}
+	if err := s.ndjsonSink.Write(ctx, resource); err != nil {
+		return err
+	}
+	if l := lineageOf(resource); l != nil {
+		l.recordOutput(s.restClient.ResourceURL(l.record.ResourceType, l.record.ResourceID))
+	}
+	return nil
+}
+
+// Delete is Deleter.Delete. The resource is deleted from HealthLake directly,
+// rather than via S3, before returning.
+func (s *s3BasedHealthLakeSink) Delete(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, id string) error {
+	name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+	if err != nil {
+		return err
+	}
+	if err := s.restClient.DeleteResource(ctx, name, id); err != nil {
+		if !s.noFailOnUploadErrors {
+			return fmt.Errorf("error deleting resource: %w", err)
+		}
+		log.Errorf("error deleting resource: %v", err)
+	}
+	return nil
+}
+
+func (s *s3BasedHealthLakeSink) Finalize(ctx context.Context) (err error) {
+	if s.ndjsonSink == nil {
+		// Write was never called; nothing to do here.
+		return nil
+	}
+
+	if err := s.ndjsonSink.Finalize(ctx); err != nil {
+		return fmt.Errorf("failed to close S3 files: %w", err)
+	}
+
+	importCfg := s.importCfg
+	importCfg.InputS3URI = s.ndjsonSink.location + "/"
+	log.Infof("Starting the HealthLake import job from S3 location where FHIR data was saved: %s", importCfg.InputS3URI)
+	ctx, span := tracing.Start(ctx, "healthlake.StartFHIRImportJob", attribute.String("s3.uri", importCfg.InputS3URI))
+	defer func() { tracing.End(span, err) }()
+	jobID, err := s.client.StartImport(ctx, importCfg)
+	if err != nil {
+		return fmt.Errorf("failed to start import job: %w", err)
+	}
+	s.importJobID = jobID
+
+	isDone := false
+	deadline := time.Now().Add(s.importJobTimeout)
+	start := time.Now()
+	for !isDone && time.Now().Before(deadline) {
+		time.Sleep(s.importJobPeriod)
+		log.Infof("HealthLake Import Job has been running for %s, still pending...", time.Since(start))
+
+		isDone, err = s.client.CheckImportStatus(ctx, jobID)
+		if err != nil {
+			log.Errorf("Error reported from the HealthLake Import Job: %s", err)
+			if !s.noFailOnUploadErrors {
+				return fmt.Errorf("error from the HealthLake Import Job: %w", err)
+			}
+			break
+		}
+	}
+
+	if !isDone && !s.noFailOnUploadErrors {
+		return fmt.Errorf("HealthLake import via S3 exceeded %s. It may still complete but bulk-fhir-fetch will not update the since_file", s.importJobTimeout)
+	} else if !isDone {
+		log.Warningf("HealthLake import via S3 exceeded %s. It may or may not still complete but bulk-fhir-fetch will update the since_file either way", s.importJobTimeout)
+	} else {
+		log.Infof("HealthLake import is complete!")
+	}
+	s.importDone = isDone
+	return nil
+}
+
+// CompletionToken is Completer.CompletionToken.
+func (s *s3BasedHealthLakeSink) CompletionToken() string {
+	if s.importJobID == "" {
+		return "HealthLake import via S3: no resources"
+	}
+	return fmt.Sprintf("HealthLake import via S3 %s: %s (done: %t)", s.ndjsonSink.location, s.importJobID, s.importDone)
+}
+
+// newS3NDJSONSink returns an ndjsonSink which writes NDJSON files to the
+// directory of the S3 bucket.
+func newS3NDJSONSink(client *healthlake.Client, bucket, directory string) *ndjsonSink {
+	sink := &ndjsonSink{
+		workerErrMut: &sync.Mutex{},
+		createFile: func(ctx context.Context, filename string) (io.WriteCloser, error) {
+			return client.GetFileWriter(ctx, bucket, path.Join(directory, filename)), nil
+		},
+		resourceChan:     make(chan ResourceWrapper, 100),
+		workerCompleteWG: &sync.WaitGroup{},
+		location:         "s3://" + path.Join(bucket, directory),
+	}
+	for i := 0; i < numWorkers; i++ {
+		go sink.writeWorker(i)
+		sink.workerCompleteWG.Add(1)
+	}
+	return sink
+}
@@ -0,0 +1,219 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/healthlake"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// fakeHealthLake serves the HealthLake FHIR REST and import job APIs and S3,
+// recording the requests made.
+type fakeHealthLake struct {
+	t         *testing.T
+	jobStatus string
+
+	mu         sync.Mutex
+	objects    map[string]string
+	importURIs []string
+	bundles    []string
+	deleted    []string
+}
+
+func (hl *fakeHealthLake) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		hl.t.Errorf("request %s %s is not signed with SigV4", req.Method, req.URL.Path)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		hl.t.Fatal(err)
+	}
+	switch {
+	case req.Header.Get("X-Amz-Target") == "HealthLake.StartFHIRImportJob":
+		var input struct {
+			InputDataConfig struct{ S3Uri string }
+		}
+		if err := json.Unmarshal(body, &input); err != nil {
+			hl.t.Errorf("could not parse StartFHIRImportJob request %s: %v", body, err)
+		}
+		hl.importURIs = append(hl.importURIs, input.InputDataConfig.S3Uri)
+		w.Write([]byte(`{"DatastoreId": "datastore", "JobId": "job1", "JobStatus": "SUBMITTED"}`))
+	case req.Header.Get("X-Amz-Target") == "HealthLake.DescribeFHIRImportJob":
+		w.Write([]byte(`{"ImportJobProperties": {"DatastoreId": "datastore", "JobId": "job1", "JobStatus": "` + hl.jobStatus + `"}}`))
+	case req.URL.Path == "/datastore/datastore/r4" && req.Method == http.MethodPost:
+		hl.bundles = append(hl.bundles, string(body))
+		w.Write([]byte(`{"resourceType":"Bundle","type":"batch-response","entry":[{"response":{"status":"201 Created"}}]}`))
+	case strings.HasPrefix(req.URL.Path, "/datastore/datastore/r4/") && req.Method == http.MethodDelete:
+		hl.deleted = append(hl.deleted, strings.TrimPrefix(req.URL.Path, "/datastore/datastore/r4/"))
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodPut:
+		hl.objects[req.URL.Path] = string(body)
+		w.Header().Set("ETag", `"etag"`)
+	default:
+		hl.t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func healthLakeConfig(server *httptest.Server) *healthlake.Config {
+	return &healthlake.Config{
+		Region:      "us-east-1",
+		DatastoreID: "datastore",
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		Endpoint:    server.URL,
+		S3Endpoint:  server.URL,
+	}
+}
+
+func TestHealthLakeSink_REST(t *testing.T) {
+	metrics.ResetAll()
+	hl := &fakeHealthLake{t: t, objects: map[string]string{}}
+	server := httptest.NewServer(hl)
+	defer server.Close()
+
+	ctx := context.Background()
+	sink, err := processing.NewHealthLakeSink(ctx, &processing.HealthLakeSinkConfig{HealthLakeConfig: healthLakeConfig(server)})
+	if err != nil {
+		t.Fatalf("NewHealthLakeSink() returned unexpected error: %v", err)
+	}
+	p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "", []byte(`{"resourceType":"Patient","id":"1"}`)); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+
+	want := []string{`{"resourceType":"Bundle","type":"batch","entry":[{"resource":{"resourceType":"Patient","id":"1"},"request":{"method":"PUT","url":"Patient/1"}}]}`}
+	if diff := cmp.Diff(want, hl.bundles); diff != "" {
+		t.Errorf("HealthLake received unexpected Bundles (-want +got):\n%s", diff)
+	}
+}
+
+func TestHealthLakeSink_S3Import(t *testing.T) {
+	cases := []struct {
+		name                 string
+		jobStatus            string
+		noFailOnUploadErrors bool
+		wantErr              bool
+	}{
+		{name: "Completed", jobStatus: "COMPLETED"},
+		{name: "Failed", jobStatus: "FAILED", wantErr: true},
+		{name: "FailedNoFailOnUploadErrors", jobStatus: "FAILED", noFailOnUploadErrors: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			hl := &fakeHealthLake{t: t, jobStatus: tc.jobStatus, objects: map[string]string{}}
+			server := httptest.NewServer(hl)
+			defer server.Close()
+
+			ctx := context.Background()
+			transactionTime := bulkfhir.NewTransactionTime()
+			transactionTime.Set(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+			sink, err := processing.NewHealthLakeSink(ctx, &processing.HealthLakeSinkConfig{
+				HealthLakeConfig:     healthLakeConfig(server),
+				NoFailOnUploadErrors: tc.noFailOnUploadErrors,
+				UseS3Import:          true,
+				S3Bucket:             "bucket",
+				ImportRoleARN:        "arn:aws:iam::123456789012:role/healthlake",
+				ImportOutputS3URI:    "s3://bucket/output/",
+				ImportOutputKMSKeyID: "key",
+				ImportJobPeriod:      time.Millisecond,
+				TransactionTime:      transactionTime,
+			})
+			if err != nil {
+				t.Fatalf("NewHealthLakeSink() returned unexpected error: %v", err)
+			}
+			p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "", []byte(`{"resourceType":"Patient","id":"1"}`)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+			if err := p.Finalize(ctx); (err != nil) != tc.wantErr {
+				t.Errorf("pipeline.Finalize() returned error %v, want error: %t", err, tc.wantErr)
+			}
+
+			// The file is named after whichever of the sink's workers wrote the
+			// resource.
+			objectKey := regexp.MustCompile(`^/bucket/2024-01-02T03:04:05\.000\+00:00/fhir_data_\d+_0\.ndjson$`)
+			var gotObjects []string
+			for key, content := range hl.objects {
+				if !objectKey.MatchString(key) {
+					t.Errorf("S3 received object %s, want a key matching %s", key, objectKey)
+				}
+				gotObjects = append(gotObjects, content)
+			}
+			if diff := cmp.Diff([]string{`{"resourceType":"Patient","id":"1"}` + "\n"}, gotObjects); diff != "" {
+				t.Errorf("S3 received unexpected objects (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff([]string{"s3://bucket/2024-01-02T03:04:05.000+00:00/"}, hl.importURIs); diff != "" {
+				t.Errorf("HealthLake received unexpected import jobs (-want +got):\n%s", diff)
+			}
+			if len(hl.bundles) > 0 {
+				t.Errorf("HealthLake received Bundles %v, want none when importing via S3", hl.bundles)
+			}
+		})
+	}
+}
+
+func TestHealthLakeSink_S3ImportDelete(t *testing.T) {
+	metrics.ResetAll()
+	hl := &fakeHealthLake{t: t, objects: map[string]string{}}
+	server := httptest.NewServer(hl)
+	defer server.Close()
+
+	ctx := context.Background()
+	sink, err := processing.NewHealthLakeSink(ctx, &processing.HealthLakeSinkConfig{HealthLakeConfig: healthLakeConfig(server), UseS3Import: true})
+	if err != nil {
+		t.Fatalf("NewHealthLakeSink() returned unexpected error: %v", err)
+	}
+	if err := sink.(processing.Deleter).Delete(ctx, cpb.ResourceTypeCode_PATIENT, "1"); err != nil {
+		t.Errorf("Delete() returned unexpected error: %v", err)
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Errorf("Finalize() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"Patient/1"}, hl.deleted); diff != "" {
+		t.Errorf("HealthLake received unexpected deletions (-want +got):\n%s", diff)
+	}
+	if len(hl.importURIs) > 0 {
+		t.Errorf("HealthLake received import jobs %v, want none without writes", hl.importURIs)
+	}
+}
@@ -0,0 +1,386 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+var (
+	// ErrResourceTimeout indicates a resource took longer than the configured
+	// ResourceIsolationConfig.Timeout to process.
+	ErrResourceTimeout = errors.New("resource processing timed out")
+	// ErrResourcePanic indicates processing a resource caused a panic.
+	ErrResourcePanic = errors.New("resource processing panicked")
+	// ErrResourceParse indicates a resource could not be parsed.
+	ErrResourceParse = errors.New("resource could not be parsed")
+	// ErrResourceProcessing indicates a processor returned an error for a
+	// resource, and ResourceIsolationConfig.DeadLetterErrors is set.
+	ErrResourceProcessing = errors.New("resource processing failed")
+	// ErrResourceWrite indicates a sink returned an error when writing a
+	// resource, and ResourceIsolationConfig.DeadLetterErrors is set.
+	ErrResourceWrite = errors.New("resource could not be written to a sink")
+)
+
+var deadLetterCounter *metrics.Counter = metrics.NewCounter("fhir-dead-letter-counter", "Count of FHIR Resources which could not be processed and were routed to the dead letter sink. The counter is tagged by the FHIR Resource type ex) OBSERVATION and the reason ex) TIMEOUT.", "1", aggregation.Count, "FHIRResourceType", "Reason")
+
+// ResourceIsolationConfig configures how a Pipeline isolates the processing of
+// individual resources, so that a single pathological resource cannot hang or
+// crash an entire run.
+type ResourceIsolationConfig struct {
+	// Timeout bounds the time spent parsing and processing a single resource.
+	// Parsing the resource, or passing it through the processors, is abandoned
+	// once the timeout is reached, and the processors are passed a context with
+	// this deadline so that they can stop early. Processors which do not
+	// implement ConcurrentProcessor are passed one resource at a time, so that an
+	// abandoned resource still held by one holds up the resources behind it,
+	// which may time out in turn. Writing to sinks is not subject to the
+	// timeout, as sinks may legitimately block while waiting for earlier writes
+	// to complete. If zero, no timeout is applied.
+	Timeout time.Duration
+	// DeadLetterSink receives resources which time out, panic or cannot be
+	// parsed. If nil, such resources are logged and dropped.
+	DeadLetterSink DeadLetterSink
+	// DeadLetterErrors routes resources for which a processor or sink returns an
+	// error, or a sink panics, to the DeadLetterSink as well, so that the run
+	// continues. As sinks are written to in turn, such a resource may already
+	// have been written to the sinks before the one which failed. Errors caused by the context being
+	// cancelled, and errors writing to the DeadLetterSink itself, are still
+	// returned.
+	DeadLetterErrors bool
+}
+
+// SetResourceIsolation enables per-resource isolation for this pipeline.
+// Resources which exceed the timeout, cause a processor to panic, or cannot be
+// parsed are routed to the dead letter sink rather than failing the run. Other
+// errors, including a sink panicking, still cause Process to return an error,
+// unless DeadLetterErrors is set, as the resource may already have been
+// written to other sinks. The number of resources routed to the dead letter
+// sink for each reason is logged by Finalize. It must be called before any
+// resources are processed.
+//
+// With isolation enabled, the resources output by the processors are only
+// written to the sinks once the processors have returned, so that a resource
+// abandoned by the timeout is never written. Every resource is also parsed
+// before it is passed to the processors, which has a performance cost if the
+// processors and sinks would otherwise only use the resource JSON.
+func (p *Pipeline) SetResourceIsolation(cfg *ResourceIsolationConfig) {
+	p.isolation = cfg
+	p.chainProcessors()
+}
+
+type sinkContextKey struct{}
+
+// sinkContext returns the context to be used for writing to sinks, which is
+// not subject to the per-resource timeout.
+func sinkContext(ctx context.Context) context.Context {
+	if sctx, ok := ctx.Value(sinkContextKey{}).(context.Context); ok {
+		return sctx
+	}
+	return ctx
+}
+
+// processIsolated passes the resource through the pipeline, routing it to the
+// dead letter sink if it times out, panics or cannot be parsed.
+func (p *Pipeline) processIsolated(ctx context.Context, rw *resourceWrapper) error {
+	// Keep the original JSON, as Proto() clears it on the wrapper.
+	original := rw.json
+
+	if err := p.parseIsolated(rw); err != nil {
+		return p.deadLetter(ctx, rw, original, err)
+	}
+	if err := p.recordOperationOutcome(ctx, rw); err != nil {
+		return err
+	}
+
+	rctx := context.WithValue(ctx, sinkContextKey{}, ctx)
+	if p.isolation.Timeout > 0 {
+		var cancel context.CancelFunc
+		rctx, cancel = context.WithTimeout(rctx, p.isolation.Timeout)
+		defer cancel()
+	}
+	outputs, err := p.runProcessorsIsolated(rctx, rw)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrResourceTimeout), errors.Is(err, ErrResourcePanic):
+		return p.deadLetter(ctx, rw, original, err)
+	case errors.Is(err, context.DeadlineExceeded) && rctx.Err() != nil && ctx.Err() == nil:
+		return p.deadLetter(ctx, rw, original, fmt.Errorf("%w after %s: %v", ErrResourceTimeout, p.isolation.Timeout, err))
+	case !p.isolation.DeadLetterErrors || ctx.Err() != nil:
+		return err
+	default:
+		return p.deadLetter(ctx, rw, original, fmt.Errorf("%w: %v", ErrResourceProcessing, err))
+	}
+
+	for _, r := range outputs {
+		// A panicking sink is not dead lettered like a panicking processor, as
+		// the sinks before it may already have written the resource.
+		err := runRecovered(func() error { return p.writeToSinks(ctx, r) })
+		var werr *sinkWriteError
+		switch {
+		case err == nil:
+			continue
+		case !p.isolation.DeadLetterErrors || ctx.Err() != nil:
+			return err
+		case errors.As(err, &werr):
+			return p.deadLetter(ctx, rw, original, fmt.Errorf("%w: %T: %v", ErrResourceWrite, werr.sink, werr.err))
+		default:
+			return p.deadLetter(ctx, rw, original, fmt.Errorf("%w: %v", ErrResourceWrite, err))
+		}
+	}
+	return nil
+}
+
+type isolatedOutputsKey struct{}
+
+// isolatedOutputs collects the resources output by the processors for a single
+// resource, until it is abandoned.
+type isolatedOutputs struct {
+	mu        sync.Mutex
+	resources []ResourceWrapper
+	abandoned bool
+}
+
+// add adds a resource, returning false if the outputs have been abandoned.
+func (o *isolatedOutputs) add(resource ResourceWrapper) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.abandoned {
+		return false
+	}
+	o.resources = append(o.resources, resource)
+	return true
+}
+
+// take returns the resources collected, and abandons the outputs, so that any
+// later resources are dropped.
+func (o *isolatedOutputs) take() []ResourceWrapper {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.abandoned = true
+	return o.resources
+}
+
+// collectOutput is the output function of the last processor when isolation is
+// enabled. Resources output while a resource is processed by processIsolated
+// are collected, to be written to the sinks once the processors have returned.
+// Resources output at other times, such as when processors are flushed or
+// finalized, are written to the sinks immediately.
+func (p *Pipeline) collectOutput(ctx context.Context, resource ResourceWrapper) error {
+	outputs, ok := ctx.Value(isolatedOutputsKey{}).(*isolatedOutputs)
+	if !ok {
+		return p.writeToSinks(ctx, resource)
+	}
+	if !outputs.add(resource) {
+		return fmt.Errorf("%w: the resource was abandoned", ErrResourceTimeout)
+	}
+	return nil
+}
+
+// runProcessorsIsolated passes the resource through the processors, giving up
+// once the timeout is reached, and returns the resources they output.
+func (p *Pipeline) runProcessorsIsolated(ctx context.Context, rw *resourceWrapper) ([]ResourceWrapper, error) {
+	outputs := &isolatedOutputs{}
+	ctx = context.WithValue(ctx, isolatedOutputsKey{}, outputs)
+	// Buffered, so that abandoned processing does not block forever.
+	done := make(chan error, 1)
+	process := func() {
+		done <- runRecovered(func() error { return p.pipelineFunc(ctx, rw) })
+	}
+
+	if p.isolation.Timeout <= 0 {
+		process()
+	} else {
+		go process()
+	}
+	var timeout <-chan time.Time
+	if p.isolation.Timeout > 0 {
+		timer := time.NewTimer(p.isolation.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-done:
+		return outputs.take(), err
+	case <-timeout:
+		// Any resources the abandoned processors output later are dropped, and
+		// the processors which are not concurrency safe are serialized (see
+		// chainProcessors), so it is safe to abandon them.
+		outputs.take()
+		return nil, fmt.Errorf("%w: processing took longer than %s", ErrResourceTimeout, p.isolation.Timeout)
+	}
+}
+
+// sinkWriteError wraps an error returned by a sink's Write, so that it can be
+// told apart from processor errors. Its message is that of the wrapped error.
+type sinkWriteError struct {
+	sink Sink
+	err  error
+}
+
+func (e *sinkWriteError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sinkWriteError) Unwrap() error {
+	return e.err
+}
+
+// parseIsolated populates the proto of the resource wrapper, giving up once the
+// timeout is reached. The JSON is retained, so that it can be passed through
+// unchanged if no processor accesses the proto.
+func (p *Pipeline) parseIsolated(rw *resourceWrapper) error {
+	type result struct {
+		proto *rpb.ContainedResource
+		err   error
+	}
+	// Buffered, so that an abandoned parse does not block forever.
+	done := make(chan result, 1)
+	parse := func() {
+		var proto *rpb.ContainedResource
+		err := runRecovered(func() error {
+			var err error
+			proto, err = rw.unmarshaller.UnmarshalR4(rw.json)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrResourceParse, err)
+			}
+			return nil
+		})
+		done <- result{proto, err}
+	}
+
+	if p.isolation.Timeout <= 0 {
+		parse()
+	} else {
+		go parse()
+	}
+	var timeout <-chan time.Time
+	if p.isolation.Timeout > 0 {
+		timer := time.NewTimer(p.isolation.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		rw.proto = r.proto
+		return nil
+	case <-timeout:
+		// The parsing goroutine only has access to this resource, which is never
+		// passed on, so it is safe to abandon it.
+		return fmt.Errorf("%w: parsing took longer than %s", ErrResourceTimeout, p.isolation.Timeout)
+	}
+}
+
+// runRecovered calls f, converting any panic into an error wrapping
+// ErrResourcePanic which includes the stack trace.
+func runRecovered(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v\n%s", ErrResourcePanic, r, debug.Stack())
+		}
+	}()
+	return f()
+}
+
+func (p *Pipeline) deadLetter(ctx context.Context, rw *resourceWrapper, original []byte, err error) error {
+	reason := "PARSE_ERROR"
+	switch {
+	case errors.Is(err, ErrResourceTimeout):
+		reason = "TIMEOUT"
+	case errors.Is(err, ErrResourcePanic):
+		reason = "PANIC"
+	case errors.Is(err, ErrInvalidEncoding):
+		reason = "INVALID_ENCODING"
+	case errors.Is(err, ErrResourceProcessing):
+		reason = "PROCESSING_ERROR"
+	case errors.Is(err, ErrResourceWrite):
+		reason = "WRITE_ERROR"
+	}
+	log.Errorf("routing %s resource from %s to the dead letter sink: %v", rw.resourceType, rw.sourceURL, err)
+	if err := deadLetterCounter.Record(ctx, 1, rw.resourceType.String(), reason); err != nil {
+		return err
+	}
+	p.deadLetterCounts.add(reason)
+	if p.errorVolume != nil {
+		p.errorVolume.deadLetters.Add(1)
+	}
+	if p.isolation.DeadLetterSink == nil {
+		return nil
+	}
+	p.deadLetterMu.Lock()
+	defer p.deadLetterMu.Unlock()
+	return p.isolation.DeadLetterSink.WriteDeadLetter(ctx, &DeadLetter{
+		ResourceType: rw.resourceType,
+		SourceURL:    rw.sourceURL,
+		JSON:         original,
+		Err:          err,
+		Reason:       reason,
+		Time:         time.Now(),
+	})
+}
+
+// deadLetterCounts counts the resources routed to the dead letter sink by
+// reason, for the summary logged by Finalize.
+type deadLetterCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *deadLetterCounts) add(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = map[string]int{}
+	}
+	c.counts[reason]++
+}
+
+// logSummary logs the number of resources routed to the dead letter sink, if
+// any, broken down by reason.
+func (c *deadLetterCounts) logSummary() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.counts) == 0 {
+		return
+	}
+	reasons := make([]string, 0, len(c.counts))
+	total := 0
+	for r, n := range c.counts {
+		reasons = append(reasons, r)
+		total += n
+	}
+	sort.Strings(reasons)
+	parts := make([]string, len(reasons))
+	for i, r := range reasons {
+		parts[i] = fmt.Sprintf("%d %s", c.counts[r], r)
+	}
+	log.Warningf("Routed %d resources to the dead letter sink: %s.", total, strings.Join(parts, ", "))
+}
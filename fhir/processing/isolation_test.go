@@ -0,0 +1,429 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// poisonProcessor misbehaves for Patients with particular IDs.
+type poisonProcessor struct {
+	processing.BaseProcessor
+}
+
+func (pp *poisonProcessor) Process(ctx context.Context, resource processing.ResourceWrapper) error {
+	proto, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	switch proto.GetPatient().GetId().GetValue() {
+	case "panic":
+		panic("poison pill")
+	case "hang":
+		<-ctx.Done()
+		return ctx.Err()
+	case "spin":
+		// Ignores the context, as CPU-bound processors do.
+		time.Sleep(200 * time.Millisecond)
+	case "error":
+		return errors.New("plain error")
+	}
+	return pp.Output(ctx, resource)
+}
+
+type testDeadLetterSink struct {
+	deadLetters []*processing.DeadLetter
+	finalized   bool
+}
+
+func (ts *testDeadLetterSink) WriteDeadLetter(ctx context.Context, dl *processing.DeadLetter) error {
+	ts.deadLetters = append(ts.deadLetters, dl)
+	return nil
+}
+
+func (ts *testDeadLetterSink) Finalize(ctx context.Context) error {
+	ts.finalized = true
+	return nil
+}
+
+func TestPipeline_ResourceIsolation(t *testing.T) {
+	cases := []struct {
+		name           string
+		json           string
+		wantWritten    bool
+		wantDeadLetter error
+		wantErr        bool
+	}{
+		{
+			name:        "valid resource",
+			json:        `{"resourceType":"Patient","id":"ok"}`,
+			wantWritten: true,
+		},
+		{
+			name:           "processor panics",
+			json:           `{"resourceType":"Patient","id":"panic"}`,
+			wantDeadLetter: processing.ErrResourcePanic,
+		},
+		{
+			name:           "processor times out",
+			json:           `{"resourceType":"Patient","id":"hang"}`,
+			wantDeadLetter: processing.ErrResourceTimeout,
+		},
+		{
+			name:           "processor ignores the timeout",
+			json:           `{"resourceType":"Patient","id":"spin"}`,
+			wantDeadLetter: processing.ErrResourceTimeout,
+		},
+		{
+			name:           "resource cannot be parsed",
+			json:           `{"resourceType":"Patient","id":`,
+			wantDeadLetter: processing.ErrResourceParse,
+		},
+		{
+			name:    "other errors are returned",
+			json:    `{"resourceType":"Patient","id":"error"}`,
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			ts := &processing.TestSink{}
+			dls := &testDeadLetterSink{}
+			p, err := processing.NewPipeline([]processing.Processor{&poisonProcessor{}}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.SetResourceIsolation(&processing.ResourceIsolationConfig{
+				Timeout:        50 * time.Millisecond,
+				DeadLetterSink: dls,
+			})
+
+			err = p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(tc.json))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("p.Process() returned error %v, want error: %v", err, tc.wantErr)
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+			}
+			if !dls.finalized {
+				t.Errorf("dead letter sink was not finalized")
+			}
+
+			// Wait for any abandoned processing to finish, to check that its
+			// output is not written.
+			time.Sleep(300 * time.Millisecond)
+			if gotWritten := len(ts.WrittenResources) == 1; gotWritten != tc.wantWritten {
+				t.Errorf("resource written to sink: %v, want %v", gotWritten, tc.wantWritten)
+			}
+			if tc.wantDeadLetter == nil {
+				if len(dls.deadLetters) != 0 {
+					t.Errorf("unexpected dead letters: %v", dls.deadLetters)
+				}
+				return
+			}
+			if len(dls.deadLetters) != 1 {
+				t.Fatalf("got %d dead letters, want 1", len(dls.deadLetters))
+			}
+			dl := dls.deadLetters[0]
+			if !errors.Is(dl.Err, tc.wantDeadLetter) {
+				t.Errorf("dead letter has error %v, want %v", dl.Err, tc.wantDeadLetter)
+			}
+			if string(dl.JSON) != tc.json || dl.SourceURL != "http://source" || dl.ResourceType != cpb.ResourceTypeCode_PATIENT {
+				t.Errorf("dead letter = {%v, %q, %s}, want {PATIENT, http://source, %s}", dl.ResourceType, dl.SourceURL, dl.JSON, tc.json)
+			}
+		})
+	}
+}
+
+// failingSink fails to write resources whose JSON contains "unwritable".
+type failingSink struct {
+	processing.TestSink
+}
+
+func (fs *failingSink) Write(ctx context.Context, resource processing.ResourceWrapper) error {
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(data), "unwritable") {
+		return errors.New("write failed")
+	}
+	return fs.TestSink.Write(ctx, resource)
+}
+
+func TestPipeline_DeadLetterErrors(t *testing.T) {
+	cases := []struct {
+		name           string
+		json           string
+		wantWritten    bool
+		wantDeadLetter error
+		wantReason     string
+	}{
+		{
+			name:        "valid resource",
+			json:        `{"resourceType":"Patient","id":"ok"}`,
+			wantWritten: true,
+		},
+		{
+			name:           "processor error",
+			json:           `{"resourceType":"Patient","id":"error"}`,
+			wantDeadLetter: processing.ErrResourceProcessing,
+			wantReason:     "PROCESSING_ERROR",
+		},
+		{
+			name:           "sink error",
+			json:           `{"resourceType":"Patient","id":"unwritable"}`,
+			wantDeadLetter: processing.ErrResourceWrite,
+			wantReason:     "WRITE_ERROR",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			fs := &failingSink{}
+			dls := &testDeadLetterSink{}
+			p, err := processing.NewPipeline([]processing.Processor{&poisonProcessor{}}, []processing.Sink{fs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.SetResourceIsolation(&processing.ResourceIsolationConfig{
+				DeadLetterSink:   dls,
+				DeadLetterErrors: true,
+			})
+
+			if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(tc.json)); err != nil {
+				t.Fatalf("p.Process() returned unexpected error: %v", err)
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+			}
+
+			if gotWritten := len(fs.WrittenResources) == 1; gotWritten != tc.wantWritten {
+				t.Errorf("resource written to sink: %v, want %v", gotWritten, tc.wantWritten)
+			}
+			if tc.wantDeadLetter == nil {
+				if len(dls.deadLetters) != 0 {
+					t.Errorf("unexpected dead letters: %v", dls.deadLetters)
+				}
+				return
+			}
+			if len(dls.deadLetters) != 1 {
+				t.Fatalf("got %d dead letters, want 1", len(dls.deadLetters))
+			}
+			dl := dls.deadLetters[0]
+			if !errors.Is(dl.Err, tc.wantDeadLetter) {
+				t.Errorf("dead letter has error %v, want %v", dl.Err, tc.wantDeadLetter)
+			}
+			if dl.Reason != tc.wantReason {
+				t.Errorf("dead letter has reason %q, want %q", dl.Reason, tc.wantReason)
+			}
+			if dl.Time.IsZero() {
+				t.Errorf("dead letter has no time")
+			}
+			if string(dl.JSON) != tc.json {
+				t.Errorf("dead letter has JSON %s, want %s", dl.JSON, tc.json)
+			}
+		})
+	}
+}
+
+// panickingSink panics when writing resources whose JSON contains "explosive".
+type panickingSink struct {
+	processing.TestSink
+}
+
+func (ps *panickingSink) Write(ctx context.Context, resource processing.ResourceWrapper) error {
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(data), "explosive") {
+		panic("sink exploded")
+	}
+	return ps.TestSink.Write(ctx, resource)
+}
+
+func TestPipeline_ResourceIsolationSinkPanics(t *testing.T) {
+	cases := []struct {
+		name             string
+		deadLetterErrors bool
+		wantErr          bool
+		wantReason       string
+	}{
+		{name: "returned", wantErr: true},
+		{name: "DeadLetterErrors", deadLetterErrors: true, wantReason: "WRITE_ERROR"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			ts := &processing.TestSink{}
+			dls := &testDeadLetterSink{}
+			p, err := processing.NewPipeline([]processing.Processor{&poisonProcessor{}}, []processing.Sink{ts, &panickingSink{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.SetResourceIsolation(&processing.ResourceIsolationConfig{
+				Timeout:          time.Second,
+				DeadLetterSink:   dls,
+				DeadLetterErrors: tc.deadLetterErrors,
+			})
+
+			// The first sink has written the resource by the time the second
+			// panics, so it is not dead lettered as a panic.
+			err = p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(`{"resourceType":"Patient","id":"explosive"}`))
+			if tc.wantErr {
+				if !errors.Is(err, processing.ErrResourcePanic) {
+					t.Errorf("p.Process() returned error %v, want %v", err, processing.ErrResourcePanic)
+				}
+			} else if err != nil {
+				t.Errorf("p.Process() returned unexpected error: %v", err)
+			}
+			if len(ts.WrittenResources) != 1 {
+				t.Errorf("first sink was written %d resources, want 1", len(ts.WrittenResources))
+			}
+			var gotReasons []string
+			for _, dl := range dls.deadLetters {
+				gotReasons = append(gotReasons, dl.Reason)
+			}
+			var wantReasons []string
+			if tc.wantReason != "" {
+				wantReasons = []string{tc.wantReason}
+			}
+			if diff := cmp.Diff(wantReasons, gotReasons); diff != "" {
+				t.Errorf("unexpected dead letter reasons (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPipeline_DeadLetterErrorsCancelled(t *testing.T) {
+	metrics.ResetAll()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dls := &testDeadLetterSink{}
+	p, err := processing.NewPipeline([]processing.Processor{&poisonProcessor{}}, []processing.Sink{&processing.TestSink{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetResourceIsolation(&processing.ResourceIsolationConfig{DeadLetterSink: dls, DeadLetterErrors: true})
+
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(`{"resourceType":"Patient","id":"hang"}`)); !errors.Is(err, context.Canceled) {
+		t.Errorf("p.Process() returned error %v, want %v", err, context.Canceled)
+	}
+	if len(dls.deadLetters) != 0 {
+		t.Errorf("unexpected dead letters: %v", dls.deadLetters)
+	}
+}
+
+func TestPipeline_ResourceIsolationPreservesJSON(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline(nil, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetResourceIsolation(&processing.ResourceIsolationConfig{Timeout: time.Second})
+
+	// JSON which is not in canonical form should be passed through unchanged if
+	// no processor accesses the proto.
+	in := `{"id": "1", "resourceType": "Patient"}`
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(in)); err != nil {
+		t.Fatalf("p.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+	}
+	got, err := ts.WrittenResources[0].JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != in {
+		t.Errorf("JSON() = %s, want %s", got, in)
+	}
+}
+
+func TestNDJSONDeadLetterSink(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ds, err := processing.NewNDJSONDeadLetterSink(ctx, dir)
+	if err != nil {
+		t.Fatalf("NewNDJSONDeadLetterSink() returned unexpected error: %v", err)
+	}
+	if err := ds.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dead_letters.ndjson")); !os.IsNotExist(err) {
+		t.Errorf("dead letter file exists without any dead letters, stat error: %v", err)
+	}
+
+	ds, err = processing.NewNDJSONDeadLetterSink(ctx, dir)
+	if err != nil {
+		t.Fatalf("NewNDJSONDeadLetterSink() returned unexpected error: %v", err)
+	}
+	for _, id := range []string{"1", "2"} {
+		if err := ds.WriteDeadLetter(ctx, &processing.DeadLetter{
+			ResourceType: cpb.ResourceTypeCode_PATIENT,
+			SourceURL:    "http://source",
+			JSON:         []byte(`{"resourceType":"Patient","id":"` + id + `"}`),
+			Err:          processing.ErrResourceTimeout,
+			Reason:       "TIMEOUT",
+			Time:         time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		}); err != nil {
+			t.Fatalf("WriteDeadLetter() returned unexpected error: %v", err)
+		}
+	}
+	if err := ds.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "dead_letters.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var got []map[string]string
+	for _, l := range lines {
+		var m map[string]string
+		if err := json.Unmarshal([]byte(l), &m); err != nil {
+			t.Fatalf("invalid dead letter line %q: %v", l, err)
+		}
+		got = append(got, m)
+	}
+	want := []map[string]string{
+		{"resource_type": "PATIENT", "source_url": "http://source", "err": "resource processing timed out", "reason": "TIMEOUT", "time": "2024-01-02T03:04:05Z", "fhir_resource": `{"resourceType":"Patient","id":"1"}`},
+		{"resource_type": "PATIENT", "source_url": "http://source", "err": "resource processing timed out", "reason": "TIMEOUT", "time": "2024-01-02T03:04:05Z", "fhir_resource": `{"resourceType":"Patient","id":"2"}`},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected dead letter file contents (-got +want): %s", diff)
+	}
+}
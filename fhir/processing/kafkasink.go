@@ -0,0 +1,280 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	"github.com/google/bulk_fhir_tools/kafka"
+	"go.opentelemetry.io/otel/attribute"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// The headers of the records produced by the Kafka sink.
+const (
+	KafkaHeaderResourceType    = "resourceType"
+	KafkaHeaderOperation       = "operation"
+	KafkaHeaderTransactionTime = "transactionTime"
+
+	// KafkaOperationUpsert is the operation of records holding a resource.
+	KafkaOperationUpsert = "upsert"
+	// KafkaOperationDelete is the operation of the tombstones produced for
+	// deleted resources.
+	KafkaOperationDelete = "delete"
+)
+
+// DefaultKafkaBatchSize is the default KafkaSinkConfig.BatchSize.
+const DefaultKafkaBatchSize = 500
+
+// kafkaMaxBatchBytes bounds the bytes of records produced to a topic in one
+// request. Brokers reject record batches larger than the topic's
+// max.message.bytes, which defaults to about 1MB.
+const kafkaMaxBatchBytes = 900 * 1000
+
+// KafkaSinkConfig defines the configuration passed to NewKafkaSink.
+type KafkaSinkConfig struct {
+	// Client produces the records. It is required, and is closed when the sink
+	// is finalized.
+	Client *kafka.Client
+	// Topic is the topic to produce every resource to. Exactly one of Topic
+	// and TopicPrefix must be set.
+	Topic string
+	// TopicPrefix, if set, produces each resource to a topic of its own
+	// resource type, named TopicPrefix followed by the type, for example
+	// fhir.Patient for a TopicPrefix of "fhir.".
+	TopicPrefix string
+	// BatchSize is the most records to produce to a topic in one request.
+	// Defaults to DefaultKafkaBatchSize.
+	BatchSize            int
+	NoFailOnUploadErrors bool
+
+	// If set, each record has a transactionTime header holding the
+	// transaction time of the export, once it is known.
+	TransactionTime *bulkfhir.TransactionTime
+}
+
+// kafkaBatch holds the records waiting to be produced to a topic.
+type kafkaBatch struct {
+	records []kafka.Record
+	bytes   int
+}
+
+// kafkaSink implements the processing.Sink interface to produce each resource
+// to a Kafka topic, in batches.
+type kafkaSink struct {
+	client          *kafka.Client
+	topic           string
+	topicPrefix     string
+	batchSize       int
+	transactionTime *bulkfhir.TransactionTime
+
+	mu      sync.Mutex
+	batches map[string]*kafkaBatch
+
+	produceErrorOccurred atomic.Bool
+	produceErrors        atomic.Int64
+	noFailOnUploadErrors bool
+}
+
+// Assert kafkaSink satisfies the Sink, Flusher, Deleter and UploadErrorCounter
+// interfaces.
+var _ Sink = &kafkaSink{}
+var _ Flusher = &kafkaSink{}
+var _ Deleter = &kafkaSink{}
+var _ UploadErrorCounter = &kafkaSink{}
+
+// NewKafkaSink creates a new Sink which produces each resource to a Kafka
+// topic, either one topic for all resources or a topic per resource type. Each
+// record's key is the resource's ID, so the versions of a resource are
+// produced to the same partition and consumed in order, and its value is the
+// resource's JSON, with resourceType and operation headers. Deleted resources
+// are produced as tombstones, records without a value, with an operation of
+// delete, which remove the resource from compacted topics.
+//
+// Records are produced in batches, when a batch is full and when the sink is
+// flushed or finalized, and only once all in-sync replicas have written them.
+// Records which fail with retriable errors are retried by the client; those
+// which still fail count as upload errors.
+func NewKafkaSink(ctx context.Context, cfg *KafkaSinkConfig) (Sink, error) {
+	if cfg == nil || cfg.Client == nil {
+		return nil, errors.New("a Kafka client is required")
+	}
+	if (cfg.Topic == "") == (cfg.TopicPrefix == "") {
+		return nil, errors.New("exactly one of a Kafka topic and topic prefix must be set")
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultKafkaBatchSize
+	}
+	return &kafkaSink{
+		client:               cfg.Client,
+		topic:                cfg.Topic,
+		topicPrefix:          cfg.TopicPrefix,
+		batchSize:            batchSize,
+		transactionTime:      cfg.TransactionTime,
+		batches:              map[string]*kafkaBatch{},
+		noFailOnUploadErrors: cfg.NoFailOnUploadErrors,
+	}, nil
+}
+
+// Write is Sink.Write. The resource is added to the batch of its topic, which
+// is produced once full.
+func (ks *kafkaSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var parsed struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	topic, record, err := ks.record(resource.Type(), parsed.ID, KafkaOperationUpsert)
+	if err != nil {
+		return err
+	}
+	record.Value = data
+	if l := lineageOf(resource); l != nil {
+		l.recordOutput(fmt.Sprintf("kafka://%s", topic))
+	}
+	ks.add(ctx, topic, record)
+	return nil
+}
+
+// Delete is Deleter.Delete. A tombstone for the resource is added to the batch
+// of its topic.
+func (ks *kafkaSink) Delete(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, id string) error {
+	topic, record, err := ks.record(resourceType, id, KafkaOperationDelete)
+	if err != nil {
+		return err
+	}
+	ks.add(ctx, topic, record)
+	return nil
+}
+
+// record returns the topic and a record without a value for the given
+// resource.
+func (ks *kafkaSink) record(resourceType cpb.ResourceTypeCode_Value, id, operation string) (string, kafka.Record, error) {
+	name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+	if err != nil {
+		return "", kafka.Record{}, err
+	}
+	topic := ks.topic
+	if ks.topicPrefix != "" {
+		topic = ks.topicPrefix + name
+	}
+	headers := []kafka.Header{
+		{Key: KafkaHeaderResourceType, Value: []byte(name)},
+		{Key: KafkaHeaderOperation, Value: []byte(operation)},
+	}
+	if ks.transactionTime != nil {
+		if t, err := ks.transactionTime.Get(); err == nil {
+			headers = append(headers, kafka.Header{Key: KafkaHeaderTransactionTime, Value: []byte(fhir.ToFHIRInstant(t))})
+		}
+	}
+	return topic, kafka.Record{Key: []byte(id), Headers: headers}, nil
+}
+
+func (ks *kafkaSink) add(ctx context.Context, topic string, record kafka.Record) {
+	size := record.Size()
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	b, ok := ks.batches[topic]
+	if !ok {
+		b = &kafkaBatch{}
+		ks.batches[topic] = b
+	}
+	if len(b.records) > 0 && b.bytes+size > kafkaMaxBatchBytes {
+		ks.produceBatch(ctx, topic, b)
+	}
+	b.records = append(b.records, record)
+	b.bytes += size
+	if len(b.records) >= ks.batchSize {
+		ks.produceBatch(ctx, topic, b)
+	}
+}
+
+// produceBatch produces the batch of records for topic. Failures are logged
+// and counted. ks.mu must be held.
+func (ks *kafkaSink) produceBatch(ctx context.Context, topic string, b *kafkaBatch) {
+	if len(b.records) == 0 {
+		return
+	}
+	ctx, span := tracing.Start(ctx, "kafka.Produce", attribute.String("kafka.topic", topic), attribute.Int("kafka.batch_size", len(b.records)))
+	err := ks.client.Produce(ctx, topic, b.records)
+	tracing.End(span, err)
+	if err != nil {
+		log.Errorf("%v", err)
+		failed := int64(len(b.records))
+		var perr *kafka.ProduceError
+		if errors.As(err, &perr) {
+			failed = int64(perr.Failed)
+		}
+		ks.produceErrorOccurred.Store(true)
+		ks.produceErrors.Add(failed)
+	}
+	b.records = nil
+	b.bytes = 0
+}
+
+// Flush is Flusher.Flush. The batches of every topic are produced before
+// returning. Resources which failed to produce are handled as on Finalize.
+func (ks *kafkaSink) Flush(ctx context.Context) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for topic, b := range ks.batches {
+		ks.produceBatch(ctx, topic, b)
+	}
+	return ks.uploadError()
+}
+
+// Finalize is Sink.Finalize. The batches of every topic are produced and the
+// client closed before returning. It returns an error if any resources failed
+// to produce, unless NoFailOnUploadErrors was set when the sink was created.
+func (ks *kafkaSink) Finalize(ctx context.Context) error {
+	err := ks.Flush(ctx)
+	if cerr := ks.client.Close(); cerr != nil {
+		log.Warningf("error closing Kafka client: %v", cerr)
+	}
+	return err
+}
+
+func (ks *kafkaSink) uploadError() error {
+	if !ks.produceErrorOccurred.Load() {
+		return nil
+	}
+	if ks.noFailOnUploadErrors {
+		log.Warningf("%v", ErrUploadFailures)
+		return nil
+	}
+	return fmt.Errorf("%w", ErrUploadFailures)
+}
+
+// UploadErrors is UploadErrorCounter.UploadErrors, counting the resources
+// which failed to produce.
+func (ks *kafkaSink) UploadErrors() int64 {
+	return ks.produceErrors.Load()
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/kafka"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func newKafkaSink(t *testing.T, server *testhelpers.KafkaServer, cfg processing.KafkaSinkConfig) processing.Sink {
+	t.Helper()
+	client, err := kafka.NewClient(context.Background(), kafka.Config{Brokers: []string{server.Addr()}, MaxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Client = client
+	sink, err := processing.NewKafkaSink(context.Background(), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func TestKafkaSink(t *testing.T) {
+	ctx := context.Background()
+	tt := bulkfhir.NewTransactionTime()
+	tt.Set(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	patient := []byte(`{"resourceType":"Patient","id":"p1"}`)
+	upsert := func(topic, resourceType string) testhelpers.KafkaRecord {
+		return testhelpers.KafkaRecord{Topic: topic, Key: []byte("p1"), Value: patient, Headers: map[string]string{"resourceType": resourceType, "operation": "upsert", "transactionTime": "2024-01-02T03:04:05.000+00:00"}}
+	}
+	tombstone := func(topic string) testhelpers.KafkaRecord {
+		return testhelpers.KafkaRecord{Topic: topic, Key: []byte("c1"), Headers: map[string]string{"resourceType": "Coverage", "operation": "delete", "transactionTime": "2024-01-02T03:04:05.000+00:00"}}
+	}
+	cases := []struct {
+		name string
+		cfg  processing.KafkaSinkConfig
+		want []testhelpers.KafkaRecord
+	}{
+		{
+			name: "SingleTopic",
+			cfg:  processing.KafkaSinkConfig{Topic: "fhir"},
+			want: []testhelpers.KafkaRecord{upsert("fhir", "Patient"), tombstone("fhir")},
+		},
+		{
+			name: "TopicPerResourceType",
+			cfg:  processing.KafkaSinkConfig{TopicPrefix: "fhir."},
+			want: []testhelpers.KafkaRecord{upsert("fhir.Patient", "Patient"), tombstone("fhir.Coverage")},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := testhelpers.NewKafkaServer(t)
+			for _, topic := range []string{"fhir", "fhir.Patient", "fhir.Coverage"} {
+				server.AddTopic(topic, 1)
+			}
+			tc.cfg.TransactionTime = tt
+			sink := newKafkaSink(t, server, tc.cfg)
+
+			if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: patient}); err != nil {
+				t.Fatalf("Write() returned unexpected error: %v", err)
+			}
+			if err := sink.(processing.Deleter).Delete(ctx, cpb.ResourceTypeCode_COVERAGE, "c1"); err != nil {
+				t.Fatalf("Delete() returned unexpected error: %v", err)
+			}
+			if got := server.ProduceRequests(); got != 0 {
+				t.Errorf("sink produced %d batches before being finalized, want 0", got)
+			}
+			if err := sink.Finalize(ctx); err != nil {
+				t.Fatalf("Finalize() returned unexpected error: %v", err)
+			}
+			sortRecords := cmpopts.SortSlices(func(a, b testhelpers.KafkaRecord) bool { return a.Topic+string(a.Key) < b.Topic+string(b.Key) })
+			if diff := cmp.Diff(tc.want, server.Records(), sortRecords); diff != "" {
+				t.Errorf("sink produced unexpected records (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestKafkaSink_Batches(t *testing.T) {
+	ctx := context.Background()
+	server := testhelpers.NewKafkaServer(t)
+	server.AddTopic("fhir", 2)
+	sink := newKafkaSink(t, server, processing.KafkaSinkConfig{Topic: "fhir", BatchSize: 10})
+
+	for i := 0; i < 25; i++ {
+		json := []byte(fmt.Sprintf(`{"resourceType":"Patient","id":"p%d"}`, i))
+		if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: json}); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if got := server.ProduceRequests(); got != 2 {
+		t.Errorf("sink produced %d batches before being flushed, want 2", got)
+	}
+	if err := sink.(processing.Flusher).Flush(ctx); err != nil {
+		t.Fatalf("Flush() returned unexpected error: %v", err)
+	}
+	if got := len(server.Records()); got != 25 {
+		t.Errorf("sink produced %d records once flushed, want 25", got)
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+}
+
+func TestKafkaSink_ProduceErrors(t *testing.T) {
+	for _, noFail := range []bool{false, true} {
+		t.Run(fmt.Sprintf("NoFailOnUploadErrors=%v", noFail), func(t *testing.T) {
+			ctx := context.Background()
+			server := testhelpers.NewKafkaServer(t)
+			server.AddTopic("fhir", 1)
+			server.FailNext(int16(kafka.ErrMessageTooLarge), 1)
+			sink := newKafkaSink(t, server, processing.KafkaSinkConfig{Topic: "fhir", NoFailOnUploadErrors: noFail})
+
+			for _, id := range []string{"p1", "p2"} {
+				json := []byte(fmt.Sprintf(`{"resourceType":"Patient","id":"%s"}`, id))
+				if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: json}); err != nil {
+					t.Fatalf("Write() returned unexpected error: %v", err)
+				}
+			}
+			err := sink.Finalize(ctx)
+			if noFail && err != nil {
+				t.Errorf("Finalize() returned unexpected error: %v", err)
+			}
+			if !noFail && !errors.Is(err, processing.ErrUploadFailures) {
+				t.Errorf("Finalize() returned error %v, want %v", err, processing.ErrUploadFailures)
+			}
+			if got := sink.(processing.UploadErrorCounter).UploadErrors(); got != 2 {
+				t.Errorf("UploadErrors() = %d, want 2", got)
+			}
+		})
+	}
+}
+
+func TestNewKafkaSink_InvalidTopics(t *testing.T) {
+	server := testhelpers.NewKafkaServer(t)
+	client, err := kafka.NewClient(context.Background(), kafka.Config{Brokers: []string{server.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, cfg := range []processing.KafkaSinkConfig{
+		{Client: client},
+		{Client: client, Topic: "fhir", TopicPrefix: "fhir."},
+	} {
+		if _, err := processing.NewKafkaSink(context.Background(), &cfg); err == nil {
+			t.Errorf("NewKafkaSink(%+v) succeeded, want error", cfg)
+		}
+	}
+}
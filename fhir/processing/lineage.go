@@ -0,0 +1,283 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// LineageRecord links a resource written to an output back to where it came
+// from. A record is written for each output a resource is written to.
+type LineageRecord struct {
+	RunID        string `json:"runID,omitempty"`
+	ResourceType string `json:"resourceType"`
+	ResourceID   string `json:"resourceID"`
+	// SourceURL is the URL the resource was downloaded from.
+	SourceURL string `json:"sourceURL"`
+	// SourceOffset and SourceLength locate the line holding the resource in the
+	// data downloaded from SourceURL, after any decompression, in bytes. They
+	// are zero if the resource was not read from an NDJSON line. All the
+	// entries of an unbundled Bundle share the location of the Bundle.
+	SourceOffset int64 `json:"sourceOffset"`
+	SourceLength int64 `json:"sourceLength"`
+	// Processors names the processors applied to the resource, in order.
+	Processors []string `json:"processors"`
+	// Output is the file the resource was written to, as a local path or a
+	// gs:// URI, or the name of the resource in a FHIR store.
+	Output string `json:"output"`
+}
+
+// LineageSink stores LineageRecords, so that resources in the outputs can be
+// audited. It is threadsafe to call WriteLineage from multiple goroutines, as
+// sinks which write resources concurrently record their outputs as they go.
+type LineageSink interface {
+	// WriteLineage writes the record to storage.
+	WriteLineage(ctx context.Context, record LineageRecord) error
+	// Finalize performs any final writing and cleanup. This is called after all
+	// records have been passed to WriteLineage().
+	Finalize(ctx context.Context) error
+}
+
+// SourceRange locates a resource within the data downloaded from its source
+// URL. See LineageRecord.
+type SourceRange struct {
+	Offset, Length int64
+}
+
+type sourceRangeContextKey struct{}
+
+// WithSourceRange returns a context for processing the resource read from the
+// given range of its source. The fetcher sets it on the context passed to
+// Pipeline.Process.
+func WithSourceRange(ctx context.Context, r SourceRange) context.Context {
+	return context.WithValue(ctx, sourceRangeContextKey{}, r)
+}
+
+// SourceRangeFromContext returns the range set on the context by
+// WithSourceRange, and whether there is one.
+func SourceRangeFromContext(ctx context.Context) (SourceRange, bool) {
+	r, ok := ctx.Value(sourceRangeContextKey{}).(SourceRange)
+	return r, ok
+}
+
+// lineageRecorder builds the LineageRecords of a pipeline.
+type lineageRecorder struct {
+	sink       LineageSink
+	runID      string
+	processors []string
+	// failed counts the records which could not be written.
+	failed atomic.Int64
+}
+
+// resourceLineage holds the lineage of a resource which is being written to
+// the sinks, to which each sink adds the output it wrote the resource to.
+type resourceLineage struct {
+	recorder *lineageRecorder
+	record   LineageRecord
+}
+
+// SetLineage makes the pipeline write a LineageRecord to sink for each output
+// a resource is written to, tagged with runID. Outputs are recorded by the
+// NDJSON and FHIR store sinks, once they have accepted the resource; resources
+// written to other sinks are not recorded. The lineage sink is finalized by
+// Finalize, after the pipeline's sinks.
+func (p *Pipeline) SetLineage(sink LineageSink, runID string) {
+	var processors []string
+	for _, pr := range p.processors {
+		processors = append(processors, processorName(pr))
+	}
+	p.lineage = &lineageRecorder{sink: sink, runID: runID, processors: processors}
+}
+
+// processorName returns the name of the processor's type, without any
+// Processor suffix, for example dedup for a dedupProcessor. Types from other
+// packages are qualified by their package name.
+func processorName(pr Processor) string {
+	t := reflect.TypeOf(pr)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.PkgPath() != reflect.TypeOf(Pipeline{}).PkgPath() {
+		return t.String()
+	}
+	return strings.TrimSuffix(t.Name(), "Processor")
+}
+
+// forResource returns the lineage of a resource about to be written to the
+// sinks.
+func (lr *lineageRecorder) forResource(ctx context.Context, resource ResourceWrapper) (*resourceLineage, error) {
+	data, err := resource.JSON()
+	if err != nil {
+		return nil, err
+	}
+	var parsed struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	resourceType, err := bulkfhir.ResourceTypeCodeToName(resource.Type())
+	if err != nil {
+		resourceType = resource.Type().String()
+	}
+	sourceRange, _ := SourceRangeFromContext(ctx)
+	return &resourceLineage{
+		recorder: lr,
+		record: LineageRecord{
+			RunID:        lr.runID,
+			ResourceType: resourceType,
+			ResourceID:   parsed.ID,
+			SourceURL:    resource.SourceURL(),
+			SourceOffset: sourceRange.Offset,
+			SourceLength: sourceRange.Length,
+			Processors:   lr.processors,
+		},
+	}, nil
+}
+
+// finalize finalizes the lineage sink, returning an error if any records
+// could not be written.
+func (lr *lineageRecorder) finalize(ctx context.Context) error {
+	if err := lr.sink.Finalize(ctx); err != nil {
+		return fmt.Errorf("error finalizing lineage sink: %w", err)
+	}
+	if n := lr.failed.Load(); n > 0 {
+		return fmt.Errorf("failed to record the lineage of %d resource outputs, check the logs for details", n)
+	}
+	return nil
+}
+
+// lineageOf returns the lineage of the resource if the pipeline records it,
+// or nil.
+func lineageOf(resource ResourceWrapper) *resourceLineage {
+	if rw, ok := resource.(*resourceWrapper); ok {
+		return rw.lineage
+	}
+	return nil
+}
+
+// recordOutput records that the resource was written to output, if the
+// pipeline records lineage.
+func recordOutput(resource ResourceWrapper, output string) {
+	if l := lineageOf(resource); l != nil {
+		l.recordOutput(output)
+	}
+}
+
+// recordOutput records that the resource was written to output. Sinks may
+// call this from their own goroutines, which have no context, so errors are
+// logged and counted rather than returned.
+func (l *resourceLineage) recordOutput(output string) {
+	record := l.record
+	record.Output = output
+	if err := l.recorder.sink.WriteLineage(context.Background(), record); err != nil {
+		log.Errorf("error recording the lineage of %s/%s in %s: %v", record.ResourceType, record.ResourceID, output, err)
+		l.recorder.failed.Add(1)
+	}
+}
+
+// lineageFileName returns the name of the file the lineage of the run with the
+// given ID is written to.
+func lineageFileName(runID string) string {
+	if runID == "" {
+		return "lineage.ndjson"
+	}
+	return fmt.Sprintf("lineage_%s.ndjson", runID)
+}
+
+type ndjsonLineageSink struct {
+	*lazyNDJSONFile
+}
+
+// NewNDJSONLineageSink returns a LineageSink which writes records as lines of
+// JSON to a lineage_<runID>.ndjson file in the given directory, so that each
+// run has its own file. The file is only created once the first record is
+// written.
+func NewNDJSONLineageSink(ctx context.Context, directory, runID string) (LineageSink, error) {
+	createFile, err := localCreateFileFunc(directory)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonLineageSink{&lazyNDJSONFile{createFile: createFile, fileName: lineageFileName(runID)}}, nil
+}
+
+// NewGCSNDJSONLineageSink returns a LineageSink which writes records to GCS.
+// See NewNDJSONLineageSink for additional documentation.
+func NewGCSNDJSONLineageSink(ctx context.Context, endpoint, bucket, directory, runID string) (LineageSink, error) {
+	createFile, err := gcsCreateFileFunc(ctx, endpoint, bucket, directory)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonLineageSink{&lazyNDJSONFile{createFile: createFile, fileName: lineageFileName(runID)}}, nil
+}
+
+func (ls *ndjsonLineageSink) WriteLineage(ctx context.Context, record LineageRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return ls.write(ctx, data)
+}
+
+// LineageQuery selects LineageRecords. Empty fields match any value.
+type LineageQuery struct {
+	RunID        string
+	ResourceType string
+	ResourceID   string
+	// Output matches records whose output starts with it, so that a directory
+	// selects the files in it.
+	Output string
+}
+
+// Matches returns whether the record is selected by the query.
+func (q LineageQuery) Matches(record LineageRecord) bool {
+	return (q.RunID == "" || record.RunID == q.RunID) &&
+		(q.ResourceType == "" || record.ResourceType == q.ResourceType) &&
+		(q.ResourceID == "" || record.ResourceID == q.ResourceID) &&
+		strings.HasPrefix(record.Output, q.Output)
+}
+
+// ReadLineage reads the NDJSON LineageRecords written by a LineageSink from r,
+// returning those selected by the query.
+func ReadLineage(r io.Reader, q LineageQuery) ([]LineageRecord, error) {
+	var records []LineageRecord
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for s.Scan() {
+		line++
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var record LineageRecord
+		if err := json.Unmarshal(s.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("error parsing lineage record on line %d: %w", line, err)
+		}
+		if q.Matches(record) {
+			records = append(records, record)
+		}
+	}
+	return records, s.Err()
+}
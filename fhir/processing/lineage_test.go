@@ -0,0 +1,181 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/fhirstore"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestPipeline_Lineage(t *testing.T) {
+	ctx := context.Background()
+	outputDir := t.TempDir()
+	lineageDir := t.TempDir()
+	ndjsonSink, err := processing.NewNDJSONSink(ctx, outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lineageSink, err := processing.NewNDJSONLineageSink(ctx, lineageDir, "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := processing.NewPipeline([]processing.Processor{processing.NewBCDARectifyProcessor(), processing.NewRunTagProcessor("bcda", "run1")}, []processing.Sink{ndjsonSink, &processing.TestSink{}})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	p.SetLineage(lineageSink, "run1")
+
+	resources := []struct {
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+		sourceRange  processing.SourceRange
+	}{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p1"}`, processing.SourceRange{Offset: 0, Length: 36}},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p2"}`, processing.SourceRange{Offset: 37, Length: 36}},
+	}
+	for _, r := range resources {
+		if err := p.Process(processing.WithSourceRange(ctx, r.sourceRange), r.resourceType, "https://server/data/patient.ndjson", []byte(r.json)); err != nil {
+			t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", r.json, err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(lineageDir, "lineage_run1.ndjson"))
+	if err != nil {
+		t.Fatalf("failed to open lineage file: %v", err)
+	}
+	defer f.Close()
+	got, err := processing.ReadLineage(f, processing.LineageQuery{})
+	if err != nil {
+		t.Fatalf("ReadLineage() returned unexpected error: %v", err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].ResourceID < got[j].ResourceID })
+	// The TestSink does not record outputs, so there is a record per resource.
+	want := []processing.LineageRecord{
+		{RunID: "run1", ResourceType: "Patient", ResourceID: "p1", SourceURL: "https://server/data/patient.ndjson", SourceOffset: 0, SourceLength: 36, Processors: []string{"bcdaRectify", "runTag"}},
+		{RunID: "run1", ResourceType: "Patient", ResourceID: "p2", SourceURL: "https://server/data/patient.ndjson", SourceOffset: 37, SourceLength: 36, Processors: []string{"bcdaRectify", "runTag"}},
+	}
+	for i := range got {
+		if filepath.Dir(got[i].Output) != outputDir || !strings.HasPrefix(filepath.Base(got[i].Output), "fhir_data_") {
+			t.Errorf("lineage record has output %s, want an NDJSON file in %s", got[i].Output, outputDir)
+		}
+		want[i].Output = got[i].Output
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReadLineage() returned unexpected records (-want +got):\n%s", diff)
+	}
+}
+
+func TestPipeline_LineageFHIRStore(t *testing.T) {
+	ctx := context.Background()
+	resources := []testhelpers.FHIRStoreTestResource{
+		{
+			ResourceID:       "PatientID",
+			ResourceTypeCode: cpb.ResourceTypeCode_PATIENT,
+			Data:             []byte(`{"resourceType":"Patient","id":"PatientID"}`),
+		},
+	}
+	testServerURL := testhelpers.FHIRStoreServer(t, resources, "project", "loc", "dataset", "store")
+	sink, err := processing.NewFHIRStoreSink(ctx, &processing.FHIRStoreSinkConfig{
+		FHIRStoreConfig: &fhirstore.Config{
+			CloudHealthcareEndpoint: testServerURL,
+			ProjectID:               "project",
+			Location:                "loc",
+			DatasetID:               "dataset",
+			FHIRStoreID:             "store",
+		},
+		MaxWorkers: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewFHIRStoreSink unexpected error: %v", err)
+	}
+	lineageDir := t.TempDir()
+	lineageSink, err := processing.NewNDJSONLineageSink(ctx, lineageDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	p.SetLineage(lineageSink, "")
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "https://server/data/patient.ndjson", resources[0].Data); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(lineageDir, "lineage.ndjson"))
+	if err != nil {
+		t.Fatalf("failed to open lineage file: %v", err)
+	}
+	defer f.Close()
+	got, err := processing.ReadLineage(f, processing.LineageQuery{})
+	if err != nil {
+		t.Fatalf("ReadLineage() returned unexpected error: %v", err)
+	}
+	want := []processing.LineageRecord{
+		{ResourceType: "Patient", ResourceID: "PatientID", SourceURL: "https://server/data/patient.ndjson", Output: "projects/project/locations/loc/datasets/dataset/fhirStores/store/fhir/Patient/PatientID"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReadLineage() returned unexpected records (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadLineage_Query(t *testing.T) {
+	lineage := `{"runID":"run1","resourceType":"Patient","resourceID":"p1","sourceURL":"u","sourceOffset":0,"sourceLength":10,"processors":[],"output":"gs://bucket/out/fhir_data_0_0.ndjson"}
+{"runID":"run1","resourceType":"Patient","resourceID":"p1","sourceURL":"u","sourceOffset":0,"sourceLength":10,"processors":[],"output":"projects/p/locations/l/datasets/d/fhirStores/s/fhir/Patient/p1"}
+{"runID":"run2","resourceType":"Patient","resourceID":"p1","sourceURL":"u","sourceOffset":20,"sourceLength":10,"processors":[],"output":"gs://bucket/out/fhir_data_0_0.ndjson"}
+{"runID":"run2","resourceType":"Coverage","resourceID":"p1","sourceURL":"u","sourceOffset":0,"sourceLength":10,"processors":[],"output":"gs://bucket/out/fhir_data_0_0.ndjson"}
+`
+	cases := []struct {
+		name string
+		q    processing.LineageQuery
+		want int
+	}{
+		{name: "everything", q: processing.LineageQuery{}, want: 4},
+		{name: "resource", q: processing.LineageQuery{ResourceType: "Patient", ResourceID: "p1"}, want: 3},
+		{name: "resource in run", q: processing.LineageQuery{RunID: "run2", ResourceType: "Patient", ResourceID: "p1"}, want: 1},
+		{name: "output directory", q: processing.LineageQuery{ResourceType: "Patient", Output: "gs://bucket/out/"}, want: 2},
+		{name: "no match", q: processing.LineageQuery{ResourceID: "p2"}, want: 0},
+	}
+	for _, tc := range cases {
+		got, err := processing.ReadLineage(strings.NewReader(lineage), tc.q)
+		if err != nil {
+			t.Fatalf("ReadLineage() with query %s returned unexpected error: %v", tc.name, err)
+		}
+		if len(got) != tc.want {
+			t.Errorf("ReadLineage() with query %s returned %d records, want %d", tc.name, len(got), tc.want)
+		}
+	}
+
+	if _, err := processing.ReadLineage(strings.NewReader("not json\n"), processing.LineageQuery{}); err == nil {
+		t.Errorf("ReadLineage() of invalid records returned nil error, want an error")
+	}
+}
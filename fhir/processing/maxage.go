@@ -0,0 +1,288 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var fhirMaxAgeDroppedCounter *metrics.Counter = metrics.NewCounter("fhir-max-age-dropped-counter", "Count of FHIR Resources which were dropped because their clinically relevant date was older than the maximum resource age. The counter is tagged by the FHIR Resource type ex) EXPLANATION_OF_BENEFIT.", "1", aggregation.Count, "FHIRResourceType")
+
+// ResourceAge is a calendar duration, such as 7 years, after which resources
+// are no longer retained.
+type ResourceAge struct {
+	Years, Months, Days int
+}
+
+// resourceAgeUnits maps the units accepted by ParseResourceAge to the
+// ResourceAge they represent.
+var resourceAgeUnits = map[string]ResourceAge{
+	"y":  {Years: 1},
+	"mo": {Months: 1},
+	"w":  {Days: 7},
+	"d":  {Days: 1},
+}
+
+// ParseResourceAge parses an age made up of a positive whole number and a unit
+// of y (years), mo (months), w (weeks) or d (days), e.g. 7y or 18mo.
+func ParseResourceAge(s string) (ResourceAge, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) })
+	if i <= 0 {
+		return ResourceAge{}, fmt.Errorf("invalid resource age %q, must be a number followed by y, mo, w or d", s)
+	}
+	n, err := strconv.Atoi(s[:i])
+	if err != nil || n <= 0 {
+		return ResourceAge{}, fmt.Errorf("invalid resource age %q, must be a positive number followed by y, mo, w or d", s)
+	}
+	unit, ok := resourceAgeUnits[s[i:]]
+	if !ok {
+		return ResourceAge{}, fmt.Errorf("invalid resource age %q, unit must be one of y, mo, w or d", s)
+	}
+	return ResourceAge{Years: n * unit.Years, Months: n * unit.Months, Days: n * unit.Days}, nil
+}
+
+// Cutoff returns the earliest time which is within the age of now.
+func (a ResourceAge) Cutoff(now time.Time) time.Time {
+	return now.AddDate(-a.Years, -a.Months, -a.Days)
+}
+
+// DefaultResourceDatePaths are the paths to the clinically relevant date of
+// commonly exported resource types, used by NewMaxAgeProcessor for resource
+// types without a configured path.
+var DefaultResourceDatePaths = []string{
+	"AllergyIntolerance.recordedDate",
+	"Claim.billablePeriod",
+	"ClaimResponse.created",
+	"Condition.recordedDate",
+	"DiagnosticReport.effective",
+	"DocumentReference.date",
+	"Encounter.period",
+	"ExplanationOfBenefit.billablePeriod",
+	"Immunization.occurrence",
+	"MedicationAdministration.effective",
+	"MedicationDispense.whenHandedOver",
+	"MedicationRequest.authoredOn",
+	"Observation.effective",
+	"Procedure.performed",
+}
+
+type maxAgeProcessor struct {
+	BaseProcessor
+	maxAge ResourceAge
+	// paths holds the element path of each resource type's date, split into
+	// its element names, without the leading resource type.
+	paths   map[cpb.ResourceTypeCode_Value][][]string
+	dropped atomic.Int64
+}
+
+// Assert maxAgeProcessor satisfies the Processor interface.
+var _ Processor = &maxAgeProcessor{}
+
+// NewMaxAgeProcessor creates a Processor which drops resources whose
+// clinically relevant date is older than maxAge.
+//
+// Each path is a simple FHIRPath expression such as
+// ExplanationOfBenefit.billablePeriod, naming a date, dateTime, instant or
+// Period element of a resource type. Choice elements may be named without
+// their type suffix (e.g. Observation.effective). The paths given for a
+// resource type replace its DefaultResourceDatePaths. A resource is dropped only
+// if the latest date found by its paths is before the cutoff; the end of a
+// Period is used where present, and partial dates are treated as the end of the
+// year or month. Resources of types without a path, or without a value at any
+// of their paths, are kept.
+func NewMaxAgeProcessor(maxAge ResourceAge, paths []string) (Processor, error) {
+	parsed, err := resourceDatePaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	return &maxAgeProcessor{maxAge: maxAge, paths: parsed}, nil
+}
+
+// resourceDatePaths parses the paths to the clinically relevant date of
+// resource types, falling back to DefaultResourceDatePaths for resource types
+// without a path.
+func resourceDatePaths(paths []string) (map[cpb.ResourceTypeCode_Value][][]string, error) {
+	configured, err := parseResourcePaths("resource date", paths)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := parseResourcePaths("resource date", DefaultResourceDatePaths)
+	if err != nil {
+		return nil, err
+	}
+	for rt, p := range configured {
+		parsed[rt] = p
+	}
+	return parsed, nil
+}
+
+// parseResourcePaths parses simple FHIRPath expressions such as
+// Observation.effective, naming an element of a resource type, into the
+// element names of each resource type. kind describes the paths in errors.
+func parseResourcePaths(kind string, paths []string) (map[cpb.ResourceTypeCode_Value][][]string, error) {
+	parsed := map[cpb.ResourceTypeCode_Value][][]string{}
+	for _, p := range paths {
+		parts := strings.Split(strings.TrimSpace(p), ".")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid %s path %q, must be a resource type followed by element names, e.g. Observation.effective", kind, p)
+		}
+		rt, err := bulkfhir.ResourceTypeCodeFromName(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s path %q: %w", kind, p, err)
+		}
+		for _, name := range parts[1:] {
+			if name == "" {
+				return nil, fmt.Errorf("invalid %s path %q, has an empty element name", kind, p)
+			}
+		}
+		parsed[rt] = append(parsed[rt], parts[1:])
+	}
+	return parsed, nil
+}
+
+func (mp *maxAgeProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	paths, ok := mp.paths[resource.Type()]
+	if !ok {
+		return mp.Output(ctx, resource)
+	}
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var parsed map[string]any
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	latest, found := latestDate(parsed, paths)
+	if !found || !latest.Before(mp.maxAge.Cutoff(time.Now())) {
+		return mp.Output(ctx, resource)
+	}
+	mp.dropped.Add(1)
+	return fhirMaxAgeDroppedCounter.Record(ctx, 1, resource.Type().String())
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (mp *maxAgeProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (mp *maxAgeProcessor) Finalize(ctx context.Context) error {
+	if n := mp.dropped.Load(); n > 0 {
+		log.Infof("Dropped %d resources older than the maximum resource age.", n)
+	}
+	return nil
+}
+
+// latestDate returns the latest date found at any of the paths within the
+// resource.
+func latestDate(resource map[string]any, paths [][]string) (time.Time, bool) {
+	var latest time.Time
+	found := false
+	for _, path := range paths {
+		for _, v := range selectElements([]any{resource}, path) {
+			t, ok := elementDate(v)
+			if ok && (!found || t.After(latest)) {
+				latest, found = t, true
+			}
+		}
+	}
+	return latest, found
+}
+
+// selectElements returns the values at the path within each of the given
+// elements, flattening arrays along the way. An element name also matches a
+// choice element with the name as its prefix followed by a type, e.g.
+// effective matches effectiveDateTime and effectivePeriod.
+func selectElements(elements []any, path []string) []any {
+	if len(path) == 0 {
+		return elements
+	}
+	var next []any
+	add := func(v any) {
+		if list, ok := v.([]any); ok {
+			next = append(next, list...)
+		} else {
+			next = append(next, v)
+		}
+	}
+	for _, e := range elements {
+		m, ok := e.(map[string]any)
+		if !ok {
+			continue
+		}
+		if v, ok := m[path[0]]; ok {
+			add(v)
+			continue
+		}
+		for k, v := range m {
+			if rest := strings.TrimPrefix(k, path[0]); rest != k && rest != "" && unicode.IsUpper(rune(rest[0])) {
+				add(v)
+			}
+		}
+	}
+	return selectElements(next, path[1:])
+}
+
+// elementDate returns the latest time described by a date, dateTime, instant
+// or Period element.
+func elementDate(v any) (time.Time, bool) {
+	switch e := v.(type) {
+	case string:
+		return parsePartialDate(e)
+	case map[string]any:
+		if end, ok := e["end"].(string); ok {
+			return parsePartialDate(end)
+		}
+		if start, ok := e["start"].(string); ok {
+			return parsePartialDate(start)
+		}
+	}
+	return time.Time{}, false
+}
+
+// parsePartialDate parses a FHIR date, dateTime or instant, returning the end
+// of the year, month or day for values without a time.
+func parsePartialDate(s string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, true
+	}
+	for _, p := range []struct {
+		layout             string
+		years, months, day int
+	}{
+		{"2006-01-02", 0, 0, 1},
+		{"2006-01", 0, 1, 0},
+		{"2006", 1, 0, 0},
+	} {
+		if t, err := time.Parse(p.layout, s); err == nil {
+			return t.AddDate(p.years, p.months, p.day).Add(-time.Nanosecond), true
+		}
+	}
+	return time.Time{}, false
+}
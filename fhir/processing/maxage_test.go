@@ -0,0 +1,158 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestMaxAgeProcessor(t *testing.T) {
+	lastYear := time.Now().AddDate(-1, 0, 0).Year()
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+		paths        []string
+		wantDropped  bool
+	}{
+		{
+			name:         "old claim",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			json:         `{"resourceType":"ExplanationOfBenefit","id":"1","billablePeriod":{"start":"2001-01-01","end":"2001-02-01"}}`,
+			wantDropped:  true,
+		},
+		{
+			name:         "recent claim",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			json:         fmt.Sprintf(`{"resourceType":"ExplanationOfBenefit","id":"1","billablePeriod":{"start":"%d-01-01"}}`, lastYear),
+		},
+		{
+			name:         "period end is used over start",
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			json:         fmt.Sprintf(`{"resourceType":"Encounter","id":"1","status":"finished","class":{"code":"IMP"},"period":{"start":"2001-01-01","end":"%d-01-01"}}`, lastYear),
+		},
+		{
+			name:         "choice element",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"},"effectiveDateTime":"2001-01-01T10:00:00Z"}`,
+			wantDropped:  true,
+		},
+		{
+			name:         "partial date is the end of the year",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         fmt.Sprintf(`{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"},"effectiveDateTime":"%d"}`, time.Now().AddDate(-3, 0, 0).Year()),
+		},
+		{
+			name:         "resource without a date is kept",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"}}`,
+		},
+		{
+			name:         "resource type without a path is kept",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1","birthDate":"1950-01-01"}`,
+		},
+		{
+			name:         "configured path replaces default",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			json:         fmt.Sprintf(`{"resourceType":"ExplanationOfBenefit","id":"1","created":"%d-01-01","billablePeriod":{"end":"2001-01-01"}}`, lastYear),
+			paths:        []string{"ExplanationOfBenefit.created"},
+		},
+		{
+			name:         "configured path within arrays",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			json:         `{"resourceType":"ExplanationOfBenefit","id":"1","item":[{"sequence":1,"servicedDate":"2001-01-01"},{"sequence":2,"servicedPeriod":{"end":"2001-03-01"}}]}`,
+			paths:        []string{"ExplanationOfBenefit.item.serviced"},
+			wantDropped:  true,
+		},
+		{
+			name:         "latest of several dates is used",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			json:         fmt.Sprintf(`{"resourceType":"ExplanationOfBenefit","id":"1","item":[{"sequence":1,"servicedDate":"2001-01-01"},{"sequence":2,"servicedDate":"%d-01-01"}]}`, lastYear),
+			paths:        []string{"ExplanationOfBenefit.item.serviced"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			mp, err := processing.NewMaxAgeProcessor(processing.ResourceAge{Years: 3}, tc.paths)
+			if err != nil {
+				t.Fatalf("NewMaxAgeProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{mp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Process(ctx, tc.resourceType, "http://source", []byte(tc.json)); err != nil {
+				t.Fatalf("p.Process() returned unexpected error: %v", err)
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+			}
+			wantWritten := 1
+			if tc.wantDropped {
+				wantWritten = 0
+			}
+			if len(ts.WrittenResources) != wantWritten {
+				t.Errorf("got %d written resources, want %d", len(ts.WrittenResources), wantWritten)
+			}
+		})
+	}
+}
+
+func TestNewMaxAgeProcessor_InvalidPath(t *testing.T) {
+	for _, path := range []string{"ExplanationOfBenefit", "NotAResource.date", "Observation..effective"} {
+		if _, err := processing.NewMaxAgeProcessor(processing.ResourceAge{Years: 1}, []string{path}); err == nil {
+			t.Errorf("NewMaxAgeProcessor(%q) returned nil error", path)
+		}
+	}
+}
+
+func TestParseResourceAge(t *testing.T) {
+	cases := []struct {
+		in   string
+		want processing.ResourceAge
+	}{
+		{"7y", processing.ResourceAge{Years: 7}},
+		{"18mo", processing.ResourceAge{Months: 18}},
+		{"6w", processing.ResourceAge{Days: 42}},
+		{"90d", processing.ResourceAge{Days: 90}},
+	}
+	for _, tc := range cases {
+		got, err := processing.ParseResourceAge(tc.in)
+		if err != nil {
+			t.Errorf("ParseResourceAge(%q) returned unexpected error: %v", tc.in, err)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("ParseResourceAge(%q) returned unexpected age (-want +got):\n%s", tc.in, diff)
+		}
+	}
+	for _, in := range []string{"", "y", "0y", "7", "7h", "-1y"} {
+		if _, err := processing.ParseResourceAge(in); err == nil {
+			t.Errorf("ParseResourceAge(%q) returned nil error", in)
+		}
+	}
+}
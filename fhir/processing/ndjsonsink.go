@@ -15,19 +15,24 @@
 package processing
 
 import (
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/google/bulk_fhir_tools/bulkfhir"
 	"github.com/google/bulk_fhir_tools/gcs"
 	log "github.com/google/bulk_fhir_tools/internal/logger"
 	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
 	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/s3"
 
 	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
 )
@@ -51,6 +56,33 @@ var ErrWorkerError = fmt.Errorf("at least one upload worker encountered errors,
 
 type createFileFunc func(ctx context.Context, filename string) (io.WriteCloser, error)
 
+// gzipCreateFile wraps createFile so that the files it creates are gzip
+// compressed, and have a .gz extension.
+func gzipCreateFile(createFile createFileFunc) createFileFunc {
+	return func(ctx context.Context, filename string) (io.WriteCloser, error) {
+		f, err := createFile(ctx, filename+".gz")
+		if err != nil {
+			return nil, err
+		}
+		return &gzipWriteCloser{Writer: gzip.NewWriter(f), file: f}, nil
+	}
+}
+
+// gzipWriteCloser flushes the gzip stream and closes the underlying file when
+// closed.
+type gzipWriteCloser struct {
+	*gzip.Writer
+	file io.WriteCloser
+}
+
+func (g *gzipWriteCloser) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		g.file.Close()
+		return err
+	}
+	return g.file.Close()
+}
+
 type fileKey struct {
 	resourceType cpb.ResourceTypeCode_Value
 	sourceURL    string
@@ -73,6 +105,29 @@ type ndjsonSink struct {
 
 	resourceChan     chan ResourceWrapper
 	workerCompleteWG *sync.WaitGroup
+
+	// composer is set if resources are written to parts, which are composed
+	// into one file per resource type on Finalize. See GCSNDJSONSinkConfig.
+	composer composer
+	// fileSuffix is appended to file names by createFile, if any.
+	fileSuffix string
+	partsMut   sync.Mutex
+	// parts holds the names of the parts written for each file, in order.
+	parts map[string][]string
+
+	// location is the directory written to, for the CompletionToken.
+	location string
+	// fileLocation returns the path or URI of the named file, as recorded in
+	// the lineage of the resources written to it. If nil, the lineage of the
+	// resources is not recorded.
+	fileLocation func(filename string) string
+	// written counts the resources written by the workers.
+	written atomic.Int64
+}
+
+// composer assembles files from their parts.
+type composer interface {
+	Compose(ctx context.Context, dst string, srcs []string) error
 }
 
 // NewNDJSONSink creates a new Sink which writes resources to NDJSON files in
@@ -82,6 +137,17 @@ type ndjsonSink struct {
 //
 // It is threadsafe to call Write on this Sink from multiple goroutines.
 func NewNDJSONSink(ctx context.Context, directory string) (Sink, error) {
+	return newLocalNDJSONSink(ctx, directory, false)
+}
+
+// NewCompressedNDJSONSink creates a new Sink which writes resources to gzip
+// compressed NDJSON files, with a .ndjson.gz extension, in the given directory.
+// See NewNDJSONSink for additional documentation.
+func NewCompressedNDJSONSink(ctx context.Context, directory string) (Sink, error) {
+	return newLocalNDJSONSink(ctx, directory, true)
+}
+
+func newLocalNDJSONSink(ctx context.Context, directory string, compress bool) (Sink, error) {
 	if stat, err := os.Stat(directory); err != nil {
 		return nil, fmt.Errorf("could not stat directory %q - %w", directory, err)
 	} else if !stat.IsDir() {
@@ -92,6 +158,9 @@ func NewNDJSONSink(ctx context.Context, directory string) (Sink, error) {
 		filename = filepath.Join(directory, filename)
 		return os.Create(filename)
 	}
+	if compress {
+		createFile = gzipCreateFile(createFile)
+	}
 
 	sink := &ndjsonSink{
 		workerErrMut:     &sync.Mutex{},
@@ -99,6 +168,13 @@ func NewNDJSONSink(ctx context.Context, directory string) (Sink, error) {
 		createFile:       createFile,
 		resourceChan:     make(chan ResourceWrapper, 100),
 		workerCompleteWG: &sync.WaitGroup{},
+		location:         directory,
+		fileLocation: func(filename string) string {
+			if compress {
+				filename += ".gz"
+			}
+			return filepath.Join(directory, filename)
+		},
 	}
 
 	for i := 0; i < numWorkers; i++ {
@@ -112,20 +188,60 @@ func NewNDJSONSink(ctx context.Context, directory string) (Sink, error) {
 // NewGCSNDJSONSink returns a Sink which writes NDJSON files to GCS. See
 // NewNDJSONSink for additional documentation.
 func NewGCSNDJSONSink(ctx context.Context, endpoint, bucket, directory string) (Sink, error) {
-	return newGCSNDJSONSink(ctx, endpoint, bucket, directory)
+	return newGCSNDJSONSink(ctx, &GCSNDJSONSinkConfig{Endpoint: endpoint, Bucket: bucket, Directory: directory})
+}
+
+// NewGCSCompressedNDJSONSink returns a Sink which writes gzip compressed NDJSON
+// files to GCS. See NewCompressedNDJSONSink for additional documentation.
+func NewGCSCompressedNDJSONSink(ctx context.Context, endpoint, bucket, directory string) (Sink, error) {
+	return newGCSNDJSONSink(ctx, &GCSNDJSONSinkConfig{Endpoint: endpoint, Bucket: bucket, Directory: directory, Compress: true})
+}
+
+// GCSNDJSONSinkConfig defines the configuration passed to
+// NewGCSNDJSONSinkFromConfig.
+type GCSNDJSONSinkConfig struct {
+	Endpoint  string
+	Bucket    string
+	Directory string
+
+	// If true, files are gzip compressed, with a .ndjson.gz extension.
+	Compress bool
+
+	// If true, each resource type is written to a single file named after it,
+	// for example Patient.ndjson. The workers write parts of each file in
+	// parallel, under a parts/ subdirectory, and on Finalize the parts are
+	// composed into the final files and deleted. This speeds up writing very
+	// large files.
+	ComposeParts bool
+}
+
+// NewGCSNDJSONSinkFromConfig returns a Sink which writes NDJSON files to GCS,
+// as configured by cfg. See NewNDJSONSink for additional documentation.
+func NewGCSNDJSONSinkFromConfig(ctx context.Context, cfg *GCSNDJSONSinkConfig) (Sink, error) {
+	return newGCSNDJSONSink(ctx, cfg)
 }
 
 // newGCSNDJSONSink returns the raw ndjsonSink, so that it can be embedded in
 // gcsBasedFHIRStoreSink without a cast.
-func newGCSNDJSONSink(ctx context.Context, endpoint, bucket, directory string) (*ndjsonSink, error) {
-	gcsClient, err := gcs.NewClient(ctx, bucket, endpoint)
+func newGCSNDJSONSink(ctx context.Context, cfg *GCSNDJSONSinkConfig) (*ndjsonSink, error) {
+	gcsClient, err := gcs.NewClient(ctx, cfg.Bucket, cfg.Endpoint)
 	if err != nil {
 		return nil, err
 	}
 
-	// This closure captures the GCS client and the `directory` parameter.
+	// This closure captures the GCS client and the directory.
 	createFile := func(ctx context.Context, filename string) (io.WriteCloser, error) {
-		return gcsClient.GetFileWriter(ctx, gcs.JoinPath(directory, filename)), nil
+		return gcsClient.GetFileWriter(ctx, gcs.JoinPath(cfg.Directory, filename)), nil
+	}
+	if cfg.ComposeParts {
+		createFile = func(ctx context.Context, filename string) (io.WriteCloser, error) {
+			return gcsClient.GetPartWriter(ctx, gcs.JoinPath(cfg.Directory, filename)), nil
+		}
+	}
+	var fileSuffix string
+	if cfg.Compress {
+		createFile = gzipCreateFile(createFile)
+		fileSuffix = ".gz"
 	}
 
 	sink := &ndjsonSink{
@@ -134,8 +250,72 @@ func newGCSNDJSONSink(ctx context.Context, endpoint, bucket, directory string) (
 		createFile:       createFile,
 		resourceChan:     make(chan ResourceWrapper, 100),
 		workerCompleteWG: &sync.WaitGroup{},
+		location:         "gs://" + gcs.JoinPath(cfg.Bucket, cfg.Directory),
+		fileLocation: func(filename string) string {
+			if cfg.Compress {
+				filename += ".gz"
+			}
+			return "gs://" + gcs.JoinPath(cfg.Bucket, cfg.Directory, filename)
+		},
 	}
 
+	worker := sink.writeWorker
+	if cfg.ComposeParts {
+		sink.composer = &gcsDirComposer{client: gcsClient, directory: cfg.Directory}
+		sink.fileSuffix = fileSuffix
+		sink.parts = map[string][]string{}
+		worker = sink.writePartsWorker
+	}
+	for i := 0; i < numWorkers; i++ {
+		go worker(i)
+		sink.workerCompleteWG.Add(1)
+	}
+	return sink, nil
+}
+
+// S3NDJSONSinkConfig defines the configuration passed to NewS3NDJSONSink.
+type S3NDJSONSinkConfig struct {
+	// Endpoint overrides the S3 endpoint of the configured AWS region, for
+	// example in tests.
+	Endpoint  string
+	Bucket    string
+	Directory string
+
+	// If true, files are gzip compressed, with a .ndjson.gz extension.
+	Compress bool
+}
+
+// NewS3NDJSONSink returns a Sink which writes NDJSON files to S3, as
+// configured by cfg, streaming each file in a multipart upload. See
+// NewNDJSONSink for additional documentation.
+func NewS3NDJSONSink(ctx context.Context, cfg *S3NDJSONSinkConfig) (Sink, error) {
+	s3Client, err := s3.NewClient(ctx, cfg.Bucket, cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// This closure captures the S3 client and the directory.
+	createFile := func(ctx context.Context, filename string) (io.WriteCloser, error) {
+		return s3Client.GetFileWriter(ctx, s3.JoinPath(cfg.Directory, filename)), nil
+	}
+	if cfg.Compress {
+		createFile = gzipCreateFile(createFile)
+	}
+
+	sink := &ndjsonSink{
+		workerErrMut:     &sync.Mutex{},
+		workerErr:        false,
+		createFile:       createFile,
+		resourceChan:     make(chan ResourceWrapper, 100),
+		workerCompleteWG: &sync.WaitGroup{},
+		location:         "s3://" + s3.JoinPath(cfg.Bucket, cfg.Directory),
+		fileLocation: func(filename string) string {
+			if cfg.Compress {
+				filename += ".gz"
+			}
+			return "s3://" + s3.JoinPath(cfg.Bucket, cfg.Directory, filename)
+		},
+	}
 	for i := 0; i < numWorkers; i++ {
 		go sink.writeWorker(i)
 		sink.workerCompleteWG.Add(1)
@@ -143,6 +323,20 @@ func newGCSNDJSONSink(ctx context.Context, endpoint, bucket, directory string) (
 	return sink, nil
 }
 
+// gcsDirComposer composes files relative to a GCS directory.
+type gcsDirComposer struct {
+	client    gcs.Client
+	directory string
+}
+
+func (c *gcsDirComposer) Compose(ctx context.Context, dst string, srcs []string) error {
+	fullSrcs := make([]string, len(srcs))
+	for i, src := range srcs {
+		fullSrcs[i] = gcs.JoinPath(c.directory, src)
+	}
+	return c.client.Compose(ctx, gcs.JoinPath(c.directory, dst), fullSrcs)
+}
+
 // Write writes the resource to the ndjsonSink. For an ndjsonSink or gcsNDJSONSink, Write is
 // non-blocking (other than writing to a channel), and may be called from multiple goroutines on
 // a single sink instance.
@@ -164,6 +358,7 @@ func (ns *ndjsonSink) Write(ctx context.Context, resource ResourceWrapper) error
 
 func (ns *ndjsonSink) writeWorker(workerID int) {
 	var currFileShard io.WriteCloser = nil
+	var currFileName string
 	var err error
 	itemsProcessed := 0
 	retryableErrCount := 0
@@ -182,7 +377,8 @@ func (ns *ndjsonSink) writeWorker(workerID int) {
 				}
 			}
 
-			currFileShard, err = ns.createFile(context.Background(), fmt.Sprintf("fhir_data_%d_%d.ndjson", workerID, itemsProcessed/numResourcesPerShard))
+			currFileName = fmt.Sprintf("fhir_data_%d_%d.ndjson", workerID, itemsProcessed/numResourcesPerShard)
+			currFileShard, err = ns.createFile(context.Background(), currFileName)
 			if err != nil {
 				log.Errorf("error creating file (ndjsonsink): %v", err)
 				recordNDJSONSinkError(errTypeFile)
@@ -222,6 +418,8 @@ func (ns *ndjsonSink) writeWorker(workerID int) {
 		}
 
 		itemsProcessed++
+		ns.written.Add(1)
+		ns.recordOutput(r, currFileName)
 	}
 
 	if currFileShard != nil {
@@ -235,6 +433,140 @@ func (ns *ndjsonSink) writeWorker(workerID int) {
 	ns.workerCompleteWG.Done()
 }
 
+// part is a part of a file being written by writePartsWorker.
+type part struct {
+	name string
+	w    io.WriteCloser
+	// n is the number of resources written to the part.
+	n int
+}
+
+// writePartsWorker writes resources to a part for each resource type, and
+// records each part in ns.parts once it has been written. A new part is
+// started every numResourcesPerShard resources. Unlike in writeWorker, errors
+// writing or closing a part are not retried, as the part's earlier contents
+// would be lost; instead the worker fails.
+func (ns *ndjsonSink) writePartsWorker(workerID int) {
+	defer ns.workerCompleteWG.Done()
+	openParts := map[string]*part{}
+	partIndex := 0
+	retryableErrCount := 0
+	fail := func(format string, args ...any) {
+		log.Errorf(format, args...)
+		recordNDJSONSinkError(errTypeFile)
+		ns.setWorkerErr()
+		// Close the remaining parts so their uploads finish, although the
+		// parts are not composed.
+		for _, p := range openParts {
+			p.w.Close()
+		}
+	}
+
+	for r := range ns.resourceChan {
+		file := resourceFileName(r.Type())
+		p := openParts[file]
+		// Close the part and start a new one, if needed.
+		if p == nil || p.n == numResourcesPerShard {
+			if p != nil {
+				delete(openParts, file)
+				if err := ns.closePart(file, p); err != nil {
+					fail("error closing file (ndjsonsink): %v", err)
+					return
+				}
+			}
+
+			name := fmt.Sprintf("parts/%s_%d_%d.ndjson", strings.TrimSuffix(file, ".ndjson"), workerID, partIndex)
+			w, err := ns.createFile(context.Background(), name)
+			if err != nil {
+				log.Errorf("error creating file (ndjsonsink): %v", err)
+				recordNDJSONSinkError(errTypeFile)
+				retryableErrCount++
+				if retryableErrCount >= retryableWorkerErrLimit {
+					fail("worker %d had too many retryable errors (%d), see logs for details", workerID, retryableWorkerErrLimit)
+					return
+				}
+				time.Sleep(time.Second)
+				ns.resourceChan <- r
+				continue
+			}
+			partIndex++
+			p = &part{name: name + ns.fileSuffix, w: w}
+			openParts[file] = p
+		}
+
+		json, err := r.JSON()
+		if err != nil {
+			log.Errorf("unable to get JSON for resource (ndjsonsink), will SKIP resource and continue: %v", err)
+			recordNDJSONSinkError(errTypeJSONMarshal)
+			continue
+		}
+		if _, err := p.w.Write(append(json, byte('\n'))); err != nil {
+			fail("error writing FHIR resource to file (ndjsonsink): %v", err)
+			return
+		}
+		p.n++
+		ns.written.Add(1)
+		// The resource ends up in the file the parts are composed into.
+		ns.recordOutput(r, file)
+	}
+
+	for file, p := range openParts {
+		delete(openParts, file)
+		if err := ns.closePart(file, p); err != nil {
+			fail("error closing file (ndjsonsink): %v", err)
+		}
+	}
+}
+
+// closePart closes p, and if successful records it as a part of file.
+func (ns *ndjsonSink) closePart(file string, p *part) error {
+	if err := p.w.Close(); err != nil {
+		return err
+	}
+	ns.partsMut.Lock()
+	defer ns.partsMut.Unlock()
+	ns.parts[file] = append(ns.parts[file], p.name)
+	return nil
+}
+
+// composeParts composes the parts of each file written by writePartsWorker.
+func (ns *ndjsonSink) composeParts(ctx context.Context) error {
+	ns.partsMut.Lock()
+	defer ns.partsMut.Unlock()
+	for file, parts := range ns.parts {
+		if err := ns.composer.Compose(ctx, file+ns.fileSuffix, parts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resourceFileName returns the name of the file resources of the given type
+// are composed into, for example Patient.ndjson.
+func resourceFileName(resourceType cpb.ResourceTypeCode_Value) string {
+	name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+	if err != nil {
+		name = resourceType.String()
+	}
+	return name + ".ndjson"
+}
+
+// recordOutput records that the resource was written to the named file, if
+// its lineage is recorded.
+func (ns *ndjsonSink) recordOutput(r ResourceWrapper, filename string) {
+	if ns.fileLocation == nil {
+		return
+	}
+	if l := lineageOf(r); l != nil {
+		l.recordOutput(ns.fileLocation(filename))
+	}
+}
+
+// CompletionToken is Completer.CompletionToken.
+func (ns *ndjsonSink) CompletionToken() string {
+	return fmt.Sprintf("ndjson %s: %d resources", ns.location, ns.written.Load())
+}
+
 func (ns *ndjsonSink) setWorkerErr() {
 	ns.workerErrMut.Lock()
 	ns.workerErr = true
@@ -251,6 +583,9 @@ func (ns *ndjsonSink) Finalize(ctx context.Context) error {
 		return ErrWorkerError
 	}
 
+	if ns.composer != nil {
+		return ns.composeParts(ctx)
+	}
 	return nil
 }
 
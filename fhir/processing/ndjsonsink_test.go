@@ -15,10 +15,16 @@
 package processing_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 
@@ -68,6 +74,11 @@ func TestNDJSONSink(t *testing.T) {
 	if !cmp.Equal(gotData, wantDataLines, cmpopts.SortSlices(func(a, b []byte) bool { return string(a) < string(b) })) {
 		t.Errorf("unexpected data in file shards. got: %v, want: %v", gotData, wantDataLines)
 	}
+
+	wantToken := fmt.Sprintf("ndjson %s: 4 resources", tempdir)
+	if got := sink.(processing.Completer).CompletionToken(); got != wantToken {
+		t.Errorf("CompletionToken() = %q, want %q", got, wantToken)
+	}
 }
 
 // Note: the logic for the GCS variant is mostly the same as for the local file
@@ -117,6 +128,222 @@ func TestGCSNDJSONSink(t *testing.T) {
 
 }
 
+func TestS3NDJSONSink(t *testing.T) {
+	ctx := context.Background()
+	testdata := []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_ACCOUNT, sourceURL: "url1", json: []byte("foo")},
+		{resourceType: cpb.ResourceTypeCode_ACCOUNT, sourceURL: "url1", json: []byte("bar")},
+		{resourceType: cpb.ResourceTypeCode_PATIENT, sourceURL: "url3", json: []byte("qux")},
+	}
+
+	testhelpers.SetFakeAWSCredentials(t)
+	s3Server := testhelpers.NewS3Server(t)
+
+	sink, err := processing.NewS3NDJSONSink(ctx, &processing.S3NDJSONSinkConfig{
+		Endpoint:  s3Server.URL(),
+		Bucket:    "bucket",
+		Directory: "directory",
+		Compress:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, td := range testdata {
+		td := td
+		if err := sink.Write(ctx, &td); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("error in Finalize: %v", err)
+	}
+
+	var gotData [][]byte
+	for _, path := range s3Server.GetAllPaths() {
+		name, ok := strings.CutPrefix(path, "s3://bucket/directory/")
+		if !ok || !strings.HasSuffix(name, ".ndjson.gz") {
+			t.Errorf("unexpected S3 object %s", path)
+			continue
+		}
+		data, _ := s3Server.GetObject("bucket", "directory/"+name)
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("gzip.NewReader(%s): %v", path, err)
+		}
+		uncompressed, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+		gotData = append(gotData, bytes.Split(bytes.TrimSpace(uncompressed), []byte("\n"))...)
+	}
+
+	wantDataLines := [][]byte{[]byte("foo"), []byte("bar"), []byte("qux")}
+	if !cmp.Equal(gotData, wantDataLines, cmpopts.SortSlices(func(a, b []byte) bool { return string(a) < string(b) })) {
+		t.Errorf("unexpected data in file shards. got: %s, want: %s", gotData, wantDataLines)
+	}
+}
+
+func TestGCSNDJSONSink_ComposeParts(t *testing.T) {
+	ctx := context.Background()
+	// Enough accounts for several parts, written by several workers.
+	var testdata []testResourceWrapper
+	wantAccounts := map[string]bool{}
+	for i := 0; i < 2500; i++ {
+		json := fmt.Sprintf("account%d", i)
+		testdata = append(testdata, testResourceWrapper{resourceType: cpb.ResourceTypeCode_ACCOUNT, sourceURL: "url1", json: []byte(json)})
+		wantAccounts[json] = true
+	}
+	testdata = append(testdata, testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, sourceURL: "url2", json: []byte("patient")})
+	wantPatients := map[string]bool{"patient": true}
+
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			gcsServer := testhelpers.NewGCSServer(t)
+			sink, err := processing.NewGCSNDJSONSinkFromConfig(ctx, &processing.GCSNDJSONSinkConfig{
+				Endpoint:     gcsServer.URL(),
+				Bucket:       "bucket",
+				Directory:    "directory",
+				Compress:     compress,
+				ComposeParts: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, td := range testdata {
+				td := td
+				if err := sink.Write(ctx, &td); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := sink.Finalize(ctx); err != nil {
+				t.Fatalf("error in Finalize: %v", err)
+			}
+
+			suffix := ""
+			if compress {
+				suffix = ".gz"
+			}
+			wantPaths := []string{"gs://bucket/directory/Account.ndjson" + suffix, "gs://bucket/directory/Patient.ndjson" + suffix}
+			if diff := cmp.Diff(wantPaths, gcsServer.GetAllPaths(), cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Errorf("unexpected objects after Finalize (-want +got): %s", diff)
+			}
+
+			for name, want := range map[string]map[string]bool{"Account": wantAccounts, "Patient": wantPatients} {
+				obj, ok := gcsServer.GetObject("bucket", "directory/"+name+".ndjson"+suffix)
+				if !ok {
+					continue
+				}
+				data := obj.Data
+				if compress {
+					// The composed file is a gzip member per part, which is itself a
+					// valid gzip file.
+					r, err := gzip.NewReader(bytes.NewReader(data))
+					if err != nil {
+						t.Fatalf("could not decompress %s: %v", name, err)
+					}
+					if data, err = io.ReadAll(r); err != nil {
+						t.Fatalf("could not decompress %s: %v", name, err)
+					}
+				}
+				lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+				if len(lines) != len(want) {
+					t.Errorf("%s has %d lines, want %d", name, len(lines), len(want))
+				}
+				got := map[string]bool{}
+				for _, line := range lines {
+					got[line] = true
+				}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("unexpected resources in %s (-want +got): %s", name, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressedNDJSONSink(t *testing.T) {
+	ctx := context.Background()
+	testdata := []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_ACCOUNT, sourceURL: "url1", json: []byte("foo")},
+		{resourceType: cpb.ResourceTypeCode_PATIENT, sourceURL: "url2", json: []byte("bar")},
+	}
+	wantDataLines := [][]byte{[]byte("foo"), []byte("bar")}
+	sortLines := cmpopts.SortSlices(func(a, b []byte) bool { return string(a) < string(b) })
+
+	t.Run("local", func(t *testing.T) {
+		tempdir := t.TempDir()
+		sink, err := processing.NewCompressedNDJSONSink(ctx, tempdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, td := range testdata {
+			td := td
+			if err := sink.Write(ctx, &td); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sink.Finalize(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := filepath.Glob(filepath.Join(tempdir, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if !strings.HasSuffix(f, ".ndjson.gz") {
+				t.Errorf("unexpected output file %s, want a .ndjson.gz file", f)
+			}
+		}
+		gotData := testhelpers.ReadAllFHIRJSON(t, tempdir, false)
+		if !cmp.Equal(gotData, wantDataLines, sortLines) {
+			t.Errorf("unexpected data in file shards. got: %s, want: %s", gotData, wantDataLines)
+		}
+	})
+
+	t.Run("GCS", func(t *testing.T) {
+		gcsServer := testhelpers.NewGCSServer(t)
+		sink, err := processing.NewGCSCompressedNDJSONSink(ctx, gcsServer.URL(), "bucket", "directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, td := range testdata {
+			td := td
+			if err := sink.Write(ctx, &td); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sink.Finalize(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		var gotData [][]byte
+		for _, p := range gcsServer.GetAllPaths() {
+			if !strings.HasSuffix(p, ".ndjson.gz") {
+				t.Errorf("unexpected output object %s, want a .ndjson.gz object", p)
+				continue
+			}
+			obj, _ := gcsServer.GetObject("bucket", strings.TrimPrefix(p, "gs://bucket/"))
+			r, err := gzip.NewReader(bytes.NewReader(obj.Data))
+			if err != nil {
+				t.Fatalf("could not decompress %s: %v", p, err)
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("could not decompress %s: %v", p, err)
+			}
+			for _, line := range bytes.Split(data, []byte("\n")) {
+				if len(line) > 0 {
+					gotData = append(gotData, line)
+				}
+			}
+		}
+		if !cmp.Equal(gotData, wantDataLines, sortLines) {
+			t.Errorf("unexpected data in file shards. got: %s, want: %s", gotData, wantDataLines)
+		}
+	})
+}
+
 func TestNDJSONSink_WorkerError(t *testing.T) {
 	// This test will pass a fake GCS server that always returns errors.
 	ctx := context.Background()
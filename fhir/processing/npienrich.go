@@ -0,0 +1,205 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	ppb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/practitioner_go_proto"
+)
+
+const (
+	// NPISystem is the identifier system of National Provider Identifiers.
+	NPISystem = "http://hl7.org/fhir/sid/us-npi"
+	// TaxonomySystem is the code system of the NUCC Health Care Provider
+	// Taxonomy, which the NPI registry records for each provider.
+	TaxonomySystem = "http://nucc.org/provider-taxonomy"
+	// DefaultNPIRegistryURL is the URL of the API of the CMS NPI registry.
+	DefaultNPIRegistryURL = "https://npiregistry.cms.hhs.gov/api/"
+)
+
+// NPIRecord holds the details of a provider held by the NPI registry.
+type NPIRecord struct {
+	Taxonomies []NPITaxonomy `json:"taxonomies"`
+}
+
+// NPITaxonomy is a provider taxonomy recorded for an NPI.
+type NPITaxonomy struct {
+	Code    string `json:"code"`
+	Desc    string `json:"desc"`
+	Primary bool   `json:"primary"`
+}
+
+// primaryTaxonomy returns the taxonomy marked primary, or the first if none
+// is, or nil if there are none.
+func (r *NPIRecord) primaryTaxonomy() *NPITaxonomy {
+	for i := range r.Taxonomies {
+		if r.Taxonomies[i].Primary {
+			return &r.Taxonomies[i]
+		}
+	}
+	if len(r.Taxonomies) > 0 {
+		return &r.Taxonomies[0]
+	}
+	return nil
+}
+
+// NPILookup looks up National Provider Identifiers.
+type NPILookup interface {
+	// LookupNPI returns the record of the NPI, or nil if it is not found.
+	LookupNPI(ctx context.Context, npi string) (*NPIRecord, error)
+}
+
+type npiRegistryLookup struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewNPIRegistryLookup returns an NPILookup which queries the API of the NPI
+// registry at baseURL, such as DefaultNPIRegistryURL, with httpClient.
+func NewNPIRegistryLookup(baseURL string, httpClient *http.Client) NPILookup {
+	return &npiRegistryLookup{baseURL: baseURL, httpClient: httpClient}
+}
+
+func (nrl *npiRegistryLookup) LookupNPI(ctx context.Context, npi string) (*NPIRecord, error) {
+	u, err := url.Parse(nrl.baseURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("version", "2.1")
+	q.Set("number", npi)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := nrl.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("NPI registry returned unexpected status %s", resp.Status)
+	}
+	var body struct {
+		Results []*NPIRecord `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("could not parse NPI registry response: %w", err)
+	}
+	if len(body.Results) == 0 {
+		return nil, nil
+	}
+	return body.Results[0], nil
+}
+
+type npiEnricher struct {
+	cache *lookupCache[NPIRecord]
+}
+
+// NewNPIEnricher returns an Enricher which looks up the NPI identifier of
+// Practitioner and Organization resources, and adds the provider's primary
+// taxonomy from the NPI registry, as a coding with the system TaxonomySystem,
+// to Practitioner.qualification or Organization.type. Resources which already
+// have the coding, or which have no NPI, are left unchanged. Lookups are
+// cached, so that each NPI is looked up once.
+func NewNPIEnricher(lookup NPILookup) Enricher {
+	return &npiEnricher{cache: newLookupCache(lookup.LookupNPI)}
+}
+
+func (ne *npiEnricher) Name() string { return "NPI" }
+
+func (ne *npiEnricher) Enrich(ctx context.Context, resource ResourceWrapper) (bool, error) {
+	if resource.Type() != cpb.ResourceTypeCode_PRACTITIONER && resource.Type() != cpb.ResourceTypeCode_ORGANIZATION {
+		return false, nil
+	}
+	cr, err := resource.Proto()
+	if err != nil {
+		return false, err
+	}
+	var identifiers []*dpb.Identifier
+	if p := cr.GetPractitioner(); p != nil {
+		identifiers = p.GetIdentifier()
+	} else if o := cr.GetOrganization(); o != nil {
+		identifiers = o.GetIdentifier()
+	} else {
+		return false, errors.New("resource was not Practitioner or Organization")
+	}
+	npi := ""
+	for _, id := range identifiers {
+		if id.GetSystem().GetValue() == NPISystem && id.GetValue().GetValue() != "" {
+			npi = id.GetValue().GetValue()
+			break
+		}
+	}
+	if npi == "" {
+		return false, nil
+	}
+	record, err := ne.cache.get(ctx, npi)
+	if err != nil {
+		return false, fmt.Errorf("%w: NPI %s: %v", ErrEnrichmentLookup, npi, err)
+	}
+	if record == nil {
+		return false, nil
+	}
+	taxonomy := record.primaryTaxonomy()
+	if taxonomy == nil {
+		return false, nil
+	}
+	coding := &dpb.Coding{
+		System:  &dpb.Uri{Value: TaxonomySystem},
+		Code:    &dpb.Code{Value: taxonomy.Code},
+		Display: &dpb.String{Value: taxonomy.Desc},
+	}
+
+	if p := cr.GetPractitioner(); p != nil {
+		for _, q := range p.GetQualification() {
+			if hasCoding(q.GetCode(), coding) {
+				return false, nil
+			}
+		}
+		p.Qualification = append(p.Qualification, &ppb.Practitioner_Qualification{
+			Code: &dpb.CodeableConcept{Coding: []*dpb.Coding{coding}},
+		})
+		return true, nil
+	}
+	o := cr.GetOrganization()
+	for _, t := range o.GetType() {
+		if hasCoding(t, coding) {
+			return false, nil
+		}
+	}
+	o.Type = append(o.Type, &dpb.CodeableConcept{Coding: []*dpb.Coding{coding}})
+	return true, nil
+}
+
+// hasCoding returns whether cc has a coding with the same system and code as
+// coding.
+func hasCoding(cc *dpb.CodeableConcept, coding *dpb.Coding) bool {
+	for _, c := range cc.GetCoding() {
+		if c.GetSystem().GetValue() == coding.GetSystem().GetValue() && c.GetCode().GetValue() == coding.GetCode().GetValue() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,306 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/gcs"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// PartitionedNDJSONSinkConfig defines the configuration passed to
+// NewPartitionedNDJSONSink.
+type PartitionedNDJSONSinkConfig struct {
+	// Directory is either a local directory, which must exist, or a GCS path of
+	// the form gs://bucket/folder_path.
+	Directory   string
+	GCSEndpoint string
+
+	// Source identifies the bulk FHIR server the data came from, as the value
+	// of the source partition key.
+	Source string
+	// RunID identifies the run, and names the files it writes, so that runs on
+	// the same day do not overwrite each other's files.
+	RunID string
+	// RunTime determines the run_date partition resources are written to.
+	// Typically this is the start time of the run.
+	RunTime time.Time
+
+	// MaxFileBytes is the size after which a new file is started in the
+	// partition. If zero, a default of 256MiB is used.
+	MaxFileBytes int64
+}
+
+// partitionManifest lists the files in a partition written by a partitioned
+// NDJSON sink. Only files listed in the manifest are complete.
+type partitionManifest struct {
+	Source       string                    `json:"source"`
+	RunDate      string                    `json:"runDate"`
+	ResourceType string                    `json:"resourceType"`
+	Files        []*partitionManifestEntry `json:"files"`
+}
+
+type partitionManifestEntry struct {
+	// Path is relative to the partition directory.
+	Path      string    `json:"path"`
+	RunID     string    `json:"runID"`
+	Resources int64     `json:"resources"`
+	Bytes     int64     `json:"bytes"`
+	Written   time.Time `json:"written"`
+}
+
+type partitionedNDJSONSink struct {
+	store        appendFileStore
+	directory    string
+	source       string
+	runID        string
+	date         string
+	maxFileBytes int64
+
+	// mu must be held when accessing the fields below.
+	mu sync.Mutex
+	// open holds the file currently being written for each resource type.
+	open map[cpb.ResourceTypeCode_Value]*partitionFile
+	// written holds the manifest entries of the files written for each
+	// resource type, including those still open.
+	written map[cpb.ResourceTypeCode_Value][]*partitionManifestEntry
+}
+
+type partitionFile struct {
+	entry *partitionManifestEntry
+	index int
+	w     io.WriteCloser
+}
+
+// NewPartitionedNDJSONSink creates a new Sink which writes resources to NDJSON
+// files in a Hive partitioned layout, so that BigQuery external tables and
+// other loaders can discover the data of each run without listing the
+// directory themselves. Resources are written to
+// source=<Source>/run_date=<YYYY-MM-DD>/type=<ResourceType>/<RunID>_<index>.ndjson,
+// where the date is that of RunTime in UTC, and the index is incremented
+// whenever a file reaches MaxFileBytes.
+//
+// Each partition has a manifest.json listing its files, along with the run
+// which wrote them and their size, which is updated when the sink is
+// finalized. Files written by a run which fails before finalizing are not
+// listed. Only one run should write to each source at a time.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+func NewPartitionedNDJSONSink(ctx context.Context, cfg *PartitionedNDJSONSinkConfig) (Sink, error) {
+	if cfg.Source == "" || strings.ContainsAny(cfg.Source, "/=") {
+		return nil, fmt.Errorf("invalid partition source %q: it must be non-empty, and not contain / or =", cfg.Source)
+	}
+	if cfg.RunID == "" {
+		return nil, errors.New("a run ID is required to name the files in each partition")
+	}
+	store, err := newAppendFileStore(ctx, cfg.Directory, cfg.GCSEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	pns := &partitionedNDJSONSink{
+		store:        store,
+		directory:    cfg.Directory,
+		source:       cfg.Source,
+		runID:        cfg.RunID,
+		date:         cfg.RunTime.UTC().Format("2006-01-02"),
+		maxFileBytes: defaultMaxNDJSONFileBytes,
+		open:         map[cpb.ResourceTypeCode_Value]*partitionFile{},
+		written:      map[cpb.ResourceTypeCode_Value][]*partitionManifestEntry{},
+	}
+	if cfg.MaxFileBytes > 0 {
+		pns.maxFileBytes = cfg.MaxFileBytes
+	}
+	return pns, nil
+}
+
+// Write is Sink.Write.
+func (pns *partitionedNDJSONSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	json, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	line := append(json, '\n')
+
+	pns.mu.Lock()
+	defer pns.mu.Unlock()
+	f, err := pns.fileFor(ctx, resource.Type(), int64(len(line)))
+	if err != nil {
+		return err
+	}
+	if _, err := f.w.Write(line); err != nil {
+		return fmt.Errorf("error writing FHIR resource to %s: %w", f.entry.Path, err)
+	}
+	f.entry.Resources++
+	f.entry.Bytes += int64(len(line))
+	if l := lineageOf(resource); l != nil {
+		name, _ := bulkfhir.ResourceTypeCodeToName(resource.Type())
+		l.recordOutput(pns.location(path.Join(pns.partition(name), f.entry.Path)))
+	}
+	return nil
+}
+
+// fileFor returns the file to write the next resource of the given type to,
+// starting a new file if writing lineBytes would exceed the maximum file size.
+// mu must be held.
+func (pns *partitionedNDJSONSink) fileFor(ctx context.Context, rt cpb.ResourceTypeCode_Value, lineBytes int64) (*partitionFile, error) {
+	index := 0
+	if f, ok := pns.open[rt]; ok {
+		if f.entry.Bytes == 0 || f.entry.Bytes+lineBytes <= pns.maxFileBytes {
+			return f, nil
+		}
+		if err := f.w.Close(); err != nil {
+			return nil, fmt.Errorf("error closing %s: %w", f.entry.Path, err)
+		}
+		delete(pns.open, rt)
+		index = f.index + 1
+	}
+	name, err := bulkfhir.ResourceTypeCodeToName(rt)
+	if err != nil {
+		return nil, err
+	}
+	entry := &partitionManifestEntry{Path: fmt.Sprintf("%s_%d.ndjson", pns.runID, index), RunID: pns.runID}
+	w, err := pns.store.openAppend(ctx, path.Join(pns.partition(name), entry.Path), 0)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", entry.Path, err)
+	}
+	f := &partitionFile{entry: entry, index: index, w: w}
+	pns.open[rt] = f
+	pns.written[rt] = append(pns.written[rt], entry)
+	return f, nil
+}
+
+// partition returns the directory of the partition of a resource type,
+// relative to the output directory.
+func (pns *partitionedNDJSONSink) partition(resourceType string) string {
+	return path.Join("source="+pns.source, "run_date="+pns.date, "type="+resourceType)
+}
+
+// location returns the path or URI of a file relative to the output
+// directory.
+func (pns *partitionedNDJSONSink) location(name string) string {
+	if strings.HasPrefix(pns.directory, "gs://") {
+		return "gs://" + gcs.JoinPath(strings.TrimPrefix(pns.directory, "gs://"), name)
+	}
+	return path.Join(pns.directory, name)
+}
+
+// Finalize is Sink.Finalize. This closes all open files, and then adds them
+// to the manifests of their partitions.
+func (pns *partitionedNDJSONSink) Finalize(ctx context.Context) error {
+	pns.mu.Lock()
+	defer pns.mu.Unlock()
+	var errs []error
+	for rt, f := range pns.open {
+		if err := f.w.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing %s: %w", f.entry.Path, err))
+		}
+		delete(pns.open, rt)
+	}
+	if len(errs) > 0 {
+		// Leave the manifests unchanged, so that the partially written files are
+		// not listed.
+		return errors.Join(errs...)
+	}
+
+	var names []string
+	entries := map[string][]*partitionManifestEntry{}
+	for rt, written := range pns.written {
+		name, err := bulkfhir.ResourceTypeCodeToName(rt)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		entries[name] = written
+	}
+	sort.Strings(names)
+	now := time.Now().UTC()
+	for _, name := range names {
+		if err := pns.updateManifest(ctx, name, entries[name], now); err != nil {
+			return err
+		}
+	}
+	log.Infof("Updated the manifests of %d partitions under %s.", len(names), pns.location("source="+pns.source))
+	return nil
+}
+
+// updateManifest adds the entries of the files written by this run to the
+// manifest of the partition of a resource type. mu must be held.
+func (pns *partitionedNDJSONSink) updateManifest(ctx context.Context, resourceType string, written []*partitionManifestEntry, now time.Time) error {
+	name := path.Join(pns.partition(resourceType), NDJSONManifestFile)
+	data, err := pns.store.readFile(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to read partition manifest %s: %w", name, err)
+	}
+	manifest := &partitionManifest{}
+	if data != nil {
+		if err := json.Unmarshal(data, manifest); err != nil {
+			return fmt.Errorf("failed to parse partition manifest %s: %w", name, err)
+		}
+	}
+	manifest.Source, manifest.RunDate, manifest.ResourceType = pns.source, pns.date, resourceType
+
+	// Replace the entries of files written again, such as by a retry of a run
+	// with the same ID.
+	for _, e := range written {
+		e.Written = now
+		i := slices.IndexFunc(manifest.Files, func(f *partitionManifestEntry) bool { return f.Path == e.Path })
+		if i < 0 {
+			manifest.Files = append(manifest.Files, e)
+		} else {
+			manifest.Files[i] = e
+		}
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+
+	data, err = json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := pns.store.replaceFile(ctx, name, data); err != nil {
+		return fmt.Errorf("failed to update partition manifest %s: %w", name, err)
+	}
+	return nil
+}
+
+// CompletionToken is Completer.CompletionToken.
+func (pns *partitionedNDJSONSink) CompletionToken() string {
+	pns.mu.Lock()
+	defer pns.mu.Unlock()
+	var files int
+	var resources int64
+	for _, written := range pns.written {
+		for _, e := range written {
+			files++
+			resources += e.Resources
+		}
+	}
+	return fmt.Sprintf("partitioned ndjson %s: %d files of %d resources in %d partitions of run_date=%s", pns.location("source="+pns.source), files, resources, len(pns.written), pns.date)
+}
@@ -0,0 +1,199 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+type partitionManifest struct {
+	Source       string                   `json:"source"`
+	RunDate      string                   `json:"runDate"`
+	ResourceType string                   `json:"resourceType"`
+	Files        []partitionManifestEntry `json:"files"`
+}
+
+type partitionManifestEntry struct {
+	Path      string `json:"path"`
+	RunID     string `json:"runID"`
+	Resources int64  `json:"resources"`
+	Bytes     int64  `json:"bytes"`
+}
+
+func readPartitionManifest(t *testing.T, data []byte) partitionManifest {
+	t.Helper()
+	var m partitionManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("failed to parse partition manifest: %v", err)
+	}
+	return m
+}
+
+func runPartitionedNDJSONSink(t *testing.T, cfg *processing.PartitionedNDJSONSinkConfig, resources []testResourceWrapper, finalize bool) {
+	t.Helper()
+	ctx := context.Background()
+	sink, err := processing.NewPartitionedNDJSONSink(ctx, cfg)
+	if err != nil {
+		t.Fatalf("NewPartitionedNDJSONSink() returned unexpected error: %v", err)
+	}
+	for _, r := range resources {
+		r := r
+		if err := sink.Write(ctx, &r); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if !finalize {
+		return
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+}
+
+func TestPartitionedNDJSONSink(t *testing.T) {
+	dir := t.TempDir()
+	day1 := time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC)
+	// Allows two of the resources below per file.
+	cfg := &processing.PartitionedNDJSONSinkConfig{Directory: dir, Source: "bcda", RunID: "run1", RunTime: day1, MaxFileBytes: 8}
+
+	runPartitionedNDJSONSink(t, cfg, []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p1a")},
+		{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte("o1a")},
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p1b")},
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p1c")},
+	}, true)
+	// A run which fails before finalizing; its file is not listed.
+	cfg.RunID = "failed"
+	runPartitionedNDJSONSink(t, cfg, []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("bad")},
+	}, false)
+	cfg.RunID = "run2"
+	runPartitionedNDJSONSink(t, cfg, []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p2a")},
+	}, true)
+	cfg.RunID, cfg.RunTime = "run3", day1.Add(2*time.Hour)
+	runPartitionedNDJSONSink(t, cfg, []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p3a")},
+	}, true)
+
+	wantFiles := map[string]string{
+		"source=bcda/run_date=2024-01-02/type=Observation/run1_0.ndjson": "o1a\n",
+		"source=bcda/run_date=2024-01-02/type=Patient/run1_0.ndjson":     "p1a\np1b\n",
+		"source=bcda/run_date=2024-01-02/type=Patient/run1_1.ndjson":     "p1c\n",
+		"source=bcda/run_date=2024-01-02/type=Patient/run2_0.ndjson":     "p2a\n",
+		"source=bcda/run_date=2024-01-03/type=Patient/run3_0.ndjson":     "p3a\n",
+	}
+	for name, want := range wantFiles {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("failed to read %s: %v", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("unexpected content of %s. got: %q, want: %q", name, got, want)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "source=bcda/run_date=2024-01-02/type=Patient", processing.NDJSONManifestFile))
+	if err != nil {
+		t.Fatalf("failed to read partition manifest: %v", err)
+	}
+	got := readPartitionManifest(t, data)
+	want := partitionManifest{
+		Source:       "bcda",
+		RunDate:      "2024-01-02",
+		ResourceType: "Patient",
+		Files: []partitionManifestEntry{
+			{Path: "run1_0.ndjson", RunID: "run1", Resources: 2, Bytes: 8},
+			{Path: "run1_1.ndjson", RunID: "run1", Resources: 1, Bytes: 4},
+			{Path: "run2_0.ndjson", RunID: "run2", Resources: 1, Bytes: 4},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected partition manifest (-want +got): %s", diff)
+	}
+
+	for _, partition := range []string{"source=bcda/run_date=2024-01-02/type=Observation", "source=bcda/run_date=2024-01-03/type=Patient"} {
+		data, err := os.ReadFile(filepath.Join(dir, partition, processing.NDJSONManifestFile))
+		if err != nil {
+			t.Fatalf("failed to read partition manifest: %v", err)
+		}
+		if got := readPartitionManifest(t, data); len(got.Files) != 1 {
+			t.Errorf("partition manifest of %s lists %d files, want 1", partition, len(got.Files))
+		}
+	}
+}
+
+func TestPartitionedNDJSONSink_GCS(t *testing.T) {
+	gcsServer := testhelpers.NewGCSServer(t)
+	cfg := &processing.PartitionedNDJSONSinkConfig{
+		Directory:   "gs://bucket/dir",
+		GCSEndpoint: gcsServer.URL(),
+		Source:      "bcda",
+		RunID:       "run1",
+		RunTime:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	runPartitionedNDJSONSink(t, cfg, []testResourceWrapper{{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p1")}}, true)
+	cfg.RunID = "run2"
+	runPartitionedNDJSONSink(t, cfg, []testResourceWrapper{{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p2")}}, true)
+
+	for name, want := range map[string]string{
+		"dir/source=bcda/run_date=2024-01-02/type=Patient/run1_0.ndjson": "p1\n",
+		"dir/source=bcda/run_date=2024-01-02/type=Patient/run2_0.ndjson": "p2\n",
+	} {
+		obj, ok := gcsServer.GetObject("bucket", name)
+		if !ok {
+			t.Errorf("GCS object %s not found", name)
+			continue
+		}
+		if got := string(obj.Data); got != want {
+			t.Errorf("unexpected content of GCS object %s. got: %q, want: %q", name, got, want)
+		}
+	}
+	obj, ok := gcsServer.GetObject("bucket", "dir/source=bcda/run_date=2024-01-02/type=Patient/"+processing.NDJSONManifestFile)
+	if !ok {
+		t.Fatalf("GCS partition manifest not found")
+	}
+	var gotPaths []string
+	for _, f := range readPartitionManifest(t, obj.Data).Files {
+		gotPaths = append(gotPaths, f.Path)
+	}
+	if diff := cmp.Diff([]string{"run1_0.ndjson", "run2_0.ndjson"}, gotPaths); diff != "" {
+		t.Errorf("unexpected files in partition manifest (-want +got): %s", diff)
+	}
+}
+
+func TestNewPartitionedNDJSONSink_Invalid(t *testing.T) {
+	for _, cfg := range []*processing.PartitionedNDJSONSinkConfig{
+		{Directory: t.TempDir(), Source: "", RunID: "run1"},
+		{Directory: t.TempDir(), Source: "a/b", RunID: "run1"},
+		{Directory: t.TempDir(), Source: "bcda"},
+	} {
+		if _, err := processing.NewPartitionedNDJSONSink(context.Background(), cfg); err == nil {
+			t.Errorf("NewPartitionedNDJSONSink(%+v) succeeded, want error", cfg)
+		}
+	}
+}
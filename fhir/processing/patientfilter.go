@@ -0,0 +1,281 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+var fhirPatientFilterDroppedCounter *metrics.Counter = metrics.NewCounter("fhir-patient-filter-dropped-counter", "Count of FHIR Resources which were dropped by the patient allowlist or denylist. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+// patientFilterFields are the fields which the patient filter follows to find
+// the patient a resource belongs to, such as Observation.subject,
+// ExplanationOfBenefit.patient and Coverage.beneficiary.
+var patientFilterFields = []protoreflect.Name{"subject", "patient", "beneficiary"}
+
+// PatientList is a list of patients, by ID or by identifier, for the processor
+// returned by NewPatientFilterProcessor.
+//
+// Resources reference patients by ID, so patients listed by identifier, such
+// as by Medicare Beneficiary Identifier, are resolved to their IDs when their
+// Patient resource is seen. PatientList is also a Sink which does just that, to
+// resolve the identifiers from an export of Patient before the resources that
+// reference them are filtered.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+type PatientList struct {
+	mu          sync.Mutex
+	ids         map[string]bool
+	identifiers map[string]bool
+}
+
+// Assert PatientList satisfies the Sink interface.
+var _ Sink = &PatientList{}
+
+// NewPatientList returns a PatientList of the given entries. Each entry is
+// either a Patient ID, or an identifier of the form system|value, such as
+// http://hl7.org/fhir/sid/us-mbi|1S00E00AA00.
+func NewPatientList(entries []string) (*PatientList, error) {
+	pl := &PatientList{ids: map[string]bool{}, identifiers: map[string]bool{}}
+	for _, e := range entries {
+		if system, value, ok := strings.Cut(e, "|"); ok {
+			if system == "" || value == "" {
+				return nil, fmt.Errorf("invalid patient identifier %q, must be of the form system|value", e)
+			}
+			pl.identifiers[e] = true
+			continue
+		}
+		if e == "" || strings.Contains(e, "/") {
+			return nil, fmt.Errorf("invalid patient ID %q", e)
+		}
+		pl.ids[e] = true
+	}
+	if len(pl.ids) == 0 && len(pl.identifiers) == 0 {
+		return nil, errors.New("the patient list is empty")
+	}
+	return pl, nil
+}
+
+// ReadPatientList reads a PatientList from a local file with one entry per
+// line; see NewPatientList. Blank lines and lines starting with # are ignored.
+func ReadPatientList(path string) (*PatientList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", path, err)
+	}
+	pl, err := NewPatientList(entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return pl, nil
+}
+
+// HasIdentifiers returns whether any patients are listed by identifier.
+func (pl *PatientList) HasIdentifiers() bool {
+	return len(pl.identifiers) > 0
+}
+
+// Write resolves the ID of the resource if it is a Patient listed by
+// identifier; other resources are ignored.
+func (pl *PatientList) Write(ctx context.Context, resource ResourceWrapper) error {
+	if resource.Type() != cpb.ResourceTypeCode_PATIENT || !pl.HasIdentifiers() {
+		return nil
+	}
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var patient struct {
+		ID         string `json:"id"`
+		Identifier []struct {
+			System string `json:"system"`
+			Value  string `json:"value"`
+		} `json:"identifier"`
+	}
+	if err := json.Unmarshal(data, &patient); err != nil {
+		return err
+	}
+	for _, i := range patient.Identifier {
+		if pl.identifiers[i.System+"|"+i.Value] {
+			pl.addID(patient.ID)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Finalize is Sink.Finalize.
+func (pl *PatientList) Finalize(ctx context.Context) error {
+	return nil
+}
+
+func (pl *PatientList) addID(id string) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.ids[id] = true
+}
+
+func (pl *PatientList) containsID(id string) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.ids[id]
+}
+
+func (pl *PatientList) containsIdentifier(i *dpb.Identifier) bool {
+	return i != nil && pl.identifiers[i.GetSystem().GetValue()+"|"+i.GetValue().GetValue()]
+}
+
+// containsReference returns whether the reference is to a listed Patient, by
+// ID or by identifier.
+func (pl *PatientList) containsReference(ref *dpb.Reference) bool {
+	if rt, id, _, ok := referenceTarget(ref); ok {
+		return rt == "Patient" && pl.containsID(id)
+	}
+	return pl.containsIdentifier(ref.GetIdentifier())
+}
+
+type patientFilterProcessor struct {
+	BaseProcessor
+	list    *PatientList
+	deny    bool
+	dropped atomic.Int64
+}
+
+// Assert patientFilterProcessor satisfies the Processor interface.
+var _ Processor = &patientFilterProcessor{}
+
+// NewPatientFilterProcessor creates a Processor which only keeps the resources
+// belonging to the patients in the list, or if deny is true, drops them, such
+// as to limit a research export to an IRB-approved cohort.
+//
+// A Patient belongs to itself, and a listed Patient's identifiers and ID are
+// matched. Other resources belong to the patients referenced by their subject,
+// patient or beneficiary fields, by ID or by identifier. Resources without any
+// of those fields, such as Practitioners and Organizations, are always kept. In
+// allowlist mode, a resource with one of those fields which does not reference
+// a listed Patient, such as an Observation about a Group, is dropped.
+//
+// Patients listed by identifier are only matched by ID once their Patient
+// resource is seen, so unless the list has been written to as a Sink with an
+// export of Patient, Patient resources must be processed first.
+func NewPatientFilterProcessor(list *PatientList, deny bool) Processor {
+	return &patientFilterProcessor{list: list, deny: deny}
+}
+
+func (pp *patientFilterProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	listed, hasPatientField := false, false
+	if p := cr.GetPatient(); p != nil {
+		hasPatientField = true
+		listed = pp.list.containsID(p.GetId().GetValue())
+		for _, i := range p.GetIdentifier() {
+			if !listed && pp.list.containsIdentifier(i) {
+				listed = true
+				pp.list.addID(p.GetId().GetValue())
+			}
+		}
+	} else {
+		m := cr.ProtoReflect()
+		field := m.WhichOneof(m.Descriptor().Oneofs().ByName("oneof_resource"))
+		if field == nil {
+			return errors.New("ContainedResource has no resource set")
+		}
+		r := m.Get(field).Message()
+		for _, name := range patientFilterFields {
+			refs, ok := referenceField(r, name)
+			if !ok {
+				continue
+			}
+			hasPatientField = true
+			for _, ref := range refs {
+				listed = listed || pp.list.containsReference(ref)
+			}
+		}
+	}
+	if !hasPatientField || listed != pp.deny {
+		return pp.Output(ctx, resource)
+	}
+	pp.dropped.Add(1)
+	return fhirPatientFilterDroppedCounter.Record(ctx, 1, resource.Type().String())
+}
+
+// referenceField returns the references in the named Reference field of the
+// resource, which may be repeated, and whether the resource has such a field.
+func referenceField(r protoreflect.Message, name protoreflect.Name) ([]*dpb.Reference, bool) {
+	fd := r.Descriptor().Fields().ByName(name)
+	if fd == nil || fd.Message() == nil || fd.Message().FullName() != (&dpb.Reference{}).ProtoReflect().Descriptor().FullName() {
+		return nil, false
+	}
+	if !fd.IsList() {
+		if !r.Has(fd) {
+			return nil, true
+		}
+		return []*dpb.Reference{r.Get(fd).Message().Interface().(*dpb.Reference)}, true
+	}
+	var refs []*dpb.Reference
+	l := r.Get(fd).List()
+	for i := 0; i < l.Len(); i++ {
+		refs = append(refs, l.Get(i).Message().Interface().(*dpb.Reference))
+	}
+	return refs, true
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (pp *patientFilterProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (pp *patientFilterProcessor) Finalize(ctx context.Context) error {
+	if n := pp.dropped.Load(); n > 0 {
+		list := "allowlist"
+		if pp.deny {
+			list = "denylist"
+		}
+		log.Infof("Dropped %d resources by the patient %s.", n, list)
+	}
+	return nil
+}
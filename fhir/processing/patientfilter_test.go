@@ -0,0 +1,177 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestPatientFilterProcessor(t *testing.T) {
+	resources := []struct {
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+	}{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p1"}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p2","identifier":[{"system":"http://hl7.org/fhir/sid/us-mbi","value":"1S00E00AA00"}]}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p3"}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"x"},"subject":{"reference":"Patient/p1"}}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o2","status":"final","code":{"text":"x"},"subject":{"reference":"https://example.com/fhir/Patient/p2"}}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o3","status":"final","code":{"text":"x"},"subject":{"reference":"Patient/p3"},"performer":[{"reference":"Patient/p1"}]}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o4","status":"final","code":{"text":"x"},"subject":{"reference":"Group/g1"}}`},
+		{cpb.ResourceTypeCode_COVERAGE, `{"resourceType":"Coverage","id":"c1","status":"active","beneficiary":{"identifier":{"system":"http://hl7.org/fhir/sid/us-mbi","value":"1S00E00AA00"}},"payor":[{"reference":"Organization/org1"}]}`},
+		{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"e1","status":"active","type":{"text":"x"},"use":"claim","patient":{"reference":"Patient/p3"},"created":"2023-01-01","insurer":{"reference":"Organization/org1"},"provider":{"reference":"Practitioner/pr1"},"outcome":"complete","insurance":[{"focal":true,"coverage":{"reference":"Coverage/c1"}}]}`},
+		{cpb.ResourceTypeCode_PRACTITIONER, `{"resourceType":"Practitioner","id":"pr1"}`},
+	}
+	cases := []struct {
+		name        string
+		deny        bool
+		wantIDs     []string
+		wantDropped map[string]int64
+	}{
+		{
+			name:        "allowlist",
+			wantIDs:     []string{"Patient/p1", "Patient/p2", "Observation/o1", "Observation/o2", "Coverage/c1", "Practitioner/pr1"},
+			wantDropped: map[string]int64{"PATIENT": 1, "OBSERVATION": 2, "EXPLANATION_OF_BENEFIT": 1},
+		},
+		{
+			name:        "denylist",
+			deny:        true,
+			wantIDs:     []string{"Patient/p3", "Observation/o3", "Observation/o4", "ExplanationOfBenefit/e1", "Practitioner/pr1"},
+			wantDropped: map[string]int64{"PATIENT": 2, "OBSERVATION": 2, "COVERAGE": 1},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			metrics.ResetAll()
+			list, err := processing.NewPatientList([]string{"p1", "http://hl7.org/fhir/sid/us-mbi|1S00E00AA00"})
+			if err != nil {
+				t.Fatalf("NewPatientList() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{processing.NewPatientFilterProcessor(list, tc.deny)}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range resources {
+				if err := p.Process(ctx, r.resourceType, "http://source", []byte(r.json)); err != nil {
+					t.Fatalf("p.Process() returned unexpected error: %v", err)
+				}
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			var gotIDs []string
+			for _, r := range ts.WrittenResources {
+				data, err := r.JSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var resource struct{ ResourceType, ID string }
+				if err := json.Unmarshal(data, &resource); err != nil {
+					t.Fatal(err)
+				}
+				gotIDs = append(gotIDs, resource.ResourceType+"/"+resource.ID)
+			}
+			if diff := cmp.Diff(tc.wantIDs, gotIDs); diff != "" {
+				t.Errorf("patient filter processor kept unexpected resources (-want +got):\n%s", diff)
+			}
+
+			gotCount, _, err := metrics.GetResults()
+			if err != nil {
+				t.Errorf("GetResults failed; err = %s", err)
+			}
+			if diff := cmp.Diff(tc.wantDropped, gotCount["fhir-patient-filter-dropped-counter"].Count); diff != "" {
+				t.Errorf("GetResults() return unexpected count (-want +got): \n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPatientList_ResolvesIdentifiersAsSink(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "patients.txt")
+	contents := "# IRB cohort\np1\n\nhttp://hl7.org/fhir/sid/us-mbi|1S00E00AA00\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := processing.ReadPatientList(path)
+	if err != nil {
+		t.Fatalf("ReadPatientList() returned unexpected error: %v", err)
+	}
+	if !list.HasIdentifiers() {
+		t.Errorf("HasIdentifiers() = false, want true")
+	}
+
+	resolve, err := processing.NewPipeline(nil, []processing.Sink{list})
+	if err != nil {
+		t.Fatal(err)
+	}
+	patient := `{"resourceType":"Patient","id":"p2","identifier":[{"system":"http://hl7.org/fhir/sid/us-mbi","value":"1S00E00AA00"}]}`
+	if err := resolve.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(patient)); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve.Finalize(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The Observation is processed without its Patient, so is only kept if the
+	// identifier was resolved by the Sink.
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{processing.NewPatientFilterProcessor(list, false)}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	observation := `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"x"},"subject":{"reference":"Patient/p2"}}`
+	if err := p.Process(ctx, cpb.ResourceTypeCode_OBSERVATION, "http://source", []byte(observation)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.WrittenResources) != 1 {
+		t.Errorf("patient filter processor wrote %d resources, want 1", len(ts.WrittenResources))
+	}
+}
+
+func TestNewPatientList_Errors(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []string
+	}{
+		{"empty", nil},
+		{"reference", []string{"Patient/p1"}},
+		{"identifier without system", []string{"|1S00E00AA00"}},
+		{"identifier without value", []string{"http://hl7.org/fhir/sid/us-mbi|"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := processing.NewPatientList(tc.entries); err == nil {
+				t.Errorf("NewPatientList(%v) returned nil error, want error", tc.entries)
+			}
+		})
+	}
+}
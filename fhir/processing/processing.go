@@ -17,14 +17,19 @@
 package processing
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 
 	"github.com/google/fhir/go/fhirversion"
 	"github.com/google/fhir/go/jsonformat"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
 	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
 	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 
 	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
 	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
@@ -34,6 +39,10 @@ import (
 // ResourceWrapper.Proto() should not be mutated.
 var ErrorDoNotModifyProto = errors.New("the pipeline is in the Sink stage(s), so the returned proto should not be mutated")
 
+// ErrFlushNotSupported is returned (wrapped) by Pipeline.Flush when one of the
+// pipeline's sinks does not implement Flusher.
+var ErrFlushNotSupported = errors.New("sink does not support flushing")
+
 // ResourceWrapper encapsulates resources to be processed and stored.
 type ResourceWrapper interface {
 	// Type returns the type of the resource, for easy filtering by processors.
@@ -63,6 +72,9 @@ type resourceWrapper struct {
 	// of sync. Once processing is done, this flag may be switched to true so that
 	// sinks may access both the JSON and the proto at the same time.
 	doneMutating bool
+	// lineage is set when the resource is written to the sinks, if the
+	// pipeline records lineage. See SetLineage.
+	lineage *resourceLineage
 }
 
 func (rw *resourceWrapper) Type() cpb.ResourceTypeCode_Value {
@@ -122,6 +134,91 @@ func (rw *resourceWrapper) JSON() ([]byte, error) {
 // Verify resourceWrapper satisfies the ResourceWrapper interface.
 var _ ResourceWrapper = &resourceWrapper{}
 
+var (
+	formattersOnce     sync.Once
+	sharedUnmarshaller *jsonformat.Unmarshaller
+	sharedMarshaller   *jsonformat.Marshaller
+	formattersErr      error
+)
+
+// newFormatters returns the R4 JSON unmarshaller and marshaller used by
+// pipelines and resources.
+func newFormatters() (*jsonformat.Unmarshaller, *jsonformat.Marshaller, error) {
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		return nil, nil, err
+	}
+	marshaller, err := jsonformat.NewMarshaller(false, "", "", fhirversion.R4)
+	if err != nil {
+		return nil, nil, err
+	}
+	return unmarshaller, marshaller, nil
+}
+
+// sharedFormatters returns a lazily initialised unmarshaller and marshaller
+// for resources created outside of Pipeline.Process.
+func sharedFormatters() (*jsonformat.Unmarshaller, *jsonformat.Marshaller, error) {
+	formattersOnce.Do(func() {
+		sharedUnmarshaller, sharedMarshaller, formattersErr = newFormatters()
+	})
+	return sharedUnmarshaller, sharedMarshaller, formattersErr
+}
+
+// NewResourceWrapperFromJSON creates a ResourceWrapper for a FHIR JSON resource
+// of the given type. This may be used by processors which emit resources other
+// than the ones they were given.
+func NewResourceWrapperFromJSON(resourceType cpb.ResourceTypeCode_Value, sourceURL string, json []byte) (ResourceWrapper, error) {
+	unmarshaller, marshaller, err := sharedFormatters()
+	if err != nil {
+		return nil, err
+	}
+	return &resourceWrapper{
+		unmarshaller: unmarshaller,
+		marshaller:   marshaller,
+		resourceType: resourceType,
+		sourceURL:    sourceURL,
+		jsonMut:      &sync.Mutex{},
+		json:         json,
+	}, nil
+}
+
+// NewResourceWrapperFromProto creates a ResourceWrapper holding the given
+// resource proto, with the resource type derived from the proto. This may be
+// used by processors which emit resources other than the ones they were given.
+func NewResourceWrapperFromProto(sourceURL string, resource *rpb.ContainedResource) (ResourceWrapper, error) {
+	unmarshaller, marshaller, err := sharedFormatters()
+	if err != nil {
+		return nil, err
+	}
+	resourceType, err := containedResourceType(resource)
+	if err != nil {
+		return nil, err
+	}
+	return &resourceWrapper{
+		unmarshaller: unmarshaller,
+		marshaller:   marshaller,
+		resourceType: resourceType,
+		sourceURL:    sourceURL,
+		proto:        resource,
+		jsonMut:      &sync.Mutex{},
+	}, nil
+}
+
+// containedResourceType returns the type of the resource set in a
+// ContainedResource.
+func containedResourceType(resource *rpb.ContainedResource) (cpb.ResourceTypeCode_Value, error) {
+	m := resource.ProtoReflect()
+	oneof := m.Descriptor().Oneofs().ByName("oneof_resource")
+	if oneof == nil {
+		return cpb.ResourceTypeCode_INVALID_UNINITIALIZED, errors.New("ContainedResource has no oneof_resource field")
+	}
+	field := m.WhichOneof(oneof)
+	if field == nil {
+		return cpb.ResourceTypeCode_INVALID_UNINITIALIZED, errors.New("ContainedResource has no resource set")
+	}
+	return bulkfhir.ResourceTypeCodeFromName(string(field.Message().Name()))
+}
+
 var operationOutcomeCounter *metrics.Counter = metrics.NewCounter("operation-outcome-counter", "Count of the severity and error code of the operation outcomes returned from the bulk fhir server.", "1", aggregation.Count, "Severity", "Code")
 var fhirResourceCounter *metrics.Counter = metrics.NewCounter("fhir-resource-counter", "Count of FHIR Resources processed by Bulk FHIR Fetch run. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
 
@@ -131,6 +228,13 @@ type OutputFunction func(ctx context.Context, resource ResourceWrapper) error
 // Processor defines a pipeline stage which may mutate resources before they are
 // written.
 //
+// A processor may pass on zero, one or many resources for each resource it is
+// given, by calling the output function the corresponding number of times. For
+// example, a filtering processor may drop resources by not calling the output
+// function at all, and a processor splitting up a Bundle may call the output
+// function once for each entry. New resources may be created with
+// NewResourceWrapperFromProto or NewResourceWrapperFromJSON.
+//
 // Processors are assumed to not be thread-safe (i.e. it is unsafe to call
 // Process from multiple goroutines). Because processors may be chained in a
 // Pipeline, Processor implementations must call the sink function set with
@@ -185,6 +289,25 @@ type Sink interface {
 	Finalize(ctx context.Context) error
 }
 
+// Flusher is implemented by Sinks which can durably store all resources written
+// so far without being finalized, and continue to accept writes afterwards.
+// This allows the progress of a fetch to be checkpointed.
+type Flusher interface {
+	// Flush returns once all resources passed to Write() before the call have
+	// been durably stored. It must not be called concurrently with Write().
+	Flush(ctx context.Context) error
+}
+
+// Completer is implemented by Sinks which can describe the durable result of
+// their writes once finalized, such as the files written or a FHIR store import
+// operation. The description is recorded before the transaction time of a
+// fetch is stored, so that the outputs of an interrupted run can be identified.
+type Completer interface {
+	// CompletionToken returns a description of the sink's durable output. It is
+	// only called after Finalize has returned without error.
+	CompletionToken() string
+}
+
 // A Pipeline consumes FHIR resources (as JSON), applies processing steps, and
 // then writes the resources to zero or more sinks.
 type Pipeline struct {
@@ -193,6 +316,19 @@ type Pipeline struct {
 	processors   []Processor
 	sinks        []Sink
 	pipelineFunc OutputFunction
+	isolation    *ResourceIsolationConfig
+	errorVolume  *errorVolumeMonitor
+	encoding     *encodingNormalizer
+	sinkRoutes   map[Sink]map[cpb.ResourceTypeCode_Value]bool
+	concurrency  *concurrentProcessing
+	lineage      *lineageRecorder
+	// sinkMu holds a mutex for each of sinks, which must be held when writing
+	// to the sink if concurrency is enabled.
+	sinkMu []sync.Mutex
+	// deadLetterMu must be held when writing to the dead letter sink.
+	deadLetterMu sync.Mutex
+
+	deadLetterCounts deadLetterCounts
 }
 
 // NewPipeline constructs a new Pipeline, plumbing together the given Processors
@@ -200,11 +336,7 @@ type Pipeline struct {
 // is required. Note that processors and sinks should not be shared between
 // pipelines.
 func NewPipeline(processors []Processor, sinks []Sink) (*Pipeline, error) {
-	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
-	if err != nil {
-		return nil, err
-	}
-	marshaller, err := jsonformat.NewMarshaller(false, "", "", fhirversion.R4)
+	unmarshaller, marshaller, err := newFormatters()
 	if err != nil {
 		return nil, err
 	}
@@ -214,46 +346,125 @@ func NewPipeline(processors []Processor, sinks []Sink) (*Pipeline, error) {
 		processors:   processors,
 		sinks:        sinks,
 	}
-	// Build the pipeline function by applying each processing step on top of the
-	// sinks, starting from the last so that the processing steps are applied in
-	// the same order they are passed to this function. If there are no
-	// processors, the pipeline function is just writing to the sinks (and if
-	// there are also no sinks the pipeline is a no-op).
+	p.chainProcessors()
+	return p, nil
+}
+
+// chainProcessors builds the pipeline function by applying each processing step
+// on top of the sinks, starting from the last so that the processing steps are
+// applied in the same order they are passed to NewPipeline. If there are no
+// processors, the pipeline function is just writing to the sinks (and if there
+// are also no sinks the pipeline is a no-op). If resource isolation is enabled,
+// the last processor outputs to collectOutput instead. If concurrency is
+// enabled, or resource isolation may abandon resources still being processed,
+// processors which may not be called concurrently are serialized.
+func (p *Pipeline) chainProcessors() {
 	p.pipelineFunc = p.writeToSinks
-	for i := len(processors) - 1; i >= 0; i-- {
-		processors[i].SetOutput(p.pipelineFunc)
-		p.pipelineFunc = processors[i].Process
+	if p.isolation != nil {
+		p.pipelineFunc = p.collectOutput
+	}
+	abandons := p.isolation != nil && p.isolation.Timeout > 0
+	for i := len(p.processors) - 1; i >= 0; i-- {
+		p.processors[i].SetOutput(p.pipelineFunc)
+		p.pipelineFunc = p.processors[i].Process
+		if (p.concurrency != nil || abandons) && !processesConcurrently(p.processors[i]) {
+			p.pipelineFunc = serialize(p.pipelineFunc)
+		}
 	}
-	return p, nil
 }
 
-// writeToSinks writes the resource to each sink sequentially.
+// writeToSinks writes the resource to each sink it is routed to sequentially.
 func (p *Pipeline) writeToSinks(ctx context.Context, resource ResourceWrapper) error {
+	ctx = sinkContext(ctx)
 	if rw, ok := resource.(*resourceWrapper); ok {
 		rw.doneMutating = true
+		if p.lineage != nil {
+			l, err := p.lineage.forResource(ctx, rw)
+			if err != nil {
+				return err
+			}
+			rw.lineage = l
+		}
 	}
-	for _, s := range p.sinks {
-		if err := s.Write(ctx, resource); err != nil {
-			return err
+	for i, s := range p.sinks {
+		if !p.routesTo(s, resource.Type()) {
+			continue
+		}
+		if err := p.writeToSink(ctx, i, resource); err != nil {
+			return &sinkWriteError{sink: s, err: err}
 		}
 	}
 	return nil
 }
 
+// writeToSink writes the resource to the i'th sink, holding its mutex if
+// concurrency is enabled.
+func (p *Pipeline) writeToSink(ctx context.Context, i int, resource ResourceWrapper) error {
+	if p.sinkMu != nil {
+		p.sinkMu[i].Lock()
+		defer p.sinkMu[i].Unlock()
+	}
+	return p.sinks[i].Write(ctx, resource)
+}
+
 // Process a single FHIR resource. The resource is passed through the processing
 // steps to the sinks.
 //
-// Pipelines do not apply any parallel processing. Resources pass through each
-// processing step sequentially, and are written to each sink sequentially; this
-// function returns only when the processor and sinks return. If a processor or
-// sink needs to perform heavy lifting, it may use parallelism internally. An
-// example could be a Sink that places work on an internal queue to handle
-// concurrently and then returns immediately to not block subsquent pipeline
-// processing. Such a Sink would ensure that all work on its internal queue is
-// complete before returning in Finalize().
+// By default, pipelines do not apply any parallel processing. Resources pass
+// through each processing step sequentially, and are written to each sink
+// sequentially; this function returns only when the processor and sinks
+// return. If a processor or sink needs to perform heavy lifting, it may use
+// parallelism internally. An example could be a Sink that places work on an
+// internal queue to handle concurrently and then returns immediately to not
+// block subsquent pipeline processing. Such a Sink would ensure that all work
+// on its internal queue is complete before returning in Finalize(). If
+// concurrency is enabled with SetConcurrency, this function instead returns
+// once the resource is queued, and errors are returned by later calls.
+//
+// Collection and searchset Bundles are split up, and each of their entries is
+// processed as a separate resource.
 //
 // It is not safe to call this function from multiple Goroutines.
 func (p *Pipeline) Process(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, sourceURL string, json []byte) error {
+	if p.concurrency != nil {
+		// The caller may reuse json once this returns.
+		json = bytes.Clone(json)
+		return p.concurrency.submit(ctx, func(ctx context.Context) error {
+			return p.process(ctx, resourceType, sourceURL, json)
+		})
+	}
+	return p.process(ctx, resourceType, sourceURL, json)
+}
+
+// process passes a resource through the pipeline, returning once it has been
+// written to the sinks.
+func (p *Pipeline) process(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, sourceURL string, json []byte) error {
+	if p.encoding != nil {
+		normalized, err := p.encoding.normalize(ctx, resourceType, json)
+		if err != nil {
+			return p.rejectEncoding(ctx, resourceType, sourceURL, json, err)
+		}
+		json = normalized
+	}
+	entries, bundleType, ok, err := maybeUnbundle(json)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return p.processResource(ctx, resourceType, sourceURL, json)
+	}
+	if err := unbundledCounter.Record(ctx, 1, bundleType); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := p.processResource(ctx, e.resourceType, sourceURL, e.json); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pipeline) processResource(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, sourceURL string, json []byte) error {
 	//  Since a processor/sink may have internal parallelism, json []byte may
 	//  still be processed by a parallel processor/sink after Process() returns.
 	//  json []byte should be a copy in case it is overwritten after Process()
@@ -272,33 +483,159 @@ func (p *Pipeline) Process(ctx context.Context, resourceType cpb.ResourceTypeCod
 	if err := fhirResourceCounter.Record(ctx, 1, resourceType.String()); err != nil {
 		return err
 	}
-	if resourceType == cpb.ResourceTypeCode_OPERATION_OUTCOME {
-		op, err := rw.Proto()
-		if err != nil {
+	if p.errorVolume != nil {
+		p.errorVolume.resources.Add(1)
+	}
+	var err error
+	if p.isolation != nil {
+		err = p.processIsolated(ctx, rw)
+	} else if err = p.recordOperationOutcome(ctx, rw); err == nil {
+		err = p.pipelineFunc(ctx, rw)
+	}
+	if err != nil || p.errorVolume == nil {
+		return err
+	}
+	return p.errorVolume.check(ctx, false)
+}
+
+// rejectEncoding handles a resource rejected by strict encoding normalization,
+// routing it to the dead letter sink if resource isolation is enabled, and
+// otherwise returning an error.
+func (p *Pipeline) rejectEncoding(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, sourceURL string, json []byte, err error) error {
+	if !errors.Is(err, ErrInvalidEncoding) {
+		return err
+	}
+	if p.isolation == nil {
+		return fmt.Errorf("%s resource from %s: %w", resourceType, sourceURL, err)
+	}
+	if err := fhirResourceCounter.Record(ctx, 1, resourceType.String()); err != nil {
+		return err
+	}
+	if p.errorVolume != nil {
+		p.errorVolume.resources.Add(1)
+	}
+	rw := &resourceWrapper{resourceType: resourceType, sourceURL: sourceURL}
+	if err := p.deadLetter(ctx, rw, append([]byte(nil), json...), err); err != nil {
+		return err
+	}
+	if p.errorVolume == nil {
+		return nil
+	}
+	return p.errorVolume.check(ctx, false)
+}
+
+func (p *Pipeline) recordOperationOutcome(ctx context.Context, rw *resourceWrapper) error {
+	if rw.resourceType != cpb.ResourceTypeCode_OPERATION_OUTCOME {
+		return nil
+	}
+	op, err := rw.Proto()
+	if err != nil {
+		return err
+	}
+	for _, issue := range op.GetOperationOutcome().GetIssue() {
+		if err := operationOutcomeCounter.Record(ctx, 1, issue.GetSeverity().GetValue().String(), issue.GetCode().GetValue().String()); err != nil {
 			return err
 		}
-		for _, issue := range op.GetOperationOutcome().GetIssue() {
-			if err := operationOutcomeCounter.Record(ctx, 1, issue.GetSeverity().GetValue().String(), issue.GetCode().GetValue().String()); err != nil {
-				return err
-			}
+	}
+	return nil
+}
+
+// Flush calls Flush on all of the Sinks in the pipeline, returning the first
+// error seen. If any Sink does not implement Flusher, this returns an error
+// wrapping ErrFlushNotSupported without flushing anything. If concurrency is
+// enabled, the resources queued so far are processed first. As with Process,
+// it is not safe to call this function from multiple Goroutines.
+func (p *Pipeline) Flush(ctx context.Context) error {
+	if err := p.CanFlush(); err != nil {
+		return err
+	}
+	if err := p.concurrency.wait(); err != nil {
+		return err
+	}
+	for _, s := range p.sinks {
+		if err := s.(Flusher).Flush(ctx); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
+// CanFlush returns an error wrapping ErrFlushNotSupported if any of the Sinks
+// in the pipeline does not implement Flusher.
+func (p *Pipeline) CanFlush() error {
+	for _, s := range p.sinks {
+		// Look through wrappers which flush the sink they wrap.
+		if bcs, ok := s.(*ByteCountingSink); ok {
+			s = bcs.Sink
+		}
+		if _, ok := s.(Flusher); !ok {
+			return fmt.Errorf("%w: %T", ErrFlushNotSupported, s)
+		}
 	}
-	return p.pipelineFunc(ctx, rw)
+	return nil
 }
 
 // Finalize calls finalize on all of the underlying Processors and Sinks in the
-// pipeline, returning the first error seen.
-func (p *Pipeline) Finalize(ctx context.Context) error {
+// pipeline, returning the first error seen. If concurrency is enabled, it first
+// waits for all queued resources to be processed, and returns the error of the
+// earliest queued resource which failed, if any, without finalizing anything.
+func (p *Pipeline) Finalize(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "pipeline.Finalize")
+	defer func() { tracing.End(span, err) }()
+	if err := p.concurrency.wait(); err != nil {
+		return err
+	}
 	for _, pr := range p.processors {
 		if err := pr.Finalize(ctx); err != nil {
 			return err
 		}
 	}
 	for _, s := range p.sinks {
-		if err := s.Finalize(ctx); err != nil {
+		if err := finalizeSink(ctx, s); err != nil {
+			return err
+		}
+	}
+	if p.isolation != nil && p.isolation.DeadLetterSink != nil {
+		if err := p.isolation.DeadLetterSink.Finalize(ctx); err != nil {
 			return err
 		}
 	}
+	if p.lineage != nil {
+		if err := p.lineage.finalize(ctx); err != nil {
+			return err
+		}
+	}
+	p.deadLetterCounts.logSummary()
+	if p.encoding != nil {
+		p.encoding.logSummary()
+	}
+	if p.errorVolume != nil {
+		return p.errorVolume.check(ctx, true)
+	}
 	return nil
 }
+
+// CompletionTokens returns the CompletionToken of each Sink in the pipeline
+// which implements Completer. It must only be called after Finalize has
+// returned without error.
+func (p *Pipeline) CompletionTokens() []string {
+	var tokens []string
+	for _, s := range p.sinks {
+		// Look through wrappers which complete the sink they wrap.
+		if bcs, ok := s.(*ByteCountingSink); ok {
+			s = bcs.Sink
+		}
+		if c, ok := s.(Completer); ok {
+			tokens = append(tokens, c.CompletionToken())
+		}
+	}
+	return tokens
+}
+
+// finalizeSink finalizes s in its own span, as sinks which upload data may
+// spend a long time finishing their uploads.
+func finalizeSink(ctx context.Context, s Sink) (err error) {
+	ctx, span := tracing.Start(ctx, "sink.Finalize", attribute.String("sink.type", fmt.Sprintf("%T", s)))
+	defer func() { tracing.End(span, err) }()
+	return s.Finalize(ctx)
+}
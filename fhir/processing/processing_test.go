@@ -23,6 +23,9 @@ import (
 	"github.com/google/bulk_fhir_tools/internal/metrics"
 
 	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	prpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/provenance_go_proto"
 )
 
 // testProcessor is a no-op processor for testing.
@@ -133,3 +136,88 @@ func TestMalformedOperationOutcomeCounter(t *testing.T) {
 		t.Errorf("GetResults() returned unexpected count (-want +got): \n%s", diff)
 	}
 }
+
+// fanOutProcessor emits each Patient twice, along with a Provenance resource
+// for it, and drops all other resources.
+type fanOutProcessor struct {
+	processing.BaseProcessor
+}
+
+func (fp *fanOutProcessor) Process(ctx context.Context, resource processing.ResourceWrapper) error {
+	if resource.Type() != cpb.ResourceTypeCode_PATIENT {
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := fp.Output(ctx, resource); err != nil {
+			return err
+		}
+	}
+	provenance, err := processing.NewResourceWrapperFromProto(resource.SourceURL(), &rpb.ContainedResource{
+		OneofResource: &rpb.ContainedResource_Provenance{Provenance: &prpb.Provenance{Id: &dpb.Id{Value: "prov"}}},
+	})
+	if err != nil {
+		return err
+	}
+	return fp.Output(ctx, provenance)
+}
+
+func TestPipeline_FanOutProcessor(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{&fanOutProcessor{}, &testProcessor{}}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(`{"resourceType":"Patient","id":"1"}`)); err != nil {
+		t.Fatalf("p.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Process(ctx, cpb.ResourceTypeCode_ACCOUNT, "http://source", []byte(`{"resourceType":"Account","id":"2"}`)); err != nil {
+		t.Fatalf("p.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+	}
+
+	var gotTypes []cpb.ResourceTypeCode_Value
+	for _, r := range ts.WrittenResources {
+		gotTypes = append(gotTypes, r.Type())
+	}
+	wantTypes := []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_PROVENANCE}
+	if diff := cmp.Diff(gotTypes, wantTypes); diff != "" {
+		t.Errorf("TestSink captured unexpected resource types (-got +want): %s", diff)
+	}
+	json, err := ts.WrittenResources[2].JSON()
+	if err != nil {
+		t.Fatalf("JSON() returned unexpected error: %v", err)
+	}
+	if want := `{"id":"prov","resourceType":"Provenance"}`; string(json) != want {
+		t.Errorf("JSON() of created resource = %s, want %s", json, want)
+	}
+}
+
+func TestPipeline_CompletionTokens(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	dir := t.TempDir()
+	ndjsonSink, err := processing.NewNDJSONSink(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sinks := []processing.Sink{processing.NewByteCountingSink(ndjsonSink), &processing.TestSink{}}
+	p, err := processing.NewPipeline(nil, sinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(`{"resourceType":"Patient","id":"1"}`)); err != nil {
+		t.Fatalf("p.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+	}
+
+	want := []string{"ndjson " + dir + ": 1 resources"}
+	if diff := cmp.Diff(want, p.CompletionTokens()); diff != "" {
+		t.Errorf("CompletionTokens() returned unexpected tokens (-want +got): %s", diff)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/gcs"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// Formats of the files written by the proto sink. See NewProtoSink.
+const (
+	ProtoFormatDelimited = "delimited"
+	ProtoFormatTFRecord  = "tfrecord"
+)
+
+// ProtoSinkConfig defines the configuration passed to NewProtoSink.
+type ProtoSinkConfig struct {
+	// Directory is either a local directory, which must exist, or a GCS path of
+	// the form gs://bucket/folder_path.
+	Directory   string
+	GCSEndpoint string
+
+	// Format is ProtoFormatDelimited or ProtoFormatTFRecord. If empty,
+	// ProtoFormatDelimited is used.
+	Format string
+}
+
+// protoFile is the proto file of a resource type.
+type protoFile struct {
+	name  string
+	file  io.WriteCloser
+	count int64
+}
+
+// protoSink implements the processing.Sink interface to write resources as
+// google/fhir R4 protos, with a file per resource type.
+type protoSink struct {
+	store     appendFileStore
+	directory string
+	format    string
+
+	// mu must be held when accessing files.
+	mu    sync.Mutex
+	files map[cpb.ResourceTypeCode_Value]*protoFile
+}
+
+// Assert protoSink satisfies the Sink interface.
+var _ Sink = &protoSink{}
+
+// NewProtoSink creates a new Sink which converts resources to the google/fhir
+// R4 protos of their resource type, such as google.fhir.r4.core.Patient, and
+// writes them in binary to files in a directory, one per resource type, for
+// pipelines which already read google/fhir protos.
+//
+// With ProtoFormatDelimited, each file is named <ResourceType>.binpb, and each
+// proto in it is preceded by its length as a varint, as written by Java's
+// writeDelimitedTo and read by Go's protodelim. With ProtoFormatTFRecord, each
+// file is named <ResourceType>.tfrecord, and each proto is a TFRecord record,
+// for reading with TensorFlow's TFRecordDataset. Each run replaces the files of
+// the previous one.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+func NewProtoSink(ctx context.Context, cfg *ProtoSinkConfig) (Sink, error) {
+	if cfg.Directory == "" {
+		return nil, errors.New("a proto output directory is required")
+	}
+	ps := &protoSink{
+		directory: cfg.Directory,
+		format:    cfg.Format,
+		files:     map[cpb.ResourceTypeCode_Value]*protoFile{},
+	}
+	if ps.format == "" {
+		ps.format = ProtoFormatDelimited
+	}
+	if ps.format != ProtoFormatDelimited && ps.format != ProtoFormatTFRecord {
+		return nil, fmt.Errorf("unknown proto format %q, want %s or %s", cfg.Format, ProtoFormatDelimited, ProtoFormatTFRecord)
+	}
+	var err error
+	if ps.store, err = newAppendFileStore(ctx, cfg.Directory, cfg.GCSEndpoint); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Write is Sink.Write. The resource's proto is appended to the file of its
+// resource type, which is created if needed.
+func (ps *protoSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	cr, err := resource.Proto()
+	if err != nil && !errors.Is(err, ErrorDoNotModifyProto) {
+		return err
+	}
+	data, err := marshalResource(cr)
+	if err != nil {
+		return err
+	}
+	if ps.format == ProtoFormatTFRecord {
+		data = appendTFRecord(nil, data)
+	} else {
+		data = append(protowire.AppendVarint(nil, uint64(len(data))), data...)
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	f, err := ps.file(ctx, resource.Type())
+	if err != nil {
+		return err
+	}
+	if _, err := f.file.Write(data); err != nil {
+		return fmt.Errorf("error writing to %s: %w", f.name, err)
+	}
+	f.count++
+	recordOutput(resource, ps.location(f.name))
+	return nil
+}
+
+// marshalResource returns the binary proto of the resource held by a
+// ContainedResource.
+func marshalResource(cr *rpb.ContainedResource) ([]byte, error) {
+	m := cr.ProtoReflect()
+	field := m.WhichOneof(m.Descriptor().Oneofs().ByName("oneof_resource"))
+	if field == nil {
+		return nil, errors.New("ContainedResource has no resource set")
+	}
+	return proto.Marshal(m.Get(field).Message().Interface())
+}
+
+// tfRecordCRC is the table of the CRC-32C checksums of TFRecord records.
+var tfRecordCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// maskedCRC returns the masked CRC-32C checksum of data, as stored in TFRecord
+// records.
+func maskedCRC(data []byte) uint32 {
+	crc := crc32.Checksum(data, tfRecordCRC)
+	return (crc>>15 | crc<<17) + 0xa282ead8
+}
+
+// appendTFRecord appends a TFRecord record holding data to b: the length of
+// data and its checksum, then data and its checksum.
+func appendTFRecord(b, data []byte) []byte {
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(data)))
+	b = binary.LittleEndian.AppendUint32(b, maskedCRC(b[len(b)-8:]))
+	b = append(b, data...)
+	return binary.LittleEndian.AppendUint32(b, maskedCRC(data))
+}
+
+// file returns the file of a resource type, creating it if needed. ps.mu must
+// be held.
+func (ps *protoSink) file(ctx context.Context, rt cpb.ResourceTypeCode_Value) (*protoFile, error) {
+	if f, ok := ps.files[rt]; ok {
+		return f, nil
+	}
+	name, err := bulkfhir.ResourceTypeCodeToName(rt)
+	if err != nil {
+		return nil, err
+	}
+	f := &protoFile{name: name + ".binpb"}
+	if ps.format == ProtoFormatTFRecord {
+		f.name = name + ".tfrecord"
+	}
+	if f.file, err = ps.store.openAppend(ctx, f.name, 0); err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", f.name, err)
+	}
+	ps.files[rt] = f
+	return f, nil
+}
+
+// location returns the path or URI of a file written by the sink.
+func (ps *protoSink) location(name string) string {
+	if strings.HasPrefix(ps.directory, "gs://") {
+		return "gs://" + gcs.JoinPath(strings.TrimPrefix(ps.directory, "gs://"), name)
+	}
+	return path.Join(ps.directory, name)
+}
+
+// Finalize is Sink.Finalize. This closes the files.
+func (ps *protoSink) Finalize(ctx context.Context) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var errs []error
+	for _, f := range ps.files {
+		if err := f.file.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing %s: %w", f.name, err))
+		}
+		log.Infof("Wrote %d resources to %s.", f.count, f.name)
+	}
+	return errors.Join(errs...)
+}
+
+// CompletionToken is Completer.CompletionToken.
+func (ps *protoSink) CompletionToken() string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var count int64
+	for _, f := range ps.files {
+		count += f.count
+	}
+	return fmt.Sprintf("proto: %d resources in %d files in %s", count, len(ps.files), ps.directory)
+}
@@ -0,0 +1,164 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	opb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/observation_go_proto"
+	ppb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/patient_go_proto"
+)
+
+// readDelimitedProtos returns the protos of a file of varint length delimited
+// protos.
+func readDelimitedProtos(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	var msgs [][]byte
+	for len(data) > 0 {
+		msg, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			t.Fatalf("invalid length delimited proto: %v", protowire.ParseError(n))
+		}
+		msgs = append(msgs, msg)
+		data = data[n:]
+	}
+	return msgs
+}
+
+// readTFRecords returns the records of a TFRecord file, checking their CRCs.
+func readTFRecords(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	table := crc32.MakeTable(crc32.Castagnoli)
+	masked := func(b []byte) uint32 {
+		crc := crc32.Checksum(b, table)
+		return (crc>>15 | crc<<17) + 0xa282ead8
+	}
+	var records [][]byte
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("TFRecord header is truncated")
+		}
+		n := binary.LittleEndian.Uint64(data)
+		if binary.LittleEndian.Uint32(data[8:]) != masked(data[:8]) {
+			t.Fatalf("TFRecord length has an invalid CRC")
+		}
+		data = data[12:]
+		if uint64(len(data)) < n+4 {
+			t.Fatalf("TFRecord data is truncated")
+		}
+		record := data[:n]
+		if binary.LittleEndian.Uint32(data[n:]) != masked(record) {
+			t.Fatalf("TFRecord data has an invalid CRC")
+		}
+		records = append(records, record)
+		data = data[n+4:]
+	}
+	return records
+}
+
+func TestProtoSink(t *testing.T) {
+	cases := []struct {
+		format    string
+		extension string
+		read      func(*testing.T, []byte) [][]byte
+	}{
+		{format: processing.ProtoFormatDelimited, extension: ".binpb", read: readDelimitedProtos},
+		{format: processing.ProtoFormatTFRecord, extension: ".tfrecord", read: readTFRecords},
+	}
+	for _, tc := range cases {
+		t.Run(tc.format, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			sink, err := processing.NewProtoSink(ctx, &processing.ProtoSinkConfig{Directory: dir, Format: tc.format})
+			if err != nil {
+				t.Fatalf("NewProtoSink() returned unexpected error: %v", err)
+			}
+			p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+			if err != nil {
+				t.Fatalf("failed to create pipeline: %v", err)
+			}
+			for _, id := range []string{"p1", "p2"} {
+				if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "http://source", []byte(`{"resourceType":"Patient","id":"`+id+`","name":[{"family":"Smith"}]}`)); err != nil {
+					t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+				}
+			}
+			observation := `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"x"},"valueString":"v"}`
+			if err := p.Process(ctx, cpb.ResourceTypeCode_OBSERVATION, "http://source", []byte(observation)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(dir, "Patient"+tc.extension))
+			if err != nil {
+				t.Fatalf("failed to read Patient file: %v", err)
+			}
+			var gotPatients []string
+			for _, msg := range tc.read(t, data) {
+				patient := &ppb.Patient{}
+				if err := proto.Unmarshal(msg, patient); err != nil {
+					t.Fatalf("failed to unmarshal Patient: %v", err)
+				}
+				if got := patient.GetName()[0].GetFamily().GetValue(); got != "Smith" {
+					t.Errorf("Patient has family name %q, want Smith", got)
+				}
+				gotPatients = append(gotPatients, patient.GetId().GetValue())
+			}
+			if len(gotPatients) != 2 || gotPatients[0] != "p1" || gotPatients[1] != "p2" {
+				t.Errorf("Patient file holds Patients %v, want [p1 p2]", gotPatients)
+			}
+
+			data, err = os.ReadFile(filepath.Join(dir, "Observation"+tc.extension))
+			if err != nil {
+				t.Fatalf("failed to read Observation file: %v", err)
+			}
+			msgs := tc.read(t, data)
+			if len(msgs) != 1 {
+				t.Fatalf("Observation file holds %d protos, want 1", len(msgs))
+			}
+			obs := &opb.Observation{}
+			if err := proto.Unmarshal(msgs[0], obs); err != nil {
+				t.Fatalf("failed to unmarshal Observation: %v", err)
+			}
+			if got := obs.GetValue().GetStringValue().GetValue(); got != "v" {
+				t.Errorf("Observation has value %q, want v", got)
+			}
+		})
+	}
+}
+
+func TestNewProtoSink_Invalid(t *testing.T) {
+	ctx := context.Background()
+	for _, cfg := range []*processing.ProtoSinkConfig{
+		{Format: processing.ProtoFormatDelimited},
+		{Directory: t.TempDir(), Format: "json"},
+		{Directory: filepath.Join(t.TempDir(), "missing")},
+	} {
+		if _, err := processing.NewProtoSink(ctx, cfg); err == nil {
+			t.Errorf("NewProtoSink(%+v) succeeded, want error", cfg)
+		}
+	}
+}
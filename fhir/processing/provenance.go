@@ -0,0 +1,70 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+)
+
+// provenanceFileName is the name of the file Provenance resources are written
+// to within the provenance directory.
+const provenanceFileName = "provenance.ndjson"
+
+// ProvenanceSink receives the Provenance resources in the output files of an
+// export job, which record where the exported data came from, so that they can
+// be kept apart from the data itself.
+type ProvenanceSink interface {
+	// WriteProvenance writes the Provenance resource, read from the output file
+	// at sourceURL, to storage.
+	WriteProvenance(ctx context.Context, sourceURL string, json []byte) error
+	// Finalize performs any final writing and cleanup. This is called after all
+	// Provenance resources have been passed to WriteProvenance().
+	Finalize(ctx context.Context) error
+}
+
+type ndjsonProvenanceSink struct {
+	*lazyNDJSONFile
+}
+
+// NewNDJSONProvenanceSink returns a ProvenanceSink which writes the Provenance
+// resources unchanged, one per line, to a provenance.ndjson file in the given
+// directory. The file is appended to by each run, and is only created once the
+// first resource is written.
+//
+// It is threadsafe to call WriteProvenance on this sink from multiple
+// goroutines.
+func NewNDJSONProvenanceSink(ctx context.Context, directory string) (ProvenanceSink, error) {
+	createFile, err := localCreateFileFunc(directory)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonProvenanceSink{&lazyNDJSONFile{createFile: createFile, fileName: provenanceFileName}}, nil
+}
+
+// NewGCSNDJSONProvenanceSink returns a ProvenanceSink which writes Provenance
+// resources to GCS. Unlike a local file, an existing file in GCS is
+// overwritten rather than appended to. See NewNDJSONProvenanceSink for
+// additional documentation.
+func NewGCSNDJSONProvenanceSink(ctx context.Context, endpoint, bucket, directory string) (ProvenanceSink, error) {
+	createFile, err := gcsCreateFileFunc(ctx, endpoint, bucket, directory)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonProvenanceSink{&lazyNDJSONFile{createFile: createFile, fileName: provenanceFileName}}, nil
+}
+
+func (ps *ndjsonProvenanceSink) WriteProvenance(ctx context.Context, sourceURL string, json []byte) error {
+	return ps.write(ctx, json)
+}
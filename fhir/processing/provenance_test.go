@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+)
+
+func TestNDJSONProvenanceSink(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ps, err := processing.NewNDJSONProvenanceSink(ctx, dir)
+	if err != nil {
+		t.Fatalf("NewNDJSONProvenanceSink() returned unexpected error: %v", err)
+	}
+	if err := ps.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "provenance.ndjson")); !os.IsNotExist(err) {
+		t.Errorf("provenance file exists without any Provenance resources, stat error: %v", err)
+	}
+
+	inputs := []string{
+		`{"resourceType":"Provenance","id":"1","target":[{"reference":"Patient/1"}]}`,
+		`{"resourceType":"Provenance","id":"2","target":[{"reference":"Patient/2"}]}`,
+	}
+	// Each run appends to the file.
+	for _, in := range inputs {
+		ps, err := processing.NewNDJSONProvenanceSink(ctx, dir)
+		if err != nil {
+			t.Fatalf("NewNDJSONProvenanceSink() returned unexpected error: %v", err)
+		}
+		if err := ps.WriteProvenance(ctx, "http://source", []byte(in)); err != nil {
+			t.Fatalf("WriteProvenance() returned unexpected error: %v", err)
+		}
+		if err := ps.Finalize(ctx); err != nil {
+			t.Fatalf("Finalize() returned unexpected error: %v", err)
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "provenance.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := inputs[0] + "\n" + inputs[1] + "\n"; string(got) != want {
+		t.Errorf("provenance file holds %q, want %q", got, want)
+	}
+
+	if _, err := processing.NewNDJSONProvenanceSink(ctx, filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("NewNDJSONProvenanceSink() with a missing directory returned nil error")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	"github.com/google/bulk_fhir_tools/pubsub"
+	"go.opentelemetry.io/otel/attribute"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// The attributes of the messages published by the Pub/Sub sink.
+const (
+	PubSubAttributeResourceType    = "resourceType"
+	PubSubAttributeResourceID      = "resourceId"
+	PubSubAttributeOperation       = "operation"
+	PubSubAttributeTransactionTime = "transactionTime"
+
+	// PubSubOperationUpsert is the operation of messages holding a resource.
+	PubSubOperationUpsert = "upsert"
+	// PubSubOperationDelete is the operation of messages for a deleted
+	// resource, which have no data.
+	PubSubOperationDelete = "delete"
+)
+
+// PubSubSinkConfig defines the configuration passed to NewPubSubSink.
+type PubSubSinkConfig struct {
+	// Client publishes to the topic. It is required.
+	Client               *pubsub.Client
+	NoFailOnUploadErrors bool
+
+	// If set, each message has a transactionTime attribute holding the
+	// transaction time of the export, once it is known.
+	TransactionTime *bulkfhir.TransactionTime
+}
+
+// pubSubSink implements the processing.Sink interface to publish each resource
+// as a Pub/Sub message, in batches.
+type pubSubSink struct {
+	client          *pubsub.Client
+	transactionTime *bulkfhir.TransactionTime
+
+	mu         sync.Mutex
+	batch      []pubsub.Message
+	batchBytes int
+
+	publishErrorOccurred atomic.Bool
+	publishErrors        atomic.Int64
+	noFailOnUploadErrors bool
+}
+
+// Assert pubSubSink satisfies the Sink, Flusher, Deleter and UploadErrorCounter
+// interfaces.
+var _ Sink = &pubSubSink{}
+var _ Flusher = &pubSubSink{}
+var _ Deleter = &pubSubSink{}
+var _ UploadErrorCounter = &pubSubSink{}
+
+// NewPubSubSink creates a new Sink which publishes each resource to a Pub/Sub
+// topic as a message holding the resource's JSON, with resourceType,
+// resourceId and operation attributes, for downstream streaming pipelines
+// such as Dataflow. Deleted resources are published as messages without data,
+// with an operation attribute of delete. Messages are published in batches,
+// when a batch is full and when the sink is flushed or finalized. Resources
+// larger than Pub/Sub's message size limit cannot be published, and count as
+// upload errors.
+func NewPubSubSink(ctx context.Context, cfg *PubSubSinkConfig) (Sink, error) {
+	if cfg == nil || cfg.Client == nil {
+		return nil, errors.New("a Pub/Sub client is required")
+	}
+	return &pubSubSink{
+		client:               cfg.Client,
+		transactionTime:      cfg.TransactionTime,
+		noFailOnUploadErrors: cfg.NoFailOnUploadErrors,
+	}, nil
+}
+
+// Write is Sink.Write. The resource is added to the current batch, which is
+// published first if the resource does not fit in it.
+func (pss *pubSubSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var parsed struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	msg, err := pss.message(resource.Type(), parsed.ID, PubSubOperationUpsert)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	if l := lineageOf(resource); l != nil {
+		l.recordOutput(fmt.Sprintf("pubsub://%s", pss.client.Topic()))
+	}
+	return pss.add(ctx, msg)
+}
+
+// Delete is Deleter.Delete. A message for the deletion is added to the current
+// batch.
+func (pss *pubSubSink) Delete(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, id string) error {
+	msg, err := pss.message(resourceType, id, PubSubOperationDelete)
+	if err != nil {
+		return err
+	}
+	return pss.add(ctx, msg)
+}
+
+// message returns a message without data for the given resource.
+func (pss *pubSubSink) message(resourceType cpb.ResourceTypeCode_Value, id, operation string) (pubsub.Message, error) {
+	name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+	if err != nil {
+		return pubsub.Message{}, err
+	}
+	attributes := map[string]string{
+		PubSubAttributeResourceType: name,
+		PubSubAttributeResourceID:   id,
+		PubSubAttributeOperation:    operation,
+	}
+	if pss.transactionTime != nil {
+		if t, err := pss.transactionTime.Get(); err == nil {
+			attributes[PubSubAttributeTransactionTime] = fhir.ToFHIRInstant(t)
+		}
+	}
+	return pubsub.Message{Attributes: attributes}, nil
+}
+
+func (pss *pubSubSink) add(ctx context.Context, msg pubsub.Message) error {
+	size := msg.Size()
+	if size > pubsub.MaxMessageBytes {
+		log.Errorf("%s/%s is %d bytes, too large to publish to Pub/Sub", msg.Attributes[PubSubAttributeResourceType], msg.Attributes[PubSubAttributeResourceID], size)
+		pss.publishErrorOccurred.Store(true)
+		pss.publishErrors.Add(1)
+		return nil
+	}
+	pss.mu.Lock()
+	defer pss.mu.Unlock()
+	if len(pss.batch) > 0 && (len(pss.batch) == pubsub.MaxBatchMessages || pss.batchBytes+size > pubsub.MaxBatchBytes) {
+		pss.publishBatch(ctx)
+	}
+	pss.batch = append(pss.batch, msg)
+	pss.batchBytes += size
+	return nil
+}
+
+// publishBatch publishes the current batch. Failures are logged and counted.
+// pss.mu must be held.
+func (pss *pubSubSink) publishBatch(ctx context.Context) {
+	if len(pss.batch) == 0 {
+		return
+	}
+	ctx, span := tracing.Start(ctx, "pubsub.Publish", attribute.Int("pubsub.batch_size", len(pss.batch)))
+	_, err := pss.client.Publish(ctx, pss.batch)
+	tracing.End(span, err)
+	if err != nil {
+		log.Errorf("%v", err)
+		pss.publishErrorOccurred.Store(true)
+		pss.publishErrors.Add(int64(len(pss.batch)))
+	}
+	pss.batch = nil
+	pss.batchBytes = 0
+}
+
+// Flush is Flusher.Flush. The current batch is published before returning.
+// Resources which failed to publish are handled as on Finalize.
+func (pss *pubSubSink) Flush(ctx context.Context) error {
+	pss.mu.Lock()
+	defer pss.mu.Unlock()
+	pss.publishBatch(ctx)
+	return pss.uploadError()
+}
+
+// Finalize is Sink.Finalize. The current batch is published before returning.
+// It returns an error if any resources failed to publish, unless
+// NoFailOnUploadErrors was set when the sink was created.
+func (pss *pubSubSink) Finalize(ctx context.Context) error {
+	return pss.Flush(ctx)
+}
+
+func (pss *pubSubSink) uploadError() error {
+	if !pss.publishErrorOccurred.Load() {
+		return nil
+	}
+	if pss.noFailOnUploadErrors {
+		log.Warningf("%v", ErrUploadFailures)
+		return nil
+	}
+	return fmt.Errorf("%w", ErrUploadFailures)
+}
+
+// UploadErrors is UploadErrorCounter.UploadErrors, counting the resources
+// which failed to publish.
+func (pss *pubSubSink) UploadErrors() int64 {
+	return pss.publishErrors.Load()
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/pubsub"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+const pubSubTopic = "projects/p/topics/fhir"
+
+func newPubSubSink(t *testing.T, server *testhelpers.PubSubServer, cfg processing.PubSubSinkConfig) processing.Sink {
+	t.Helper()
+	client, err := pubsub.NewClient(context.Background(), server.URL(), pubSubTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Client = client
+	sink, err := processing.NewPubSubSink(context.Background(), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func TestPubSubSink(t *testing.T) {
+	ctx := context.Background()
+	server := testhelpers.NewPubSubServer(t, pubSubTopic)
+	tt := bulkfhir.NewTransactionTime()
+	tt.Set(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	sink := newPubSubSink(t, server, processing.PubSubSinkConfig{TransactionTime: tt})
+
+	patient := []byte(`{"resourceType":"Patient","id":"p1"}`)
+	if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: patient}); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if err := sink.(processing.Deleter).Delete(ctx, cpb.ResourceTypeCode_COVERAGE, "c1"); err != nil {
+		t.Fatalf("Delete() returned unexpected error: %v", err)
+	}
+	if got := server.PublishCalls(); got != 0 {
+		t.Errorf("sink published %d batches before being finalized, want 0", got)
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	want := []testhelpers.PubSubMessage{
+		{Data: patient, Attributes: map[string]string{"resourceType": "Patient", "resourceId": "p1", "operation": "upsert", "transactionTime": "2024-01-02T03:04:05.000+00:00"}},
+		{Attributes: map[string]string{"resourceType": "Coverage", "resourceId": "c1", "operation": "delete", "transactionTime": "2024-01-02T03:04:05.000+00:00"}},
+	}
+	if diff := cmp.Diff(want, server.Messages()); diff != "" {
+		t.Errorf("sink published unexpected messages (-want +got): %s", diff)
+	}
+}
+
+func TestPubSubSink_Batches(t *testing.T) {
+	ctx := context.Background()
+	server := testhelpers.NewPubSubServer(t, pubSubTopic)
+	sink := newPubSubSink(t, server, processing.PubSubSinkConfig{})
+
+	n := pubsub.MaxBatchMessages + 10
+	for i := 0; i < n; i++ {
+		json := []byte(fmt.Sprintf(`{"resourceType":"Patient","id":"p%d"}`, i))
+		if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: json}); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if got := server.PublishCalls(); got != 1 {
+		t.Errorf("sink published %d batches before being flushed, want 1", got)
+	}
+	if err := sink.(processing.Flusher).Flush(ctx); err != nil {
+		t.Fatalf("Flush() returned unexpected error: %v", err)
+	}
+	if got := len(server.Messages()); got != n {
+		t.Errorf("sink published %d messages once flushed, want %d", got, n)
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+	if got := server.PublishCalls(); got != 2 {
+		t.Errorf("sink made %d publish requests, want 2", got)
+	}
+}
+
+func TestPubSubSink_PublishErrors(t *testing.T) {
+	for _, noFail := range []bool{false, true} {
+		t.Run(fmt.Sprintf("NoFailOnUploadErrors=%v", noFail), func(t *testing.T) {
+			ctx := context.Background()
+			server := testhelpers.NewPubSubServer(t, pubSubTopic)
+			server.FailNext(1)
+			sink := newPubSubSink(t, server, processing.PubSubSinkConfig{NoFailOnUploadErrors: noFail})
+
+			for _, id := range []string{"p1", "p2"} {
+				json := []byte(fmt.Sprintf(`{"resourceType":"Patient","id":"%s"}`, id))
+				if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: json}); err != nil {
+					t.Fatalf("Write() returned unexpected error: %v", err)
+				}
+			}
+			err := sink.Finalize(ctx)
+			if noFail && err != nil {
+				t.Errorf("Finalize() returned unexpected error: %v", err)
+			}
+			if !noFail && !errors.Is(err, processing.ErrUploadFailures) {
+				t.Errorf("Finalize() returned error %v, want %v", err, processing.ErrUploadFailures)
+			}
+			if got := sink.(processing.UploadErrorCounter).UploadErrors(); got != 2 {
+				t.Errorf("UploadErrors() = %d, want 2", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,457 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"github.com/google/bulk_fhir_tools/gcs"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+var fhirQuarantineCounter *metrics.Counter = metrics.NewCounter("fhir-quarantine-counter", "Count of FHIR Resources which matched a quarantine rule and were held back for review instead of being written to the sinks. The counter is tagged by the FHIR Resource type ex) PATIENT and the rule ex) impossible_ages.", "1", aggregation.Count, "FHIRResourceType", "Rule")
+
+// quarantineFileName is the name of the file quarantined resources are written
+// to within the quarantine directory.
+const quarantineFileName = "quarantine.ndjson"
+
+// QuarantineRule names a check which the quarantine processor applies to each
+// resource. Resources matching any enabled rule are quarantined.
+type QuarantineRule string
+
+const (
+	// QuarantineFutureDates matches resources with a date, dateTime or instant
+	// more than a day in the future. The end of a Period, and resources which
+	// routinely describe planned events (e.g. Appointment or Coverage), are not
+	// checked.
+	QuarantineFutureDates QuarantineRule = "future_dates"
+	// QuarantineNegativeAmounts matches resources with a negative Money value.
+	QuarantineNegativeAmounts QuarantineRule = "negative_amounts"
+	// QuarantineImpossibleAges matches Patients born in the future, more than
+	// maxAgeYears ago or after their death, and resources with an Age which is
+	// negative or more than maxAgeYears.
+	QuarantineImpossibleAges QuarantineRule = "impossible_ages"
+)
+
+// AllQuarantineRules lists every QuarantineRule.
+var AllQuarantineRules = []QuarantineRule{QuarantineFutureDates, QuarantineNegativeAmounts, QuarantineImpossibleAges}
+
+// ParseQuarantineRules parses a comma separated list of QuarantineRule names.
+func ParseQuarantineRules(s string) ([]QuarantineRule, error) {
+	var rules []QuarantineRule
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		r := QuarantineRule(name)
+		known := false
+		for _, k := range AllQuarantineRules {
+			known = known || r == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown quarantine rule %q, must be one of %v", name, AllQuarantineRules)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+const (
+	// maxAgeYears is the greatest age considered possible by
+	// QuarantineImpossibleAges.
+	maxAgeYears = 150
+	// futureDateTolerance allows for timezones and clock skew before a date is
+	// considered to be in the future.
+	futureDateTolerance = 24 * time.Hour
+)
+
+// plannedResourceTypes are the resource types which routinely hold future
+// dates, and so are not checked by QuarantineFutureDates.
+var plannedResourceTypes = map[cpb.ResourceTypeCode_Value]bool{
+	cpb.ResourceTypeCode_APPOINTMENT:                 true,
+	cpb.ResourceTypeCode_APPOINTMENT_RESPONSE:        true,
+	cpb.ResourceTypeCode_CARE_PLAN:                   true,
+	cpb.ResourceTypeCode_CONTRACT:                    true,
+	cpb.ResourceTypeCode_COVERAGE:                    true,
+	cpb.ResourceTypeCode_DEVICE_REQUEST:              true,
+	cpb.ResourceTypeCode_GOAL:                        true,
+	cpb.ResourceTypeCode_IMMUNIZATION_RECOMMENDATION: true,
+	cpb.ResourceTypeCode_MEDICATION_REQUEST:          true,
+	cpb.ResourceTypeCode_NUTRITION_ORDER:             true,
+	cpb.ResourceTypeCode_SCHEDULE:                    true,
+	cpb.ResourceTypeCode_SERVICE_REQUEST:             true,
+	cpb.ResourceTypeCode_SLOT:                        true,
+	cpb.ResourceTypeCode_TASK:                        true,
+}
+
+// QuarantinedResource describes a resource which was held back from the sinks
+// of a Pipeline because it matched one or more quarantine rules.
+type QuarantinedResource struct {
+	ResourceType cpb.ResourceTypeCode_Value
+	SourceURL    string
+	// JSON is the resource as it was passed to the quarantine processor.
+	JSON []byte
+	// Reasons describe each rule the resource matched, and why.
+	Reasons []string
+}
+
+// QuarantineSink receives resources which were quarantined, so that they can
+// be reviewed and released later.
+type QuarantineSink interface {
+	// WriteQuarantined writes the quarantined resource to storage.
+	WriteQuarantined(ctx context.Context, qr *QuarantinedResource) error
+	// Finalize performs any final writing and cleanup. This is called after all
+	// quarantined resources have been passed to WriteQuarantined().
+	Finalize(ctx context.Context) error
+}
+
+type quarantineProcessor struct {
+	BaseProcessor
+	rules []QuarantineRule
+	sink  QuarantineSink
+}
+
+// Assert quarantineProcessor satisfies the Processor interface.
+var _ Processor = &quarantineProcessor{}
+
+// NewQuarantineProcessor creates a Processor which checks each resource against
+// the given rules. Resources matching any rule are written to the
+// QuarantineSink for human review instead of being passed on, and may later be
+// released with ReleaseQuarantined. The sink is finalized along with the
+// processor.
+func NewQuarantineProcessor(rules []QuarantineRule, sink QuarantineSink) Processor {
+	return &quarantineProcessor{rules: rules, sink: sink}
+}
+
+func (qp *quarantineProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	// Keep the JSON as it was received, as calling Proto() discards it.
+	original, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	proto, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	reasons, matched := checkQuarantineRules(resource.Type(), proto, qp.rules, time.Now())
+	if len(reasons) == 0 {
+		return qp.Output(ctx, resource)
+	}
+	for _, r := range matched {
+		if err := fhirQuarantineCounter.Record(ctx, 1, resource.Type().String(), string(r)); err != nil {
+			return err
+		}
+	}
+	return qp.sink.WriteQuarantined(ctx, &QuarantinedResource{
+		ResourceType: resource.Type(),
+		SourceURL:    resource.SourceURL(),
+		JSON:         original,
+		Reasons:      reasons,
+	})
+}
+
+func (qp *quarantineProcessor) Finalize(ctx context.Context) error {
+	return qp.sink.Finalize(ctx)
+}
+
+// checkQuarantineRules returns a description of each problem found by the given
+// rules, and the rules which found them.
+func checkQuarantineRules(resourceType cpb.ResourceTypeCode_Value, cr *rpb.ContainedResource, rules []QuarantineRule, now time.Time) (reasons []string, matched []QuarantineRule) {
+	for _, rule := range rules {
+		var found []string
+		switch rule {
+		case QuarantineFutureDates:
+			if !plannedResourceTypes[resourceType] {
+				found = findFutureDates(cr, now)
+			}
+		case QuarantineNegativeAmounts:
+			found = findNegativeAmounts(cr)
+		case QuarantineImpossibleAges:
+			found = findImpossibleAges(cr, now)
+		}
+		for _, f := range found {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", rule, f))
+		}
+		if len(found) > 0 {
+			matched = append(matched, rule)
+		}
+	}
+	return reasons, matched
+}
+
+var (
+	dateName     = (&dpb.Date{}).ProtoReflect().Descriptor().FullName()
+	dateTimeName = (&dpb.DateTime{}).ProtoReflect().Descriptor().FullName()
+	instantName  = (&dpb.Instant{}).ProtoReflect().Descriptor().FullName()
+	moneyName    = (&dpb.Money{}).ProtoReflect().Descriptor().FullName()
+	ageName      = (&dpb.Age{}).ProtoReflect().Descriptor().FullName()
+)
+
+// walkMessages calls fn for every message nested within the resource, along
+// with its path as FHIR JSON field names (e.g. item[0].net).
+func walkMessages(cr *rpb.ContainedResource, fn func(path string, m protoreflect.Message)) {
+	var walk func(path string, m protoreflect.Message)
+	walk = func(path string, m protoreflect.Message) {
+		fn(path, m)
+		m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+			if fd.Kind() != protoreflect.MessageKind {
+				return true
+			}
+			p := fd.JSONName()
+			if path != "" {
+				p = path + "." + p
+			}
+			if fd.IsList() {
+				for i := 0; i < v.List().Len(); i++ {
+					walk(fmt.Sprintf("%s[%d]", p, i), v.List().Get(i).Message())
+				}
+			} else if !fd.IsMap() {
+				walk(p, v.Message())
+			}
+			return true
+		})
+	}
+	// Skip the ContainedResource and resource messages, so that paths start at
+	// the fields of the resource.
+	cr.ProtoReflect().Range(func(_ protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		walk("", v.Message())
+		return false
+	})
+}
+
+// timeValue returns the time held by a date, dateTime or instant message.
+func timeValue(m protoreflect.Message) (time.Time, bool) {
+	switch v := m.Interface().(type) {
+	case *dpb.Date:
+		return time.UnixMicro(v.GetValueUs()), true
+	case *dpb.DateTime:
+		return time.UnixMicro(v.GetValueUs()), true
+	case *dpb.Instant:
+		return time.UnixMicro(v.GetValueUs()), true
+	}
+	return time.Time{}, false
+}
+
+func findFutureDates(cr *rpb.ContainedResource, now time.Time) []string {
+	var found []string
+	walkMessages(cr, func(path string, m protoreflect.Message) {
+		switch m.Descriptor().FullName() {
+		case dateName, dateTimeName, instantName:
+		default:
+			return
+		}
+		// The end of a Period may legitimately be planned.
+		if path == "end" || strings.HasSuffix(path, ".end") {
+			return
+		}
+		if t, _ := timeValue(m); t.After(now.Add(futureDateTolerance)) {
+			found = append(found, fmt.Sprintf("%s is in the future (%s)", path, t.UTC().Format(time.RFC3339)))
+		}
+	})
+	return found
+}
+
+func findNegativeAmounts(cr *rpb.ContainedResource) []string {
+	var found []string
+	walkMessages(cr, func(path string, m protoreflect.Message) {
+		if m.Descriptor().FullName() != moneyName {
+			return
+		}
+		value := m.Interface().(*dpb.Money).GetValue().GetValue()
+		if v, err := strconv.ParseFloat(value, 64); err == nil && v < 0 {
+			found = append(found, fmt.Sprintf("%s has negative value %s", path, value))
+		}
+	})
+	return found
+}
+
+// ageUnitsPerYear maps UCUM units of time to how many of them make a year.
+var ageUnitsPerYear = map[string]float64{
+	"a":   1,
+	"mo":  12,
+	"wk":  52,
+	"d":   365,
+	"h":   365 * 24,
+	"min": 365 * 24 * 60,
+}
+
+func findImpossibleAges(cr *rpb.ContainedResource, now time.Time) []string {
+	var found []string
+	if p := cr.GetPatient(); p.GetBirthDate() != nil {
+		birth := time.UnixMicro(p.GetBirthDate().GetValueUs())
+		switch {
+		case birth.After(now.Add(futureDateTolerance)):
+			found = append(found, "birthDate is in the future")
+		case birth.Before(now.AddDate(-maxAgeYears, 0, 0)):
+			found = append(found, fmt.Sprintf("birthDate implies an age of more than %d years", maxAgeYears))
+		}
+		if d := p.GetDeceased().GetDateTime(); d != nil && time.UnixMicro(d.GetValueUs()).Before(birth) {
+			found = append(found, "deceased.dateTime is before birthDate")
+		}
+	}
+	walkMessages(cr, func(path string, m protoreflect.Message) {
+		if m.Descriptor().FullName() != ageName {
+			return
+		}
+		age := m.Interface().(*dpb.Age)
+		v, err := strconv.ParseFloat(age.GetValue().GetValue(), 64)
+		if err != nil {
+			return
+		}
+		if v < 0 {
+			found = append(found, fmt.Sprintf("%s is negative", path))
+		} else if perYear, ok := ageUnitsPerYear[age.GetCode().GetValue()]; ok && v/perYear > maxAgeYears {
+			found = append(found, fmt.Sprintf("%s is more than %d years", path, maxAgeYears))
+		}
+	})
+	return found
+}
+
+// quarantineNDJSONLine is the format of each line written by
+// ndjsonQuarantineSink, and read by ReleaseQuarantined.
+type quarantineNDJSONLine struct {
+	ResourceType string   `json:"resource_type"`
+	SourceURL    string   `json:"source_url"`
+	Reasons      []string `json:"reasons"`
+	FHIRResource string   `json:"fhir_resource"`
+}
+
+type ndjsonQuarantineSink struct {
+	createFile createFileFunc
+
+	mu sync.Mutex
+	// The file is only created once the first resource is quarantined, so that
+	// runs without suspect resources do not leave an empty file behind.
+	w io.WriteCloser
+}
+
+// NewNDJSONQuarantineSink returns a QuarantineSink which writes quarantined
+// resources to a quarantine.ndjson file in the given directory. Each line holds
+// the resource type, source URL, reasons and original JSON of the resource.
+//
+// It is threadsafe to call WriteQuarantined on this sink from multiple
+// goroutines.
+func NewNDJSONQuarantineSink(ctx context.Context, directory string) (QuarantineSink, error) {
+	if stat, err := os.Stat(directory); err != nil {
+		return nil, fmt.Errorf("could not stat directory %q - %w", directory, err)
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", directory)
+	}
+	// This closure captures the `directory` parameter.
+	createFile := func(ctx context.Context, filename string) (io.WriteCloser, error) {
+		return os.OpenFile(filepath.Join(directory, filename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	}
+	return &ndjsonQuarantineSink{createFile: createFile}, nil
+}
+
+// NewGCSNDJSONQuarantineSink returns a QuarantineSink which writes quarantined
+// resources to GCS. See NewNDJSONQuarantineSink for additional documentation.
+func NewGCSNDJSONQuarantineSink(ctx context.Context, endpoint, bucket, directory string) (QuarantineSink, error) {
+	gcsClient, err := gcs.NewClient(ctx, bucket, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// This closure captures the GCS client and the `directory` parameter.
+	createFile := func(ctx context.Context, filename string) (io.WriteCloser, error) {
+		return gcsClient.GetFileWriter(ctx, gcs.JoinPath(directory, filename)), nil
+	}
+	return &ndjsonQuarantineSink{createFile: createFile}, nil
+}
+
+func (qs *ndjsonQuarantineSink) WriteQuarantined(ctx context.Context, qr *QuarantinedResource) error {
+	data, err := json.Marshal(quarantineNDJSONLine{
+		ResourceType: qr.ResourceType.String(),
+		SourceURL:    qr.SourceURL,
+		Reasons:      qr.Reasons,
+		FHIRResource: string(qr.JSON),
+	})
+	if err != nil {
+		return err
+	}
+
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if qs.w == nil {
+		qs.w, err = qs.createFile(ctx, quarantineFileName)
+		if err != nil {
+			return fmt.Errorf("error creating quarantine file: %w", err)
+		}
+	}
+	_, err = qs.w.Write(append(data, '\n'))
+	return err
+}
+
+func (qs *ndjsonQuarantineSink) Finalize(ctx context.Context) error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if qs.w == nil {
+		return nil
+	}
+	return qs.w.Close()
+}
+
+// ReleaseQuarantined reads quarantined resources in the format written by
+// NewNDJSONQuarantineSink from r, and passes each of them to the Pipeline. It
+// returns the number of resources released. The Pipeline is not finalized.
+//
+// Reviewers are expected to remove resources which should not be released from
+// the file, or correct them, before releasing it. The Pipeline should not
+// include a quarantine processor, or the resources would be quarantined again.
+func ReleaseQuarantined(ctx context.Context, p *Pipeline, r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	released := 0
+	for lineNum := 1; ; lineNum++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return released, err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			var q quarantineNDJSONLine
+			if err := json.Unmarshal(trimmed, &q); err != nil {
+				return released, fmt.Errorf("invalid quarantined resource on line %d: %w", lineNum, err)
+			}
+			resourceType, ok := cpb.ResourceTypeCode_Value_value[q.ResourceType]
+			if !ok {
+				return released, fmt.Errorf("invalid resource type %q on line %d", q.ResourceType, lineNum)
+			}
+			if err := p.Process(ctx, cpb.ResourceTypeCode_Value(resourceType), q.SourceURL, []byte(q.FHIRResource)); err != nil {
+				return released, fmt.Errorf("error releasing resource on line %d: %w", lineNum, err)
+			}
+			released++
+		}
+		if err != nil {
+			return released, nil
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+type testQuarantineSink struct {
+	quarantined []*processing.QuarantinedResource
+	finalized   bool
+}
+
+func (ts *testQuarantineSink) WriteQuarantined(ctx context.Context, qr *processing.QuarantinedResource) error {
+	ts.quarantined = append(ts.quarantined, qr)
+	return nil
+}
+
+func (ts *testQuarantineSink) Finalize(ctx context.Context) error {
+	ts.finalized = true
+	return nil
+}
+
+func TestQuarantineProcessor(t *testing.T) {
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+		rules        []processing.QuarantineRule
+		wantReasons  []string
+	}{
+		{
+			name:         "plausible patient",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1","birthDate":"1990-01-01"}`,
+		},
+		{
+			name:         "patient born in the future",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1","birthDate":"2999-01-01"}`,
+			wantReasons: []string{
+				"future_dates: birthDate is in the future (2999-01-01T00:00:00Z)",
+				"impossible_ages: birthDate is in the future",
+			},
+		},
+		{
+			name:         "only enabled rules are checked",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1","birthDate":"2999-01-01"}`,
+			rules:        []processing.QuarantineRule{processing.QuarantineNegativeAmounts},
+		},
+		{
+			name:         "patient too old",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1","birthDate":"1700-01-01"}`,
+			wantReasons:  []string{"impossible_ages: birthDate implies an age of more than 150 years"},
+		},
+		{
+			name:         "patient died before birth",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1","birthDate":"1990-01-01","deceasedDateTime":"1980-01-01"}`,
+			wantReasons:  []string{"impossible_ages: deceased.dateTime is before birthDate"},
+		},
+		{
+			name:         "negative money",
+			resourceType: cpb.ResourceTypeCode_CLAIM,
+			json:         `{"resourceType":"Claim","id":"1","total":{"value":-10.5,"currency":"USD"},"item":[{"sequence":1,"net":{"value":3}}]}`,
+			wantReasons:  []string{"negative_amounts: total has negative value -10.5"},
+		},
+		{
+			name:         "impossible onset age",
+			resourceType: cpb.ResourceTypeCode_CONDITION,
+			json:         `{"resourceType":"Condition","id":"1","onsetAge":{"value":200,"system":"http://unitsofmeasure.org","code":"a"}}`,
+			wantReasons:  []string{"impossible_ages: onset.age is more than 150 years"},
+		},
+		{
+			name:         "future encounter start",
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			json:         `{"resourceType":"Encounter","id":"1","period":{"start":"2999-01-01T10:00:00Z"}}`,
+			wantReasons:  []string{"future_dates: period.start is in the future (2999-01-01T10:00:00Z)"},
+		},
+		{
+			name:         "future period end is allowed",
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			json:         `{"resourceType":"Encounter","id":"1","period":{"start":"2020-01-01","end":"2999-01-01"}}`,
+		},
+		{
+			name:         "planned resources may be in the future",
+			resourceType: cpb.ResourceTypeCode_APPOINTMENT,
+			json:         `{"resourceType":"Appointment","id":"1","start":"2999-01-01T10:00:00Z"}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			rules := tc.rules
+			if rules == nil {
+				rules = processing.AllQuarantineRules
+			}
+			ts := &processing.TestSink{}
+			qs := &testQuarantineSink{}
+			p, err := processing.NewPipeline([]processing.Processor{processing.NewQuarantineProcessor(rules, qs)}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Process(ctx, tc.resourceType, "http://source", []byte(tc.json)); err != nil {
+				t.Fatalf("p.Process() returned unexpected error: %v", err)
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+			}
+			if !qs.finalized {
+				t.Errorf("quarantine sink was not finalized")
+			}
+
+			if len(tc.wantReasons) == 0 {
+				if len(qs.quarantined) != 0 || len(ts.WrittenResources) != 1 {
+					t.Errorf("got %d quarantined and %d written resources, want 0 and 1", len(qs.quarantined), len(ts.WrittenResources))
+				}
+				return
+			}
+			if len(qs.quarantined) != 1 || len(ts.WrittenResources) != 0 {
+				t.Fatalf("got %d quarantined and %d written resources, want 1 and 0", len(qs.quarantined), len(ts.WrittenResources))
+			}
+			got := qs.quarantined[0]
+			want := &processing.QuarantinedResource{
+				ResourceType: tc.resourceType,
+				SourceURL:    "http://source",
+				JSON:         []byte(tc.json),
+				Reasons:      tc.wantReasons,
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("unexpected quarantined resource (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseQuarantineRules(t *testing.T) {
+	got, err := processing.ParseQuarantineRules("future_dates, impossible_ages")
+	if err != nil {
+		t.Fatalf("ParseQuarantineRules() returned unexpected error: %v", err)
+	}
+	want := []processing.QuarantineRule{processing.QuarantineFutureDates, processing.QuarantineImpossibleAges}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ParseQuarantineRules() returned unexpected rules (-want +got):\n%s", diff)
+	}
+	if _, err := processing.ParseQuarantineRules("future_dates,unknown"); err == nil {
+		t.Errorf("ParseQuarantineRules() with an unknown rule returned nil error")
+	}
+}
+
+func TestNDJSONQuarantineSink_Release(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	dir := t.TempDir()
+	qs, err := processing.NewNDJSONQuarantineSink(ctx, dir)
+	if err != nil {
+		t.Fatalf("NewNDJSONQuarantineSink() returned unexpected error: %v", err)
+	}
+	if err := qs.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "quarantine.ndjson")); !os.IsNotExist(err) {
+		t.Errorf("quarantine file exists without any quarantined resources, stat error: %v", err)
+	}
+
+	qs, err = processing.NewNDJSONQuarantineSink(ctx, dir)
+	if err != nil {
+		t.Fatalf("NewNDJSONQuarantineSink() returned unexpected error: %v", err)
+	}
+	inputs := []string{
+		`{"resourceType":"Patient","id":"1","birthDate":"1700-01-01"}`,
+		`{"resourceType":"Patient","id":"2","birthDate":"1700-01-01"}`,
+	}
+	for _, in := range inputs {
+		if err := qs.WriteQuarantined(ctx, &processing.QuarantinedResource{
+			ResourceType: cpb.ResourceTypeCode_PATIENT,
+			SourceURL:    "http://source",
+			JSON:         []byte(in),
+			Reasons:      []string{"impossible_ages: birthDate implies an age of more than 150 years"},
+		}); err != nil {
+			t.Fatalf("WriteQuarantined() returned unexpected error: %v", err)
+		}
+	}
+	if err := qs.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "quarantine.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline(nil, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	released, err := processing.ReleaseQuarantined(ctx, p, f)
+	if err != nil {
+		t.Fatalf("ReleaseQuarantined() returned unexpected error: %v", err)
+	}
+	if released != len(inputs) {
+		t.Errorf("ReleaseQuarantined() released %d resources, want %d", released, len(inputs))
+	}
+	var got []string
+	for _, r := range ts.WrittenResources {
+		json, err := r.JSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Type() != cpb.ResourceTypeCode_PATIENT || r.SourceURL() != "http://source" {
+			t.Errorf("released resource has type %v and source URL %q, want PATIENT and http://source", r.Type(), r.SourceURL())
+		}
+		got = append(got, string(json))
+	}
+	if diff := cmp.Diff(inputs, got); diff != "" {
+		t.Errorf("unexpected released resources (-want +got):\n%s", diff)
+	}
+
+	if _, err := processing.ReleaseQuarantined(ctx, p, strings.NewReader("not json\n")); err == nil {
+		t.Errorf("ReleaseQuarantined() with an invalid line returned nil error")
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// RectifyAction is the kind of fix made by a RectifyRule.
+type RectifyAction string
+
+const (
+	// RectifyAddMissing adds the element at the rule's Path, set to its Value,
+	// wherever the element's parent is present but the element is not, such as
+	// a required field the source does not map.
+	RectifyAddMissing RectifyAction = "add_missing"
+	// RectifyReplaceSystem replaces the system of Codings, Identifiers and
+	// Quantities which is From with To, such as a code system sent with a
+	// non-canonical URL. If the rule has a Path, only systems within the
+	// elements at the path are replaced, and otherwise all systems in resources
+	// of every type are.
+	RectifyReplaceSystem RectifyAction = "replace_system"
+	// RectifyCoerce converts the primitive values at the rule's Path to its
+	// Type, such as a decimal sent as a JSON string. Values which cannot be
+	// converted are left as they are.
+	RectifyCoerce RectifyAction = "coerce"
+)
+
+// rectifyCoerceTypes are the types a RectifyCoerce rule may convert values to.
+var rectifyCoerceTypes = []string{"string", "integer", "decimal", "boolean"}
+
+// RectifyRule describes a fix to make to resources, for use with
+// NewRectifyRulesProcessor. Rules are usually read from a JSON file with
+// ReadRectifyRules.
+type RectifyRule struct {
+	// Name identifies the rule in the fhir-rectify-counter metric. If empty,
+	// the upper case Action is used, e.g. ADD_MISSING.
+	Name   string        `json:"name,omitempty"`
+	Action RectifyAction `json:"action"`
+	// Path is a simple FHIRPath expression such as ExplanationOfBenefit.provider,
+	// naming the element of a resource type the rule applies to. The last
+	// element name of the path must be exact, such as valueQuantity rather than
+	// value.
+	Path string `json:"path,omitempty"`
+	// Value is the FHIR JSON value added by RectifyAddMissing rules.
+	Value json.RawMessage `json:"value,omitempty"`
+	// From and To are the systems replaced by RectifyReplaceSystem rules.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Type is the type RectifyCoerce rules convert to: string, integer, decimal
+	// or boolean.
+	Type string `json:"type,omitempty"`
+}
+
+// rectifyRule is a RectifyRule which has been checked and parsed.
+type rectifyRule struct {
+	RectifyRule
+	name string
+	// resourceType and path are unset if the rule applies to every resource
+	// type.
+	resourceType cpb.ResourceTypeCode_Value
+	path         []string
+}
+
+// ReadRectifyRules reads RectifyRules from a local JSON file of the form
+// {"rules": [{"action": "add_missing", "path": ..., "value": ...}, ...]}.
+func ReadRectifyRules(path string) ([]RectifyRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var file struct {
+		Rules []RectifyRule `json:"rules"`
+	}
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse rectify rules %s: %w", path, err)
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("%s has no rectify rules", path)
+	}
+	return file.Rules, nil
+}
+
+func parseRectifyRule(r RectifyRule) (*rectifyRule, error) {
+	parsed := &rectifyRule{RectifyRule: r, name: r.Name}
+	if parsed.name == "" {
+		parsed.name = strings.ToUpper(string(r.Action))
+	}
+	if r.Path != "" {
+		paths, err := parseResourcePaths("rectify rule", []string{r.Path})
+		if err != nil {
+			return nil, err
+		}
+		for rt, p := range paths {
+			parsed.resourceType, parsed.path = rt, p[0]
+		}
+	}
+	switch r.Action {
+	case RectifyAddMissing:
+		if r.Path == "" {
+			return nil, errors.New("add_missing rules require a path")
+		}
+		if len(r.Value) == 0 || !json.Valid(r.Value) {
+			return nil, errors.New("add_missing rules require a JSON value")
+		}
+	case RectifyReplaceSystem:
+		if r.From == "" || r.To == "" {
+			return nil, errors.New("replace_system rules require from and to systems")
+		}
+	case RectifyCoerce:
+		if r.Path == "" {
+			return nil, errors.New("coerce rules require a path")
+		}
+		known := false
+		for _, t := range rectifyCoerceTypes {
+			known = known || r.Type == t
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown coerce type %q, must be one of %v", r.Type, rectifyCoerceTypes)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q, must be one of %v", r.Action, []RectifyAction{RectifyAddMissing, RectifyReplaceSystem, RectifyCoerce})
+	}
+	return parsed, nil
+}
+
+// appliesTo returns whether the rule applies to resources of the given type.
+func (r *rectifyRule) appliesTo(resourceType cpb.ResourceTypeCode_Value) bool {
+	return r.path == nil || r.resourceType == resourceType
+}
+
+// apply applies the rule to the parsed JSON resource, returning the number of
+// elements changed.
+func (r *rectifyRule) apply(resource map[string]any) (int, error) {
+	switch r.Action {
+	case RectifyAddMissing:
+		n := 0
+		field := r.path[len(r.path)-1]
+		for _, e := range selectElements([]any{resource}, r.path[:len(r.path)-1]) {
+			parent, ok := e.(map[string]any)
+			if !ok {
+				continue
+			}
+			if _, ok := parent[field]; ok {
+				continue
+			}
+			// Decode the value for each element it is added to, so that the
+			// elements can be changed independently by later rules.
+			dec := json.NewDecoder(bytes.NewReader(r.Value))
+			dec.UseNumber()
+			var v any
+			if err := dec.Decode(&v); err != nil {
+				return n, err
+			}
+			parent[field] = v
+			n++
+		}
+		return n, nil
+	case RectifyReplaceSystem:
+		elements := []any{resource}
+		if r.path != nil {
+			elements = selectElements(elements, r.path)
+		}
+		n := 0
+		for _, e := range elements {
+			n += replaceSystem(e, r.From, r.To)
+		}
+		return n, nil
+	case RectifyCoerce:
+		n := 0
+		field := r.path[len(r.path)-1]
+		for _, e := range selectElements([]any{resource}, r.path[:len(r.path)-1]) {
+			parent, ok := e.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch v := parent[field].(type) {
+			case nil:
+			case []any:
+				for i, item := range v {
+					if c, ok := coerceValue(item, r.Type); ok {
+						v[i] = c
+						n++
+					}
+				}
+			default:
+				if c, ok := coerceValue(v, r.Type); ok {
+					parent[field] = c
+					n++
+				}
+			}
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown rectify action %q", r.Action)
+}
+
+// replaceSystem replaces any system within the JSON element which is from with
+// to, returning the number replaced.
+func replaceSystem(element any, from, to string) int {
+	n := 0
+	switch e := element.(type) {
+	case map[string]any:
+		for k, v := range e {
+			if s, ok := v.(string); ok && k == "system" && s == from {
+				e[k] = to
+				n++
+				continue
+			}
+			n += replaceSystem(v, from, to)
+		}
+	case []any:
+		for _, v := range e {
+			n += replaceSystem(v, from, to)
+		}
+	}
+	return n
+}
+
+// coerceValue converts the JSON primitive to the given type, returning false
+// if it is already of that type or cannot be converted.
+func coerceValue(v any, typ string) (any, bool) {
+	switch typ {
+	case "string":
+		switch p := v.(type) {
+		case json.Number:
+			return p.String(), true
+		case bool:
+			return strconv.FormatBool(p), true
+		}
+	case "decimal":
+		if s, ok := v.(string); ok {
+			if n, ok := parseJSONNumber(s); ok {
+				return n, true
+			}
+		}
+	case "integer":
+		var n json.Number
+		switch p := v.(type) {
+		case string:
+			var ok bool
+			if n, ok = parseJSONNumber(p); !ok {
+				return nil, false
+			}
+		case json.Number:
+			n = p
+		default:
+			return nil, false
+		}
+		f, err := n.Float64()
+		if err != nil || f != math.Trunc(f) || f < math.MinInt32 || f > math.MaxInt32 {
+			return nil, false
+		}
+		i := json.Number(strconv.FormatInt(int64(f), 10))
+		if i == v {
+			return nil, false
+		}
+		return i, true
+	case "boolean":
+		if s, ok := v.(string); ok {
+			switch strings.ToLower(strings.TrimSpace(s)) {
+			case "true":
+				return true, true
+			case "false":
+				return false, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// parseJSONNumber returns s as a JSON number, if it is one.
+func parseJSONNumber(s string) (json.Number, bool) {
+	s = strings.TrimSpace(s)
+	if _, err := strconv.ParseFloat(s, 64); err != nil || !json.Valid([]byte(s)) {
+		return "", false
+	}
+	return json.Number(s), true
+}
+
+type rectifyRulesProcessor struct {
+	BaseProcessor
+	rules []*rectifyRule
+}
+
+// Assert rectifyRulesProcessor satisfies the Processor interface.
+var _ Processor = &rectifyRulesProcessor{}
+
+// NewRectifyRulesProcessor creates a Processor which fixes resources according
+// to the given rules, in order, so that FHIR from servers with known mapping
+// issues can be made valid R4 without changes to this code, as
+// NewBCDARectifyProcessor does for BCDA. Rules are applied to the FHIR JSON,
+// so this processor should come before any which parse resources, as a
+// resource which is invalid until rectified may fail to parse.
+func NewRectifyRulesProcessor(rules []RectifyRule) (Processor, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("at least one rectify rule is required")
+	}
+	rp := &rectifyRulesProcessor{}
+	for i, r := range rules {
+		parsed, err := parseRectifyRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rectify rule %d: %w", i+1, err)
+		}
+		rp.rules = append(rp.rules, parsed)
+	}
+	return rp, nil
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (rp *rectifyRulesProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (rp *rectifyRulesProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	var rules []*rectifyRule
+	for _, r := range rp.rules {
+		if r.appliesTo(resource.Type()) {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return rp.Output(ctx, resource)
+	}
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as written, so that they are not changed by rules which
+	// don't apply to them.
+	dec.UseNumber()
+	var parsed map[string]any
+	if err := dec.Decode(&parsed); err != nil {
+		return err
+	}
+	changed := false
+	for _, r := range rules {
+		n, err := r.apply(parsed)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		changed = true
+		if err := fhirRectifyCounter.Record(ctx, int64(n), resource.Type().String(), r.name); err != nil {
+			return err
+		}
+	}
+	if !changed {
+		return rp.Output(ctx, resource)
+	}
+	rectified, err := json.Marshal(parsed)
+	if err != nil {
+		return err
+	}
+	rw, err := NewResourceWrapperFromJSON(resource.Type(), resource.SourceURL(), rectified)
+	if err != nil {
+		return err
+	}
+	return rp.Output(ctx, rw)
+}
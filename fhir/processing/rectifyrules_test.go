@@ -0,0 +1,192 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestRectifyRulesProcessor(t *testing.T) {
+	cases := []struct {
+		name         string
+		rules        []processing.RectifyRule
+		resourceType cpb.ResourceTypeCode_Value
+		jsonIn       []byte
+		wantJSON     []byte
+		wantCount    map[string]int64
+	}{
+		{
+			name: "AddMissing",
+			rules: []processing.RectifyRule{
+				{Name: "MISSING_PROVIDER_REFERENCE", Action: processing.RectifyAddMissing, Path: "ExplanationOfBenefit.provider", Value: json.RawMessage(`{"display": "unknown"}`)},
+				{Action: processing.RectifyAddMissing, Path: "ExplanationOfBenefit.insurance.focal", Value: json.RawMessage(`true`)},
+			},
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			jsonIn:       []byte(`{"resourceType": "ExplanationOfBenefit", "id": "123", "insurance": [{"coverage": {"reference": "Coverage/1"}}, {"coverage": {"reference": "Coverage/2"}, "focal": false}]}`),
+			wantJSON:     []byte(`{"resourceType": "ExplanationOfBenefit", "id": "123", "provider": {"display": "unknown"}, "insurance": [{"coverage": {"reference": "Coverage/1"}, "focal": true}, {"coverage": {"reference": "Coverage/2"}, "focal": false}]}`),
+			wantCount:    map[string]int64{"EXPLANATION_OF_BENEFIT-MISSING_PROVIDER_REFERENCE": 1, "EXPLANATION_OF_BENEFIT-ADD_MISSING": 1},
+		},
+		{
+			name: "AddMissingPresent",
+			rules: []processing.RectifyRule{
+				{Action: processing.RectifyAddMissing, Path: "ExplanationOfBenefit.provider", Value: json.RawMessage(`{"display": "unknown"}`)},
+			},
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			jsonIn:       []byte(`{"resourceType": "ExplanationOfBenefit", "id": "123", "provider": {"reference": "Practitioner/1"}}`),
+			wantJSON:     []byte(`{"resourceType": "ExplanationOfBenefit", "id": "123", "provider": {"reference": "Practitioner/1"}}`),
+			wantCount:    map[string]int64{},
+		},
+		{
+			name: "ReplaceSystemEverywhere",
+			rules: []processing.RectifyRule{
+				{Action: processing.RectifyReplaceSystem, From: "urn:oid:2.16.840.1.113883.6.1", To: "http://loinc.org"},
+			},
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			jsonIn:       []byte(`{"resourceType": "Observation", "id": "123", "status": "final", "code": {"coding": [{"system": "urn:oid:2.16.840.1.113883.6.1", "code": "1234-5"}, {"system": "http://snomed.info/sct", "code": "1"}]}, "component": [{"code": {"coding": [{"system": "urn:oid:2.16.840.1.113883.6.1", "code": "2345-6"}]}}]}`),
+			wantJSON:     []byte(`{"resourceType": "Observation", "id": "123", "status": "final", "code": {"coding": [{"system": "http://loinc.org", "code": "1234-5"}, {"system": "http://snomed.info/sct", "code": "1"}]}, "component": [{"code": {"coding": [{"system": "http://loinc.org", "code": "2345-6"}]}}]}`),
+			wantCount:    map[string]int64{"OBSERVATION-REPLACE_SYSTEM": 2},
+		},
+		{
+			name: "ReplaceSystemAtPath",
+			rules: []processing.RectifyRule{
+				{Action: processing.RectifyReplaceSystem, Path: "Observation.code", From: "urn:oid:2.16.840.1.113883.6.1", To: "http://loinc.org"},
+			},
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			jsonIn:       []byte(`{"resourceType": "Observation", "id": "123", "status": "final", "code": {"coding": [{"system": "urn:oid:2.16.840.1.113883.6.1", "code": "1234-5"}]}, "component": [{"code": {"coding": [{"system": "urn:oid:2.16.840.1.113883.6.1", "code": "2345-6"}]}}]}`),
+			wantJSON:     []byte(`{"resourceType": "Observation", "id": "123", "status": "final", "code": {"coding": [{"system": "http://loinc.org", "code": "1234-5"}]}, "component": [{"code": {"coding": [{"system": "urn:oid:2.16.840.1.113883.6.1", "code": "2345-6"}]}}]}`),
+			wantCount:    map[string]int64{"OBSERVATION-REPLACE_SYSTEM": 1},
+		},
+		{
+			name: "Coerce",
+			rules: []processing.RectifyRule{
+				{Action: processing.RectifyCoerce, Path: "ExplanationOfBenefit.item.sequence", Type: "integer"},
+				{Action: processing.RectifyCoerce, Path: "ExplanationOfBenefit.item.net.value", Type: "decimal"},
+				{Action: processing.RectifyCoerce, Path: "ExplanationOfBenefit.insurance.focal", Type: "boolean"},
+			},
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			jsonIn:       []byte(`{"resourceType": "ExplanationOfBenefit", "id": "123", "insurance": [{"focal": "TRUE"}], "item": [{"sequence": "1", "net": {"value": "12.50"}}, {"sequence": 2, "net": {"value": "n/a"}}]}`),
+			wantJSON:     []byte(`{"resourceType": "ExplanationOfBenefit", "id": "123", "insurance": [{"focal": true}], "item": [{"sequence": 1, "net": {"value": 12.50}}, {"sequence": 2, "net": {"value": "n/a"}}]}`),
+			wantCount:    map[string]int64{"EXPLANATION_OF_BENEFIT-COERCE": 3},
+		},
+		{
+			name: "OtherResourceType",
+			rules: []processing.RectifyRule{
+				{Action: processing.RectifyAddMissing, Path: "ExplanationOfBenefit.provider", Value: json.RawMessage(`{"display": "unknown"}`)},
+			},
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       []byte(`{"resourceType": "Patient", "id": "123"}`),
+			wantJSON:     []byte(`{"resourceType": "Patient", "id": "123"}`),
+			wantCount:    map[string]int64{},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			rp, err := processing.NewRectifyRulesProcessor(tc.rules)
+			if err != nil {
+				t.Fatalf("NewRectifyRulesProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{rp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), tc.resourceType, "", tc.jsonIn); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.jsonIn, err)
+			}
+			if err := p.Finalize(context.Background()); err != nil {
+				t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			normalizedWantJSON := testhelpers.NormalizeJSON(t, tc.wantJSON)
+			normalizedGotJSON := testhelpers.NormalizeJSON(t, gotJSON)
+			if !cmp.Equal(normalizedGotJSON, normalizedWantJSON) {
+				t.Errorf("pipeline.Process(..., %s) produced unexpected output. got: %s, want: %s", tc.jsonIn, normalizedGotJSON, normalizedWantJSON)
+			}
+
+			gotCount, _, err := metrics.GetResults()
+			if err != nil {
+				t.Errorf("GetResults failed; err = %s", err)
+			}
+			if diff := cmp.Diff(tc.wantCount, gotCount["fhir-rectify-counter"].Count); diff != "" {
+				t.Errorf("GetResults() return unexpected count (-want +got): \n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewRectifyRulesProcessor_Invalid(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules []processing.RectifyRule
+	}{
+		{name: "NoRules"},
+		{name: "UnknownAction", rules: []processing.RectifyRule{{Action: "delete", Path: "Patient.name"}}},
+		{name: "InvalidPath", rules: []processing.RectifyRule{{Action: processing.RectifyCoerce, Path: "NotAResource.value", Type: "string"}}},
+		{name: "AddMissingWithoutPath", rules: []processing.RectifyRule{{Action: processing.RectifyAddMissing, Value: json.RawMessage(`1`)}}},
+		{name: "AddMissingWithoutValue", rules: []processing.RectifyRule{{Action: processing.RectifyAddMissing, Path: "Patient.active"}}},
+		{name: "ReplaceSystemWithoutTo", rules: []processing.RectifyRule{{Action: processing.RectifyReplaceSystem, From: "urn:a"}}},
+		{name: "CoerceUnknownType", rules: []processing.RectifyRule{{Action: processing.RectifyCoerce, Path: "Patient.active", Type: "date"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := processing.NewRectifyRulesProcessor(tc.rules); err == nil {
+				t.Errorf("NewRectifyRulesProcessor(%v) succeeded, want error", tc.rules)
+			}
+		})
+	}
+}
+
+func TestReadRectifyRules(t *testing.T) {
+	dir := t.TempDir()
+	rulesFile := path.Join(dir, "rules.json")
+	rulesJSON := `{"rules": [{"name": "LOINC_OID", "action": "replace_system", "from": "urn:oid:2.16.840.1.113883.6.1", "to": "http://loinc.org"}, {"action": "add_missing", "path": "Coverage.status", "value": "active"}]}`
+	if err := os.WriteFile(rulesFile, []byte(rulesJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := processing.ReadRectifyRules(rulesFile)
+	if err != nil {
+		t.Fatalf("ReadRectifyRules() returned unexpected error: %v", err)
+	}
+	want := []processing.RectifyRule{
+		{Name: "LOINC_OID", Action: processing.RectifyReplaceSystem, From: "urn:oid:2.16.840.1.113883.6.1", To: "http://loinc.org"},
+		{Action: processing.RectifyAddMissing, Path: "Coverage.status", Value: json.RawMessage(`"active"`)},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReadRectifyRules() returned unexpected rules (-want +got):\n%s", diff)
+	}
+
+	unknownFile := path.Join(dir, "unknown.json")
+	if err := os.WriteFile(unknownFile, []byte(`{"rules": [{"action": "coerce", "paths": ["Patient.active"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := processing.ReadRectifyRules(unknownFile); err == nil {
+		t.Errorf("ReadRectifyRules(%s) succeeded, want error for unknown field", unknownFile)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"github.com/google/fhir/go/jsonformat"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+var fhirReferenceFormCounter *metrics.Counter = metrics.NewCounter("fhir-reference-form-counter", "Count of references within FHIR Resources which were rewritten to the configured relative or absolute form. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+// ReferenceForm is the form references to other resources are rewritten to.
+type ReferenceForm string
+
+const (
+	// ReferenceFormRelative rewrites references to the form ResourceType/id.
+	ReferenceFormRelative ReferenceForm = "relative"
+	// ReferenceFormAbsolute rewrites references to the form
+	// <base URL>/ResourceType/id.
+	ReferenceFormAbsolute ReferenceForm = "absolute"
+)
+
+// ReferenceFormConfig configures the processor returned by
+// NewReferenceFormProcessor.
+type ReferenceFormConfig struct {
+	Form ReferenceForm
+	// BaseURL is the base URL of the destination server, such as
+	// https://healthcare.googleapis.com/v1/projects/<project>/locations/<location>/datasets/<dataset>/fhirStores/<store>/fhir.
+	// It is required for ReferenceFormAbsolute.
+	BaseURL string
+	// LocalBaseURLs are the base URLs of absolute references to resources which
+	// are exported alongside the referencing resource, such as the base URL of
+	// the bulk FHIR server. Absolute references with BaseURL are also treated
+	// as local. Absolute references with other base URLs, which refer to
+	// resources on other servers, are left unchanged.
+	LocalBaseURLs []string
+}
+
+type referenceFormProcessor struct {
+	BaseProcessor
+	form    ReferenceForm
+	baseURL string
+	// localBaseURLs holds the local base URLs without trailing slashes, longest
+	// first, so that the most specific one is matched.
+	localBaseURLs []string
+	rewritten     atomic.Int64
+}
+
+// Assert referenceFormProcessor satisfies the Processor interface.
+var _ Processor = &referenceFormProcessor{}
+
+// NewReferenceFormProcessor creates a Processor which rewrites the references
+// to other resources by type and ID within each resource to the same form,
+// relative (ResourceType/id) or absolute (<BaseURL>/ResourceType/id), as
+// different destination servers require. The version of versioned references
+// is kept. References to contained resources, and other references which are
+// not to a resource by type and ID, such as URNs, are left unchanged.
+func NewReferenceFormProcessor(cfg ReferenceFormConfig) (Processor, error) {
+	rp := &referenceFormProcessor{form: cfg.Form}
+	switch cfg.Form {
+	case ReferenceFormRelative:
+	case ReferenceFormAbsolute:
+		if cfg.BaseURL == "" {
+			return nil, errors.New("a base URL is required to make references absolute")
+		}
+	default:
+		return nil, fmt.Errorf("unknown reference form %q, must be one of %s or %s", cfg.Form, ReferenceFormRelative, ReferenceFormAbsolute)
+	}
+	bases := cfg.LocalBaseURLs
+	if cfg.BaseURL != "" {
+		bases = append([]string{cfg.BaseURL}, bases...)
+	}
+	var err error
+	if rp.localBaseURLs, err = parseLocalBaseURLs(bases); err != nil {
+		return nil, err
+	}
+	if cfg.BaseURL != "" {
+		rp.baseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	}
+	return rp, nil
+}
+
+// parseLocalBaseURLs validates the base URLs of local references, returning
+// them without trailing slashes, longest first, so that the most specific one
+// is matched.
+func parseLocalBaseURLs(bases []string) ([]string, error) {
+	var parsed []string
+	for _, b := range bases {
+		u, err := url.Parse(b)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return nil, fmt.Errorf("invalid base URL %q, must be an absolute URL such as https://example.com/fhir", b)
+		}
+		parsed = append(parsed, strings.TrimSuffix(b, "/"))
+	}
+	sort.SliceStable(parsed, func(i, j int) bool { return len(parsed[i]) > len(parsed[j]) })
+	return parsed, nil
+}
+
+func (rp *referenceFormProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	rewritten := 0
+	walkMessages(cr, func(_ string, m protoreflect.Message) {
+		ref, ok := m.Interface().(*dpb.Reference)
+		if !ok {
+			return
+		}
+		changed, rerr := rp.rewrite(ref)
+		err = errors.Join(err, rerr)
+		if changed {
+			rewritten++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if rewritten > 0 {
+		rp.rewritten.Add(int64(rewritten))
+		if err := fhirReferenceFormCounter.Record(ctx, int64(rewritten), resource.Type().String()); err != nil {
+			return err
+		}
+	}
+	return rp.Output(ctx, resource)
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (rp *referenceFormProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (rp *referenceFormProcessor) Finalize(ctx context.Context) error {
+	if n := rp.rewritten.Load(); n > 0 {
+		log.Infof("Rewrote %d references to %s form.", n, rp.form)
+	}
+	return nil
+}
+
+// rewrite rewrites the reference to the configured form, returning whether it
+// was changed.
+func (rp *referenceFormProcessor) rewrite(ref *dpb.Reference) (bool, error) {
+	var relative string
+	switch r := ref.GetReference().(type) {
+	case nil, *dpb.Reference_Fragment:
+		return false, nil
+	case *dpb.Reference_Uri:
+		uri := r.Uri.GetValue()
+		if isRelativeReference(uri) {
+			relative = uri
+		} else if _, relative = localReferencePath(rp.localBaseURLs, uri); relative == "" {
+			return false, nil
+		}
+	default:
+		denormalized, err := jsonformat.NewDenormalizedReference(ref)
+		if err != nil {
+			return false, err
+		}
+		relative = denormalized.(*dpb.Reference).GetUri().GetValue()
+	}
+
+	if rp.form == ReferenceFormRelative {
+		if _, ok := ref.GetReference().(*dpb.Reference_Uri); !ok {
+			// Already relative, in its normalized form.
+			return false, nil
+		}
+		ref.Reference = &dpb.Reference_Uri{Uri: &dpb.String{Value: relative}}
+		return true, jsonformat.NormalizeReference(ref)
+	}
+	absolute := rp.baseURL + "/" + relative
+	if r, ok := ref.GetReference().(*dpb.Reference_Uri); ok && r.Uri.GetValue() == absolute {
+		return false, nil
+	}
+	ref.Reference = &dpb.Reference_Uri{Uri: &dpb.String{Value: absolute}}
+	return true, nil
+}
+
+// localReferencePath splits an absolute reference with one of the local base
+// URLs into the base URL and its relative form, returning empty strings if it
+// does not have one.
+func localReferencePath(localBaseURLs []string, uri string) (base, relative string) {
+	for _, base := range localBaseURLs {
+		if rest, ok := strings.CutPrefix(uri, base+"/"); ok && isRelativeReference(rest) {
+			return base, rest
+		}
+	}
+	return "", ""
+}
+
+// isRelativeReference returns whether s is a relative reference of the form
+// ResourceType/id or ResourceType/id/_history/version.
+func isRelativeReference(s string) bool {
+	parts := strings.Split(s, "/")
+	switch {
+	case len(parts) == 4 && parts[2] == "_history" && parts[3] != "":
+	case len(parts) == 2:
+	default:
+		return false
+	}
+	if _, err := bulkfhir.ResourceTypeCodeFromName(parts[0]); err != nil {
+		return false
+	}
+	return parts[1] != ""
+}
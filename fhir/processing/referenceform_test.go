@@ -0,0 +1,154 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestReferenceFormProcessor(t *testing.T) {
+	in := `{
+		"resourceType": "Observation",
+		"id": "1",
+		"status": "final",
+		"code": {"text": "x"},
+		"subject": {"reference": "Patient/p1"},
+		"encounter": {"reference": "https://source.example.com/fhir/Encounter/e1/_history/2"},
+		"performer": [
+			{"reference": "https://other.example.com/fhir/Practitioner/pr1"},
+			{"reference": "#contained"},
+			{"reference": "urn:uuid:6b2f1c8e-0c8a-4f6a-9c4b-6f7f4a1c2d3e"},
+			{"reference": "https://dest.example.com/fhir/Practitioner/pr2"}
+		]
+	}`
+	cases := []struct {
+		name      string
+		cfg       processing.ReferenceFormConfig
+		want      string
+		wantCount int64
+	}{
+		{
+			name: "relative",
+			cfg:  processing.ReferenceFormConfig{Form: processing.ReferenceFormRelative, LocalBaseURLs: []string{"https://source.example.com/fhir/"}},
+			want: `{
+				"resourceType": "Observation",
+				"id": "1",
+				"status": "final",
+				"code": {"text": "x"},
+				"subject": {"reference": "Patient/p1"},
+				"encounter": {"reference": "Encounter/e1/_history/2"},
+				"performer": [
+					{"reference": "https://other.example.com/fhir/Practitioner/pr1"},
+					{"reference": "#contained"},
+					{"reference": "urn:uuid:6b2f1c8e-0c8a-4f6a-9c4b-6f7f4a1c2d3e"},
+					{"reference": "https://dest.example.com/fhir/Practitioner/pr2"}
+				]
+			}`,
+			wantCount: 1,
+		},
+		{
+			name: "absolute",
+			cfg:  processing.ReferenceFormConfig{Form: processing.ReferenceFormAbsolute, BaseURL: "https://dest.example.com/fhir", LocalBaseURLs: []string{"https://source.example.com/fhir"}},
+			want: `{
+				"resourceType": "Observation",
+				"id": "1",
+				"status": "final",
+				"code": {"text": "x"},
+				"subject": {"reference": "https://dest.example.com/fhir/Patient/p1"},
+				"encounter": {"reference": "https://dest.example.com/fhir/Encounter/e1/_history/2"},
+				"performer": [
+					{"reference": "https://other.example.com/fhir/Practitioner/pr1"},
+					{"reference": "#contained"},
+					{"reference": "urn:uuid:6b2f1c8e-0c8a-4f6a-9c4b-6f7f4a1c2d3e"},
+					{"reference": "https://dest.example.com/fhir/Practitioner/pr2"}
+				]
+			}`,
+			wantCount: 2,
+		},
+		{
+			name: "relative with destination base URL",
+			cfg:  processing.ReferenceFormConfig{Form: processing.ReferenceFormRelative, BaseURL: "https://dest.example.com/fhir"},
+			want: `{
+				"resourceType": "Observation",
+				"id": "1",
+				"status": "final",
+				"code": {"text": "x"},
+				"subject": {"reference": "Patient/p1"},
+				"encounter": {"reference": "https://source.example.com/fhir/Encounter/e1/_history/2"},
+				"performer": [
+					{"reference": "https://other.example.com/fhir/Practitioner/pr1"},
+					{"reference": "#contained"},
+					{"reference": "urn:uuid:6b2f1c8e-0c8a-4f6a-9c4b-6f7f4a1c2d3e"},
+					{"reference": "Practitioner/pr2"}
+				]
+			}`,
+			wantCount: 1,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			rp, err := processing.NewReferenceFormProcessor(tc.cfg)
+			if err != nil {
+				t.Fatalf("NewReferenceFormProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{rp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), cpb.ResourceTypeCode_OBSERVATION, "", []byte(in)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(testhelpers.NormalizeJSON(t, []byte(tc.want)), testhelpers.NormalizeJSON(t, gotJSON)); diff != "" {
+				t.Errorf("pipeline.Process() produced unexpected output (-want +got):\n%s", diff)
+			}
+
+			gotCount, _, err := metrics.GetResults()
+			if err != nil {
+				t.Errorf("GetResults failed; err = %s", err)
+			}
+			if diff := cmp.Diff(map[string]int64{"OBSERVATION": tc.wantCount}, gotCount["fhir-reference-form-counter"].Count); diff != "" {
+				t.Errorf("GetResults() return unexpected count (-want +got): \n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewReferenceFormProcessor_Invalid(t *testing.T) {
+	for _, cfg := range []processing.ReferenceFormConfig{
+		{},
+		{Form: "canonical"},
+		{Form: processing.ReferenceFormAbsolute},
+		{Form: processing.ReferenceFormAbsolute, BaseURL: "/fhir"},
+		{Form: processing.ReferenceFormRelative, LocalBaseURLs: []string{"example.com"}},
+	} {
+		if _, err := processing.NewReferenceFormProcessor(cfg); err == nil {
+			t.Errorf("NewReferenceFormProcessor(%+v) returned nil error", cfg)
+		}
+	}
+}
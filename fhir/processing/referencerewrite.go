@@ -0,0 +1,330 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"github.com/google/fhir/go/jsonformat"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+var fhirReferenceRewriteCounter *metrics.Counter = metrics.NewCounter("fhir-reference-rewrite-counter", "Count of references within FHIR Resources which were remapped to a new ID or stripped. The counter is tagged by the FHIR Resource type ex) OBSERVATION, and the rewrite: remapped or stripped.", "1", aggregation.Count, "FHIRResourceType", "Rewrite")
+
+// ReferenceRewriteConfig configures the processor returned by
+// NewReferenceRewriteProcessor.
+type ReferenceRewriteConfig struct {
+	// IDMap maps resources, as ResourceType/id, to the IDs they are given on the
+	// destination server, such as {"Patient/123": "456"}. See
+	// NewCSVReferenceIDMap.
+	IDMap map[string]string
+	// StripResourceTypes are the types of resources which are not being
+	// imported, references to which are removed.
+	StripResourceTypes []cpb.ResourceTypeCode_Value
+	// LocalBaseURLs are the base URLs of absolute references to resources which
+	// are exported alongside the referencing resource, such as the base URL of
+	// the bulk FHIR server. Absolute references with other base URLs are left
+	// unchanged.
+	LocalBaseURLs []string
+}
+
+type referenceRewriteProcessor struct {
+	BaseProcessor
+	idMap         map[string]string
+	stripTypes    map[string]bool
+	localBaseURLs []string
+	remapped      atomic.Int64
+	stripped      atomic.Int64
+}
+
+// Assert referenceRewriteProcessor satisfies the Processor interface.
+var _ Processor = &referenceRewriteProcessor{}
+
+// NewReferenceRewriteProcessor creates a Processor which rewrites the
+// references between resources, so that they can be loaded onto a different
+// server without broken references:
+//
+//   - Resources in the IDMap are given their new ID, and references to them
+//     are rewritten to it, keeping their form (relative or absolute) and any
+//     version.
+//   - References to resources of the StripResourceTypes are removed. The
+//     Reference keeps its display and identifier, if it has any; otherwise the
+//     whole element is removed. Removing a required element makes the
+//     resource invalid, which can be caught with the validation processor.
+//
+// To make references relative or absolute, add a reference form processor
+// after this one; see NewReferenceFormProcessor.
+func NewReferenceRewriteProcessor(cfg ReferenceRewriteConfig) (Processor, error) {
+	if len(cfg.IDMap) == 0 && len(cfg.StripResourceTypes) == 0 {
+		return nil, errors.New("either an ID map or resource types to strip are required")
+	}
+	for ref, id := range cfg.IDMap {
+		if !isRelativeReference(ref) || strings.Contains(ref, "/_history/") {
+			return nil, fmt.Errorf("invalid ID map key %q, must be of the form ResourceType/id", ref)
+		}
+		if id == "" || strings.Contains(id, "/") {
+			return nil, fmt.Errorf("invalid new ID %q for %s", id, ref)
+		}
+	}
+	localBaseURLs, err := parseLocalBaseURLs(cfg.LocalBaseURLs)
+	if err != nil {
+		return nil, err
+	}
+	rp := &referenceRewriteProcessor{
+		idMap:         cfg.IDMap,
+		stripTypes:    map[string]bool{},
+		localBaseURLs: localBaseURLs,
+	}
+	for _, rt := range cfg.StripResourceTypes {
+		name, err := bulkfhir.ResourceTypeCodeToName(rt)
+		if err != nil {
+			return nil, err
+		}
+		rp.stripTypes[name] = true
+	}
+	return rp, nil
+}
+
+// NewCSVReferenceIDMap reads a ReferenceRewriteConfig.IDMap from a local CSV
+// file. The file must have a header row with the columns resource_type, id
+// and new_id, in any order; other columns are ignored.
+func NewCSVReferenceIDMap(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header of %s: %w", path, err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range []string{"resource_type", "id", "new_id"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%s has no %s column", path, name)
+		}
+	}
+
+	idMap := map[string]string{}
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", path, err)
+		}
+		ref := row[columns["resource_type"]] + "/" + row[columns["id"]]
+		if prev, ok := idMap[ref]; ok && prev != row[columns["new_id"]] {
+			return nil, fmt.Errorf("%s is mapped to both %s and %s in %s", ref, prev, row[columns["new_id"]], path)
+		}
+		idMap[ref] = row[columns["new_id"]]
+	}
+	return idMap, nil
+}
+
+func (rp *referenceRewriteProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	m := cr.ProtoReflect()
+	field := m.WhichOneof(m.Descriptor().Oneofs().ByName("oneof_resource"))
+	if field == nil {
+		return errors.New("ContainedResource has no resource set")
+	}
+	r := m.Mutable(field).Message()
+	if fd := r.Descriptor().Fields().ByName("id"); fd != nil && r.Has(fd) {
+		if id, ok := r.Get(fd).Message().Interface().(*dpb.Id); ok {
+			if newID, ok := rp.idMap[string(r.Descriptor().Name())+"/"+id.GetValue()]; ok {
+				id.Value = newID
+			}
+		}
+	}
+
+	remapped := 0
+	if len(rp.idMap) > 0 {
+		walkMessages(cr, func(_ string, m protoreflect.Message) {
+			ref, ok := m.Interface().(*dpb.Reference)
+			if !ok {
+				return
+			}
+			changed, rerr := rp.remap(ref)
+			err = errors.Join(err, rerr)
+			if changed {
+				remapped++
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	stripped := 0
+	if len(rp.stripTypes) > 0 {
+		stripped = rp.strip(r)
+	}
+
+	if remapped > 0 {
+		rp.remapped.Add(int64(remapped))
+		if err := fhirReferenceRewriteCounter.Record(ctx, int64(remapped), resource.Type().String(), "remapped"); err != nil {
+			return err
+		}
+	}
+	if stripped > 0 {
+		rp.stripped.Add(int64(stripped))
+		if err := fhirReferenceRewriteCounter.Record(ctx, int64(stripped), resource.Type().String(), "stripped"); err != nil {
+			return err
+		}
+	}
+	return rp.Output(ctx, resource)
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (rp *referenceRewriteProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (rp *referenceRewriteProcessor) Finalize(ctx context.Context) error {
+	if r, s := rp.remapped.Load(), rp.stripped.Load(); r > 0 || s > 0 {
+		log.Infof("Remapped %d references to new IDs and stripped %d references.", r, s)
+	}
+	return nil
+}
+
+// target returns the base URL, which is empty for relative references, and
+// the type, ID and version of the local resource the reference is to. ok is
+// false for references which are not to a local resource by type and ID.
+func (rp *referenceRewriteProcessor) target(ref *dpb.Reference) (base, resourceType, id, version string, ok bool) {
+	switch r := ref.GetReference().(type) {
+	case nil, *dpb.Reference_Fragment:
+		return "", "", "", "", false
+	case *dpb.Reference_Uri:
+		uri := r.Uri.GetValue()
+		if !isRelativeReference(uri) {
+			if base, _ = localReferencePath(rp.localBaseURLs, uri); base == "" {
+				return "", "", "", "", false
+			}
+		}
+	}
+	resourceType, id, version, ok = referenceTarget(ref)
+	return base, resourceType, id, version, ok
+}
+
+// remap rewrites a reference to a resource in the ID map to its new ID,
+// returning whether it was changed.
+func (rp *referenceRewriteProcessor) remap(ref *dpb.Reference) (bool, error) {
+	base, resourceType, id, version, ok := rp.target(ref)
+	if !ok {
+		return false, nil
+	}
+	newID, ok := rp.idMap[resourceType+"/"+id]
+	if !ok {
+		return false, nil
+	}
+	uri := resourceType + "/" + newID
+	if version != "" {
+		uri += "/_history/" + version
+	}
+	_, wasURI := ref.GetReference().(*dpb.Reference_Uri)
+	if base != "" {
+		uri = base + "/" + uri
+	}
+	ref.Reference = &dpb.Reference_Uri{Uri: &dpb.String{Value: uri}}
+	if wasURI {
+		return true, nil
+	}
+	// Keep references which were in their normalized form normalized.
+	return true, jsonformat.NormalizeReference(ref)
+}
+
+// strip removes the references to the stripped resource types within m,
+// returning how many were removed. Elements left empty, such as a Reference
+// with no display or identifier, are removed from their parents.
+func (rp *referenceRewriteProcessor) strip(m protoreflect.Message) int {
+	var fields []protoreflect.FieldDescriptor
+	m.Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		if fd.Kind() == protoreflect.MessageKind && !fd.IsMap() {
+			fields = append(fields, fd)
+		}
+		return true
+	})
+	n := 0
+	for _, fd := range fields {
+		if !fd.IsList() {
+			child := m.Mutable(fd).Message()
+			if removed := rp.strip(child); removed > 0 {
+				n += removed
+				if isEmptyMessage(child) {
+					m.Clear(fd)
+				}
+			}
+			continue
+		}
+		l := m.Mutable(fd).List()
+		kept := 0
+		for i := 0; i < l.Len(); i++ {
+			v := l.Get(i)
+			if removed := rp.strip(v.Message()); removed > 0 {
+				n += removed
+				if isEmptyMessage(v.Message()) {
+					continue
+				}
+			}
+			l.Set(kept, v)
+			kept++
+		}
+		if kept == 0 {
+			m.Clear(fd)
+		} else {
+			l.Truncate(kept)
+		}
+	}
+	if ref, ok := m.Interface().(*dpb.Reference); ok {
+		if _, resourceType, _, _, ok := rp.target(ref); ok && rp.stripTypes[resourceType] {
+			ref.Reference = nil
+			ref.Type = nil
+			n++
+		}
+	}
+	return n
+}
+
+// isEmptyMessage returns whether no fields of m are set.
+func isEmptyMessage(m protoreflect.Message) bool {
+	empty := true
+	m.Range(func(protoreflect.FieldDescriptor, protoreflect.Value) bool {
+		empty = false
+		return false
+	})
+	return empty
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestReferenceRewriteProcessor(t *testing.T) {
+	in := `{
+		"resourceType": "Observation",
+		"id": "o1",
+		"status": "final",
+		"code": {"text": "x"},
+		"subject": {"reference": "Patient/p1"},
+		"encounter": {"reference": "https://source.example.com/fhir/Encounter/e1/_history/2"},
+		"performer": [
+			{"reference": "Practitioner/pr1"},
+			{"reference": "Practitioner/pr2", "display": "Dr. Smith"},
+			{"reference": "https://other.example.com/fhir/Practitioner/pr3"},
+			{"reference": "Patient/p2"}
+		],
+		"basedOn": [{"reference": "ServiceRequest/s1"}]
+	}`
+	cases := []struct {
+		name      string
+		cfg       processing.ReferenceRewriteConfig
+		want      string
+		wantCount map[string]int64
+	}{
+		{
+			name: "remap IDs",
+			cfg: processing.ReferenceRewriteConfig{
+				IDMap:         map[string]string{"Patient/p1": "new-p1", "Encounter/e1": "new-e1", "Observation/o1": "new-o1", "Practitioner/pr3": "new-pr3"},
+				LocalBaseURLs: []string{"https://source.example.com/fhir"},
+			},
+			want: `{
+				"resourceType": "Observation",
+				"id": "new-o1",
+				"status": "final",
+				"code": {"text": "x"},
+				"subject": {"reference": "Patient/new-p1"},
+				"encounter": {"reference": "https://source.example.com/fhir/Encounter/new-e1/_history/2"},
+				"performer": [
+					{"reference": "Practitioner/pr1"},
+					{"reference": "Practitioner/pr2", "display": "Dr. Smith"},
+					{"reference": "https://other.example.com/fhir/Practitioner/pr3"},
+					{"reference": "Patient/p2"}
+				],
+				"basedOn": [{"reference": "ServiceRequest/s1"}]
+			}`,
+			wantCount: map[string]int64{"OBSERVATION-remapped": 2},
+		},
+		{
+			name: "strip resource types",
+			cfg: processing.ReferenceRewriteConfig{
+				StripResourceTypes: []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PRACTITIONER, cpb.ResourceTypeCode_SERVICE_REQUEST},
+			},
+			want: `{
+				"resourceType": "Observation",
+				"id": "o1",
+				"status": "final",
+				"code": {"text": "x"},
+				"subject": {"reference": "Patient/p1"},
+				"encounter": {"reference": "https://source.example.com/fhir/Encounter/e1/_history/2"},
+				"performer": [
+					{"display": "Dr. Smith"},
+					{"reference": "https://other.example.com/fhir/Practitioner/pr3"},
+					{"reference": "Patient/p2"}
+				]
+			}`,
+			wantCount: map[string]int64{"OBSERVATION-stripped": 3},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			rp, err := processing.NewReferenceRewriteProcessor(tc.cfg)
+			if err != nil {
+				t.Fatalf("NewReferenceRewriteProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{rp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), cpb.ResourceTypeCode_OBSERVATION, "", []byte(in)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(testhelpers.NormalizeJSON(t, []byte(tc.want)), testhelpers.NormalizeJSON(t, gotJSON)); diff != "" {
+				t.Errorf("pipeline.Process() produced unexpected output (-want +got):\n%s", diff)
+			}
+
+			gotCount, _, err := metrics.GetResults()
+			if err != nil {
+				t.Errorf("GetResults failed; err = %s", err)
+			}
+			if diff := cmp.Diff(tc.wantCount, gotCount["fhir-reference-rewrite-counter"].Count); diff != "" {
+				t.Errorf("GetResults() return unexpected count (-want +got): \n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewReferenceRewriteProcessor_Invalid(t *testing.T) {
+	for _, cfg := range []processing.ReferenceRewriteConfig{
+		{},
+		{IDMap: map[string]string{"p1": "p2"}},
+		{IDMap: map[string]string{"Patient/p1": "Patient/p2"}},
+		{IDMap: map[string]string{"Patient/p1": ""}},
+		{IDMap: map[string]string{"Patient/p1": "p2"}, LocalBaseURLs: []string{"example.com"}},
+	} {
+		if _, err := processing.NewReferenceRewriteProcessor(cfg); err == nil {
+			t.Errorf("NewReferenceRewriteProcessor(%+v) returned nil error", cfg)
+		}
+	}
+}
+
+func TestNewCSVReferenceIDMap(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ids.csv")
+	data := "new_id,resource_type,id,note\nnew-p1,Patient,p1,x\nnew-e1,Encounter,e1,\nnew-p1,Patient,p1,duplicate\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := processing.NewCSVReferenceIDMap(path)
+	if err != nil {
+		t.Fatalf("NewCSVReferenceIDMap() returned unexpected error: %v", err)
+	}
+	want := map[string]string{"Patient/p1": "new-p1", "Encounter/e1": "new-e1"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("NewCSVReferenceIDMap() returned unexpected map (-want +got):\n%s", diff)
+	}
+
+	conflicting := filepath.Join(dir, "conflicting.csv")
+	if err := os.WriteFile(conflicting, []byte("resource_type,id,new_id\nPatient,p1,a\nPatient,p1,b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := processing.NewCSVReferenceIDMap(conflicting); err == nil {
+		t.Errorf("NewCSVReferenceIDMap() of a file mapping an ID twice returned nil error")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"errors"
+	"fmt"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ErrUnknownSink is returned (wrapped) by SetSinkRoutes for a route to a sink
+// which is not one of the pipeline's sinks.
+var ErrUnknownSink = errors.New("sink is not in the pipeline")
+
+// SetSinkRoutes restricts the resource types passed to some of the pipeline's
+// sinks, for example to upload only Patient and Coverage resources to a FHIR
+// store while writing every resource to NDJSON. Each sink in routes is only
+// passed resources, and deletions of resources, of the listed types. Sinks
+// which are not in routes are passed every resource. Routes are matched by
+// sink identity, so a sink wrapped in a ByteCountingSink must be given as the
+// wrapper passed to NewPipeline.
+//
+// Calling SetSinkRoutes replaces any routes set before. It returns an error
+// wrapping ErrUnknownSink if routes holds a sink which is not in the pipeline.
+func (p *Pipeline) SetSinkRoutes(routes map[Sink][]cpb.ResourceTypeCode_Value) error {
+	sinkRoutes := map[Sink]map[cpb.ResourceTypeCode_Value]bool{}
+	for s, types := range routes {
+		if !p.hasSink(s) {
+			return fmt.Errorf("%w: %T", ErrUnknownSink, s)
+		}
+		sinkRoutes[s] = map[cpb.ResourceTypeCode_Value]bool{}
+		for _, t := range types {
+			sinkRoutes[s][t] = true
+		}
+	}
+	p.sinkRoutes = sinkRoutes
+	return nil
+}
+
+func (p *Pipeline) hasSink(s Sink) bool {
+	for _, ps := range p.sinks {
+		if ps == s {
+			return true
+		}
+	}
+	return false
+}
+
+// routesTo returns whether resources of type resourceType are passed to s.
+func (p *Pipeline) routesTo(s Sink, resourceType cpb.ResourceTypeCode_Value) bool {
+	types, ok := p.sinkRoutes[s]
+	return !ok || types[resourceType]
+}
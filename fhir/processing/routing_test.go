@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func writtenTypes(ts *processing.TestSink) []cpb.ResourceTypeCode_Value {
+	var types []cpb.ResourceTypeCode_Value
+	for _, r := range ts.WrittenResources {
+		types = append(types, r.Type())
+	}
+	return types
+}
+
+func TestPipeline_SinkRoutes(t *testing.T) {
+	metrics.ResetAll()
+	ctx := context.Background()
+	store := &processing.TestSink{}
+	ndjson := &processing.TestSink{}
+	p, err := processing.NewPipeline(nil, []processing.Sink{store, ndjson})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.SetSinkRoutes(map[processing.Sink][]cpb.ResourceTypeCode_Value{
+		store: {cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_COVERAGE},
+	})
+	if err != nil {
+		t.Fatalf("SetSinkRoutes() returned unexpected error: %v", err)
+	}
+
+	resources := []struct {
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+	}{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1"}`},
+		{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"2"}`},
+		{cpb.ResourceTypeCode_COVERAGE, `{"resourceType":"Coverage","id":"3"}`},
+	}
+	for _, r := range resources {
+		if err := p.Process(ctx, r.resourceType, "http://source", []byte(r.json)); err != nil {
+			t.Fatalf("p.Process() returned unexpected error: %v", err)
+		}
+	}
+	for _, rt := range []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT} {
+		if err := p.Delete(ctx, rt, "4"); err != nil {
+			t.Fatalf("p.Delete() returned unexpected error: %v", err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+	}
+
+	wantStore := []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_COVERAGE}
+	if diff := cmp.Diff(wantStore, writtenTypes(store)); diff != "" {
+		t.Errorf("routed sink was written unexpected resource types (-want +got):\n%s", diff)
+	}
+	wantNDJSON := []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, cpb.ResourceTypeCode_COVERAGE}
+	if diff := cmp.Diff(wantNDJSON, writtenTypes(ndjson)); diff != "" {
+		t.Errorf("unrouted sink was written unexpected resource types (-want +got):\n%s", diff)
+	}
+	wantStoreDeleted := []processing.TestDeletedResource{{ResourceType: cpb.ResourceTypeCode_PATIENT, ID: "4"}}
+	if diff := cmp.Diff(wantStoreDeleted, store.DeletedResources); diff != "" {
+		t.Errorf("routed sink was passed unexpected deletions (-want +got):\n%s", diff)
+	}
+	if got := len(ndjson.DeletedResources); got != 2 {
+		t.Errorf("unrouted sink was passed %d deletions, want 2", got)
+	}
+	if !store.FinalizeCalled || !ndjson.FinalizeCalled {
+		t.Errorf("Finalize() was not called on every sink")
+	}
+}
+
+func TestPipeline_SinkRoutes_UnknownSink(t *testing.T) {
+	p, err := processing.NewPipeline(nil, []processing.Sink{&processing.TestSink{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.SetSinkRoutes(map[processing.Sink][]cpb.ResourceTypeCode_Value{
+		&processing.TestSink{}: {cpb.ResourceTypeCode_PATIENT},
+	})
+	if !errors.Is(err, processing.ErrUnknownSink) {
+		t.Errorf("SetSinkRoutes() returned error %v, want %v", err, processing.ErrUnknownSink)
+	}
+}
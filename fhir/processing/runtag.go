@@ -0,0 +1,76 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+
+	"google.golang.org/protobuf/proto"
+
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+// RunTagSystemPrefix is the prefix of the system of the tags added by the run
+// tag processor. It is followed by the code of the source system.
+const RunTagSystemPrefix = "urn:bulk-fhir-tools:run:"
+
+type runTagProcessor struct {
+	BaseProcessor
+	tag *dpb.Coding
+}
+
+// Assert runTagProcessor satisfies the Processor interface.
+var _ Processor = &runTagProcessor{}
+
+// NewRunTagProcessor creates a Processor which adds a meta.tag to each resource
+// identifying the run which loaded it. The tag has the system
+// RunTagSystemPrefix followed by sourceSystem, and the run ID as its code, so
+// that the resources loaded by a run can be found with a search such as
+// _tag=<runID>, or _tag=<system>|<runID> to also match the source system.
+// Resources which already have the tag are passed on unchanged.
+func NewRunTagProcessor(sourceSystem, runID string) Processor {
+	return &runTagProcessor{tag: &dpb.Coding{
+		System: &dpb.Uri{Value: RunTagSystemPrefix + sourceSystem},
+		Code:   &dpb.Code{Value: runID},
+	}}
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (rtp *runTagProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (rtp *runTagProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	if err := addTag(resource, rtp.tag); err != nil {
+		return err
+	}
+	return rtp.Output(ctx, resource)
+}
+
+// addTag adds a copy of tag to the meta.tag of the resource, unless it already
+// has a tag with the same system and code.
+func addTag(resource ResourceWrapper, tag *dpb.Coding) error {
+	meta, err := resourceMeta(resource)
+	if err != nil {
+		return err
+	}
+	for _, t := range meta.GetTag() {
+		if t.GetSystem().GetValue() == tag.GetSystem().GetValue() && t.GetCode().GetValue() == tag.GetCode().GetValue() {
+			return nil
+		}
+	}
+	meta.Tag = append(meta.Tag, proto.Clone(tag).(*dpb.Coding))
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestRunTagProcessor(t *testing.T) {
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		jsonIn       string
+		wantJSON     string
+	}{
+		{
+			name:         "resource without meta",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"1"}`,
+			wantJSON:     `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:run:bcda","code":"run1"}]}}`,
+		},
+		{
+			name:         "existing tags are kept",
+			resourceType: cpb.ResourceTypeCode_COVERAGE,
+			jsonIn:       `{"resourceType":"Coverage","id":"1","meta":{"lastUpdated":"2020-01-01T00:00:00Z","tag":[{"system":"other","code":"x"}]}}`,
+			wantJSON:     `{"resourceType":"Coverage","id":"1","meta":{"lastUpdated":"2020-01-01T00:00:00Z","tag":[{"system":"other","code":"x"},{"system":"urn:bulk-fhir-tools:run:bcda","code":"run1"}]}}`,
+		},
+		{
+			name:         "tag is not repeated",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:run:bcda","code":"run1"}]}}`,
+			wantJSON:     `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:run:bcda","code":"run1"}]}}`,
+		},
+		{
+			name:         "tags from other runs are kept",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:run:bcda","code":"run0"}]}}`,
+			wantJSON:     `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:run:bcda","code":"run0"},{"system":"urn:bulk-fhir-tools:run:bcda","code":"run1"}]}}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{processing.NewRunTagProcessor("bcda", "run1")}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), tc.resourceType, "", []byte(tc.jsonIn)); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.jsonIn, err)
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			normalizedWantJSON := testhelpers.NormalizeJSON(t, []byte(tc.wantJSON))
+			normalizedGotJSON := testhelpers.NormalizeJSON(t, gotJSON)
+			if !cmp.Equal(normalizedGotJSON, normalizedWantJSON) {
+				t.Errorf("pipeline.Process(..., %s) produced unexpected output. got: %s, want: %s", tc.jsonIn, normalizedGotJSON, normalizedWantJSON)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+)
+
+// serverErrorFileName is the name of the file OperationOutcomes are written to
+// within the server errors directory.
+const serverErrorFileName = "server_errors.ndjson"
+
+// ServerErrorSink receives the OperationOutcomes listed in the error array of
+// an export job's manifest, which describe problems the bulk FHIR server
+// encountered while exporting data, so that they can be inspected later.
+type ServerErrorSink interface {
+	// WriteServerError writes the OperationOutcome, read from the error file at
+	// sourceURL, to storage.
+	WriteServerError(ctx context.Context, sourceURL string, json []byte) error
+	// Finalize performs any final writing and cleanup. This is called after all
+	// OperationOutcomes have been passed to WriteServerError().
+	Finalize(ctx context.Context) error
+}
+
+type ndjsonServerErrorSink struct {
+	*lazyNDJSONFile
+}
+
+// lazyNDJSONFile writes resources, one per line, to a file which is only
+// created once the first resource is written, so that runs without any do not
+// leave an empty file behind.
+type lazyNDJSONFile struct {
+	createFile createFileFunc
+	fileName   string
+
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// localCreateFileFunc returns a createFileFunc which opens files for appending
+// in directory, which must exist.
+func localCreateFileFunc(directory string) (createFileFunc, error) {
+	if stat, err := os.Stat(directory); err != nil {
+		return nil, fmt.Errorf("could not stat directory %q - %w", directory, err)
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", directory)
+	}
+	// This closure captures the `directory` parameter.
+	return func(ctx context.Context, filename string) (io.WriteCloser, error) {
+		return os.OpenFile(filepath.Join(directory, filename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	}, nil
+}
+
+// gcsCreateFileFunc returns a createFileFunc which writes files in directory
+// of the GCS bucket.
+func gcsCreateFileFunc(ctx context.Context, endpoint, bucket, directory string) (createFileFunc, error) {
+	gcsClient, err := gcs.NewClient(ctx, bucket, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// This closure captures the GCS client and the `directory` parameter.
+	return func(ctx context.Context, filename string) (io.WriteCloser, error) {
+		return gcsClient.GetFileWriter(ctx, gcs.JoinPath(directory, filename)), nil
+	}, nil
+}
+
+func (l *lazyNDJSONFile) write(ctx context.Context, json []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w == nil {
+		var err error
+		l.w, err = l.createFile(ctx, l.fileName)
+		if err != nil {
+			return fmt.Errorf("error creating %s: %w", l.fileName, err)
+		}
+	}
+	_, err := l.w.Write(append(append([]byte(nil), json...), '\n'))
+	return err
+}
+
+func (l *lazyNDJSONFile) Finalize(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w == nil {
+		return nil
+	}
+	return l.w.Close()
+}
+
+// NewNDJSONServerErrorSink returns a ServerErrorSink which writes the
+// OperationOutcomes unchanged, one per line, to a server_errors.ndjson file in
+// the given directory. The file is appended to by each run.
+//
+// It is threadsafe to call WriteServerError on this sink from multiple
+// goroutines.
+func NewNDJSONServerErrorSink(ctx context.Context, directory string) (ServerErrorSink, error) {
+	createFile, err := localCreateFileFunc(directory)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonServerErrorSink{&lazyNDJSONFile{createFile: createFile, fileName: serverErrorFileName}}, nil
+}
+
+// NewGCSNDJSONServerErrorSink returns a ServerErrorSink which writes
+// OperationOutcomes to GCS. Unlike a local file, an existing file in GCS is
+// overwritten rather than appended to. See NewNDJSONServerErrorSink for
+// additional documentation.
+func NewGCSNDJSONServerErrorSink(ctx context.Context, endpoint, bucket, directory string) (ServerErrorSink, error) {
+	createFile, err := gcsCreateFileFunc(ctx, endpoint, bucket, directory)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonServerErrorSink{&lazyNDJSONFile{createFile: createFile, fileName: serverErrorFileName}}, nil
+}
+
+func (ss *ndjsonServerErrorSink) WriteServerError(ctx context.Context, sourceURL string, json []byte) error {
+	return ss.write(ctx, json)
+}
+
+// ServerErrorSummary counts the issues in the OperationOutcomes from the error
+// files of an export job's manifest. The zero value is an empty summary.
+type ServerErrorSummary struct {
+	// OperationOutcomes is the number of OperationOutcomes added.
+	OperationOutcomes int
+	// Issues counts the issues of the OperationOutcomes by severity and code,
+	// keyed by "<severity>/<code>", such as "error/not-found".
+	Issues map[string]int
+}
+
+// Add counts the issues of an OperationOutcome, given as JSON.
+func (s *ServerErrorSummary) Add(operationOutcomeJSON []byte) error {
+	var oo struct {
+		ResourceType string `json:"resourceType"`
+		Issue        []struct {
+			Severity string `json:"severity"`
+			Code     string `json:"code"`
+		} `json:"issue"`
+	}
+	if err := json.Unmarshal(operationOutcomeJSON, &oo); err != nil {
+		return fmt.Errorf("invalid OperationOutcome: %w", err)
+	}
+	if oo.ResourceType != "OperationOutcome" {
+		return fmt.Errorf("error files must hold OperationOutcomes, got %q", oo.ResourceType)
+	}
+	if s.Issues == nil {
+		s.Issues = map[string]int{}
+	}
+	s.OperationOutcomes++
+	for _, i := range oo.Issue {
+		s.Issues[i.Severity+"/"+i.Code]++
+	}
+	return nil
+}
+
+// Errors returns the number of issues with a severity of error or fatal. Issues
+// which are warnings or information do not count.
+func (s *ServerErrorSummary) Errors() int {
+	n := 0
+	for k, count := range s.Issues {
+		if severity, _, _ := strings.Cut(k, "/"); severity == "error" || severity == "fatal" {
+			n += count
+		}
+	}
+	return n
+}
+
+// String returns a summary of the issues suitable for logging, such as
+// "3 OperationOutcomes: error/not-found=2 warning/processing=1".
+func (s *ServerErrorSummary) String() string {
+	keys := make([]string, 0, len(s.Issues))
+	for k := range s.Issues {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d OperationOutcomes:", s.OperationOutcomes)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%d", k, s.Issues[k])
+	}
+	return b.String()
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+)
+
+func TestServerErrorSummary(t *testing.T) {
+	var s processing.ServerErrorSummary
+	inputs := []string{
+		`{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"not-found"},{"severity":"warning","code":"processing"}]}`,
+		`{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"not-found"}]}`,
+		`{"resourceType":"OperationOutcome","issue":[{"severity":"fatal","code":"exception"}]}`,
+	}
+	for _, in := range inputs {
+		if err := s.Add([]byte(in)); err != nil {
+			t.Fatalf("Add(%s) returned unexpected error: %v", in, err)
+		}
+	}
+	want := processing.ServerErrorSummary{
+		OperationOutcomes: 3,
+		Issues:            map[string]int{"error/not-found": 2, "warning/processing": 1, "fatal/exception": 1},
+	}
+	if diff := cmp.Diff(s, want); diff != "" {
+		t.Errorf("Add() produced unexpected summary (-got +want): %s", diff)
+	}
+	if got := s.Errors(); got != 3 {
+		t.Errorf("Errors() = %d, want 3", got)
+	}
+	if got, want := s.String(), "3 OperationOutcomes: error/not-found=2 fatal/exception=1 warning/processing=1"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	for _, in := range []string{`{"resourceType":"Patient","id":"1"}`, `not json`} {
+		if err := s.Add([]byte(in)); err == nil {
+			t.Errorf("Add(%s) returned nil error", in)
+		}
+	}
+}
+
+func TestNDJSONServerErrorSink(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ss, err := processing.NewNDJSONServerErrorSink(ctx, dir)
+	if err != nil {
+		t.Fatalf("NewNDJSONServerErrorSink() returned unexpected error: %v", err)
+	}
+	if err := ss.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "server_errors.ndjson")); !os.IsNotExist(err) {
+		t.Errorf("server error file exists without any OperationOutcomes, stat error: %v", err)
+	}
+
+	inputs := []string{
+		`{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"not-found"}]}`,
+		`{"resourceType":"OperationOutcome","issue":[{"severity":"fatal","code":"exception"}]}`,
+	}
+	// Each run appends to the file.
+	for _, in := range inputs {
+		ss, err := processing.NewNDJSONServerErrorSink(ctx, dir)
+		if err != nil {
+			t.Fatalf("NewNDJSONServerErrorSink() returned unexpected error: %v", err)
+		}
+		if err := ss.WriteServerError(ctx, "http://source", []byte(in)); err != nil {
+			t.Fatalf("WriteServerError() returned unexpected error: %v", err)
+		}
+		if err := ss.Finalize(ctx); err != nil {
+			t.Fatalf("Finalize() returned unexpected error: %v", err)
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "server_errors.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := inputs[0] + "\n" + inputs[1] + "\n"; string(got) != want {
+		t.Errorf("server error file holds %q, want %q", got, want)
+	}
+
+	if _, err := processing.NewNDJSONServerErrorSink(ctx, filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("NewNDJSONServerErrorSink() with a missing directory returned nil error")
+	}
+}
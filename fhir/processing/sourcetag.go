@@ -0,0 +1,144 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+// The systems of the tags added by the source tag processor.
+const (
+	// SourceTagSystemExportJob is the system of the tag whose code is the URL
+	// of the export job the resource was fetched by.
+	SourceTagSystemExportJob = "urn:bulk-fhir-tools:source:export-job"
+	// SourceTagSystemTransactionTime is the system of the tag whose code is the
+	// transaction time of the export job, in RFC 3339 format.
+	SourceTagSystemTransactionTime = "urn:bulk-fhir-tools:source:transaction-time"
+	// SourceTagSystemServer is the system of the tag whose code is the base
+	// URL of the bulk FHIR server the resource was fetched from.
+	SourceTagSystemServer = "urn:bulk-fhir-tools:source:server"
+	// SourceTagSystemToolVersion is the system of the tag whose code is the
+	// version of the tool which fetched the resource.
+	SourceTagSystemToolVersion = "urn:bulk-fhir-tools:source:tool-version"
+)
+
+// ExportJob describes the export job whose data is being processed.
+type ExportJob struct {
+	// URL is the job status URL of the export job.
+	URL string
+	// TransactionTime is the transaction time of the export job.
+	TransactionTime time.Time
+	// ServerURL is the base URL of the bulk FHIR server which ran the job.
+	ServerURL string
+}
+
+type exportJobContextKey struct{}
+
+// WithExportJob returns a context for processing the data of the given export
+// job. The fetcher sets it on the context passed to Pipeline.Process.
+func WithExportJob(ctx context.Context, job ExportJob) context.Context {
+	return context.WithValue(ctx, exportJobContextKey{}, job)
+}
+
+// ExportJobFromContext returns the export job set on the context by
+// WithExportJob, and whether there is one.
+func ExportJobFromContext(ctx context.Context) (ExportJob, bool) {
+	job, ok := ctx.Value(exportJobContextKey{}).(ExportJob)
+	return job, ok
+}
+
+type sourceTagProcessor struct {
+	BaseProcessor
+	toolVersion string
+}
+
+// Assert sourceTagProcessor satisfies the Processor interface.
+var _ Processor = &sourceTagProcessor{}
+
+// NewSourceTagProcessor creates a Processor which adds meta.tags to each
+// resource recording where it came from, so that every record in a FHIR store
+// can be traced back to the fetch which loaded it: the URL and transaction
+// time of the export job and the base URL of the bulk FHIR server, as set on
+// the context passed to Pipeline.Process by WithExportJob, and toolVersion if
+// it is not empty. Each tag has one of the SourceTagSystem* systems, and
+// replaces any tag with the same system the resource already has, such as
+// from an earlier load of the same data.
+func NewSourceTagProcessor(toolVersion string) Processor {
+	return &sourceTagProcessor{toolVersion: toolVersion}
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (stp *sourceTagProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (stp *sourceTagProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	tags := map[string]string{SourceTagSystemToolVersion: stp.toolVersion}
+	if job, ok := ExportJobFromContext(ctx); ok {
+		tags[SourceTagSystemExportJob] = job.URL
+		tags[SourceTagSystemServer] = job.ServerURL
+		if !job.TransactionTime.IsZero() {
+			tags[SourceTagSystemTransactionTime] = job.TransactionTime.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	// The tags are set in a fixed order, so that the output is deterministic.
+	for _, system := range []string{SourceTagSystemExportJob, SourceTagSystemTransactionTime, SourceTagSystemServer, SourceTagSystemToolVersion} {
+		if code := tags[system]; code != "" {
+			if err := setTag(resource, &dpb.Coding{System: &dpb.Uri{Value: system}, Code: &dpb.Code{Value: code}}); err != nil {
+				return err
+			}
+		}
+	}
+	return stp.Output(ctx, resource)
+}
+
+// setTag sets tag as the only meta.tag of the resource with its system.
+func setTag(resource ResourceWrapper, tag *dpb.Coding) error {
+	meta, err := resourceMeta(resource)
+	if err != nil {
+		return err
+	}
+	tags := meta.GetTag()[:0]
+	for _, t := range meta.GetTag() {
+		if t.GetSystem().GetValue() != tag.GetSystem().GetValue() {
+			tags = append(tags, t)
+		}
+	}
+	meta.Tag = append(tags, tag)
+	return nil
+}
+
+// resourceMeta returns the meta of the resource, which may be modified.
+func resourceMeta(resource ResourceWrapper) (*dpb.Meta, error) {
+	cr, err := resource.Proto()
+	if err != nil {
+		return nil, err
+	}
+	m := cr.ProtoReflect()
+	field := m.WhichOneof(m.Descriptor().Oneofs().ByName("oneof_resource"))
+	if field == nil {
+		return nil, errors.New("ContainedResource has no resource set")
+	}
+	r := m.Mutable(field).Message()
+	metaField := r.Descriptor().Fields().ByName("meta")
+	if metaField == nil {
+		return nil, errors.New("resource has no meta field")
+	}
+	return r.Mutable(metaField).Message().Interface().(*dpb.Meta), nil
+}
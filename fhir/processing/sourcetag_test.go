@@ -0,0 +1,85 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestSourceTagProcessor(t *testing.T) {
+	job := processing.ExportJob{
+		URL:             "https://server/jobs/1",
+		TransactionTime: time.Date(2024, 3, 1, 12, 0, 0, 500000000, time.FixedZone("EST", -5*60*60)),
+		ServerURL:       "https://server/api/v2",
+	}
+	jobTags := `{"system":"urn:bulk-fhir-tools:source:export-job","code":"https://server/jobs/1"},{"system":"urn:bulk-fhir-tools:source:transaction-time","code":"2024-03-01T17:00:00.5Z"},{"system":"urn:bulk-fhir-tools:source:server","code":"https://server/api/v2"}`
+	cases := []struct {
+		name        string
+		ctx         context.Context
+		toolVersion string
+		jsonIn      string
+		wantJSON    string
+	}{
+		{
+			name:        "resource without meta",
+			ctx:         processing.WithExportJob(context.Background(), job),
+			toolVersion: "v1.2.3",
+			jsonIn:      `{"resourceType":"Patient","id":"1"}`,
+			wantJSON:    `{"resourceType":"Patient","id":"1","meta":{"tag":[` + jobTags + `,{"system":"urn:bulk-fhir-tools:source:tool-version","code":"v1.2.3"}]}}`,
+		},
+		{
+			name:     "earlier source tags are replaced and others kept",
+			ctx:      processing.WithExportJob(context.Background(), job),
+			jsonIn:   `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:source:export-job","code":"https://server/jobs/0"},{"system":"other","code":"x"}]}}`,
+			wantJSON: `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"other","code":"x"},` + jobTags + `]}}`,
+		},
+		{
+			name:        "without an export job",
+			ctx:         context.Background(),
+			toolVersion: "v1.2.3",
+			jsonIn:      `{"resourceType":"Patient","id":"1"}`,
+			wantJSON:    `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"urn:bulk-fhir-tools:source:tool-version","code":"v1.2.3"}]}}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{processing.NewSourceTagProcessor(tc.toolVersion)}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(tc.ctx, cpb.ResourceTypeCode_PATIENT, "", []byte(tc.jsonIn)); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.jsonIn, err)
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			normalizedWantJSON := testhelpers.NormalizeJSON(t, []byte(tc.wantJSON))
+			normalizedGotJSON := testhelpers.NormalizeJSON(t, gotJSON)
+			if !cmp.Equal(normalizedGotJSON, normalizedWantJSON) {
+				t.Errorf("pipeline.Process(..., %s) produced unexpected output. got: %s, want: %s", tc.jsonIn, normalizedGotJSON, normalizedWantJSON)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/internal/fhirpath"
+	"github.com/google/bulk_fhir_tools/sqlite"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// sqliteColumn is a column promoted from the resources of a type, as the first
+// value of a FHIRPath expression.
+type sqliteColumn struct {
+	name string
+	typ  string
+	path *fhirpath.Expression
+}
+
+// sqlitePromotedColumns are the columns promoted from common resource types,
+// beyond the id, lastUpdated and patient columns of every table.
+var sqlitePromotedColumns = map[string][]sqliteColumn{
+	"Patient": {
+		{"gender", sqlite.Text, mustParseFHIRPath("Patient.gender")},
+		{"birthDate", sqlite.Text, mustParseFHIRPath("Patient.birthDate")},
+	},
+	"Observation": {
+		{"status", sqlite.Text, mustParseFHIRPath("Observation.status")},
+		{"code", sqlite.Text, mustParseFHIRPath("Observation.code.coding.first().code")},
+		{"effective", sqlite.Text, mustParseFHIRPath("Observation.effective")},
+		{"value", sqlite.Real, mustParseFHIRPath("Observation.value.value")},
+		{"unit", sqlite.Text, mustParseFHIRPath("Observation.value.unit")},
+	},
+	"Condition": {
+		{"clinicalStatus", sqlite.Text, mustParseFHIRPath("Condition.clinicalStatus.coding.first().code")},
+		{"code", sqlite.Text, mustParseFHIRPath("Condition.code.coding.first().code")},
+		{"onset", sqlite.Text, mustParseFHIRPath("Condition.onset")},
+	},
+	"Encounter": {
+		{"status", sqlite.Text, mustParseFHIRPath("Encounter.status")},
+		{"class", sqlite.Text, mustParseFHIRPath("Encounter.class.code")},
+		{"start", sqlite.Text, mustParseFHIRPath("Encounter.period.start")},
+		{"end", sqlite.Text, mustParseFHIRPath("Encounter.period.end")},
+	},
+	"Procedure": {
+		{"status", sqlite.Text, mustParseFHIRPath("Procedure.status")},
+		{"code", sqlite.Text, mustParseFHIRPath("Procedure.code.coding.first().code")},
+		{"performed", sqlite.Text, mustParseFHIRPath("Procedure.performed")},
+	},
+	"MedicationRequest": {
+		{"status", sqlite.Text, mustParseFHIRPath("MedicationRequest.status")},
+		{"medication", sqlite.Text, mustParseFHIRPath("MedicationRequest.medication.coding.first().code")},
+		{"authoredOn", sqlite.Text, mustParseFHIRPath("MedicationRequest.authoredOn")},
+	},
+	"Coverage": {
+		{"status", sqlite.Text, mustParseFHIRPath("Coverage.status")},
+		{"start", sqlite.Text, mustParseFHIRPath("Coverage.period.start")},
+		{"end", sqlite.Text, mustParseFHIRPath("Coverage.period.end")},
+	},
+	"ExplanationOfBenefit": {
+		{"status", sqlite.Text, mustParseFHIRPath("ExplanationOfBenefit.status")},
+		{"type", sqlite.Text, mustParseFHIRPath("ExplanationOfBenefit.type.coding.first().code")},
+		{"start", sqlite.Text, mustParseFHIRPath("ExplanationOfBenefit.billablePeriod.start")},
+		{"end", sqlite.Text, mustParseFHIRPath("ExplanationOfBenefit.billablePeriod.end")},
+	},
+	"Claim": {
+		{"status", sqlite.Text, mustParseFHIRPath("Claim.status")},
+		{"type", sqlite.Text, mustParseFHIRPath("Claim.type.coding.first().code")},
+		{"start", sqlite.Text, mustParseFHIRPath("Claim.billablePeriod.start")},
+		{"end", sqlite.Text, mustParseFHIRPath("Claim.billablePeriod.end")},
+	},
+}
+
+func mustParseFHIRPath(src string) *fhirpath.Expression {
+	e, err := fhirpath.Parse(src)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// sqliteTable is the table of a resource type and its promoted columns.
+type sqliteTable struct {
+	table    *sqlite.Table
+	promoted []sqliteColumn
+}
+
+// sqliteSink implements the processing.Sink interface to write resources into
+// a SQLite database file, with a table per resource type.
+type sqliteSink struct {
+	path string
+
+	// mu must be held when accessing db or tables.
+	mu     sync.Mutex
+	db     *sqlite.DB
+	tables map[cpb.ResourceTypeCode_Value]*sqliteTable
+}
+
+// Assert sqliteSink satisfies the Sink interface.
+var _ Sink = &sqliteSink{}
+
+// NewSQLiteSink creates a new Sink which writes resources into a new SQLite
+// database file at path, for querying locally with the sqlite3 shell, DuckDB
+// or any SQLite driver. Each resource type has a table of the same name, such
+// as Patient, with the columns:
+//
+//   - id: the resource's ID.
+//   - lastUpdated: the resource's meta.lastUpdated.
+//   - patient: the reference to the patient the resource belongs to, from its
+//     subject, patient or beneficiary, or Patient/id for a Patient.
+//   - a few columns promoted from common resource types, such as code and
+//     effective for Observation.
+//   - json: the resource's JSON, for use with SQLite's JSON functions.
+//
+// The database is written to a temporary file, which replaces any existing
+// file at path when the sink is finalized, so each run writes a new database
+// of the resources it fetched.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+func NewSQLiteSink(ctx context.Context, path string) (Sink, error) {
+	if path == "" {
+		return nil, errors.New("a SQLite database path is required")
+	}
+	db, err := sqlite.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating SQLite database: %w", err)
+	}
+	return &sqliteSink{path: path, db: db, tables: map[cpb.ResourceTypeCode_Value]*sqliteTable{}}, nil
+}
+
+// Write is Sink.Write. The resource is inserted into the table for its
+// resource type, which is created if needed.
+func (ss *sqliteSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var parsed map[string]any
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	name, err := bulkfhir.ResourceTypeCodeToName(resource.Type())
+	if err != nil {
+		return err
+	}
+
+	id, _ := parsed["id"].(string)
+	var lastUpdated any
+	if meta, ok := parsed["meta"].(map[string]any); ok {
+		if v, ok := meta["lastUpdated"].(string); ok {
+			lastUpdated = v
+		}
+	}
+	values := []any{id, lastUpdated, sqlitePatientReference(name, id, parsed)}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	t, err := ss.table(resource.Type(), name)
+	if err != nil {
+		return err
+	}
+	for _, c := range t.promoted {
+		values = append(values, sqliteValue(c, parsed))
+	}
+	values = append(values, string(data))
+	if err := t.table.Insert(values...); err != nil {
+		return err
+	}
+	if l := lineageOf(resource); l != nil {
+		l.recordOutput(fmt.Sprintf("%s#%s", ss.path, name))
+	}
+	return nil
+}
+
+// table returns the table for a resource type, creating it if needed. ss.mu
+// must be held.
+func (ss *sqliteSink) table(rt cpb.ResourceTypeCode_Value, name string) (*sqliteTable, error) {
+	if t, ok := ss.tables[rt]; ok {
+		return t, nil
+	}
+	columns := []sqlite.Column{
+		{Name: "id", Type: sqlite.Text},
+		{Name: "lastUpdated", Type: sqlite.Text},
+		{Name: "patient", Type: sqlite.Text},
+	}
+	promoted := sqlitePromotedColumns[name]
+	for _, c := range promoted {
+		columns = append(columns, sqlite.Column{Name: c.name, Type: c.typ})
+	}
+	columns = append(columns, sqlite.Column{Name: "json", Type: sqlite.Text})
+	table, err := ss.db.CreateTable(name, columns)
+	if err != nil {
+		return nil, err
+	}
+	t := &sqliteTable{table: table, promoted: promoted}
+	ss.tables[rt] = t
+	return t, nil
+}
+
+// sqlitePatientReference returns the reference to the patient a resource
+// belongs to, or nil if it has none.
+func sqlitePatientReference(resourceType, id string, resource map[string]any) any {
+	if resourceType == "Patient" {
+		return "Patient/" + id
+	}
+	for _, field := range patientFilterFields {
+		ref, ok := resource[string(field)].(map[string]any)
+		if !ok {
+			continue
+		}
+		if r, ok := ref["reference"].(string); ok && (strings.HasPrefix(r, "Patient/") || strings.Contains(r, "/Patient/")) {
+			return r
+		}
+	}
+	return nil
+}
+
+// sqliteValue returns the value of a promoted column for a resource, or nil if
+// it has none, or its value is not a string, number or boolean.
+func sqliteValue(c sqliteColumn, resource map[string]any) any {
+	values, err := c.path.Evaluate(resource)
+	if err != nil || len(values) == 0 {
+		return nil
+	}
+	switch v := values[0].(type) {
+	case string, float64, bool:
+		return v
+	}
+	return nil
+}
+
+// Finalize is Sink.Finalize. The database is completed and moved to its path.
+func (ss *sqliteSink) Finalize(ctx context.Context) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if err := ss.db.Close(); err != nil {
+		return fmt.Errorf("error writing SQLite database %s: %w", ss.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestSQLiteSink(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "fhir.db")
+	// An existing database is replaced once the sink is finalized.
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := processing.NewSQLiteSink(ctx, path)
+	if err != nil {
+		t.Fatalf("NewSQLiteSink() returned unexpected error: %v", err)
+	}
+
+	patient := `{"resourceType":"Patient","id":"p1","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},"gender":"female","birthDate":"1970-01-01"}`
+	observation := `{"resourceType":"Observation","id":"o1","status":"final","subject":{"reference":"Patient/p1"},"code":{"coding":[{"system":"http://loinc.org","code":"8867-4"}]},"effectiveDateTime":"2024-01-01","valueQuantity":{"value":72.5,"unit":"/min"}}`
+	periodObservation := `{"resourceType":"Observation","id":"o2","subject":{"reference":"Group/g1"},"effectivePeriod":{"start":"2024-01-01"}}`
+	coverage := `{"resourceType":"Coverage","id":"c1","beneficiary":{"reference":"https://server/fhir/Patient/p1"},"period":{"start":"2024-01-01"}}`
+	for _, r := range []*testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(patient)},
+		{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte(observation)},
+		{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte(periodObservation)},
+		{resourceType: cpb.ResourceTypeCode_COVERAGE, json: []byte(coverage)},
+	} {
+		if err := sink.Write(ctx, r); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		table       string
+		wantColumns []string
+		wantRows    [][]any
+	}{
+		{
+			table:       "Patient",
+			wantColumns: []string{"id", "lastUpdated", "patient", "gender", "birthDate", "json"},
+			wantRows:    [][]any{{"p1", "2024-01-02T03:04:05Z", "Patient/p1", "female", "1970-01-01", patient}},
+		},
+		{
+			table:       "Observation",
+			wantColumns: []string{"id", "lastUpdated", "patient", "status", "code", "effective", "value", "unit", "json"},
+			wantRows: [][]any{
+				{"o1", nil, "Patient/p1", "final", "8867-4", "2024-01-01", 72.5, "/min", observation},
+				{"o2", nil, nil, nil, nil, nil, nil, nil, periodObservation},
+			},
+		},
+		{
+			table:       "Coverage",
+			wantColumns: []string{"id", "lastUpdated", "patient", "status", "start", "end", "json"},
+			wantRows:    [][]any{{"c1", nil, "https://server/fhir/Patient/p1", nil, "2024-01-01", nil, coverage}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.table, func(t *testing.T) {
+			gotColumns, gotRows := testhelpers.ReadSQLiteTable(t, path, tc.table)
+			if diff := cmp.Diff(tc.wantColumns, gotColumns); diff != "" {
+				t.Errorf("table %s has unexpected columns (-want +got): %s", tc.table, diff)
+			}
+			if diff := cmp.Diff(tc.wantRows, gotRows); diff != "" {
+				t.Errorf("table %s has unexpected rows (-want +got): %s", tc.table, diff)
+			}
+		})
+	}
+}
+
+func TestSQLiteSink_NoResources(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "fhir.db")
+	sink, err := processing.NewSQLiteSink(ctx, path)
+	if err != nil {
+		t.Fatalf("NewSQLiteSink() returned unexpected error: %v", err)
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Finalize() did not write an empty database: %v", err)
+	}
+}
@@ -16,20 +16,35 @@ package processing
 
 import (
 	"context"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
 )
 
 // TestSink can be used for testing processors by capturing processed resources.
 type TestSink struct {
 	WrittenResources []ResourceWrapper
+	DeletedResources []TestDeletedResource
 	FinalizeCalled   bool
 }
 
+// TestDeletedResource is a resource passed to TestSink.Delete.
+type TestDeletedResource struct {
+	ResourceType cpb.ResourceTypeCode_Value
+	ID           string
+}
+
 // Write is Sink.Write
 func (ts *TestSink) Write(ctx context.Context, resource ResourceWrapper) error {
 	ts.WrittenResources = append(ts.WrittenResources, resource)
 	return nil
 }
 
+// Delete is Deleter.Delete
+func (ts *TestSink) Delete(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, id string) error {
+	ts.DeletedResources = append(ts.DeletedResources, TestDeletedResource{ResourceType: resourceType, ID: id})
+	return nil
+}
+
 // Finalize is Sink.Finalize
 func (ts *TestSink) Finalize(ctx context.Context) error {
 	ts.FinalizeCalled = true
@@ -38,3 +53,4 @@ func (ts *TestSink) Finalize(ctx context.Context) error {
 
 // Assert that TestSink satisfies the Sink interface.
 var _ Sink = &TestSink{}
+var _ Deleter = &TestSink{}
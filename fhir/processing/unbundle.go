@@ -0,0 +1,89 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var unbundledCounter *metrics.Counter = metrics.NewCounter("fhir-unbundled-counter", "Count of collection and searchset Bundles received from the bulk fhir server which were split into their entries. The counter is tagged by the Bundle type ex) searchset.", "1", aggregation.Count, "BundleType")
+
+// bundleTypesToUnbundle are the Bundle.type values which are containers of
+// otherwise independent resources, and so are split into their entries. Other
+// Bundle types (e.g. document or transaction) are meaningful as a whole, and
+// are passed through unchanged.
+var bundleTypesToUnbundle = map[string]bool{
+	"collection": true,
+	"searchset":  true,
+}
+
+// unbundledEntry is a single resource extracted from a Bundle.
+type unbundledEntry struct {
+	resourceType cpb.ResourceTypeCode_Value
+	json         []byte
+}
+
+// maybeUnbundle checks whether the given JSON is a collection or searchset
+// Bundle, and if so returns the resources in its entries. The second return
+// value is false if the JSON should be processed as-is.
+func maybeUnbundle(resourceJSON []byte) ([]unbundledEntry, string, bool, error) {
+	// Avoid parsing every resource; bare resources will rarely mention Bundle.
+	if !bytes.Contains(resourceJSON, []byte(`"Bundle"`)) {
+		return nil, "", false, nil
+	}
+	var bundle struct {
+		ResourceType string `json:"resourceType"`
+		Type         string `json:"type"`
+		Entry        []struct {
+			Resource json.RawMessage `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(resourceJSON, &bundle); err != nil {
+		// Leave malformed JSON for the rest of the pipeline to report.
+		return nil, "", false, nil
+	}
+	if bundle.ResourceType != "Bundle" || !bundleTypesToUnbundle[bundle.Type] {
+		return nil, "", false, nil
+	}
+
+	entries := make([]unbundledEntry, 0, len(bundle.Entry))
+	for i, e := range bundle.Entry {
+		// Entries without a resource (e.g. a deleted resource in a history) have
+		// nothing to process.
+		if len(e.Resource) == 0 || bytes.Equal(e.Resource, []byte("null")) {
+			continue
+		}
+		var header struct {
+			ResourceType string `json:"resourceType"`
+		}
+		if err := json.Unmarshal(e.Resource, &header); err != nil {
+			return nil, "", false, fmt.Errorf("invalid resource in %s Bundle entry %d: %w", bundle.Type, i, err)
+		}
+		resourceType, err := bulkfhir.ResourceTypeCodeFromName(header.ResourceType)
+		if err != nil {
+			return nil, "", false, fmt.Errorf("invalid resource in %s Bundle entry %d: %w", bundle.Type, i, err)
+		}
+		entries = append(entries, unbundledEntry{resourceType: resourceType, json: e.Resource})
+	}
+	return entries, bundle.Type, true, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestPipeline_Unbundle(t *testing.T) {
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+		wantTypes    []cpb.ResourceTypeCode_Value
+		wantJSON     []string
+	}{
+		{
+			name:         "searchset Bundle",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Bundle","type":"searchset","entry":[{"resource":{"resourceType":"Patient","id":"1"}},{"resource":{"resourceType":"Observation","id":"2"}}]}`,
+			wantTypes:    []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_OBSERVATION},
+			wantJSON:     []string{`{"resourceType":"Patient","id":"1"}`, `{"resourceType":"Observation","id":"2"}`},
+		},
+		{
+			name:         "collection Bundle with an entry without a resource",
+			resourceType: cpb.ResourceTypeCode_BUNDLE,
+			json:         `{"resourceType": "Bundle", "type": "collection", "entry": [{"fullUrl": "urn:1"}, {"resource": {"resourceType": "Patient", "id": "1"}}]}`,
+			wantTypes:    []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT},
+			wantJSON:     []string{`{"resourceType": "Patient", "id": "1"}`},
+		},
+		{
+			name:         "empty searchset Bundle",
+			resourceType: cpb.ResourceTypeCode_BUNDLE,
+			json:         `{"resourceType":"Bundle","type":"searchset"}`,
+		},
+		{
+			name:         "document Bundle is not unbundled",
+			resourceType: cpb.ResourceTypeCode_BUNDLE,
+			json:         `{"resourceType":"Bundle","type":"document","entry":[{"resource":{"resourceType":"Composition","id":"1"}}]}`,
+			wantTypes:    []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_BUNDLE},
+			wantJSON:     []string{`{"resourceType":"Bundle","type":"document","entry":[{"resource":{"resourceType":"Composition","id":"1"}}]}`},
+		},
+		{
+			name:         "bare resource",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1"}`,
+			wantTypes:    []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT},
+			wantJSON:     []string{`{"resourceType":"Patient","id":"1"}`},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{&testProcessor{}}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Process(ctx, tc.resourceType, "http://source", []byte(tc.json)); err != nil {
+				t.Fatalf("p.Process() returned unexpected error: %v", err)
+			}
+
+			var gotTypes []cpb.ResourceTypeCode_Value
+			var gotJSON []string
+			for _, r := range ts.WrittenResources {
+				gotTypes = append(gotTypes, r.Type())
+				json, err := r.JSON()
+				if err != nil {
+					t.Fatalf("JSON() returned unexpected error: %v", err)
+				}
+				gotJSON = append(gotJSON, string(json))
+				if r.SourceURL() != "http://source" {
+					t.Errorf("SourceURL() = %q, want %q", r.SourceURL(), "http://source")
+				}
+			}
+			if diff := cmp.Diff(gotTypes, tc.wantTypes); diff != "" {
+				t.Errorf("TestSink captured unexpected resource types (-got +want): %s", diff)
+			}
+			if diff := cmp.Diff(gotJSON, tc.wantJSON); diff != "" {
+				t.Errorf("TestSink captured unexpected resources (-got +want): %s", diff)
+			}
+		})
+	}
+}
+
+func TestPipeline_UnbundleInvalidEntry(t *testing.T) {
+	metrics.ResetAll()
+	p, err := processing.NewPipeline(nil, []processing.Sink{&processing.TestSink{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := `{"resourceType":"Bundle","type":"collection","entry":[{"resource":{"resourceType":"NotAResource"}}]}`
+	if err := p.Process(context.Background(), cpb.ResourceTypeCode_BUNDLE, "http://source", []byte(bundle)); err == nil {
+		t.Errorf("p.Process() succeeded for a Bundle with an invalid entry, want error")
+	}
+}
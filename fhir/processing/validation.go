@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+)
+
+// ErrResourceInvalid indicates a resource does not conform to the R4 structure
+// definitions.
+var ErrResourceInvalid = errors.New("resource failed R4 validation")
+
+var fhirInvalidResourceCounter *metrics.Counter = metrics.NewCounter("fhir-invalid-resource-counter", "Count of FHIR Resources which failed R4 validation and were routed to the invalid resource sink instead of the outputs. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+type validationProcessor struct {
+	BaseProcessor
+	unmarshaller *jsonformat.Unmarshaller
+	sink         DeadLetterSink
+	invalid      atomic.Int64
+
+	// sinkMu must be held when writing to sink, as Process may be called
+	// concurrently.
+	sinkMu sync.Mutex
+}
+
+// Assert validationProcessor satisfies the Processor interface.
+var _ Processor = &validationProcessor{}
+
+// NewValidationProcessor creates a Processor which validates each resource
+// against the R4 structure definitions, checking required elements, reference
+// types, cardinalities and the format of primitive values. Valid resources are
+// passed on unchanged. Invalid resources are written to sink, with an error
+// wrapping ErrResourceInvalid which lists every problem found, rather than to
+// the outputs, where a FHIR store would reject them with less helpful errors.
+// If sink is nil, invalid resources are logged and dropped.
+//
+// The processor should come after any processors which modify resources, so
+// that the resources are validated as they will be written.
+func NewValidationProcessor(sink DeadLetterSink) (Processor, error) {
+	unmarshaller, err := jsonformat.NewUnmarshaller("UTC", fhirversion.R4)
+	if err != nil {
+		return nil, err
+	}
+	return &validationProcessor{unmarshaller: unmarshaller, sink: sink}, nil
+}
+
+func (vp *validationProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	_, verr := vp.unmarshaller.UnmarshalR4(data)
+	if verr == nil {
+		return vp.Output(ctx, resource)
+	}
+	verr = fmt.Errorf("%w: %v", ErrResourceInvalid, verr)
+	log.Errorf("routing invalid %s resource from %s to the invalid resource sink: %v", resource.Type(), resource.SourceURL(), verr)
+	vp.invalid.Add(1)
+	if err := fhirInvalidResourceCounter.Record(ctx, 1, resource.Type().String()); err != nil {
+		return err
+	}
+	if vp.sink == nil {
+		return nil
+	}
+	vp.sinkMu.Lock()
+	defer vp.sinkMu.Unlock()
+	return vp.sink.WriteDeadLetter(sinkContext(ctx), &DeadLetter{
+		ResourceType: resource.Type(),
+		SourceURL:    resource.SourceURL(),
+		JSON:         data,
+		Err:          verr,
+		Reason:       "INVALID",
+		Time:         time.Now(),
+	})
+}
+
+// ProcessesConcurrently is ConcurrentProcessor.ProcessesConcurrently.
+func (vp *validationProcessor) ProcessesConcurrently() bool {
+	return true
+}
+
+func (vp *validationProcessor) Finalize(ctx context.Context) error {
+	if n := vp.invalid.Load(); n > 0 {
+		log.Warningf("%d resources failed R4 validation and were not written to the outputs.", n)
+	}
+	if vp.sink == nil {
+		return nil
+	}
+	return vp.sink.Finalize(ctx)
+}
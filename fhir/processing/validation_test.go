@@ -0,0 +1,122 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestValidationProcessor(t *testing.T) {
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+		wantInvalid  bool
+	}{
+		{
+			name:         "valid resource",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"},"subject":{"reference":"Patient/1"}}`,
+		},
+		{
+			name:         "missing required element",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final"}`,
+			wantInvalid:  true,
+		},
+		{
+			name:         "reference to a disallowed type",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"},"subject":{"reference":"Claim/1"}}`,
+			wantInvalid:  true,
+		},
+		{
+			name:         "invalid primitive",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"not a valid id!"}`,
+			wantInvalid:  true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ctx := context.Background()
+			ds := &testDeadLetterSink{}
+			vp, err := processing.NewValidationProcessor(ds)
+			if err != nil {
+				t.Fatalf("NewValidationProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{vp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Process(ctx, tc.resourceType, "http://source", []byte(tc.json)); err != nil {
+				t.Fatalf("p.Process() returned unexpected error: %v", err)
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+			}
+			if !ds.finalized {
+				t.Error("invalid resource sink was not finalized")
+			}
+			if !tc.wantInvalid {
+				if len(ts.WrittenResources) != 1 || len(ds.deadLetters) != 0 {
+					t.Fatalf("got %d written resources and %d invalid resources, want the resource to be written", len(ts.WrittenResources), len(ds.deadLetters))
+				}
+				return
+			}
+			if len(ts.WrittenResources) != 0 || len(ds.deadLetters) != 1 {
+				t.Fatalf("got %d written resources and %d invalid resources, want the resource to be routed to the invalid resource sink", len(ts.WrittenResources), len(ds.deadLetters))
+			}
+			dl := ds.deadLetters[0]
+			if !errors.Is(dl.Err, processing.ErrResourceInvalid) {
+				t.Errorf("invalid resource error = %v, want it to wrap ErrResourceInvalid", dl.Err)
+			}
+			if dl.ResourceType != tc.resourceType || dl.SourceURL != "http://source" || string(dl.JSON) != tc.json {
+				t.Errorf("got invalid resource %v %q %s, want %v %q %s", dl.ResourceType, dl.SourceURL, dl.JSON, tc.resourceType, "http://source", tc.json)
+			}
+		})
+	}
+}
+
+func TestValidationProcessor_NoSink(t *testing.T) {
+	ctx := context.Background()
+	vp, err := processing.NewValidationProcessor(nil)
+	if err != nil {
+		t.Fatalf("NewValidationProcessor() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{vp}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Process(ctx, cpb.ResourceTypeCode_OBSERVATION, "http://source", []byte(`{"resourceType":"Observation","id":"1"}`)); err != nil {
+		t.Fatalf("p.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) != 0 {
+		t.Errorf("got %d written resources, want the invalid resource to be dropped", len(ts.WrittenResources))
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/internal/fhirpath"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// resourceKeyExpression is the column path which returns the resource's ID.
+const resourceKeyExpression = "getResourceKey()"
+
+var (
+	viewNamePattern     = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+	referenceKeyPattern = regexp.MustCompile(`^(.+)\.getReferenceKey\(\s*([A-Za-z]*)\s*\)$`)
+)
+
+// ViewDefinition is a SQL on FHIR v2 ViewDefinition
+// (https://build.fhir.org/ig/FHIR/sql-on-fhir-v2/StructureDefinition-ViewDefinition.html),
+// which flattens resources of one type into rows of a table, such as a row per
+// line item of each ExplanationOfBenefit.
+//
+// The supported subset is select with column, forEach, forEachOrNull, nested
+// select and unionAll, and where. Paths are evaluated with the FHIRPath subset
+// of the fhirpath package, along with the getResourceKey() and
+// getReferenceKey([type]) functions in columns, which return the ID of the
+// resource and the ID of the resource a Reference refers to. Constants are not
+// supported.
+type ViewDefinition struct {
+	// Name names the view's table or file.
+	Name         string
+	ResourceType cpb.ResourceTypeCode_Value
+
+	columns []ViewColumn
+	root    *viewSelect
+	where   []*fhirpath.Expression
+}
+
+// ViewColumn is a column of the rows of a ViewDefinition.
+type ViewColumn struct {
+	Name string
+	// Type is the FHIR type of the column's values, such as string or decimal,
+	// if the ViewDefinition gives one.
+	Type string
+	// If Collection is true, the values of the column are lists.
+	Collection bool
+}
+
+// viewSelect is a select of a ViewDefinition, which produces rows from each
+// element of its focus.
+type viewSelect struct {
+	columns []*viewColumn
+	// forEach, if set, selects the elements to produce rows from, rather than
+	// the focus itself. If orNull is true and it selects no elements, a row of
+	// nulls is produced.
+	forEach *fhirpath.Expression
+	orNull  bool
+	selects []*viewSelect
+	// unionAll holds selects whose rows are concatenated.
+	unionAll []*viewSelect
+	// width is the number of columns of the select's rows.
+	width int
+}
+
+type viewColumn struct {
+	ViewColumn
+	path *fhirpath.Expression
+	// resourceKey is true for getResourceKey().
+	resourceKey bool
+	// referenceKey is true for <path>.getReferenceKey([referenceType]).
+	referenceKey  bool
+	referenceType string
+}
+
+type viewDefinitionJSON struct {
+	ResourceType string            `json:"resourceType"`
+	Name         string            `json:"name"`
+	Resource     string            `json:"resource"`
+	Constant     []json.RawMessage `json:"constant"`
+	Select       []viewSelectJSON  `json:"select"`
+	Where        []struct {
+		Path string `json:"path"`
+	} `json:"where"`
+}
+
+type viewSelectJSON struct {
+	Column []struct {
+		Name       string `json:"name"`
+		Path       string `json:"path"`
+		Type       string `json:"type"`
+		Collection bool   `json:"collection"`
+	} `json:"column"`
+	Select        []viewSelectJSON `json:"select"`
+	ForEach       string           `json:"forEach"`
+	ForEachOrNull string           `json:"forEachOrNull"`
+	UnionAll      []viewSelectJSON `json:"unionAll"`
+}
+
+// ParseViewDefinition parses a ViewDefinition resource in FHIR JSON form.
+func ParseViewDefinition(data []byte) (*ViewDefinition, error) {
+	var vj viewDefinitionJSON
+	if err := json.Unmarshal(data, &vj); err != nil {
+		return nil, fmt.Errorf("failed to parse ViewDefinition: %w", err)
+	}
+	if vj.ResourceType != "ViewDefinition" {
+		return nil, fmt.Errorf("got a %q resource, want a ViewDefinition", vj.ResourceType)
+	}
+	if !viewNamePattern.MatchString(vj.Name) {
+		return nil, fmt.Errorf("ViewDefinition name %q must start with a letter, and contain only letters, digits and underscores", vj.Name)
+	}
+	rt, err := bulkfhir.ResourceTypeCodeFromName(vj.Resource)
+	if err != nil {
+		return nil, fmt.Errorf("ViewDefinition %s: %w", vj.Name, err)
+	}
+	if len(vj.Constant) > 0 {
+		return nil, fmt.Errorf("ViewDefinition %s: constants are not supported", vj.Name)
+	}
+	if len(vj.Select) == 0 {
+		return nil, fmt.Errorf("ViewDefinition %s has no select", vj.Name)
+	}
+	v := &ViewDefinition{Name: vj.Name, ResourceType: rt}
+	v.root, err = parseViewSelect(viewSelectJSON{Select: vj.Select})
+	if err != nil {
+		return nil, fmt.Errorf("ViewDefinition %s: %w", vj.Name, err)
+	}
+	v.columns = v.root.viewColumns()
+	seen := map[string]bool{}
+	for _, c := range v.columns {
+		if seen[c.Name] {
+			return nil, fmt.Errorf("ViewDefinition %s has more than one column named %s", vj.Name, c.Name)
+		}
+		seen[c.Name] = true
+	}
+	for _, w := range vj.Where {
+		e, err := fhirpath.Parse(w.Path)
+		if err != nil {
+			return nil, fmt.Errorf("ViewDefinition %s where: %w", vj.Name, err)
+		}
+		v.where = append(v.where, e)
+	}
+	return v, nil
+}
+
+// ReadViewDefinitions reads the ViewDefinitions in the .json files of a local
+// directory, ordered by file name.
+func ReadViewDefinitions(dir string) ([]*ViewDefinition, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var views []*ViewDefinition
+	names := map[string]string{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		v, err := ParseViewDefinition(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if other, ok := names[strings.ToLower(v.Name)]; ok {
+			return nil, fmt.Errorf("%s and %s both define a view named %s", other, path, v.Name)
+		}
+		names[strings.ToLower(v.Name)] = path
+		views = append(views, v)
+	}
+	if len(views) == 0 {
+		return nil, fmt.Errorf("no ViewDefinition .json files in %s", dir)
+	}
+	return views, nil
+}
+
+func parseViewSelect(sj viewSelectJSON) (*viewSelect, error) {
+	s := &viewSelect{}
+	if sj.ForEach != "" && sj.ForEachOrNull != "" {
+		return nil, errors.New("a select cannot have both forEach and forEachOrNull")
+	}
+	if forEach := sj.ForEach + sj.ForEachOrNull; forEach != "" {
+		e, err := fhirpath.Parse(forEach)
+		if err != nil {
+			return nil, err
+		}
+		s.forEach, s.orNull = e, sj.ForEachOrNull != ""
+	}
+	for _, cj := range sj.Column {
+		if !viewNamePattern.MatchString(cj.Name) {
+			return nil, fmt.Errorf("column name %q must start with a letter, and contain only letters, digits and underscores", cj.Name)
+		}
+		c := &viewColumn{ViewColumn: ViewColumn{Name: cj.Name, Type: cj.Type, Collection: cj.Collection}}
+		path := strings.TrimSpace(cj.Path)
+		if path == resourceKeyExpression {
+			c.resourceKey = true
+		} else {
+			if m := referenceKeyPattern.FindStringSubmatch(path); m != nil {
+				path, c.referenceKey, c.referenceType = m[1], true, m[2]
+			}
+			e, err := fhirpath.Parse(path)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", cj.Name, err)
+			}
+			c.path = e
+		}
+		s.columns = append(s.columns, c)
+		s.width++
+	}
+	for _, nj := range sj.Select {
+		n, err := parseViewSelect(nj)
+		if err != nil {
+			return nil, err
+		}
+		s.selects = append(s.selects, n)
+		s.width += n.width
+	}
+	for i, uj := range sj.UnionAll {
+		u, err := parseViewSelect(uj)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && !sameViewColumns(s.unionAll[0].viewColumns(), u.viewColumns()) {
+			return nil, errors.New("the selects of a unionAll must have the same columns")
+		}
+		s.unionAll = append(s.unionAll, u)
+	}
+	if len(s.unionAll) > 0 {
+		s.width += s.unionAll[0].width
+	}
+	return s, nil
+}
+
+func sameViewColumns(a, b []ViewColumn) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name {
+			return false
+		}
+	}
+	return true
+}
+
+// viewColumns returns the columns of the select's rows: its own, then those
+// of its nested selects, and then those of its unionAll.
+func (s *viewSelect) viewColumns() []ViewColumn {
+	var columns []ViewColumn
+	for _, c := range s.columns {
+		columns = append(columns, c.ViewColumn)
+	}
+	for _, n := range s.selects {
+		columns = append(columns, n.viewColumns()...)
+	}
+	if len(s.unionAll) > 0 {
+		columns = append(columns, s.unionAll[0].viewColumns()...)
+	}
+	return columns
+}
+
+// Columns returns the columns of the view's rows.
+func (v *ViewDefinition) Columns() []ViewColumn {
+	return v.columns
+}
+
+// Rows returns the rows of the view for a resource, as decoded from FHIR JSON
+// by encoding/json, with a value for each of Columns. Values are strings,
+// float64s, bools or nil, or lists of them for collection columns. A resource
+// of a different type, or not matching the view's where paths, has no rows.
+func (v *ViewDefinition) Rows(resource map[string]any) ([][]any, error) {
+	if rt, _ := bulkfhir.ResourceTypeCodeToName(v.ResourceType); resource["resourceType"] != rt {
+		return nil, nil
+	}
+	for _, w := range v.where {
+		ok, err := w.Matches(resource)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %w", v.Name, err)
+		}
+		if !ok {
+			return nil, nil
+		}
+	}
+	rows, err := v.root.rows(resource, resource)
+	if err != nil {
+		return nil, fmt.Errorf("view %s: %w", v.Name, err)
+	}
+	return rows, nil
+}
+
+// rows returns the rows of the select for the focus, an element of resource.
+func (s *viewSelect) rows(resource map[string]any, focus any) ([][]any, error) {
+	elements := []any{focus}
+	if s.forEach != nil {
+		var err error
+		if elements, err = s.forEach.EvaluateElement(focus); err != nil {
+			return nil, err
+		}
+		if len(elements) == 0 && s.orNull {
+			return [][]any{make([]any, s.width)}, nil
+		}
+	}
+	var rows [][]any
+	for _, e := range elements {
+		row := make([]any, 0, len(s.columns))
+		for _, c := range s.columns {
+			value, err := c.value(resource, e)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, value)
+		}
+		// The rows of the element are the cross product of its own row with
+		// the rows of each nested select and of the unionAll.
+		elementRows := [][]any{row}
+		for _, n := range s.selects {
+			nested, err := n.rows(resource, e)
+			if err != nil {
+				return nil, err
+			}
+			elementRows = crossJoin(elementRows, nested)
+		}
+		if len(s.unionAll) > 0 {
+			var union [][]any
+			for _, u := range s.unionAll {
+				r, err := u.rows(resource, e)
+				if err != nil {
+					return nil, err
+				}
+				union = append(union, r...)
+			}
+			elementRows = crossJoin(elementRows, union)
+		}
+		rows = append(rows, elementRows...)
+	}
+	return rows, nil
+}
+
+func crossJoin(left, right [][]any) [][]any {
+	var out [][]any
+	for _, l := range left {
+		for _, r := range right {
+			row := make([]any, 0, len(l)+len(r))
+			out = append(out, append(append(row, l...), r...))
+		}
+	}
+	return out
+}
+
+// value returns the value of the column for the focus, an element of
+// resource.
+func (c *viewColumn) value(resource map[string]any, focus any) (any, error) {
+	if c.resourceKey {
+		id, _ := resource["id"].(string)
+		if id == "" {
+			return nil, nil
+		}
+		return id, nil
+	}
+	values, err := c.path.EvaluateElement(focus)
+	if err != nil {
+		return nil, fmt.Errorf("column %s: %w", c.Name, err)
+	}
+	if c.referenceKey {
+		var keys []any
+		for _, v := range values {
+			if key, ok := referenceKey(v, c.referenceType); ok {
+				keys = append(keys, key)
+			}
+		}
+		values = keys
+	}
+	for _, v := range values {
+		switch v.(type) {
+		case string, float64, bool:
+		default:
+			return nil, fmt.Errorf("column %s: %s is not a primitive value", c.Name, c.path)
+		}
+	}
+	if c.Collection {
+		if values == nil {
+			values = []any{}
+		}
+		return values, nil
+	}
+	switch len(values) {
+	case 0:
+		return nil, nil
+	case 1:
+		return values[0], nil
+	}
+	return nil, fmt.Errorf("column %s: %s returned %d values; set collection to true to return them all", c.Name, c.path, len(values))
+}
+
+// referenceKey returns the ID of the resource a Reference refers to, if it is
+// a relative or absolute literal reference to a resource of referenceType,
+// or of any type if referenceType is empty.
+func referenceKey(v any, referenceType string) (string, bool) {
+	ref, ok := v.(map[string]any)
+	if !ok {
+		return "", false
+	}
+	s, _ := ref["reference"].(string)
+	if before, _, ok := strings.Cut(s, "/_history/"); ok {
+		s = before
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || parts[len(parts)-1] == "" {
+		return "", false
+	}
+	if referenceType != "" && parts[len(parts)-2] != referenceType {
+		return "", false
+	}
+	return parts[len(parts)-1], true
+}
@@ -0,0 +1,241 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+)
+
+const eobLineView = `{
+	"resourceType": "ViewDefinition",
+	"name": "eob_line",
+	"resource": "ExplanationOfBenefit",
+	"where": [{"path": "status = 'active'"}],
+	"select": [
+		{"column": [
+			{"name": "id", "path": "getResourceKey()"},
+			{"name": "patient_id", "path": "patient.getReferenceKey(Patient)"}
+		]},
+		{"forEach": "item", "column": [
+			{"name": "sequence", "path": "sequence", "type": "positiveInt"},
+			{"name": "code", "path": "productOrService.coding.code"},
+			{"name": "net", "path": "net.value", "type": "decimal"}
+		]}
+	]
+}`
+
+const eobJSON = `{
+	"resourceType": "ExplanationOfBenefit",
+	"id": "e1",
+	"status": "active",
+	"patient": {"reference": "https://server/fhir/Patient/p1/_history/2"},
+	"item": [
+		{"sequence": 1, "productOrService": {"coding": [{"code": "99213"}]}, "net": {"value": 100.5}},
+		{"sequence": 2, "productOrService": {"coding": [{"code": "85025"}]}}
+	]
+}`
+
+func parseView(t *testing.T, view string) *processing.ViewDefinition {
+	t.Helper()
+	v, err := processing.ParseViewDefinition([]byte(view))
+	if err != nil {
+		t.Fatalf("ParseViewDefinition() returned unexpected error: %v", err)
+	}
+	return v
+}
+
+func decodeResource(t *testing.T, resource string) map[string]any {
+	t.Helper()
+	var m map[string]any
+	if err := json.Unmarshal([]byte(resource), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestViewDefinition_Rows(t *testing.T) {
+	patient := `{
+		"resourceType": "Patient",
+		"id": "p1",
+		"name": [{"given": ["Ann", "B"], "family": "Smith"}],
+		"telecom": [{"system": "phone", "value": "555-0100"}],
+		"contact": [{"telecom": [{"system": "email", "value": "c@example.com"}]}]
+	}`
+	cases := []struct {
+		name        string
+		view        string
+		resource    string
+		wantColumns []string
+		wantRows    [][]any
+	}{
+		{
+			name:        "forEach",
+			view:        eobLineView,
+			resource:    eobJSON,
+			wantColumns: []string{"id", "patient_id", "sequence", "code", "net"},
+			wantRows: [][]any{
+				{"e1", "p1", 1.0, "99213", 100.5},
+				{"e1", "p1", 2.0, "85025", nil},
+			},
+		},
+		{
+			name:     "not matching where",
+			view:     eobLineView,
+			resource: `{"resourceType": "ExplanationOfBenefit", "id": "e2", "status": "cancelled", "item": [{"sequence": 1}]}`,
+		},
+		{
+			name:     "other resource type",
+			view:     eobLineView,
+			resource: patient,
+		},
+		{
+			name: "forEach without elements",
+			view: `{"resourceType": "ViewDefinition", "name": "v", "resource": "Patient", "select": [
+				{"column": [{"name": "id", "path": "id"}]},
+				{"forEach": "address", "column": [{"name": "city", "path": "city"}]}
+			]}`,
+			resource:    patient,
+			wantColumns: []string{"id", "city"},
+		},
+		{
+			name: "forEachOrNull",
+			view: `{"resourceType": "ViewDefinition", "name": "v", "resource": "Patient", "select": [
+				{"column": [{"name": "id", "path": "id"}]},
+				{"forEachOrNull": "address", "column": [{"name": "city", "path": "city"}]}
+			]}`,
+			resource:    patient,
+			wantColumns: []string{"id", "city"},
+			wantRows:    [][]any{{"p1", nil}},
+		},
+		{
+			name: "unionAll and collection",
+			view: `{"resourceType": "ViewDefinition", "name": "v", "resource": "Patient", "select": [
+				{"column": [
+					{"name": "id", "path": "getResourceKey()"},
+					{"name": "given", "path": "name.given", "collection": true}
+				]},
+				{"unionAll": [
+					{"forEach": "telecom", "column": [{"name": "system", "path": "system"}, {"name": "value", "path": "value"}]},
+					{"forEach": "contact.telecom", "column": [{"name": "system", "path": "system"}, {"name": "value", "path": "value"}]}
+				]}
+			]}`,
+			resource:    patient,
+			wantColumns: []string{"id", "given", "system", "value"},
+			wantRows: [][]any{
+				{"p1", []any{"Ann", "B"}, "phone", "555-0100"},
+				{"p1", []any{"Ann", "B"}, "email", "c@example.com"},
+			},
+		},
+		{
+			name: "nested select",
+			view: `{"resourceType": "ViewDefinition", "name": "v", "resource": "Patient", "select": [
+				{"forEach": "name", "column": [{"name": "family", "path": "family"}], "select": [
+					{"forEach": "given", "column": [{"name": "given", "path": "$this"}]}
+				]}
+			]}`,
+			resource:    patient,
+			wantColumns: []string{"family", "given"},
+			wantRows:    [][]any{{"Smith", "Ann"}, {"Smith", "B"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := parseView(t, tc.view)
+			var gotColumns []string
+			for _, c := range v.Columns() {
+				gotColumns = append(gotColumns, c.Name)
+			}
+			if tc.wantColumns != nil {
+				if diff := cmp.Diff(tc.wantColumns, gotColumns); diff != "" {
+					t.Errorf("Columns() returned unexpected columns (-want +got): %s", diff)
+				}
+			}
+			got, err := v.Rows(decodeResource(t, tc.resource))
+			if err != nil {
+				t.Fatalf("Rows() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantRows, got); diff != "" {
+				t.Errorf("Rows() returned unexpected rows (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestViewDefinition_Rows_MultipleValues(t *testing.T) {
+	v := parseView(t, `{"resourceType": "ViewDefinition", "name": "v", "resource": "Patient", "select": [
+		{"column": [{"name": "given", "path": "name.given"}]}
+	]}`)
+	if _, err := v.Rows(decodeResource(t, `{"resourceType": "Patient", "name": [{"given": ["Ann", "B"]}]}`)); err == nil {
+		t.Error("Rows() of a column with several values succeeded, want error")
+	}
+}
+
+func TestParseViewDefinition_Invalid(t *testing.T) {
+	for _, view := range []string{
+		`{"resourceType": "Patient"}`,
+		`{"resourceType": "ViewDefinition", "name": "v", "resource": "Patient"}`,
+		`{"resourceType": "ViewDefinition", "name": "my view", "resource": "Patient", "select": [{"column": [{"name": "id", "path": "id"}]}]}`,
+		`{"resourceType": "ViewDefinition", "name": "v", "resource": "Nothing", "select": [{"column": [{"name": "id", "path": "id"}]}]}`,
+		`{"resourceType": "ViewDefinition", "name": "v", "resource": "Patient", "select": [{"column": [{"name": "id", "path": "id"}, {"name": "id", "path": "gender"}]}]}`,
+		`{"resourceType": "ViewDefinition", "name": "v", "resource": "Patient", "select": [{"column": [{"name": "id", "path": "id +"}]}]}`,
+		`{"resourceType": "ViewDefinition", "name": "v", "resource": "Patient", "constant": [{"name": "c", "valueString": "x"}], "select": [{"column": [{"name": "id", "path": "id"}]}]}`,
+		`{"resourceType": "ViewDefinition", "name": "v", "resource": "Patient", "select": [{"unionAll": [
+			{"column": [{"name": "a", "path": "id"}]},
+			{"column": [{"name": "b", "path": "id"}]}
+		]}]}`,
+	} {
+		if _, err := processing.ParseViewDefinition([]byte(view)); err == nil {
+			t.Errorf("ParseViewDefinition(%s) succeeded, want error", view)
+		}
+	}
+}
+
+func TestReadViewDefinitions(t *testing.T) {
+	dir := t.TempDir()
+	patientView := `{"resourceType": "ViewDefinition", "name": "patient", "resource": "Patient", "select": [{"column": [{"name": "id", "path": "id"}]}]}`
+	for name, view := range map[string]string{"b.json": eobLineView, "a.json": patientView, "README.md": "not a view"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(view), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	views, err := processing.ReadViewDefinitions(dir)
+	if err != nil {
+		t.Fatalf("ReadViewDefinitions() returned unexpected error: %v", err)
+	}
+	var got []string
+	for _, v := range views {
+		got = append(got, v.Name)
+	}
+	if diff := cmp.Diff([]string{"patient", "eob_line"}, got); diff != "" {
+		t.Errorf("ReadViewDefinitions() returned unexpected views (-want +got): %s", diff)
+	}
+
+	// Two views with the same name.
+	if err := os.WriteFile(filepath.Join(dir, "c.json"), []byte(patientView), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := processing.ReadViewDefinitions(dir); err == nil {
+		t.Error("ReadViewDefinitions() of views with the same name succeeded, want error")
+	}
+	if _, err := processing.ReadViewDefinitions(t.TempDir()); err == nil {
+		t.Error("ReadViewDefinitions() of an empty directory succeeded, want error")
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	bqapi "google.golang.org/api/bigquery/v2"
+	"github.com/google/bulk_fhir_tools/bigquery"
+	"github.com/google/bulk_fhir_tools/gcs"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ViewSinkConfig defines the configuration passed to NewViewSink. At least
+// one of Directory and BigQueryConfig must be set.
+type ViewSinkConfig struct {
+	Views []*ViewDefinition
+
+	// If Directory is set, the rows of each view are written to <name>.csv in
+	// it, replacing the file written by any previous run. It is either a local
+	// directory, which must exist, or a GCS path of the form
+	// gs://bucket/folder_path.
+	Directory   string
+	GCSEndpoint string
+
+	// If BigQueryConfig is set, the rows of each view are inserted into a table
+	// of the same name in its dataset, which is created if needed.
+	BigQueryConfig *bigquery.Config
+	// BigQueryBatchSize is the maximum number of rows inserted in a single
+	// request. If zero, a default batch size is used.
+	BigQueryBatchSize int
+}
+
+// viewOutput holds the outputs of the rows of a view.
+type viewOutput struct {
+	view *ViewDefinition
+	rows int64
+
+	file io.WriteCloser
+	csv  *csv.Writer
+
+	pending []bigquery.Row
+}
+
+// viewBatch is a batch of rows to insert into the BigQuery table of a view.
+type viewBatch struct {
+	table string
+	rows  []bigquery.Row
+}
+
+// viewSink implements the processing.Sink interface to flatten resources into
+// the rows of SQL on FHIR views.
+type viewSink struct {
+	directory string
+	bq        *bigquery.Client
+	batchSize int
+
+	views map[cpb.ResourceTypeCode_Value][]*viewOutput
+
+	// mu must be held when writing to the outputs of views.
+	mu sync.Mutex
+}
+
+// NewViewSink creates a new Sink which evaluates SQL on FHIR ViewDefinitions
+// (see ViewDefinition) against the resources written to it, and writes the
+// resulting rows as CSV files with a header row, or inserts them into BigQuery
+// tables, or both, so that analysts get tidy tables, such as a row per line
+// item of each ExplanationOfBenefit, straight from the export. Resources of
+// types without a view are ignored.
+//
+// The CSV files and BigQuery tables of every view are created when the sink is
+// created, so that a view with no rows still has an empty table. In BigQuery,
+// columns are typed from the FHIR type of the view's columns, or are strings if
+// the view does not give one.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+func NewViewSink(ctx context.Context, cfg *ViewSinkConfig) (Sink, error) {
+	if len(cfg.Views) == 0 {
+		return nil, errors.New("at least one ViewDefinition is required")
+	}
+	if cfg.Directory == "" && cfg.BigQueryConfig == nil {
+		return nil, errors.New("a view output directory or BigQuery dataset is required")
+	}
+	vs := &viewSink{
+		directory: cfg.Directory,
+		batchSize: defaultBigQueryBatchSize,
+		views:     map[cpb.ResourceTypeCode_Value][]*viewOutput{},
+	}
+	if cfg.BigQueryBatchSize > 0 {
+		vs.batchSize = cfg.BigQueryBatchSize
+	}
+	var store appendFileStore
+	if cfg.Directory != "" {
+		var err error
+		if store, err = newAppendFileStore(ctx, cfg.Directory, cfg.GCSEndpoint); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.BigQueryConfig != nil {
+		var err error
+		if vs.bq, err = bigquery.NewClient(ctx, cfg.BigQueryConfig); err != nil {
+			return nil, fmt.Errorf("error initializing BigQuery client: %w", err)
+		}
+	}
+
+	for _, v := range cfg.Views {
+		out := &viewOutput{view: v}
+		if store != nil {
+			if err := out.createCSV(ctx, store); err != nil {
+				vs.closeFiles()
+				return nil, err
+			}
+		}
+		vs.views[v.ResourceType] = append(vs.views[v.ResourceType], out)
+		if vs.bq != nil {
+			if err := vs.bq.EnsureNamedTable(ctx, v.Name, viewTableSchema(v.Columns())); err != nil {
+				vs.closeFiles()
+				return nil, err
+			}
+		}
+	}
+	return vs, nil
+}
+
+// createCSV creates the view's CSV file, and writes its header row.
+func (out *viewOutput) createCSV(ctx context.Context, store appendFileStore) error {
+	name := out.view.Name + ".csv"
+	w, err := store.openAppend(ctx, name, 0)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", name, err)
+	}
+	out.file, out.csv = w, csv.NewWriter(w)
+	var header []string
+	for _, c := range out.view.Columns() {
+		header = append(header, c.Name)
+	}
+	return out.csv.Write(header)
+}
+
+// Write is Sink.Write. The rows of the views of the resource's type are
+// written to their outputs.
+func (vs *viewSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	outputs := vs.views[resource.Type()]
+	if len(outputs) == 0 {
+		return nil
+	}
+	data, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var parsed map[string]any
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+
+	var full []viewBatch
+	vs.mu.Lock()
+	for _, out := range outputs {
+		rows, err := out.view.Rows(parsed)
+		if err != nil {
+			vs.mu.Unlock()
+			return err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		if err := vs.writeRows(out, rows); err != nil {
+			vs.mu.Unlock()
+			return err
+		}
+		recordOutput(resource, vs.location(out.view))
+		if len(out.pending) >= vs.batchSize {
+			full = append(full, viewBatch{table: out.view.Name, rows: out.pending})
+			out.pending = nil
+		}
+	}
+	vs.mu.Unlock()
+
+	for _, b := range full {
+		if err := vs.bq.InsertNamedRows(ctx, b.table, b.rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRows writes rows of a view to its CSV file, and queues them for
+// insertion into BigQuery. mu must be held.
+func (vs *viewSink) writeRows(out *viewOutput, rows [][]any) error {
+	columns := out.view.Columns()
+	for _, row := range rows {
+		if out.csv != nil {
+			record := make([]string, len(row))
+			for i, v := range row {
+				var err error
+				if record[i], err = viewCSVValue(v); err != nil {
+					return err
+				}
+			}
+			if err := out.csv.Write(record); err != nil {
+				return fmt.Errorf("error writing to %s.csv: %w", out.view.Name, err)
+			}
+		}
+		if vs.bq != nil {
+			bqRow := bigquery.Row{}
+			for i, v := range row {
+				value, err := viewBigQueryValue(columns[i], v)
+				if err != nil {
+					return err
+				}
+				bqRow[columns[i].Name] = value
+			}
+			out.pending = append(out.pending, bqRow)
+		}
+		out.rows++
+	}
+	return nil
+}
+
+// location returns the file or table the rows of a view are written to.
+func (vs *viewSink) location(v *ViewDefinition) string {
+	if vs.directory == "" {
+		return "bigquery:" + v.Name
+	}
+	if strings.HasPrefix(vs.directory, "gs://") {
+		return "gs://" + gcs.JoinPath(strings.TrimPrefix(vs.directory, "gs://"), v.Name+".csv")
+	}
+	return path.Join(vs.directory, v.Name+".csv")
+}
+
+func (vs *viewSink) closeFiles() {
+	for _, outputs := range vs.views {
+		for _, out := range outputs {
+			if out.file != nil {
+				out.file.Close()
+			}
+		}
+	}
+}
+
+// Finalize is Sink.Finalize. This completes the CSV files, and inserts the
+// remaining rows into BigQuery.
+func (vs *viewSink) Finalize(ctx context.Context) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	var errs []error
+	views := 0
+	for _, outputs := range vs.views {
+		for _, out := range outputs {
+			views++
+			if out.csv != nil {
+				out.csv.Flush()
+				if err := out.csv.Error(); err != nil {
+					errs = append(errs, fmt.Errorf("error writing to %s.csv: %w", out.view.Name, err))
+				}
+				if err := out.file.Close(); err != nil {
+					errs = append(errs, fmt.Errorf("error closing %s.csv: %w", out.view.Name, err))
+				}
+			}
+			if len(out.pending) > 0 {
+				if err := vs.bq.InsertNamedRows(ctx, out.view.Name, out.pending); err != nil {
+					errs = append(errs, err)
+				}
+				out.pending = nil
+			}
+			log.Infof("Wrote %d rows of view %s.", out.rows, out.view.Name)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CompletionToken is Completer.CompletionToken.
+func (vs *viewSink) CompletionToken() string {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	var views int
+	var rows int64
+	for _, outputs := range vs.views {
+		for _, out := range outputs {
+			views++
+			rows += out.rows
+		}
+	}
+	return fmt.Sprintf("views: %d rows of %d views", rows, views)
+}
+
+// viewCSVValue formats a value of a view's rows as a CSV field. Collections are
+// written as JSON arrays.
+func viewCSVValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// viewBigQueryType returns the BigQuery type of a column of a view.
+func viewBigQueryType(c ViewColumn) string {
+	switch c.Type {
+	case "boolean":
+		return "BOOLEAN"
+	case "integer", "positiveInt", "unsignedInt", "integer64":
+		return "INTEGER"
+	case "decimal":
+		return "FLOAT"
+	}
+	return "STRING"
+}
+
+func viewTableSchema(columns []ViewColumn) *bqapi.TableSchema {
+	schema := &bqapi.TableSchema{}
+	for _, c := range columns {
+		mode := "NULLABLE"
+		if c.Collection {
+			mode = "REPEATED"
+		}
+		schema.Fields = append(schema.Fields, &bqapi.TableFieldSchema{Name: c.Name, Type: viewBigQueryType(c), Mode: mode})
+	}
+	return schema
+}
+
+// viewBigQueryValue converts a value of a view's rows to the BigQuery type of
+// its column. Values of STRING columns are formatted as in CSV files.
+func viewBigQueryValue(c ViewColumn, v any) (bqapi.JsonValue, error) {
+	if list, ok := v.([]any); ok {
+		values := []bqapi.JsonValue{}
+		for _, e := range list {
+			value, err := viewBigQueryValue(ViewColumn{Name: c.Name, Type: c.Type}, e)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	if v == nil {
+		return nil, nil
+	}
+	switch viewBigQueryType(c) {
+	case "BOOLEAN":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "INTEGER", "FLOAT":
+		if f, ok := v.(float64); ok {
+			return f, nil
+		}
+	default:
+		return viewCSVValue(v)
+	}
+	return nil, fmt.Errorf("column %s has type %s, but got %v", c.Name, c.Type, v)
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/bigquery"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+const patientNameView = `{
+	"resourceType": "ViewDefinition",
+	"name": "patient_name",
+	"resource": "Patient",
+	"select": [
+		{"column": [{"name": "id", "path": "getResourceKey()"}, {"name": "active", "path": "active", "type": "boolean"}]},
+		{"forEach": "name", "column": [
+			{"name": "family", "path": "family"},
+			{"name": "given", "path": "given", "collection": true}
+		]}
+	]
+}`
+
+func writeViewSink(t *testing.T, cfg *processing.ViewSinkConfig) {
+	t.Helper()
+	ctx := context.Background()
+	sink, err := processing.NewViewSink(ctx, cfg)
+	if err != nil {
+		t.Fatalf("NewViewSink() returned unexpected error: %v", err)
+	}
+	for _, r := range []*testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, json: []byte(eobJSON)},
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(`{"resourceType":"Patient","id":"p1","active":true,"name":[{"family":"Smith, Jr","given":["Ann","B"]}]}`)},
+		{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte(`{"resourceType":"Observation","id":"o1"}`)},
+	} {
+		if err := sink.Write(ctx, r); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+}
+
+func TestViewSink_CSV(t *testing.T) {
+	dir := t.TempDir()
+	writeViewSink(t, &processing.ViewSinkConfig{
+		Views:     []*processing.ViewDefinition{parseView(t, eobLineView), parseView(t, patientNameView)},
+		Directory: dir,
+	})
+
+	want := map[string]string{
+		"eob_line.csv":     "id,patient_id,sequence,code,net\ne1,p1,1,99213,100.5\ne1,p1,2,85025,\n",
+		"patient_name.csv": "id,active,family,given\np1,true,\"Smith, Jr\",\"[\"\"Ann\"\",\"\"B\"\"]\"\n",
+	}
+	for name, wantContent := range want {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		if diff := cmp.Diff(wantContent, string(got)); diff != "" {
+			t.Errorf("unexpected content of %s (-want +got): %s", name, diff)
+		}
+	}
+}
+
+func TestViewSink_BigQuery(t *testing.T) {
+	server := testhelpers.NewBigQueryServer(t, "project", "dataset")
+	writeViewSink(t, &processing.ViewSinkConfig{
+		Views:             []*processing.ViewDefinition{parseView(t, eobLineView), parseView(t, patientNameView)},
+		BigQueryConfig:    &bigquery.Config{Endpoint: server.URL(), ProjectID: "project", DatasetID: "dataset"},
+		BigQueryBatchSize: 1,
+	})
+
+	if diff := cmp.Diff([]string{"eob_line", "patient_name"}, server.Tables()); diff != "" {
+		t.Errorf("view sink created unexpected tables (-want +got): %s", diff)
+	}
+	var schema struct {
+		Fields []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+			Mode string `json:"mode"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(server.Schema("patient_name"), &schema); err != nil {
+		t.Fatalf("failed to parse schema: %v", err)
+	}
+	wantSchema := []string{"id STRING NULLABLE", "active BOOLEAN NULLABLE", "family STRING NULLABLE", "given STRING REPEATED"}
+	var gotSchema []string
+	for _, f := range schema.Fields {
+		gotSchema = append(gotSchema, f.Name+" "+f.Type+" "+f.Mode)
+	}
+	if diff := cmp.Diff(wantSchema, gotSchema); diff != "" {
+		t.Errorf("unexpected schema of patient_name (-want +got): %s", diff)
+	}
+
+	wantRows := map[string][]map[string]any{
+		"eob_line": {
+			{"id": "e1", "patient_id": "p1", "sequence": 1.0, "code": "99213", "net": 100.5},
+			{"id": "e1", "patient_id": "p1", "sequence": 2.0, "code": "85025", "net": nil},
+		},
+		"patient_name": {
+			{"id": "p1", "active": true, "family": "Smith, Jr", "given": []any{"Ann", "B"}},
+		},
+	}
+	for table, want := range wantRows {
+		if diff := cmp.Diff(want, server.Rows(table)); diff != "" {
+			t.Errorf("unexpected rows in %s (-want +got): %s", table, diff)
+		}
+	}
+}
+
+func TestNewViewSink_Invalid(t *testing.T) {
+	ctx := context.Background()
+	view := parseView(t, eobLineView)
+	for _, cfg := range []*processing.ViewSinkConfig{
+		{Directory: t.TempDir()},
+		{Views: []*processing.ViewDefinition{view}},
+		{Views: []*processing.ViewDefinition{view}, Directory: filepath.Join(t.TempDir(), "missing")},
+	} {
+		if _, err := processing.NewViewSink(ctx, cfg); err == nil {
+			t.Errorf("NewViewSink(%+v) succeeded, want error", cfg)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+const (
+	// CountyFIPSExtensionURL is the URL of the extension added to addresses by
+	// the ZIP enricher, holding the FIPS code of the county of their ZIP code.
+	CountyFIPSExtensionURL = "https://github.com/google/bulk_fhir_tools/StructureDefinition/county-fips"
+	// SVIExtensionURL is the URL of the extension added to addresses by the ZIP
+	// enricher, holding the Social Vulnerability Index of their ZIP code.
+	SVIExtensionURL = "https://github.com/google/bulk_fhir_tools/StructureDefinition/svi"
+)
+
+// ZIPRecord holds the geographic data of a ZIP code.
+type ZIPRecord struct {
+	CountyFIPS string
+	CountyName string
+	// SVI is the CDC/ATSDR Social Vulnerability Index, between 0 and 1, as a
+	// decimal string. It is empty if unknown.
+	SVI string
+}
+
+// ZIPLookup looks up the geographic data of ZIP codes.
+type ZIPLookup interface {
+	// LookupZIP returns the record of the 5 digit ZIP code, or nil if it is not
+	// found.
+	LookupZIP(ctx context.Context, zip string) (*ZIPRecord, error)
+}
+
+type csvZIPLookup struct {
+	records map[string]*ZIPRecord
+}
+
+// NewCSVZIPLookup returns a ZIPLookup which reads the ZIP codes from a local
+// CSV file, such as a ZIP to county crosswalk joined with the county level
+// Social Vulnerability Index. The file must have a header row with the columns
+// zip, county_fips, county_name and optionally svi, in any order; other
+// columns are ignored. If a ZIP code spans several counties, only the first
+// row for it is used, so the rows should be ordered with the county holding
+// most of each ZIP code's addresses first.
+func NewCSVZIPLookup(path string) (ZIPLookup, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header of %s: %w", path, err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range []string{"zip", "county_fips", "county_name"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%s has no %s column", path, name)
+		}
+	}
+	sviColumn, hasSVI := columns["svi"]
+
+	records := map[string]*ZIPRecord{}
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", path, err)
+		}
+		zip := row[columns["zip"]]
+		if _, ok := records[zip]; ok {
+			continue
+		}
+		record := &ZIPRecord{CountyFIPS: row[columns["county_fips"]], CountyName: row[columns["county_name"]]}
+		if hasSVI && row[sviColumn] != "" {
+			// The SVI is kept as written, as FHIR decimals preserve precision.
+			if _, err := strconv.ParseFloat(row[sviColumn], 64); err != nil {
+				return nil, fmt.Errorf("invalid svi %q for ZIP code %s in %s", row[sviColumn], zip, path)
+			}
+			record.SVI = row[sviColumn]
+		}
+		records[zip] = record
+	}
+	return &csvZIPLookup{records: records}, nil
+}
+
+func (czl *csvZIPLookup) LookupZIP(ctx context.Context, zip string) (*ZIPRecord, error) {
+	return czl.records[zip], nil
+}
+
+type zipEnricher struct {
+	cache *lookupCache[ZIPRecord]
+}
+
+// NewZIPEnricher returns an Enricher which looks up the ZIP code of every
+// Address in a resource, such as Patient.address, and adds the county to it:
+// the county name as its district if that is not set, and the extensions
+// CountyFIPSExtensionURL and, if known, SVIExtensionURL. Addresses which
+// already have the extensions, or which have no US ZIP code, are left
+// unchanged. Lookups are cached, so that each ZIP code is looked up once.
+func NewZIPEnricher(lookup ZIPLookup) Enricher {
+	return &zipEnricher{cache: newLookupCache(lookup.LookupZIP)}
+}
+
+func (ze *zipEnricher) Name() string { return "ZIP" }
+
+func (ze *zipEnricher) Enrich(ctx context.Context, resource ResourceWrapper) (bool, error) {
+	cr, err := resource.Proto()
+	if err != nil {
+		return false, err
+	}
+	var addresses []*dpb.Address
+	collectAddresses(cr.ProtoReflect(), &addresses)
+	changed := false
+	for _, a := range addresses {
+		zip, ok := zipCode(a)
+		if !ok || hasExtension(a.GetExtension(), CountyFIPSExtensionURL) {
+			continue
+		}
+		record, err := ze.cache.get(ctx, zip)
+		if err != nil {
+			return changed, fmt.Errorf("%w: ZIP code %s: %v", ErrEnrichmentLookup, zip, err)
+		}
+		if record == nil {
+			continue
+		}
+		if a.GetDistrict().GetValue() == "" && record.CountyName != "" {
+			a.District = &dpb.String{Value: record.CountyName}
+		}
+		a.Extension = append(a.Extension, &dpb.Extension{
+			Url:   &dpb.Uri{Value: CountyFIPSExtensionURL},
+			Value: &dpb.Extension_ValueX{Choice: &dpb.Extension_ValueX_Code{Code: &dpb.Code{Value: record.CountyFIPS}}},
+		})
+		if record.SVI != "" {
+			a.Extension = append(a.Extension, &dpb.Extension{
+				Url:   &dpb.Uri{Value: SVIExtensionURL},
+				Value: &dpb.Extension_ValueX{Choice: &dpb.Extension_ValueX_Decimal{Decimal: &dpb.Decimal{Value: record.SVI}}},
+			})
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// zipCode returns the 5 digit ZIP code of a US address, ignoring any ZIP+4
+// suffix.
+func zipCode(a *dpb.Address) (string, bool) {
+	if c := a.GetCountry().GetValue(); c != "" && !strings.EqualFold(c, "US") && !strings.EqualFold(c, "USA") {
+		return "", false
+	}
+	zip, _, _ := strings.Cut(strings.TrimSpace(a.GetPostalCode().GetValue()), "-")
+	if len(zip) != 5 {
+		return "", false
+	}
+	for _, c := range zip {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return zip, true
+}
+
+func hasExtension(extensions []*dpb.Extension, url string) bool {
+	for _, e := range extensions {
+		if e.GetUrl().GetValue() == url {
+			return true
+		}
+	}
+	return false
+}
+
+// collectAddresses appends every Address in the message, at any depth, to
+// addresses.
+func collectAddresses(m protoreflect.Message, addresses *[]*dpb.Address) {
+	if a, ok := m.Interface().(*dpb.Address); ok {
+		*addresses = append(*addresses, a)
+		return
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Kind() != protoreflect.MessageKind && fd.Kind() != protoreflect.GroupKind {
+			return true
+		}
+		switch {
+		case fd.IsList():
+			l := v.List()
+			for i := 0; i < l.Len(); i++ {
+				collectAddresses(l.Get(i).Message(), addresses)
+			}
+		case fd.IsMap():
+			// FHIR protos do not use maps.
+		default:
+			collectAddresses(v.Message(), addresses)
+		}
+		return true
+	})
+}
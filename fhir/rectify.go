@@ -93,7 +93,7 @@ func rectifyCoverage(cov *cpb.Coverage) (jsonOut []byte, err error) {
 			// We only try to correct this placeholder reference for safety. We
 			// replace the Coverage reference with a Contract reference with the same
 			// value.
-			contract.Reference = &dpb.Reference_ContractId{&dpb.ReferenceId{Value: "part-a-contract1"}}
+			contract.Reference = &dpb.Reference_ContractId{ContractId: &dpb.ReferenceId{Value: "part-a-contract1"}}
 		}
 	}
 
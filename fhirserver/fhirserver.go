@@ -0,0 +1,296 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fhirserver contains utilities for writing resources to any FHIR R4
+// server, such as a HAPI FHIR JPA server or a vendor's FHIR API, through the
+// standard FHIR REST API.
+package fhirserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+)
+
+var fhirServerBundleCounter *metrics.Counter = metrics.NewCounter("fhir-server-bundle-counter", "Count of FHIR Bundles posted to a FHIR server by HTTP Status. Even if the bundle succeeds FHIR resources in a batch bundle may fail. See fhir-server-bundle-resource-counter for status of individual FHIR resources.", "1", aggregation.Count, "HTTPStatus")
+var fhirServerBundleResourceCounter *metrics.Counter = metrics.NewCounter("fhir-server-bundle-resource-counter", "Unpacks the FHIR Bundle responses from a FHIR server and counts the individual FHIR Resources uploaded by HTTP Status.", "1", aggregation.Count, "HTTPStatus")
+var fhirServerDeleteCounter *metrics.Counter = metrics.NewCounter("fhir-server-delete-counter", "Count of deletions of FHIR Resources from a FHIR server by FHIR Resource Type and HTTP Status.", "1", aggregation.Count, "FHIRResourceType", "HTTPStatus")
+
+// ErrorServer indicates that an error was received from the FHIR server.
+var ErrorServer = errors.New("error was received from the FHIR server")
+
+const fhirJSONContentType = "application/fhir+json;charset=utf-8"
+
+// Client writes resources to a FHIR R4 server. Do not use this directly, call
+// NewClient to create a new one.
+type Client struct {
+	baseURL       string
+	authenticator bulkfhir.Authenticator
+	httpClient    *http.Client
+}
+
+// ClientOption configures a Client created by NewClient.
+type ClientOption func(*Client)
+
+// WithHTTPClient makes the Client send requests with hc, such as to use a
+// custom transport for mutual TLS. By default http.DefaultClient is used.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// NewClient returns a Client for the FHIR server at baseURL, for example
+// https://hapi.example.com/fhir. authenticator adds credentials to each
+// request, and may be nil for servers which do not require any.
+func NewClient(baseURL string, authenticator bulkfhir.Authenticator, opts ...ClientOption) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse FHIR server URL %q: %w", baseURL, err)
+	}
+	if !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("FHIR server URL %q is not an absolute http or https URL", baseURL)
+	}
+	c := &Client{
+		baseURL:       strings.TrimSuffix(baseURL, "/"),
+		authenticator: authenticator,
+		httpClient:    http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// ResourceURL returns the URL of the FHIR resource with the given type and ID
+// on the server.
+func (c *Client) ResourceURL(resourceType, resourceID string) string {
+	return fmt.Sprintf("%s/%s/%s", c.baseURL, resourceType, resourceID)
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Accept", "application/fhir+json")
+	if c.authenticator != nil {
+		if err := c.authenticator.AddAuthenticationToRequest(c.httpClient, req); err != nil {
+			return nil, fmt.Errorf("failed to authenticate with the FHIR server: %w", err)
+		}
+	}
+	return c.httpClient.Do(req)
+}
+
+// UploadBundle uploads the provided FHIR resources to the server in a single
+// Bundle. Resources with an ID are updated (PUT) with that ID, and others are
+// created (POST). If transaction is false, the Bundle is a batch, in which each
+// resource succeeds or fails independently; otherwise it is a transaction, in
+// which all resources fail if any does. The error returned may be an instance
+// of BundleError, which identifies the resources which failed.
+func (c *Client) UploadBundle(ctx context.Context, fhirJSONs [][]byte, transaction bool) error {
+	bundle, err := makeFHIRBundle(fhirJSONs, transaction)
+	if err != nil {
+		return err
+	}
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL, bytes.NewReader(bundleJSON))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", fhirJSONContentType)
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("error posting Bundle to FHIR server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := fhirServerBundleCounter.Record(ctx, 1, http.StatusText(resp.StatusCode)); err != nil {
+		return err
+	}
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read response: %v", err)
+	}
+	bundleErr := &BundleError{ResponseStatusCode: resp.StatusCode, ResponseStatusText: resp.Status, ResponseBytes: respBytes}
+	if resp.StatusCode > 299 {
+		return bundleErr
+	}
+
+	var resps bundleResponses
+	if err := json.Unmarshal(respBytes, &resps); err != nil {
+		return fmt.Errorf("could not unmarshal response: %v", err)
+	}
+	if len(resps.Entry) != len(fhirJSONs) {
+		// Without a response for each entry, we can't tell which failed.
+		return bundleErr
+	}
+	for i, r := range resps.Entry {
+		if err := fhirServerBundleResourceCounter.Record(ctx, 1, r.Response.Status); err != nil {
+			return err
+		}
+		// According to the FHIR spec Response.status shall start with a 3 digit
+		// HTTP code
+		// (https://build.fhir.org/bundle-definitions.html#Bundle.entry.response.status)
+		if len(r.Response.Status) < 3 {
+			return fmt.Errorf("invalid status %q in Bundle response", r.Response.Status)
+		}
+		scode, err := strconv.Atoi(r.Response.Status[:3])
+		if err != nil {
+			return err
+		}
+		if scode > 299 {
+			log.Errorf("error uploading fhir resource in bundle: %s %s", r.Response.Status, r.Response.Outcome)
+			bundleErr.FailedEntries = append(bundleErr.FailedEntries, i)
+		}
+	}
+	if len(bundleErr.FailedEntries) > 0 {
+		return bundleErr
+	}
+	return nil
+}
+
+// DeleteResource deletes the FHIR resource with the given type (e.g. Patient)
+// and ID from the server. Deleting a resource which does not exist, or has
+// already been deleted, succeeds.
+func (c *Client) DeleteResource(ctx context.Context, resourceType, resourceID string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.ResourceURL(resourceType, resourceID), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("error deleting %s/%s from FHIR server: %w", resourceType, resourceID, err)
+	}
+	defer resp.Body.Close()
+
+	if err := fhirServerDeleteCounter.Record(ctx, 1, resourceType, http.StatusText(resp.StatusCode)); err != nil {
+		return err
+	}
+
+	if resp.StatusCode > 299 && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusGone {
+		respBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("could not read response: %v", err)
+		}
+		return fmt.Errorf("error deleting %s/%s from FHIR server: status %d %s: %s %w", resourceType, resourceID, resp.StatusCode, resp.Status, respBytes, ErrorServer)
+	}
+	return nil
+}
+
+// bundleResponses holds the entries of the Bundle returned for a batch or
+// transaction.
+type bundleResponses struct {
+	Entry []struct {
+		Response struct {
+			Status  string          `json:"status"`
+			Outcome json.RawMessage `json:"outcome,omitempty"`
+		} `json:"response"`
+	} `json:"entry"`
+}
+
+// BundleError represents an error returned from a FHIR server when attempting
+// to upload a FHIR bundle. A batch Bundle may succeed even if FHIR resources
+// inside the bundle failed to upload. In that case ResponseStatusCode and
+// ResponseStatusText hold the status of the bundle, FailedEntries the
+// resources which failed, and ResponseBytes may have details on the individual
+// resources.
+type BundleError struct {
+	// ResponseStatusCode and ResponseStatusText hold the status for the bundle.
+	// Within the bundle individual FHIR resources may have still failed to
+	// upload.
+	ResponseStatusCode int
+	ResponseStatusText string
+	ResponseBytes      []byte
+	// FailedEntries holds the indices of the resources which failed to upload,
+	// or is nil if they all did.
+	FailedEntries []int
+}
+
+// Error returns a string version of error information.
+func (b *BundleError) Error() string {
+	if b.FailedEntries != nil {
+		return fmt.Sprintf("error from FHIR server for %d resources in Bundle, StatusCode: %d StatusText: %s Response: %s", len(b.FailedEntries), b.ResponseStatusCode, b.ResponseStatusText, b.ResponseBytes)
+	}
+	return fmt.Sprintf("error from FHIR server, StatusCode: %d StatusText: %s Response: %s", b.ResponseStatusCode, b.ResponseStatusText, b.ResponseBytes)
+}
+
+// Is returns true if this error should be considered equivalent to the target
+// error (and makes this work smoothly with errors.Is calls)
+func (b *BundleError) Is(target error) bool {
+	return target == ErrorServer
+}
+
+type fhirBundle struct {
+	ResourceType string  `json:"resourceType"`
+	Type         string  `json:"type"`
+	Entry        []entry `json:"entry"`
+}
+
+type request struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+type entry struct {
+	Resource json.RawMessage `json:"resource"`
+	Request  request         `json:"request"`
+}
+
+func makeFHIRBundle(fhirJSONs [][]byte, isTransaction bool) (*fhirBundle, error) {
+	bundleType := "batch"
+	if isTransaction {
+		bundleType = "transaction"
+	}
+
+	bundle := fhirBundle{
+		ResourceType: "Bundle",
+		Type:         bundleType,
+	}
+
+	bundle.Entry = make([]entry, len(fhirJSONs))
+	for i, fhirJSON := range fhirJSONs {
+		var data struct {
+			ResourceID   string `json:"id"`
+			ResourceType string `json:"resourceType"`
+		}
+		if err := json.Unmarshal(fhirJSON, &data); err != nil {
+			return nil, err
+		}
+		if data.ResourceType == "" {
+			return nil, errors.New("resource has no resourceType")
+		}
+		bundle.Entry[i].Resource = fhirJSON
+		if data.ResourceID == "" {
+			bundle.Entry[i].Request = request{URL: data.ResourceType, Method: http.MethodPost}
+			continue
+		}
+		bundle.Entry[i].Request = request{
+			URL:    fmt.Sprintf("%s/%s", data.ResourceType, data.ResourceID),
+			Method: http.MethodPut,
+		}
+	}
+
+	return &bundle, nil
+}
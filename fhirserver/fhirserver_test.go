@@ -0,0 +1,202 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhirserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhirserver"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+)
+
+type bundleRequest struct {
+	ResourceType string `json:"resourceType"`
+	Type         string `json:"type"`
+	Entry        []struct {
+		Resource json.RawMessage `json:"resource"`
+		Request  struct {
+			Method string `json:"method"`
+			URL    string `json:"url"`
+		} `json:"request"`
+	} `json:"entry"`
+}
+
+func TestUploadBundle(t *testing.T) {
+	inputJSONs := [][]byte{
+		[]byte(`{"id":"1","resourceType":"Patient"}`),
+		[]byte(`{"resourceType":"Observation"}`),
+	}
+	cases := []struct {
+		name        string
+		transaction bool
+		status      int
+		response    string
+		wantType    string
+		wantErr     *fhirserver.BundleError
+	}{
+		{
+			name:     "Batch",
+			status:   http.StatusOK,
+			response: `{"resourceType":"Bundle","type":"batch-response","entry":[{"response":{"status":"200 OK"}},{"response":{"status":"201 Created"}}]}`,
+			wantType: "batch",
+		},
+		{
+			name:        "Transaction",
+			transaction: true,
+			status:      http.StatusOK,
+			response:    `{"resourceType":"Bundle","type":"transaction-response","entry":[{"response":{"status":"200 OK"}},{"response":{"status":"201"}}]}`,
+			wantType:    "transaction",
+		},
+		{
+			name:     "ErrorInsideBundle",
+			status:   http.StatusOK,
+			response: `{"resourceType":"Bundle","type":"batch-response","entry":[{"response":{"status":"200 OK"}},{"response":{"status":"422 Unprocessable Entity"}}]}`,
+			wantType: "batch",
+			wantErr:  &fhirserver.BundleError{ResponseStatusCode: 200, ResponseStatusText: "200 OK", FailedEntries: []int{1}},
+		},
+		{
+			name:        "ErrorWholeBundle",
+			transaction: true,
+			status:      http.StatusBadRequest,
+			response:    `{"resourceType":"OperationOutcome"}`,
+			wantType:    "transaction",
+			wantErr:     &fhirserver.BundleError{ResponseStatusCode: 400, ResponseStatusText: "400 Bad Request"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.InitNoOp()
+			var got bundleRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodPost || req.URL.Path != "/fhir" {
+					t.Errorf("unexpected request %s %s, want POST /fhir", req.Method, req.URL.Path)
+				}
+				if got, want := req.Header.Get("Authorization"), "Bearer token"; got != want {
+					t.Errorf("unexpected Authorization header %q, want %q", got, want)
+				}
+				body, err := io.ReadAll(req.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := json.Unmarshal(body, &got); err != nil {
+					t.Errorf("could not parse request body %s: %v", body, err)
+				}
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.response))
+			}))
+			defer server.Close()
+
+			auth, err := bulkfhir.NewStaticBearerTokenAuthenticator("token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := fhirserver.NewClient(server.URL+"/fhir/", auth)
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			uploadErr := c.UploadBundle(context.Background(), inputJSONs, tc.transaction)
+
+			if got.ResourceType != "Bundle" || got.Type != tc.wantType || len(got.Entry) != 2 {
+				t.Fatalf("server received unexpected Bundle %+v, want a %s of 2 entries", got, tc.wantType)
+			}
+			if got.Entry[0].Request.Method != "PUT" || got.Entry[0].Request.URL != "Patient/1" {
+				t.Errorf("unexpected request for resource with ID: %+v, want PUT Patient/1", got.Entry[0].Request)
+			}
+			if got.Entry[1].Request.Method != "POST" || got.Entry[1].Request.URL != "Observation" {
+				t.Errorf("unexpected request for resource without ID: %+v, want POST Observation", got.Entry[1].Request)
+			}
+
+			if tc.wantErr == nil {
+				if uploadErr != nil {
+					t.Errorf("UploadBundle() returned unexpected error: %v", uploadErr)
+				}
+				return
+			}
+			var bundleErr *fhirserver.BundleError
+			if !errors.As(uploadErr, &bundleErr) {
+				t.Fatalf("UploadBundle() returned error %v, want a BundleError", uploadErr)
+			}
+			if !errors.Is(uploadErr, fhirserver.ErrorServer) {
+				t.Errorf("UploadBundle() returned error %v, want it to be ErrorServer", uploadErr)
+			}
+			tc.wantErr.ResponseBytes = []byte(tc.response)
+			if diff := cmp.Diff(tc.wantErr, bundleErr); diff != "" {
+				t.Errorf("UploadBundle() returned unexpected error (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDeleteResource(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "Deleted", status: http.StatusNoContent},
+		{name: "NotFound", status: http.StatusNotFound},
+		{name: "Gone", status: http.StatusGone},
+		{name: "Error", status: http.StatusInternalServerError, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.InitNoOp()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodDelete || req.URL.Path != "/fhir/Patient/1" {
+					t.Errorf("unexpected request %s %s, want DELETE /fhir/Patient/1", req.Method, req.URL.Path)
+				}
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			c, err := fhirserver.NewClient(server.URL+"/fhir", nil)
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			err = c.DeleteResource(context.Background(), "Patient", "1")
+			if (err != nil) != tc.wantErr {
+				t.Errorf("DeleteResource() returned error %v, want error: %t", err, tc.wantErr)
+			}
+			if err != nil && !errors.Is(err, fhirserver.ErrorServer) {
+				t.Errorf("DeleteResource() returned error %v, want it to be ErrorServer", err)
+			}
+		})
+	}
+}
+
+func TestNewClient_Invalid(t *testing.T) {
+	for _, u := range []string{"", "/fhir", "ftp://example.com/fhir", "://"} {
+		if _, err := fhirserver.NewClient(u, nil); err == nil {
+			t.Errorf("NewClient(%q) succeeded, want error", u)
+		}
+	}
+}
+
+func TestResourceURL(t *testing.T) {
+	c, err := fhirserver.NewClient("https://hapi.example.com/fhir/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.ResourceURL("Patient", "1"), "https://hapi.example.com/fhir/Patient/1"; got != want {
+		t.Errorf("ResourceURL() = %q, want %q", got, want)
+	}
+}
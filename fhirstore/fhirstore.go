@@ -23,7 +23,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	healthcare "google.golang.org/api/healthcare/v1"
 	"google.golang.org/api/option"
@@ -33,6 +35,7 @@ import (
 )
 
 var fhirStoreUploadCounter *metrics.Counter = metrics.NewCounter("fhir-store-upload-counter", "Count of uploads to FHIR Store by FHIR Resource Type and HTTP Status.", "1", aggregation.Count, "FHIRResourceType", "HTTPStatus")
+var fhirStoreDeleteCounter *metrics.Counter = metrics.NewCounter("fhir-store-delete-counter", "Count of deletions of FHIR Resources from FHIR Store by FHIR Resource Type and HTTP Status.", "1", aggregation.Count, "FHIRResourceType", "HTTPStatus")
 var fhirStoreBatchUploadCounter *metrics.Counter = metrics.NewCounter("fhir-store-batch-upload-counter", "Count of FHIR Bundles uploaded to FHIR Store by HTTP Status. Even if the bundle succeeds FHIR resources in the bundle may fail. See fhir-store-batch-upload-resource-counter for status of individual FHIR resources.", "1", aggregation.Count, "HTTPStatus")
 var fhirStoreBatchUploadResourceCounter *metrics.Counter = metrics.NewCounter("fhir-store-batch-upload-resource-counter", "Unpacks the FHIR Bundles Response and counts the individiual FHIR Resources uploaded to FHIR Store by HTTP Status.", "1", aggregation.Count, "HTTPStatus")
 
@@ -41,6 +44,28 @@ var fhirStoreBatchUploadResourceCounter *metrics.Counter = metrics.NewCounter("f
 // environment.
 const DefaultHealthcareEndpoint = "https://healthcare.googleapis.com/"
 
+const healthcareHost = "healthcare.googleapis.com"
+
+// RegionalHealthcareEndpoint returns the regional cloud healthcare API endpoint
+// for the given location, for example
+// "https://us-central1-healthcare.googleapis.com/" for us-central1. Regional
+// endpoints keep requests within the location, which may be required by data
+// residency policies.
+func RegionalHealthcareEndpoint(location string) string {
+	return fmt.Sprintf("https://%s-%s/", location, healthcareHost)
+}
+
+// isGoogleHealthcareEndpoint returns whether the endpoint is the global or a
+// regional cloud healthcare API endpoint, as opposed to a test server.
+func isGoogleHealthcareEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	host := u.Hostname()
+	return host == healthcareHost || strings.HasSuffix(host, "-"+healthcareHost)
+}
+
 // ErrorAPIServer indicates that an error was received from the Healthcare API
 // server.
 var ErrorAPIServer = errors.New("error was received from the Healthcare API server")
@@ -69,26 +94,76 @@ type Config struct {
 	FHIRStoreID string
 }
 
-// NewClient initializes and returns a new FHIR store client.
-func NewClient(ctx context.Context, cfg *Config) (*Client, error) {
+// ClientOption configures a Client created by NewClient.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	httpClient *http.Client
+}
+
+// WithHTTPClient makes the Client send requests to the Cloud Healthcare API
+// with hc, which must add any credentials required, for example a client
+// from golang.org/x/oauth2/google.DefaultClient. By default the application
+// default credentials are used with the Cloud Healthcare API endpoints, and no
+// credentials with other endpoints, such as test servers.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(o *clientOptions) { o.httpClient = hc }
+}
+
+// validate returns an error if a field identifying the FHIR store is unset.
+func (cfg *Config) validate() error {
+	for _, f := range []struct{ name, value string }{
+		{"project ID", cfg.ProjectID},
+		{"location", cfg.Location},
+		{"dataset ID", cfg.DatasetID},
+		{"FHIR store ID", cfg.FHIRStoreID},
+	} {
+		if f.value == "" {
+			return fmt.Errorf("a FHIR store %s is required", f.name)
+		}
+	}
+	return nil
+}
+
+// NewClient initializes and returns a new FHIR store client. An error is
+// returned if cfg does not identify a FHIR store. If cfg has no
+// CloudHealthcareEndpoint, DefaultHealthcareEndpoint is used.
+func NewClient(ctx context.Context, cfg *Config, opts ...ClientOption) (*Client, error) {
+	if cfg == nil {
+		return nil, errors.New("a FHIR store config is required")
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	o := &clientOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	cp := *cfg
+	if cp.CloudHealthcareEndpoint == "" {
+		cp.CloudHealthcareEndpoint = DefaultHealthcareEndpoint
+	}
+
 	var service *healthcare.Service
 	var err error
-	if cfg.CloudHealthcareEndpoint == DefaultHealthcareEndpoint {
-		service, err = healthcare.NewService(ctx, option.WithEndpoint(cfg.CloudHealthcareEndpoint))
+	if o.httpClient != nil {
+		service, err = healthcare.NewService(ctx, option.WithHTTPClient(o.httpClient), option.WithEndpoint(cp.CloudHealthcareEndpoint))
+	} else if isGoogleHealthcareEndpoint(cp.CloudHealthcareEndpoint) {
+		service, err = healthcare.NewService(ctx, option.WithEndpoint(cp.CloudHealthcareEndpoint))
 	} else {
-		// When not using the default GCP Healthcare endpoint, we provide an empty
+		// When not using a GCP Healthcare endpoint, we provide an empty
 		// http.Client. This case is generally used in the test, so that the
 		// healthcare.Service doesn't complain about not being able to find
 		// credentials in the test environment.
 		// TODO(b/211028663): we should try to find a better way to handle this
 		// case, perhaps we can set fake default creds in the test setup.
-		service, err = healthcare.NewService(ctx, option.WithHTTPClient(&http.Client{}), option.WithEndpoint(cfg.CloudHealthcareEndpoint))
+		service, err = healthcare.NewService(ctx, option.WithHTTPClient(&http.Client{}), option.WithEndpoint(cp.CloudHealthcareEndpoint))
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &Client{service: service, cfg: cfg}, nil
+	return &Client{service: service, cfg: &cp}, nil
 }
 
 // UploadResource uploads the provided FHIR Resource to the GCP FHIR Store
@@ -100,7 +175,7 @@ func (c *Client) UploadResource(fhirJSON []byte) error {
 	if err != nil {
 		return err
 	}
-	name := fmt.Sprintf("projects/%s/locations/%s/datasets/%s/fhirStores/%s/fhir/%s/%s", c.cfg.ProjectID, c.cfg.Location, c.cfg.DatasetID, c.cfg.FHIRStoreID, resourceType, resourceID)
+	name := c.ResourceName(resourceType, resourceID)
 
 	call := fhirService.Update(name, bytes.NewReader(fhirJSON))
 	call.Header().Set("Content-Type", "application/fhir+json;charset=utf-8")
@@ -125,6 +200,38 @@ func (c *Client) UploadResource(fhirJSON []byte) error {
 	return nil
 }
 
+// DeleteResource deletes the FHIR resource with the given type (e.g. Patient)
+// and ID from the GCP FHIR Store. Deleting a resource which does not exist, or
+// has already been deleted, succeeds.
+func (c *Client) DeleteResource(ctx context.Context, resourceType, resourceID string) error {
+	fhirService := c.service.Projects.Locations.Datasets.FhirStores.Fhir
+
+	resp, err := fhirService.Delete(c.ResourceName(resourceType, resourceID)).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error executing Healthcare API call (Delete): %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := fhirStoreDeleteCounter.Record(ctx, 1, resourceType, http.StatusText(resp.StatusCode)); err != nil {
+		return err
+	}
+
+	if resp.StatusCode > 299 {
+		respBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("could not read response: %v", err)
+		}
+		return fmt.Errorf("error deleting %s/%s from API server: status %d %s: %s %w", resourceType, resourceID, resp.StatusCode, resp.Status, respBytes, ErrorAPIServer)
+	}
+	return nil
+}
+
+// ResourceName returns the Healthcare API name of the FHIR resource with
+// the given type and ID in the FHIR store.
+func (c *Client) ResourceName(resourceType, resourceID string) string {
+	return fmt.Sprintf("projects/%s/locations/%s/datasets/%s/fhirStores/%s/fhir/%s/%s", c.cfg.ProjectID, c.cfg.Location, c.cfg.DatasetID, c.cfg.FHIRStoreID, resourceType, resourceID)
+}
+
 // UploadBatch uploads the provided group of FHIR resources to the GCP FHIR
 // store specified, and does so in "batch" mode assuming each FHIR resource is
 // independent. The error returned may be an instance of BundleError,
@@ -32,6 +32,12 @@ import (
 	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
 )
 
+func TestRegionalHealthcareEndpoint(t *testing.T) {
+	if got, want := fhirstore.RegionalHealthcareEndpoint("us-central1"), "https://us-central1-healthcare.googleapis.com/"; got != want {
+		t.Errorf("RegionalHealthcareEndpoint(%q) = %q, want %q", "us-central1", got, want)
+	}
+}
+
 func TestUploadResource(t *testing.T) {
 	resourceType := "Patient"
 	resourceID := "resourceID"
@@ -109,6 +115,53 @@ func TestUploadResource(t *testing.T) {
 	})
 }
 
+func TestDeleteResource(t *testing.T) {
+	cases := []struct {
+		name      string
+		status    int
+		wantErr   error
+		wantCount map[string]int64
+	}{
+		{name: "ValidResponse", status: http.StatusOK, wantCount: map[string]int64{"Patient-OK": 1}},
+		{name: "ErrorResponse", status: http.StatusInternalServerError, wantErr: fhirstore.ErrorAPIServer, wantCount: map[string]int64{"Patient-Internal Server Error": 1}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			wantPath := "/v1/projects/projectID/locations/us-east1/datasets/datasetID/fhirStores/fhirstoreID/fhir/Patient/resourceID"
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodDelete || req.URL.Path != wantPath {
+					t.Errorf("FHIR store test server got unexpected request %s %s, want DELETE %s", req.Method, req.URL.Path, wantPath)
+				}
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			c, err := fhirstore.NewClient(context.Background(), &fhirstore.Config{
+				CloudHealthcareEndpoint: server.URL,
+				ProjectID:               "projectID",
+				Location:                "us-east1",
+				DatasetID:               "datasetID",
+				FHIRStoreID:             "fhirstoreID",
+			})
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			if err := c.DeleteResource(context.Background(), "Patient", "resourceID"); !errors.Is(err, tc.wantErr) {
+				t.Errorf("DeleteResource() returned unexpected error. got: %v, want: %v", err, tc.wantErr)
+			}
+
+			gotCount, _, err := metrics.GetResults()
+			if err != nil {
+				t.Errorf("GetResults failed; err = %s", err)
+			}
+			if diff := cmp.Diff(tc.wantCount, gotCount["fhir-store-delete-counter"].Count); diff != "" {
+				t.Errorf("GetResults() return unexpected count (-want +got): \n%s", diff)
+			}
+		})
+	}
+}
+
 func TestUploadBatch(t *testing.T) {
 	inputJSONs := [][]byte{
 		[]byte("{\"id\":\"1\",\"resourceType\":\"Patient\"}"),
@@ -459,10 +512,10 @@ func TestCheckGCSImportStatus(t *testing.T) {
 
 		c, err := fhirstore.NewClient(context.Background(), &fhirstore.Config{
 			CloudHealthcareEndpoint: server.URL,
-			ProjectID:               "",
-			Location:                "",
-			DatasetID:               "",
-			FHIRStoreID:             "",
+			ProjectID:               "project",
+			Location:                "location",
+			DatasetID:               "dataset",
+			FHIRStoreID:             "store",
 		})
 		if err != nil {
 			t.Errorf("encountered an unexpected error when creating the FHIR store client: %v", err)
@@ -520,3 +573,53 @@ type gcsImportRequest struct {
 	ContentStructure string    `json:"contentStructure"`
 	GCSSource        gcsSource `json:"gcsSource"`
 }
+
+// headerTransport adds a header to each request, standing in for a transport
+// which adds credentials.
+type headerTransport struct{}
+
+func (headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer token")
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNewClient_WithHTTPClient(t *testing.T) {
+	var gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotAuth = req.Header.Get("Authorization")
+		w.Write([]byte(`{"resourceType": "Patient", "id": "1"}`))
+	}))
+	defer server.Close()
+
+	c, err := fhirstore.NewClient(context.Background(), &fhirstore.Config{
+		CloudHealthcareEndpoint: server.URL,
+		ProjectID:               "project",
+		Location:                "location",
+		DatasetID:               "dataset",
+		FHIRStoreID:             "store",
+	}, fhirstore.WithHTTPClient(&http.Client{Transport: headerTransport{}}))
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	if err := c.UploadResource([]byte(`{"resourceType": "Patient", "id": "1"}`)); err != nil {
+		t.Fatalf("UploadResource() returned unexpected error: %v", err)
+	}
+	if gotAuth != "Bearer token" {
+		t.Errorf("request had Authorization header %q, want the one added by the client passed to WithHTTPClient", gotAuth)
+	}
+}
+
+func TestNewClient_Invalid(t *testing.T) {
+	valid := fhirstore.Config{ProjectID: "project", Location: "location", DatasetID: "dataset", FHIRStoreID: "store"}
+	noProject, noLocation, noDataset, noStore := valid, valid, valid, valid
+	noProject.ProjectID = ""
+	noLocation.Location = ""
+	noDataset.DatasetID = ""
+	noStore.FHIRStoreID = ""
+	for _, cfg := range []*fhirstore.Config{nil, &noProject, &noLocation, &noDataset, &noStore} {
+		if _, err := fhirstore.NewClient(context.Background(), cfg); err == nil {
+			t.Errorf("NewClient(%+v) returned nil error, want an error", cfg)
+		}
+	}
+}
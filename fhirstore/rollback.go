@@ -0,0 +1,267 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhirstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/api/googleapi"
+	healthcare "google.golang.org/api/healthcare/v1"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+)
+
+var fhirStoreRollbackCounter *metrics.Counter = metrics.NewCounter("fhir-store-rollback-counter", "Count of FHIR resources rolled back in FHIR Store by FHIR Resource Type and action (Deleted or Restored).", "1", aggregation.Count, "FHIRResourceType", "Action")
+
+// searchPageSize is the number of resources requested per page when searching
+// for tagged resources, which is the maximum allowed by the Healthcare API.
+const searchPageSize = "1000"
+
+// RollbackResult holds the number of resources changed by RollbackTag.
+type RollbackResult struct {
+	// Deleted is the number of resources which were deleted.
+	Deleted int
+	// Restored is the number of resources which were restored to a prior
+	// version.
+	Restored int
+}
+
+// RollbackTag undoes the writes to the FHIR store of the resources which carry
+// the meta.tag with the given system and code in their current version, such
+// as the tags added by processing.NewRunTagProcessor.
+//
+// If restorePriorVersions is false, the tagged resources are deleted.
+// Otherwise each is restored to its latest version without the tag, and only
+// deleted if it has no such version, because it was created with the tag or
+// was deleted before being written with it. Restoring prior versions relies on
+// the FHIR store keeping resource history, which is the default.
+//
+// Resources are found with a _tag search, which the Healthcare API indexes
+// asynchronously, so resources written moments before may not be rolled back.
+// RollbackTag can safely be run again, as the current version of a rolled back
+// resource no longer carries the tag.
+func (c *Client) RollbackTag(ctx context.Context, system, code string, restorePriorVersions bool) (RollbackResult, error) {
+	var result RollbackResult
+	// All tagged resources are found before changing any, so that the changes
+	// do not affect the pages of search results.
+	resources, err := c.searchByTag(ctx, system, code)
+	if err != nil {
+		return result, err
+	}
+	log.Infof("Found %d FHIR store resources with tag %s|%s to roll back.", len(resources), system, code)
+
+	for _, r := range resources {
+		var prior []byte
+		if restorePriorVersions {
+			prior, err = c.latestVersionWithoutTag(ctx, r, system, code)
+			if err != nil {
+				return result, err
+			}
+		}
+		if prior != nil {
+			if err := c.UploadResource(prior); err != nil {
+				return result, fmt.Errorf("error restoring prior version of %s/%s: %w", r.ResourceType, r.ResourceID, err)
+			}
+			result.Restored++
+			if err := fhirStoreRollbackCounter.Record(ctx, 1, r.ResourceType, "Restored"); err != nil {
+				return result, err
+			}
+			continue
+		}
+		if err := c.DeleteResource(ctx, r.ResourceType, r.ResourceID); err != nil {
+			return result, err
+		}
+		result.Deleted++
+		if err := fhirStoreRollbackCounter.Record(ctx, 1, r.ResourceType, "Deleted"); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// readBundle holds the parts of a searchset or history Bundle returned by the
+// FHIR store which are needed for rolling back resources.
+type readBundle struct {
+	Link []struct {
+		Relation string `json:"relation"`
+		URL      string `json:"url"`
+	} `json:"link"`
+	Entry []struct {
+		Resource json.RawMessage `json:"resource"`
+		Request  struct {
+			Method string `json:"method"`
+		} `json:"request"`
+	} `json:"entry"`
+}
+
+// nextPageToken returns the page token of the bundle's next link, or an empty
+// string if this is the last page.
+func (b *readBundle) nextPageToken() (string, error) {
+	for _, l := range b.Link {
+		if l.Relation != "next" {
+			continue
+		}
+		u, err := url.Parse(l.URL)
+		if err != nil {
+			return "", fmt.Errorf("invalid next link %q: %v", l.URL, err)
+		}
+		return u.Query().Get("_page_token"), nil
+	}
+	return "", nil
+}
+
+// taggedResource holds the parts of a resource needed to find its tags.
+type taggedResource struct {
+	Meta struct {
+		Tag []struct {
+			System string `json:"system"`
+			Code   string `json:"code"`
+		} `json:"tag"`
+	} `json:"meta"`
+}
+
+func (t *taggedResource) hasTag(system, code string) bool {
+	for _, tag := range t.Meta.Tag {
+		if tag.System == system && tag.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) searchByTag(ctx context.Context, system, code string) ([]resourceData, error) {
+	entries, err := c.search(ctx, "",
+		googleapi.QueryParameter("_tag", system+"|"+code),
+		googleapi.QueryParameter("_elements", "id"))
+	if err != nil {
+		return nil, err
+	}
+	var resources []resourceData
+	for _, e := range entries {
+		var r resourceData
+		if err := json.Unmarshal(e, &r); err != nil {
+			return nil, fmt.Errorf("could not unmarshal search result: %v", err)
+		}
+		resources = append(resources, r)
+	}
+	return resources, nil
+}
+
+// search returns the resources matching the search parameters in opts,
+// following the pages of results. If resourceType is empty, resources of all
+// types are searched.
+func (c *Client) search(ctx context.Context, resourceType string, opts ...googleapi.CallOption) ([]json.RawMessage, error) {
+	fhirService := c.service.Projects.Locations.Datasets.FhirStores.Fhir
+	parent := fmt.Sprintf("projects/%s/locations/%s/datasets/%s/fhirStores/%s", c.cfg.ProjectID, c.cfg.Location, c.cfg.DatasetID, c.cfg.FHIRStoreID)
+
+	var resources []json.RawMessage
+	pageToken := ""
+	for {
+		pageOpts := append(opts[:len(opts):len(opts)], googleapi.QueryParameter("_count", searchPageSize))
+		if pageToken != "" {
+			pageOpts = append(pageOpts, googleapi.QueryParameter("_page_token", pageToken))
+		}
+		var resp *http.Response
+		var err error
+		if resourceType == "" {
+			resp, err = fhirService.Search(parent, &healthcare.SearchResourcesRequest{}).Context(ctx).Do(pageOpts...)
+		} else {
+			resp, err = fhirService.SearchType(parent, resourceType, &healthcare.SearchResourcesRequest{ResourceType: resourceType}).Context(ctx).Do(pageOpts...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error executing Healthcare API call (Search): %v", err)
+		}
+		bundle, err := readBundleResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range bundle.Entry {
+			resources = append(resources, e.Resource)
+		}
+		pageToken, err = bundle.nextPageToken()
+		if err != nil {
+			return nil, err
+		}
+		if pageToken == "" {
+			return resources, nil
+		}
+	}
+}
+
+// latestVersionWithoutTag returns the JSON of the latest version of the
+// resource which does not carry the tag, or nil if there is no such version or
+// the resource was deleted at that version.
+func (c *Client) latestVersionWithoutTag(ctx context.Context, r resourceData, system, code string) ([]byte, error) {
+	fhirService := c.service.Projects.Locations.Datasets.FhirStores.Fhir
+	name := c.ResourceName(r.ResourceType, r.ResourceID)
+
+	pageToken := ""
+	for {
+		call := fhirService.History(name).Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		resp, err := call.Do()
+		if err != nil {
+			return nil, fmt.Errorf("error executing Healthcare API call (History): %v", err)
+		}
+		bundle, err := readBundleResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+		// History entries are ordered from the latest version to the oldest.
+		for _, e := range bundle.Entry {
+			if e.Request.Method == http.MethodDelete || len(e.Resource) == 0 {
+				return nil, nil
+			}
+			var tr taggedResource
+			if err := json.Unmarshal(e.Resource, &tr); err != nil {
+				return nil, fmt.Errorf("could not unmarshal history of %s/%s: %v", r.ResourceType, r.ResourceID, err)
+			}
+			if !tr.hasTag(system, code) {
+				return e.Resource, nil
+			}
+		}
+		pageToken, err = bundle.nextPageToken()
+		if err != nil {
+			return nil, err
+		}
+		if pageToken == "" {
+			return nil, nil
+		}
+	}
+}
+
+func readBundleResponse(resp *http.Response) (*readBundle, error) {
+	defer resp.Body.Close()
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response: %v", err)
+	}
+	if resp.StatusCode > 299 {
+		return nil, fmt.Errorf("error from API server: status %d %s: %s %w", resp.StatusCode, resp.Status, respBytes, ErrorAPIServer)
+	}
+	var bundle readBundle
+	if err := json.Unmarshal(respBytes, &bundle); err != nil {
+		return nil, fmt.Errorf("could not unmarshal response: %v", err)
+	}
+	return &bundle, nil
+}
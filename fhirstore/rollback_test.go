@@ -0,0 +1,161 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhirstore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/bulk_fhir_tools/fhirstore"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+)
+
+func TestRollbackTag(t *testing.T) {
+	const (
+		tagged   = `"meta":{"tag":[{"system":"urn:bulk-fhir-tools:run:bcda","code":"run1"}]}`
+		untagged = `"meta":{"tag":[{"system":"urn:bulk-fhir-tools:run:bcda","code":"run0"}]}`
+	)
+	// Patient/1 was updated by the run, Observation/2 was created by it and
+	// Patient/3 was deleted before the run recreated it.
+	histories := map[string]string{
+		"Patient/1":     `{"entry":[{"resource":{"resourceType":"Patient","id":"1",` + tagged + `}},{"resource":{"resourceType":"Patient","id":"1","gender":"female",` + untagged + `}}]}`,
+		"Observation/2": `{"entry":[{"resource":{"resourceType":"Observation","id":"2",` + tagged + `}}]}`,
+		"Patient/3":     `{"entry":[{"resource":{"resourceType":"Patient","id":"3",` + tagged + `}},{"request":{"method":"DELETE"}},{"resource":{"resourceType":"Patient","id":"3",` + untagged + `}}]}`,
+	}
+	projectID := "projectID"
+	location := "us-east1"
+	datasetID := "datasetID"
+	fhirStoreID := "fhirstoreID"
+	fhirPath := fmt.Sprintf("/v1/projects/%s/locations/%s/datasets/%s/fhirStores/%s/fhir/", projectID, location, datasetID, fhirStoreID)
+
+	cases := []struct {
+		name                 string
+		restorePriorVersions bool
+		wantResult           fhirstore.RollbackResult
+		wantDeleted          []string
+		wantRestored         map[string]string
+	}{
+		{
+			name:        "delete",
+			wantResult:  fhirstore.RollbackResult{Deleted: 3},
+			wantDeleted: []string{"Observation/2", "Patient/1", "Patient/3"},
+		},
+		{
+			name:                 "restore prior versions",
+			restorePriorVersions: true,
+			wantResult:           fhirstore.RollbackResult{Deleted: 2, Restored: 1},
+			wantDeleted:          []string{"Observation/2", "Patient/3"},
+			wantRestored:         map[string]string{"Patient/1": `{"resourceType":"Patient","id":"1","gender":"female",` + untagged + `}`},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			var mu sync.Mutex
+			var deleted []string
+			restored := map[string]string{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if !strings.HasPrefix(req.URL.Path, fhirPath) {
+					t.Errorf("unexpected request path %s", req.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				resource := strings.TrimPrefix(req.URL.Path, fhirPath)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case req.Method == http.MethodPost && resource == "_search":
+					if got, want := req.URL.Query().Get("_tag"), "urn:bulk-fhir-tools:run:bcda|run1"; got != want {
+						t.Errorf("search has _tag %q, want %q", got, want)
+					}
+					if req.URL.Query().Get("_page_token") == "" {
+						fmt.Fprint(w, `{"link":[{"relation":"next","url":"https://healthcare.googleapis.com/fhir?_page_token=page2"}],"entry":[{"resource":{"resourceType":"Patient","id":"1"}}]}`)
+						return
+					}
+					fmt.Fprint(w, `{"entry":[{"resource":{"resourceType":"Observation","id":"2"}},{"resource":{"resourceType":"Patient","id":"3"}}]}`)
+				case req.Method == http.MethodGet && strings.HasSuffix(resource, "/_history"):
+					fmt.Fprint(w, histories[strings.TrimSuffix(resource, "/_history")])
+				case req.Method == http.MethodPut:
+					body, err := io.ReadAll(req.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					restored[resource] = string(body)
+				case req.Method == http.MethodDelete:
+					deleted = append(deleted, resource)
+				default:
+					t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			}))
+			defer server.Close()
+
+			c, err := fhirstore.NewClient(context.Background(), &fhirstore.Config{
+				CloudHealthcareEndpoint: server.URL,
+				ProjectID:               projectID,
+				Location:                location,
+				DatasetID:               datasetID,
+				FHIRStoreID:             fhirStoreID,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			got, err := c.RollbackTag(context.Background(), "urn:bulk-fhir-tools:run:bcda", "run1", tc.restorePriorVersions)
+			if err != nil {
+				t.Fatalf("RollbackTag() returned unexpected error: %v", err)
+			}
+			if got != tc.wantResult {
+				t.Errorf("RollbackTag() returned %+v, want %+v", got, tc.wantResult)
+			}
+			sort.Strings(deleted)
+			if diff := cmp.Diff(tc.wantDeleted, deleted); diff != "" {
+				t.Errorf("RollbackTag() deleted unexpected resources (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantRestored, restored, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("RollbackTag() restored unexpected resources (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("ErrorResponse", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+		c, err := fhirstore.NewClient(context.Background(), &fhirstore.Config{
+			CloudHealthcareEndpoint: server.URL,
+			ProjectID:               projectID,
+			Location:                location,
+			DatasetID:               datasetID,
+			FHIRStoreID:             fhirStoreID,
+		})
+		if err != nil {
+			t.Fatalf("NewClient() returned unexpected error: %v", err)
+		}
+		if _, err := c.RollbackTag(context.Background(), "system", "code", false); !errors.Is(err, fhirstore.ErrorAPIServer) {
+			t.Errorf("RollbackTag() returned unexpected error. got: %v, want: %v", err, fhirstore.ErrorAPIServer)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhirstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// verifyIDBatchSize is the number of resource IDs looked up by each search when
+// verifying resources by type, which keeps the search URLs to a reasonable
+// length.
+const verifyIDBatchSize = 100
+
+// VerifyResult reports how the resources in the FHIR store compare with the
+// resources expected to be there, such as those written to NDJSON by the same
+// run.
+type VerifyResult struct {
+	// Compared is the number of distinct expected resources.
+	Compared int `json:"compared"`
+	// Missing holds the references (e.g. Patient/123) of the expected resources
+	// which are not in the FHIR store.
+	Missing []string `json:"missing,omitempty"`
+	// Mismatched holds the expected resources whose current version in the
+	// FHIR store differs.
+	Mismatched []Mismatch `json:"mismatched,omitempty"`
+	// Unexpected holds the references of the resources in the FHIR store which
+	// carry the tag but were not expected. It is only set by VerifyTag.
+	Unexpected []string `json:"unexpected,omitempty"`
+}
+
+// Mismatch describes an expected resource which differs in the FHIR store.
+type Mismatch struct {
+	Resource string `json:"resource"`
+	// Fields holds the paths of the fields which differ, such as
+	// name[0].family, in which an array index of * means the arrays have
+	// different lengths.
+	Fields []string `json:"fields"`
+}
+
+// OK returns whether the FHIR store held exactly the expected resources.
+func (r *VerifyResult) OK() bool {
+	return len(r.Missing) == 0 && len(r.Mismatched) == 0 && len(r.Unexpected) == 0
+}
+
+// VerifyResources reads back the expected resources, given as FHIR JSON, from
+// the FHIR store by type and ID, and compares them with their current versions.
+// An expected resource replaces any earlier one with the same type and ID, as
+// it would when uploaded in order. The meta.versionId and meta.lastUpdated
+// fields, which are set by the FHIR store, are not compared.
+func (c *Client) VerifyResources(ctx context.Context, expected [][]byte) (*VerifyResult, error) {
+	want, err := expectedResources(expected)
+	if err != nil {
+		return nil, err
+	}
+	idsByType := map[string][]string{}
+	for ref := range want {
+		resourceType, id, _ := strings.Cut(ref, "/")
+		idsByType[resourceType] = append(idsByType[resourceType], id)
+	}
+	got := map[string]json.RawMessage{}
+	for resourceType, ids := range idsByType {
+		sort.Strings(ids)
+		for len(ids) > 0 {
+			batch := ids[:min(len(ids), verifyIDBatchSize)]
+			ids = ids[len(batch):]
+			resources, err := c.search(ctx, resourceType, googleapi.QueryParameter("_id", strings.Join(batch, ",")))
+			if err != nil {
+				return nil, err
+			}
+			if err := addResources(got, resources); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return compareResources(want, got), nil
+}
+
+// VerifyTag reads back the resources in the FHIR store which carry the meta.tag
+// with the given system and code in their current version, such as the tags
+// added by processing.NewRunTagProcessor, and compares them with the expected
+// resources, as VerifyResources does. Tagged resources which were not expected
+// are reported too. As with RollbackTag, the _tag search may not find
+// resources written moments before.
+func (c *Client) VerifyTag(ctx context.Context, system, code string, expected [][]byte) (*VerifyResult, error) {
+	want, err := expectedResources(expected)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := c.search(ctx, "", googleapi.QueryParameter("_tag", system+"|"+code))
+	if err != nil {
+		return nil, err
+	}
+	got := map[string]json.RawMessage{}
+	if err := addResources(got, resources); err != nil {
+		return nil, err
+	}
+	return compareResources(want, got), nil
+}
+
+// expectedResources returns the resources keyed by reference, with later
+// resources replacing earlier ones with the same reference.
+func expectedResources(expected [][]byte) (map[string]json.RawMessage, error) {
+	want := map[string]json.RawMessage{}
+	for _, r := range expected {
+		resourceType, id, err := getResourceTypeAndID(r)
+		if err != nil {
+			return nil, err
+		}
+		want[resourceType+"/"+id] = r
+	}
+	return want, nil
+}
+
+func addResources(m map[string]json.RawMessage, resources []json.RawMessage) error {
+	for _, r := range resources {
+		resourceType, id, err := getResourceTypeAndID(r)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal search result: %v", err)
+		}
+		m[resourceType+"/"+id] = r
+	}
+	return nil
+}
+
+// compareResources compares the expected resources with those read from the
+// FHIR store, both keyed by reference.
+func compareResources(want, got map[string]json.RawMessage) *VerifyResult {
+	result := &VerifyResult{Compared: len(want)}
+	for ref, w := range want {
+		g, ok := got[ref]
+		if !ok {
+			result.Missing = append(result.Missing, ref)
+			continue
+		}
+		if fields := diffFields("", normalizeForCompare(w), normalizeForCompare(g)); len(fields) > 0 {
+			result.Mismatched = append(result.Mismatched, Mismatch{Resource: ref, Fields: fields})
+		}
+	}
+	for ref := range got {
+		if _, ok := want[ref]; !ok {
+			result.Unexpected = append(result.Unexpected, ref)
+		}
+	}
+	sort.Strings(result.Missing)
+	sort.Strings(result.Unexpected)
+	sort.Slice(result.Mismatched, func(i, j int) bool { return result.Mismatched[i].Resource < result.Mismatched[j].Resource })
+	return result
+}
+
+// normalizeForCompare parses the resource, removing the meta fields set by the
+// FHIR store.
+func normalizeForCompare(resource json.RawMessage) any {
+	var v map[string]any
+	if err := json.Unmarshal(resource, &v); err != nil {
+		// The resources have already been parsed to find their type and ID.
+		return nil
+	}
+	if meta, ok := v["meta"].(map[string]any); ok {
+		delete(meta, "versionId")
+		delete(meta, "lastUpdated")
+		if len(meta) == 0 {
+			delete(v, "meta")
+		}
+	}
+	return v
+}
+
+// diffFields returns the paths of the fields which differ between want and
+// got, sorted.
+func diffFields(path string, want, got any) []string {
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			break
+		}
+		var fields []string
+		for k := range w {
+			fields = append(fields, diffFields(joinField(path, k), w[k], g[k])...)
+		}
+		for k := range g {
+			if _, ok := w[k]; !ok {
+				fields = append(fields, joinField(path, k))
+			}
+		}
+		sort.Strings(fields)
+		return fields
+	case []any:
+		g, ok := got.([]any)
+		if !ok {
+			break
+		}
+		if len(w) != len(g) {
+			return []string{path + "[*]"}
+		}
+		var fields []string
+		for i := range w {
+			fields = append(fields, diffFields(fmt.Sprintf("%s[%d]", path, i), w[i], g[i])...)
+		}
+		return fields
+	}
+	if reflect.DeepEqual(want, got) {
+		return nil
+	}
+	return []string{path}
+}
+
+func joinField(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhirstore_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhirstore"
+)
+
+func TestVerify(t *testing.T) {
+	const tag = `{"system":"urn:bulk-fhir-tools:run:bcda","code":"run1"}`
+	projectID := "projectID"
+	location := "us-east1"
+	datasetID := "datasetID"
+	fhirStoreID := "fhirstoreID"
+	fhirPath := fmt.Sprintf("/v1/projects/%s/locations/%s/datasets/%s/fhirStores/%s/fhir/", projectID, location, datasetID, fhirStoreID)
+
+	// The FHIR store holds Patient/1 as expected, apart from the meta fields it
+	// sets, Patient/2 with a different name, and Patient/4, which is tagged but
+	// not expected. Observation/3 is missing.
+	stored := map[string]string{
+		"Patient/1": `{"resourceType":"Patient","id":"1","gender":"male","meta":{"versionId":"v1","lastUpdated":"2024-01-02T03:04:05Z","tag":[` + tag + `]}}`,
+		"Patient/2": `{"resourceType":"Patient","id":"2","name":[{"family":"Smith","given":["Jo"]}],"meta":{"tag":[` + tag + `]}}`,
+		"Patient/4": `{"resourceType":"Patient","id":"4","meta":{"tag":[` + tag + `]}}`,
+	}
+	expected := [][]byte{
+		[]byte(`{"resourceType":"Patient","id":"1","gender":"male","meta":{"tag":[` + tag + `]}}`),
+		[]byte(`{"resourceType":"Patient","id":"2","name":[{"family":"Smyth","given":["Jo","Ann"]}],"meta":{"tag":[` + tag + `]}}`),
+		[]byte(`{"resourceType":"Observation","id":"3"}`),
+	}
+	wantMismatched := []fhirstore.Mismatch{{Resource: "Patient/2", Fields: []string{"name[0].family", "name[0].given[*]"}}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resource := strings.TrimPrefix(req.URL.Path, fhirPath)
+		if req.Method != http.MethodPost || !strings.HasSuffix(resource, "_search") {
+			t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var entries []string
+		if resourceType := strings.TrimSuffix(resource, "/_search"); resourceType != resource {
+			for _, id := range strings.Split(req.URL.Query().Get("_id"), ",") {
+				if r, ok := stored[resourceType+"/"+id]; ok {
+					entries = append(entries, `{"resource":`+r+`}`)
+				}
+			}
+		} else {
+			if got, want := req.URL.Query().Get("_tag"), "urn:bulk-fhir-tools:run:bcda|run1"; got != want {
+				t.Errorf("search has _tag %q, want %q", got, want)
+			}
+			for _, ref := range []string{"Patient/1", "Patient/2", "Patient/4"} {
+				entries = append(entries, `{"resource":`+stored[ref]+`}`)
+			}
+		}
+		fmt.Fprintf(w, `{"entry":[%s]}`, strings.Join(entries, ","))
+	}))
+	defer server.Close()
+
+	c, err := fhirstore.NewClient(context.Background(), &fhirstore.Config{
+		CloudHealthcareEndpoint: server.URL,
+		ProjectID:               projectID,
+		Location:                location,
+		DatasetID:               datasetID,
+		FHIRStoreID:             fhirStoreID,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+
+	t.Run("VerifyResources", func(t *testing.T) {
+		got, err := c.VerifyResources(context.Background(), expected)
+		if err != nil {
+			t.Fatalf("VerifyResources() returned unexpected error: %v", err)
+		}
+		want := &fhirstore.VerifyResult{Compared: 3, Missing: []string{"Observation/3"}, Mismatched: wantMismatched}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("VerifyResources() returned unexpected diff (-want +got):\n%s", diff)
+		}
+		if got.OK() {
+			t.Errorf("VerifyResources() result is OK, want not OK")
+		}
+	})
+
+	t.Run("VerifyTag", func(t *testing.T) {
+		got, err := c.VerifyTag(context.Background(), "urn:bulk-fhir-tools:run:bcda", "run1", expected)
+		if err != nil {
+			t.Fatalf("VerifyTag() returned unexpected error: %v", err)
+		}
+		want := &fhirstore.VerifyResult{Compared: 3, Missing: []string{"Observation/3"}, Mismatched: wantMismatched, Unexpected: []string{"Patient/4"}}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("VerifyTag() returned unexpected diff (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("VerifyResourcesOK", func(t *testing.T) {
+		got, err := c.VerifyResources(context.Background(), expected[:1])
+		if err != nil {
+			t.Fatalf("VerifyResources() returned unexpected error: %v", err)
+		}
+		if !got.OK() {
+			t.Errorf("VerifyResources() returned %+v, want OK result", got)
+		}
+	})
+}
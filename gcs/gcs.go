@@ -19,11 +19,18 @@ package gcs
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
@@ -35,22 +42,94 @@ const DefaultCloudStorageEndpoint = "https://storage.googleapis.com/"
 // ErrInvalidGCSPath is an error indicating the GCS path is not valid.
 var ErrInvalidGCSPath = errors.New("the GCS path is not valid. a bucket and folder must be included, along with a gs:// prefix. For example gs://bucket/folder")
 
+// DefaultUploadChunkSize is the default size of each chunk of a resumable
+// upload.
+const DefaultUploadChunkSize = googleapi.DefaultUploadChunkSize
+
+// UploadConfig configures how files written with GetFileWriter are uploaded.
+type UploadConfig struct {
+	// ChunkSize is the size in bytes of each chunk of a resumable upload.
+	// Files larger than this are uploaded in several chunks, and a chunk which
+	// fails with a transient error is retried rather than failing the whole
+	// upload. The data for each chunk is buffered in memory. It is rounded up
+	// to a multiple of 256KiB. If zero, each file is uploaded in a single
+	// request, which is not retried.
+	ChunkSize int
+	// ChunkRetryDeadline is how long a failed chunk is retried for. If zero,
+	// the storage library default of 32 seconds is used.
+	ChunkRetryDeadline time.Duration
+}
+
+var (
+	defaultUploadConfigMu sync.Mutex
+	defaultUploadConfig   = UploadConfig{ChunkSize: DefaultUploadChunkSize}
+)
+
+// SetDefaultUploadConfig sets the UploadConfig of clients subsequently created
+// by NewClient.
+func SetDefaultUploadConfig(cfg UploadConfig) {
+	defaultUploadConfigMu.Lock()
+	defer defaultUploadConfigMu.Unlock()
+	defaultUploadConfig = cfg
+}
+
 // Client represents a GCS API client belonging to some project.
 type Client struct {
 	*storage.Client
 	endpointURL string
 	bucketName  string
+	upload      UploadConfig
+}
+
+// ClientOption configures a Client created by NewClient.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	httpClient *http.Client
+	upload     *UploadConfig
+}
+
+// WithHTTPClient makes the Client send requests to GCS with hc, which must add
+// any credentials required. By default the application default credentials
+// are used with DefaultCloudStorageEndpoint, and no credentials with other
+// endpoints, such as test servers.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(o *clientOptions) { o.httpClient = hc }
+}
+
+// WithUploadConfig sets how files written with GetFileWriter are uploaded,
+// instead of the default set by SetDefaultUploadConfig.
+func WithUploadConfig(cfg UploadConfig) ClientOption {
+	return func(o *clientOptions) { o.upload = &cfg }
 }
 
 // NewClient creates and returns a new gcs client for use in writing resources to an existing GCS
 // bucket. Note `bucketName` must belong to an existing bucket. See here for how to create a GCS
-// bucket: https://cloud.google.com/storage/docs/creating-buckets.
+// bucket: https://cloud.google.com/storage/docs/creating-buckets. If endpointURL is empty,
+// DefaultCloudStorageEndpoint is used.
 // TODO(b/243677730): Add support for creating buckets.
-func NewClient(ctx context.Context, bucketName, endpointURL string) (Client, error) {
+func NewClient(ctx context.Context, bucketName, endpointURL string, opts ...ClientOption) (Client, error) {
+	if bucketName == "" {
+		return Client{}, errors.New("a GCS bucket name is required")
+	}
+	if endpointURL == "" {
+		endpointURL = DefaultCloudStorageEndpoint
+	}
+	o := &clientOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	var storageClient *storage.Client
 	var err error
 
-	if endpointURL == DefaultCloudStorageEndpoint {
+	if o.httpClient != nil {
+		clientOpts := []option.ClientOption{option.WithHTTPClient(o.httpClient)}
+		if endpointURL != DefaultCloudStorageEndpoint {
+			clientOpts = append(clientOpts, option.WithEndpoint(endpointURL))
+		}
+		storageClient, err = storage.NewClient(ctx, clientOpts...)
+	} else if endpointURL == DefaultCloudStorageEndpoint {
 		storageClient, err = storage.NewClient(ctx)
 	} else {
 		// When not using the default Cloud Storage endpoint, we provide an empty
@@ -61,17 +140,169 @@ func NewClient(ctx context.Context, bucketName, endpointURL string) (Client, err
 		// case, perhaps we can set fake default creds in the test setup.
 		storageClient, err = storage.NewClient(ctx, option.WithHTTPClient(&http.Client{}), option.WithEndpoint(endpointURL))
 	}
-	gcsClient := Client{endpointURL: endpointURL, bucketName: bucketName, Client: storageClient}
+	defaultUploadConfigMu.Lock()
+	upload := defaultUploadConfig
+	defaultUploadConfigMu.Unlock()
+	if o.upload != nil {
+		upload = *o.upload
+	}
+	gcsClient := Client{endpointURL: endpointURL, bucketName: bucketName, Client: storageClient, upload: upload}
 	return gcsClient, err
 }
 
+// SetUploadConfig sets how files written with GetFileWriter are uploaded,
+// overriding the default set by SetDefaultUploadConfig.
+func (gcsClient *Client) SetUploadConfig(cfg UploadConfig) {
+	gcsClient.upload = cfg
+}
+
 // GetFileWriter returns a write closer that allows the user to write to a file named `fileName` in
 // the pre defined GCS bucket.
 // Closing the write closer will send the written data to GCS.
 func (gcsClient Client) GetFileWriter(ctx context.Context, fileName string) io.WriteCloser {
+	return gcsClient.newWriter(ctx, fileName, gcsClient.upload)
+}
+
+// GetPartWriter returns a write closer for a part of a larger file, which is
+// assembled from its parts with Compose. Unlike GetFileWriter, the part is
+// uploaded in a single request as it is written, without buffering a chunk in
+// memory, so that many parts may be written in parallel. Parts should be kept
+// small, as a failed part cannot be resumed.
+func (gcsClient Client) GetPartWriter(ctx context.Context, fileName string) io.WriteCloser {
+	return gcsClient.newWriter(ctx, fileName, UploadConfig{})
+}
+
+// GetConditionalFileWriter is like GetFileWriter, but the file is only
+// written if its generation is still the given one, as returned by
+// GetFileReaderWithGeneration, or if generation is 0 and the file does not
+// exist. Otherwise closing the writer returns an error for which
+// IsPreconditionFailed returns true. This allows read-modify-write updates of
+// a file which may be written concurrently.
+func (gcsClient Client) GetConditionalFileWriter(ctx context.Context, fileName string, generation int64) io.WriteCloser {
+	conds := storage.Conditions{GenerationMatch: generation}
+	if generation == 0 {
+		conds = storage.Conditions{DoesNotExist: true}
+	}
+	return gcsClient.newObjectWriter(ctx, gcsClient.Bucket(gcsClient.bucketName).Object(fileName).If(conds), fileName, gcsClient.upload)
+}
+
+// GetRetainedFileWriter returns a writer to a new file named `fileName`, whose
+// Close returns an error for which IsPreconditionFailed returns true if the
+// file already exists. If retainUntil is not zero, the file is written with a
+// Locked retention configuration, so that nobody, including the bucket's
+// owners, can delete or replace it until then. This requires a bucket with
+// object retention enabled.
+func (gcsClient Client) GetRetainedFileWriter(ctx context.Context, fileName string, retainUntil time.Time) io.WriteCloser {
+	obj := gcsClient.Bucket(gcsClient.bucketName).Object(fileName).If(storage.Conditions{DoesNotExist: true})
+	w := gcsClient.newObjectWriter(ctx, obj, fileName, gcsClient.upload).(*tracedWriter)
+	if !retainUntil.IsZero() {
+		w.Retention = &storage.ObjectRetention{Mode: "Locked", RetainUntil: retainUntil}
+	}
+	return w
+}
+
+// WriteConditional writes data to the file on the same condition as
+// GetConditionalFileWriter, and returns the generation of the new file.
+func (gcsClient Client) WriteConditional(ctx context.Context, fileName string, data []byte, generation int64) (int64, error) {
+	w := gcsClient.GetConditionalFileWriter(ctx, fileName, generation).(*tracedWriter)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return w.Attrs().Generation, nil
+}
+
+// DeleteConditional deletes the file if its generation is still the given
+// one, as returned by GetFileReaderWithGeneration. Otherwise an error for which
+// IsPreconditionFailed returns true is returned.
+func (gcsClient Client) DeleteConditional(ctx context.Context, fileName string, generation int64) error {
+	obj := gcsClient.Bucket(gcsClient.bucketName).Object(fileName)
+	return obj.If(storage.Conditions{GenerationMatch: generation}).Delete(ctx)
+}
+
+// IsPreconditionFailed returns whether err is the error returned by GCS when
+// the conditions of a request, such as those of GetConditionalFileWriter, are
+// not met.
+func IsPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+func (gcsClient Client) newWriter(ctx context.Context, fileName string, upload UploadConfig) io.WriteCloser {
+	return gcsClient.newObjectWriter(ctx, gcsClient.Bucket(gcsClient.bucketName).Object(fileName), fileName, upload)
+}
+
+func (gcsClient Client) newObjectWriter(ctx context.Context, obj *storage.ObjectHandle, fileName string, upload UploadConfig) io.WriteCloser {
+	ctx, span := tracing.Start(ctx, "gcs.Upload",
+		attribute.String("gcs.bucket", gcsClient.bucketName),
+		attribute.String("gcs.object", fileName))
+	w := obj.NewWriter(ctx)
+	w.ChunkSize = upload.ChunkSize
+	w.ChunkRetryDeadline = upload.ChunkRetryDeadline
+	return &tracedWriter{Writer: w, span: span}
+}
+
+// maxComposeSources is the maximum number of objects GCS will compose in a
+// single request.
+const maxComposeSources = 32
+
+// Compose concatenates the files named by srcs, in order, into the file dst,
+// and then deletes srcs. Any number of sources may be given, although dst
+// must not be one of them. If srcs is empty, nothing is written.
+func (gcsClient Client) Compose(ctx context.Context, dst string, srcs []string) (err error) {
+	ctx, span := tracing.Start(ctx, "gcs.Compose",
+		attribute.String("gcs.bucket", gcsClient.bucketName),
+		attribute.String("gcs.object", dst),
+		attribute.Int("gcs.sources", len(srcs)))
+	defer func() { tracing.End(span, err) }()
+
 	bkt := gcsClient.Bucket(gcsClient.bucketName)
-	obj := bkt.Object(fileName)
-	return obj.NewWriter(ctx)
+	dstObj := bkt.Object(dst)
+	// GCS limits the number of sources per request, so larger files are built
+	// up by repeatedly appending the next sources to dst.
+	for i := 0; i < len(srcs); {
+		var objs []*storage.ObjectHandle
+		if i > 0 {
+			objs = append(objs, dstObj)
+		}
+		end := min(len(srcs), i+maxComposeSources-len(objs))
+		for _, src := range srcs[i:end] {
+			objs = append(objs, bkt.Object(src))
+		}
+		if _, err := dstObj.ComposerFrom(objs...).Run(ctx); err != nil {
+			return fmt.Errorf("error composing %s: %w", dst, err)
+		}
+		i = end
+	}
+	for _, src := range srcs {
+		if err := bkt.Object(src).Delete(ctx); err != nil {
+			return fmt.Errorf("error deleting %s after composing %s: %w", src, dst, err)
+		}
+	}
+	return nil
+}
+
+// tracedWriter ends the span covering an upload when the upload is closed.
+type tracedWriter struct {
+	*storage.Writer
+	span trace.Span
+	n    int64
+}
+
+func (tw *tracedWriter) Write(p []byte) (int, error) {
+	n, err := tw.Writer.Write(p)
+	tw.n += int64(n)
+	return n, err
+}
+
+func (tw *tracedWriter) Close() error {
+	err := tw.Writer.Close()
+	tw.span.SetAttributes(attribute.Int64("gcs.uploaded_bytes", tw.n))
+	tracing.End(tw.span, err)
+	return err
 }
 
 // GetFileReader returns a reader for a file in GCS named `fileName`.
@@ -83,6 +314,17 @@ func (gcsClient Client) GetFileReader(ctx context.Context, fileName string) (io.
 	return bkt.Object(fileName).NewReader(ctx)
 }
 
+// GetFileReaderWithGeneration is like GetFileReader, but also returns the
+// generation of the file being read, to be passed to GetConditionalFileWriter.
+func (gcsClient Client) GetFileReaderWithGeneration(ctx context.Context, fileName string) (io.ReadCloser, int64, error) {
+	bkt := gcsClient.Bucket(gcsClient.bucketName)
+	r, err := bkt.Object(fileName).NewReader(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, r.Attrs.Generation, nil
+}
+
 // IsBucketInProject returns true if the bucket is in the GCP project.
 func (gcsClient Client) IsBucketInProject(ctx context.Context, project string) (bool, error) {
 	it := gcsClient.Buckets(ctx, project)
@@ -15,9 +15,12 @@
 package gcs
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/google/bulk_fhir_tools/testhelpers"
 )
@@ -104,6 +107,123 @@ func TestGCSClientWritesResourceToGCS(t *testing.T) {
 	}
 }
 
+func TestGCSClientResumableUploadRetriesChunks(t *testing.T) {
+	const bucketID = "TestBucket"
+	const resourceName = "directory/TestResource"
+	const chunkSize = 256 * 1024
+	// Three chunks, the last partially filled.
+	resourceData := bytes.Repeat([]byte("0123456789"), (2*chunkSize+100)/10)
+
+	server := testhelpers.NewGCSServer(t)
+	server.FailUploadChunks(1)
+	ctx := context.Background()
+
+	gcsClient, err := NewClient(ctx, bucketID, server.URL())
+	if err != nil {
+		t.Fatalf("Unexpected error when getting NewClient: %v", err)
+	}
+	gcsClient.SetUploadConfig(UploadConfig{ChunkSize: chunkSize, ChunkRetryDeadline: 10 * time.Second})
+
+	w := gcsClient.GetFileWriter(ctx, resourceName)
+	if _, err := w.Write(resourceData); err != nil {
+		t.Errorf("Unexpected error when writing file: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unexpected error when closing file and uploading data to GCS: %v", err)
+	}
+
+	obj, ok := server.GetObject(bucketID, resourceName)
+	if !ok {
+		t.Fatalf("object %s/%s was not found", bucketID, resourceName)
+	}
+	if !bytes.Equal(obj.Data, resourceData) {
+		t.Errorf("uploaded object has %d bytes, want the %d bytes written", len(obj.Data), len(resourceData))
+	}
+	if got, want := server.UploadChunkRequests(), 4; got != want {
+		t.Errorf("upload made %d chunk requests, want %d (3 chunks and 1 retry)", got, want)
+	}
+}
+
+func TestNewClient_Options(t *testing.T) {
+	ctx := context.Background()
+	server := testhelpers.NewGCSServer(t)
+	upload := UploadConfig{ChunkSize: 512 * 1024, ChunkRetryDeadline: time.Minute}
+	gcsClient, err := NewClient(ctx, "bucket", server.URL(), WithUploadConfig(upload))
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	if gcsClient.upload != upload {
+		t.Errorf("NewClient() client has upload config %+v, want %+v", gcsClient.upload, upload)
+	}
+
+	if _, err := NewClient(ctx, "", server.URL()); err == nil {
+		t.Errorf("NewClient() with no bucket returned nil error, want an error")
+	}
+}
+
+func TestGCSClientComposesParts(t *testing.T) {
+	const bucketID = "TestBucket"
+	const dst = "directory/Patient.ndjson"
+	cases := []struct {
+		name     string
+		numParts int
+	}{
+		{name: "no parts", numParts: 0},
+		{name: "single part", numParts: 1},
+		{name: "single request", numParts: 32},
+		// Needs three compose requests, of 32, 31 and 7 parts.
+		{name: "several requests", numParts: 70},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := testhelpers.NewGCSServer(t)
+			ctx := context.Background()
+
+			gcsClient, err := NewClient(ctx, bucketID, server.URL())
+			if err != nil {
+				t.Fatalf("Unexpected error when getting NewClient: %v", err)
+			}
+
+			var parts []string
+			var want []byte
+			for i := 0; i < tc.numParts; i++ {
+				part := fmt.Sprintf("directory/parts/Patient_%d.ndjson", i)
+				data := []byte(fmt.Sprintf("part %d\n", i))
+				w := gcsClient.GetPartWriter(ctx, part)
+				if _, err := w.Write(data); err != nil {
+					t.Errorf("Unexpected error when writing part: %v", err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatalf("Unexpected error when closing part: %v", err)
+				}
+				parts = append(parts, part)
+				want = append(want, data...)
+			}
+
+			if err := gcsClient.Compose(ctx, dst, parts); err != nil {
+				t.Fatalf("Compose(%s, %d parts) returned unexpected error: %v", dst, len(parts), err)
+			}
+
+			obj, ok := server.GetObject(bucketID, dst)
+			if tc.numParts == 0 {
+				if ok {
+					t.Errorf("Compose(%s, no parts) wrote object %q, want none", dst, obj.Data)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("object %s/%s was not found", bucketID, dst)
+			}
+			if !bytes.Equal(obj.Data, want) {
+				t.Errorf("composed object is %q, want %q", obj.Data, want)
+			}
+			if got := server.GetAllPaths(); len(got) != 1 {
+				t.Errorf("GCS holds %v after Compose, want only the composed object", got)
+			}
+		})
+	}
+}
+
 func TestGCSClientReadsDataFromGCS(t *testing.T) {
 	var bucketID = "TestBucket"
 	var fileName = "TestFile"
@@ -136,6 +256,93 @@ func TestGCSClientReadsDataFromGCS(t *testing.T) {
 
 }
 
+func TestGCSClientConditionalWrite(t *testing.T) {
+	bucketID := "TestBucket"
+	fileName := "TestFile"
+	server := testhelpers.NewGCSServer(t)
+	ctx := context.Background()
+
+	gcsClient, err := NewClient(ctx, bucketID, server.URL())
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	write := func(generation int64, data string) error {
+		w := gcsClient.GetConditionalFileWriter(ctx, fileName, generation)
+		if _, err := w.Write([]byte(data)); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	if err := write(0, "first"); err != nil {
+		t.Fatalf("conditional write of a new file returned unexpected error: %v", err)
+	}
+	if err := write(0, "second"); !IsPreconditionFailed(err) {
+		t.Errorf("conditional write of an existing file as new returned error %v, want precondition failed", err)
+	}
+
+	reader, generation, err := gcsClient.GetFileReaderWithGeneration(ctx, fileName)
+	if err != nil {
+		t.Fatalf("GetFileReaderWithGeneration() returned unexpected error: %v", err)
+	}
+	reader.Close()
+	if generation == 0 {
+		t.Fatal("GetFileReaderWithGeneration() returned generation 0, want the generation of the file")
+	}
+
+	if err := write(generation, "third"); err != nil {
+		t.Fatalf("conditional write with the current generation returned unexpected error: %v", err)
+	}
+	if err := write(generation, "fourth"); !IsPreconditionFailed(err) {
+		t.Errorf("conditional write with a stale generation returned error %v, want precondition failed", err)
+	}
+
+	obj, ok := server.GetObject(bucketID, fileName)
+	if !ok || string(obj.Data) != "third" {
+		t.Errorf("file contents after conditional writes = %q, want %q", obj.Data, "third")
+	}
+}
+
+func TestGCSClientWriteAndDeleteConditional(t *testing.T) {
+	bucketID := "TestBucket"
+	fileName := "TestFile"
+	server := testhelpers.NewGCSServer(t)
+	ctx := context.Background()
+
+	gcsClient, err := NewClient(ctx, bucketID, server.URL())
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	generation, err := gcsClient.WriteConditional(ctx, fileName, []byte("data"), 0)
+	if err != nil {
+		t.Fatalf("WriteConditional() returned unexpected error: %v", err)
+	}
+	if _, err := gcsClient.WriteConditional(ctx, fileName, []byte("other"), 0); !IsPreconditionFailed(err) {
+		t.Errorf("WriteConditional() of an existing file as new returned error %v, want precondition failed", err)
+	}
+	reader, readGeneration, err := gcsClient.GetFileReaderWithGeneration(ctx, fileName)
+	if err != nil {
+		t.Fatalf("GetFileReaderWithGeneration() returned unexpected error: %v", err)
+	}
+	reader.Close()
+	if generation == 0 || generation != readGeneration {
+		t.Errorf("WriteConditional() returned generation %d, want %d", generation, readGeneration)
+	}
+
+	if err := gcsClient.DeleteConditional(ctx, fileName, generation+1); !IsPreconditionFailed(err) {
+		t.Errorf("DeleteConditional() with a stale generation returned error %v, want precondition failed", err)
+	}
+	if _, ok := server.GetObject(bucketID, fileName); !ok {
+		t.Fatal("file was deleted despite a stale generation")
+	}
+	if err := gcsClient.DeleteConditional(ctx, fileName, generation); err != nil {
+		t.Fatalf("DeleteConditional() with the current generation returned unexpected error: %v", err)
+	}
+	if _, ok := server.GetObject(bucketID, fileName); ok {
+		t.Error("file still exists after DeleteConditional()")
+	}
+}
+
 func TestJoinPath(t *testing.T) {
 	for _, tc := range []struct {
 		description string
@@ -0,0 +1,254 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package healthlake contains utilities for writing resources to an AWS
+// HealthLake data store, either through its SigV4 signed FHIR REST API, or by
+// staging NDJSON files in S3 and starting a FHIR import job.
+package healthlake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/healthlake"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+)
+
+var healthLakeImportJobCounter *metrics.Counter = metrics.NewCounter("healthlake-import-job-counter", "Count of HealthLake FHIR import jobs by their final status.", "1", aggregation.Count, "JobStatus")
+
+// signingName is the name HealthLake requests are signed for with SigV4.
+const signingName = "healthlake"
+
+// ErrImportFailed indicates that a HealthLake import job did not import all of
+// its resources.
+var ErrImportFailed = errors.New("HealthLake import job failed")
+
+// Config describes the HealthLake data store to write to.
+type Config struct {
+	// Region is the AWS region of the data store, for example us-east-1.
+	Region string
+	// DatastoreID is the ID of the data store.
+	DatastoreID string
+
+	// Credentials are used to sign requests. If nil, the default AWS credential
+	// chain is used, which reads the AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY environment variables, the shared credentials file
+	// and the credentials of the instance or task role.
+	Credentials *credentials.Credentials
+
+	// Endpoint and S3Endpoint override the HealthLake and S3 endpoints of the
+	// region, for example in tests. If S3Endpoint is set, path style S3 URLs
+	// are used.
+	Endpoint   string
+	S3Endpoint string
+}
+
+// Client writes resources to a HealthLake data store. Do not use this
+// directly, call NewClient to create a new one.
+type Client struct {
+	cfg      Config
+	service  *healthlake.HealthLake
+	uploader *s3manager.Uploader
+	signer   *v4.Signer
+}
+
+// NewClient returns a Client for the HealthLake data store described by cfg.
+func NewClient(ctx context.Context, cfg *Config) (*Client, error) {
+	if cfg == nil || cfg.Region == "" || cfg.DatastoreID == "" {
+		return nil, errors.New("a HealthLake region and data store ID are required")
+	}
+	awsCfg := aws.NewConfig().WithRegion(cfg.Region)
+	if cfg.Credentials != nil {
+		awsCfg = awsCfg.WithCredentials(cfg.Credentials)
+	}
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+	healthLakeCfg := aws.NewConfig()
+	if cfg.Endpoint != "" {
+		healthLakeCfg = healthLakeCfg.WithEndpoint(cfg.Endpoint)
+	}
+	s3Cfg := aws.NewConfig()
+	if cfg.S3Endpoint != "" {
+		s3Cfg = s3Cfg.WithEndpoint(cfg.S3Endpoint).WithS3ForcePathStyle(true)
+	}
+	return &Client{
+		cfg:      *cfg,
+		service:  healthlake.New(sess, healthLakeCfg),
+		uploader: s3manager.NewUploaderWithClient(s3.New(sess, s3Cfg)),
+		signer:   v4.NewSigner(sess.Config.Credentials),
+	}, nil
+}
+
+// FHIRBaseURL returns the base URL of the data store's FHIR REST API.
+func (c *Client) FHIRBaseURL() string {
+	endpoint := c.cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://healthlake.%s.amazonaws.com", c.cfg.Region)
+	}
+	return fmt.Sprintf("%s/datastore/%s/r4", strings.TrimSuffix(endpoint, "/"), c.cfg.DatastoreID)
+}
+
+// Authenticator returns a bulkfhir.Authenticator which signs requests to the
+// data store's FHIR REST API with SigV4, for use with fhirserver.NewClient.
+func (c *Client) Authenticator() bulkfhir.Authenticator {
+	return &sigV4Authenticator{signer: c.signer, region: c.cfg.Region}
+}
+
+// sigV4Authenticator signs requests with AWS Signature Version 4.
+type sigV4Authenticator struct {
+	signer *v4.Signer
+	region string
+}
+
+// Authenticate is Authenticator.Authenticate. Credentials are resolved when
+// each request is signed, so there is nothing to exchange.
+func (a *sigV4Authenticator) Authenticate(hc *http.Client) error {
+	return nil
+}
+
+// AuthenticateIfNecessary is Authenticator.AuthenticateIfNecessary.
+func (a *sigV4Authenticator) AuthenticateIfNecessary(hc *http.Client) error {
+	return nil
+}
+
+// AddAuthenticationToRequest is Authenticator.AddAuthenticationToRequest. The
+// body of the request is read to sign it, and replaced.
+func (a *sigV4Authenticator) AddAuthenticationToRequest(hc *http.Client, req *http.Request) error {
+	var body io.ReadSeeker
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		req.Body.Close()
+		body = bytes.NewReader(b)
+	}
+	_, err := a.signer.Sign(req, body, signingName, a.region, time.Now())
+	return err
+}
+
+// GetFileWriter returns a writer to the object key in the S3 bucket. The object
+// is uploaded as it is written, and the upload completes when the writer is
+// closed, which returns any error.
+func (c *Client) GetFileWriter(ctx context.Context, bucket, key string) io.WriteCloser {
+	pr, pw := io.Pipe()
+	w := &s3Writer{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := c.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   pr,
+		})
+		// Unblock any writes if the upload fails before reading everything.
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w
+}
+
+type s3Writer struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	w.pw.Close()
+	if err := <-w.done; err != nil {
+		return fmt.Errorf("error uploading to S3: %w", err)
+	}
+	return nil
+}
+
+// ImportConfig configures a HealthLake FHIR import job.
+type ImportConfig struct {
+	// InputS3URI is the S3 location of the NDJSON files to import, for example
+	// s3://bucket/prefix/.
+	InputS3URI string
+	// DataAccessRoleARN is the ARN of the IAM role HealthLake assumes to read
+	// the input and write the output.
+	DataAccessRoleARN string
+	// OutputS3URI is the S3 location HealthLake writes the job's results to,
+	// encrypted with the KMS key OutputKMSKeyID.
+	OutputS3URI    string
+	OutputKMSKeyID string
+}
+
+// StartImport starts a FHIR import job of the NDJSON files at
+// cfg.InputS3URI into the data store, returning the ID of the job.
+func (c *Client) StartImport(ctx context.Context, cfg ImportConfig) (string, error) {
+	out, err := c.service.StartFHIRImportJobWithContext(ctx, &healthlake.StartFHIRImportJobInput{
+		DatastoreId:       aws.String(c.cfg.DatastoreID),
+		DataAccessRoleArn: aws.String(cfg.DataAccessRoleARN),
+		InputDataConfig:   &healthlake.InputDataConfig{S3Uri: aws.String(cfg.InputS3URI)},
+		JobOutputDataConfig: &healthlake.OutputDataConfig{
+			S3Configuration: &healthlake.S3Configuration{
+				S3Uri:    aws.String(cfg.OutputS3URI),
+				KmsKeyId: aws.String(cfg.OutputKMSKeyID),
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error starting the HealthLake import job: %w", err)
+	}
+	return aws.StringValue(out.JobId), nil
+}
+
+// CheckImportStatus checks the HealthLake import job with the given ID, and
+// returns whether it is complete. An error wrapping ErrImportFailed is returned
+// if the job failed, was cancelled or completed with errors.
+func (c *Client) CheckImportStatus(ctx context.Context, jobID string) (isDone bool, err error) {
+	out, err := c.service.DescribeFHIRImportJobWithContext(ctx, &healthlake.DescribeFHIRImportJobInput{
+		DatastoreId: aws.String(c.cfg.DatastoreID),
+		JobId:       aws.String(jobID),
+	})
+	if err != nil {
+		return false, fmt.Errorf("error describing HealthLake import job %s: %w", jobID, err)
+	}
+	props := out.ImportJobProperties
+	if props == nil {
+		return false, fmt.Errorf("HealthLake import job %s has no properties", jobID)
+	}
+	status := aws.StringValue(props.JobStatus)
+	switch status {
+	case healthlake.JobStatusSubmitted, healthlake.JobStatusInProgress, healthlake.JobStatusCancelSubmitted, healthlake.JobStatusCancelInProgress:
+		return false, nil
+	}
+	if err := healthLakeImportJobCounter.Record(ctx, 1, status); err != nil {
+		return true, err
+	}
+	if status != healthlake.JobStatusCompleted {
+		return true, fmt.Errorf("import job %s finished with status %s: %s %w", jobID, status, aws.StringValue(props.Message), ErrImportFailed)
+	}
+	return true, nil
+}
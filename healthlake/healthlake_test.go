@@ -0,0 +1,210 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthlake_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/healthlake"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+)
+
+func newTestClient(t *testing.T, server *httptest.Server) *healthlake.Client {
+	t.Helper()
+	c, err := healthlake.NewClient(context.Background(), &healthlake.Config{
+		Region:      "us-east-1",
+		DatastoreID: "datastore",
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		Endpoint:    server.URL,
+		S3Endpoint:  server.URL,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	return c
+}
+
+func TestStartImport(t *testing.T) {
+	var got map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if target := req.Header.Get("X-Amz-Target"); target != "HealthLake.StartFHIRImportJob" {
+			t.Errorf("unexpected X-Amz-Target %q, want HealthLake.StartFHIRImportJob", target)
+		}
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Errorf("could not parse request body: %v", err)
+		}
+		w.Write([]byte(`{"DatastoreId": "datastore", "JobId": "job1", "JobStatus": "SUBMITTED"}`))
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server)
+	jobID, err := c.StartImport(context.Background(), healthlake.ImportConfig{
+		InputS3URI:        "s3://bucket/dir/",
+		DataAccessRoleARN: "arn:aws:iam::123456789012:role/healthlake",
+		OutputS3URI:       "s3://bucket/output/",
+		OutputKMSKeyID:    "key",
+	})
+	if err != nil {
+		t.Fatalf("StartImport() returned unexpected error: %v", err)
+	}
+	if jobID != "job1" {
+		t.Errorf("StartImport() = %q, want job1", jobID)
+	}
+	want := map[string]any{
+		"DatastoreId":         "datastore",
+		"DataAccessRoleArn":   "arn:aws:iam::123456789012:role/healthlake",
+		"InputDataConfig":     map[string]any{"S3Uri": "s3://bucket/dir/"},
+		"JobOutputDataConfig": map[string]any{"S3Configuration": map[string]any{"S3Uri": "s3://bucket/output/", "KmsKeyId": "key"}},
+	}
+	delete(got, "ClientToken")
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("StartImport() sent unexpected request (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckImportStatus(t *testing.T) {
+	cases := []struct {
+		status   string
+		wantDone bool
+		wantErr  bool
+	}{
+		{status: "SUBMITTED"},
+		{status: "IN_PROGRESS"},
+		{status: "COMPLETED", wantDone: true},
+		{status: "COMPLETED_WITH_ERRORS", wantDone: true, wantErr: true},
+		{status: "FAILED", wantDone: true, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.status, func(t *testing.T) {
+			metrics.ResetAll()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if target := req.Header.Get("X-Amz-Target"); target != "HealthLake.DescribeFHIRImportJob" {
+					t.Errorf("unexpected X-Amz-Target %q, want HealthLake.DescribeFHIRImportJob", target)
+				}
+				w.Write([]byte(`{"ImportJobProperties": {"DatastoreId": "datastore", "JobId": "job1", "JobStatus": "` + tc.status + `"}}`))
+			}))
+			defer server.Close()
+
+			c := newTestClient(t, server)
+			done, err := c.CheckImportStatus(context.Background(), "job1")
+			if done != tc.wantDone {
+				t.Errorf("CheckImportStatus() = %t, want %t", done, tc.wantDone)
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("CheckImportStatus() returned error %v, want error: %t", err, tc.wantErr)
+			}
+			if err != nil && !errors.Is(err, healthlake.ErrImportFailed) {
+				t.Errorf("CheckImportStatus() returned error %v, want ErrImportFailed", err)
+			}
+		})
+	}
+}
+
+func TestGetFileWriter(t *testing.T) {
+	var gotPath string
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPut {
+			t.Errorf("unexpected method %s, want PUT", req.Method)
+		}
+		gotPath = req.URL.Path
+		var err error
+		if gotBody, err = io.ReadAll(req.Body); err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server)
+	w := c.GetFileWriter(context.Background(), "bucket", "dir/Patient_0.ndjson")
+	if _, err := w.Write([]byte(`{"resourceType":"Patient"}` + "\n")); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+	if gotPath != "/bucket/dir/Patient_0.ndjson" {
+		t.Errorf("object uploaded to %q, want /bucket/dir/Patient_0.ndjson", gotPath)
+	}
+	if string(gotBody) != `{"resourceType":"Patient"}`+"\n" {
+		t.Errorf("object uploaded with body %q", gotBody)
+	}
+}
+
+func TestGetFileWriter_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server)
+	w := c.GetFileWriter(context.Background(), "bucket", "dir/Patient_0.ndjson")
+	w.Write([]byte(`{"resourceType":"Patient"}`))
+	if err := w.Close(); err == nil {
+		t.Error("Close() succeeded, want error for a failed upload")
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	c, err := healthlake.NewClient(context.Background(), &healthlake.Config{
+		Region:      "us-east-1",
+		DatastoreID: "datastore",
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	if got, want := c.FHIRBaseURL(), "https://healthlake.us-east-1.amazonaws.com/datastore/datastore/r4"; got != want {
+		t.Errorf("FHIRBaseURL() = %q, want %q", got, want)
+	}
+
+	body := []byte(`{"resourceType":"Bundle"}`)
+	req, err := http.NewRequest(http.MethodPost, c.FHIRBaseURL(), bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Authenticator().AddAuthenticationToRequest(http.DefaultClient, req); err != nil {
+		t.Fatalf("AddAuthenticationToRequest() returned unexpected error: %v", err)
+	}
+	if auth := req.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-east-1/healthlake/aws4_request") {
+		t.Errorf("unexpected Authorization header %q, want a SigV4 signature for healthlake in us-east-1", auth)
+	}
+	gotBody, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotBody, body) {
+		t.Errorf("request body after signing = %s, want %s", gotBody, body)
+	}
+}
+
+func TestNewClient_Invalid(t *testing.T) {
+	for _, cfg := range []*healthlake.Config{nil, {Region: "us-east-1"}, {DatastoreID: "datastore"}} {
+		if _, err := healthlake.NewClient(context.Background(), cfg); err == nil {
+			t.Errorf("NewClient(%+v) succeeded, want error", cfg)
+		}
+	}
+}
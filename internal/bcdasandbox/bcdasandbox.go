@@ -0,0 +1,135 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bcdasandbox parses the synthetic data credentials published for the
+// BCDA sandbox, and checks that they can be used, to make it quicker to get
+// started with bulk_fhir_fetch in demos and tests.
+package bcdasandbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+const (
+	// BaseURL is the bulk FHIR base URL of the BCDA sandbox.
+	BaseURL = "https://sandbox.bcda.cms.gov/api/v2"
+	// AuthURL is the token URL of the BCDA sandbox.
+	AuthURL = "https://sandbox.bcda.cms.gov/auth/token"
+	// GuideURL is where the sandbox credentials of each ACO size are published.
+	GuideURL = "https://bcda.cms.gov/guide.html#try-the-api"
+)
+
+// Credentials are the sandbox credentials of one synthetic ACO.
+type Credentials struct {
+	// Size names the ACO, such as small or extra_large. It is normalized by
+	// Parse to lower case, with spaces and hyphens replaced by underscores.
+	Size         string `json:"size"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+}
+
+// String describes the credentials without revealing the client secret.
+func (c Credentials) String() string {
+	return fmt.Sprintf("%s: client_id=%s client_secret=%s", c.Size, c.ClientID, maskSecret(c.ClientSecret))
+}
+
+// maskSecret hides all but the last four characters of a secret, so that
+// credentials can be told apart in logs.
+func maskSecret(secret string) string {
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+// NormalizeSize returns the normalized form of an ACO size, so that for
+// example "Extra-Small" and "extra_small" select the same credentials.
+func NormalizeSize(size string) string {
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(strings.ToLower(strings.TrimSpace(size)))
+}
+
+// Parse parses a JSON file of the form {"acos": [{"size": ..., "clientId": ...,
+// "clientSecret": ...}]}, listing the sandbox credentials of each ACO size as
+// published in the BCDA guide (see GuideURL). Sizes must be unique.
+func Parse(data []byte) ([]Credentials, error) {
+	var file struct {
+		ACOs []Credentials `json:"acos"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid BCDA sandbox credentials: %w", err)
+	}
+	if len(file.ACOs) == 0 {
+		return nil, errors.New("no BCDA sandbox credentials listed")
+	}
+	seen := map[string]bool{}
+	for i := range file.ACOs {
+		c := &file.ACOs[i]
+		c.Size = NormalizeSize(c.Size)
+		if c.Size == "" || c.ClientID == "" || c.ClientSecret == "" {
+			return nil, fmt.Errorf("BCDA sandbox credentials %d must have a size, clientId and clientSecret", i)
+		}
+		if seen[c.Size] {
+			return nil, fmt.Errorf("BCDA sandbox credentials for size %q are listed more than once", c.Size)
+		}
+		seen[c.Size] = true
+	}
+	return file.ACOs, nil
+}
+
+// Select returns the credentials of the given ACO size, or all of them if size
+// is empty.
+func Select(creds []Credentials, size string) ([]Credentials, error) {
+	if size == "" {
+		return creds, nil
+	}
+	size = NormalizeSize(size)
+	var sizes []string
+	for _, c := range creds {
+		if c.Size == size {
+			return []Credentials{c}, nil
+		}
+		sizes = append(sizes, c.Size)
+	}
+	return nil, fmt.Errorf("no BCDA sandbox credentials for ACO size %q, must be one of %s", size, strings.Join(sizes, ", "))
+}
+
+// Check verifies that cl, which should be authenticated with a set of sandbox
+// credentials, can obtain an access token and start a Patient level export of
+// Patient resources. The export is cancelled straight away.
+func Check(ctx context.Context, cl *bulkfhir.Client) error {
+	if err := cl.Authenticate(); err != nil {
+		return fmt.Errorf("failed to obtain an access token: %w", err)
+	}
+	jobURL, err := cl.StartBulkDataExportAllContext(ctx, []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT}, nil, time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to start an export: %w", err)
+	}
+	if err := cl.CancelJobContext(ctx, jobURL); err != nil {
+		log.Warningf("failed to cancel export job %s started to check the credentials: %v", jobURL, err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcdasandbox_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/internal/bcdasandbox"
+)
+
+const testCredentials = `{"acos": [
+	{"size": "Extra-Small", "clientId": "xs-id", "clientSecret": "xs-secret-1234"},
+	{"size": "large", "clientId": "l-id", "clientSecret": "short"}
+]}`
+
+func TestParse(t *testing.T) {
+	got, err := bcdasandbox.Parse([]byte(testCredentials))
+	if err != nil {
+		t.Fatalf("Parse() returned unexpected error: %v", err)
+	}
+	want := []bcdasandbox.Credentials{
+		{Size: "extra_small", ClientID: "xs-id", ClientSecret: "xs-secret-1234"},
+		{Size: "large", ClientID: "l-id", ClientSecret: "short"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Parse() returned unexpected credentials (-got +want): %s", diff)
+	}
+	if got, want := got[0].String(), "extra_small: client_id=xs-id client_secret=****1234"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got, want := got[1].String(), "large: client_id=l-id client_secret=****"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	cases := []struct {
+		name string
+		json string
+	}{
+		{"not json", `acos`},
+		{"unknown field", `{"acos": [{"size": "small", "clientId": "a", "clientSecret": "b", "group": "c"}]}`},
+		{"empty", `{"acos": []}`},
+		{"missing secret", `{"acos": [{"size": "small", "clientId": "a"}]}`},
+		{"duplicate size", `{"acos": [{"size": "small", "clientId": "a", "clientSecret": "b"}, {"size": "Small", "clientId": "c", "clientSecret": "d"}]}`},
+	}
+	for _, tc := range cases {
+		if _, err := bcdasandbox.Parse([]byte(tc.json)); err == nil {
+			t.Errorf("Parse() for %s returned nil error, want an error", tc.name)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	creds, err := bcdasandbox.Parse([]byte(testCredentials))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		size    string
+		want    []bcdasandbox.Credentials
+		wantErr bool
+	}{
+		{size: "", want: creds},
+		{size: "extra small", want: creds[:1]},
+		{size: "LARGE", want: creds[1:]},
+		{size: "small", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := bcdasandbox.Select(creds, tc.size)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Select(%q) returned error %v, want error: %t", tc.size, err, tc.wantErr)
+		}
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("Select(%q) returned unexpected credentials (-got +want): %s", tc.size, diff)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name       string
+		exportCode int
+		wantErr    error
+	}{
+		{name: "export started", exportCode: http.StatusAccepted},
+		{name: "unauthorized", exportCode: http.StatusUnauthorized, wantErr: bulkfhir.ErrorUnauthorized},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var cancelled bool
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch {
+				case req.URL.Path == "/auth/token":
+					w.Write([]byte(`{"access_token": "token", "expires_in": 1200}`))
+				case req.URL.Path == "/Patient/$export":
+					if got := req.URL.Query().Get("_type"); got != "Patient" {
+						t.Errorf("export requested _type %q, want Patient", got)
+					}
+					w.Header().Set("Content-Location", server.URL+"/jobs/1")
+					w.WriteHeader(tc.exportCode)
+				case req.URL.Path == "/jobs/1" && req.Method == http.MethodDelete:
+					cancelled = true
+					w.WriteHeader(http.StatusAccepted)
+				default:
+					t.Errorf("unexpected request %s %s", req.Method, req.URL)
+				}
+			}))
+			defer server.Close()
+
+			authenticator, err := bulkfhir.NewHTTPBasicOAuthAuthenticator("id", "secret", server.URL+"/auth/token", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cl, err := bulkfhir.NewClient(server.URL, authenticator)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = bcdasandbox.Check(context.Background(), cl)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Check() returned error %v, want %v", err, tc.wantErr)
+			}
+			if wantCancelled := tc.wantErr == nil; cancelled != wantCancelled {
+				t.Errorf("Check() cancelled the export: %t, want %t", cancelled, wantCancelled)
+			}
+		})
+	}
+}
@@ -0,0 +1,1117 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fhirpath evaluates a subset of FHIRPath (http://hl7.org/fhirpath/)
+// against resources in FHIR JSON form, for filtering resources client-side.
+//
+// The supported subset is:
+//
+//   - Paths of element names, which may start with a resource type (e.g.
+//     Claim.billablePeriod.start). Choice elements may be named without their
+//     type suffix (e.g. Observation.value). Names may be delimited by
+//     backticks.
+//   - String ('text'), number, boolean, date and dateTime (@2022-01-01,
+//     @2022-01-01T10:00:00Z) literals, the empty collection {}, and $this.
+//   - Indexing with [n].
+//   - The operators =, !=, <, <=, >, >=, |, in, contains, and, or, xor,
+//     implies and unary minus on numbers. Dates and dateTimes of different
+//     precision are compared as far as their shared precision allows, as the
+//     FHIRPath specification describes.
+//   - The functions where, select, exists, all, empty, count, first, last,
+//     not, hasValue, startsWith, endsWith, contains, matches, lower, upper,
+//     length, today and now.
+//
+// Unsupported syntax, such as arithmetic, type operators and other functions,
+// is rejected by Parse.
+package fhirpath
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Expression is a parsed FHIRPath expression.
+type Expression struct {
+	src  string
+	root node
+}
+
+// Parse parses a FHIRPath expression.
+func Parse(src string) (*Expression, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FHIRPath expression %q: %w", src, err)
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpression()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = fmt.Errorf("unexpected %q at offset %d", p.peek().text, p.peek().pos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid FHIRPath expression %q: %w", src, err)
+	}
+	return &Expression{src: src, root: root}, nil
+}
+
+func (e *Expression) String() string {
+	return e.src
+}
+
+// ResourceType returns the resource type the expression starts with, such as
+// Claim for Claim.where(billablePeriod.start >= @2022-01-01) or
+// Claim.status = 'active', or an empty string if it does not start with one.
+func (e *Expression) ResourceType() string {
+	n := e.root
+	for {
+		switch v := n.(type) {
+		case *memberNode:
+			if v.target == nil {
+				if isTypeName(v.name) {
+					return v.name
+				}
+				return ""
+			}
+			n = v.target
+		case *functionNode:
+			if v.target == nil {
+				return ""
+			}
+			n = v.target
+		case *indexNode:
+			n = v.target
+		case *binaryNode:
+			n = v.left
+		case *negateNode:
+			n = v.operand
+		default:
+			return ""
+		}
+	}
+}
+
+// Evaluate evaluates the expression against a resource, as decoded from FHIR
+// JSON by encoding/json, returning the resulting collection.
+func (e *Expression) Evaluate(resource map[string]any) ([]any, error) {
+	return e.root.eval([]any{resource})
+}
+
+// EvaluateElement evaluates the expression against an element of a resource,
+// such as a backbone element returned by another expression, which the paths
+// of the expression are relative to. A primitive element is $this.
+func (e *Expression) EvaluateElement(element any) ([]any, error) {
+	return e.root.eval([]any{element})
+}
+
+// Matches evaluates the expression against a resource, returning whether the
+// result is non-empty and not a single false value. For example, a Claim
+// matches Claim.where(status = 'active') if its status is active.
+func (e *Expression) Matches(resource map[string]any) (bool, error) {
+	result, err := e.Evaluate(resource)
+	if err != nil {
+		return false, err
+	}
+	if len(result) == 1 {
+		if b, ok := result[0].(bool); ok {
+			return b, nil
+		}
+	}
+	return len(result) > 0, nil
+}
+
+// isTypeName returns whether an element name is a type, such as a resource
+// type, rather than an element, whose names start with a lower case letter.
+func isTypeName(name string) bool {
+	return name != "" && unicode.IsUpper(rune(name[0]))
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdentifier
+	// tokenDelimitedIdentifier is an identifier in backticks, which is never a
+	// keyword.
+	tokenDelimitedIdentifier
+	tokenString
+	tokenNumber
+	tokenDate
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// operators are the operators and punctuation recognized by lex, longest
+// first.
+var operators = []string{"!=", "<=", ">=", "{}", ".", "(", ")", "[", "]", ",", "=", "<", ">", "|", "-", "$this"}
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'':
+			s, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%v at offset %d", err, i)
+			}
+			tokens = append(tokens, token{tokenString, s, i})
+			i += n
+		case c == '`':
+			end := strings.IndexByte(src[i+1:], '`')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated identifier at offset %d", i)
+			}
+			tokens = append(tokens, token{tokenDelimitedIdentifier, src[i+1 : i+1+end], i})
+			i += end + 2
+		case c == '@':
+			j := i + 1
+			for j < len(src) && strings.IndexByte("0123456789-:.+TZ", src[j]) >= 0 {
+				j++
+			}
+			tokens = append(tokens, token{tokenDate, src[i+1 : j], i})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.' && j+1 < len(src) && src[j+1] >= '0' && src[j+1] <= '9') {
+				j++
+			}
+			tokens = append(tokens, token{tokenNumber, src[i:j], i})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{tokenIdentifier, src[i:j], i})
+			i = j
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{tokenOperator, op, i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, text: "end of expression", pos: len(src)}), nil
+}
+
+// lexString returns the value of the string literal at the start of src, and
+// its length including the quotes.
+func lexString(src string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		switch c := src[i]; c {
+		case '\'':
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(src) {
+				return "", 0, errors.New("unterminated string")
+			}
+			switch e := src[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'f':
+				b.WriteByte('\f')
+			case 'u':
+				if i+4 >= len(src) {
+					return "", 0, errors.New("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(src[i+1:i+5], 16, 16)
+				if err != nil {
+					return "", 0, errors.New("invalid unicode escape")
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isOperator returns whether the next token is one of the given operators or
+// keywords.
+func (p *parser) isOperator(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOperator && t.kind != tokenIdentifier {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if t := p.next(); t.kind != tokenOperator || t.text != op {
+		return fmt.Errorf("expected %q at offset %d, found %q", op, t.pos, t.text)
+	}
+	return nil
+}
+
+// binaryLevels lists the binary operators from the lowest precedence to the
+// highest.
+var binaryLevels = [][]string{
+	{"implies"},
+	{"or", "xor"},
+	{"and"},
+	{"in", "contains"},
+	{"=", "!="},
+	{"<", "<=", ">", ">="},
+	{"|"},
+}
+
+func (p *parser) parseExpression() (node, error) {
+	return p.parseBinary(0)
+}
+
+func (p *parser) parseBinary(level int) (node, error) {
+	if level == len(binaryLevels) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.isOperator(binaryLevels[level]...)
+		if !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if _, ok := p.isOperator("-"); ok {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negateNode{operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.peek().kind == tokenOperator && p.peek().text == ".":
+			p.next()
+			t := p.next()
+			if t.kind != tokenIdentifier && t.kind != tokenDelimitedIdentifier {
+				return nil, fmt.Errorf("expected an element or function name at offset %d, found %q", t.pos, t.text)
+			}
+			if n, err = p.parseInvocation(n, t); err != nil {
+				return nil, err
+			}
+		case p.peek().kind == tokenOperator && p.peek().text == "[":
+			p.next()
+			index, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = &indexNode{target: n, index: index}
+		default:
+			return n, nil
+		}
+	}
+}
+
+// parseInvocation parses the element or function named by t, which is applied
+// to target, or to the focus if target is nil.
+func (p *parser) parseInvocation(target node, t token) (node, error) {
+	if t.kind != tokenIdentifier || p.peek().kind != tokenOperator || p.peek().text != "(" {
+		return &memberNode{target: target, name: t.text}, nil
+	}
+	p.next()
+	f, ok := functions[t.text]
+	if !ok {
+		return nil, fmt.Errorf("unsupported function %s() at offset %d", t.text, t.pos)
+	}
+	var args []node
+	if _, ok := p.isOperator(")"); !ok {
+		for {
+			arg, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.isOperator(","); !ok {
+				break
+			}
+			p.next()
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if len(args) < f.minArgs || len(args) > f.maxArgs {
+		return nil, fmt.Errorf("%s() at offset %d takes %d to %d arguments, got %d", t.text, t.pos, f.minArgs, f.maxArgs, len(args))
+	}
+	if t.text == "matches" {
+		// Compile literal patterns up front, so that invalid ones are reported
+		// by Parse.
+		if lit, ok := args[0].(*literalNode); ok {
+			if s, ok := lit.value.(string); ok {
+				if _, err := regexp.Compile(s); err != nil {
+					return nil, fmt.Errorf("invalid regular expression for matches() at offset %d: %w", t.pos, err)
+				}
+			}
+		}
+	}
+	return &functionNode{target: target, name: t.text, fn: f, args: args}, nil
+}
+
+func (p *parser) parseTerm() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return &literalNode{value: t.text}, nil
+	case tokenNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", t.text, t.pos)
+		}
+		return &literalNode{value: v}, nil
+	case tokenDate:
+		d, ok := parseDate(strings.TrimSuffix(t.text, "T"))
+		if !ok {
+			return nil, fmt.Errorf("invalid date or dateTime @%s at offset %d", t.text, t.pos)
+		}
+		return &literalNode{value: d}, nil
+	case tokenIdentifier:
+		switch t.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "and", "or", "xor", "implies", "in", "contains":
+			return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+		}
+		return p.parseInvocation(nil, t)
+	case tokenDelimitedIdentifier:
+		return &memberNode{name: t.text}, nil
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			n, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "{}":
+			return &literalNode{}, nil
+		case "$this":
+			return &thisNode{}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+// node is a node of the syntax tree of an expression. eval returns the result
+// of the node applied to the focus, the collection being navigated.
+type node interface {
+	eval(focus []any) ([]any, error)
+}
+
+type literalNode struct {
+	// value is nil for the empty collection.
+	value any
+}
+
+func (n *literalNode) eval(focus []any) ([]any, error) {
+	if n.value == nil {
+		return nil, nil
+	}
+	return []any{n.value}, nil
+}
+
+type thisNode struct{}
+
+func (n *thisNode) eval(focus []any) ([]any, error) {
+	return focus, nil
+}
+
+// memberNode selects the elements with a name from the target, or from the
+// focus if target is nil. At the start of an expression, a type name such as
+// Claim selects the items of the focus of that resource type.
+type memberNode struct {
+	target node
+	name   string
+}
+
+func (n *memberNode) eval(focus []any) ([]any, error) {
+	input := focus
+	if n.target != nil {
+		var err error
+		if input, err = n.target.eval(focus); err != nil {
+			return nil, err
+		}
+	}
+	var out []any
+	add := func(v any) {
+		if list, ok := v.([]any); ok {
+			for _, e := range list {
+				if e != nil {
+					out = append(out, e)
+				}
+			}
+		} else if v != nil {
+			out = append(out, v)
+		}
+	}
+	for _, item := range input {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if n.target == nil && isTypeName(n.name) {
+			if m["resourceType"] == n.name {
+				out = append(out, m)
+			}
+			continue
+		}
+		if v, ok := m[n.name]; ok {
+			add(v)
+			continue
+		}
+		// Match a choice element, such as valueQuantity for value.
+		for k, v := range m {
+			if rest := strings.TrimPrefix(k, n.name); rest != k && isTypeName(rest) {
+				add(v)
+			}
+		}
+	}
+	return out, nil
+}
+
+type indexNode struct {
+	target, index node
+}
+
+func (n *indexNode) eval(focus []any) ([]any, error) {
+	input, err := n.target.eval(focus)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(focus)
+	if err != nil || len(index) == 0 {
+		return nil, err
+	}
+	i, ok := singletonNumber(index)
+	if !ok || i != math.Trunc(i) {
+		return nil, errors.New("index must be a single integer")
+	}
+	if i < 0 || int(i) >= len(input) {
+		return nil, nil
+	}
+	return []any{input[int(i)]}, nil
+}
+
+type negateNode struct {
+	operand node
+}
+
+func (n *negateNode) eval(focus []any) ([]any, error) {
+	v, err := n.operand.eval(focus)
+	if err != nil || len(v) == 0 {
+		return nil, err
+	}
+	f, ok := singletonNumber(v)
+	if !ok {
+		return nil, errors.New("unary minus requires a single number")
+	}
+	return []any{-f}, nil
+}
+
+// function is a FHIRPath function, called with the input collection and its
+// unevaluated arguments, which it evaluates as needed.
+type function struct {
+	minArgs, maxArgs int
+	call             func(input []any, args []node) ([]any, error)
+}
+
+var functions map[string]function
+
+func init() {
+	// Assigned in init, as the functions refer to evalBoolean, which refers to
+	// functions through the nodes it evaluates.
+	functions = map[string]function{
+		"where": {1, 1, func(input []any, args []node) ([]any, error) {
+			var out []any
+			for _, item := range input {
+				b, err := evalBoolean(args[0], []any{item})
+				if err != nil {
+					return nil, err
+				}
+				if b != nil && *b {
+					out = append(out, item)
+				}
+			}
+			return out, nil
+		}},
+		"select": {1, 1, func(input []any, args []node) ([]any, error) {
+			var out []any
+			for _, item := range input {
+				v, err := args[0].eval([]any{item})
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, v...)
+			}
+			return out, nil
+		}},
+		"exists": {0, 1, func(input []any, args []node) ([]any, error) {
+			if len(args) == 1 {
+				var err error
+				if input, err = functions["where"].call(input, args); err != nil {
+					return nil, err
+				}
+			}
+			return []any{len(input) > 0}, nil
+		}},
+		"all": {1, 1, func(input []any, args []node) ([]any, error) {
+			for _, item := range input {
+				b, err := evalBoolean(args[0], []any{item})
+				if err != nil {
+					return nil, err
+				}
+				if b == nil || !*b {
+					return []any{false}, nil
+				}
+			}
+			return []any{true}, nil
+		}},
+		"empty": {0, 0, func(input []any, args []node) ([]any, error) {
+			return []any{len(input) == 0}, nil
+		}},
+		"count": {0, 0, func(input []any, args []node) ([]any, error) {
+			return []any{float64(len(input))}, nil
+		}},
+		"first": {0, 0, func(input []any, args []node) ([]any, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			return input[:1], nil
+		}},
+		"last": {0, 0, func(input []any, args []node) ([]any, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			return input[len(input)-1:], nil
+		}},
+		"not": {0, 0, func(input []any, args []node) ([]any, error) {
+			b, err := toBoolean(input)
+			if err != nil || b == nil {
+				return nil, err
+			}
+			return []any{!*b}, nil
+		}},
+		"hasValue": {0, 0, func(input []any, args []node) ([]any, error) {
+			if len(input) != 1 {
+				return []any{false}, nil
+			}
+			_, isObject := input[0].(map[string]any)
+			return []any{!isObject}, nil
+		}},
+		"startsWith": stringFunction(1, func(s string, args []string) (any, error) { return strings.HasPrefix(s, args[0]), nil }),
+		"endsWith":   stringFunction(1, func(s string, args []string) (any, error) { return strings.HasSuffix(s, args[0]), nil }),
+		"contains":   stringFunction(1, func(s string, args []string) (any, error) { return strings.Contains(s, args[0]), nil }),
+		"matches": stringFunction(1, func(s string, args []string) (any, error) {
+			re, err := regexp.Compile(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(s), nil
+		}),
+		"lower":  stringFunction(0, func(s string, args []string) (any, error) { return strings.ToLower(s), nil }),
+		"upper":  stringFunction(0, func(s string, args []string) (any, error) { return strings.ToUpper(s), nil }),
+		"length": stringFunction(0, func(s string, args []string) (any, error) { return float64(len([]rune(s))), nil }),
+		"today": {0, 0, func(input []any, args []node) ([]any, error) {
+			return []any{dateValue{t: time.Now(), precision: precisionDay}}, nil
+		}},
+		"now": {0, 0, func(input []any, args []node) ([]any, error) {
+			return []any{dateValue{t: time.Now(), precision: precisionTime}}, nil
+		}},
+	}
+}
+
+// stringFunction returns a function of a single string input, and n string
+// arguments. As in FHIRPath, the result is empty if the input or an argument
+// is empty.
+func stringFunction(n int, f func(s string, args []string) (any, error)) function {
+	return function{n, n, func(input []any, args []node) ([]any, error) {
+		if len(input) == 0 {
+			return nil, nil
+		}
+		s, ok := singletonString(input)
+		if !ok {
+			return nil, errors.New("string function requires a single string input")
+		}
+		var values []string
+		for _, arg := range args {
+			// Arguments are evaluated with the input as their focus.
+			v, err := arg.eval(input)
+			if err != nil || len(v) == 0 {
+				return nil, err
+			}
+			a, ok := singletonString(v)
+			if !ok {
+				return nil, errors.New("string function requires single string arguments")
+			}
+			values = append(values, a)
+		}
+		result, err := f(s, values)
+		if err != nil {
+			return nil, err
+		}
+		return []any{result}, nil
+	}}
+}
+
+type functionNode struct {
+	// target is nil for functions applied to the focus.
+	target node
+	name   string
+	fn     function
+	args   []node
+}
+
+func (n *functionNode) eval(focus []any) ([]any, error) {
+	input := focus
+	if n.target != nil {
+		var err error
+		if input, err = n.target.eval(focus); err != nil {
+			return nil, err
+		}
+	}
+	out, err := n.fn.call(input, n.args)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %w", n.name, err)
+	}
+	return out, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(focus []any) ([]any, error) {
+	switch n.op {
+	case "and", "or", "xor", "implies":
+		return n.evalLogical(focus)
+	}
+	left, err := n.left.eval(focus)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(focus)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "|":
+		out := append([]any(nil), left...)
+		for _, r := range right {
+			if !containsValue(out, r) {
+				out = append(out, r)
+			}
+		}
+		return out, nil
+	case "in":
+		return membership(left, right)
+	case "contains":
+		return membership(right, left)
+	case "=", "!=":
+		if len(left) == 0 || len(right) == 0 {
+			return nil, nil
+		}
+		eq, ok := collectionsEqual(left, right)
+		if !ok {
+			return nil, nil
+		}
+		return []any{eq == (n.op == "=")}, nil
+	default:
+		if len(left) == 0 || len(right) == 0 {
+			return nil, nil
+		}
+		if len(left) > 1 || len(right) > 1 {
+			return nil, fmt.Errorf("%s requires single values", n.op)
+		}
+		c, ok, err := compare(left[0], right[0])
+		if err != nil || !ok {
+			return nil, err
+		}
+		var result bool
+		switch n.op {
+		case "<":
+			result = c < 0
+		case "<=":
+			result = c <= 0
+		case ">":
+			result = c > 0
+		case ">=":
+			result = c >= 0
+		}
+		return []any{result}, nil
+	}
+}
+
+// evalLogical evaluates the logical operators, with the three-valued logic of
+// FHIRPath, in which an empty operand is unknown.
+func (n *binaryNode) evalLogical(focus []any) ([]any, error) {
+	left, err := evalBoolean(n.left, focus)
+	if err != nil {
+		return nil, err
+	}
+	right, err := evalBoolean(n.right, focus)
+	if err != nil {
+		return nil, err
+	}
+	isTrue := func(b *bool) bool { return b != nil && *b }
+	isFalse := func(b *bool) bool { return b != nil && !*b }
+	var result *bool
+	set := func(v bool) { result = &v }
+	switch n.op {
+	case "and":
+		switch {
+		case isFalse(left) || isFalse(right):
+			set(false)
+		case isTrue(left) && isTrue(right):
+			set(true)
+		}
+	case "or":
+		switch {
+		case isTrue(left) || isTrue(right):
+			set(true)
+		case isFalse(left) && isFalse(right):
+			set(false)
+		}
+	case "xor":
+		if left != nil && right != nil {
+			set(*left != *right)
+		}
+	case "implies":
+		switch {
+		case isFalse(left) || isTrue(right):
+			set(true)
+		case isTrue(left) && isFalse(right):
+			set(false)
+		}
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return []any{*result}, nil
+}
+
+// evalBoolean evaluates n against the focus as a boolean, returning nil if the
+// result is empty.
+func evalBoolean(n node, focus []any) (*bool, error) {
+	v, err := n.eval(focus)
+	if err != nil {
+		return nil, err
+	}
+	return toBoolean(v)
+}
+
+// toBoolean converts a collection to a boolean as FHIRPath does: an empty
+// collection is unknown (nil), a single boolean is itself, and any other
+// single value is true.
+func toBoolean(v []any) (*bool, error) {
+	switch len(v) {
+	case 0:
+		return nil, nil
+	case 1:
+		b, ok := v[0].(bool)
+		if !ok {
+			b = true
+		}
+		return &b, nil
+	default:
+		return nil, fmt.Errorf("expected a single boolean, got %d values", len(v))
+	}
+}
+
+func membership(item, collection []any) ([]any, error) {
+	if len(item) == 0 {
+		return nil, nil
+	}
+	if len(item) > 1 {
+		return nil, errors.New("membership requires a single value")
+	}
+	return []any{containsValue(collection, item[0])}, nil
+}
+
+func containsValue(collection []any, v any) bool {
+	for _, c := range collection {
+		if eq, ok := equal(c, v); ok && eq {
+			return true
+		}
+	}
+	return false
+}
+
+// collectionsEqual returns whether two collections hold equal values in the
+// same order. It returns false for ok if equality cannot be determined, such
+// as for dates of different precision.
+func collectionsEqual(a, b []any) (eq, ok bool) {
+	if len(a) != len(b) {
+		return false, true
+	}
+	for i := range a {
+		eq, ok := equal(a[i], b[i])
+		if !ok || !eq {
+			return eq, ok
+		}
+	}
+	return true, true
+}
+
+func equal(a, b any) (eq, ok bool) {
+	if x, isNumber := toNumber(a); isNumber {
+		y, isNumber := toNumber(b)
+		return isNumber && x == y, true
+	}
+	_, aDate := a.(dateValue)
+	_, bDate := b.(dateValue)
+	if aDate || bDate {
+		c, ok, err := compare(a, b)
+		if err != nil {
+			return false, true
+		}
+		return c == 0, ok
+	}
+	return reflect.DeepEqual(a, b), true
+}
+
+// compare returns the order of two values, or false for ok if it cannot be
+// determined, such as for dates of different precision.
+func compare(a, b any) (c int, ok bool, err error) {
+	if x, isNumber := toNumber(a); isNumber {
+		y, isNumber := toNumber(b)
+		if !isNumber {
+			return 0, false, fmt.Errorf("cannot compare %v with %v", a, b)
+		}
+		switch {
+		case x < y:
+			return -1, true, nil
+		case x > y:
+			return 1, true, nil
+		default:
+			return 0, true, nil
+		}
+	}
+	da, aDate := toDate(a)
+	db, bDate := toDate(b)
+	_, aLiteral := a.(dateValue)
+	_, bLiteral := b.(dateValue)
+	if aLiteral || bLiteral || aDate && bDate {
+		if !aDate || !bDate {
+			return 0, false, fmt.Errorf("cannot compare %v with %v", a, b)
+		}
+		c, ok := compareDates(da, db)
+		return c, ok, nil
+	}
+	sa, aString := a.(string)
+	sb, bString := b.(string)
+	if !aString || !bString {
+		return 0, false, fmt.Errorf("cannot compare %v with %v", a, b)
+	}
+	return strings.Compare(sa, sb), true, nil
+}
+
+func toNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case interface{ Float64() (float64, error) }:
+		// json.Number, if the resource was decoded with UseNumber.
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func singletonNumber(v []any) (float64, bool) {
+	if len(v) != 1 {
+		return 0, false
+	}
+	return toNumber(v[0])
+}
+
+func singletonString(v []any) (string, bool) {
+	if len(v) != 1 {
+		return "", false
+	}
+	s, ok := v[0].(string)
+	return s, ok
+}
+
+// precision is the precision of a date or dateTime.
+type precision int
+
+const (
+	precisionYear precision = iota
+	precisionMonth
+	precisionDay
+	// precisionTime is the precision of a dateTime with a time.
+	precisionTime
+)
+
+// dateValue is a date or dateTime, from a literal or an element.
+type dateValue struct {
+	t         time.Time
+	precision precision
+}
+
+func (d dateValue) String() string {
+	switch d.precision {
+	case precisionYear:
+		return d.t.Format("2006")
+	case precisionMonth:
+		return d.t.Format("2006-01")
+	case precisionDay:
+		return d.t.Format("2006-01-02")
+	default:
+		return d.t.Format(time.RFC3339Nano)
+	}
+}
+
+var dateLayouts = []struct {
+	layout    string
+	precision precision
+}{
+	{"2006", precisionYear},
+	{"2006-01", precisionMonth},
+	{"2006-01-02", precisionDay},
+	{time.RFC3339Nano, precisionTime},
+	{"2006-01-02T15:04:05.999999999", precisionTime},
+	{"2006-01-02T15:04Z07:00", precisionTime},
+	{"2006-01-02T15:04", precisionTime},
+}
+
+// parseDate parses a FHIR date or dateTime. DateTimes without a time zone are
+// treated as UTC.
+func parseDate(s string) (dateValue, bool) {
+	for _, l := range dateLayouts {
+		if t, err := time.Parse(l.layout, s); err == nil {
+			return dateValue{t: t, precision: l.precision}, true
+		}
+	}
+	return dateValue{}, false
+}
+
+func toDate(v any) (dateValue, bool) {
+	switch d := v.(type) {
+	case dateValue:
+		return d, true
+	case string:
+		return parseDate(d)
+	}
+	return dateValue{}, false
+}
+
+// truncate returns the date truncated to the precision. Dates are truncated in
+// the time zone they were written in, so that 2022-01-01T23:00:00-05:00 is on
+// 2022-01-01.
+func (d dateValue) truncate(p precision) time.Time {
+	y, m, day := d.t.Date()
+	switch p {
+	case precisionYear:
+		return time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+	case precisionMonth:
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	case precisionDay:
+		return time.Date(y, m, day, 0, 0, 0, 0, time.UTC)
+	default:
+		return d.t.UTC()
+	}
+}
+
+// compareDates compares two dates as far as their shared precision allows. If
+// they are the same to that precision, but differ in precision, the order is
+// unknown.
+func compareDates(a, b dateValue) (int, bool) {
+	p := min(a.precision, b.precision)
+	c := a.truncate(p).Compare(b.truncate(p))
+	if c == 0 && a.precision != b.precision {
+		return 0, false
+	}
+	return c, true
+}
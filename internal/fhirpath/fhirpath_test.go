@@ -0,0 +1,217 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhirpath_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/internal/fhirpath"
+)
+
+const claimJSON = `{
+	"resourceType": "Claim",
+	"id": "c1",
+	"status": "active",
+	"billablePeriod": {"start": "2022-03-04T10:00:00Z", "end": "2022-03-05"},
+	"total": {"value": 120.5, "currency": "USD"},
+	"item": [
+		{"sequence": 1, "productOrService": {"coding": [{"system": "http://example.com", "code": "A1"}]}},
+		{"sequence": 2, "productOrService": {"coding": [{"system": "http://example.com", "code": "B2"}]}}
+	],
+	"diagnosis": [{"sequence": 1, "diagnosisCodeableConcept": {"text": "Flu"}}]
+}`
+
+func decode(t *testing.T, s string) map[string]any {
+	t.Helper()
+	var m map[string]any
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func parse(t *testing.T, src string) *fhirpath.Expression {
+	t.Helper()
+	e, err := fhirpath.Parse(src)
+	if err != nil {
+		t.Fatalf("Parse(%q) returned unexpected error: %v", src, err)
+	}
+	return e
+}
+
+func TestMatches(t *testing.T) {
+	claim := decode(t, claimJSON)
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{"Claim", true},
+		{"Patient", false},
+		{"Claim.where(billablePeriod.start >= @2022-01-01)", true},
+		{"Claim.where(billablePeriod.start >= @2023-01-01)", false},
+		{"Claim.billablePeriod.start < @2022-03-04T11:00:00Z", true},
+		{"Claim.billablePeriod.start > @2022-03-04T06:00:00-05:00", false},
+		// The end is a date, and the comparison at the shared precision is equal,
+		// so the result is unknown.
+		{"Claim.billablePeriod.end = @2022-03-05T00:00:00Z", false},
+		{"Claim.billablePeriod.end = @2022-03-05", true},
+		{"Claim.billablePeriod.end >= @2022-03", false},
+		{"Claim.billablePeriod.end > @2022-02", true},
+		{"Claim.status = 'active'", true},
+		{"Claim.status != 'active'", false},
+		{"Claim.status in ('draft' | 'active')", true},
+		{"('draft' | 'cancelled') contains Claim.status", false},
+		{"Claim.total.value > 100", true},
+		{"Claim.total.value > -1 and Claim.total.value <= 120.5", true},
+		{"Claim.item.count() = 2", true},
+		{"Claim.item[1].sequence = 2", true},
+		{"Claim.item[5].exists()", false},
+		{"Claim.item.productOrService.coding.where(code = 'B2').exists()", true},
+		{"Claim.item.productOrService.coding.exists(code.startsWith('C'))", false},
+		{"Claim.item.all(sequence > 0)", true},
+		{"Claim.item.select(sequence).last() = 2", true},
+		{"Claim.diagnosis.diagnosis.text.lower() = 'flu'", true},
+		{"Claim.diagnosis.`diagnosisCodeableConcept`.text.matches('^F')", true},
+		{"Claim.provider.exists() or Claim.status.endsWith('ive')", true},
+		{"Claim.provider.exists().not()", true},
+		{"Claim.provider.empty() implies Claim.status = 'draft'", false},
+		{"Claim.provider = 'x' or Claim.status = 'active'", true},
+		{"Claim.provider = 'x' and Claim.status = 'active'", false},
+		{"Claim.status = 'active' xor Claim.id = 'c1'", false},
+		{"Claim.where($this.id.length() = 2)", true},
+		{"Claim.where(status = {})", false},
+		{"Claim.billablePeriod.start.hasValue()", true},
+		{"Claim.billablePeriod.hasValue()", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.expr, func(t *testing.T) {
+			e, err := fhirpath.Parse(tc.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q) returned unexpected error: %v", tc.expr, err)
+			}
+			got, err := e.Matches(claim)
+			if err != nil {
+				t.Fatalf("Matches() returned unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Matches() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	claim := decode(t, claimJSON)
+	e, err := fhirpath.Parse("Claim.item.productOrService.coding.code | 'A1' | 'C3'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := e.Evaluate(claim)
+	if err != nil {
+		t.Fatalf("Evaluate() returned unexpected error: %v", err)
+	}
+	want := []any{"A1", "B2", "C3"}
+	if len(got) != len(want) {
+		t.Fatalf("Evaluate() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Evaluate()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestEvaluateElement(t *testing.T) {
+	claim := decode(t, claimJSON)
+	items, err := parse(t, "Claim.item").Evaluate(claim)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("Evaluate(Claim.item) = %v, %v, want 2 items", items, err)
+	}
+	e := parse(t, "productOrService.coding.code")
+	for i, want := range []string{"A1", "B2"} {
+		got, err := e.EvaluateElement(items[i])
+		if err != nil {
+			t.Fatalf("EvaluateElement() returned unexpected error: %v", err)
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("EvaluateElement(item %d) = %v, want [%s]", i, got, want)
+		}
+	}
+	got, err := parse(t, "$this.startsWith('act')").EvaluateElement("active")
+	if err != nil || len(got) != 1 || got[0] != true {
+		t.Errorf("EvaluateElement() of a primitive = %v, %v, want [true]", got, err)
+	}
+}
+
+func TestEvaluate_Error(t *testing.T) {
+	claim := decode(t, claimJSON)
+	for _, expr := range []string{
+		"Claim.item.sequence > 1",
+		"Claim.status < 1",
+		"Claim.item.sequence.startsWith('1')",
+	} {
+		e, err := fhirpath.Parse(expr)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned unexpected error: %v", expr, err)
+		}
+		if _, err := e.Evaluate(claim); err == nil {
+			t.Errorf("Evaluate(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"Claim.",
+		"Claim.where(",
+		"Claim.where()",
+		"Claim.status = 'active",
+		"Claim.status + 1",
+		"Claim.ofType(Patient)",
+		"Claim.where(status.matches('('))",
+		"@2022-13-01",
+		"Claim and",
+	} {
+		if _, err := fhirpath.Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestResourceType(t *testing.T) {
+	cases := []struct {
+		expr, want string
+	}{
+		{"Claim.where(billablePeriod.start >= @2022-01-01)", "Claim"},
+		{"Patient.name.exists()", "Patient"},
+		{"Observation", "Observation"},
+		{"Observation.code[0]", "Observation"},
+		{"status = 'active'", ""},
+		{"where(status = 'active')", ""},
+		{"Claim.status = 'active' or Claim.id = 'c1'", "Claim"},
+		{"'active' = Claim.status", ""},
+	}
+	for _, tc := range cases {
+		e, err := fhirpath.Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned unexpected error: %v", tc.expr, err)
+		}
+		if got := e.ResourceType(); got != tc.want {
+			t.Errorf("ResourceType() for %q = %q, want %q", tc.expr, got, tc.want)
+		}
+	}
+}
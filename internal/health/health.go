@@ -0,0 +1,186 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package health tracks the health of a long running bulk_fhir_fetch process
+// and serves it over HTTP as /healthz (liveness) and /readyz (readiness)
+// endpoints, suitable for use as Kubernetes probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Used for testing.
+var timeNow = time.Now
+
+// A Check is a readiness check. It returns a non-nil error if the process is
+// not ready to serve (for example, if credentials can no longer be exchanged).
+type Check func(ctx context.Context) error
+
+// Status holds the health state of the process. The zero value is not usable;
+// create one with New. It is safe to use from multiple goroutines.
+type Status struct {
+	mu sync.Mutex
+
+	running      bool
+	lastRunStart time.Time
+	lastRunEnd   time.Time
+	lastRunErr   error
+	nextRun      time.Time
+
+	// If a run takes longer than this the process is reported as not live.
+	maxRunDuration time.Duration
+
+	checks map[string]Check
+	// checkMu serializes readiness checks, which are not required to be thread
+	// safe.
+	checkMu sync.Mutex
+}
+
+// New returns a new Status. If maxRunDuration is non-zero, /healthz reports
+// failure once a single run has been in progress for longer than that, which
+// lets an orchestrator restart a wedged process.
+func New(maxRunDuration time.Duration) *Status {
+	return &Status{maxRunDuration: maxRunDuration, checks: map[string]Check{}}
+}
+
+// AddReadinessCheck registers a named check that is run on each /readyz
+// request.
+func (s *Status) AddReadinessCheck(name string, c Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks[name] = c
+}
+
+// RunStarted records that a fetch run has started.
+func (s *Status) RunStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = true
+	s.lastRunStart = timeNow()
+}
+
+// RunFinished records that a fetch run has finished, with the given result.
+func (s *Status) RunFinished(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	s.lastRunEnd = timeNow()
+	s.lastRunErr = err
+}
+
+// SetNextRun records when the next scheduled fetch run will start.
+func (s *Status) SetNextRun(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextRun = t
+}
+
+// report is the JSON body served by both endpoints.
+type report struct {
+	Status       string            `json:"status"`
+	Running      bool              `json:"running"`
+	LastRunStart string            `json:"lastRunStart,omitempty"`
+	LastRunEnd   string            `json:"lastRunEnd,omitempty"`
+	LastRunError string            `json:"lastRunError,omitempty"`
+	NextRun      string            `json:"nextRun,omitempty"`
+	Checks       map[string]string `json:"checks,omitempty"`
+}
+
+func (s *Status) baseReport() (report, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := report{Running: s.running}
+	if !s.lastRunStart.IsZero() {
+		r.LastRunStart = s.lastRunStart.Format(time.RFC3339)
+	}
+	if !s.lastRunEnd.IsZero() {
+		r.LastRunEnd = s.lastRunEnd.Format(time.RFC3339)
+	}
+	if s.lastRunErr != nil {
+		r.LastRunError = s.lastRunErr.Error()
+	}
+	if !s.nextRun.IsZero() {
+		r.NextRun = s.nextRun.Format(time.RFC3339)
+	}
+	live := !(s.running && s.maxRunDuration > 0 && timeNow().Sub(s.lastRunStart) > s.maxRunDuration)
+	return r, live
+}
+
+func (s *Status) healthz(w http.ResponseWriter, req *http.Request) {
+	r, live := s.baseReport()
+	writeReport(w, r, live)
+}
+
+func (s *Status) readyz(w http.ResponseWriter, req *http.Request) {
+	r, ok := s.baseReport()
+	if r.LastRunError != "" {
+		ok = false
+	}
+
+	s.mu.Lock()
+	names := make([]string, 0, len(s.checks))
+	for name := range s.checks {
+		names = append(names, name)
+	}
+	checks := make(map[string]Check, len(s.checks))
+	for name, c := range s.checks {
+		checks[name] = c
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+
+	s.checkMu.Lock()
+	defer s.checkMu.Unlock()
+	r.Checks = map[string]string{}
+	for _, name := range names {
+		if err := checks[name](req.Context()); err != nil {
+			r.Checks[name] = err.Error()
+			ok = false
+		} else {
+			r.Checks[name] = "ok"
+		}
+	}
+	writeReport(w, r, ok)
+}
+
+func writeReport(w http.ResponseWriter, r report, ok bool) {
+	code := http.StatusOK
+	r.Status = "ok"
+	if !ok {
+		code = http.StatusServiceUnavailable
+		r.Status = "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(r)
+}
+
+// Register adds the /healthz and /readyz handlers to the given mux.
+func (s *Status) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+}
+
+// Handler returns a http.Handler serving only /healthz and /readyz.
+func (s *Status) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.Register(mux)
+	return mux
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, h http.Handler, path string) (int, report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var r report
+	if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+		t.Fatalf("%s returned invalid JSON %q: %v", path, rec.Body.String(), err)
+	}
+	return rec.Code, r
+}
+
+func TestHealthz(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	s := New(time.Hour)
+	h := s.Handler()
+
+	if code, _ := get(t, h, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz before any run returned %d, want %d", code, http.StatusOK)
+	}
+
+	s.RunStarted()
+	now = now.Add(30 * time.Minute)
+	if code, r := get(t, h, "/healthz"); code != http.StatusOK || !r.Running {
+		t.Errorf("/healthz during run returned %d (running %v), want %d (running true)", code, r.Running, http.StatusOK)
+	}
+
+	now = now.Add(time.Hour)
+	if code, _ := get(t, h, "/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz for a run exceeding the max duration returned %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	s.RunFinished(nil)
+	if code, r := get(t, h, "/healthz"); code != http.StatusOK || r.LastRunEnd == "" {
+		t.Errorf("/healthz after run returned %d (lastRunEnd %q), want %d with lastRunEnd set", code, r.LastRunEnd, http.StatusOK)
+	}
+
+	next := now.Add(6 * time.Hour)
+	s.SetNextRun(next)
+	if _, r := get(t, h, "/healthz"); r.NextRun != next.Format(time.RFC3339) {
+		t.Errorf("/healthz after SetNextRun(%v) returned nextRun %q, want %q", next, r.NextRun, next.Format(time.RFC3339))
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	s := New(0)
+	h := s.Handler()
+
+	var credErr error
+	s.AddReadinessCheck("credentials", func(ctx context.Context) error { return credErr })
+
+	if code, r := get(t, h, "/readyz"); code != http.StatusOK || r.Checks["credentials"] != "ok" {
+		t.Errorf("/readyz returned %d (checks %v), want %d with passing checks", code, r.Checks, http.StatusOK)
+	}
+
+	credErr = errors.New("bad credentials")
+	if code, r := get(t, h, "/readyz"); code != http.StatusServiceUnavailable || r.Checks["credentials"] != "bad credentials" {
+		t.Errorf("/readyz with failing check returned %d (checks %v), want %d", code, r.Checks, http.StatusServiceUnavailable)
+	}
+
+	credErr = nil
+	s.RunStarted()
+	s.RunFinished(errors.New("run failed"))
+	if code, r := get(t, h, "/readyz"); code != http.StatusServiceUnavailable || r.LastRunError != "run failed" {
+		t.Errorf("/readyz after failed run returned %d (lastRunError %q), want %d", code, r.LastRunError, http.StatusServiceUnavailable)
+	}
+}
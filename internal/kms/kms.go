@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kms encrypts and decrypts small payloads, such as data encryption
+// keys, with a symmetric GCP Cloud KMS key.
+package kms
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	cloudkms "google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// DefaultKMSEndpoint is the default Cloud KMS API endpoint. This should be
+// passed to NewClient, unless in a test environment.
+const DefaultKMSEndpoint = "https://cloudkms.googleapis.com/"
+
+const kmsHost = "cloudkms.googleapis.com"
+
+// ErrChecksumMismatch indicates that a payload sent to or returned by Cloud KMS
+// was corrupted in transit.
+var ErrChecksumMismatch = errors.New("KMS payload does not match its checksum")
+
+var keyNameRegex = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// IsKeyName returns whether value is a Cloud KMS CryptoKey resource name, for
+// example "projects/p/locations/global/keyRings/r/cryptoKeys/k".
+func IsKeyName(value string) bool {
+	return keyNameRegex.MatchString(value)
+}
+
+// Client encrypts and decrypts with a single Cloud KMS CryptoKey. It implements
+// processing.KeyEncrypter and processing.KeyDecrypter.
+type Client struct {
+	service *cloudkms.Service
+	keyName string
+}
+
+// NewClient initializes and returns a new Cloud KMS client for the CryptoKey
+// with the given resource name, at the given endpoint.
+func NewClient(ctx context.Context, endpoint, keyName string) (*Client, error) {
+	if !IsKeyName(keyName) {
+		return nil, fmt.Errorf("invalid KMS key name %q, must be of the form projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>", keyName)
+	}
+	var service *cloudkms.Service
+	var err error
+	if u, perr := url.Parse(endpoint); perr == nil && u.Scheme == "https" && u.Hostname() == kmsHost {
+		service, err = cloudkms.NewService(ctx, option.WithEndpoint(endpoint))
+	} else {
+		// As in fhirstore.NewClient, non-Google endpoints are generally test
+		// servers, so no credentials are looked up.
+		service, err = cloudkms.NewService(ctx, option.WithHTTPClient(&http.Client{}), option.WithEndpoint(endpoint))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Client{service: service, keyName: keyName}, nil
+}
+
+// Encrypt encrypts plaintext with the primary version of the key.
+func (c *Client) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	req := &cloudkms.EncryptRequest{
+		Plaintext:       base64.StdEncoding.EncodeToString(plaintext),
+		PlaintextCrc32c: checksum(plaintext),
+	}
+	resp, err := c.service.Projects.Locations.KeyRings.CryptoKeys.Encrypt(c.keyName, req).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting with KMS key %s: %w", c.keyName, err)
+	}
+	if !resp.VerifiedPlaintextCrc32c {
+		return nil, fmt.Errorf("encrypting with KMS key %s: %w", c.keyName, ErrChecksumMismatch)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding ciphertext from KMS key %s: %w", c.keyName, err)
+	}
+	if resp.CiphertextCrc32c != 0 && checksum(ciphertext) != resp.CiphertextCrc32c {
+		return nil, fmt.Errorf("encrypting with KMS key %s: %w", c.keyName, ErrChecksumMismatch)
+	}
+	return ciphertext, nil
+}
+
+// Decrypt decrypts ciphertext returned by Encrypt, with whichever version of
+// the key encrypted it.
+func (c *Client) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	req := &cloudkms.DecryptRequest{
+		Ciphertext:       base64.StdEncoding.EncodeToString(ciphertext),
+		CiphertextCrc32c: checksum(ciphertext),
+	}
+	resp, err := c.service.Projects.Locations.KeyRings.CryptoKeys.Decrypt(c.keyName, req).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting with KMS key %s: %w", c.keyName, err)
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding plaintext from KMS key %s: %w", c.keyName, err)
+	}
+	if resp.PlaintextCrc32c != 0 && checksum(plaintext) != resp.PlaintextCrc32c {
+		return nil, fmt.Errorf("decrypting with KMS key %s: %w", c.keyName, ErrChecksumMismatch)
+	}
+	return plaintext, nil
+}
+
+func checksum(data []byte) int64 {
+	return int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/internal/kms"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+const keyName = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+func TestIsKeyName(t *testing.T) {
+	cases := []struct {
+		value string
+		want  bool
+	}{
+		{keyName, true},
+		{"projects/p/locations/us-east1/keyRings/ring/cryptoKeys/field-key", true},
+		{keyName + "/cryptoKeyVersions/1", false},
+		{"projects/p/secrets/s/versions/latest", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		if got := kms.IsKeyName(tc.value); got != tc.want {
+			t.Errorf("IsKeyName(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	server := testhelpers.NewKMSServer(t, keyName)
+	ctx := context.Background()
+	c, err := kms.NewClient(ctx, server.URL(), keyName)
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	plaintext := []byte("data key")
+	ciphertext, err := c.Encrypt(ctx, plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt() returned unexpected error: %v", err)
+	}
+	if string(ciphertext) == string(plaintext) {
+		t.Errorf("Encrypt() returned the plaintext")
+	}
+	got, err := c.Decrypt(ctx, ciphertext)
+	if err != nil {
+		t.Fatalf("Decrypt() returned unexpected error: %v", err)
+	}
+	if string(got) != string(plaintext) {
+		t.Errorf("Decrypt(Encrypt(%q)) = %q", plaintext, got)
+	}
+}
+
+func TestEncrypt_ChecksumMismatch(t *testing.T) {
+	cases := []struct {
+		name     string
+		response string
+	}{
+		{name: "PlaintextNotVerified", response: `{"ciphertext": "Y2lwaGVy"}`},
+		{name: "CiphertextCorrupted", response: `{"ciphertext": "Y2lwaGVy", "ciphertextCrc32c": "1", "verifiedPlaintextCrc32c": true}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tc.response)
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			c, err := kms.NewClient(ctx, server.URL, keyName)
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			if _, err := c.Encrypt(ctx, []byte("data key")); !errors.Is(err, kms.ErrChecksumMismatch) {
+				t.Errorf("Encrypt() returned error %v, want %v", err, kms.ErrChecksumMismatch)
+			}
+		})
+	}
+}
+
+func TestNewClient_InvalidKeyName(t *testing.T) {
+	if _, err := kms.NewClient(context.Background(), kms.DefaultKMSEndpoint, "projects/p/keys/k"); err == nil {
+		t.Error("NewClient() with an invalid key name returned nil error, want an error")
+	}
+}
@@ -21,6 +21,7 @@ package logger
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"sync"
@@ -38,6 +39,13 @@ var nErrs int
 
 const logID = "bulk-fhir-fetch"
 
+// teeLoggers receive a copy of each log line, in addition to the configured
+// loggers. See AddWriter.
+var (
+	teeMu      sync.Mutex
+	teeLoggers []*log.Logger
+)
+
 type logger struct {
 	infoLogger    *log.Logger
 	warningLogger *log.Logger
@@ -98,44 +106,86 @@ func InitGCPWithClient(ctx context.Context, c *gcpLog.Client) {
 
 // Info logs with severity Info.
 func Info(v ...any) {
+	tee("INFO", func() string { return fmt.Sprint(v...) })
 	globalLogger.infoLogger.Print(v...)
 }
 
 // Infof formats the string and logs with severity Info.
 func Infof(format string, v ...any) {
+	tee("INFO", func() string { return fmt.Sprintf(format, v...) })
 	globalLogger.infoLogger.Printf(format, v...)
 }
 
 // Warning logs with severity Warning.
 func Warning(v ...any) {
+	tee("WARNING", func() string { return fmt.Sprint(v...) })
 	globalLogger.warningLogger.Print(v...)
 }
 
 // Warningf formats the string and logs with severity Warning.
 func Warningf(format string, v ...any) {
+	tee("WARNING", func() string { return fmt.Sprintf(format, v...) })
 	globalLogger.warningLogger.Printf(format, v...)
 }
 
 // Error logs with severity Error.
 func Error(v ...any) {
+	tee("ERROR", func() string { return fmt.Sprint(v...) })
 	globalLogger.errorLogger.Print(v...)
 }
 
 // Errorf formats the string and logs with severity Error.
 func Errorf(format string, v ...any) {
+	tee("ERROR", func() string { return fmt.Sprintf(format, v...) })
 	globalLogger.errorLogger.Printf(format, v...)
 }
 
 // Fatal is equivalent to logging to Error() followed by a call to os.Exit(1).
 func Fatal(v ...any) {
+	tee("ERROR", func() string { return fmt.Sprint(v...) })
 	globalLogger.errorLogger.Fatal(v...)
 }
 
 // Fatalf is equivalent to logging to Errorf() followed by a call to os.Exit(1).
 func Fatalf(format string, v ...any) {
+	tee("ERROR", func() string { return fmt.Sprintf(format, v...) })
 	globalLogger.errorLogger.Fatalf(format, v...)
 }
 
+// AddWriter also writes each subsequent log line to w, prefixed with its time
+// and severity, until the returned function is called. It is intended for
+// capturing the logs of a single operation.
+func AddWriter(w io.Writer) (remove func()) {
+	l := log.New(w, "", log.Ldate|log.Ltime)
+	teeMu.Lock()
+	defer teeMu.Unlock()
+	teeLoggers = append(teeLoggers, l)
+	return func() {
+		teeMu.Lock()
+		defer teeMu.Unlock()
+		for i, tl := range teeLoggers {
+			if tl == l {
+				teeLoggers = append(teeLoggers[:i:i], teeLoggers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// tee writes the message returned by msg to the loggers added by AddWriter.
+// msg is only called if there are any.
+func tee(severity string, msg func() string) {
+	teeMu.Lock()
+	defer teeMu.Unlock()
+	if len(teeLoggers) == 0 {
+		return
+	}
+	m := severity + ": " + msg()
+	for _, l := range teeLoggers {
+		l.Print(m)
+	}
+}
+
 // Close should be called before the program exits to flush any buffered log
 // entries to the GCP Logging service.
 func Close() error {
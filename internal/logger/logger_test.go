@@ -15,7 +15,9 @@
 package logger_test
 
 import (
+	"bytes"
 	"context"
+	"regexp"
 	"testing"
 
 	gcpLog "cloud.google.com/go/logging"
@@ -91,3 +93,23 @@ func TestGCPLogger(t *testing.T) {
 		t.Errorf("getNErrs() = %v, want %v", got, want)
 	}
 }
+
+func TestAddWriter(t *testing.T) {
+	logger.Info("Before adding the writer.")
+
+	var buf bytes.Buffer
+	remove := logger.AddWriter(&buf)
+	logger.Info("No worries.")
+	logger.Warningf("Number of times warned: %d", 2)
+	logger.Error("Yikes", " an error!")
+	remove()
+	logger.Info("After removing the writer.")
+
+	want := regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d INFO: No worries.
+\d{4}/\d\d/\d\d \d\d:\d\d:\d\d WARNING: Number of times warned: 2
+\d{4}/\d\d/\d\d \d\d:\d\d:\d\d ERROR: Yikes an error!
+$`)
+	if got := buf.String(); !want.MatchString(got) {
+		t.Errorf("AddWriter() captured unexpected logs %q, want match for %q", got, want)
+	}
+}
@@ -15,15 +15,17 @@
 // Package aggregation holds an enum of different aggregation types for Counters.
 package aggregation
 
+import "github.com/google/bulk_fhir_tools/metrics"
+
 // Aggregation is an enum of the different aggregation types for counter metrics.
-type Aggregation int
+type Aggregation = metrics.Aggregation
 
 const (
 	// Count keeps a count the number of times something occurs.
-	Count Aggregation = iota
+	Count = metrics.Count
 	// LastValueInGCPMaxValueInLocal when used by OpenCensus implementation uses the
 	// view.LastValue aggregation, sending the last recorded value whenever the
 	// metric is exported to GCP. Local implementation will return the max value
 	// recorded by the metric.
-	LastValueInGCPMaxValueInLocal Aggregation = iota
+	LastValueInGCPMaxValueInLocal = metrics.LastValue
 )
@@ -82,6 +82,8 @@ func (c *Counter) initialize() error {
 			c.counterImp = &opencensus.Counter{}
 		} else if implementation == fakeImp {
 			c.counterImp = &fake.Counter{}
+		} else if implementation == recorderImp {
+			c.counterImp = &recorderCounter{recorder: recorder}
 		} else {
 			err = errors.New("in metrics.NewCounter, implementation is set to an unknown value, this should never happen")
 		}
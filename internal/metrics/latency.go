@@ -83,6 +83,8 @@ func (l *Latency) initialize() error {
 			l.latencyImp = &opencensus.Latency{}
 		} else if implementation == fakeImp {
 			l.latencyImp = &fake.Latency{}
+		} else if implementation == recorderImp {
+			l.latencyImp = &recorderLatency{recorder: recorder}
 		} else {
 
 			err = errors.New("in metrics.NewCounter, implementation is set to an unknown value, this should never happen")
@@ -28,6 +28,7 @@ import (
 	"contrib.go.opencensus.io/exporter/stackdriver"
 	log "github.com/google/bulk_fhir_tools/internal/logger"
 	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	extmetrics "github.com/google/bulk_fhir_tools/metrics"
 )
 
 // implementation should be set by Init and is used to decide which Close to
@@ -36,9 +37,10 @@ import (
 var implementation = localImp
 
 const (
-	localImp = iota
-	gcpImp   = iota
-	fakeImp  = iota
+	localImp    = iota
+	gcpImp      = iota
+	fakeImp     = iota
+	recorderImp = iota
 )
 
 // globalMu synchronizes the reading and writing to counterRegistry, latencyRegistry and globalRecordCalled globals.
@@ -49,11 +51,14 @@ var latencyRegistry map[string]*Latency = make(map[string]*Latency)
 
 // globalRecordCalled tracks whether we have called Record() on any created metric before calling Init.
 var globalRecordCalled = false
-var errInitAfterRecord = errors.New("initAndExportGCP was called after a metric called record")
+var errInitAfterRecord = errors.New("initAndExportGCP or InitRecorder was called after a metric called record")
 var errUnknownImplementation = errors.New("implementation is set to an unknown value, this should never happen")
 
 var sd *stackdriver.Exporter
 
+// recorder is the Recorder set by InitRecorder.
+var recorder extmetrics.Recorder
+
 // InitLocal is optional and does nothing, but does make it clearer to the code
 // reader that we are using the local implementation of metrics. The local
 // implementation is used by default and logs all metrics upon call to CloseAll.
@@ -84,6 +89,21 @@ func InitAndExportGCP(projectID string) error {
 	return sd.StartMetricsExporter()
 }
 
+// InitRecorder sends all metrics to r, which creates each metric when it is
+// first recorded. As with InitAndExportGCP, no callers should call Record() on
+// any metric until InitRecorder is called. Closing r, if needed, is up to the
+// caller.
+func InitRecorder(r extmetrics.Recorder) error {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	if globalRecordCalled {
+		return errInitAfterRecord
+	}
+	implementation = recorderImp
+	recorder = r
+	return nil
+}
+
 // InitNoOp initializes all metrics to have no-op behavior on all calls. Since
 // many metrics may be globals or package-specific globals, this makes it easier
 // to run t.Parallel tests where metric results are not checked or
@@ -148,7 +168,7 @@ func CloseAll() error {
 		}
 	case gcpImp:
 		closeGCP()
-	case fakeImp:
+	case fakeImp, recorderImp:
 		// No op.
 	default:
 		return errUnknownImplementation
@@ -0,0 +1,76 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	extmetrics "github.com/google/bulk_fhir_tools/metrics"
+)
+
+// recorderCounter implements the counterInterface with a Counter of the
+// Recorder set by InitRecorder.
+type recorderCounter struct {
+	recorder extmetrics.Recorder
+	counter  extmetrics.Counter
+	// initErr is the error creating counter, which is returned by Record, as
+	// errors from Init are not surfaced.
+	initErr error
+}
+
+func (c *recorderCounter) Init(name, description, unit string, aggregation aggregation.Aggregation, tagKeys ...string) error {
+	c.counter, c.initErr = c.recorder.NewCounter(name, description, unit, aggregation, tagKeys...)
+	return c.initErr
+}
+
+func (c *recorderCounter) Record(ctx context.Context, val int64, tagValues ...string) error {
+	if c.initErr != nil {
+		return c.initErr
+	}
+	return c.counter.Record(ctx, val, tagValues...)
+}
+
+// MaybeGetResult is not supported for Recorders.
+func (c *recorderCounter) MaybeGetResult() map[string]int64 { return nil }
+
+// Close is a no-op, as the Recorder is closed by its owner.
+func (c *recorderCounter) Close() {}
+
+// recorderLatency implements the latencyInterface with a Latency of the
+// Recorder set by InitRecorder.
+type recorderLatency struct {
+	recorder extmetrics.Recorder
+	latency  extmetrics.Latency
+	initErr  error
+}
+
+func (l *recorderLatency) Init(name, description, unit string, buckets []float64, tagKeys ...string) error {
+	l.latency, l.initErr = l.recorder.NewLatency(name, description, unit, buckets, tagKeys...)
+	return l.initErr
+}
+
+func (l *recorderLatency) Record(ctx context.Context, val float64, tagValues ...string) error {
+	if l.initErr != nil {
+		return l.initErr
+	}
+	return l.latency.Record(ctx, val, tagValues...)
+}
+
+// MaybeGetResult is not supported for Recorders.
+func (l *recorderLatency) MaybeGetResult() map[string][]int { return nil }
+
+// Close is a no-op, as the Recorder is closed by its owner.
+func (l *recorderLatency) Close() {}
@@ -0,0 +1,103 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	extmetrics "github.com/google/bulk_fhir_tools/metrics"
+)
+
+// fakeRecorder records the values of each metric in memory.
+type fakeRecorder struct {
+	counts    map[string]int64
+	latencies map[string][]float64
+}
+
+type fakeCounter struct {
+	r    *fakeRecorder
+	name string
+}
+
+func (c fakeCounter) Record(_ context.Context, val int64, tagValues ...string) error {
+	c.r.counts[c.name] += val
+	return nil
+}
+
+type fakeLatency struct {
+	r    *fakeRecorder
+	name string
+}
+
+func (l fakeLatency) Record(_ context.Context, val float64, tagValues ...string) error {
+	l.r.latencies[l.name] = append(l.r.latencies[l.name], val)
+	return nil
+}
+
+func (r *fakeRecorder) NewCounter(name, description, unit string, aggregation extmetrics.Aggregation, tagKeys ...string) (extmetrics.Counter, error) {
+	if name == "BadCounter" {
+		return nil, errors.New("bad counter")
+	}
+	return fakeCounter{r: r, name: name}, nil
+}
+
+func (r *fakeRecorder) NewLatency(name, description, unit string, buckets []float64, tagKeys ...string) (extmetrics.Latency, error) {
+	return fakeLatency{r: r, name: name}, nil
+}
+
+func TestInitRecorder(t *testing.T) {
+	ResetAll()
+	t.Cleanup(func() {
+		implementation = localImp
+		recorder = nil
+		// Remove the metrics so that they do not show up in the results of tests
+		// of the local implementation.
+		delete(counterRegistry, "RecorderCounter")
+		delete(counterRegistry, "BadCounter")
+		delete(latencyRegistry, "RecorderLatency")
+		ResetAll()
+	})
+	r := &fakeRecorder{counts: map[string]int64{}, latencies: map[string][]float64{}}
+	c := NewCounter("RecorderCounter", "Counter Description", "1", aggregation.Count, "FHIRResource")
+	l := NewLatency("RecorderLatency", "Latency Description", "ms", []float64{0, 3, 5})
+	bad := NewCounter("BadCounter", "Counter Description", "1", aggregation.Count)
+	if err := InitRecorder(r); err != nil {
+		t.Fatalf("InitRecorder() returned unexpected error: %v", err)
+	}
+
+	c.Record(context.Background(), 1, "OBSERVATION")
+	c.Record(context.Background(), 3, "ENCOUNTER")
+	l.Record(context.Background(), 2.5)
+	if err := bad.Record(context.Background(), 1); err == nil {
+		t.Error("Record() of a counter the Recorder failed to create succeeded, want error")
+	}
+	if err := CloseAll(); err != nil {
+		t.Errorf("CloseAll() returned unexpected error: %v", err)
+	}
+
+	if diff := cmp.Diff(map[string]int64{"RecorderCounter": 4}, r.counts); diff != "" {
+		t.Errorf("Recorder got unexpected counts (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string][]float64{"RecorderLatency": {2.5}}, r.latencies); diff != "" {
+		t.Errorf("Recorder got unexpected latencies (-want +got):\n%s", diff)
+	}
+	if err := InitRecorder(r); !errors.Is(err, errInitAfterRecord) {
+		t.Errorf("InitRecorder() after Record returned error %v, want %v", err, errInitAfterRecord)
+	}
+}
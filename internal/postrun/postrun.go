@@ -0,0 +1,253 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package postrun parses and executes the actions, such as calling a webhook
+// or running a BigQuery load job, which bulk_fhir_fetch takes after each
+// successful fetch, so that simple downstream automation does not need an
+// external orchestrator.
+package postrun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/bigquery"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// Action is a single post-run action. Exactly one of HTTP and BigQueryLoad
+// must be set.
+type Action struct {
+	// Name identifies the action in logs and in the After list of other
+	// actions.
+	Name string `json:"name"`
+	// After lists the names of the actions which must succeed before this one
+	// is run. If any of them fails, this action is skipped.
+	After []string `json:"after,omitempty"`
+
+	HTTP         *HTTPAction         `json:"http,omitempty"`
+	BigQueryLoad *BigQueryLoadAction `json:"bigqueryLoad,omitempty"`
+}
+
+// HTTPAction sends an HTTP request, such as calling a webhook or starting a dbt
+// Cloud job, and succeeds if the response has a 2xx status.
+type HTTPAction struct {
+	// Method defaults to POST.
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// BigQueryLoadAction runs a BigQuery load job appending newline delimited JSON
+// files in GCS to a table, and waits for it to finish.
+type BigQueryLoadAction struct {
+	Project    string   `json:"project"`
+	Dataset    string   `json:"dataset"`
+	Table      string   `json:"table"`
+	SourceURIs []string `json:"sourceUris"`
+}
+
+// Run describes the fetch which succeeded. Its fields are substituted for the
+// variables ${RUN_ID} and ${TRANSACTION_TIME} in the URL, headers and body of
+// HTTP actions and in the source URIs of BigQuery load actions.
+type Run struct {
+	RunID           string
+	TransactionTime string
+}
+
+// Env holds the clients and endpoints used to execute actions.
+type Env struct {
+	HTTPClient       *http.Client
+	BigQueryEndpoint string
+}
+
+// Plan is a validated set of actions, ordered so that each action comes after
+// the actions it depends on.
+type Plan struct {
+	actions []Action
+}
+
+// Parse parses a JSON file of the form {"actions": [...]} and validates the
+// actions. Action names must be unique, and the After lists must name other
+// actions without forming a cycle.
+func Parse(data []byte) (*Plan, error) {
+	var file struct {
+		Actions []Action `json:"actions"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid post-run actions: %w", err)
+	}
+	byName := map[string]Action{}
+	for _, a := range file.Actions {
+		if err := validateAction(a); err != nil {
+			return nil, err
+		}
+		if _, ok := byName[a.Name]; ok {
+			return nil, fmt.Errorf("post-run action %q is defined more than once", a.Name)
+		}
+		byName[a.Name] = a
+	}
+	for _, a := range file.Actions {
+		for _, dep := range a.After {
+			if _, ok := byName[dep]; !ok {
+				return nil, fmt.Errorf("post-run action %q runs after unknown action %q", a.Name, dep)
+			}
+		}
+	}
+
+	// Order the actions so that each comes after its dependencies, otherwise
+	// keeping the order of the file.
+	p := &Plan{}
+	done := map[string]bool{}
+	for len(p.actions) < len(file.Actions) {
+		progressed := false
+		for _, a := range file.Actions {
+			if done[a.Name] || !allDone(a.After, done) {
+				continue
+			}
+			p.actions = append(p.actions, a)
+			done[a.Name] = true
+			progressed = true
+		}
+		if !progressed {
+			return nil, errors.New("post-run actions have a cycle in their after lists")
+		}
+	}
+	return p, nil
+}
+
+func validateAction(a Action) error {
+	if a.Name == "" {
+		return errors.New("post-run action is missing a name")
+	}
+	if (a.HTTP == nil) == (a.BigQueryLoad == nil) {
+		return fmt.Errorf("post-run action %q must set exactly one of http or bigqueryLoad", a.Name)
+	}
+	if a.HTTP != nil {
+		u, err := url.Parse(a.HTTP.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("post-run action %q must have an http or https url", a.Name)
+		}
+	}
+	if b := a.BigQueryLoad; b != nil {
+		if b.Project == "" || b.Dataset == "" || b.Table == "" || len(b.SourceURIs) == 0 {
+			return fmt.Errorf("post-run action %q must set the project, dataset, table and sourceUris of bigqueryLoad", a.Name)
+		}
+		for _, uri := range b.SourceURIs {
+			if !strings.HasPrefix(uri, "gs://") {
+				return fmt.Errorf("post-run action %q has source URI %q which is not in GCS", a.Name, uri)
+			}
+		}
+	}
+	return nil
+}
+
+func allDone(names []string, done map[string]bool) bool {
+	for _, n := range names {
+		if !done[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// Names returns the names of the actions in the order they are executed.
+func (p *Plan) Names() []string {
+	var names []string
+	for _, a := range p.actions {
+		names = append(names, a.Name)
+	}
+	return names
+}
+
+// Execute runs each action in turn. An action whose dependencies did not all
+// succeed is skipped, but the other actions are still run. The returned error
+// joins the errors of all actions which failed or were skipped.
+func (p *Plan) Execute(ctx context.Context, env Env, run Run) error {
+	vars := strings.NewReplacer("${RUN_ID}", run.RunID, "${TRANSACTION_TIME}", run.TransactionTime)
+	succeeded := map[string]bool{}
+	var errs []error
+	for _, a := range p.actions {
+		if !allDone(a.After, succeeded) {
+			log.Warningf("Skipping post-run action %s, as an action it runs after did not succeed.", a.Name)
+			errs = append(errs, fmt.Errorf("post-run action %s skipped", a.Name))
+			continue
+		}
+		log.Infof("Running post-run action %s.", a.Name)
+		var err error
+		if a.HTTP != nil {
+			err = executeHTTP(ctx, env.HTTPClient, a.HTTP, vars)
+		} else {
+			err = executeBigQueryLoad(ctx, env.BigQueryEndpoint, a.BigQueryLoad, vars)
+		}
+		if err != nil {
+			log.Errorf("Post-run action %s failed: %v", a.Name, err)
+			errs = append(errs, fmt.Errorf("post-run action %s failed: %w", a.Name, err))
+			continue
+		}
+		succeeded[a.Name] = true
+	}
+	return errors.Join(errs...)
+}
+
+func executeHTTP(ctx context.Context, client *http.Client, a *HTTPAction, vars *strings.Replacer) error {
+	method := a.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, vars.Replace(a.URL), strings.NewReader(vars.Replace(a.Body)))
+	if err != nil {
+		return err
+	}
+	for k, v := range a.Headers {
+		req.Header.Set(k, vars.Replace(v))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL may hold a token, so only the underlying error is returned.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("request returned status %s", resp.Status)
+	}
+	return nil
+}
+
+func executeBigQueryLoad(ctx context.Context, endpoint string, a *BigQueryLoadAction, vars *strings.Replacer) error {
+	c, err := bigquery.NewClient(ctx, &bigquery.Config{Endpoint: endpoint, ProjectID: a.Project, DatasetID: a.Dataset})
+	if err != nil {
+		return err
+	}
+	var uris []string
+	for _, uri := range a.SourceURIs {
+		uris = append(uris, vars.Replace(uri))
+	}
+	return c.LoadJSON(ctx, a.Table, uris)
+}
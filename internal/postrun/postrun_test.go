@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postrun_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/internal/postrun"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+func TestParse_Order(t *testing.T) {
+	p, err := postrun.Parse([]byte(`{"actions": [
+		{"name": "dbt", "after": ["load"], "http": {"url": "https://dbt.example.com/run"}},
+		{"name": "load", "bigqueryLoad": {"project": "p", "dataset": "d", "table": "t", "sourceUris": ["gs://b/*.ndjson"]}},
+		{"name": "notify", "http": {"url": "https://hooks.example.com/x"}}
+	]}`))
+	if err != nil {
+		t.Fatalf("Parse() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(p.Names(), []string{"load", "notify", "dbt"}); diff != "" {
+		t.Errorf("Parse() returned actions in unexpected order (-got +want): %s", diff)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	cases := []struct {
+		name string
+		json string
+	}{
+		{"not json", `actions`},
+		{"unknown field", `{"actions": [{"name": "a", "http": {"url": "https://x"}, "retries": 3}]}`},
+		{"missing name", `{"actions": [{"http": {"url": "https://x"}}]}`},
+		{"no kind", `{"actions": [{"name": "a"}]}`},
+		{"two kinds", `{"actions": [{"name": "a", "http": {"url": "https://x"}, "bigqueryLoad": {"project": "p", "dataset": "d", "table": "t", "sourceUris": ["gs://b/f"]}}]}`},
+		{"bad url", `{"actions": [{"name": "a", "http": {"url": "ftp://x"}}]}`},
+		{"incomplete load", `{"actions": [{"name": "a", "bigqueryLoad": {"project": "p", "table": "t", "sourceUris": ["gs://b/f"]}}]}`},
+		{"local source", `{"actions": [{"name": "a", "bigqueryLoad": {"project": "p", "dataset": "d", "table": "t", "sourceUris": ["/tmp/f"]}}]}`},
+		{"duplicate name", `{"actions": [{"name": "a", "http": {"url": "https://x"}}, {"name": "a", "http": {"url": "https://y"}}]}`},
+		{"unknown dependency", `{"actions": [{"name": "a", "after": ["b"], "http": {"url": "https://x"}}]}`},
+		{"cycle", `{"actions": [{"name": "a", "after": ["b"], "http": {"url": "https://x"}}, {"name": "b", "after": ["a"], "http": {"url": "https://y"}}]}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := postrun.Parse([]byte(tc.json)); err == nil {
+				t.Errorf("Parse(%s) succeeded, want error", tc.json)
+			}
+		})
+	}
+}
+
+func TestExecute(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		requests = append(requests, fmt.Sprintf("%s %s %s %s", req.Method, req.URL.Path, req.Header.Get("Authorization"), body))
+		mu.Unlock()
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	bqServer := testhelpers.NewBigQueryServer(t, "project", "dataset")
+
+	p, err := postrun.Parse([]byte(fmt.Sprintf(`{"actions": [
+		{"name": "load", "bigqueryLoad": {"project": "project", "dataset": "dataset", "table": "patients", "sourceUris": ["gs://bucket/${RUN_ID}/Patient_*.ndjson"]}},
+		{"name": "dbt", "after": ["load"], "http": {"url": "%[1]s/dbt", "headers": {"Authorization": "Token secret"}, "body": "{\"cause\": \"${TRANSACTION_TIME}\"}"}},
+		{"name": "broken", "http": {"method": "PUT", "url": "%[1]s/fail"}},
+		{"name": "after-broken", "after": ["broken"], "http": {"url": "%[1]s/never"}},
+		{"name": "notify", "after": ["dbt"], "http": {"method": "GET", "url": "%[1]s/notify"}}
+	]}`, server.URL)))
+	if err != nil {
+		t.Fatalf("Parse() returned unexpected error: %v", err)
+	}
+
+	env := postrun.Env{HTTPClient: server.Client(), BigQueryEndpoint: bqServer.URL()}
+	run := postrun.Run{RunID: "run1", TransactionTime: "2024-01-01T00:00:00Z"}
+	err = p.Execute(context.Background(), env, run)
+	if err == nil {
+		t.Fatal("Execute() succeeded, want error for the failed action")
+	}
+	for _, name := range []string{"broken failed", "after-broken skipped"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Execute() returned error %v, want it to mention %q", err, name)
+		}
+	}
+	if strings.Contains(err.Error(), "dbt") || strings.Contains(err.Error(), "notify") {
+		t.Errorf("Execute() returned error %v for actions which succeeded", err)
+	}
+
+	wantRequests := []string{
+		`POST /dbt Token secret {"cause": "2024-01-01T00:00:00Z"}`,
+		"PUT /fail  ",
+		"GET /notify  ",
+	}
+	if diff := cmp.Diff(requests, wantRequests); diff != "" {
+		t.Errorf("Execute() sent unexpected requests (-got +want): %s", diff)
+	}
+	wantLoads := []testhelpers.LoadJob{{Table: "patients", SourceURIs: []string{"gs://bucket/run1/Patient_*.ndjson"}}}
+	if diff := cmp.Diff(bqServer.LoadJobs(), wantLoads); diff != "" {
+		t.Errorf("Execute() ran unexpected load jobs (-got +want): %s", diff)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redact removes sensitive values, such as secrets or site-specific
+// internal URLs, from text before it is logged or sent elsewhere.
+package redact
+
+import (
+	"sort"
+	"strings"
+)
+
+// Placeholder replaces redacted values.
+const Placeholder = "[REDACTED]"
+
+// minValueLength is the length below which values are not redacted from free
+// text, as doing so would mangle unrelated text (e.g. a value of "1" or
+// "true").
+const minValueLength = 4
+
+// Redactor replaces sensitive values in text with Placeholder. A nil Redactor
+// redacts nothing.
+type Redactor struct {
+	values []string
+}
+
+// New returns a Redactor for the given values. Empty values, and values
+// shorter than four characters, are ignored.
+func New(values ...string) *Redactor {
+	r := &Redactor{}
+	for _, v := range values {
+		if len(v) >= minValueLength {
+			r.values = append(r.values, v)
+		}
+	}
+	// Replace longer values first, so that a value containing another is
+	// redacted in full.
+	sort.Slice(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+	return r
+}
+
+// String returns s with all sensitive values replaced.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, Placeholder)
+	}
+	return s
+}
+
+// Error returns an error whose message has all sensitive values replaced, and
+// which wraps err so that errors.Is and errors.As still work. If the message
+// contains no sensitive values, err is returned as is.
+func (r *Redactor) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	redacted := r.String(msg)
+	if redacted == msg {
+		return err
+	}
+	return &redactedError{msg: redacted, err: err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+
+func (e *redactedError) Unwrap() error { return e.err }
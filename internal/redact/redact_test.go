@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/internal/redact"
+)
+
+func TestString(t *testing.T) {
+	r := redact.New("secret", "https://internal.example.com", "https://internal.example.com/fhir", "", "1")
+	cases := []struct {
+		in, want string
+	}{
+		{"no sensitive values", "no sensitive values"},
+		{"client secret is secret", "client [REDACTED] is [REDACTED]"},
+		{"GET https://internal.example.com/fhir/Patient", "GET [REDACTED]/Patient"},
+		{"GET https://internal.example.com/other", "GET [REDACTED]/other"},
+		{"short values like 1 are kept", "short values like 1 are kept"},
+	}
+	for _, tc := range cases {
+		if got := r.String(tc.in); got != tc.want {
+			t.Errorf("String(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestString_NilRedactor(t *testing.T) {
+	var r *redact.Redactor
+	if got := r.String("secret"); got != "secret" {
+		t.Errorf("String(%q) = %q, want it unchanged", "secret", got)
+	}
+}
+
+func TestError(t *testing.T) {
+	sentinel := errors.New("sentinel")
+	r := redact.New("secret")
+
+	err := r.Error(fmt.Errorf("failed with secret: %w", sentinel))
+	if got, want := err.Error(), "failed with [REDACTED]: sentinel"; got != want {
+		t.Errorf("Error() message = %q, want %q", got, want)
+	}
+	if !errors.Is(err, sentinel) {
+		t.Errorf("Error() = %v, want it to wrap %v", err, sentinel)
+	}
+
+	unchanged := fmt.Errorf("failed: %w", sentinel)
+	if got := r.Error(unchanged); got != unchanged {
+		t.Errorf("Error(%v) = %v, want the error returned as is", unchanged, got)
+	}
+	if r.Error(nil) != nil {
+		t.Errorf("Error(nil) returned non-nil error")
+	}
+}
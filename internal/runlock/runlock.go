@@ -0,0 +1,300 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package runlock provides a lock held as a lease in shared storage, so that
+// bulk_fhir_fetch processes on different hosts do not run the same fetch
+// concurrently.
+package runlock
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/bulk_fhir_tools/gcs"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+var (
+	// ErrHeld indicates that another process holds an unexpired lease on the
+	// lock.
+	ErrHeld = errors.New("run lock is held by another process")
+	// ErrConflict is returned by a Store when a record is not at the expected
+	// version.
+	ErrConflict = errors.New("run lock record was modified concurrently")
+)
+
+// A Store holds lock records, and supports conditional updates of them. Each
+// write of a record gives it a new version, which is never 0.
+//
+// Only a GCS Store is provided, but a Store may be implemented on any storage
+// with compare-and-swap semantics, such as DynamoDB or Redis.
+type Store interface {
+	// Read returns the record with the given name and its version, or a version
+	// of 0 if there is no such record.
+	Read(ctx context.Context, name string) ([]byte, int64, error)
+	// Write stores the record if it is still at the given version, or if
+	// version is 0 and there is no such record, and returns its new version.
+	// Otherwise it returns an error wrapping ErrConflict.
+	Write(ctx context.Context, name string, data []byte, version int64) (int64, error)
+	// Delete deletes the record if it is still at the given version. Otherwise
+	// it returns an error wrapping ErrConflict.
+	Delete(ctx context.Context, name string, version int64) error
+}
+
+// record is the content of a lock record.
+type record struct {
+	Key     string    `json:"key"`
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// Locker takes leases on locks in a Store.
+type Locker struct {
+	store  Store
+	ttl    time.Duration
+	holder string
+}
+
+// New returns a Locker which takes leases of duration ttl on locks in store.
+// Leases are renewed well before they expire, so ttl bounds how long a lock
+// stays held after its holder dies without releasing it. As expiry is judged
+// by each host's clock, ttl should be much longer than any clock skew between
+// hosts.
+func New(store Store, ttl time.Duration) *Locker {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &Locker{
+		store:  store,
+		ttl:    ttl,
+		holder: fmt.Sprintf("%s/%d", host, os.Getpid()),
+	}
+}
+
+// recordName returns the name of the record of the lock for key, which may
+// contain any characters.
+func recordName(key string) string {
+	return fmt.Sprintf("%x.lock", sha256.Sum256([]byte(key)))
+}
+
+// Acquire takes the lock for key, or returns an error wrapping ErrHeld if
+// another process holds an unexpired lease on it. An expired lease is taken
+// over. The lease is renewed in the background until it is released.
+func (l *Locker) Acquire(ctx context.Context, key string) (*Lease, error) {
+	name := recordName(key)
+	data, version, err := l.store.Read(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the run lock for %s: %w", key, err)
+	}
+	if version != 0 {
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("failed to parse the run lock for %s: %w", key, err)
+		}
+		if time.Now().Before(rec.Expires) {
+			return nil, fmt.Errorf("%w: %s is held by %s until %s", ErrHeld, key, rec.Holder, rec.Expires.Format(time.RFC3339))
+		}
+		log.Warningf("Taking over the run lock for %s from %s, whose lease expired at %s.", key, rec.Holder, rec.Expires.Format(time.RFC3339))
+	}
+
+	lease := &Lease{
+		locker: l,
+		key:    key,
+		name:   name,
+		lost:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := lease.write(ctx, version); err != nil {
+		if errors.Is(err, ErrConflict) {
+			return nil, fmt.Errorf("%w: %s was acquired concurrently by another process", ErrHeld, key)
+		}
+		return nil, err
+	}
+	go lease.renew(context.WithoutCancel(ctx))
+	return lease, nil
+}
+
+// AcquireWait is like Acquire, but if the lock is held it tries again every
+// poll until it is acquired or ctx is done.
+func (l *Locker) AcquireWait(ctx context.Context, key string, poll time.Duration) (*Lease, error) {
+	for {
+		lease, err := l.Acquire(ctx, key)
+		if !errors.Is(err, ErrHeld) {
+			return lease, err
+		}
+		log.Infof("Waiting for the run lock: %v", err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up waiting for the run lock: %w", ctx.Err())
+		case <-time.After(poll):
+		}
+	}
+}
+
+// A Lease is a held lock.
+type Lease struct {
+	locker    *Locker
+	key, name string
+	lost      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+
+	// mu guards the fields below, which are only written while renewing.
+	mu      sync.Mutex
+	version int64
+	expires time.Time
+}
+
+// write stores the lease with a new expiry, on condition that its record is
+// still at version.
+func (le *Lease) write(ctx context.Context, version int64) error {
+	expires := time.Now().Add(le.locker.ttl)
+	data, err := json.Marshal(record{Key: le.key, Holder: le.locker.holder, Expires: expires})
+	if err != nil {
+		return err
+	}
+	version, err = le.locker.store.Write(ctx, le.name, data, version)
+	if err != nil {
+		return fmt.Errorf("failed to write the run lock for %s: %w", le.key, err)
+	}
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.version = version
+	le.expires = expires
+	return nil
+}
+
+// renew extends the lease every third of its duration until it is released.
+// If it is taken over, or cannot be renewed before it expires, the lease is
+// lost.
+func (le *Lease) renew(ctx context.Context) {
+	defer close(le.done)
+	ticker := time.NewTicker(le.locker.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-le.stop:
+			return
+		case <-ticker.C:
+		}
+		le.mu.Lock()
+		version, expires := le.version, le.expires
+		le.mu.Unlock()
+		err := le.write(ctx, version)
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, ErrConflict):
+			log.Errorf("Lost the run lock for %s, which was taken over by another process.", le.key)
+		case time.Now().After(expires):
+			log.Errorf("Lost the run lock for %s, which expired before it could be renewed: %v", le.key, err)
+		default:
+			log.Warningf("Failed to renew the run lock for %s, will retry: %v", le.key, err)
+			continue
+		}
+		close(le.lost)
+		return
+	}
+}
+
+// Lost returns a channel which is closed if the lease is lost before it is
+// released, in which case another process may acquire the lock.
+func (le *Lease) Lost() <-chan struct{} {
+	return le.lost
+}
+
+// Release stops renewing the lease and releases the lock, unless the lease has
+// been lost.
+func (le *Lease) Release(ctx context.Context) error {
+	close(le.stop)
+	<-le.done
+	select {
+	case <-le.lost:
+		return nil
+	default:
+	}
+	le.mu.Lock()
+	version := le.version
+	le.mu.Unlock()
+	if err := le.locker.store.Delete(ctx, le.name, version); err != nil {
+		if errors.Is(err, ErrConflict) {
+			log.Warningf("The run lock for %s was taken over by another process before it was released.", le.key)
+			return nil
+		}
+		return fmt.Errorf("failed to release the run lock for %s: %w", le.key, err)
+	}
+	return nil
+}
+
+type gcsStore struct {
+	client gcs.Client
+	dir    string
+}
+
+// NewGCSStore returns a Store which holds lock records as objects in the GCS
+// directory at uri, of the form gs://<bucket>/<directory>. The generation of
+// each object is used as its version.
+func NewGCSStore(ctx context.Context, gcsEndpoint, uri string) (Store, error) {
+	bucket, dir, err := gcs.PathComponents(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := gcs.NewClient(ctx, bucket, gcsEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GCS client: %w", err)
+	}
+	return &gcsStore{client: client, dir: dir}, nil
+}
+
+func (gs *gcsStore) Read(ctx context.Context, name string) ([]byte, int64, error) {
+	r, generation, err := gs.client.GetFileReaderWithGeneration(ctx, gcs.JoinPath(gs.dir, name))
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, generation, nil
+}
+
+func (gs *gcsStore) Write(ctx context.Context, name string, data []byte, version int64) (int64, error) {
+	generation, err := gs.client.WriteConditional(ctx, gcs.JoinPath(gs.dir, name), data, version)
+	if gcs.IsPreconditionFailed(err) {
+		return 0, fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	return generation, err
+}
+
+func (gs *gcsStore) Delete(ctx context.Context, name string, version int64) error {
+	err := gs.client.DeleteConditional(ctx, gcs.JoinPath(gs.dir, name), version)
+	if gcs.IsPreconditionFailed(err) || errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runlock_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/internal/runlock"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+func newGCSStore(t *testing.T) (runlock.Store, *testhelpers.GCSServer) {
+	t.Helper()
+	server := testhelpers.NewGCSServer(t)
+	store, err := runlock.NewGCSStore(context.Background(), server.URL(), "gs://bucket/locks")
+	if err != nil {
+		t.Fatalf("NewGCSStore() returned unexpected error: %v", err)
+	}
+	return store, server
+}
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newGCSStore(t)
+	a := runlock.New(store, time.Minute)
+	b := runlock.New(store, time.Minute)
+
+	lease, err := a.Acquire(ctx, "https://server/ group/1")
+	if err != nil {
+		t.Fatalf("Acquire() returned unexpected error: %v", err)
+	}
+	if _, err := b.Acquire(ctx, "https://server/ group/1"); !errors.Is(err, runlock.ErrHeld) {
+		t.Errorf("Acquire() of a held lock returned error %v, want %v", err, runlock.ErrHeld)
+	}
+	other, err := b.Acquire(ctx, "https://server/ group/2")
+	if err != nil {
+		t.Fatalf("Acquire() of a different key returned unexpected error: %v", err)
+	}
+	if err := other.Release(ctx); err != nil {
+		t.Errorf("Release() returned unexpected error: %v", err)
+	}
+
+	if err := lease.Release(ctx); err != nil {
+		t.Fatalf("Release() returned unexpected error: %v", err)
+	}
+	lease, err = b.Acquire(ctx, "https://server/ group/1")
+	if err != nil {
+		t.Fatalf("Acquire() of a released lock returned unexpected error: %v", err)
+	}
+	if err := lease.Release(ctx); err != nil {
+		t.Errorf("Release() returned unexpected error: %v", err)
+	}
+}
+
+func TestAcquire_RenewsLease(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newGCSStore(t)
+	ttl := 300 * time.Millisecond
+
+	lease, err := runlock.New(store, ttl).Acquire(ctx, "key")
+	if err != nil {
+		t.Fatalf("Acquire() returned unexpected error: %v", err)
+	}
+	defer lease.Release(ctx)
+	time.Sleep(3 * ttl)
+
+	select {
+	case <-lease.Lost():
+		t.Fatal("lease was lost, want it to be renewed")
+	default:
+	}
+	if _, err := runlock.New(store, ttl).Acquire(ctx, "key"); !errors.Is(err, runlock.ErrHeld) {
+		t.Errorf("Acquire() of a renewed lock returned error %v, want %v", err, runlock.ErrHeld)
+	}
+}
+
+// overwriteLockRecords replaces every lock record held by server with data, as
+// another process taking over the locks would.
+func overwriteLockRecords(t *testing.T, server *testhelpers.GCSServer, data string) {
+	t.Helper()
+	for _, path := range server.GetAllPaths() {
+		server.AddObject("bucket", strings.TrimPrefix(path, "gs://bucket/"), testhelpers.GCSObjectEntry{Data: []byte(data)})
+	}
+}
+
+func TestAcquire_TakesOverExpiredLease(t *testing.T) {
+	ctx := context.Background()
+	store, server := newGCSStore(t)
+
+	stale, err := runlock.New(store, time.Minute).Acquire(ctx, "key")
+	if err != nil {
+		t.Fatalf("Acquire() returned unexpected error: %v", err)
+	}
+	// Simulate the lease expiring, as it would if its holder had died.
+	overwriteLockRecords(t, server, `{"key":"key","holder":"dead","expires":"2024-01-01T00:00:00Z"}`)
+
+	lease, err := runlock.New(store, time.Minute).Acquire(ctx, "key")
+	if err != nil {
+		t.Fatalf("Acquire() of an expired lock returned unexpected error: %v", err)
+	}
+	if err := stale.Release(ctx); err != nil {
+		t.Errorf("Release() of a lease which was taken over returned unexpected error: %v", err)
+	}
+	if _, err := runlock.New(store, time.Minute).Acquire(ctx, "key"); !errors.Is(err, runlock.ErrHeld) {
+		t.Errorf("Acquire() after releasing a lease which was taken over returned error %v, want %v", err, runlock.ErrHeld)
+	}
+	if err := lease.Release(ctx); err != nil {
+		t.Errorf("Release() returned unexpected error: %v", err)
+	}
+}
+
+func TestLease_Lost(t *testing.T) {
+	ctx := context.Background()
+	store, server := newGCSStore(t)
+
+	lease, err := runlock.New(store, 300*time.Millisecond).Acquire(ctx, "key")
+	if err != nil {
+		t.Fatalf("Acquire() returned unexpected error: %v", err)
+	}
+	overwriteLockRecords(t, server, `{"key":"key","holder":"other","expires":"2100-01-01T00:00:00Z"}`)
+
+	select {
+	case <-lease.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease was not lost after its record was overwritten")
+	}
+	if err := lease.Release(ctx); err != nil {
+		t.Errorf("Release() of a lost lease returned unexpected error: %v", err)
+	}
+	if got := len(server.GetAllPaths()); got != 1 {
+		t.Errorf("%d lock records remain after Release() of a lost lease, want the record of the new holder", got)
+	}
+}
+
+func TestAcquireWait(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newGCSStore(t)
+
+	held, err := runlock.New(store, time.Minute).Acquire(ctx, "key")
+	if err != nil {
+		t.Fatalf("Acquire() returned unexpected error: %v", err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		held.Release(ctx)
+	}()
+
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	lease, err := runlock.New(store, time.Minute).AcquireWait(waitCtx, "key", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("AcquireWait() returned unexpected error: %v", err)
+	}
+	if err := lease.Release(ctx); err != nil {
+		t.Errorf("Release() returned unexpected error: %v", err)
+	}
+}
+
+func TestAcquireWait_ContextDone(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newGCSStore(t)
+
+	held, err := runlock.New(store, time.Minute).Acquire(ctx, "key")
+	if err != nil {
+		t.Fatalf("Acquire() returned unexpected error: %v", err)
+	}
+	defer held.Release(ctx)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := runlock.New(store, time.Minute).AcquireWait(waitCtx, "key", 50*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AcquireWait() returned error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
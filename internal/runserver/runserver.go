@@ -0,0 +1,326 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package runserver serves a small REST API for starting bulk_fhir_fetch runs
+// and inspecting their progress, so that fetches can be driven by other
+// services without shelling out and parsing logs:
+//
+//	POST /runs           starts a run with the options in the JSON body
+//	GET  /runs           lists the runs
+//	GET  /runs/{id}      returns the state and result of a run
+//	GET  /runs/{id}/log  returns the log of a run as plain text
+//
+// Only one run may be in progress at a time, as runs share the process wide
+// logger and metrics.
+package runserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// maxRuns is the number of runs which are remembered. Once exceeded, the
+// oldest finished run is forgotten.
+const maxRuns = 100
+
+// maxOptionsSize is the maximum size of the body of a POST /runs request.
+const maxOptionsSize = 1 << 20
+
+// A Job performs a run, returning metadata about its results which is
+// marshalled to JSON. The ID of the run may be retrieved from ctx with
+// IDFromContext.
+type Job func(ctx context.Context) (result any, err error)
+
+// NewJobFunc returns the Job for the options in the body of a POST /runs
+// request. It should return an error if the options are invalid, which is
+// reported to the client without starting a run.
+type NewJobFunc func(options json.RawMessage) (Job, error)
+
+// State is the state of a run.
+type State string
+
+// Run states.
+const (
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+)
+
+// Run is the JSON representation of a run.
+type Run struct {
+	ID        string          `json:"id"`
+	State     State           `json:"state"`
+	Options   json.RawMessage `json:"options,omitempty"`
+	StartTime string          `json:"startTime"`
+	EndTime   string          `json:"endTime,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Result    any             `json:"result,omitempty"`
+}
+
+type run struct {
+	Run
+	log syncBuffer
+}
+
+// syncBuffer is a bytes.Buffer which is safe to use from multiple goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) WriteTo(w io.Writer) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.NewReader(b.buf.Bytes()).WriteTo(w)
+}
+
+// Server runs jobs requested over HTTP. The zero value is not usable; create
+// one with New. Serve its Handler to expose the API.
+type Server struct {
+	ctx    context.Context
+	secret string
+	newJob NewJobFunc
+
+	mu      sync.Mutex
+	runs    map[string]*run
+	order   []string
+	running bool
+	wg      sync.WaitGroup
+}
+
+// New returns a Server which creates jobs with newJob and runs them on ctx.
+// Runs are not cancelled when the request which started them completes. If
+// secret is set, requests must send it as a bearer token in their
+// Authorization header, and are rejected with 401 Unauthorized otherwise.
+func New(ctx context.Context, secret string, newJob NewJobFunc) *Server {
+	return &Server{ctx: ctx, secret: secret, newJob: newJob, runs: map[string]*run{}}
+}
+
+// Wait waits for any run in progress to finish.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// Register adds the /runs handlers to the given mux.
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/runs", s.handleRuns)
+	mux.HandleFunc("/runs/", s.handleRun)
+}
+
+// Handler returns a http.Handler serving only the /runs API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.Register(mux)
+	return mux
+}
+
+// authorized returns whether req holds the secret of the Server, writing an
+// error response if not.
+func (s *Server) authorized(w http.ResponseWriter, req *http.Request) bool {
+	if s.secret == "" || subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+s.secret)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, http.StatusUnauthorized, errors.New("invalid authorization"))
+	return false
+}
+
+func (s *Server) handleRuns(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(w, req) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		runs := make([]Run, 0, len(s.order))
+		for i := len(s.order) - 1; i >= 0; i-- {
+			runs = append(runs, s.runs[s.order[i]].Run)
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, runs)
+	case http.MethodPost:
+		s.startRun(w, req)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+	}
+}
+
+func (s *Server) startRun(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxOptionsSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error reading request body: %w", err))
+		return
+	}
+	options := json.RawMessage(bytes.TrimSpace(body))
+	if len(options) == 0 {
+		options = json.RawMessage("{}")
+	}
+	if !json.Valid(options) {
+		writeError(w, http.StatusBadRequest, errors.New("request body is not valid JSON"))
+		return
+	}
+	job, err := s.newJob(options)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	id, err := NewID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		writeError(w, http.StatusConflict, errors.New("a run is already in progress"))
+		return
+	}
+	s.running = true
+	r := &run{Run: Run{ID: id, State: StateRunning, Options: options, StartTime: time.Now().Format(time.RFC3339)}}
+	s.add(r)
+	status := r.Run
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go s.run(r, job)
+	w.Header().Set("Location", "/runs/"+id)
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// add adds r to the runs, forgetting the oldest finished run if there are too
+// many. s.mu must be held.
+func (s *Server) add(r *run) {
+	s.runs[r.ID] = r
+	s.order = append(s.order, r.ID)
+	if len(s.order) <= maxRuns {
+		return
+	}
+	for i, id := range s.order {
+		if s.runs[id].State != StateRunning {
+			delete(s.runs, id)
+			s.order = append(s.order[:i:i], s.order[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Server) run(r *run, job Job) {
+	defer s.wg.Done()
+	// Only one run is in progress at a time, so all logs written until it
+	// finishes belong to it.
+	removeWriter := log.AddWriter(&r.log)
+	log.Infof("Starting run %s with options %s", r.ID, r.Options)
+	result, err := job(context.WithValue(s.ctx, idKey{}, r.ID))
+	if err != nil {
+		log.Errorf("Run %s failed: %v", r.ID, err)
+	} else {
+		log.Infof("Run %s succeeded", r.ID)
+	}
+	removeWriter()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	r.EndTime = time.Now().Format(time.RFC3339)
+	r.Result = result
+	if err != nil {
+		r.State = StateFailed
+		r.Error = err.Error()
+	} else {
+		r.State = StateSucceeded
+	}
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(w, req) {
+		return
+	}
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	id, sub, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/runs/"), "/")
+	if sub != "" && sub != "log" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", req.URL.Path))
+		return
+	}
+	s.mu.Lock()
+	r, ok := s.runs[id]
+	var status Run
+	if ok {
+		status = r.Run
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("run %q not found", id))
+		return
+	}
+
+	if sub == "log" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		r.log.WriteTo(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// NewID returns a new random run ID, of the same form as the IDs of runs
+// started through the API.
+func NewID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating run ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type idKey struct{}
+
+// IDFromContext returns the ID of the run whose Job was passed ctx.
+func IDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(idKey{}).(string)
+	return id, ok
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,203 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+type options struct {
+	Fail bool `json:"fail"`
+}
+
+// newTestServer returns a Server with the given secret whose jobs log a
+// message and then wait for a value on the returned channel before finishing.
+func newTestServer(t *testing.T, secret string) (*Server, chan struct{}) {
+	t.Helper()
+	release := make(chan struct{})
+	s := New(context.Background(), secret, func(raw json.RawMessage) (Job, error) {
+		var opts options
+		if err := json.Unmarshal(raw, &opts); err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) (any, error) {
+			id, _ := IDFromContext(ctx)
+			log.Infof("job %s is running", id)
+			<-release
+			if opts.Fail {
+				return nil, errors.New("job failed")
+			}
+			return map[string]int{"resources": 3}, nil
+		}, nil
+	})
+	t.Cleanup(func() {
+		close(release)
+		s.Wait()
+	})
+	return s, release
+}
+
+func do(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func decodeRun(t *testing.T, rec *httptest.ResponseRecorder) Run {
+	t.Helper()
+	var r Run
+	if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", rec.Body.String(), err)
+	}
+	return r
+}
+
+func TestServer(t *testing.T) {
+	s, release := newTestServer(t, "")
+	h := s.Handler()
+
+	rec := do(t, h, http.MethodPost, "/runs", `{"fail":false}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /runs returned %d %s, want %d", rec.Code, rec.Body.String(), http.StatusAccepted)
+	}
+	started := decodeRun(t, rec)
+	if started.ID == "" || started.State != StateRunning {
+		t.Errorf("POST /runs returned run %+v, want a running run with an ID", started)
+	}
+	if got, want := rec.Header().Get("Location"), "/runs/"+started.ID; got != want {
+		t.Errorf("POST /runs returned Location %q, want %q", got, want)
+	}
+
+	if rec := do(t, h, http.MethodPost, "/runs", `{}`); rec.Code != http.StatusConflict {
+		t.Errorf("POST /runs while a run is in progress returned %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	release <- struct{}{}
+	s.Wait()
+
+	rec = do(t, h, http.MethodGet, "/runs/"+started.ID, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /runs/%s returned %d, want %d", started.ID, rec.Code, http.StatusOK)
+	}
+	got := decodeRun(t, rec)
+	want := Run{
+		ID:        started.ID,
+		State:     StateSucceeded,
+		Options:   json.RawMessage(`{"fail":false}`),
+		StartTime: started.StartTime,
+		EndTime:   got.EndTime,
+		Result:    map[string]any{"resources": float64(3)},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GET /runs/%s returned unexpected run (-want +got):\n%s", started.ID, diff)
+	}
+	if got.EndTime == "" {
+		t.Errorf("GET /runs/%s returned no end time for a finished run", started.ID)
+	}
+
+	rec = do(t, h, http.MethodGet, "/runs/"+started.ID+"/log", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "INFO: job "+started.ID+" is running") {
+		t.Errorf("GET /runs/%s/log returned %d %q, want it to contain the job's log", started.ID, rec.Code, rec.Body.String())
+	}
+
+	// Another run may be started once the first has finished.
+	rec = do(t, h, http.MethodPost, "/runs", `{"fail": true}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /runs returned %d %s, want %d", rec.Code, rec.Body.String(), http.StatusAccepted)
+	}
+	failed := decodeRun(t, rec)
+	release <- struct{}{}
+	s.Wait()
+	if got := decodeRun(t, do(t, h, http.MethodGet, "/runs/"+failed.ID, "")); got.State != StateFailed || got.Error != "job failed" {
+		t.Errorf("GET /runs/%s returned state %s with error %q, want %s with error %q", failed.ID, got.State, got.Error, StateFailed, "job failed")
+	}
+
+	var runs []Run
+	if err := json.Unmarshal(do(t, h, http.MethodGet, "/runs", "").Body.Bytes(), &runs); err != nil {
+		t.Fatalf("GET /runs returned invalid JSON: %v", err)
+	}
+	if len(runs) != 2 || runs[0].ID != failed.ID || runs[1].ID != started.ID {
+		t.Errorf("GET /runs returned %+v, want runs %s and %s, most recent first", runs, failed.ID, started.ID)
+	}
+}
+
+func TestServer_Errors(t *testing.T) {
+	s, _ := newTestServer(t, "")
+	h := s.Handler()
+
+	cases := []struct {
+		method, path, body string
+		wantCode           int
+	}{
+		{method: http.MethodPost, path: "/runs", body: `not json`, wantCode: http.StatusBadRequest},
+		{method: http.MethodPost, path: "/runs", body: `{"fail": "yes"}`, wantCode: http.StatusBadRequest},
+		{method: http.MethodDelete, path: "/runs", wantCode: http.StatusMethodNotAllowed},
+		{method: http.MethodGet, path: "/runs/unknown", wantCode: http.StatusNotFound},
+		{method: http.MethodGet, path: "/runs/unknown/log", wantCode: http.StatusNotFound},
+		{method: http.MethodPost, path: "/runs/unknown", wantCode: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range cases {
+		if rec := do(t, h, tc.method, tc.path, tc.body); rec.Code != tc.wantCode {
+			t.Errorf("%s %s returned %d, want %d", tc.method, tc.path, rec.Code, tc.wantCode)
+		}
+	}
+}
+
+func TestServer_Authorization(t *testing.T) {
+	s, release := newTestServer(t, "secret")
+	h := s.Handler()
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		for _, path := range []string{"/runs", "/runs/unknown", "/runs/unknown/log"} {
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{}`))
+			if path != "/runs" {
+				req.Method = http.MethodGet
+			}
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s with Authorization %q returned %d, want %d", req.Method, path, auth, rec.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+	s.mu.Lock()
+	if len(s.runs) != 0 {
+		t.Errorf("unauthorized requests started %d runs, want none", len(s.runs))
+	}
+	s.mu.Unlock()
+
+	req := httptest.NewRequest(http.MethodPost, "/runs", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /runs with the secret returned %d %s, want %d", rec.Code, rec.Body.String(), http.StatusAccepted)
+	}
+	release <- struct{}{}
+}
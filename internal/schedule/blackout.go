@@ -0,0 +1,218 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxBlackout bounds how far ahead End looks for the end of a blackout. No
+// window is longer than a day, so a blackout which lasts longer than a week
+// never ends.
+const maxBlackout = 8 * 24 * time.Hour
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// A Blackout is a set of recurring windows of the week during which work,
+// such as downloading and uploading data, should not be done.
+type Blackout struct {
+	loc     *time.Location
+	windows []window
+}
+
+// window is a recurring blackout window, starting at start and ending at end
+// after midnight on each of days. end may be more than a day after midnight
+// for windows which end the next day.
+type window struct {
+	days       [7]bool
+	start, end clock
+}
+
+// clock is a wall clock time of day.
+type clock struct {
+	hour, minute int
+}
+
+// ParseBlackout parses spec, a comma separated list of windows of the form
+// "[<days> ]HH:MM-HH:MM", such as "Mon-Fri 08:00-18:00, Sat 10:00-14:00".
+// days is a day such as Sat, or a range of days such as Mon-Fri or Fri-Mon,
+// and defaults to every day. A window which ends at or before its start ends
+// the next day, so "22:00-06:00" is overnight. Times are in the local time
+// zone, unless spec is prefixed with "TZ=<zone> ".
+func ParseBlackout(spec string) (*Blackout, error) {
+	b := &Blackout{loc: time.Local}
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "TZ=") {
+		zone, rest, _ := strings.Cut(spec, " ")
+		loc, err := time.LoadLocation(strings.TrimPrefix(zone, "TZ="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid blackout time zone: %w", err)
+		}
+		b.loc, spec = loc, rest
+	}
+	for _, w := range strings.Split(spec, ",") {
+		parsed, err := parseWindow(strings.TrimSpace(w))
+		if err != nil {
+			return nil, fmt.Errorf("invalid blackout window %q: %w", strings.TrimSpace(w), err)
+		}
+		b.windows = append(b.windows, parsed)
+	}
+	if now := time.Now(); b.End(now).Sub(now) >= maxBlackout {
+		return nil, errors.New("blackout windows cover the whole week")
+	}
+	return b, nil
+}
+
+func parseWindow(spec string) (window, error) {
+	var w window
+	times := spec
+	if days, rest, ok := strings.Cut(spec, " "); ok {
+		if err := w.parseDays(days); err != nil {
+			return w, err
+		}
+		times = strings.TrimSpace(rest)
+	} else {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	from, to, ok := strings.Cut(times, "-")
+	if !ok {
+		return w, errors.New("want a time range of the form HH:MM-HH:MM")
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return w, err
+	}
+	if w.start.hour == 24 {
+		return w, errors.New("a window cannot start at 24:00")
+	}
+	if w.end.minutes() <= w.start.minutes() {
+		w.end.hour += 24
+	}
+	return w, nil
+}
+
+func (w *window) parseDays(spec string) error {
+	from, to, isRange := strings.Cut(spec, "-")
+	first, ok := weekdays[strings.ToLower(from)]
+	if !ok {
+		return fmt.Errorf("unknown day %q", from)
+	}
+	last := first
+	if isRange {
+		if last, ok = weekdays[strings.ToLower(to)]; !ok {
+			return fmt.Errorf("unknown day %q", to)
+		}
+	}
+	for d := first; ; d = (d + 1) % 7 {
+		w.days[d] = true
+		if d == last {
+			return nil
+		}
+	}
+}
+
+// parseClock parses a time of day of the form HH:MM, where 24:00 is the end of
+// the day.
+func parseClock(s string) (clock, error) {
+	t, err := time.Parse("15:04", s)
+	if err == nil {
+		return clock{hour: t.Hour(), minute: t.Minute()}, nil
+	}
+	if s == "24:00" {
+		return clock{hour: 24}, nil
+	}
+	return clock{}, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+}
+
+func (c clock) minutes() int {
+	return c.hour*60 + c.minute
+}
+
+// Active returns whether t is within a blackout window.
+func (b *Blackout) Active(t time.Time) bool {
+	return b.End(t).After(t)
+}
+
+// End returns the time the blackout in effect at t ends, taking into account
+// windows which overlap or follow on from each other, or t if no blackout
+// window contains t.
+func (b *Blackout) End(t time.Time) time.Time {
+	from := t
+	for t.Sub(from) < maxBlackout {
+		end, ok := b.windowEnd(t)
+		if !ok {
+			return t
+		}
+		t = end
+	}
+	return t
+}
+
+// windowEnd returns the latest end of the windows which contain t, and
+// whether any does.
+func (b *Blackout) windowEnd(t time.Time) (time.Time, bool) {
+	local := t.In(b.loc)
+	var end time.Time
+	for _, w := range b.windows {
+		// A window containing t started either on the day of t, or on the day
+		// before if it ends the next day.
+		for offset := 0; offset <= 1; offset++ {
+			day := time.Date(local.Year(), local.Month(), local.Day()-offset, 0, 0, 0, 0, b.loc)
+			if !w.days[day.Weekday()] {
+				continue
+			}
+			start := time.Date(day.Year(), day.Month(), day.Day(), w.start.hour, w.start.minute, 0, 0, b.loc)
+			stop := time.Date(day.Year(), day.Month(), day.Day(), w.end.hour, w.end.minute, 0, 0, b.loc)
+			if !t.Before(start) && t.Before(stop) && stop.After(end) {
+				end = stop
+			}
+		}
+	}
+	return end, !end.IsZero()
+}
+
+// Wait blocks until no blackout window is in effect, or ctx is done, in which
+// case it returns ctx's error.
+func (b *Blackout) Wait(ctx context.Context) error {
+	for {
+		now := time.Now()
+		end := b.End(now)
+		if !end.After(now) {
+			return nil
+		}
+		timer := time.NewTimer(end.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
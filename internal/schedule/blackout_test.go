@@ -0,0 +1,157 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schedule_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/internal/schedule"
+)
+
+func TestParseBlackout(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	// 2024-03-01 is a Friday.
+	cases := []struct {
+		name    string
+		spec    string
+		t       time.Time
+		wantEnd time.Time
+	}{
+		{
+			name:    "weekday peak hours",
+			spec:    "TZ=America/New_York Mon-Fri 08:00-18:00",
+			t:       time.Date(2024, 3, 1, 9, 30, 0, 0, ny),
+			wantEnd: time.Date(2024, 3, 1, 18, 0, 0, 0, ny),
+		},
+		{
+			name:    "other time zone",
+			spec:    "TZ=America/New_York Mon-Fri 08:00-18:00",
+			t:       time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC),
+			wantEnd: time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "before window",
+			spec: "TZ=America/New_York Mon-Fri 08:00-18:00",
+			t:    time.Date(2024, 3, 1, 7, 59, 0, 0, ny),
+		},
+		{
+			name: "at end of window",
+			spec: "TZ=America/New_York Mon-Fri 08:00-18:00",
+			t:    time.Date(2024, 3, 1, 18, 0, 0, 0, ny),
+		},
+		{
+			name: "weekend",
+			spec: "TZ=America/New_York Mon-Fri 08:00-18:00",
+			t:    time.Date(2024, 3, 2, 9, 30, 0, 0, ny),
+		},
+		{
+			name:    "overnight",
+			spec:    "TZ=UTC 22:00-06:00",
+			t:       time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC),
+			wantEnd: time.Date(2024, 3, 2, 6, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "overnight from the day before only",
+			spec:    "TZ=UTC Fri 22:00-06:00",
+			t:       time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC),
+			wantEnd: time.Date(2024, 3, 2, 6, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "overnight not from the day before",
+			spec: "TZ=UTC Sat 22:00-06:00",
+			t:    time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "adjacent windows",
+			spec:    "TZ=UTC 08:00-12:00, Fri 12:00-24:00, Sat 00:00-02:00",
+			t:       time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC),
+			wantEnd: time.Date(2024, 3, 2, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "day range wrapping the week",
+			spec:    "TZ=UTC Sat-Sun 10:00-14:00",
+			t:       time.Date(2024, 3, 3, 11, 0, 0, 0, time.UTC),
+			wantEnd: time.Date(2024, 3, 3, 14, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := schedule.ParseBlackout(tc.spec)
+			if err != nil {
+				t.Fatalf("ParseBlackout(%q) returned unexpected error: %v", tc.spec, err)
+			}
+			wantActive := !tc.wantEnd.IsZero()
+			if got := b.Active(tc.t); got != wantActive {
+				t.Errorf("Active(%v) = %v, want %v", tc.t, got, wantActive)
+			}
+			wantEnd := tc.wantEnd
+			if !wantActive {
+				wantEnd = tc.t
+			}
+			if got := b.End(tc.t); !got.Equal(wantEnd) {
+				t.Errorf("End(%v) = %v, want %v", tc.t, got, wantEnd)
+			}
+		})
+	}
+}
+
+func TestParseBlackout_Invalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"08:00",
+		"8am-6pm",
+		"Mon-Fri",
+		"Weekdays 08:00-18:00",
+		"08:00-25:00",
+		"24:00-06:00",
+		"TZ=Nowhere/Special 08:00-18:00",
+		"00:00-24:00",
+		"Mon-Sun 12:00-12:00",
+	} {
+		if _, err := schedule.ParseBlackout(spec); err == nil {
+			t.Errorf("ParseBlackout(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestBlackout_Wait(t *testing.T) {
+	now := time.Now().UTC()
+	// A window which started a minute ago and ends in an hour.
+	start, end := now.Add(-time.Minute), now.Add(time.Hour)
+	spec := "TZ=UTC " + start.Format("15:04") + "-" + end.Format("15:04")
+	b, err := schedule.ParseBlackout(spec)
+	if err != nil {
+		t.Fatalf("ParseBlackout(%q) returned unexpected error: %v", spec, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait() during a blackout window returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A window which ended a minute ago.
+	spec = "TZ=UTC " + now.Add(-time.Hour).Format("15:04") + "-" + start.Format("15:04")
+	if b, err = schedule.ParseBlackout(spec); err != nil {
+		t.Fatalf("ParseBlackout(%q) returned unexpected error: %v", spec, err)
+	}
+	if err := b.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() outside blackout windows returned unexpected error: %v", err)
+	}
+}
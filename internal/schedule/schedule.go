@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package schedule parses the schedules on which bulk_fhir_fetch runs
+// periodic fetches when it is run as a long running process.
+package schedule
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// A Schedule returns the time of the next run after the given time.
+type Schedule interface {
+	Next(time.Time) time.Time
+}
+
+// Parse parses spec, which is either a duration such as "6h" to run at that
+// interval, or a standard five field cron expression such as "0 2 * * *" to
+// run at the matching times in the local time zone. Cron descriptors such as
+// "@daily", and a "CRON_TZ=<zone>" prefix to use a different time zone, are
+// also accepted.
+func Parse(spec string) (Schedule, error) {
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("schedule interval must be positive, got %s", spec)
+		}
+		return interval(d), nil
+	}
+	s, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("schedule %q is neither a duration nor a cron expression: %w", spec, err)
+	}
+	return s, nil
+}
+
+// interval is a Schedule which runs at a fixed interval after each run.
+type interval time.Duration
+
+func (i interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(i))
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/internal/schedule"
+)
+
+func TestParse(t *testing.T) {
+	from := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	cases := []struct {
+		spec string
+		want time.Time
+	}{
+		{spec: "6h", want: time.Date(2024, 3, 1, 16, 30, 0, 0, time.UTC)},
+		{spec: "90m", want: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{spec: "CRON_TZ=UTC 0 2 * * *", want: time.Date(2024, 3, 2, 2, 0, 0, 0, time.UTC)},
+		{spec: "CRON_TZ=UTC */15 * * * *", want: time.Date(2024, 3, 1, 10, 45, 0, 0, time.UTC)},
+		{spec: "CRON_TZ=UTC @weekly", want: time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.spec, func(t *testing.T) {
+			s, err := schedule.Parse(tc.spec)
+			if err != nil {
+				t.Fatalf("Parse(%q) returned unexpected error: %v", tc.spec, err)
+			}
+			if got := s.Next(from); !got.Equal(tc.want) {
+				t.Errorf("Parse(%q).Next(%v) = %v, want %v", tc.spec, from, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "0s", "-1h", "daily", "0 2 * *", "61 * * * *"} {
+		if _, err := schedule.Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", spec)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package secrets reads secret values, such as client credentials, from GCP
+// Secret Manager so that they need not be passed on the command line.
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// DefaultSecretManagerEndpoint is the default Secret Manager API endpoint. This
+// should be passed to NewClient, unless in a test environment.
+const DefaultSecretManagerEndpoint = "https://secretmanager.googleapis.com/"
+
+const secretManagerHost = "secretmanager.googleapis.com"
+
+// ErrChecksumMismatch indicates that the payload returned by Secret Manager did
+// not match its checksum.
+var ErrChecksumMismatch = errors.New("secret payload does not match its checksum")
+
+var resourceNameRegex = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+/versions/[^/]+$`)
+
+// IsResourceName returns whether value is a Secret Manager secret version
+// resource name, for example "projects/p/secrets/s/versions/latest".
+func IsResourceName(value string) bool {
+	return resourceNameRegex.MatchString(value)
+}
+
+// Client reads secret versions from Secret Manager.
+type Client struct {
+	service *secretmanager.Service
+}
+
+// NewClient initializes and returns a new Secret Manager client for the given
+// endpoint.
+func NewClient(ctx context.Context, endpoint string) (*Client, error) {
+	var service *secretmanager.Service
+	var err error
+	if u, perr := url.Parse(endpoint); perr == nil && u.Scheme == "https" && u.Hostname() == secretManagerHost {
+		service, err = secretmanager.NewService(ctx, option.WithEndpoint(endpoint))
+	} else {
+		// As in fhirstore.NewClient, non-Google endpoints are generally test
+		// servers, so no credentials are looked up.
+		service, err = secretmanager.NewService(ctx, option.WithHTTPClient(&http.Client{}), option.WithEndpoint(endpoint))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Client{service: service}, nil
+}
+
+// Access returns the payload of the secret version with the given resource
+// name.
+func (c *Client) Access(ctx context.Context, name string) ([]byte, error) {
+	resp, err := c.service.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error accessing secret %s: %w", name, err)
+	}
+	if resp.Payload == nil {
+		return nil, fmt.Errorf("secret %s has no payload", name)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding secret %s: %w", name, err)
+	}
+	if resp.Payload.DataCrc32c != 0 {
+		if got := int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))); got != resp.Payload.DataCrc32c {
+			return nil, fmt.Errorf("secret %s: %w", name, ErrChecksumMismatch)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/internal/secrets"
+)
+
+func TestIsResourceName(t *testing.T) {
+	cases := []struct {
+		value string
+		want  bool
+	}{
+		{"projects/p/secrets/s/versions/latest", true},
+		{"projects/123/secrets/client-secret/versions/2", true},
+		{"projects/p/secrets/s", false},
+		{"/path/to/key.pem", false},
+		{"hunter2", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		if got := secrets.IsResourceName(tc.value); got != tc.want {
+			t.Errorf("IsResourceName(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestAccess(t *testing.T) {
+	const name = "projects/p/secrets/s/versions/latest"
+	payload := []byte("super-secret")
+	checksum := int64(crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)))
+
+	cases := []struct {
+		name     string
+		checksum int64
+		wantErr  error
+	}{
+		{name: "WithChecksum", checksum: checksum},
+		{name: "WithoutChecksum"},
+		{name: "ChecksumMismatch", checksum: checksum + 1, wantErr: secrets.ErrChecksumMismatch},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/"+name+":access" {
+					t.Errorf("Secret Manager request has unexpected path %q", r.URL.Path)
+				}
+				fmt.Fprintf(w, `{"name": %q, "payload": {"data": %q, "dataCrc32c": "%d"}}`, name, base64.StdEncoding.EncodeToString(payload), tc.checksum)
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			c, err := secrets.NewClient(ctx, server.URL)
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			got, err := c.Access(ctx, name)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Access(%q) returned error %v, want %v", name, err, tc.wantErr)
+			}
+			if tc.wantErr == nil && string(got) != string(payload) {
+				t.Errorf("Access(%q) = %q, want %q", name, got, payload)
+			}
+		})
+	}
+}
+
+func TestAccess_NotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	c, err := secrets.NewClient(ctx, server.URL)
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	if _, err := c.Access(ctx, "projects/p/secrets/missing/versions/1"); err == nil {
+		t.Error("Access() for a missing secret returned nil error, want an error")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing wraps OpenTelemetry tracing for bulk_fhir_tools. Spans are
+// created with Start and ended with End. Until Init is called with an
+// exporter, spans are no-ops and cost very little, so libraries can be
+// instrumented unconditionally.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	texporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters which may be passed to Init.
+const (
+	// ExporterNone disables tracing.
+	ExporterNone = ""
+	// ExporterOTLP exports traces to an OTLP collector over HTTP. The collector
+	// is configured with the standard OTEL_EXPORTER_OTLP_* environment
+	// variables, and defaults to localhost:4318.
+	ExporterOTLP = "otlp"
+	// ExporterGCP exports traces to Cloud Trace.
+	ExporterGCP = "gcp"
+)
+
+const (
+	serviceName = "bulk-fhir-fetch"
+	tracerName  = "github.com/google/bulk_fhir_tools"
+)
+
+// Init installs a global tracer provider which samples the given ratio of
+// traces and sends them to the given exporter. projectID is only used by
+// ExporterGCP. The returned function flushes any pending spans and shuts the
+// provider down; it should be called before the program exits.
+func Init(ctx context.Context, exporter, projectID string, sampleRatio float64) (func(context.Context) error, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exp, err = otlptracehttp.New(ctx)
+	case ExporterGCP:
+		exp, err = texporter.New(texporter.WithProjectID(projectID))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s trace exporter: %w", exporter, err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Start starts a span with the given name and attributes, as a child of any
+// span in ctx. The returned context carries the new span, and should be passed
+// to work done within it.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends the span, first marking it as failed if err is non-nil. It is
+// intended to be deferred with a named error result:
+//
+//	ctx, span := tracing.Start(ctx, "name")
+//	defer func() { tracing.End(span, err) }()
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStartEnd(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	ctx, parent := tracing.Start(context.Background(), "parent")
+	_, child := tracing.Start(ctx, "child", attribute.String("key", "value"))
+	tracing.End(child, errors.New("child failed"))
+	tracing.End(parent, nil)
+
+	spans := exp.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	gotChild, gotParent := spans[0], spans[1]
+	if gotChild.Name != "child" || gotParent.Name != "parent" {
+		t.Fatalf("got spans %q, %q, want child, parent", gotChild.Name, gotParent.Name)
+	}
+	if gotChild.Parent.SpanID() != gotParent.SpanContext.SpanID() {
+		t.Errorf("child span parent = %v, want %v", gotChild.Parent.SpanID(), gotParent.SpanContext.SpanID())
+	}
+	if len(gotChild.Attributes) != 1 || gotChild.Attributes[0] != attribute.String("key", "value") {
+		t.Errorf("child span attributes = %v, want key=value", gotChild.Attributes)
+	}
+	if gotChild.Status.Code != codes.Error || gotChild.Status.Description != "child failed" {
+		t.Errorf("child span status = %v, want error with description %q", gotChild.Status, "child failed")
+	}
+	if gotParent.Status.Code != codes.Unset {
+		t.Errorf("parent span status = %v, want unset", gotParent.Status)
+	}
+}
+
+func TestInit(t *testing.T) {
+	shutdown, err := tracing.Init(context.Background(), tracing.ExporterNone, "", 1)
+	if err != nil {
+		t.Fatalf("Init(%q) error: %v", tracing.ExporterNone, err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown error: %v", err)
+	}
+
+	if _, err := tracing.Init(context.Background(), "zipkin", "", 1); err == nil {
+		t.Errorf("Init(%q) succeeded, want error", "zipkin")
+	}
+}
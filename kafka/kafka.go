@@ -0,0 +1,645 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kafka contains a minimal Kafka producer, which produces records to
+// the partitions of a topic over the Kafka protocol, with TLS and SASL
+// authentication.
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+const (
+	// DefaultTimeout is the default Config.Timeout.
+	DefaultTimeout = 30 * time.Second
+	// DefaultMaxAttempts is the default Config.MaxAttempts.
+	DefaultMaxAttempts = 5
+	// DefaultRetryBackoff is the default Config.RetryBackoff.
+	DefaultRetryBackoff = time.Second
+)
+
+// maxResponseBytes bounds the size of responses read from a broker, to guard
+// against reading a connection which is not speaking the Kafka protocol.
+const maxResponseBytes = 100 * 1024 * 1024
+
+// Config configures a Client.
+type Config struct {
+	// Brokers are the host:port addresses of the brokers to bootstrap from.
+	// The other brokers of the cluster are discovered from them.
+	Brokers []string
+	// TLS, if set, is used to connect to the brokers over TLS.
+	TLS *tls.Config
+	// SASL, if set, authenticates each connection to a broker.
+	SASL *SASL
+	// ClientID identifies the client in the brokers' logs and quotas.
+	ClientID string
+	// Timeout bounds each request to a broker, including the time the broker
+	// waits for the records produced to be replicated. Defaults to
+	// DefaultTimeout.
+	Timeout time.Duration
+	// MaxAttempts is the most times records are sent when the broker returns a
+	// retriable error, such as when the leader of a partition moves to another
+	// broker, or the connection fails. Defaults to DefaultMaxAttempts.
+	MaxAttempts int
+	// RetryBackoff is the delay between attempts, which doubles after each.
+	// Defaults to DefaultRetryBackoff.
+	RetryBackoff time.Duration
+}
+
+// Header is a header of a record.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Record is a record to produce. Records with the same Key are produced to the
+// same partition, so are consumed in the order produced. A record with a nil
+// Value is a tombstone, which deletes the Key from compacted topics.
+type Record struct {
+	Key     []byte
+	Value   []byte
+	Headers []Header
+}
+
+// Size returns the number of bytes of the record's key, value and headers.
+func (r Record) Size() int {
+	n := len(r.Key) + len(r.Value)
+	for _, h := range r.Headers {
+		n += len(h.Key) + len(h.Value)
+	}
+	return n
+}
+
+// Error is an error code returned by a Kafka broker.
+type Error int16
+
+// The errors returned by brokers which the Client handles specially.
+const (
+	ErrUnknownTopicOrPartition Error = 3
+	ErrLeaderNotAvailable      Error = 5
+	ErrNotLeaderForPartition   Error = 6
+	ErrRequestTimedOut         Error = 7
+	ErrMessageTooLarge         Error = 10
+	ErrNetworkException        Error = 13
+	ErrNotEnoughReplicas       Error = 19
+	ErrNotEnoughReplicasAfter  Error = 20
+	ErrTopicAuthorization      Error = 29
+	ErrSASLAuthentication      Error = 58
+)
+
+var errorNames = map[Error]string{
+	2:                          "CORRUPT_MESSAGE",
+	ErrUnknownTopicOrPartition: "UNKNOWN_TOPIC_OR_PARTITION",
+	ErrLeaderNotAvailable:      "LEADER_NOT_AVAILABLE",
+	ErrNotLeaderForPartition:   "NOT_LEADER_OR_FOLLOWER",
+	ErrRequestTimedOut:         "REQUEST_TIMED_OUT",
+	ErrMessageTooLarge:         "MESSAGE_TOO_LARGE",
+	ErrNetworkException:        "NETWORK_EXCEPTION",
+	17:                         "INVALID_TOPIC_EXCEPTION",
+	18:                         "RECORD_LIST_TOO_LARGE",
+	ErrNotEnoughReplicas:       "NOT_ENOUGH_REPLICAS",
+	ErrNotEnoughReplicasAfter:  "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	ErrTopicAuthorization:      "TOPIC_AUTHORIZATION_FAILED",
+	31:                         "CLUSTER_AUTHORIZATION_FAILED",
+	33:                         "UNSUPPORTED_SASL_MECHANISM",
+	34:                         "ILLEGAL_SASL_STATE",
+	35:                         "UNSUPPORTED_VERSION",
+	ErrSASLAuthentication:      "SASL_AUTHENTICATION_FAILED",
+	87:                         "INVALID_RECORD",
+}
+
+func (e Error) Error() string {
+	if name, ok := errorNames[e]; ok {
+		return fmt.Sprintf("Kafka error %s (%d)", name, int16(e))
+	}
+	return fmt.Sprintf("Kafka error %d", int16(e))
+}
+
+// Retriable returns whether a request which failed with the error may succeed
+// if retried, for example once the client has found the new leader of a
+// partition.
+func (e Error) Retriable() bool {
+	switch e {
+	case 2, ErrUnknownTopicOrPartition, ErrLeaderNotAvailable, ErrNotLeaderForPartition, ErrRequestTimedOut, ErrNetworkException, ErrNotEnoughReplicas, ErrNotEnoughReplicasAfter:
+		return true
+	}
+	return false
+}
+
+// ProduceError is returned by Produce when some of the records could not be
+// delivered.
+type ProduceError struct {
+	// Failed is the number of records which were not delivered. The others
+	// were.
+	Failed int
+	// Err is the last error encountered.
+	Err error
+}
+
+func (e *ProduceError) Error() string {
+	return fmt.Sprintf("failed to produce %d records to Kafka: %v", e.Failed, e.Err)
+}
+
+func (e *ProduceError) Unwrap() error { return e.Err }
+
+// Client produces records to Kafka topics. It is safe for concurrent use.
+type Client struct {
+	cfg Config
+
+	mu sync.Mutex
+	// brokers maps the node IDs of the brokers discovered to their addresses.
+	brokers map[int32]string
+	// leaders maps each topic to the node ID of the leader of each of its
+	// partitions, by partition index.
+	leaders map[string][]int32
+	conns   map[string]*conn
+	// roundRobin is the partition to produce the next record without a key to,
+	// by topic.
+	roundRobin map[string]int
+}
+
+// NewClient returns a Client for the cluster of cfg.Brokers, having checked
+// that a broker can be connected to with the configured credentials.
+func NewClient(ctx context.Context, cfg Config) (*Client, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("at least one Kafka broker is required")
+	}
+	if cfg.SASL != nil {
+		if err := cfg.SASL.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultMaxAttempts
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = DefaultRetryBackoff
+	}
+	c := &Client{
+		cfg:        cfg,
+		brokers:    map[int32]string{},
+		leaders:    map[string][]int32{},
+		conns:      map[string]*conn{},
+		roundRobin: map[string]int{},
+	}
+	if err := c.refreshMetadata(ctx, nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the Client's connections to the brokers.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for addr, cn := range c.conns {
+		errs = append(errs, cn.nc.Close())
+		delete(c.conns, addr)
+	}
+	return errors.Join(errs...)
+}
+
+// Produce produces records to topic, waiting until all in-sync replicas of
+// each partition have written them. Records are partitioned by the murmur2
+// hash of their keys, as Kafka's Java producer does, and records without keys
+// are spread across the partitions. Records which fail with a retriable error
+// are retried up to Config.MaxAttempts times. If any records are not
+// delivered, the error is a *ProduceError.
+func (c *Client) Produce(ctx context.Context, topic string, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	pending := records
+	backoff := c.cfg.RetryBackoff
+	failed := 0
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		var retry []Record
+		leaders, err := c.topicLeaders(ctx, topic, attempt > 1)
+		switch {
+		case err == nil:
+			retry, failed, lastErr = c.produceOnce(ctx, topic, leaders, pending, failed, lastErr)
+		case isRetriable(err):
+			retry, lastErr = pending, err
+		default:
+			failed, lastErr = failed+len(pending), err
+		}
+		if len(retry) == 0 {
+			break
+		}
+		if attempt >= c.cfg.MaxAttempts {
+			failed += len(retry)
+			break
+		}
+		log.Warningf("Producing %d records to Kafka topic %s failed (attempt %d of %d), retrying: %v", len(retry), topic, attempt, c.cfg.MaxAttempts, lastErr)
+		select {
+		case <-ctx.Done():
+			return &ProduceError{Failed: failed + len(retry), Err: ctx.Err()}
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		pending = retry
+	}
+	if failed > 0 {
+		return &ProduceError{Failed: failed, Err: lastErr}
+	}
+	return nil
+}
+
+// produceOnce sends one produce request to the leader of each partition of
+// records, returning the records to retry, and adding the records which failed
+// with errors that are not retriable to failed.
+func (c *Client) produceOnce(ctx context.Context, topic string, leaders []int32, records []Record, failed int, lastErr error) ([]Record, int, error) {
+	// byLeader groups the records by the leader of their partition, and then by
+	// partition.
+	byLeader := map[int32]map[int32][]Record{}
+	for _, r := range records {
+		p := int32(c.partition(topic, r.Key, len(leaders)))
+		leader := leaders[p]
+		if byLeader[leader] == nil {
+			byLeader[leader] = map[int32][]Record{}
+		}
+		byLeader[leader][p] = append(byLeader[leader][p], r)
+	}
+
+	var retry []Record
+	for leader, partitions := range byLeader {
+		errs, err := c.produceToBroker(ctx, leader, topic, partitions)
+		if err != nil {
+			// The request failed as a whole, for example because the connection
+			// failed, so each of its partitions failed with err.
+			errs = map[int32]error{}
+			for p := range partitions {
+				errs[p] = err
+			}
+		}
+		for p, perr := range errs {
+			lastErr = perr
+			if isRetriable(perr) {
+				retry = append(retry, partitions[p]...)
+			} else {
+				failed += len(partitions[p])
+			}
+		}
+	}
+	return retry, failed, lastErr
+}
+
+// isRetriable returns whether a produce request which failed with err may be
+// retried: broker errors which are retriable, and connection failures.
+func isRetriable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var kerr Error
+	if errors.As(err, &kerr) {
+		return kerr.Retriable()
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errShortResponse)
+}
+
+// partition returns the partition of topic, which has n partitions, to produce
+// a record with key to.
+func (c *Client) partition(topic string, key []byte, n int) int {
+	if key != nil {
+		return partitionForKey(key, n)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.roundRobin[topic] % n
+	c.roundRobin[topic] = p + 1
+	return p
+}
+
+// produceToBroker sends a produce request for the records of each partition to
+// the broker with the given node ID, returning the error of each partition
+// which failed.
+func (c *Client) produceToBroker(ctx context.Context, nodeID int32, topic string, partitions map[int32][]Record) (map[int32]error, error) {
+	c.mu.Lock()
+	addr, ok := c.brokers[nodeID]
+	c.mu.Unlock()
+	if !ok {
+		return nil, ErrLeaderNotAvailable
+	}
+	cn, err := c.conn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	body := &encoder{}
+	body.nullableString("") // transactional ID
+	body.int16(requiredAcks)
+	body.int32(int32(c.cfg.Timeout / time.Millisecond))
+	body.int32(1)
+	body.string(topic)
+	body.int32(int32(len(partitions)))
+	for p, records := range partitions {
+		body.int32(p)
+		body.bytes(recordBatch(records, now))
+	}
+	resp, err := c.roundTrip(ctx, addr, cn, apiKeyProduce, produceVersion, body.b)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := map[int32]error{}
+	d := &decoder{b: resp}
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		d.string() // topic
+		for j, m := 0, d.arrayLen(); j < m; j++ {
+			p := d.int32()
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if code != 0 {
+				errs[p] = Error(code)
+			}
+		}
+	}
+	d.int32() // throttle time
+	if d.err != nil {
+		return nil, d.err
+	}
+	return errs, nil
+}
+
+// topicLeaders returns the node ID of the leader of each partition of topic,
+// fetching the topic's metadata if it is not known or refresh is set.
+func (c *Client) topicLeaders(ctx context.Context, topic string, refresh bool) ([]int32, error) {
+	c.mu.Lock()
+	leaders, ok := c.leaders[topic]
+	c.mu.Unlock()
+	if ok && !refresh {
+		return leaders, nil
+	}
+	if err := c.refreshMetadata(ctx, []string{topic}); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leaders[topic], nil
+}
+
+// refreshMetadata fetches the brokers of the cluster and the partitions of
+// topics from the first broker which responds.
+func (c *Client) refreshMetadata(ctx context.Context, topics []string) error {
+	c.mu.Lock()
+	addrs := append([]string(nil), c.cfg.Brokers...)
+	for _, addr := range c.brokers {
+		addrs = append(addrs, addr)
+	}
+	c.mu.Unlock()
+
+	body := &encoder{}
+	body.int32(int32(len(topics)))
+	for _, t := range topics {
+		body.string(t)
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		cn, err := c.conn(ctx, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp, err := c.roundTrip(ctx, addr, cn, apiKeyMetadata, metadataVersion, body.b)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return c.parseMetadata(resp)
+	}
+	return fmt.Errorf("failed to fetch Kafka metadata from brokers %v: %w", c.cfg.Brokers, lastErr)
+}
+
+func (c *Client) parseMetadata(resp []byte) error {
+	d := &decoder{b: resp}
+	brokers := map[int32]string{}
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32() // controller ID
+	leaders := map[string][]int32{}
+	var topicErr error
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		code := d.int16()
+		name := d.string()
+		d.int8() // is internal
+		var partitions []int32
+		for j, m := 0, d.arrayLen(); j < m; j++ {
+			d.int16() // partition error code
+			index := d.int32()
+			leader := d.int32()
+			for k, r := 0, d.arrayLen(); k < r; k++ {
+				d.int32() // replica
+			}
+			for k, r := 0, d.arrayLen(); k < r; k++ {
+				d.int32() // in-sync replica
+			}
+			if int(index) >= len(partitions) {
+				partitions = append(partitions, make([]int32, int(index)+1-len(partitions))...)
+			}
+			partitions[index] = leader
+		}
+		if code != 0 {
+			topicErr = fmt.Errorf("topic %s: %w", name, Error(code))
+			continue
+		}
+		if len(partitions) == 0 {
+			topicErr = fmt.Errorf("topic %s has no partitions: %w", name, ErrLeaderNotAvailable)
+			continue
+		}
+		leaders[name] = partitions
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.brokers = brokers
+	for name, partitions := range leaders {
+		c.leaders[name] = partitions
+	}
+	return topicErr
+}
+
+// conn is a connection to a broker. Requests on a connection are made one at a
+// time.
+type conn struct {
+	mu            sync.Mutex
+	nc            net.Conn
+	r             *bufio.Reader
+	correlationID int32
+}
+
+// conn returns the connection to the broker at addr, connecting and
+// authenticating if there is none.
+func (c *Client) conn(ctx context.Context, addr string) (*conn, error) {
+	c.mu.Lock()
+	cn, ok := c.conns[addr]
+	c.mu.Unlock()
+	if ok {
+		return cn, nil
+	}
+
+	dialer := &net.Dialer{Timeout: c.cfg.Timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Kafka broker %s: %w", addr, err)
+	}
+	if c.cfg.TLS != nil {
+		tlsCfg := c.cfg.TLS.Clone()
+		if tlsCfg.ServerName == "" {
+			host, _, _ := net.SplitHostPort(addr)
+			tlsCfg.ServerName = host
+		}
+		tc := tls.Client(nc, tlsCfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("TLS handshake with Kafka broker %s failed: %w", addr, err)
+		}
+		nc = tc
+	}
+	cn = &conn{nc: nc, r: bufio.NewReader(nc)}
+	if c.cfg.SASL != nil {
+		if err := c.authenticate(ctx, cn); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("SASL authentication with Kafka broker %s failed: %w", addr, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.conns[addr]; ok {
+		// Another request connected first.
+		nc.Close()
+		return existing, nil
+	}
+	c.conns[addr] = cn
+	return cn, nil
+}
+
+// authenticate runs the SASL handshake and exchange on a new connection.
+func (c *Client) authenticate(ctx context.Context, cn *conn) error {
+	body := &encoder{}
+	body.string(c.cfg.SASL.Mechanism)
+	resp, err := c.request(ctx, cn, apiKeySASLHandshake, saslHandshakeVersion, body.b)
+	if err != nil {
+		return err
+	}
+	d := &decoder{b: resp}
+	if code := d.int16(); code != 0 {
+		var enabled []string
+		for i, n := 0, d.arrayLen(); i < n; i++ {
+			enabled = append(enabled, d.string())
+		}
+		return fmt.Errorf("the broker does not support mechanism %s, only %v: %w", c.cfg.SASL.Mechanism, enabled, Error(code))
+	}
+	return c.cfg.SASL.authenticate(func(msg []byte) ([]byte, error) {
+		body := &encoder{}
+		body.bytes(msg)
+		resp, err := c.request(ctx, cn, apiKeySASLAuthenticate, saslAuthenticateVersion, body.b)
+		if err != nil {
+			return nil, err
+		}
+		d := &decoder{b: resp}
+		code := d.int16()
+		message := d.string()
+		reply := d.bytes()
+		if code != 0 {
+			return nil, fmt.Errorf("%s: %w", message, Error(code))
+		}
+		return reply, d.err
+	})
+}
+
+// roundTrip makes a request on the connection to the broker at addr. If the
+// request fails, the connection is closed, so that the next request
+// reconnects.
+func (c *Client) roundTrip(ctx context.Context, addr string, cn *conn, apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	resp, err := c.request(ctx, cn, apiKey, apiVersion, body)
+	if err != nil {
+		cn.nc.Close()
+		c.mu.Lock()
+		if c.conns[addr] == cn {
+			delete(c.conns, addr)
+		}
+		c.mu.Unlock()
+		return nil, fmt.Errorf("request to Kafka broker %s failed: %w", addr, err)
+	}
+	return resp, nil
+}
+
+// request sends a request on cn and returns the body of the response.
+func (c *Client) request(ctx context.Context, cn *conn, apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	deadline := time.Now().Add(c.cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := cn.nc.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	cn.correlationID++
+	req := requestHeader(apiKey, apiVersion, cn.correlationID, c.cfg.ClientID)
+	req.b = append(req.b, body...)
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(req.b)))
+	if _, err := cn.nc.Write(append(frame, req.b...)); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(cn.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > maxResponseBytes {
+		return nil, fmt.Errorf("invalid Kafka response size %d", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(cn.r, resp); err != nil {
+		return nil, err
+	}
+	if id := int32(binary.BigEndian.Uint32(resp)); id != cn.correlationID {
+		return nil, fmt.Errorf("Kafka response has correlation ID %d, want %d", id, cn.correlationID)
+	}
+	return resp[4:], nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/kafka"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+func newClient(t *testing.T, server *testhelpers.KafkaServer, cfg kafka.Config) *kafka.Client {
+	t.Helper()
+	cfg.Brokers = []string{server.Addr()}
+	cfg.RetryBackoff = time.Millisecond
+	c, err := kafka.NewClient(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestProduce(t *testing.T) {
+	server := testhelpers.NewKafkaServer(t)
+	server.AddTopic("fhir", 3)
+	c := newClient(t, server, kafka.Config{ClientID: "test"})
+
+	records := []kafka.Record{
+		{Key: []byte("p1"), Value: []byte(`{"id":"p1"}`), Headers: []kafka.Header{{Key: "resourceType", Value: []byte("Patient")}}},
+		{Key: []byte("p2"), Value: []byte(`{"id":"p2"}`)},
+		{Key: []byte("p1"), Value: nil},
+	}
+	if err := c.Produce(context.Background(), "fhir", records); err != nil {
+		t.Fatalf("Produce() returned unexpected error: %v", err)
+	}
+
+	got := server.Records()
+	if len(got) != len(records) {
+		t.Fatalf("Produce() produced %d records, want %d", len(got), len(records))
+	}
+	byKey := map[string][]testhelpers.KafkaRecord{}
+	for _, r := range got {
+		byKey[string(r.Key)] = append(byKey[string(r.Key)], r)
+	}
+	p1 := byKey["p1"]
+	if len(p1) != 2 {
+		t.Fatalf("Produce() produced %d records with key p1, want 2", len(p1))
+	}
+	if p1[0].Partition != p1[1].Partition {
+		t.Errorf("Produce() produced records with the same key to partitions %d and %d, want the same partition", p1[0].Partition, p1[1].Partition)
+	}
+	want := testhelpers.KafkaRecord{Topic: "fhir", Partition: p1[0].Partition, Key: []byte("p1"), Value: []byte(`{"id":"p1"}`), Headers: map[string]string{"resourceType": "Patient"}}
+	if diff := cmp.Diff(want, p1[0]); diff != "" {
+		t.Errorf("Produce() produced unexpected record (-want +got): %s", diff)
+	}
+	if p1[1].Value != nil {
+		t.Errorf("Produce() produced tombstone with value %q, want nil", p1[1].Value)
+	}
+}
+
+func TestProduce_Retries(t *testing.T) {
+	cases := []struct {
+		name         string
+		code         int16
+		failures     int
+		wantFailed   int
+		wantRequests int
+	}{
+		{name: "RetriableSucceeds", code: int16(kafka.ErrNotLeaderForPartition), failures: 2, wantRequests: 3},
+		{name: "RetriableExhausted", code: int16(kafka.ErrNotEnoughReplicas), failures: 3, wantFailed: 2, wantRequests: 3},
+		{name: "NotRetriable", code: int16(kafka.ErrMessageTooLarge), failures: 1, wantFailed: 2, wantRequests: 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := testhelpers.NewKafkaServer(t)
+			server.AddTopic("fhir", 1)
+			server.FailNext(tc.code, tc.failures)
+			c := newClient(t, server, kafka.Config{MaxAttempts: 3})
+
+			err := c.Produce(context.Background(), "fhir", []kafka.Record{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("2")}})
+			var perr *kafka.ProduceError
+			switch {
+			case tc.wantFailed == 0 && err != nil:
+				t.Errorf("Produce() returned unexpected error: %v", err)
+			case tc.wantFailed > 0 && !errors.As(err, &perr):
+				t.Errorf("Produce() returned error %v, want a *ProduceError", err)
+			case tc.wantFailed > 0 && perr.Failed != tc.wantFailed:
+				t.Errorf("Produce() returned error for %d records, want %d", perr.Failed, tc.wantFailed)
+			case tc.wantFailed > 0 && !errors.Is(err, kafka.Error(tc.code)):
+				t.Errorf("Produce() returned error %v, want %v", err, kafka.Error(tc.code))
+			}
+			if got := server.ProduceRequests(); got != tc.wantRequests {
+				t.Errorf("Produce() made %d produce requests, want %d", got, tc.wantRequests)
+			}
+		})
+	}
+}
+
+func TestProduce_UnknownTopic(t *testing.T) {
+	server := testhelpers.NewKafkaServer(t)
+	c := newClient(t, server, kafka.Config{MaxAttempts: 2})
+	err := c.Produce(context.Background(), "missing", []kafka.Record{{Value: []byte("1")}})
+	if !errors.Is(err, kafka.ErrUnknownTopicOrPartition) {
+		t.Errorf("Produce() to a missing topic returned error %v, want %v", err, kafka.ErrUnknownTopicOrPartition)
+	}
+}
+
+func TestNewClient_SASLPlain(t *testing.T) {
+	for _, password := range []string{"secret", "wrong"} {
+		t.Run(fmt.Sprintf("password=%s", password), func(t *testing.T) {
+			server := testhelpers.NewKafkaServer(t)
+			server.AddTopic("fhir", 1)
+			server.RequireSASLPlain("user", "secret")
+			cfg := kafka.Config{
+				Brokers: []string{server.Addr()},
+				SASL:    &kafka.SASL{Mechanism: kafka.SASLPlain, Username: "user", Password: password},
+			}
+			c, err := kafka.NewClient(context.Background(), cfg)
+			if password == "wrong" {
+				if err == nil {
+					c.Close()
+					t.Fatalf("NewClient() with the wrong password succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			defer c.Close()
+			if err := c.Produce(context.Background(), "fhir", []kafka.Record{{Value: []byte("1")}}); err != nil {
+				t.Errorf("Produce() returned unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewClient_NoBrokers(t *testing.T) {
+	if _, err := kafka.NewClient(context.Background(), kafka.Config{}); err == nil {
+		t.Errorf("NewClient() without brokers succeeded, want error")
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+// The keys and versions of the Kafka API requests made by the Client. These
+// versions are supported by every broker since Kafka 1.0.
+const (
+	apiKeyProduce          int16 = 0
+	apiKeyMetadata         int16 = 3
+	apiKeySASLHandshake    int16 = 17
+	apiKeySASLAuthenticate int16 = 36
+
+	produceVersion          int16 = 3
+	metadataVersion         int16 = 1
+	saslHandshakeVersion    int16 = 1
+	saslAuthenticateVersion int16 = 0
+)
+
+// requiredAcks is the acks of produce requests: all in-sync replicas must
+// have written the records before the broker responds.
+const requiredAcks int16 = -1
+
+var errShortResponse = errors.New("truncated Kafka response")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// encoder appends values to a request in the Kafka protocol's encoding.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) int8(v int8)   { e.b = append(e.b, byte(v)) }
+func (e *encoder) int16(v int16) { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *encoder) int32(v int32) { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *encoder) int64(v int64) { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+func (e *encoder) varint(v int64) {
+	e.b = binary.AppendVarint(e.b, v)
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// nullableString encodes s, or null if s is empty.
+func (e *encoder) nullableString(s string) {
+	if s == "" {
+		e.int16(-1)
+		return
+	}
+	e.string(s)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// varBytes encodes b with a varint length, as in records, where nil is
+// encoded as null.
+func (e *encoder) varBytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// decoder reads values from a response in the Kafka protocol's encoding. Once
+// the response is found to be truncated, every value read is zero, and err is
+// set.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.b) < n {
+		d.err = errShortResponse
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+// arrayLen reads the length of an array, treating null as empty.
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	// Each element is at least one byte, so this bounds allocations made for
+	// corrupt lengths.
+	if int(n) > len(d.b) {
+		d.err = errShortResponse
+		return 0
+	}
+	return int(n)
+}
+
+// requestHeader encodes the header of a request, version 1.
+func requestHeader(apiKey, apiVersion int16, correlationID int32, clientID string) *encoder {
+	e := &encoder{}
+	e.int16(apiKey)
+	e.int16(apiVersion)
+	e.int32(correlationID)
+	e.nullableString(clientID)
+	return e
+}
+
+// recordBatch encodes records as a record batch, magic version 2, with
+// timestamps of now.
+func recordBatch(records []Record, now time.Time) []byte {
+	ts := now.UnixMilli()
+	body := &encoder{}
+	body.int16(0) // attributes: no compression, create time timestamps.
+	body.int32(int32(len(records) - 1))
+	body.int64(ts)
+	body.int64(ts)
+	body.int64(-1) // producer ID
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(records)))
+	for i, r := range records {
+		rec := &encoder{}
+		rec.int8(0) // attributes
+		rec.varint(0)
+		rec.varint(int64(i))
+		rec.varBytes(r.Key)
+		rec.varBytes(r.Value)
+		rec.varint(int64(len(r.Headers)))
+		for _, h := range r.Headers {
+			rec.varint(int64(len(h.Key)))
+			rec.b = append(rec.b, h.Key...)
+			rec.varBytes(h.Value)
+		}
+		body.varint(int64(len(rec.b)))
+		body.b = append(body.b, rec.b...)
+	}
+
+	batch := &encoder{}
+	batch.int64(0) // base offset
+	// The length counts the bytes from the partition leader epoch on.
+	batch.int32(int32(4 + 1 + 4 + len(body.b)))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body.b, crc32c)))
+	batch.b = append(batch.b, body.b...)
+	return batch.b
+}
+
+// murmur2 is the hash Kafka's Java producer partitions records by key, so that
+// records with the same key are produced to the same partition whichever
+// client produces them.
+func murmur2(data []byte) uint32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+	n := len(data)
+	h := seed ^ uint32(n)
+	for i := 0; i+4 <= n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[n&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// partitionForKey returns the partition of the n partitions of a topic to
+// which a record with key is produced, as Kafka's Java producer does.
+func partitionForKey(key []byte, n int) int {
+	return int(murmur2(key)&0x7fffffff) % n
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The SASL mechanisms supported by the Client.
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// SASL holds the credentials with which the Client authenticates to the
+// brokers.
+type SASL struct {
+	// Mechanism is one of SASLPlain, SASLScramSHA256 or SASLScramSHA512. PLAIN
+	// sends the password to the broker, so should only be used over TLS.
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+func (s *SASL) validate() error {
+	switch s.Mechanism {
+	case SASLPlain, SASLScramSHA256, SASLScramSHA512:
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %q, want one of %s, %s or %s", s.Mechanism, SASLPlain, SASLScramSHA256, SASLScramSHA512)
+	}
+	if s.Username == "" {
+		return errors.New("a SASL username is required")
+	}
+	return nil
+}
+
+// authenticate runs the SASL exchange of the mechanism, calling exchange to
+// send each client message and receive the broker's reply.
+func (s *SASL) authenticate(exchange func([]byte) ([]byte, error)) error {
+	switch s.Mechanism {
+	case SASLPlain:
+		_, err := exchange([]byte("\x00" + s.Username + "\x00" + s.Password))
+		return err
+	case SASLScramSHA256:
+		return scram(sha256.New, s.Username, s.Password, exchange)
+	case SASLScramSHA512:
+		return scram(sha512.New, s.Username, s.Password, exchange)
+	}
+	return fmt.Errorf("unsupported SASL mechanism %q", s.Mechanism)
+}
+
+// newSCRAMNonce returns a random client nonce. It is a variable so that tests
+// can use known nonces.
+var newSCRAMNonce = func() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// scram runs a SCRAM exchange (RFC 5802) without channel binding.
+func scram(h func() hash.Hash, username, password string, exchange func([]byte) ([]byte, error)) error {
+	nonce, err := newSCRAMNonce()
+	if err != nil {
+		return err
+	}
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(username)
+	clientFirstBare := "n=" + name + ",r=" + nonce
+
+	serverFirst, err := exchange([]byte("n,," + clientFirstBare))
+	if err != nil {
+		return err
+	}
+	attrs := scramAttributes(string(serverFirst))
+	serverNonce, salt64, iterations := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(serverNonce, nonce) || len(serverNonce) == len(nonce) {
+		return errors.New("SCRAM server nonce does not extend the client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return fmt.Errorf("invalid SCRAM salt: %w", err)
+	}
+	iter, err := strconv.Atoi(iterations)
+	if err != nil || iter < 1 {
+		return fmt.Errorf("invalid SCRAM iteration count %q", iterations)
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iter, h().Size(), h)
+	clientKey := hmacSum(h, saltedPassword, "Client Key")
+	storedKey := h()
+	storedKey.Write(clientKey)
+	clientFinalWithoutProof := "c=biws,r=" + serverNonce
+	authMessage := clientFirstBare + "," + string(serverFirst) + "," + clientFinalWithoutProof
+	proof := hmacSum(h, storedKey.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	serverFinal, err := exchange([]byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	attrs = scramAttributes(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("SCRAM authentication failed: %s", e)
+	}
+	serverSignature := hmacSum(h, hmacSum(h, saltedPassword, "Server Key"), authMessage)
+	got, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || subtle.ConstantTimeCompare(got, serverSignature) != 1 {
+		return errors.New("SCRAM server signature is invalid")
+	}
+	return nil
+}
+
+func hmacSum(h func() hash.Hash, key []byte, message string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// scramAttributes parses a SCRAM message of the form "a=value,b=value".
+func scramAttributes(msg string) map[string]string {
+	attrs := map[string]string{}
+	for _, part := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
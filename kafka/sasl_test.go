@@ -0,0 +1,76 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSCRAMSHA256(t *testing.T) {
+	// The example exchange of RFC 7677.
+	defer func(f func() (string, error)) { newSCRAMNonce = f }(newSCRAMNonce)
+	newSCRAMNonce = func() (string, error) { return "rOprNGfwEbeRWgbNEkqO", nil }
+	exchanges := []struct{ client, server string }{
+		{
+			client: "n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+			server: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		},
+		{
+			client: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			server: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	}
+	for _, tc := range []struct {
+		name        string
+		password    string
+		wantSuccess bool
+	}{
+		{name: "ValidPassword", password: "pencil", wantSuccess: true},
+		{name: "InvalidPassword", password: "crayon"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			i := 0
+			sasl := &SASL{Mechanism: SASLScramSHA256, Username: "user", Password: tc.password}
+			err := sasl.authenticate(func(msg []byte) ([]byte, error) {
+				if i >= len(exchanges) {
+					return nil, errors.New("too many SCRAM messages")
+				}
+				want := exchanges[i]
+				i++
+				if string(msg) != want.client {
+					// A broker rejects the proof of the wrong password.
+					return nil, errors.New("unexpected SCRAM message")
+				}
+				return []byte(want.server), nil
+			})
+			if tc.wantSuccess && err != nil {
+				t.Errorf("authenticate() returned unexpected error: %v", err)
+			}
+			if !tc.wantSuccess && err == nil {
+				t.Errorf("authenticate() with the wrong password succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestSASLValidate(t *testing.T) {
+	if err := (&SASL{Mechanism: "GSSAPI", Username: "u"}).validate(); err == nil {
+		t.Errorf("validate() of an unsupported mechanism succeeded, want error")
+	}
+	if err := (&SASL{Mechanism: SASLPlain}).validate(); err == nil {
+		t.Errorf("validate() without a username succeeded, want error")
+	}
+}
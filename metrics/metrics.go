@@ -0,0 +1,77 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics defines the Recorder interface through which the counters
+// and latencies of the bulk_fhir_tools libraries are recorded. Programs
+// embedding the libraries, for example to run a fetcher.Fetcher, can pass a
+// Recorder to fetcher.SetMetricsRecorder to send the metrics to their own
+// telemetry: NoOp discards them, and the prometheus and opencensus subpackages
+// provide Recorders for those systems.
+package metrics
+
+import "context"
+
+// Aggregation is how the values recorded by a Counter are aggregated.
+type Aggregation int
+
+const (
+	// Count sums the values recorded.
+	Count Aggregation = iota
+	// LastValue keeps the last value recorded. The local implementation used by
+	// default by bulk_fhir_fetch reports the maximum value recorded instead.
+	LastValue
+)
+
+// Recorder creates the metrics recorded by the libraries. NewCounter and
+// NewLatency are called once for each metric, with a name unique among all
+// metrics, before its first value is recorded. TagKeys are labels which
+// describe a closed set of values, for example FHIR resource type, and the
+// tagValues passed to Record match them in order. Metrics do not hold any PHI.
+type Recorder interface {
+	NewCounter(name, description, unit string, aggregation Aggregation, tagKeys ...string) (Counter, error)
+	// NewLatency creates a distribution of values, defined by buckets. For
+	// example, buckets [0, 3, 5] define 4 buckets: <0, >=0 <3, >=3 <5 and >=5.
+	NewLatency(name, description, unit string, buckets []float64, tagKeys ...string) (Latency, error)
+}
+
+// Counter records int64 values, aggregated as given to Recorder.NewCounter.
+type Counter interface {
+	Record(ctx context.Context, val int64, tagValues ...string) error
+}
+
+// Latency records float64 values into a distribution.
+type Latency interface {
+	Record(ctx context.Context, val float64, tagValues ...string) error
+}
+
+// NoOp is a Recorder which discards all metrics.
+var NoOp Recorder = noOpRecorder{}
+
+type noOpRecorder struct{}
+
+func (noOpRecorder) NewCounter(name, description, unit string, aggregation Aggregation, tagKeys ...string) (Counter, error) {
+	return noOpCounter{}, nil
+}
+
+func (noOpRecorder) NewLatency(name, description, unit string, buckets []float64, tagKeys ...string) (Latency, error) {
+	return noOpLatency{}, nil
+}
+
+type noOpCounter struct{}
+
+func (noOpCounter) Record(ctx context.Context, val int64, tagValues ...string) error { return nil }
+
+type noOpLatency struct{}
+
+func (noOpLatency) Record(ctx context.Context, val float64, tagValues ...string) error { return nil }
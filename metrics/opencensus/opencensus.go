@@ -0,0 +1,49 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package opencensus provides a metrics.Recorder which records metrics as
+// OpenCensus measures, each with a registered view, for export by whichever
+// OpenCensus exporters the embedding program has set up.
+package opencensus
+
+import (
+	"github.com/google/bulk_fhir_tools/internal/metrics/opencensus"
+	"github.com/google/bulk_fhir_tools/metrics"
+)
+
+type recorder struct{}
+
+// NewRecorder returns a metrics.Recorder which records metrics with
+// OpenCensus. Counters with the Count aggregation are exported as counts of
+// the values recorded, and with the LastValue aggregation as the last value
+// recorded. Latencies are exported as distributions.
+func NewRecorder() metrics.Recorder {
+	return recorder{}
+}
+
+func (recorder) NewCounter(name, description, unit string, aggregation metrics.Aggregation, tagKeys ...string) (metrics.Counter, error) {
+	c := &opencensus.Counter{}
+	if err := c.Init(name, description, unit, aggregation, tagKeys...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (recorder) NewLatency(name, description, unit string, buckets []float64, tagKeys ...string) (metrics.Latency, error) {
+	l := &opencensus.Latency{}
+	if err := l.Init(name, description, unit, buckets, tagKeys...); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
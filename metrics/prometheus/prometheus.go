@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prometheus provides a metrics.Recorder which records metrics as
+// Prometheus collectors, registered with a prometheus.Registerer for the
+// embedding program to serve.
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/google/bulk_fhir_tools/metrics"
+)
+
+var (
+	errMatchingTags  = errors.New("there must be an equal number of tagKeys and tagValues")
+	errNegativeCount = errors.New("Prometheus counters cannot decrease")
+)
+
+// invalidNameChars matches the characters which may not appear in Prometheus
+// metric and label names.
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// sanitizeName returns name with characters which Prometheus does not allow,
+// such as the dashes in the library's metric names, replaced by underscores.
+func sanitizeName(name string) string {
+	name = invalidNameChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+type recorder struct {
+	registerer prometheus.Registerer
+	namespace  string
+}
+
+// NewRecorder returns a metrics.Recorder which registers a collector for each
+// metric with registerer, named with the given namespace (which may be empty)
+// and the metric's name, with characters which Prometheus does not allow
+// replaced by underscores. Counters with the Count aggregation are Prometheus
+// counters of the sum of the values recorded, and with the LastValue
+// aggregation are gauges holding the last value recorded. Latencies are
+// histograms with the metric's buckets.
+func NewRecorder(registerer prometheus.Registerer, namespace string) metrics.Recorder {
+	return &recorder{registerer: registerer, namespace: sanitizeName(namespace)}
+}
+
+func labelNames(tagKeys []string) []string {
+	names := make([]string, len(tagKeys))
+	for i, k := range tagKeys {
+		names[i] = sanitizeName(k)
+	}
+	return names
+}
+
+func (r *recorder) NewCounter(name, description, unit string, aggregation metrics.Aggregation, tagKeys ...string) (metrics.Counter, error) {
+	if aggregation == metrics.LastValue {
+		g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: r.namespace, Name: sanitizeName(name), Help: description}, labelNames(tagKeys))
+		if err := r.registerer.Register(g); err != nil {
+			return nil, err
+		}
+		return &gauge{vec: g, numTags: len(tagKeys)}, nil
+	}
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: r.namespace, Name: sanitizeName(name), Help: description}, labelNames(tagKeys))
+	if err := r.registerer.Register(c); err != nil {
+		return nil, err
+	}
+	return &counter{vec: c, numTags: len(tagKeys)}, nil
+}
+
+func (r *recorder) NewLatency(name, description, unit string, buckets []float64, tagKeys ...string) (metrics.Latency, error) {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: r.namespace, Name: sanitizeName(name), Help: description, Buckets: buckets}, labelNames(tagKeys))
+	if err := r.registerer.Register(h); err != nil {
+		return nil, err
+	}
+	return &histogram{vec: h, numTags: len(tagKeys)}, nil
+}
+
+type counter struct {
+	vec     *prometheus.CounterVec
+	numTags int
+}
+
+func (c *counter) Record(_ context.Context, val int64, tagValues ...string) error {
+	if len(tagValues) != c.numTags {
+		return errMatchingTags
+	}
+	if val < 0 {
+		return errNegativeCount
+	}
+	c.vec.WithLabelValues(tagValues...).Add(float64(val))
+	return nil
+}
+
+type gauge struct {
+	vec     *prometheus.GaugeVec
+	numTags int
+}
+
+func (g *gauge) Record(_ context.Context, val int64, tagValues ...string) error {
+	if len(tagValues) != g.numTags {
+		return errMatchingTags
+	}
+	g.vec.WithLabelValues(tagValues...).Set(float64(val))
+	return nil
+}
+
+type histogram struct {
+	vec     *prometheus.HistogramVec
+	numTags int
+}
+
+func (h *histogram) Record(_ context.Context, val float64, tagValues ...string) error {
+	if len(tagValues) != h.numTags {
+		return errMatchingTags
+	}
+	h.vec.WithLabelValues(tagValues...).Observe(val)
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/google/bulk_fhir_tools/metrics"
+)
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewPedanticRegistry()
+	r := NewRecorder(reg, "bulk-fhir")
+
+	c, err := r.NewCounter("download-counter", "Downloads.", "1", metrics.Count, "Outcome")
+	if err != nil {
+		t.Fatalf("NewCounter() returned unexpected error: %v", err)
+	}
+	c.Record(ctx, 2, "OK")
+	c.Record(ctx, 3, "OK")
+	c.Record(ctx, 1, "THROTTLED")
+	if err := c.Record(ctx, 1); err == nil {
+		t.Error("Counter.Record() with too few tag values succeeded, want error")
+	}
+
+	g, err := r.NewCounter("workers", "Workers.", "1", metrics.LastValue)
+	if err != nil {
+		t.Fatalf("NewCounter() returned unexpected error: %v", err)
+	}
+	g.Record(ctx, 8)
+	g.Record(ctx, 2)
+
+	l, err := r.NewLatency("process-url-time", "Processing time.", "min", []float64{1, 5})
+	if err != nil {
+		t.Fatalf("NewLatency() returned unexpected error: %v", err)
+	}
+	l.Record(ctx, 0.5)
+	l.Record(ctx, 3)
+
+	want := `
+# HELP bulk_fhir_download_counter Downloads.
+# TYPE bulk_fhir_download_counter counter
+bulk_fhir_download_counter{Outcome="OK"} 5
+bulk_fhir_download_counter{Outcome="THROTTLED"} 1
+# HELP bulk_fhir_process_url_time Processing time.
+# TYPE bulk_fhir_process_url_time histogram
+bulk_fhir_process_url_time_bucket{le="1"} 1
+bulk_fhir_process_url_time_bucket{le="5"} 2
+bulk_fhir_process_url_time_bucket{le="+Inf"} 2
+bulk_fhir_process_url_time_sum 3.5
+bulk_fhir_process_url_time_count 2
+# HELP bulk_fhir_workers Workers.
+# TYPE bulk_fhir_workers gauge
+bulk_fhir_workers 2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Errorf("unexpected metrics: %v", err)
+	}
+}
+
+func TestRecorder_DuplicateName(t *testing.T) {
+	r := NewRecorder(prometheus.NewRegistry(), "")
+	if _, err := r.NewCounter("counter", "Counter.", "1", metrics.Count); err != nil {
+		t.Fatalf("NewCounter() returned unexpected error: %v", err)
+	}
+	if _, err := r.NewCounter("counter", "Counter.", "1", metrics.Count); err == nil {
+		t.Error("NewCounter() with a name already registered succeeded, want error")
+	}
+}
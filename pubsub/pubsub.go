@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pubsub publishes messages to a GCP Pub/Sub topic.
+package pubsub
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"google.golang.org/api/option"
+	pubsubapi "google.golang.org/api/pubsub/v1"
+)
+
+// DefaultPubSubEndpoint is the default Pub/Sub API endpoint. This should be
+// passed to NewClient, unless in a test environment.
+const DefaultPubSubEndpoint = "https://pubsub.googleapis.com/"
+
+const pubsubHost = "pubsub.googleapis.com"
+
+const (
+	// MaxBatchMessages is the most messages Pub/Sub accepts in one publish
+	// request.
+	MaxBatchMessages = 1000
+	// MaxBatchBytes is the most bytes of message data and attributes to send in
+	// one publish request. Pub/Sub accepts requests of up to 10MB, including
+	// the overhead of encoding the messages, so this leaves some headroom.
+	MaxBatchBytes = 7 * 1000 * 1000
+	// MaxMessageBytes is the largest message Pub/Sub accepts.
+	MaxMessageBytes = 10 * 1000 * 1000
+)
+
+var topicNameRegex = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+
+// IsTopicName returns whether value is a Pub/Sub topic resource name, for
+// example "projects/p/topics/t".
+func IsTopicName(value string) bool {
+	return topicNameRegex.MatchString(value)
+}
+
+// Message is a message to publish.
+type Message struct {
+	Data       []byte
+	Attributes map[string]string
+}
+
+// Size returns the number of bytes of the message's data and attributes, which
+// count towards MaxBatchBytes.
+func (m Message) Size() int {
+	n := len(m.Data)
+	for k, v := range m.Attributes {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// Client publishes messages to a single Pub/Sub topic.
+type Client struct {
+	service *pubsubapi.Service
+	topic   string
+}
+
+// NewClient initializes and returns a new Pub/Sub client for the topic with the
+// given resource name, at the given endpoint.
+func NewClient(ctx context.Context, endpoint, topic string) (*Client, error) {
+	if !IsTopicName(topic) {
+		return nil, fmt.Errorf("invalid Pub/Sub topic name %q, must be of the form projects/<project>/topics/<topic>", topic)
+	}
+	var service *pubsubapi.Service
+	var err error
+	if u, perr := url.Parse(endpoint); perr == nil && u.Scheme == "https" && u.Hostname() == pubsubHost {
+		service, err = pubsubapi.NewService(ctx, option.WithEndpoint(endpoint))
+	} else {
+		// As in fhirstore.NewClient, non-Google endpoints are generally test
+		// servers, so no credentials are looked up.
+		service, err = pubsubapi.NewService(ctx, option.WithHTTPClient(&http.Client{}), option.WithEndpoint(endpoint))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Client{service: service, topic: topic}, nil
+}
+
+// Topic returns the resource name of the client's topic.
+func (c *Client) Topic() string { return c.topic }
+
+// Publish publishes msgs, which must fit in one request (see MaxBatchMessages
+// and MaxBatchBytes), and returns the IDs the server assigned them.
+func (c *Client) Publish(ctx context.Context, msgs []Message) ([]string, error) {
+	req := &pubsubapi.PublishRequest{}
+	for _, m := range msgs {
+		req.Messages = append(req.Messages, &pubsubapi.PubsubMessage{
+			Data:       base64.StdEncoding.EncodeToString(m.Data),
+			Attributes: m.Attributes,
+		})
+	}
+	resp, err := c.service.Projects.Topics.Publish(c.topic, req).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error publishing %d messages to Pub/Sub topic %s: %w", len(msgs), c.topic, err)
+	}
+	return resp.MessageIds, nil
+}
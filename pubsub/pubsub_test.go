@@ -0,0 +1,89 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pubsub_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/pubsub"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+const topic = "projects/p/topics/t"
+
+func TestIsTopicName(t *testing.T) {
+	cases := []struct {
+		value string
+		want  bool
+	}{
+		{topic, true},
+		{"projects/my-project/topics/fhir-resources", true},
+		{topic + "/subscriptions/s", false},
+		{"topics/t", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		if got := pubsub.IsTopicName(tc.value); got != tc.want {
+			t.Errorf("IsTopicName(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	server := testhelpers.NewPubSubServer(t, topic)
+	ctx := context.Background()
+	c, err := pubsub.NewClient(ctx, server.URL(), topic)
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	msgs := []pubsub.Message{
+		{Data: []byte(`{"resourceType":"Patient"}`), Attributes: map[string]string{"resourceType": "Patient"}},
+		{Data: []byte("second")},
+	}
+	ids, err := c.Publish(ctx, msgs)
+	if err != nil {
+		t.Fatalf("Publish() returned unexpected error: %v", err)
+	}
+	if len(ids) != len(msgs) {
+		t.Errorf("Publish() returned %d IDs, want %d", len(ids), len(msgs))
+	}
+	want := []testhelpers.PubSubMessage{
+		{Data: msgs[0].Data, Attributes: msgs[0].Attributes},
+		{Data: msgs[1].Data},
+	}
+	if diff := cmp.Diff(want, server.Messages()); diff != "" {
+		t.Errorf("Publish() published unexpected messages (-want +got): %s", diff)
+	}
+
+	server.FailNext(1)
+	if _, err := c.Publish(ctx, msgs); err == nil {
+		t.Errorf("Publish() succeeded when the server failed, want error")
+	}
+}
+
+func TestNewClient_InvalidTopic(t *testing.T) {
+	if _, err := pubsub.NewClient(context.Background(), pubsub.DefaultPubSubEndpoint, "t"); err == nil {
+		t.Errorf("NewClient() with an invalid topic succeeded, want error")
+	}
+}
+
+func TestMessageSize(t *testing.T) {
+	m := pubsub.Message{Data: []byte("12345"), Attributes: map[string]string{"ab": "cde"}}
+	if got := m.Size(); got != 10 {
+		t.Errorf("Size() = %d, want 10", got)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package s3 contains helpers that facilitate data transfer of Resources into
+// Amazon S3, parallel to the gcs package.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/google/bulk_fhir_tools/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultRegion is the region requests are sent to if none is configured with
+// the AWS_REGION environment variable or the shared config file.
+const DefaultRegion = "us-east-1"
+
+// ErrInvalidS3Path is an error indicating the S3 path is not valid.
+var ErrInvalidS3Path = errors.New("the S3 path is not valid. a bucket and folder must be included, along with a s3:// prefix. For example s3://bucket/folder")
+
+// ErrObjectNotExist is returned (wrapped) when reading an object which does
+// not exist.
+var ErrObjectNotExist = errors.New("S3 object does not exist")
+
+// Client reads and writes objects in an S3 bucket. Call NewClient to create
+// one.
+type Client struct {
+	service    *s3.S3
+	uploader   *s3manager.Uploader
+	bucketName string
+}
+
+// ClientOption configures a Client created by NewClient.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	credentials *credentials.Credentials
+	partSize    int64
+}
+
+// WithCredentials makes the Client sign requests with c. By default the AWS
+// credential chain is used, which reads the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY environment variables, the shared credentials file and
+// the credentials of the instance or task role.
+func WithCredentials(c *credentials.Credentials) ClientOption {
+	return func(o *clientOptions) { o.credentials = c }
+}
+
+// WithPartSize sets the size in bytes of each part of the multipart uploads
+// of files written with GetFileWriter. The data for each part is buffered in
+// memory. Files smaller than this are uploaded in a single request. Defaults
+// to 5MiB, the minimum S3 allows.
+func WithPartSize(n int64) ClientOption {
+	return func(o *clientOptions) { o.partSize = n }
+}
+
+// NewClient creates and returns a new S3 client for the existing bucket
+// bucketName. If endpointURL is empty, the S3 endpoint of the configured
+// region is used; otherwise requests are sent to endpointURL with path style
+// URLs, which is generally used in tests or with S3 compatible storage.
+func NewClient(ctx context.Context, bucketName, endpointURL string, opts ...ClientOption) (Client, error) {
+	if bucketName == "" {
+		return Client{}, errors.New("an S3 bucket name is required")
+	}
+	o := &clientOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	awsCfg := aws.NewConfig()
+	if o.credentials != nil {
+		awsCfg = awsCfg.WithCredentials(o.credentials)
+	}
+	if endpointURL != "" {
+		awsCfg = awsCfg.WithEndpoint(endpointURL).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{Config: *awsCfg, SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess.Config.Region = aws.String(DefaultRegion)
+	}
+	service := s3.New(sess)
+	uploader := s3manager.NewUploaderWithClient(service, func(u *s3manager.Uploader) {
+		if o.partSize > 0 {
+			u.PartSize = o.partSize
+		}
+	})
+	return Client{service: service, uploader: uploader, bucketName: bucketName}, nil
+}
+
+// GetFileWriter returns a writer to the object named fileName. The object is
+// uploaded as it is written, in a multipart upload if it is larger than the
+// part size, and the upload completes when the writer is closed, which returns
+// any error.
+func (c Client) GetFileWriter(ctx context.Context, fileName string) io.WriteCloser {
+	ctx, span := tracing.Start(ctx, "s3.Upload",
+		attribute.String("s3.bucket", c.bucketName),
+		attribute.String("s3.object", fileName))
+	pr, pw := io.Pipe()
+	w := &uploadWriter{pw: pw, done: make(chan error, 1), span: span}
+	go func() {
+		_, err := c.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket: aws.String(c.bucketName),
+			Key:    aws.String(fileName),
+			Body:   pr,
+		})
+		// Unblock any writes if the upload fails before reading everything.
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w
+}
+
+type uploadWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+	span trace.Span
+	n    int64
+}
+
+func (w *uploadWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *uploadWriter) Close() error {
+	w.pw.Close()
+	err := <-w.done
+	if err != nil {
+		err = fmt.Errorf("error uploading to S3: %w", err)
+	}
+	w.span.SetAttributes(attribute.Int64("s3.uploaded_bytes", w.n))
+	tracing.End(w.span, err)
+	return err
+}
+
+// GetConditionalFileWriter returns a writer to the object named fileName,
+// whose Close returns an error for which IsPreconditionFailed returns true if
+// the object's ETag is no longer etag, or, if etag is empty, if the object
+// exists. The content is buffered in memory and uploaded on Close.
+func (c Client) GetConditionalFileWriter(ctx context.Context, fileName, etag string) io.WriteCloser {
+	return &conditionalWriter{ctx: ctx, client: c, fileName: fileName, etag: etag}
+}
+
+type conditionalWriter struct {
+	bytes.Buffer
+	ctx      context.Context
+	client   Client
+	fileName string
+	etag     string
+}
+
+func (w *conditionalWriter) Close() error {
+	_, err := w.client.WriteConditional(w.ctx, w.fileName, w.Bytes(), w.etag)
+	return err
+}
+
+// WriteConditional writes data to the object on the same condition as
+// GetConditionalFileWriter, and returns the ETag of the new object.
+func (c Client) WriteConditional(ctx context.Context, fileName string, data []byte, etag string) (string, error) {
+	header := map[string]string{"If-None-Match": "*"}
+	if etag != "" {
+		header = map[string]string{"If-Match": etag}
+	}
+	out, err := c.service.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(fileName),
+		Body:   bytes.NewReader(data),
+	}, request.WithSetRequestHeaders(header))
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+// IsPreconditionFailed returns whether err is the error returned by S3 when
+// the conditions of a request, such as those of GetConditionalFileWriter, are
+// not met, including when a concurrent conditional write won.
+func IsPreconditionFailed(err error) bool {
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && (reqErr.StatusCode() == http.StatusPreconditionFailed || reqErr.StatusCode() == http.StatusConflict)
+}
+
+// GetFileReader returns a reader for the object named fileName. An error
+// wrapping ErrObjectNotExist is returned if the object is not found.
+//
+// The caller must call Close on the returned Reader when done reading.
+func (c Client) GetFileReader(ctx context.Context, fileName string) (io.ReadCloser, error) {
+	r, _, err := c.GetFileReaderWithETag(ctx, fileName)
+	return r, err
+}
+
+// GetFileReaderWithETag is like GetFileReader, but also returns the ETag of the
+// object being read, to be passed to GetConditionalFileWriter.
+func (c Client) GetFileReaderWithETag(ctx context.Context, fileName string) (io.ReadCloser, string, error) {
+	out, err := c.service.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(fileName),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, "", fmt.Errorf("%w: s3://%s/%s", ErrObjectNotExist, c.bucketName, fileName)
+		}
+		return nil, "", err
+	}
+	return out.Body, aws.StringValue(out.ETag), nil
+}
+
+// JoinPath joins the elements of an object name with forward slashes, after
+// converting any backslashes to forward slashes and removing leading and
+// trailing slashes from each. See gcs.JoinPath.
+func JoinPath(elems ...string) string {
+	var cleaned []string
+	for _, e := range elems {
+		cleaned = append(cleaned, strings.Trim(strings.ReplaceAll(e, `\`, `/`), `/`))
+	}
+	return strings.Join(cleaned, `/`)
+}
+
+// PathComponents takes an S3 path (e.g. s3://some_bucket/relative/path) and
+// returns the bucket name and the relative path. For example,
+// s3://some_bucket/relative/path would return some_bucket and relative/path.
+// At least a bucket and a folder must be included.
+func PathComponents(uri string) (bucket, relativePath string, err error) {
+	if !strings.HasPrefix(uri, "s3://") {
+		return "", "", ErrInvalidS3Path
+	}
+	bucket, relativePath, ok := strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+	if !ok || relativePath == "" {
+		return "", "", ErrInvalidS3Path
+	}
+	return bucket, relativePath, nil
+}
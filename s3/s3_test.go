@@ -0,0 +1,173 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+func newTestClient(t *testing.T, server *testhelpers.S3Server, opts ...ClientOption) Client {
+	t.Helper()
+	opts = append([]ClientOption{WithCredentials(credentials.NewStaticCredentials("id", "secret", ""))}, opts...)
+	c, err := NewClient(context.Background(), "bucket", server.URL(), opts...)
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	return c
+}
+
+func TestS3ClientWritesFile(t *testing.T) {
+	server := testhelpers.NewS3Server(t)
+	c := newTestClient(t, server)
+
+	w := c.GetFileWriter(context.Background(), "dir/file.ndjson")
+	if _, err := w.Write([]byte("Hello World")); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+
+	got, ok := server.GetObject("bucket", "dir/file.ndjson")
+	if !ok {
+		t.Fatal("object not found")
+	}
+	if string(got) != "Hello World" {
+		t.Errorf("object holds %q, want %q", got, "Hello World")
+	}
+	if server.PartRequests() != 0 {
+		t.Errorf("small object was uploaded in %d parts, want a single request", server.PartRequests())
+	}
+}
+
+func TestS3ClientMultipartUpload(t *testing.T) {
+	server := testhelpers.NewS3Server(t)
+	c := newTestClient(t, server)
+
+	// The minimum part size is 5MiB.
+	data := bytes.Repeat([]byte("0123456789"), 1200*1024)
+	w := c.GetFileWriter(context.Background(), "big.ndjson")
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+
+	got, ok := server.GetObject("bucket", "big.ndjson")
+	if !ok {
+		t.Fatal("object not found")
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("object holds %d bytes, want the %d written", len(got), len(data))
+	}
+	if server.PartRequests() != 3 {
+		t.Errorf("object was uploaded in %d parts, want 3", server.PartRequests())
+	}
+}
+
+func TestS3ClientReadsFile(t *testing.T) {
+	server := testhelpers.NewS3Server(t)
+	server.AddObject("bucket", "dir/file.txt", []byte("Hello World"))
+	c := newTestClient(t, server)
+
+	r, err := c.GetFileReader(context.Background(), "dir/file.txt")
+	if err != nil {
+		t.Fatalf("GetFileReader() returned unexpected error: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "Hello World" {
+		t.Errorf("GetFileReader() read %q, want %q", got, "Hello World")
+	}
+
+	if _, err := c.GetFileReader(context.Background(), "missing.txt"); !errors.Is(err, ErrObjectNotExist) {
+		t.Errorf("GetFileReader() of a missing object returned error %v, want %v", err, ErrObjectNotExist)
+	}
+}
+
+func TestS3ClientConditionalWrite(t *testing.T) {
+	server := testhelpers.NewS3Server(t)
+	c := newTestClient(t, server)
+	ctx := context.Background()
+
+	etag, err := c.WriteConditional(ctx, "since.txt", []byte("1\n"), "")
+	if err != nil {
+		t.Fatalf("WriteConditional() of a new object returned unexpected error: %v", err)
+	}
+	if _, err := c.WriteConditional(ctx, "since.txt", []byte("2\n"), ""); !IsPreconditionFailed(err) {
+		t.Errorf("WriteConditional() of an existing object with no ETag returned error %v, want precondition failed", err)
+	}
+
+	w := c.GetConditionalFileWriter(ctx, "since.txt", etag)
+	w.Write([]byte("1\n3\n"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() of conditional writer with the current ETag returned unexpected error: %v", err)
+	}
+	// The object no longer has the ETag read.
+	w = c.GetConditionalFileWriter(ctx, "since.txt", etag)
+	w.Write([]byte("1\n4\n"))
+	if err := w.Close(); !IsPreconditionFailed(err) {
+		t.Errorf("Close() of conditional writer with a stale ETag returned error %v, want precondition failed", err)
+	}
+
+	r, gotETag, err := c.GetFileReaderWithETag(ctx, "since.txt")
+	if err != nil {
+		t.Fatalf("GetFileReaderWithETag() returned unexpected error: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "1\n3\n" {
+		t.Errorf("object holds %q, want %q", got, "1\n3\n")
+	}
+	if gotETag == etag || gotETag == "" {
+		t.Errorf("GetFileReaderWithETag() returned ETag %q, want a new ETag", gotETag)
+	}
+}
+
+func TestS3PathComponents(t *testing.T) {
+	cases := []struct {
+		uri, wantBucket, wantPath string
+		wantErr                   bool
+	}{
+		{uri: "s3://bucket/dir/file.txt", wantBucket: "bucket", wantPath: "dir/file.txt"},
+		{uri: "s3://bucket/dir/", wantBucket: "bucket", wantPath: "dir/"},
+		{uri: "s3://bucket", wantErr: true},
+		{uri: "s3://bucket/", wantErr: true},
+		{uri: "gs://bucket/dir", wantErr: true},
+	}
+	for _, tc := range cases {
+		bucket, path, err := PathComponents(tc.uri)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("PathComponents(%q) returned error %v, want error: %v", tc.uri, err, tc.wantErr)
+		}
+		if bucket != tc.wantBucket || path != tc.wantPath {
+			t.Errorf("PathComponents(%q) = %q, %q, want %q, %q", tc.uri, bucket, path, tc.wantBucket, tc.wantPath)
+		}
+	}
+}
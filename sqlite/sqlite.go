@@ -0,0 +1,544 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlite writes new SQLite database files
+// (https://www.sqlite.org/fileformat2.html) of tables of rows, without
+// depending on the SQLite library. The files can be queried with the sqlite3
+// shell, any SQLite driver, or DuckDB (ATTACH 'file.db' (TYPE sqlite)).
+//
+// Only what is needed to write a database once is supported: tables are
+// created and rows appended, but not updated, deleted or indexed, and an
+// existing database cannot be opened.
+package sqlite
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// pageSize is the size of each page of the database, SQLite's default.
+	pageSize = 4096
+	// headerSize is the size of the database header at the start of page 1.
+	headerSize = 100
+
+	leafTablePage     = 0x0d
+	interiorTablePage = 0x05
+
+	// maxLocal and minLocal are the most and least bytes of a row's payload
+	// which are stored on its leaf page; the rest overflows to a chain of
+	// overflow pages.
+	maxLocal = pageSize - 35
+	minLocal = (pageSize-12)*32/255 - 23
+
+	// sqliteVersion is the SQLITE_VERSION_NUMBER recorded as having written
+	// the database.
+	sqliteVersion = 3040001
+)
+
+// Column types.
+const (
+	Integer = "INTEGER"
+	Real    = "REAL"
+	Text    = "TEXT"
+	Blob    = "BLOB"
+)
+
+// Column describes a column of a table.
+type Column struct {
+	Name string
+	// Type is the column's declared type, normally one of Integer, Real, Text
+	// or Blob. SQLite does not enforce it, but uses it to convert values when
+	// they are compared or stored.
+	Type string
+}
+
+// DB is a database being written. It is not threadsafe.
+type DB struct {
+	f        *os.File
+	path     string
+	nextPage uint32
+	tables   []*Table
+	closed   bool
+}
+
+// child is a page of a b-tree, and the largest row ID it holds.
+type child struct {
+	page   uint32
+	maxKey int64
+}
+
+// Table is a table of a DB, which rows are appended to.
+type Table struct {
+	db      *DB
+	name    string
+	sql     string
+	columns int
+
+	rowID  int64
+	cells  [][]byte
+	used   int
+	leaves []child
+}
+
+// Create starts writing a new database to path. The database is written to a
+// temporary file alongside path, which replaces any existing file at path when
+// the DB is closed, so that a database at path is always complete. Like the
+// other outputs, the database is readable by all, subject to the umask.
+func Create(path string) (*DB, error) {
+	f, err := createTemp(dirOf(path))
+	if err != nil {
+		return nil, err
+	}
+	// Page 1 holds the database header and the schema, which are written on
+	// Close.
+	return &DB{f: f, path: path, nextPage: 2}, nil
+}
+
+// createTemp creates a new temporary file in dir. Unlike with os.CreateTemp,
+// which creates files only readable by their owner, the file is created with
+// mode 0644 less the umask, as it is renamed to the output.
+func createTemp(dir string) (*os.File, error) {
+	for i := 0; i < 100; i++ {
+		name := filepath.Join(dir, ".sqlite-"+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+	return nil, fmt.Errorf("failed to create a temporary file in %s", dir)
+}
+
+func dirOf(path string) string {
+	if i := strings.LastIndexAny(path, `/\`); i >= 0 {
+		return path[:i+1]
+	}
+	return "."
+}
+
+// CreateTable adds a table with the given columns to the database.
+func (db *DB) CreateTable(name string, columns []Column) (*Table, error) {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "sqlite_") {
+		return nil, fmt.Errorf("invalid table name %q", name)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s has no columns", name)
+	}
+	for _, t := range db.tables {
+		if strings.EqualFold(t.name, name) {
+			return nil, fmt.Errorf("table %s already exists", name)
+		}
+	}
+	defs := make([]string, len(columns))
+	for i, c := range columns {
+		defs[i] = quote(c.Name)
+		if c.Type != "" {
+			defs[i] += " " + c.Type
+		}
+	}
+	t := &Table{
+		db:      db,
+		name:    name,
+		sql:     fmt.Sprintf("CREATE TABLE %s (%s)", quote(name), strings.Join(defs, ", ")),
+		columns: len(columns),
+	}
+	db.tables = append(db.tables, t)
+	return t, nil
+}
+
+// quote quotes an identifier.
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Insert appends a row to the table, with a value for each column. Values
+// must be nil, bool, int, int64, float64, string or []byte.
+func (t *Table) Insert(values ...any) error {
+	if len(values) != t.columns {
+		return fmt.Errorf("table %s has %d columns, got %d values", t.name, t.columns, len(values))
+	}
+	record, err := encodeRecord(values)
+	if err != nil {
+		return err
+	}
+	rowID := t.rowID + 1
+	cell, err := t.db.leafCell(rowID, record)
+	if err != nil {
+		return err
+	}
+	if t.used+len(cell)+2 > pageSize-8 {
+		if err := t.flush(); err != nil {
+			return err
+		}
+	}
+	t.cells = append(t.cells, cell)
+	t.used += len(cell) + 2
+	t.rowID = rowID
+	return nil
+}
+
+// flush writes the rows of the table not yet written as a leaf page.
+func (t *Table) flush() error {
+	page := t.db.allocate()
+	if err := t.db.writePage(page, pageImage(leafTablePage, t.cells, 0, 0)); err != nil {
+		return err
+	}
+	t.leaves = append(t.leaves, child{page: page, maxKey: t.rowID})
+	t.cells = nil
+	t.used = 0
+	return nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Close writes the remaining rows and the schema of the database, and moves
+// it to its path.
+func (db *DB) Close() error {
+	if db.closed {
+		return errors.New("database already closed")
+	}
+	db.closed = true
+	err := db.finish()
+	if cerr := db.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(db.f.Name(), db.path)
+	}
+	if err != nil {
+		os.Remove(db.f.Name())
+	}
+	return err
+}
+
+func (db *DB) finish() error {
+	var schema [][]byte
+	for i, t := range db.tables {
+		if len(t.cells) > 0 || len(t.leaves) == 0 {
+			if err := t.flush(); err != nil {
+				return err
+			}
+		}
+		root, err := db.buildTree(t.leaves, 0)
+		if err != nil {
+			return err
+		}
+		record, err := encodeRecord([]any{"table", t.name, t.name, int64(root), t.sql})
+		if err != nil {
+			return err
+		}
+		cell, err := db.leafCell(int64(i+1), record)
+		if err != nil {
+			return err
+		}
+		schema = append(schema, cell)
+	}
+
+	// The schema table's root is page 1, after the database header. If it
+	// does not fit there, it is split into leaves under an interior page 1.
+	var leaves []child
+	var cells [][]byte
+	used := 0
+	for i, cell := range schema {
+		if len(cells) > 0 && used+len(cell)+2 > pageSize-headerSize-8 {
+			page := db.allocate()
+			if err := db.writePage(page, pageImage(leafTablePage, cells, 0, 0)); err != nil {
+				return err
+			}
+			leaves = append(leaves, child{page: page, maxKey: int64(i)})
+			cells, used = nil, 0
+		}
+		cells = append(cells, cell)
+		used += len(cell) + 2
+	}
+	if len(leaves) == 0 {
+		if err := db.writePage(1, pageImage(leafTablePage, cells, 0, headerSize)); err != nil {
+			return err
+		}
+	} else {
+		page := db.allocate()
+		if err := db.writePage(page, pageImage(leafTablePage, cells, 0, 0)); err != nil {
+			return err
+		}
+		leaves = append(leaves, child{page: page, maxKey: int64(len(schema))})
+		if _, err := db.buildTree(leaves, 1); err != nil {
+			return err
+		}
+	}
+	return db.writeHeader()
+}
+
+// buildTree builds the interior pages of a b-tree over its leaves, and returns
+// the page number of its root. If root is non-zero, the root is written to
+// that page.
+func (db *DB) buildTree(children []child, root uint32) (uint32, error) {
+	if len(children) == 1 && root == 0 {
+		return children[0].page, nil
+	}
+	for {
+		// Interior pages are limited to the space left on page 1, so that any
+		// of them may be the root of the schema table.
+		const capacity = pageSize - headerSize - 12
+		var nodes [][]child
+		var node []child
+		used := 0
+		for _, c := range children {
+			size := 4 + varintLen(uint64(c.maxKey)) + 2
+			if len(node) > 0 && used+size > capacity {
+				nodes = append(nodes, node)
+				node, used = nil, 0
+			}
+			node = append(node, c)
+			used += size
+		}
+		nodes = append(nodes, node)
+		// Every interior page needs at least two children.
+		if n := len(nodes); n > 1 && len(nodes[n-1]) == 1 {
+			prev := nodes[n-2]
+			nodes[n-1] = append([]child{prev[len(prev)-1]}, nodes[n-1]...)
+			nodes[n-2] = prev[:len(prev)-1]
+		}
+
+		if len(nodes) == 1 {
+			page := root
+			if page == 0 {
+				page = db.allocate()
+			}
+			offset := 0
+			if page == 1 {
+				offset = headerSize
+			}
+			return page, db.writePage(page, interiorPage(nodes[0], offset))
+		}
+		var parents []child
+		for _, n := range nodes {
+			page := db.allocate()
+			if err := db.writePage(page, interiorPage(n, 0)); err != nil {
+				return 0, err
+			}
+			parents = append(parents, child{page: page, maxKey: n[len(n)-1].maxKey})
+		}
+		children = parents
+	}
+}
+
+// interiorPage returns the image of an interior page over children. Each
+// cell points to a child and holds its largest key; the last child is the
+// page's right-most pointer.
+func interiorPage(children []child, offset int) []byte {
+	cells := make([][]byte, 0, len(children)-1)
+	for _, c := range children[:len(children)-1] {
+		cell := binary.BigEndian.AppendUint32(nil, c.page)
+		cells = append(cells, appendVarint(cell, uint64(c.maxKey)))
+	}
+	return pageImage(interiorTablePage, cells, children[len(children)-1].page, offset)
+}
+
+// pageImage returns the image of a b-tree page holding cells, whose header
+// starts at offset. Cell contents are packed at the end of the page.
+func pageImage(flag byte, cells [][]byte, rightMost uint32, offset int) []byte {
+	img := make([]byte, pageSize)
+	header := 8
+	if flag == interiorTablePage {
+		header = 12
+		binary.BigEndian.PutUint32(img[offset+8:], rightMost)
+	}
+	img[offset] = flag
+	binary.BigEndian.PutUint16(img[offset+3:], uint16(len(cells)))
+	content := pageSize
+	ptr := offset + header
+	for _, c := range cells {
+		content -= len(c)
+		copy(img[content:], c)
+		binary.BigEndian.PutUint16(img[ptr:], uint16(content))
+		ptr += 2
+	}
+	binary.BigEndian.PutUint16(img[offset+5:], uint16(content))
+	return img
+}
+
+// leafCell returns a leaf cell holding the record of a row. The part of the
+// record which does not fit on the leaf is written to overflow pages.
+func (db *DB) leafCell(rowID int64, record []byte) ([]byte, error) {
+	cell := appendVarint(nil, uint64(len(record)))
+	cell = appendVarint(cell, uint64(rowID))
+	if len(record) <= maxLocal {
+		return append(cell, record...), nil
+	}
+	local := minLocal + (len(record)-minLocal)%(pageSize-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	cell = append(cell, record[:local]...)
+
+	overflow := record[local:]
+	page := db.allocate()
+	cell = binary.BigEndian.AppendUint32(cell, page)
+	for len(overflow) > 0 {
+		n := min(len(overflow), pageSize-4)
+		var next uint32
+		if n < len(overflow) {
+			next = db.allocate()
+		}
+		img := binary.BigEndian.AppendUint32(make([]byte, 0, pageSize), next)
+		if err := db.writePage(page, append(img, overflow[:n]...)); err != nil {
+			return nil, err
+		}
+		overflow = overflow[n:]
+		page = next
+	}
+	return cell, nil
+}
+
+func (db *DB) allocate() uint32 {
+	page := db.nextPage
+	db.nextPage++
+	return page
+}
+
+func (db *DB) writePage(page uint32, data []byte) error {
+	if len(data) < pageSize {
+		data = append(data, make([]byte, pageSize-len(data))...)
+	}
+	_, err := db.f.WriteAt(data, int64(page-1)*pageSize)
+	return err
+}
+
+// writeHeader writes the database header, once the size of the database is
+// known.
+func (db *DB) writeHeader() error {
+	h := make([]byte, headerSize)
+	copy(h, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(h[16:], pageSize)
+	h[18], h[19] = 1, 1 // Legacy (rollback journal) file format.
+	h[20] = 0           // Reserved space per page.
+	h[21], h[22], h[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(h[24:], 1) // File change counter.
+	binary.BigEndian.PutUint32(h[28:], db.nextPage-1)
+	binary.BigEndian.PutUint32(h[40:], 1) // Schema cookie.
+	binary.BigEndian.PutUint32(h[44:], 4) // Schema format number.
+	binary.BigEndian.PutUint32(h[56:], 1) // UTF-8 text encoding.
+	binary.BigEndian.PutUint32(h[92:], 1) // Version-valid-for, the change counter.
+	binary.BigEndian.PutUint32(h[96:], sqliteVersion)
+	_, err := db.f.WriteAt(h, 0)
+	return err
+}
+
+// encodeRecord encodes values in the record format: a header of the serial
+// type of each value, then the values.
+func encodeRecord(values []any) ([]byte, error) {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = appendVarint(types, 0)
+		case bool:
+			types = appendVarint(types, uint64(8+boolToInt(v)))
+		case int:
+			types, body = appendInteger(types, body, int64(v))
+		case int64:
+			types, body = appendInteger(types, body, v)
+		case float64:
+			types = appendVarint(types, 7)
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(v))
+		case string:
+			types = appendVarint(types, uint64(len(v))*2+13)
+			body = append(body, v...)
+		case []byte:
+			types = appendVarint(types, uint64(len(v))*2+12)
+			body = append(body, v...)
+		default:
+			return nil, fmt.Errorf("unsupported value type %T", v)
+		}
+	}
+	// The header's size includes the varint of its size.
+	size := len(types) + 1
+	for varintLen(uint64(size)) != size-len(types) {
+		size = len(types) + varintLen(uint64(size))
+	}
+	record := appendVarint(make([]byte, 0, size+len(body)), uint64(size))
+	record = append(record, types...)
+	return append(record, body...), nil
+}
+
+// appendInteger appends an integer with the smallest serial type which holds
+// it.
+func appendInteger(types, body []byte, v int64) ([]byte, []byte) {
+	switch {
+	case v == 0, v == 1:
+		return appendVarint(types, uint64(8+v)), body
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return appendVarint(types, 1), append(body, byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return appendVarint(types, 2), binary.BigEndian.AppendUint16(body, uint16(v))
+	case v >= -1<<23 && v < 1<<23:
+		return appendVarint(types, 3), append(body, byte(v>>16), byte(v>>8), byte(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return appendVarint(types, 4), binary.BigEndian.AppendUint32(body, uint32(v))
+	case v >= -1<<47 && v < 1<<47:
+		b := binary.BigEndian.AppendUint64(nil, uint64(v))
+		return appendVarint(types, 5), append(body, b[2:]...)
+	default:
+		return appendVarint(types, 6), binary.BigEndian.AppendUint64(body, uint64(v))
+	}
+}
+
+// appendVarint appends v as a SQLite varint: big-endian groups of seven bits,
+// with the high bit set on all but the last byte, and the ninth byte, if any,
+// holding eight bits.
+func appendVarint(b []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	n := 0
+	for {
+		buf[n] = byte(v&0x7f) | 0x80
+		n++
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	buf[0] &= 0x7f
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, buf[i])
+	}
+	return b
+}
+
+func varintLen(v uint64) int {
+	return len(appendVarint(nil, v))
+}
@@ -0,0 +1,201 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/sqlite"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sqlite.Create(path)
+	if err != nil {
+		t.Fatalf("Create() returned unexpected error: %v", err)
+	}
+	values, err := db.CreateTable("values", []sqlite.Column{{Name: "i", Type: sqlite.Integer}, {Name: "f", Type: sqlite.Real}, {Name: "s", Type: sqlite.Text}, {Name: "b", Type: sqlite.Blob}})
+	if err != nil {
+		t.Fatalf("CreateTable() returned unexpected error: %v", err)
+	}
+	rows := [][]any{
+		{int64(0), 1.5, "text", []byte{1, 2}},
+		{int64(1), -2.25, "", []byte{}},
+		{int64(-100), nil, nil, nil},
+		{int64(1 << 20), 0.0, strings.Repeat("long", 5000), nil},
+		{int64(1 << 40), 1e100, "unicode ✓", nil},
+		{int64(-1 << 62), nil, "x", nil},
+	}
+	for _, r := range rows {
+		if err := values.Insert(r...); err != nil {
+			t.Fatalf("Insert(%v) returned unexpected error: %v", r, err)
+		}
+	}
+	if _, err := db.CreateTable("empty", []sqlite.Column{{Name: "a"}}); err != nil {
+		t.Fatalf("CreateTable() returned unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("database exists at %s before being closed, want it written on Close", path)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+
+	gotColumns, gotRows := testhelpers.ReadSQLiteTable(t, path, "values")
+	if diff := cmp.Diff([]string{"i", "f", "s", "b"}, gotColumns); diff != "" {
+		t.Errorf("table has unexpected columns (-want +got): %s", diff)
+	}
+	if diff := cmp.Diff(rows, gotRows); diff != "" {
+		t.Errorf("table has unexpected rows (-want +got): %s", diff)
+	}
+	if _, gotRows := testhelpers.ReadSQLiteTable(t, path, "empty"); len(gotRows) != 0 {
+		t.Errorf("empty table has rows %v, want none", gotRows)
+	}
+	checkWithSQLite3(t, path, "SELECT count(*), sum(length(s)) FROM \"values\";", "6|20014")
+}
+
+func TestWrite_ManyRowsAndTables(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sqlite.Create(path)
+	if err != nil {
+		t.Fatalf("Create() returned unexpected error: %v", err)
+	}
+	// Enough tables that the schema does not fit on the first page, and enough
+	// rows that the table has several levels of interior pages.
+	const tables, rows = 150, 200000
+	var big *sqlite.Table
+	for i := 0; i < tables; i++ {
+		table, err := db.CreateTable(fmt.Sprintf("table_with_a_long_name_%d", i), []sqlite.Column{{Name: "id", Type: sqlite.Integer}, {Name: "description_of_the_row", Type: sqlite.Text}})
+		if err != nil {
+			t.Fatalf("CreateTable() returned unexpected error: %v", err)
+		}
+		if i == 0 {
+			big = table
+		}
+	}
+	for i := 0; i < rows; i++ {
+		if err := big.Insert(int64(i), fmt.Sprintf("row %d", i)); err != nil {
+			t.Fatalf("Insert() returned unexpected error: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+
+	_, got := testhelpers.ReadSQLiteTable(t, path, "table_with_a_long_name_0")
+	if len(got) != rows {
+		t.Fatalf("table has %d rows, want %d", len(got), rows)
+	}
+	for i, r := range got {
+		if r[0] != int64(i) {
+			t.Fatalf("row %d has id %v, want %d", i, r[0], i)
+		}
+	}
+	if _, got := testhelpers.ReadSQLiteTable(t, path, fmt.Sprintf("table_with_a_long_name_%d", tables-1)); len(got) != 0 {
+		t.Errorf("last table has %d rows, want 0", len(got))
+	}
+	checkWithSQLite3(t, path, "SELECT count(*) FROM sqlite_master; SELECT max(id) FROM table_with_a_long_name_0 WHERE id < 150000;", "150\n149999")
+}
+
+func TestCreateTable_Invalid(t *testing.T) {
+	db, err := sqlite.Create(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Create() returned unexpected error: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.CreateTable("a", []sqlite.Column{{Name: "x"}}); err != nil {
+		t.Fatalf("CreateTable() returned unexpected error: %v", err)
+	}
+	for _, name := range []string{"", "sqlite_master", "A"} {
+		if _, err := db.CreateTable(name, []sqlite.Column{{Name: "x"}}); err == nil {
+			t.Errorf("CreateTable(%q) succeeded, want error", name)
+		}
+	}
+	if _, err := db.CreateTable("b", nil); err == nil {
+		t.Errorf("CreateTable() without columns succeeded, want error")
+	}
+}
+
+func TestInsert_Invalid(t *testing.T) {
+	db, err := sqlite.Create(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Create() returned unexpected error: %v", err)
+	}
+	defer db.Close()
+	table, err := db.CreateTable("a", []sqlite.Column{{Name: "x"}})
+	if err != nil {
+		t.Fatalf("CreateTable() returned unexpected error: %v", err)
+	}
+	if err := table.Insert(1, 2); err == nil {
+		t.Errorf("Insert() with too many values succeeded, want error")
+	}
+	if err := table.Insert(struct{}{}); err == nil {
+		t.Errorf("Insert() of an unsupported value succeeded, want error")
+	}
+}
+
+// checkWithSQLite3 runs the query against the database with the sqlite3
+// shell, if it is installed, to check that SQLite itself can read the
+// database, and that it passes SQLite's integrity check.
+func checkWithSQLite3(t *testing.T, path, query, want string) {
+	t.Helper()
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Log("sqlite3 is not installed; skipping the check with SQLite")
+		return
+	}
+	out, err := exec.Command("sqlite3", path, "PRAGMA integrity_check; "+query).CombinedOutput()
+	if err != nil {
+		t.Fatalf("sqlite3 returned error %v: %s", err, out)
+	}
+	if diff := cmp.Diff("ok\n"+want, strings.TrimSpace(string(out))); diff != "" {
+		t.Errorf("sqlite3 returned unexpected output (-want +got): %s", diff)
+	}
+}
+
+func TestCreate_FileMode(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sqlite.Create(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Create() returned unexpected error: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+	got, err := os.Stat(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to stat the database: %v", err)
+	}
+	// A file created with mode 0644 has the umask applied, as the database
+	// should.
+	ref, err := os.OpenFile(filepath.Join(dir, "ref"), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to create reference file: %v", err)
+	}
+	ref.Close()
+	want, err := os.Stat(ref.Name())
+	if err != nil {
+		t.Fatalf("failed to stat reference file: %v", err)
+	}
+	if got.Mode() != want.Mode() {
+		t.Errorf("database has mode %v, want %v", got.Mode(), want.Mode())
+	}
+}
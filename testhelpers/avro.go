@@ -0,0 +1,147 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testhelpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// ReadAvroFile reads the schema, as decoded from its JSON, and the records of
+// an Avro object container file. Nulls are returned as nil, booleans as bool,
+// ints and longs as int64, floats and doubles as float64, strings as string,
+// bytes as []byte, arrays as []any and records and maps as map[string]any.
+// The file is decoded with the linkedin/goavro library, so that the files
+// written by the avro package are checked against an implementation of Avro
+// other than its own. Schemas which refer to named types by name are not
+// supported.
+func ReadAvroFile(t *testing.T, data []byte) (schema any, records []any) {
+	t.Helper()
+	r, err := goavro.NewOCFReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid Avro object container file: %v", err)
+	}
+	if err := json.Unmarshal(r.MetaData()["avro.schema"], &schema); err != nil {
+		t.Fatalf("invalid Avro schema: %v", err)
+	}
+	for r.Scan() {
+		v, err := r.Read()
+		if err != nil {
+			t.Fatalf("failed to read Avro record %d: %v", len(records), err)
+		}
+		records = append(records, normalizeAvro(t, schema, "", v))
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("failed to read Avro file: %v", err)
+	}
+	return schema, records
+}
+
+// normalizeAvro converts a value decoded by goavro to the types returned by
+// ReadAvroFile, unwrapping the branches of unions, which goavro decodes as a
+// map from the name of the branch's type to its value. namespace is the
+// namespace enclosing the schema.
+func normalizeAvro(t *testing.T, schema any, namespace string, v any) any {
+	t.Helper()
+	switch s := schema.(type) {
+	case []any:
+		if v == nil {
+			return nil
+		}
+		m, ok := v.(map[string]any)
+		if !ok || len(m) != 1 {
+			t.Fatalf("Avro union value %v is not a single branch", v)
+		}
+		for name, bv := range m {
+			for _, b := range s {
+				if avroTypeName(b, namespace) == name {
+					return normalizeAvro(t, b, namespace, bv)
+				}
+			}
+			t.Fatalf("Avro union %v has no branch %s", s, name)
+		}
+	case map[string]any:
+		switch s["type"] {
+		case "record":
+			full := avroTypeName(s, namespace)
+			ns := ""
+			if i := strings.LastIndex(full, "."); i >= 0 {
+				ns = full[:i]
+			}
+			rec := map[string]any{}
+			m := v.(map[string]any)
+			for _, f := range s["fields"].([]any) {
+				f := f.(map[string]any)
+				name := f["name"].(string)
+				rec[name] = normalizeAvro(t, f["type"], ns, m[name])
+			}
+			return rec
+		case "array":
+			items := []any{}
+			for _, e := range v.([]any) {
+				items = append(items, normalizeAvro(t, s["items"], namespace, e))
+			}
+			return items
+		case "map":
+			m := map[string]any{}
+			for k, e := range v.(map[string]any) {
+				m[k] = normalizeAvro(t, s["values"], namespace, e)
+			}
+			return m
+		default:
+			return normalizeAvro(t, s["type"], namespace, v)
+		}
+	case string:
+		switch v := v.(type) {
+		case int32:
+			return int64(v)
+		case float32:
+			return float64(v)
+		case nil, bool, int64, float64, string, []byte:
+			return v
+		}
+	}
+	t.Fatalf("unsupported Avro schema %v for value %v", schema, v)
+	return nil
+}
+
+// avroTypeName returns the name goavro gives the branch of a union with the
+// given schema: the full name of named types, and the type otherwise.
+func avroTypeName(schema any, namespace string) string {
+	switch s := schema.(type) {
+	case string:
+		return s
+	case map[string]any:
+		if s["type"] != "record" {
+			return avroTypeName(s["type"], namespace)
+		}
+		name := s["name"].(string)
+		if strings.Contains(name, ".") {
+			return name
+		}
+		if ns, ok := s["namespace"].(string); ok {
+			namespace = ns
+		}
+		if namespace == "" {
+			return name
+		}
+		return namespace + "." + name
+	}
+	return ""
+}
@@ -0,0 +1,280 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testhelpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// BigQueryServer provides a minimal implementation of the BigQuery API for
+// use in tests, supporting getting and creating tables, streaming inserts and
+// load jobs into a single dataset.
+type BigQueryServer struct {
+	t                    *testing.T
+	server               *httptest.Server
+	projectID, datasetID string
+
+	// RejectRow, if set, is called for each inserted row. If it returns a
+	// non-empty string, the row is rejected with that string as the error
+	// message.
+	RejectRow func(table string, row map[string]any) string
+	// FailLoad, if set, is called for each load job. If it returns a non-empty
+	// string, the job fails with that string as the error message.
+	FailLoad func(table string, sourceURIs []string) string
+
+	mu       sync.Mutex
+	schemas  map[string]json.RawMessage
+	rows     map[string][]map[string]any
+	loadJobs []LoadJob
+	jobs     map[string]json.RawMessage
+}
+
+// LoadJob describes a load job run by the BigQueryServer.
+type LoadJob struct {
+	Table      string
+	SourceURIs []string
+}
+
+// NewBigQueryServer creates a new BigQueryServer for the given dataset. The
+// server is closed at the end of the test.
+func NewBigQueryServer(t *testing.T, projectID, datasetID string) *BigQueryServer {
+	bqs := &BigQueryServer{
+		t:         t,
+		projectID: projectID,
+		datasetID: datasetID,
+		schemas:   map[string]json.RawMessage{},
+		rows:      map[string][]map[string]any{},
+		jobs:      map[string]json.RawMessage{},
+	}
+	bqs.server = httptest.NewServer(http.HandlerFunc(bqs.handleHTTP))
+	t.Cleanup(bqs.server.Close)
+	return bqs
+}
+
+// URL returns the endpoint to use in the BigQuery client config.
+func (bqs *BigQueryServer) URL() string {
+	return bqs.server.URL + "/"
+}
+
+// AddTable creates a table without a schema, as though it already existed.
+func (bqs *BigQueryServer) AddTable(table string) {
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	bqs.schemas[table] = nil
+}
+
+// Tables returns the names of all tables, sorted.
+func (bqs *BigQueryServer) Tables() []string {
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	var tables []string
+	for t := range bqs.schemas {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// Schema returns the JSON schema the table was created with.
+func (bqs *BigQueryServer) Schema(table string) json.RawMessage {
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	return bqs.schemas[table]
+}
+
+// Rows returns the rows which have been inserted into the table, in the order
+// they were inserted.
+func (bqs *BigQueryServer) Rows(table string) []map[string]any {
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	return bqs.rows[table]
+}
+
+// LoadJobs returns the load jobs which have been run, in the order they were
+// started.
+func (bqs *BigQueryServer) LoadJobs() []LoadJob {
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	return append([]LoadJob(nil), bqs.loadJobs...)
+}
+
+func (bqs *BigQueryServer) handleHTTP(w http.ResponseWriter, req *http.Request) {
+	jobsPrefix := fmt.Sprintf("/projects/%s/jobs", bqs.projectID)
+	if strings.HasPrefix(req.URL.Path, jobsPrefix) {
+		bqs.handleJobs(w, req, strings.Trim(strings.TrimPrefix(req.URL.Path, jobsPrefix), "/"))
+		return
+	}
+	prefix := fmt.Sprintf("/projects/%s/datasets/%s/tables", bqs.projectID, bqs.datasetID)
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		bqs.t.Errorf("BigQuery server got request for unexpected path %s", req.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, prefix), "/"), "/")
+	switch {
+	case req.Method == http.MethodPost && parts[0] == "":
+		bqs.handleCreateTable(w, req)
+	case req.Method == http.MethodGet && len(parts) == 1:
+		bqs.handleGetTable(w, parts[0])
+	case req.Method == http.MethodPost && len(parts) == 2 && parts[1] == "insertAll":
+		bqs.handleInsertAll(w, req, parts[0])
+	default:
+		bqs.t.Errorf("BigQuery server got unexpected request %s %s", req.Method, req.URL.Path)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (bqs *BigQueryServer) handleGetTable(w http.ResponseWriter, table string) {
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	if _, ok := bqs.schemas[table]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"code": 404, "message": "Not found: Table"}}`))
+		return
+	}
+	fmt.Fprintf(w, `{"tableReference": {"projectId": %q, "datasetId": %q, "tableId": %q}}`, bqs.projectID, bqs.datasetID, table)
+}
+
+func (bqs *BigQueryServer) handleCreateTable(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		TableReference struct {
+			TableID string `json:"tableId"`
+		} `json:"tableReference"`
+		Schema json.RawMessage `json:"schema"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		bqs.t.Errorf("BigQuery server got invalid create table request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	if _, ok := bqs.schemas[body.TableReference.TableID]; ok {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error": {"code": 409, "message": "Already Exists: Table"}}`))
+		return
+	}
+	bqs.schemas[body.TableReference.TableID] = body.Schema
+	w.Write([]byte(`{}`))
+}
+
+func (bqs *BigQueryServer) handleInsertAll(w http.ResponseWriter, req *http.Request, table string) {
+	var body struct {
+		Rows []struct {
+			JSON map[string]any `json:"json"`
+		} `json:"rows"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		bqs.t.Errorf("BigQuery server got invalid insertAll request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	if _, ok := bqs.schemas[table]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"code": 404, "message": "Not found: Table"}}`))
+		return
+	}
+	type errorProto struct {
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	}
+	type insertError struct {
+		Index  int          `json:"index"`
+		Errors []errorProto `json:"errors"`
+	}
+	var insertErrors []insertError
+	for i, r := range body.Rows {
+		if bqs.RejectRow != nil {
+			if msg := bqs.RejectRow(table, r.JSON); msg != "" {
+				insertErrors = append(insertErrors, insertError{Index: i, Errors: []errorProto{{Reason: "invalid", Message: msg}}})
+				continue
+			}
+		}
+		bqs.rows[table] = append(bqs.rows[table], r.JSON)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"insertErrors": insertErrors})
+}
+
+// handleJobs starts load jobs, which are done immediately, and gets them.
+func (bqs *BigQueryServer) handleJobs(w http.ResponseWriter, req *http.Request, jobID string) {
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	if req.Method == http.MethodGet && jobID != "" {
+		job, ok := bqs.jobs[jobID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "Not found: Job"}}`))
+			return
+		}
+		w.Write(job)
+		return
+	}
+	if req.Method != http.MethodPost || jobID != "" {
+		bqs.t.Errorf("BigQuery server got unexpected request %s %s", req.Method, req.URL.Path)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Configuration struct {
+			Load *struct {
+				DestinationTable struct {
+					DatasetID string `json:"datasetId"`
+					TableID   string `json:"tableId"`
+				} `json:"destinationTable"`
+				SourceURIs []string `json:"sourceUris"`
+			} `json:"load"`
+		} `json:"configuration"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Configuration.Load == nil {
+		bqs.t.Errorf("BigQuery server got invalid load job request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	load := body.Configuration.Load
+	if load.DestinationTable.DatasetID != bqs.datasetID {
+		bqs.t.Errorf("BigQuery server got load job into unexpected dataset %s", load.DestinationTable.DatasetID)
+	}
+	bqs.loadJobs = append(bqs.loadJobs, LoadJob{Table: load.DestinationTable.TableID, SourceURIs: load.SourceURIs})
+	if _, ok := bqs.schemas[load.DestinationTable.TableID]; !ok {
+		bqs.schemas[load.DestinationTable.TableID] = nil
+	}
+	status := map[string]any{"state": "DONE"}
+	if bqs.FailLoad != nil {
+		if msg := bqs.FailLoad(load.DestinationTable.TableID, load.SourceURIs); msg != "" {
+			status["errorResult"] = map[string]string{"reason": "invalid", "message": msg}
+		}
+	}
+	jobID = fmt.Sprintf("job%d", len(bqs.loadJobs))
+	job, err := json.Marshal(map[string]any{
+		"jobReference": map[string]string{"projectId": bqs.projectID, "jobId": jobID},
+		"status":       status,
+	})
+	if err != nil {
+		bqs.t.Errorf("BigQuery server failed to marshal job: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	bqs.jobs[jobID] = job
+	w.Write(job)
+}
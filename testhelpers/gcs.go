@@ -23,6 +23,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"regexp"
 	"slices"
 	"strings"
@@ -36,10 +37,25 @@ type gcsObjectKey struct {
 	bucket, name string
 }
 
-// GCSObjectEntry holds the contents and content type of stored objects.
+// GCSObjectEntry holds the contents and content type of stored objects, and
+// the retention configuration they were uploaded with, if any.
 type GCSObjectEntry struct {
 	Data        []byte
 	ContentType string
+	Retention   *GCSObjectRetention
+}
+
+// GCSObjectRetention is the retention configuration of an object, as in the
+// object's metadata.
+type GCSObjectRetention struct {
+	Mode            string `json:"mode"`
+	RetainUntilTime string `json:"retainUntilTime"`
+}
+
+// gcsObjectMetadata holds the fields of the metadata of an uploaded object
+// which are recorded.
+type gcsObjectMetadata struct {
+	Retention *GCSObjectRetention `json:"retention"`
 }
 
 // GCSServer provides a minimal implementation of the GCS API for use in tests.
@@ -48,14 +64,41 @@ type GCSServer struct {
 	objectsMut *sync.RWMutex
 	objects    map[gcsObjectKey]GCSObjectEntry
 	server     *httptest.Server
+
+	// uploads holds the resumable uploads in progress, by upload ID. It is
+	// guarded by objectsMut, as are the fields below.
+	uploads      map[string]*resumableUpload
+	nextUploadID int
+	// failChunks is the number of subsequent resumable upload chunks to fail.
+	failChunks int
+	// chunkRequests is the number of resumable upload chunk requests received,
+	// including failed ones.
+	chunkRequests int
+	// generations holds the generation of each object, which is incremented
+	// each time an object is written, so that writes may be made conditional on
+	// it with the ifGenerationMatch parameter.
+	generations    map[gcsObjectKey]int64
+	lastGeneration int64
+}
+
+type resumableUpload struct {
+	key         gcsObjectKey
+	contentType string
+	data        []byte
+	// ifGenerationMatch is the ifGenerationMatch parameter of the request
+	// starting the upload, which is checked once the upload completes.
+	ifGenerationMatch string
+	metadata          gcsObjectMetadata
 }
 
 // NewGCSServer creates a new GCS Server for use in tests.
 func NewGCSServer(t *testing.T) *GCSServer {
 	gs := &GCSServer{
-		t:          t,
-		objectsMut: &sync.RWMutex{},
-		objects:    map[gcsObjectKey]GCSObjectEntry{},
+		t:           t,
+		objectsMut:  &sync.RWMutex{},
+		objects:     map[gcsObjectKey]GCSObjectEntry{},
+		uploads:     map[string]*resumableUpload{},
+		generations: map[gcsObjectKey]int64{},
 	}
 	gs.server = httptest.NewServer(http.HandlerFunc(gs.handleHTTP))
 	t.Cleanup(func() {
@@ -68,7 +111,24 @@ func NewGCSServer(t *testing.T) *GCSServer {
 func (gs *GCSServer) AddObject(bucket, name string, obj GCSObjectEntry) {
 	gs.objectsMut.Lock()
 	defer gs.objectsMut.Unlock()
-	gs.objects[gcsObjectKey{bucket, name}] = obj
+	gs.putObject(gcsObjectKey{bucket, name}, obj)
+}
+
+// putObject stores an object with a new generation. objectsMut must be held.
+func (gs *GCSServer) putObject(key gcsObjectKey, obj GCSObjectEntry) {
+	gs.objects[key] = obj
+	gs.lastGeneration++
+	gs.generations[key] = gs.lastGeneration
+}
+
+// generationMatches returns whether the object meets an ifGenerationMatch
+// condition, which is met by any object if empty, and only by a missing object
+// if "0". objectsMut must be held.
+func (gs *GCSServer) generationMatches(key gcsObjectKey, ifGenerationMatch string) bool {
+	if ifGenerationMatch == "" {
+		return true
+	}
+	return ifGenerationMatch == fmt.Sprint(gs.generations[key])
 }
 
 // GetObject retrieves an object which has been uploaded to the server.
@@ -108,6 +168,22 @@ func (gs *GCSServer) URL() string {
 	return gs.server.URL
 }
 
+// FailUploadChunks causes the next n resumable upload chunk requests to fail
+// with a retryable error.
+func (gs *GCSServer) FailUploadChunks(n int) {
+	gs.objectsMut.Lock()
+	defer gs.objectsMut.Unlock()
+	gs.failChunks = n
+}
+
+// UploadChunkRequests returns the number of resumable upload chunk requests
+// received, including those failed by FailUploadChunks.
+func (gs *GCSServer) UploadChunkRequests() int {
+	gs.objectsMut.RLock()
+	defer gs.objectsMut.RUnlock()
+	return gs.chunkRequests
+}
+
 const uploadPathPrefix = "/upload/storage/v1/b/"
 
 // this should match for paths like:
@@ -115,9 +191,18 @@ const uploadPathPrefix = "/upload/storage/v1/b/"
 // /b/bucketName/o - list objects
 var listPathRegex = regexp.MustCompile(`^/b(?:/.*/o|)$`)
 
+// this should match the JSON API path of an object, as used by the compose
+// and delete calls, capturing the bucket and escaped object name:
+// /b/bucketName/o/objectName
+var objectPathRegex = regexp.MustCompile(`^/b/([^/]+)/o/([^/]+)$`)
+
 func (gs *GCSServer) handleHTTP(w http.ResponseWriter, req *http.Request) {
 	if strings.HasPrefix(req.URL.Path, uploadPathPrefix) {
 		gs.handleUpload(w, req)
+	} else if req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/compose") {
+		gs.handleCompose(w, req)
+	} else if req.Method == http.MethodDelete {
+		gs.handleDelete(w, req)
 	} else if listPathRegex.MatchString(req.URL.Path) {
 		gs.handleList(w, req)
 	} else {
@@ -198,16 +283,29 @@ func (gs *GCSServer) handleUpload(w http.ResponseWriter, req *http.Request) {
 	bucket := strings.Split(strings.TrimPrefix(req.URL.Path, uploadPathPrefix), "/")[0]
 	name := req.URL.Query().Get("name")
 
+	if req.URL.Query().Get("uploadType") == "resumable" {
+		if req.URL.Query().Get("upload_id") == "" {
+			gs.startResumableUpload(w, req, gcsObjectKey{bucket, name})
+		} else {
+			gs.handleUploadChunk(w, req)
+		}
+		return
+	}
+
 	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
 	if err != nil {
 		gs.t.Fatalf("failed to parse media type header: %v", err)
 	}
 	mr := multipart.NewReader(req.Body, params["boundary"])
 
-	// We ignore the first part, as we don't use the metadata.
-	if _, err := mr.NextPart(); err != nil {
+	mp, err := mr.NextPart()
+	if err != nil {
 		gs.t.Fatalf("failed to get first part from GCS upload request: %v", err)
 	}
+	var metadata gcsObjectMetadata
+	if err := json.NewDecoder(mp).Decode(&metadata); err != nil {
+		gs.t.Fatalf("failed to parse GCS upload metadata: %v", err)
+	}
 
 	p, err := mr.NextPart()
 	if err != nil {
@@ -217,18 +315,179 @@ func (gs *GCSServer) handleUpload(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		gs.t.Fatalf("failed to read GCS upload request body: %v", err)
 	}
-	gs.AddObject(bucket, name, GCSObjectEntry{
+	if _, err := mr.NextPart(); err != io.EOF {
+		gs.t.Error("expected exactly 2 parts in GCS upload request")
+	}
+
+	gs.objectsMut.Lock()
+	defer gs.objectsMut.Unlock()
+	key := gcsObjectKey{bucket, name}
+	if !gs.generationMatches(key, req.URL.Query().Get("ifGenerationMatch")) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	gs.putObject(key, GCSObjectEntry{
 		Data:        data,
 		ContentType: p.Header.Get("Content-Type"),
+		Retention:   metadata.Retention,
 	})
 
-	if _, err := mr.NextPart(); err != io.EOF {
-		gs.t.Error("expected exactly 2 parts in GCS upload request")
+	gs.writeObjectResource(w, key)
+}
+
+// startResumableUpload handles the request initiating a resumable upload,
+// returning the session URI to upload chunks to in the Location header.
+func (gs *GCSServer) startResumableUpload(w http.ResponseWriter, req *http.Request, key gcsObjectKey) {
+	var metadata gcsObjectMetadata
+	if err := json.NewDecoder(req.Body).Decode(&metadata); err != nil && err != io.EOF {
+		gs.t.Fatalf("failed to parse GCS upload metadata: %v", err)
+	}
+	gs.objectsMut.Lock()
+	defer gs.objectsMut.Unlock()
+	id := fmt.Sprintf("upload-%d", gs.nextUploadID)
+	gs.nextUploadID++
+	gs.uploads[id] = &resumableUpload{key: key, contentType: req.Header.Get("X-Upload-Content-Type"), ifGenerationMatch: req.URL.Query().Get("ifGenerationMatch"), metadata: metadata}
+	w.Header().Set("Location", fmt.Sprintf("%s%s%s/o?uploadType=resumable&upload_id=%s", gs.server.URL, uploadPathPrefix, key.bucket, id))
+	w.Write([]byte("{}"))
+}
+
+// handleUploadChunk handles a chunk of a resumable upload, of which the
+// Content-Range header is of the form "bytes <first>-<last>/<total or *>", or
+// "bytes */<total>" for an empty final chunk.
+func (gs *GCSServer) handleUploadChunk(w http.ResponseWriter, req *http.Request) {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		gs.t.Fatalf("failed to read GCS upload chunk: %v", err)
+	}
+
+	gs.objectsMut.Lock()
+	defer gs.objectsMut.Unlock()
+	gs.chunkRequests++
+	if gs.failChunks > 0 {
+		gs.failChunks--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
 	}
+	upload, ok := gs.uploads[req.URL.Query().Get("upload_id")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var first, last int
+	rangeSpec, total, _ := strings.Cut(strings.TrimPrefix(req.Header.Get("Content-Range"), "bytes "), "/")
+	if rangeSpec != "*" {
+		if _, err := fmt.Sscanf(rangeSpec, "%d-%d", &first, &last); err != nil {
+			gs.t.Fatalf("failed to parse Content-Range %q: %v", req.Header.Get("Content-Range"), err)
+		}
+		if first != len(upload.data) {
+			gs.t.Errorf("GCS upload chunk starts at byte %d, want %d", first, len(upload.data))
+		}
+		upload.data = append(upload.data[:first], data...)
+	}
+
+	if total == "*" || total != fmt.Sprint(len(upload.data)) {
+		// The client asks for 200 OK with this header rather than a 308 status,
+		// which the Go HTTP client treats as a redirect.
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.data)-1))
+		return
+	}
+	delete(gs.uploads, req.URL.Query().Get("upload_id"))
+	if !gs.generationMatches(upload.key, upload.ifGenerationMatch) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	gs.putObject(upload.key, GCSObjectEntry{Data: upload.data, ContentType: upload.contentType, Retention: upload.metadata.Retention})
+	gs.writeObjectResource(w, upload.key)
+}
+
+// writeObjectResource writes the response to a successful upload, which
+// includes the generation of the new object. objectsMut must be held.
+func (gs *GCSServer) writeObjectResource(w http.ResponseWriter, key gcsObjectKey) {
+	fmt.Fprintf(w, `{"bucket":%q,"name":%q,"generation":"%d"}`, key.bucket, key.name, gs.generations[key])
+}
 
+// objectKeyFromPath returns the object addressed by a JSON API path, which is
+// of the form /b/bucketName/o/objectName with the object name escaped.
+func (gs *GCSServer) objectKeyFromPath(escapedPath string) (gcsObjectKey, bool) {
+	m := objectPathRegex.FindStringSubmatch(escapedPath)
+	if m == nil {
+		return gcsObjectKey{}, false
+	}
+	name, err := url.PathUnescape(m[2])
+	if err != nil {
+		return gcsObjectKey{}, false
+	}
+	return gcsObjectKey{m[1], name}, true
+}
+
+// composeRequest holds the parts of a compose request body used by the test
+// server.
+type composeRequest struct {
+	SourceObjects []struct {
+		Name string
+	}
+}
+
+// handleCompose concatenates the source objects of the request into the
+// destination object, which may also be one of the sources.
+func (gs *GCSServer) handleCompose(w http.ResponseWriter, req *http.Request) {
+	dst, ok := gs.objectKeyFromPath(strings.TrimSuffix(req.URL.EscapedPath(), "/compose"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unrecognised compose endpoint %s", req.URL.Path)
+		return
+	}
+	var cr composeRequest
+	if err := json.NewDecoder(req.Body).Decode(&cr); err != nil {
+		gs.t.Fatalf("failed to decode GCS compose request: %v", err)
+	}
+	if len(cr.SourceObjects) > 32 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "too many source objects: %d", len(cr.SourceObjects))
+		return
+	}
+
+	gs.objectsMut.Lock()
+	defer gs.objectsMut.Unlock()
+	var composed GCSObjectEntry
+	for _, src := range cr.SourceObjects {
+		obj, ok := gs.objects[gcsObjectKey{dst.bucket, src.Name}]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "object %s not found", src.Name)
+			return
+		}
+		composed.Data = append(composed.Data, obj.Data...)
+		composed.ContentType = obj.ContentType
+	}
+	gs.putObject(dst, composed)
 	w.Write([]byte("{}"))
 }
 
+func (gs *GCSServer) handleDelete(w http.ResponseWriter, req *http.Request) {
+	key, ok := gs.objectKeyFromPath(req.URL.EscapedPath())
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unrecognised delete endpoint %s", req.URL.Path)
+		return
+	}
+	gs.objectsMut.Lock()
+	defer gs.objectsMut.Unlock()
+	if _, ok := gs.objects[key]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !gs.generationMatches(key, req.URL.Query().Get("ifGenerationMatch")) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	delete(gs.objects, key)
+	delete(gs.generations, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (gs *GCSServer) handleDownload(w http.ResponseWriter, req *http.Request) {
 	bucket, name, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
 
@@ -238,7 +497,11 @@ func (gs *GCSServer) handleDownload(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	object, ok := gs.GetObject(bucket, name)
+	gs.objectsMut.RLock()
+	key := gcsObjectKey{bucket, name}
+	object, ok := gs.objects[key]
+	generation := gs.generations[key]
+	gs.objectsMut.RUnlock()
 
 	if !ok {
 		w.WriteHeader(http.StatusNotFound)
@@ -247,6 +510,7 @@ func (gs *GCSServer) handleDownload(w http.ResponseWriter, req *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", object.ContentType)
+	w.Header().Set("X-Goog-Generation", fmt.Sprint(generation))
 
 	if _, err := w.Write(object.Data); err != nil {
 		gs.t.Log(err)
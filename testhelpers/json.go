@@ -16,7 +16,9 @@ package testhelpers
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -48,8 +50,9 @@ func NormalizeJSONString(t *testing.T, jsonIn string) string {
 }
 
 // ReadAllFHIRJSON reads all ndjsons in the output directory, extracts out the FHIR json for each
-// resource, and adds it to the output [][]byte. If normalize=true, then NormalizeJSON is applied to
-// the json bytes before being added to the output.
+// resource, and adds it to the output [][]byte. Gzip compressed .ndjson.gz files are decompressed.
+// If normalize=true, then NormalizeJSON is applied to the json bytes before being added to the
+// output.
 func ReadAllFHIRJSON(t *testing.T, outputDir string, normalize bool) [][]byte {
 	t.Helper()
 	files, err := os.ReadDir(outputDir)
@@ -60,7 +63,7 @@ func ReadAllFHIRJSON(t *testing.T, outputDir string, normalize bool) [][]byte {
 	fullData := make([][]byte, 0)
 
 	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".ndjson") {
+		if !strings.HasSuffix(file.Name(), ".ndjson") && !strings.HasSuffix(file.Name(), ".ndjson.gz") {
 			continue
 		}
 		fullPath := filepath.Join(outputDir, file.Name())
@@ -68,6 +71,7 @@ func ReadAllFHIRJSON(t *testing.T, outputDir string, normalize bool) [][]byte {
 		if err != nil {
 			t.Errorf("could not read %s: %v", fullPath, err)
 		}
+		gotData = maybeGunzip(t, fullPath, gotData)
 		dataLines := bytes.Split(gotData, []byte("\n"))
 
 		for _, line := range dataLines {
@@ -83,3 +87,20 @@ func ReadAllFHIRJSON(t *testing.T, outputDir string, normalize bool) [][]byte {
 	}
 	return fullData
 }
+
+// maybeGunzip decompresses the data if the file name has a .gz extension.
+func maybeGunzip(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+	if !strings.HasSuffix(name, ".gz") {
+		return data
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("could not decompress %s: %v", name, err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("could not decompress %s: %v", name, err)
+	}
+	return out
+}
@@ -0,0 +1,371 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testhelpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// KafkaRecord is a record produced to a KafkaServer.
+type KafkaRecord struct {
+	Topic     string
+	Partition int32
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+}
+
+// KafkaServer provides a minimal fake of a single Kafka broker for use in
+// tests. It supports the Metadata (v1), Produce (v3), SaslHandshake (v1) and
+// SaslAuthenticate (v0) requests, with SASL PLAIN authentication. Requests are
+// decoded and responses encoded with the franz-go kmsg package rather than the
+// kafka package's own encoding, and a test fails if a request is not encoded
+// byte for byte as kmsg encodes it.
+type KafkaServer struct {
+	t   *testing.T
+	lis net.Listener
+
+	mu              sync.Mutex
+	topics          map[string]int32
+	records         []KafkaRecord
+	produceRequests int
+	// failures are the error codes to fail the next produce requests with.
+	failures               []int16
+	saslUser, saslPassword string
+}
+
+// NewKafkaServer creates and starts a new KafkaServer, which is stopped at the
+// end of the test.
+func NewKafkaServer(t *testing.T) *KafkaServer {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ks := &KafkaServer{t: t, lis: lis, topics: map[string]int32{}}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		lis.Close()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ks.serve(c)
+			}()
+		}
+	}()
+	return ks
+}
+
+// Addr returns the host:port address of the broker.
+func (ks *KafkaServer) Addr() string {
+	return ks.lis.Addr().String()
+}
+
+// AddTopic creates a topic with the given number of partitions. Producing to
+// topics which have not been added fails with UNKNOWN_TOPIC_OR_PARTITION.
+func (ks *KafkaServer) AddTopic(name string, partitions int32) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.topics[name] = partitions
+}
+
+// RequireSASLPlain makes the broker require connections to authenticate with
+// SASL PLAIN, with the given username and password.
+func (ks *KafkaServer) RequireSASLPlain(username, password string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.saslUser, ks.saslPassword = username, password
+}
+
+// FailNext makes the next n produce requests fail with the Kafka error code,
+// for every partition.
+func (ks *KafkaServer) FailNext(code int16, n int) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for i := 0; i < n; i++ {
+		ks.failures = append(ks.failures, code)
+	}
+}
+
+// Records returns the records produced so far, in the order received.
+func (ks *KafkaServer) Records() []KafkaRecord {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return append([]KafkaRecord(nil), ks.records...)
+}
+
+// ProduceRequests returns the number of produce requests the broker has
+// handled.
+func (ks *KafkaServer) ProduceRequests() int {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.produceRequests
+}
+
+func (ks *KafkaServer) serve(c net.Conn) {
+	defer c.Close()
+	ks.mu.Lock()
+	authenticated := ks.saslUser == ""
+	ks.mu.Unlock()
+	r := bufio.NewReader(c)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		frame := make([]byte, 4+binary.BigEndian.Uint32(size[:]))
+		copy(frame, size[:])
+		if _, err := io.ReadFull(r, frame[4:]); err != nil {
+			return
+		}
+		req, correlationID, err := parseKafkaRequest(frame)
+		if err != nil {
+			ks.t.Errorf("Kafka server got invalid request: %v", err)
+			return
+		}
+
+		var resp kmsg.Response
+		switch req := req.(type) {
+		case *kmsg.SASLHandshakeRequest:
+			hr := kmsg.NewPtrSASLHandshakeResponse()
+			hr.SupportedMechanisms = []string{"PLAIN"}
+			if req.Mechanism != "PLAIN" {
+				hr.ErrorCode = 33 // UNSUPPORTED_SASL_MECHANISM
+			}
+			resp = hr
+		case *kmsg.SASLAuthenticateRequest:
+			ks.mu.Lock()
+			authenticated = string(req.SASLAuthBytes) == "\x00"+ks.saslUser+"\x00"+ks.saslPassword
+			ks.mu.Unlock()
+			ar := kmsg.NewPtrSASLAuthenticateResponse()
+			if !authenticated {
+				ar.ErrorCode = 58 // SASL_AUTHENTICATION_FAILED
+				ar.ErrorMessage = kmsg.StringPtr("invalid credentials")
+			}
+			resp = ar
+		case *kmsg.MetadataRequest:
+			if !authenticated {
+				ks.t.Errorf("Kafka server got request %d on an unauthenticated connection", req.Key())
+				return
+			}
+			resp = ks.metadata(req)
+		case *kmsg.ProduceRequest:
+			if !authenticated {
+				ks.t.Errorf("Kafka server got request %d on an unauthenticated connection", req.Key())
+				return
+			}
+			if resp, err = ks.produce(req); err != nil {
+				ks.t.Errorf("Kafka server got invalid produce request: %v", err)
+				return
+			}
+		}
+		resp.SetVersion(req.GetVersion())
+		out := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(correlationID))
+		out = resp.AppendTo(out)
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		if _, err := c.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// kafkaRequestVersions are the versions of the requests the KafkaServer
+// supports, by API key.
+var kafkaRequestVersions = map[int16]int16{0: 3, 3: 1, 17: 1, 36: 0}
+
+// parseKafkaRequest decodes a request frame, including its size, with the
+// franz-go kmsg package, so that requests are checked against an
+// implementation of the protocol other than the kafka package's own. The frame
+// must be exactly the encoding kmsg gives the decoded request.
+func parseKafkaRequest(frame []byte) (kmsg.Request, int32, error) {
+	if len(frame) < 14 {
+		return nil, 0, errors.New("truncated request header")
+	}
+	apiKey := int16(binary.BigEndian.Uint16(frame[4:]))
+	version := int16(binary.BigEndian.Uint16(frame[6:]))
+	correlationID := int32(binary.BigEndian.Uint32(frame[8:]))
+	if want, ok := kafkaRequestVersions[apiKey]; !ok || version != want {
+		return nil, 0, fmt.Errorf("unsupported request %d version %d", apiKey, version)
+	}
+	var clientID *string
+	offset := 14
+	if n := int16(binary.BigEndian.Uint16(frame[12:])); n >= 0 {
+		if offset+int(n) > len(frame) {
+			return nil, 0, errors.New("truncated request header")
+		}
+		id := string(frame[offset : offset+int(n)])
+		clientID, offset = &id, offset+int(n)
+	}
+
+	req := kmsg.RequestForKey(apiKey)
+	req.SetVersion(version)
+	if err := req.ReadFrom(frame[offset:]); err != nil {
+		return nil, 0, fmt.Errorf("request %d: %w", apiKey, err)
+	}
+	var opts []kmsg.RequestFormatterOpt
+	if clientID != nil {
+		opts = append(opts, kmsg.FormatterClientID(*clientID))
+	}
+	if want := kmsg.NewRequestFormatter(opts...).AppendRequest(nil, req, correlationID); !bytes.Equal(frame, want) {
+		return nil, 0, fmt.Errorf("request %d is not encoded as kmsg encodes it:\n got %x\nwant %x", apiKey, frame, want)
+	}
+	return req, correlationID, nil
+}
+
+func (ks *KafkaServer) metadata(req *kmsg.MetadataRequest) *kmsg.MetadataResponse {
+	host, port, _ := net.SplitHostPort(ks.Addr())
+	portNum, _ := strconv.Atoi(port)
+	resp := kmsg.NewPtrMetadataResponse()
+	resp.Brokers = []kmsg.MetadataResponseBroker{{NodeID: 0, Host: host, Port: int32(portNum)}}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for _, rt := range req.Topics {
+		t := kmsg.NewMetadataResponseTopic()
+		t.Topic = rt.Topic
+		partitions, ok := ks.topics[*rt.Topic]
+		if !ok {
+			t.ErrorCode = 3 // UNKNOWN_TOPIC_OR_PARTITION
+		}
+		for p := int32(0); p < partitions; p++ {
+			tp := kmsg.NewMetadataResponseTopicPartition()
+			tp.Partition, tp.Leader = p, 0
+			tp.Replicas, tp.ISR = []int32{0}, []int32{0}
+			t.Partitions = append(t.Partitions, tp)
+		}
+		resp.Topics = append(resp.Topics, t)
+	}
+	return resp
+}
+
+func (ks *KafkaServer) produce(req *kmsg.ProduceRequest) (*kmsg.ProduceResponse, error) {
+	if req.Acks != -1 {
+		return nil, errors.New("produce request does not require acks from all replicas")
+	}
+	resp := kmsg.NewPtrProduceResponse()
+	var produced []KafkaRecord
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.produceRequests++
+	var failure int16
+	if len(ks.failures) > 0 {
+		failure, ks.failures = ks.failures[0], ks.failures[1:]
+	}
+	for _, rt := range req.Topics {
+		t := kmsg.NewProduceResponseTopic()
+		t.Topic = rt.Topic
+		for _, rp := range rt.Partitions {
+			records, err := decodeKafkaRecordBatch(rp.Records)
+			if err != nil {
+				return nil, err
+			}
+			code := failure
+			if partitions, ok := ks.topics[rt.Topic]; code == 0 && (!ok || rp.Partition >= partitions) {
+				code = 3 // UNKNOWN_TOPIC_OR_PARTITION
+			}
+			if code == 0 {
+				for _, r := range records {
+					r.Topic, r.Partition = rt.Topic, rp.Partition
+					produced = append(produced, r)
+				}
+			}
+			p := kmsg.NewProduceResponseTopicPartition()
+			p.Partition, p.ErrorCode, p.LogAppendTime = rp.Partition, code, -1
+			t.Partitions = append(t.Partitions, p)
+		}
+		resp.Topics = append(resp.Topics, t)
+	}
+	ks.records = append(ks.records, produced...)
+	return resp, nil
+}
+
+// decodeKafkaRecordBatch decodes a record batch of magic version 2 with kmsg,
+// checking its length, CRC and that each record is encoded as kmsg encodes it.
+func decodeKafkaRecordBatch(b []byte) ([]KafkaRecord, error) {
+	var batch kmsg.RecordBatch
+	if err := batch.ReadFrom(b); err != nil {
+		return nil, fmt.Errorf("record batch: %w", err)
+	}
+	if batch.Magic != 2 {
+		return nil, errors.New("record batch is not magic version 2")
+	}
+	if !bytes.Equal(batch.AppendTo(nil), b) {
+		return nil, errors.New("record batch is not encoded as kmsg encodes it")
+	}
+	// The length counts the bytes after it, the CRC those after the CRC.
+	if int(batch.Length) != len(b)-12 {
+		return nil, errors.New("record batch length does not match its size")
+	}
+	if crc32.Checksum(b[21:], crc32.MakeTable(crc32.Castagnoli)) != uint32(batch.CRC) {
+		return nil, errors.New("record batch CRC does not match")
+	}
+
+	var records []KafkaRecord
+	rest := batch.Records
+	for i := int32(0); i < batch.NumRecords; i++ {
+		length, n := binary.Varint(rest)
+		if n <= 0 || int(length) > len(rest)-n {
+			return nil, errors.New("truncated record")
+		}
+		var rec kmsg.Record
+		if err := rec.ReadFrom(rest[:n+int(length)]); err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		if !bytes.Equal(rec.AppendTo(nil), rest[:n+int(length)]) {
+			return nil, fmt.Errorf("record %d is not encoded as kmsg encodes it", i)
+		}
+		if rec.OffsetDelta != i {
+			return nil, fmt.Errorf("record %d has offset delta %d", i, rec.OffsetDelta)
+		}
+		rest = rest[n+int(length):]
+		r := KafkaRecord{Key: rec.Key, Value: rec.Value}
+		if len(rec.Headers) > 0 {
+			r.Headers = map[string]string{}
+			for _, h := range rec.Headers {
+				r.Headers[h.Key] = string(h.Value)
+			}
+		}
+		records = append(records, r)
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("record batch has trailing bytes")
+	}
+	if batch.LastOffsetDelta != batch.NumRecords-1 {
+		return nil, fmt.Errorf("record batch has last offset delta %d for %d records", batch.LastOffsetDelta, batch.NumRecords)
+	}
+	return records, nil
+}
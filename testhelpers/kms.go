@@ -0,0 +1,128 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testhelpers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// kmsCiphertextPrefix is prepended to plaintexts by the KMSServer in place of
+// encrypting them.
+const kmsCiphertextPrefix = "kms-wrapped:"
+
+// KMSServer provides a minimal fake of the Cloud KMS API for use in tests,
+// supporting encrypt and decrypt requests for a single CryptoKey. It does not
+// really encrypt: ciphertexts are the plaintext with a fixed prefix.
+type KMSServer struct {
+	t       *testing.T
+	server  *httptest.Server
+	keyName string
+
+	mu                         sync.Mutex
+	encryptCalls, decryptCalls int
+}
+
+// NewKMSServer creates a new KMSServer for the CryptoKey with the given
+// resource name. The server is closed at the end of the test.
+func NewKMSServer(t *testing.T, keyName string) *KMSServer {
+	ks := &KMSServer{t: t, keyName: keyName}
+	ks.server = httptest.NewServer(http.HandlerFunc(ks.handleHTTP))
+	t.Cleanup(ks.server.Close)
+	return ks
+}
+
+// URL returns the endpoint to use in the KMS client.
+func (ks *KMSServer) URL() string {
+	return ks.server.URL + "/"
+}
+
+// EncryptCalls returns the number of encrypt requests the server has handled.
+func (ks *KMSServer) EncryptCalls() int {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.encryptCalls
+}
+
+// DecryptCalls returns the number of decrypt requests the server has handled.
+func (ks *KMSServer) DecryptCalls() int {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.decryptCalls
+}
+
+func kmsChecksum(data []byte) string {
+	return fmt.Sprint(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+func (ks *KMSServer) handleHTTP(w http.ResponseWriter, req *http.Request) {
+	name, method, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/v1/"), ":")
+	if !ok || name != ks.keyName || req.Method != http.MethodPost {
+		ks.t.Errorf("KMS server got unexpected request %s %s", req.Method, req.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ks.t.Errorf("KMS server could not decode request body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	switch method {
+	case "encrypt":
+		ks.encryptCalls++
+		plaintext, err := base64.StdEncoding.DecodeString(body.Plaintext)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ciphertext := append([]byte(kmsCiphertextPrefix), plaintext...)
+		json.NewEncoder(w).Encode(map[string]any{
+			"name":                    ks.keyName + "/cryptoKeyVersions/1",
+			"ciphertext":              base64.StdEncoding.EncodeToString(ciphertext),
+			"ciphertextCrc32c":        kmsChecksum(ciphertext),
+			"verifiedPlaintextCrc32c": true,
+		})
+	case "decrypt":
+		ks.decryptCalls++
+		ciphertext, err := base64.StdEncoding.DecodeString(body.Ciphertext)
+		if err != nil || !bytes.HasPrefix(ciphertext, []byte(kmsCiphertextPrefix)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		plaintext := ciphertext[len(kmsCiphertextPrefix):]
+		json.NewEncoder(w).Encode(map[string]any{
+			"plaintext":       base64.StdEncoding.EncodeToString(plaintext),
+			"plaintextCrc32c": kmsChecksum(plaintext),
+		})
+	default:
+		ks.t.Errorf("KMS server got unexpected method %q", method)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
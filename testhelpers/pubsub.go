@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testhelpers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// PubSubMessage is a message published to a PubSubServer.
+type PubSubMessage struct {
+	Data       []byte
+	Attributes map[string]string
+}
+
+// PubSubServer provides a minimal fake of the Pub/Sub API for use in tests,
+// supporting publish requests to a single topic.
+type PubSubServer struct {
+	t      *testing.T
+	server *httptest.Server
+	topic  string
+
+	mu           sync.Mutex
+	messages     []PubSubMessage
+	publishCalls int
+	// failures is the number of publish requests to fail before succeeding.
+	failures int
+}
+
+// NewPubSubServer creates a new PubSubServer for the topic with the given
+// resource name. The server is closed at the end of the test.
+func NewPubSubServer(t *testing.T, topic string) *PubSubServer {
+	ps := &PubSubServer{t: t, topic: topic}
+	ps.server = httptest.NewServer(http.HandlerFunc(ps.handleHTTP))
+	t.Cleanup(ps.server.Close)
+	return ps
+}
+
+// URL returns the endpoint to use in the Pub/Sub client.
+func (ps *PubSubServer) URL() string {
+	return ps.server.URL + "/"
+}
+
+// Messages returns the messages published so far, in the order received.
+func (ps *PubSubServer) Messages() []PubSubMessage {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return append([]PubSubMessage(nil), ps.messages...)
+}
+
+// PublishCalls returns the number of publish requests the server has handled.
+func (ps *PubSubServer) PublishCalls() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.publishCalls
+}
+
+// FailNext makes the next n publish requests fail with a non-retryable error.
+func (ps *PubSubServer) FailNext(n int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.failures = n
+}
+
+func (ps *PubSubServer) handleHTTP(w http.ResponseWriter, req *http.Request) {
+	name, method, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/v1/"), ":")
+	if !ok || name != ps.topic || method != "publish" || req.Method != http.MethodPost {
+		ps.t.Errorf("Pub/Sub server got unexpected request %s %s", req.Method, req.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Messages []struct {
+			Data       string            `json:"data"`
+			Attributes map[string]string `json:"attributes"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ps.t.Errorf("Pub/Sub server could not decode request body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.publishCalls++
+	if ps.failures > 0 {
+		ps.failures--
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var ids []string
+	for _, m := range body.Messages {
+		msg := PubSubMessage{Attributes: m.Attributes}
+		if m.Data != "" {
+			data, err := base64.StdEncoding.DecodeString(m.Data)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			msg.Data = data
+		}
+		ps.messages = append(ps.messages, msg)
+		ids = append(ids, fmt.Sprint(len(ps.messages)))
+	}
+	json.NewEncoder(w).Encode(map[string]any{"messageIds": ids})
+}
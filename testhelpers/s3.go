@@ -0,0 +1,217 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testhelpers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Note: this is tested in s3/s3_test.go
+
+type s3ObjectKey struct {
+	bucket, name string
+}
+
+// S3Server provides a minimal implementation of the path style S3 REST API
+// for use in tests: putting objects, conditionally on their ETag with the
+// If-Match and If-None-Match headers, multipart uploads and getting objects.
+// Requests are not authenticated.
+type S3Server struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[s3ObjectKey][]byte
+	// uploads holds the parts of the multipart uploads in progress, by upload
+	// ID and part number.
+	uploads      map[string]map[int][]byte
+	nextUploadID int
+	// partRequests is the number of multipart upload parts received.
+	partRequests int
+	server       *httptest.Server
+}
+
+// NewS3Server creates a new S3 Server for use in tests.
+func NewS3Server(t *testing.T) *S3Server {
+	s := &S3Server{
+		t:       t,
+		objects: map[s3ObjectKey][]byte{},
+		uploads: map[string]map[int][]byte{},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handleHTTP))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// URL returns the URL of the S3 server, to use as the endpoint of clients.
+func (s *S3Server) URL() string {
+	return s.server.URL
+}
+
+// AddObject adds an object to be served by the S3 server.
+func (s *S3Server) AddObject(bucket, name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[s3ObjectKey{bucket, name}] = data
+}
+
+// GetObject retrieves an object which has been uploaded to the server.
+func (s *S3Server) GetObject(bucket, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[s3ObjectKey{bucket, name}]
+	return data, ok
+}
+
+// GetAllPaths returns the s3:// paths of all objects held by the server,
+// sorted.
+func (s *S3Server) GetAllPaths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var paths []string
+	for key := range s.objects {
+		paths = append(paths, fmt.Sprintf("s3://%s/%s", key.bucket, key.name))
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// PartRequests returns the number of multipart upload parts received.
+func (s *S3Server) PartRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.partRequests
+}
+
+// s3ETag returns the ETag of an object with the given content.
+func s3ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func (s *S3Server) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(s3Error{Code: code, Message: code})
+}
+
+func (s *S3Server) handleHTTP(w http.ResponseWriter, req *http.Request) {
+	bucket, name, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if !ok || name == "" {
+		s.t.Errorf("unsupported S3 request path %s", req.URL.Path)
+		s.writeError(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+	key := s3ObjectKey{bucket, name}
+	query := req.URL.Query()
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		s.t.Errorf("failed to read S3 request body: %v", err)
+		s.writeError(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case req.Method == http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", s3ETag(data))
+		w.Write(data)
+	case req.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		parts[n] = body
+		s.partRequests++
+		w.Header().Set("ETag", s3ETag(body))
+	case req.Method == http.MethodPut:
+		existing, exists := s.objects[key]
+		if req.Header.Get("If-None-Match") == "*" && exists {
+			s.writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if ifMatch := req.Header.Get("If-Match"); ifMatch != "" && (!exists || ifMatch != s3ETag(existing)) {
+			s.writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		s.objects[key] = body
+		w.Header().Set("ETag", s3ETag(body))
+	case req.Method == http.MethodPost && query.Has("uploads"):
+		id := fmt.Sprintf("upload-%d", s.nextUploadID)
+		s.nextUploadID++
+		s.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, name, id)
+	case req.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		slices.Sort(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		s.objects[key] = data
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>", bucket, name, s3ETag(data))
+	case req.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.t.Errorf("unsupported S3 request %s %s", req.Method, req.URL)
+		s.writeError(w, http.StatusBadRequest, "InvalidRequest")
+	}
+}
+
+// SetFakeAWSCredentials sets the environment variables read by the default AWS
+// credential chain to fake credentials for the duration of the test, so that
+// clients of an S3Server do not look for real ones.
+func SetFakeAWSCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "fake-access-key-id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "fake-secret-access-key")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+}
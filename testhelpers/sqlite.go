@@ -0,0 +1,179 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testhelpers
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+// ReadSQLiteTable reads the columns and rows of a table from a SQLite
+// database file, in row ID order. Integers are returned as int64, reals as
+// float64, text as string and blobs as []byte. Only the parts of the file
+// format needed to read tables are supported, which is enough to check the
+// databases written by the sqlite package without depending on SQLite.
+func ReadSQLiteTable(t *testing.T, path, table string) (columns []string, rows [][]any) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read SQLite database: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "SQLite format 3\x00") {
+		t.Fatalf("%s is not a SQLite database", path)
+	}
+	r := &sqliteReader{t: t, data: data, pageSize: int(binary.BigEndian.Uint16(data[16:]))}
+	if r.pageSize == 1 {
+		r.pageSize = 65536
+	}
+	for _, schema := range r.readTree(1) {
+		if schema[0] != "table" || schema[1] != table {
+			continue
+		}
+		// The columns are between the brackets of the CREATE TABLE statement,
+		// each a quoted name followed by a type.
+		sql := schema[4].(string)
+		defs := sql[strings.Index(sql, "(")+1 : strings.LastIndex(sql, ")")]
+		for _, def := range strings.Split(defs, ",") {
+			name := strings.Fields(strings.TrimSpace(def))[0]
+			columns = append(columns, strings.ReplaceAll(strings.Trim(name, `"`), `""`, `"`))
+		}
+		return columns, r.readTree(int(schema[3].(int64)))
+	}
+	t.Fatalf("table %s not found in %s", table, path)
+	return nil, nil
+}
+
+type sqliteReader struct {
+	t        *testing.T
+	data     []byte
+	pageSize int
+}
+
+func (r *sqliteReader) page(n int) []byte {
+	if n < 1 || n*r.pageSize > len(r.data) {
+		r.t.Fatalf("SQLite page %d is out of range", n)
+	}
+	return r.data[(n-1)*r.pageSize : n*r.pageSize]
+}
+
+// readTree returns the records of the leaves of the table b-tree rooted at
+// root.
+func (r *sqliteReader) readTree(root int) [][]any {
+	p := r.page(root)
+	header := 0
+	if root == 1 {
+		header = 100
+	}
+	cells := int(binary.BigEndian.Uint16(p[header+3:]))
+	var rows [][]any
+	switch p[header] {
+	case 0x05:
+		for i := 0; i < cells; i++ {
+			ptr := int(binary.BigEndian.Uint16(p[header+12+2*i:]))
+			rows = append(rows, r.readTree(int(binary.BigEndian.Uint32(p[ptr:])))...)
+		}
+		return append(rows, r.readTree(int(binary.BigEndian.Uint32(p[header+8:])))...)
+	case 0x0d:
+		for i := 0; i < cells; i++ {
+			ptr := int(binary.BigEndian.Uint16(p[header+8+2*i:]))
+			rows = append(rows, r.readRecord(r.readPayload(p[ptr:])))
+		}
+		return rows
+	}
+	r.t.Fatalf("SQLite page %d has unsupported type %#x", root, p[header])
+	return nil
+}
+
+// readPayload returns the payload of a table leaf cell, following its
+// overflow pages.
+func (r *sqliteReader) readPayload(cell []byte) []byte {
+	size, n := sqliteVarint(cell)
+	_, m := sqliteVarint(cell[n:])
+	cell = cell[n+m:]
+	usable := r.pageSize
+	maxLocal := usable - 35
+	if int(size) <= maxLocal {
+		return cell[:size]
+	}
+	minLocal := (usable-12)*32/255 - 23
+	local := minLocal + (int(size)-minLocal)%(usable-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	payload := append([]byte{}, cell[:local]...)
+	next := int(binary.BigEndian.Uint32(cell[local:]))
+	for len(payload) < int(size) {
+		p := r.page(next)
+		n := min(int(size)-len(payload), usable-4)
+		payload = append(payload, p[4:4+n]...)
+		next = int(binary.BigEndian.Uint32(p))
+	}
+	return payload
+}
+
+// readRecord decodes a record into its values.
+func (r *sqliteReader) readRecord(record []byte) []any {
+	headerSize, n := sqliteVarint(record)
+	header := record[n:headerSize]
+	body := record[headerSize:]
+	var values []any
+	for len(header) > 0 {
+		serialType, n := sqliteVarint(header)
+		header = header[n:]
+		switch {
+		case serialType == 0:
+			values = append(values, nil)
+		case serialType >= 1 && serialType <= 6:
+			size := []int{0, 1, 2, 3, 4, 6, 8}[serialType]
+			v := int64(int8(body[0]))
+			for _, b := range body[1:size] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+			body = body[size:]
+		case serialType == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(body)))
+			body = body[8:]
+		case serialType == 8, serialType == 9:
+			values = append(values, int64(serialType-8))
+		case serialType >= 12 && serialType%2 == 0:
+			size := int(serialType-12) / 2
+			values = append(values, append([]byte{}, body[:size]...))
+			body = body[size:]
+		case serialType >= 13:
+			size := int(serialType-13) / 2
+			values = append(values, string(body[:size]))
+			body = body[size:]
+		default:
+			r.t.Fatalf("unsupported SQLite serial type %d", serialType)
+		}
+	}
+	return values
+}
+
+// sqliteVarint decodes a SQLite varint, returning its value and length.
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v<<8 | uint64(b[8]), 9
+}